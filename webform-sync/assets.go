@@ -0,0 +1,10 @@
+// Package webformsync holds files shipped with the service that the binary
+// also needs at run time
+package webformsync
+
+import _ "embed"
+
+// DefaultConfig is the commented example config, webform-sync.yml
+//
+//go:embed webform-sync.yml
+var DefaultConfig []byte
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// backupRun is the body of POST /admin/backup/now
+type backupRun struct {
+	File    string `json:"file"`
+	Bytes   int64  `json:"bytes"`
+	SHA256  string `json:"sha256"`
+	Remotes []struct {
+		Remote string `json:"remote"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	} `json:"remotes"`
+}
+
+// cleanupResult is the body of POST /sync/cleanup
+type cleanupResult struct {
+	Exempted int `json:"exempted_count"`
+	Presets  []struct {
+		ID            string     `json:"id"`
+		Name          string     `json:"name"`
+		DeviceID      string     `json:"deviceId"`
+		LastUsed      *time.Time `json:"lastUsed"`
+		RetentionDays int        `json:"retentionDays"`
+	} `json:"presets"`
+}
+
+// runBackupNow backs up the database and waits until the backup is verified
+func runBackupNow(c *client, args []string) int {
+	flags := flag.NewFlagSet("backup now", flag.ContinueOnError)
+	if code, ok := parseFlags(flags, args, "backup now", 0); !ok {
+		return code
+	}
+
+	var run backupRun
+	resp, err := c.call("POST", "/admin/backup/now", nil, nil, &run)
+	if err != nil {
+		return fail("back up", err)
+	}
+	if c.json {
+		printJSON(resp.Data)
+		return 0
+	}
+
+	fmt.Printf("Backed up to %s (%d bytes)\nSHA-256: %s\n", run.File, run.Bytes, run.SHA256)
+	code := 0
+	for _, remote := range run.Remotes {
+		if remote.Error != "" {
+			fmt.Printf("  %s: %s: %s\n", remote.Remote, remote.Status, remote.Error)
+			code = 1
+		} else {
+			fmt.Printf("  %s: %s\n", remote.Remote, remote.Status)
+		}
+	}
+	return code
+}
+
+// runCleanup removes presets unused for a number of days, or with -dry-run
+// lists them
+func runCleanup(c *client, args []string) int {
+	flags := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	days := flags.Int("days", 90, "remove presets unused for this many days; retention rules still apply")
+	dryRun := flags.Bool("dry-run", false, "list the presets that would be removed without removing them")
+	if code, ok := parseFlags(flags, args, "cleanup [-days n] [-dry-run]", 0); !ok {
+		return code
+	}
+
+	query := url.Values{"days": {strconv.Itoa(*days)}, "dry_run": {strconv.FormatBool(*dryRun)}}
+	var result cleanupResult
+	resp, err := c.call("POST", "/sync/cleanup", query, nil, &result)
+	if err != nil {
+		return fail("clean up", err)
+	}
+	if c.json {
+		printJSON(resp.Data)
+		return 0
+	}
+
+	if len(result.Presets) > 0 {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tDEVICE\tLAST USED\tKEPT FOR")
+		for _, p := range result.Presets {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d days\n", p.ID, p.Name, p.DeviceID, formatTime(p.LastUsed), p.RetentionDays)
+		}
+		tw.Flush()
+	}
+	fmt.Printf("%s; %d exempt\n", resp.Message, result.Exempted)
+	return 0
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// client calls the service's API as the admin
+type client struct {
+	// base is the API root, such as http://localhost:8765/api/v1
+	base  string
+	token string
+	http  *http.Client
+	// json prints responses as JSON rather than tables
+	json bool
+}
+
+// apiResponse is the envelope every API response comes in
+type apiResponse struct {
+	Success   bool            `json:"success"`
+	Data      json.RawMessage `json:"data"`
+	Error     string          `json:"error"`
+	Message   string          `json:"message"`
+	RequestID string          `json:"requestId"`
+}
+
+// apiError is a response the service refused or failed
+type apiError struct {
+	Status    int
+	Message   string
+	RequestID string
+}
+
+func (e *apiError) Error() string {
+	msg := fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// newClient creates a client for the service at server, an http(s) URL or
+// unix:///path for its Unix socket
+func newClient(server, token string) (*client, error) {
+	c := &client{token: token, http: &http.Client{}}
+
+	if path, ok := strings.CutPrefix(server, "unix://"); ok {
+		c.base = "http://localhost/api/v1"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		return c, nil
+	}
+
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http(s) or unix:// address", server)
+	}
+	c.base = strings.TrimSuffix(u.String(), "/") + "/api/v1"
+	return c, nil
+}
+
+// do sends a request and returns the response, which is the caller's to
+// close. Responses other than 2xx are returned as an *apiError.
+func (c *client) do(method, path string, query url.Values, body io.Reader, header http.Header) (*http.Response, error) {
+	target := c.base + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	apiErr := &apiError{Status: resp.StatusCode}
+	var envelope apiResponse
+	if json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&envelope) == nil && envelope.Error != "" {
+		apiErr.Message = envelope.Error
+		apiErr.RequestID = envelope.RequestID
+	} else {
+		apiErr.Message = "unexpected response from the service"
+	}
+	return nil, apiErr
+}
+
+// call sends a request with an optional JSON body and decodes the data of
+// the response into out, if it isn't nil. It returns the response, for its
+// message and raw data.
+func (c *client) call(method, path string, query url.Values, in, out interface{}) (*apiResponse, error) {
+	var body io.Reader
+	header := http.Header{}
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+		header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.do(method, path, query, body, header)
+	if err != nil {
+		return nil, err
+	}
+	return decode(resp, out)
+}
+
+// decode reads a response's envelope, filling out with its data, and
+// closes it
+func decode(resp *http.Response, out interface{}) (*apiResponse, error) {
+	defer resp.Body.Close()
+
+	var envelope apiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("failed to read the response: %w", err)
+	}
+	if out != nil && len(envelope.Data) > 0 {
+		if err := json.Unmarshal(envelope.Data, out); err != nil {
+			return nil, fmt.Errorf("failed to read the response: %w", err)
+		}
+	}
+	return &envelope, nil
+}
+
+// printJSON writes v, such as a response's data, indented to stdout
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// fail reports a failed command and returns its exit code
+func fail(what string, err error) int {
+	fmt.Fprintf(os.Stderr, "Failed to %s: %v\n", what, err)
+	return 1
+}
+
+// formatTime shows a time in the local zone to the minute, or "-" for none
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// device holds the fields of a device that presetsctl shows
+type device struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Platform  string     `json:"platform"`
+	Browser   string     `json:"browser"`
+	LastSeen  time.Time  `json:"lastSeen"`
+	RevokedAt *time.Time `json:"revokedAt"`
+	UserID    string     `json:"userId"`
+}
+
+// runDevicesList lists the registered devices
+func runDevicesList(c *client, args []string) int {
+	flags := flag.NewFlagSet("devices list", flag.ContinueOnError)
+	if code, ok := parseFlags(flags, args, "devices list", 0); !ok {
+		return code
+	}
+
+	var devices []device
+	resp, err := c.call("GET", "/devices", nil, nil, &devices)
+	if err != nil {
+		return fail("list devices", err)
+	}
+
+	if c.json {
+		printJSON(resp.Data)
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPLATFORM\tBROWSER\tUSER\tLAST SEEN\tREVOKED")
+	for _, d := range devices {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", d.ID, d.Name, d.Platform, d.Browser, orDash(d.UserID), formatTime(&d.LastSeen), formatTime(d.RevokedAt))
+	}
+	tw.Flush()
+	return 0
+}
+
+// runDevicesRevoke blocks a device from making further requests
+func runDevicesRevoke(c *client, args []string) int {
+	flags := flag.NewFlagSet("devices revoke", flag.ContinueOnError)
+	if code, ok := parseFlags(flags, args, "devices revoke <device-id>", 1); !ok {
+		return code
+	}
+	id := flags.Arg(0)
+
+	var d device
+	resp, err := c.call("POST", "/devices/"+url.PathEscape(id)+"/revoke", nil, nil, &d)
+	if err != nil {
+		return fail("revoke "+id, err)
+	}
+	if c.json {
+		printJSON(resp.Data)
+		return 0
+	}
+	fmt.Printf("Revoked %s (%s) at %s\n", d.ID, d.Name, formatTime(d.RevokedAt))
+	return 0
+}
+
+// runTokensCreate creates a user with an API token, or issues a new token
+// for an existing user, replacing the old one
+func runTokensCreate(c *client, args []string) int {
+	flags := flag.NewFlagSet("tokens create", flag.ContinueOnError)
+	userID := flags.String("user", "", "issue a new token for this existing user; their old token stops working")
+	if code, ok := parseFlags(flags, args, "tokens create <user-name> | -user <user-id>", -1); !ok {
+		return code
+	}
+	if (*userID == "") != (flags.NArg() == 1) || flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	var issued struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Token string `json:"token"`
+	}
+	var resp *apiResponse
+	var err error
+	if *userID != "" {
+		resp, err = c.call("POST", "/users/"+url.PathEscape(*userID)+"/token", nil, nil, &issued)
+	} else {
+		resp, err = c.call("POST", "/users", nil, map[string]string{"name": flags.Arg(0)}, &issued)
+	}
+	if err != nil {
+		return fail("create a token", err)
+	}
+
+	if c.json {
+		printJSON(resp.Data)
+		return 0
+	}
+	// The token alone goes to stdout, so it can be piped into a file or a
+	// secret store
+	if issued.Name != "" {
+		fmt.Fprintf(os.Stderr, "Created user %s (%s). Store the token now; it is not shown again.\n", issued.Name, issued.ID)
+	} else {
+		fmt.Fprintf(os.Stderr, "Issued a new token for user %s; the old one no longer works. Store it now; it is not shown again.\n", issued.ID)
+	}
+	fmt.Println(issued.Token)
+	return 0
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
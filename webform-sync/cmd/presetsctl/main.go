@@ -0,0 +1,152 @@
+// Command presetsctl manages a webform-sync service through its API, so a
+// headless server can be looked after over SSH without hand-written curl
+// calls. It authenticates with the admin token.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Set at build time with -ldflags (see Makefile)
+var (
+	Version   = "1.0.0"
+	BuildTime = "unknown"
+)
+
+// command runs one subcommand with its own arguments and returns the
+// process exit code
+type command func(c *client, args []string) int
+
+var commands = map[string]command{
+	"presets list":   runPresetsList,
+	"presets export": runPresetsExport,
+	"presets import": runPresetsImport,
+	"devices list":   runDevicesList,
+	"devices revoke": runDevicesRevoke,
+	"tokens create":  runTokensCreate,
+	"backup now":     runBackupNow,
+	"cleanup":        runCleanup,
+}
+
+const usage = `Usage: presetsctl [flags] <command> [command flags]
+
+Commands:
+  presets list     [-device id]
+  presets export   [-format json|ndjson|csv] [-device id] [-passphrase-file path] [-o path]
+  presets import   [-format name] [-conflict skip|overwrite|rename] [-device id] [-dry-run] [-passphrase-file path] <file | ->
+  devices list
+  devices revoke   <device-id>
+  tokens create    <user-name> | -user <user-id>
+  backup now
+  cleanup          [-days n] [-dry-run]
+
+Run "presetsctl <command> -h" for a command's flags.
+
+Flags:`
+
+func main() {
+	flags := flag.NewFlagSet("presetsctl", flag.ContinueOnError)
+	server := flags.String("server", envOr("PRESETSCTL_SERVER", "http://localhost:8765"), "the service's address, or unix:///path for its socket ($PRESETSCTL_SERVER)")
+	token := flags.String("token", "", "the admin token; prefer -token-file or $PRESETSCTL_TOKEN, which stay out of the process list")
+	tokenFile := flags.String("token-file", os.Getenv("PRESETSCTL_TOKEN_FILE"), "read the admin token from this file ($PRESETSCTL_TOKEN_FILE)")
+	jsonOutput := flags.Bool("json", false, "print the API's data as JSON instead of a table")
+	showVersion := flags.Bool("version", false, "print the version and exit")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+
+	if *showVersion {
+		fmt.Printf("presetsctl %s (built %s)\n", Version, BuildTime)
+		return
+	}
+
+	run, args, ok := lookup(flags.Args())
+	if !ok {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	secret, err := adminToken(*token, *tokenFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the token: %v\n", err)
+		os.Exit(1)
+	}
+	c, err := newClient(*server, secret)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -server: %v\n", err)
+		os.Exit(2)
+	}
+	c.json = *jsonOutput
+	os.Exit(run(c, args))
+}
+
+// lookup finds the command named by the first one or two arguments
+func lookup(args []string) (command, []string, bool) {
+	if len(args) == 0 {
+		return nil, nil, false
+	}
+	if run, ok := commands[args[0]]; ok {
+		return run, args[1:], true
+	}
+	if len(args) > 1 {
+		if run, ok := commands[args[0]+" "+args[1]]; ok {
+			return run, args[2:], true
+		}
+	}
+	return nil, nil, false
+}
+
+// adminToken returns the token from -token, -token-file or $PRESETSCTL_TOKEN,
+// in that order
+func adminToken(token, tokenFile string) (string, error) {
+	switch {
+	case token != "":
+		return token, nil
+	case tokenFile != "":
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	default:
+		return os.Getenv("PRESETSCTL_TOKEN"), nil
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// parseFlags parses a command's flags, returning the exit code to stop
+// with if it shouldn't go on
+func parseFlags(flags *flag.FlagSet, args []string, usage string, nargs int) (int, bool) {
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: presetsctl "+usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0, false
+		}
+		return 2, false
+	}
+	if nargs >= 0 && flags.NArg() != nargs {
+		flags.Usage()
+		return 2, false
+	}
+	return 0, true
+}
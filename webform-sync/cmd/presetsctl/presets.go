@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// preset holds the fields of a preset that presetsctl shows
+type preset struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	ScopeType  string     `json:"scopeType"`
+	ScopeValue string     `json:"scopeValue"`
+	DeviceID   string     `json:"deviceId"`
+	UseCount   int        `json:"useCount"`
+	LastUsed   *time.Time `json:"lastUsed"`
+}
+
+// importResult is the body of POST /import
+type importResult struct {
+	Total     int            `json:"total"`
+	Counts    map[string]int `json:"counts"`
+	Cancelled bool           `json:"cancelled"`
+	Items     []struct {
+		Index  int    `json:"index"`
+		Name   string `json:"name"`
+		Action string `json:"action"`
+		Error  string `json:"error"`
+	} `json:"items"`
+}
+
+// runPresetsList lists one device's presets, or every preset
+func runPresetsList(c *client, args []string) int {
+	flags := flag.NewFlagSet("presets list", flag.ContinueOnError)
+	device := flags.String("device", "", "only presets this device can use")
+	if code, ok := parseFlags(flags, args, "presets list [-device id]", 0); !ok {
+		return code
+	}
+
+	var data json.RawMessage
+	var err error
+	if *device != "" {
+		var resp *apiResponse
+		if resp, err = c.call("GET", "/presets", url.Values{"device_id": {*device}}, nil, nil); err == nil {
+			data = resp.Data
+		}
+	} else {
+		// Presets are only listed per device; the export has them all
+		data, err = c.allPresets()
+	}
+	if err != nil {
+		return fail("list presets", err)
+	}
+
+	if c.json {
+		printJSON(data)
+		return 0
+	}
+	var presets []preset
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return fail("list presets", err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSCOPE\tDEVICE\tUSES\tLAST USED")
+	for _, p := range presets {
+		scope := p.ScopeType
+		if p.ScopeValue != "" {
+			scope += ":" + p.ScopeValue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", p.ID, p.Name, scope, p.DeviceID, p.UseCount, formatTime(p.LastUsed))
+	}
+	tw.Flush()
+	return 0
+}
+
+// allPresets reads every preset from an NDJSON export, as a JSON array
+func (c *client) allPresets() (json.RawMessage, error) {
+	resp, err := c.do("GET", "/export", url.Values{"format": {"ndjson"}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	presets := []json.RawMessage{}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var p json.RawMessage
+		if err := dec.Decode(&p); err == io.EOF {
+			return json.Marshal(presets)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read the export: %w", err)
+		}
+		presets = append(presets, p)
+	}
+}
+
+// runPresetsExport streams an export to a file or stdout
+func runPresetsExport(c *client, args []string) int {
+	flags := flag.NewFlagSet("presets export", flag.ContinueOnError)
+	format := flags.String("format", "json", "json, ndjson or csv")
+	device := flags.String("device", "", "only this device's presets")
+	passphraseFile := flags.String("passphrase-file", "", "encrypt the export with the passphrase in this file")
+	output := flags.String("o", "", "write the export to this file instead of stdout")
+	if code, ok := parseFlags(flags, args, "presets export [-format json|ndjson|csv] [-device id] [-passphrase-file path] [-o path]", 0); !ok {
+		return code
+	}
+
+	query := url.Values{"format": {*format}}
+	if *device != "" {
+		query.Set("device_id", *device)
+	}
+	header := http.Header{}
+	if *passphraseFile != "" {
+		passphrase, err := readPassphrase(*passphraseFile)
+		if err != nil {
+			return fail("read the passphrase", err)
+		}
+		header.Set("X-Export-Passphrase", passphrase)
+	}
+
+	resp, err := c.do("GET", "/export", query, nil, header)
+	if err != nil {
+		return fail("export presets", err)
+	}
+	defer resp.Body.Close()
+
+	// Only create the file once the export has started, so a refused
+	// export doesn't leave an empty one behind
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fail("export presets", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	n, err := io.Copy(out, resp.Body)
+	if err != nil {
+		return fail("export presets", err)
+	}
+	if *output != "" {
+		fmt.Fprintf(os.Stderr, "Wrote %d bytes to %s\n", n, *output)
+	}
+	return 0
+}
+
+// runPresetsImport uploads an export, or a third-party export, to import
+func runPresetsImport(c *client, args []string) int {
+	flags := flag.NewFlagSet("presets import", flag.ContinueOnError)
+	format := flags.String("format", "", "json, ndjson, csv or a converter name (detected if omitted)")
+	conflict := flags.String("conflict", "skip", "skip, overwrite or rename presets that already exist")
+	device := flags.String("device", "", "import every preset into this device (required for converter formats)")
+	dryRun := flags.Bool("dry-run", false, "show what would be imported without writing anything")
+	passphraseFile := flags.String("passphrase-file", "", "decrypt an encrypted export with the passphrase in this file")
+	if code, ok := parseFlags(flags, args, "presets import [flags] <file | ->", 1); !ok {
+		return code
+	}
+
+	var in io.Reader = os.Stdin
+	if name := flags.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return fail("import presets", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	query := url.Values{"conflict": {*conflict}, "dry_run": {fmt.Sprint(*dryRun)}}
+	if *format != "" {
+		query.Set("format", *format)
+	}
+	if *device != "" {
+		query.Set("device_id", *device)
+	}
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	if *passphraseFile != "" {
+		passphrase, err := readPassphrase(*passphraseFile)
+		if err != nil {
+			return fail("read the passphrase", err)
+		}
+		header.Set("X-Import-Passphrase", passphrase)
+	}
+
+	resp, err := c.do("POST", "/import", query, in, header)
+	if err != nil {
+		return fail("import presets", err)
+	}
+	var result importResult
+	envelope, err := decode(resp, &result)
+	if err != nil {
+		return fail("import presets", err)
+	}
+
+	if c.json {
+		printJSON(envelope.Data)
+		return 0
+	}
+	for _, item := range result.Items {
+		if item.Error != "" {
+			fmt.Printf("  #%d %s: %s\n", item.Index, item.Name, item.Error)
+		}
+	}
+	var counts []string
+	for _, action := range []string{"created", "updated", "renamed", "skipped", "failed"} {
+		if n := result.Counts[action]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, action))
+		}
+	}
+	fmt.Printf("%s (%d presets: %s)\n", envelope.Message, result.Total, strings.Join(counts, ", "))
+	if result.Counts["failed"] > 0 || result.Cancelled {
+		return 1
+	}
+	return 0
+}
+
+// readPassphrase reads a passphrase from a file
+func readPassphrase(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
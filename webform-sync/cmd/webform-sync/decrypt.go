@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/archive"
+	"github.com/tezza1971/webform-sync/internal/config"
+)
+
+// runDecryptBackup decrypts a backup copied to a remote, so it can be
+// restored like a local one. It returns the process exit code.
+func runDecryptBackup(args []string) int {
+	flags := flag.NewFlagSet("decrypt-backup", flag.ContinueOnError)
+	configPath := flags.String("config", "", "read storage.backup.passphrase from this config")
+	passphraseFile := flags.String("passphrase-file", "", "read the passphrase from this file")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: webform-sync decrypt-backup [-config path | -passphrase-file path] <backup.db.enc> <backup.db>")
+		fmt.Fprintln(flags.Output(), "Without -config or -passphrase-file, the passphrase is read from standard input.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	input, output := flags.Arg(0), flags.Arg(1)
+
+	passphrase, err := backupPassphrase(*configPath, *passphraseFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the passphrase: %v\n", err)
+		return 1
+	}
+
+	if err := decryptFile(input, output, passphrase); err != nil {
+		if errors.Is(err, archive.ErrInvalidPassphrase) {
+			fmt.Fprintf(os.Stderr, "Failed to decrypt %s: wrong passphrase, or the file is damaged\n", input)
+		} else {
+			fmt.Fprintf(os.Stderr, "Failed to decrypt %s: %v\n", input, err)
+		}
+		return 1
+	}
+	fmt.Printf("Wrote %s\n", output)
+	return 0
+}
+
+// backupPassphrase reads the passphrase from a config, a file or stdin
+func backupPassphrase(configPath, passphraseFile string) (string, error) {
+	switch {
+	case configPath != "":
+		cfg, err := config.LoadConfig(configPath)
+		if err != nil {
+			return "", err
+		}
+		if cfg.Storage.Backup.Passphrase == "" {
+			return "", fmt.Errorf("%s has no storage.backup.passphrase", configPath)
+		}
+		return cfg.Storage.Backup.Passphrase, nil
+	case passphraseFile != "":
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// decryptFile writes the plaintext of an encrypted backup to output, which
+// must not exist yet. Nothing is left behind if decryption fails.
+func decryptFile(input, output, passphrase string) error {
+	src, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var magic [8]byte
+	if _, err := io.ReadFull(src, magic[:]); err != nil || !archive.IsEncrypted(magic[:]) {
+		return fmt.Errorf("not an encrypted backup")
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	plain, err := archive.NewDecryptReader(bufio.NewReader(src), passphrase)
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, plain)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output)
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	webformsync "github.com/tezza1971/webform-sync"
+	"github.com/tezza1971/webform-sync/internal/config"
+)
+
+// runInit writes a commented config with fresh secrets. It returns the
+// process exit code.
+func runInit(args []string) int {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	output := flags.String("output", "webform-sync.yml", "where to write the config")
+	docker := flags.Bool("docker", false, "use container paths and listen on all interfaces")
+	force := flags.Bool("force", false, "overwrite an existing file")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: webform-sync init [-output path] [-docker] [-force]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	token, err := randomSecret()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate a token: %v\n", err)
+		return 1
+	}
+	shareSecret, err := randomSecret()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate a secret: %v\n", err)
+		return 1
+	}
+
+	settings := []yamlSetting{
+		{"server.host", `"127.0.0.1"`},
+		{"authentication.enabled", "true"},
+		{"authentication.api_token", `"` + token + `"`},
+		{"sharing.secret", `"` + shareSecret + `"`},
+	}
+	if *docker {
+		settings = append(settings, []yamlSetting{
+			{"server.host", `"0.0.0.0"`},
+			{"storage.data_dir", `"/app/data"`},
+			{"storage.backup.backup_dir", `"/app/data/backups"`},
+			{"logging.output", `"console"`},
+			{"logging.log_file", `"/app/logs/webform-sync.log"`},
+		}...)
+	}
+
+	text, err := generateConfig("webform-sync init", settings)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate config: %v\n", err)
+		return 1
+	}
+	err = writeConfig(*output, text, *force)
+	if errors.Is(err, fs.ErrExist) {
+		fmt.Fprintf(os.Stderr, "%s already exists; use -force to overwrite it\n", *output)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write %s: %v\n", *output, err)
+		return 1
+	}
+
+	fmt.Printf("Wrote %s\n", *output)
+	fmt.Printf("API token for the browser extension: %s\n", token)
+	return 0
+}
+
+// yamlSetting is a value for a dotted path in the config template
+type yamlSetting struct{ path, value string }
+
+// generateConfig fills settings into the config template, noting what
+// generated it, and checks that the result loads
+func generateConfig(generator string, settings []yamlSetting) (string, error) {
+	text := string(webformsync.DefaultConfig)
+	for _, s := range settings {
+		var err error
+		if text, err = setYAMLValue(text, s.path, s.value); err != nil {
+			return "", err
+		}
+	}
+	text = fmt.Sprintf("# Generated by %s on %s\n", generator, time.Now().Format("2006-01-02")) + text
+
+	// Catch a template that no longer loads before handing it to the user
+	if err := checkGenerated(text); err != nil {
+		return "", fmt.Errorf("generated config is invalid: %w", err)
+	}
+	return text, nil
+}
+
+// writeConfig writes a config readable only by its owner, since it holds
+// secrets. Unless force is set, it fails with fs.ErrExist rather than
+// overwrite a file.
+func writeConfig(path, text string, force bool) error {
+	mode := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, mode, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(text); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// randomSecret returns 32 random bytes, base64url encoded
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// yamlKeyLine matches a "key: value  # comment" line
+var yamlKeyLine = regexp.MustCompile(`^(\s*)([A-Za-z0-9_]+):(\s*)([^#]*?)(\s+#.*)?$`)
+
+// setYAMLValue replaces the value at a dotted path in YAML text, keeping
+// comments and layout. Commented-out keys are ignored.
+func setYAMLValue(text, path, value string) (string, error) {
+	keys := strings.Split(path, ".")
+	lines := strings.Split(text, "\n")
+
+	// indents[i] is the indentation of the section matching keys[i]
+	var indents []int
+	for i, line := range lines {
+		m := yamlKeyLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		indent := len(m[1])
+		for len(indents) > 0 && indent <= indents[len(indents)-1] {
+			indents = indents[:len(indents)-1]
+		}
+		if m[2] != keys[len(indents)] {
+			continue
+		}
+		if len(indents) < len(keys)-1 {
+			indents = append(indents, indent)
+			continue
+		}
+		lines[i] = m[1] + m[2] + ": " + value + m[5]
+		return strings.Join(lines, "\n"), nil
+	}
+	return "", fmt.Errorf("setting %s not found in the template", path)
+}
+
+// checkGenerated validates a generated config by loading it
+func checkGenerated(text string) error {
+	file, err := os.CreateTemp("", "webform-sync-*.yml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(text); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	_, err = config.LoadConfig(file.Name())
+	return err
+}
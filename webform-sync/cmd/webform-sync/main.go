@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/logger"
+	"github.com/tezza1971/webform-sync/internal/server"
+	"github.com/tezza1971/webform-sync/internal/storage"
+	"github.com/tezza1971/webform-sync/internal/systemd"
+	"github.com/tezza1971/webform-sync/plugin"
+)
+
+// Set at build time with -ldflags (see Makefile)
+var (
+	Version   = "1.0.0"
+	BuildTime = "unknown"
+)
+
+const banner = `
+ __      __      _      __                             _____
+/  \    /  \____| |____/ _| ___  ______ ____   ____  / ____\___ ___________   _____
+\   \/\/   /  _ | _/  < |_ / _ \|  ___/  __ \_/ ___\/ /_  / _ \\___   ___\ /  ___/
+ \        (  __/ |>    \  > (_) | |  | | | | / /__ \  __| \___/ / | |     /\___ \
+  \__/\  / \___/_|___/\_|  \___/|_|  |_| |_| \____/_/     \____/  |_|     /____  >
+       \/                                                                        \/
+                   ╭╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╮
+                   ┆   Webform Preset Sync Service v%-8s┆
+                   ╰╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╌╯
+
+`
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "init":
+			os.Exit(runInit(os.Args[2:]))
+		case "install-service":
+			os.Exit(runInstallService(os.Args[2:]))
+		case "service":
+			os.Exit(runService(os.Args[2:]))
+		case "decrypt-backup":
+			os.Exit(runDecryptBackup(os.Args[2:]))
+		case "restore":
+			os.Exit(runRestore(os.Args[2:]))
+		case "tui":
+			os.Exit(runTUI(os.Args[2:]))
+		}
+	}
+
+	configPath := flag.String("config", "webform-sync.yml", "path to the config file")
+	checkConfig := flag.Bool("check-config", false, "validate the config file, print any problems and exit")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	workDir := flag.String("workdir", "", "change to this directory first, so relative paths in the config resolve against it")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: webform-sync [flags]\n       webform-sync init [-output path] [-docker] [-force]\n       webform-sync install-service [-config path] [-user name] [-socket]\n       webform-sync service install|uninstall|start|stop [-config path]\n       webform-sync decrypt-backup [-config path | -passphrase-file path] <backup.db.enc> <backup.db>\n       webform-sync restore [-config path] [-tenant id] [-staging] [-confirm] <backup>\n       webform-sync tui [-config path] [-server url] [-interval 2s]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("webform-sync %s (built %s)\n", Version, BuildTime)
+		return
+	}
+	if *workDir != "" {
+		if err := os.Chdir(*workDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to change to %s: %v\n", *workDir, err)
+			os.Exit(1)
+		}
+	}
+	if *checkConfig {
+		os.Exit(runCheckConfig(*configPath))
+	}
+
+	// Under the Windows Service Control Manager, it decides when to stop
+	if ran, code := runAsService(*configPath); ran {
+		os.Exit(code)
+	}
+
+	fmt.Printf(banner, Version)
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	os.Exit(serve(*configPath, quit))
+}
+
+// serve runs the service until a signal arrives on stop. It returns the
+// process exit code.
+func serve(configPath string, stop <-chan os.Signal) int {
+	// Without a config, the setup wizard writes one first
+	if _, err := os.Stat(configPath); errors.Is(err, fs.ErrNotExist) {
+		if ok, code := runSetup(configPath, stop); !ok {
+			return code
+		}
+	}
+
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load %s: %v\n", configPath, err)
+		return 1
+	}
+
+	log := logger.NewLogger(cfg.Logging)
+	log.Info("Starting webform-sync service...")
+	log.Info("Loading configuration from: %s", configPath)
+
+	if err := loadPlugins(cfg.Plugins.Files); err != nil {
+		log.Fatal("%v", err)
+	}
+	registered := plugin.Registered()
+	for _, kind := range []string{"auth providers", "notifiers", "backup stores"} {
+		if names := registered[kind]; len(names) > 0 {
+			log.Info("Extensions available: %s %s", kind, strings.Join(names, ", "))
+		}
+	}
+
+	store, err := storage.NewStorage(cfg.Storage, log)
+	if err != nil {
+		log.Fatal("Failed to initialize storage: %v", err)
+	}
+
+	srv, err := server.NewServer(cfg, store, log)
+	if err != nil {
+		store.Close()
+		log.Fatal("Failed to create server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		store.Close()
+		log.Fatal("Failed to start server: %v", err)
+	}
+	srv.WatchConfig(configPath)
+	if err := systemd.Notify("READY=1"); err != nil {
+		log.Warn("%v", err)
+	}
+
+	sig := <-stop
+	log.Info("Received %s, shutting down", sig)
+	systemd.Notify("STOPPING=1")
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		log.Error("Shutdown did not complete cleanly: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// runCheckConfig validates the config file and prints every problem found.
+// It returns the process exit code.
+func runCheckConfig(path string) int {
+	_, err := config.LoadConfig(path)
+	if err == nil {
+		fmt.Printf("%s: OK\n", path)
+		return 0
+	}
+
+	var invalid *config.ValidationError
+	if !errors.As(err, &invalid) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d problem(s):\n", path, len(invalid.Problems))
+	for _, problem := range invalid.Problems {
+		fmt.Fprintf(os.Stderr, "  - %s\n", problem)
+	}
+	return 1
+}
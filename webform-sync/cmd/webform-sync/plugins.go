@@ -0,0 +1,19 @@
+//go:build cgo && (linux || darwin || freebsd)
+
+package main
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// loadPlugins opens each plugin file, which registers its extensions as it
+// initialises
+func loadPlugins(files []string) error {
+	for _, file := range files {
+		if _, err := plugin.Open(file); err != nil {
+			return fmt.Errorf("failed to load plugin %s: %w", file, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !cgo || !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+// loadPlugins fails where Go can't load plugins; extensions can still be
+// built into the binary
+func loadPlugins(files []string) error {
+	if len(files) > 0 {
+		return errors.New("plugins.files: Go plugins can't be loaded on this platform; build the extensions into webform-sync instead")
+	}
+	return nil
+}
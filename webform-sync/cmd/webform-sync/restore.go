@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/tezza1971/webform-sync/internal/archive"
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/logger"
+	"github.com/tezza1971/webform-sync/internal/server"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// runRestore previews restoring a backup into the configured database, and
+// restores it, or stages its presets, with -confirm. It returns the process
+// exit code.
+func runRestore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	configPath := flags.String("config", "webform-sync.yml", "path to the config file")
+	tenant := flags.String("tenant", "", "restore this tenant's database")
+	staging := flags.Bool("staging", false, "stage the backup's presets for recovering chosen ones, instead of restoring everything")
+	confirm := flags.Bool("confirm", false, "restore; without it, only show what would change")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: webform-sync restore [-config path] [-tenant id] [-staging] [-confirm] <backup.db | backup.db.enc>")
+		fmt.Fprintln(flags.Output(), "Stop the service first, or restore through POST /api/v1/admin/restore while it runs.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	backup := flags.Arg(0)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load %s: %v\n", *configPath, err)
+		return 1
+	}
+	backupDir := cfg.Storage.Backup.BackupDir
+	if backupDir == "" {
+		backupDir = cfg.Storage.DataDir
+	}
+	if *tenant != "" {
+		if !hasTenant(cfg, *tenant) {
+			fmt.Fprintf(os.Stderr, "No tenant %q in %s\n", *tenant, *configPath)
+			return 1
+		}
+		cfg.Storage.DataDir = filepath.Join(cfg.Storage.DataDir, "tenants", *tenant)
+		backupDir = filepath.Join(backupDir, "tenants", *tenant)
+	}
+
+	// Backups copied to a remote are encrypted
+	path, cleanup, err := plainBackup(backup, cfg.Storage.Backup.Passphrase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", backup, err)
+		return 1
+	}
+	defer cleanup()
+
+	cfg.Logging.Output = "console"
+	cfg.Logging.Level = "warn"
+	store, err := storage.NewStorage(cfg.Storage, logger.NewLogger(cfg.Logging))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open the database: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	preview, err := store.PreviewRestore(ctx, path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", backup, err)
+		return 1
+	}
+	printPreview(os.Stdout, preview)
+
+	if !*confirm {
+		fmt.Println("\nNothing was changed. Run again with -confirm to restore.")
+		return 0
+	}
+
+	if *staging {
+		staged, err := store.StageBackup(ctx, path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to stage %s: %v\n", backup, err)
+			return 1
+		}
+		fmt.Printf("\nStaged %d presets. List them with GET /api/v1/admin/restore/staging and recover chosen ones with POST /api/v1/admin/restore/staging/recover.\n", staged)
+		return 0
+	}
+
+	safety, err := server.PreRestoreBackup(ctx, store, backupDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to back up the database before restoring: %v\n", err)
+		return 1
+	}
+	restored, err := store.RestoreBackup(ctx, path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to restore %s: %v\n", backup, err)
+		return 1
+	}
+	fmt.Printf("\nRestored %d presets. The database as it was before is in %s.\n", restored, safety)
+	return 0
+}
+
+func hasTenant(cfg *config.Config, id string) bool {
+	for _, t := range cfg.Tenancy.Tenants {
+		if t.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// plainBackup returns the path of a backup's database, decrypting it to a
+// temporary file first if it is encrypted. cleanup removes that file.
+func plainBackup(path, passphrase string) (plain string, cleanup func(), err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	magic := make([]byte, len(archive.Magic))
+	_, err = io.ReadFull(f, magic)
+	f.Close()
+	if err != nil || !archive.IsEncrypted(magic) {
+		return path, func() {}, nil
+	}
+
+	if passphrase == "" {
+		return "", nil, errors.New("it is encrypted, and the config has no storage.backup.passphrase")
+	}
+	dir, err := os.MkdirTemp("", "webform-sync-restore-")
+	if err != nil {
+		return "", nil, err
+	}
+	plain = filepath.Join(dir, "backup.db")
+	if err := decryptFile(path, plain, passphrase); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	return plain, func() { os.RemoveAll(dir) }, nil
+}
+
+// printPreview shows what restoring would change, device by device
+func printPreview(w io.Writer, preview *storage.RestorePreview) {
+	fmt.Fprintf(w, "Presets now: %d, in the backup: %d\n\n", preview.CurrentPresets, preview.BackupPresets)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tNAME\tNOW\tBACKUP\tADDED\tREMOVED\tCHANGED")
+	for _, d := range preview.Devices {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\n", d.DeviceID, d.Name, d.Current, d.Backup, d.Added, d.Removed, d.Changed)
+	}
+	tw.Flush()
+}
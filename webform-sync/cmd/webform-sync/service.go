@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+)
+
+// runService installs, removes, starts or stops the service with the
+// platform's service manager: systemd on Linux, launchd on macOS (as a
+// login item for the current user) and the Service Control Manager on
+// Windows. It returns the process exit code.
+func runService(args []string) int {
+	const usage = "Usage: webform-sync service install|uninstall|start|stop [-config path] [-name name] [-user name]"
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	action := args[0]
+
+	flags := flag.NewFlagSet("service "+action, flag.ContinueOnError)
+	configPath := flags.String("config", "webform-sync.yml", "path to the config file the service runs with")
+	name := flags.String("name", "webform-sync", "service name")
+	runAs := flags.String("user", defaultServiceUser(), "user the service runs as (Linux only)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	var err error
+	var done string
+	switch action {
+	case "install":
+		var cfg *config.Config
+		if cfg, err = config.LoadConfig(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load %s: %v\n", *configPath, err)
+			return 1
+		}
+		var unit *serviceUnit
+		if unit, err = newServiceUnit(cfg, *configPath, *runAs); err == nil {
+			err = installService(*name, unit)
+		}
+		done = "Installed"
+	case "uninstall":
+		err, done = uninstallService(*name), "Uninstalled"
+	case "start":
+		err, done = startService(*name), "Started"
+	case "stop":
+		err, done = stopService(*name), "Stopped"
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to %s service %s: %v\n", action, *name, err)
+		return 1
+	}
+	fmt.Printf("%s service %s\n", done, *name)
+	return 0
+}
+
+// runCommand runs a service manager command, returning its output as the
+// error if it fails
+func runCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if text := strings.TrimSpace(string(out)); text != "" {
+			return fmt.Errorf("%s: %s", name, text)
+		}
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
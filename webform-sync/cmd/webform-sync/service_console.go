@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// runAsService only applies on Windows; elsewhere the service manager
+// stops the service with a signal
+func runAsService(configPath string) (bool, int) {
+	return false, 0
+}
@@ -0,0 +1,111 @@
+//go:build darwin
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// launchAgentLabel is the launchd label for a service name
+func launchAgentLabel(name string) string {
+	return "com." + name
+}
+
+// launchAgentPath is where the current user's agent is installed
+func launchAgentPath(name string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", launchAgentLabel(name)+".plist"), nil
+}
+
+// launchdDomain is the current user's GUI session, where login items run
+func launchdDomain() string {
+	return fmt.Sprintf("gui/%d", os.Getuid())
+}
+
+// installService writes a launch agent that starts the service at login and
+// restarts it if it crashes, and loads it, which starts it now
+func installService(name string, unit *serviceUnit) error {
+	path, err := launchAgentPath(name)
+	if err != nil {
+		return err
+	}
+	home, _ := os.UserHomeDir()
+	logFile := filepath.Join(home, "Library", "Logs", name+".log")
+
+	var b bytes.Buffer
+	str := func(s string) string {
+		var e bytes.Buffer
+		xml.EscapeText(&e, []byte(s))
+		return "<string>" + e.String() + "</string>"
+	}
+	fmt.Fprintf(&b, `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>Label</key>
+    %s
+    <key>ProgramArguments</key>
+    <array>
+        %s
+        <string>-config</string>
+        %s
+    </array>
+    <key>WorkingDirectory</key>
+    %s
+    <key>RunAtLoad</key>
+    <true/>
+    <key>KeepAlive</key>
+    <dict>
+        <key>SuccessfulExit</key>
+        <false/>
+    </dict>
+    <key>StandardOutPath</key>
+    %s
+    <key>StandardErrorPath</key>
+    %s
+</dict>
+</plist>
+`, str(launchAgentLabel(name)), str(unit.executable), str(unit.configPath), str(unit.workDir), str(logFile), str(logFile))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Replace an agent that is already loaded
+	runCommand("launchctl", "bootout", launchdDomain()+"/"+launchAgentLabel(name))
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	return runCommand("launchctl", "bootstrap", launchdDomain(), path)
+}
+
+// uninstallService unloads the agent, which stops the service, and removes
+// it
+func uninstallService(name string) error {
+	path, err := launchAgentPath(name)
+	if err != nil {
+		return err
+	}
+	runCommand("launchctl", "bootout", launchdDomain()+"/"+launchAgentLabel(name))
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func startService(name string) error {
+	return runCommand("launchctl", "kickstart", launchdDomain()+"/"+launchAgentLabel(name))
+}
+
+// stopService stops the service until the next login. A clean exit isn't
+// restarted, because KeepAlive only covers unsuccessful ones.
+func stopService(name string) error {
+	return runCommand("launchctl", "kill", "SIGTERM", launchdDomain()+"/"+launchAgentLabel(name))
+}
@@ -0,0 +1,48 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// systemUnitDir is where system-wide systemd units are installed
+const systemUnitDir = "/etc/systemd/system"
+
+// installService writes the systemd unit and enables it at boot
+func installService(name string, unit *serviceUnit) error {
+	path := filepath.Join(systemUnitDir, name+".service")
+	if err := os.WriteFile(path, []byte(unit.service(name)), 0644); err != nil {
+		return err
+	}
+	if err := runCommand("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	return runCommand("systemctl", "enable", name+".service")
+}
+
+// uninstallService stops and disables the service and removes its units,
+// including a socket unit written by install-service -socket
+func uninstallService(name string) error {
+	if err := runCommand("systemctl", "disable", "--now", name+".service"); err != nil {
+		return err
+	}
+	runCommand("systemctl", "disable", "--now", name+".socket")
+	for _, unit := range []string{name + ".service", name + ".socket"} {
+		if err := os.Remove(filepath.Join(systemUnitDir, unit)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", unit, err)
+		}
+	}
+	return runCommand("systemctl", "daemon-reload")
+}
+
+func startService(name string) error {
+	return runCommand("systemctl", "start", name+".service")
+}
+
+func stopService(name string) error {
+	return runCommand("systemctl", "stop", name+".service")
+}
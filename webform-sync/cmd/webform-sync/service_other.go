@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "errors"
+
+// errServiceUnsupported is returned on platforms without a supported
+// service manager
+var errServiceUnsupported = errors.New("not supported on this platform; run webform-sync from your init system instead")
+
+func installService(name string, unit *serviceUnit) error { return errServiceUnsupported }
+func uninstallService(name string) error                  { return errServiceUnsupported }
+func startService(name string) error                      { return errServiceUnsupported }
+func stopService(name string) error                       { return errServiceUnsupported }
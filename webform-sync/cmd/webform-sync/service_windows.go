@@ -0,0 +1,181 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// installService registers a service that starts at boot and is restarted
+// if it fails. It runs as LocalSystem, so the config's paths should be
+// absolute or relative to its working directory.
+func installService(name string, unit *serviceUnit) error {
+	binPath := syscall.EscapeArg(unit.executable) +
+		" -workdir " + syscall.EscapeArg(unit.workDir) +
+		" -config " + syscall.EscapeArg(unit.configPath)
+	if err := runCommand("sc.exe", "create", name, "binPath=", binPath, "start=", "auto", "DisplayName=", "Webform Sync Service"); err != nil {
+		return err
+	}
+	runCommand("sc.exe", "description", name, "Syncs webform presets between browsers")
+	return runCommand("sc.exe", "failure", name, "reset=", "86400", "actions=", "restart/5000/restart/5000/restart/60000")
+}
+
+func uninstallService(name string) error {
+	runCommand("sc.exe", "stop", name)
+	return runCommand("sc.exe", "delete", name)
+}
+
+func startService(name string) error {
+	return runCommand("sc.exe", "start", name)
+}
+
+func stopService(name string) error {
+	return runCommand("sc.exe", "stop", name)
+}
+
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW  = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped     = 1
+	serviceStopPending = 3
+	serviceRunning     = 4
+
+	serviceAcceptStop     = 0x1
+	serviceAcceptShutdown = 0x4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	errorServiceSpecificError = 1066
+	errorCallNotImplemented   = 120
+)
+
+// serviceStatus is the Win32 SERVICE_STATUS structure
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// scmService connects the process to the Service Control Manager. The
+// SCM calls serviceMain and control on threads of its own; they hand over
+// to serve through the channels.
+type scmService struct {
+	name    *uint16
+	handle  uintptr
+	started chan struct{}
+	stop    chan os.Signal
+	done    chan struct{}
+
+	mu sync.Mutex
+}
+
+var scm *scmService
+
+// runAsService runs the service under the Service Control Manager, if it
+// started the process. It returns false straight away otherwise.
+func runAsService(configPath string) (bool, int) {
+	name, _ := syscall.UTF16PtrFromString("webform-sync")
+	scm = &scmService{
+		name:    name,
+		started: make(chan struct{}),
+		stop:    make(chan os.Signal, 1),
+		done:    make(chan struct{}),
+	}
+
+	dispatched := make(chan error, 1)
+	go func() {
+		// The dispatcher holds this thread until the service stops
+		runtime.LockOSThread()
+		table := []serviceTableEntry{{name: name, proc: syscall.NewCallback(serviceMain)}, {}}
+		r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0])))
+		if r == 0 {
+			dispatched <- err
+			return
+		}
+		dispatched <- nil
+	}()
+
+	select {
+	case <-dispatched:
+		// ERROR_FAILED_SERVICE_CONTROLLER_CONNECT: started from a console
+		return false, 0
+	case <-scm.started:
+	}
+
+	code := serve(configPath, scm.stop)
+	scm.setStatus(serviceStopped, code)
+	close(scm.done)
+	<-dispatched
+	return true, code
+}
+
+// serviceMain is the ServiceMain callback. It reports the service running
+// and waits for serve to finish, since the service ends when it returns.
+func serviceMain(argc, argv uintptr) uintptr {
+	handle, _, _ := procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(scm.name)), syscall.NewCallback(serviceControl), 0)
+	if handle == 0 {
+		return 0
+	}
+	scm.handle = handle
+	scm.setStatus(serviceRunning, 0)
+	close(scm.started)
+	<-scm.done
+	return 0
+}
+
+// serviceControl is the HandlerEx callback for requests from the SCM
+func serviceControl(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		scm.setStatus(serviceStopPending, 0)
+		select {
+		case scm.stop <- syscall.SIGTERM:
+		default:
+		}
+		return 0
+	case serviceControlInterrogate:
+		return 0
+	}
+	return errorCallNotImplemented
+}
+
+// setStatus reports the service's state, and its exit code once stopped
+func (s *scmService) setStatus(state uint32, exitCode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := serviceStatus{serviceType: serviceWin32OwnProcess, currentState: state}
+	if state == serviceRunning {
+		status.controlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	}
+	if state == serviceStopPending {
+		status.waitHint = 60000
+	}
+	if exitCode != 0 {
+		status.win32ExitCode = errorServiceSpecificError
+		status.serviceSpecificExitCode = uint32(exitCode)
+	}
+	procSetServiceStatus.Call(s.handle, uintptr(unsafe.Pointer(&status)))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/server"
+	"github.com/tezza1971/webform-sync/internal/systemd"
+)
+
+// setupPage is the first-run setup wizard
+//
+//go:embed setup.html
+var setupPage []byte
+
+// setupCodeHeader carries the code printed on the console, which every
+// setup request needs, so other users of the machine can't set it up
+const setupCodeHeader = "X-Setup-Code"
+
+// setupRequest is what the setup wizard asks for
+type setupRequest struct {
+	DataDir string `json:"dataDir"`
+	// Host is 127.0.0.1 to serve only this machine, or 0.0.0.0 for the
+	// network
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// Auth is token, generating an API token, or basic with a username and
+	// password
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Backup   struct {
+		Enabled       bool   `json:"enabled"`
+		Dir           string `json:"dir"`
+		IntervalHours int    `json:"intervalHours"`
+		MaxBackups    int    `json:"maxBackups"`
+	} `json:"backup"`
+}
+
+// setupResult tells the wizard where the service will be and how to reach
+// it
+type setupResult struct {
+	ConfigPath string `json:"configPath"`
+	URL        string `json:"url"`
+	// Token is the generated API token, shown once
+	Token string `json:"token,omitempty"`
+}
+
+// setupDefaults are the wizard's starting values, matching the config
+// template's
+var setupDefaults = func() setupRequest {
+	var d setupRequest
+	d.DataDir, d.Host, d.Port, d.Auth = "./data", "127.0.0.1", 8765, "token"
+	d.Backup.Enabled, d.Backup.Dir, d.Backup.IntervalHours, d.Backup.MaxBackups = true, "./backups", 24, 7
+	return d
+}()
+
+// runSetup serves the setup wizard on this machine until it has written the
+// config at configPath. It returns false, with the process exit code, if it
+// stopped first.
+func runSetup(configPath string, stop <-chan os.Signal) (bool, int) {
+	code, err := randomSecret()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate a setup code: %v\n", err)
+		return false, 1
+	}
+	code = code[:16]
+
+	// The usual port if it's free, so the page can follow the service
+	// there after the restart
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(setupDefaults.Port)))
+	if err != nil {
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start the setup wizard: %v\n", err)
+		return false, 1
+	}
+
+	done := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/setup" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(setupPage)
+	})
+	mux.HandleFunc("/setup/defaults", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if checkSetupCode(w, r, code) {
+			setupRespond(w, http.StatusOK, server.APIResponse{Success: true, Data: setupDefaults})
+		}
+	})
+	mux.HandleFunc("/setup/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkSetupCode(w, r, code) {
+			return
+		}
+		var req setupRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			setupRespond(w, http.StatusBadRequest, server.APIResponse{Error: "Invalid request body"})
+			return
+		}
+		result, err := writeSetupConfig(configPath, req)
+		if errors.Is(err, fs.ErrExist) {
+			setupRespond(w, http.StatusConflict, server.APIResponse{Error: configPath + " already exists"})
+			return
+		}
+		if err != nil {
+			setupRespond(w, http.StatusBadRequest, server.APIResponse{Error: err.Error()})
+			return
+		}
+		setupRespond(w, http.StatusOK, server.APIResponse{Success: true, Data: result, Message: "Config written; the service is starting"})
+		close(done)
+	})
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(listener)
+	port := listener.Addr().(*net.TCPAddr).Port
+	fmt.Printf("No config found at %s. To set up webform-sync, open:\n\n    http://127.0.0.1:%d/setup?code=%s\n\n", configPath, port, code)
+	fmt.Printf("On a remote machine, forward the port first: ssh -L %d:127.0.0.1:%d <host>\n", port, port)
+	// A Type=notify unit would otherwise time out while setup waits
+	systemd.Notify(fmt.Sprintf("READY=1\nSTATUS=Waiting for setup on 127.0.0.1:%d", port))
+
+	select {
+	case <-stop:
+		srv.Close()
+		return false, 0
+	case <-done:
+	}
+	// Shutdown waits for the response to the wizard to be sent
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+	fmt.Printf("Wrote %s; starting the service\n", configPath)
+	return true, 0
+}
+
+// checkSetupCode rejects requests without the code printed on the console
+func checkSetupCode(w http.ResponseWriter, r *http.Request, code string) bool {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(setupCodeHeader)), []byte(code)) == 1 {
+		return true
+	}
+	setupRespond(w, http.StatusForbidden, server.APIResponse{Error: "Setup code missing or wrong: open the link printed on the console"})
+	return false
+}
+
+func setupRespond(w http.ResponseWriter, status int, resp server.APIResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeSetupConfig checks the wizard's choices, creates the directories
+// they name and writes the config
+func writeSetupConfig(configPath string, req setupRequest) (*setupResult, error) {
+	if req.DataDir == "" {
+		return nil, errors.New("choose a data directory")
+	}
+	if ip := net.ParseIP(req.Host); ip == nil {
+		return nil, fmt.Errorf("host %q is not an IP address", req.Host)
+	}
+	if req.Port < 1 || req.Port > 65535 {
+		return nil, errors.New("port must be between 1 and 65535")
+	}
+	if req.Backup.Enabled {
+		if req.Backup.Dir == "" {
+			return nil, errors.New("choose a backup directory, or turn backups off")
+		}
+		if req.Backup.IntervalHours < 1 || req.Backup.MaxBackups < 1 {
+			return nil, errors.New("back up at least every hour and keep at least one backup")
+		}
+	}
+
+	shareSecret, err := randomSecret()
+	if err != nil {
+		return nil, err
+	}
+	result := &setupResult{ConfigPath: configPath}
+	settings := []yamlSetting{
+		{"server.host", strconv.Quote(req.Host)},
+		{"server.port", strconv.Itoa(req.Port)},
+		{"storage.data_dir", strconv.Quote(req.DataDir)},
+		{"storage.backup.enabled", strconv.FormatBool(req.Backup.Enabled)},
+		{"authentication.enabled", "true"},
+		{"sharing.secret", strconv.Quote(shareSecret)},
+	}
+	if req.Backup.Enabled {
+		settings = append(settings, []yamlSetting{
+			{"storage.backup.backup_dir", strconv.Quote(req.Backup.Dir)},
+			{"storage.backup.interval_hours", strconv.Itoa(req.Backup.IntervalHours)},
+			{"storage.backup.max_backups", strconv.Itoa(req.Backup.MaxBackups)},
+		}...)
+	}
+	switch req.Auth {
+	case "token":
+		if result.Token, err = randomSecret(); err != nil {
+			return nil, err
+		}
+		settings = append(settings, yamlSetting{"authentication.api_token", strconv.Quote(result.Token)})
+	case "basic":
+		if req.Username == "" || len(req.Password) < 12 {
+			return nil, errors.New("basic authentication needs a username and a password of at least 12 characters")
+		}
+		settings = append(settings, []yamlSetting{
+			{"authentication.type", `"basic"`},
+			{"authentication.username", strconv.Quote(req.Username)},
+			{"authentication.password", strconv.Quote(req.Password)},
+		}...)
+	default:
+		return nil, errors.New("authentication must be token or basic")
+	}
+
+	text, err := generateConfig("the webform-sync setup wizard", settings)
+	if err != nil {
+		return nil, err
+	}
+
+	// Directories that can't be created would only fail at startup, after
+	// the wizard has gone
+	dirs := []string{req.DataDir}
+	if req.Backup.Enabled {
+		dirs = append(dirs, req.Backup.Dir)
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, fmt.Errorf("can't create %s: %w", dir, err)
+		}
+	}
+	if err := writeConfig(configPath, text, false); err != nil {
+		return nil, fmt.Errorf("can't write %s: %w", configPath, err)
+	}
+
+	host := req.Host
+	if ip := net.ParseIP(host); ip.IsUnspecified() {
+		host = "localhost"
+	}
+	result.URL = "http://" + net.JoinHostPort(host, strconv.Itoa(req.Port))
+	return result, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+)
+
+// runInstallService writes a hardened systemd unit for the service, and a
+// socket unit with -socket. It returns the process exit code.
+func runInstallService(args []string) int {
+	flags := flag.NewFlagSet("install-service", flag.ContinueOnError)
+	configPath := flags.String("config", "webform-sync.yml", "path to the config file the service runs with")
+	unitDir := flags.String("dir", "/etc/systemd/system", "where to write the unit files")
+	name := flags.String("name", "webform-sync", "unit name")
+	runAs := flags.String("user", defaultServiceUser(), "user the service runs as")
+	socket := flags.Bool("socket", false, "also write a socket unit, so systemd opens the ports")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: webform-sync install-service [-config path] [-user name] [-socket] [-dir path] [-name unit]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load %s: %v\n", *configPath, err)
+		return 1
+	}
+	unit, err := newServiceUnit(cfg, *configPath, *runAs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	unit.socket = *socket
+
+	files := map[string]string{*name + ".service": unit.service(*name)}
+	if *socket {
+		files[*name+".socket"] = unit.socketUnit()
+	}
+	for file, text := range files {
+		path := filepath.Join(*unitDir, file)
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write %s: %v\n", path, err)
+			return 1
+		}
+		fmt.Printf("Wrote %s\n", path)
+	}
+
+	start := *name
+	if *socket {
+		start += ".socket"
+	}
+	fmt.Printf("Enable and start it with:\n  sudo systemctl daemon-reload\n  sudo systemctl enable --now %s\n", start)
+	return 0
+}
+
+// defaultServiceUser is the user who ran sudo, or else the current user
+func defaultServiceUser() string {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "root"
+}
+
+// serviceUnit holds what the unit files are generated from. Paths are
+// absolute, since systemd doesn't start the service in the current
+// directory.
+type serviceUnit struct {
+	cfg        *config.Config
+	executable string
+	configPath string
+	workDir    string
+	user       string
+	socket     bool
+}
+
+func newServiceUnit(cfg *config.Config, configPath, runAs string) (*serviceUnit, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find this executable: %w", err)
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return nil, fmt.Errorf("failed to find this executable: %w", err)
+	}
+	workDir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	if configPath, err = filepath.Abs(configPath); err != nil {
+		return nil, err
+	}
+	return &serviceUnit{cfg: cfg, executable: executable, configPath: configPath, workDir: workDir, user: runAs}, nil
+}
+
+// service renders the .service unit
+func (u *serviceUnit) service(name string) string {
+	var b strings.Builder
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format+"\n", args...)
+	}
+
+	line("[Unit]")
+	line("Description=Webform Sync Service")
+	line("Documentation=https://github.com/tezza1971/webform-presets")
+	line("Wants=network-online.target")
+	line("After=network-online.target")
+	if u.socket {
+		line("Requires=%s.socket", name)
+		line("After=%s.socket", name)
+	}
+	line("")
+	line("[Service]")
+	line("Type=notify")
+	line("User=%s", u.user)
+	line("WorkingDirectory=%s", u.workDir)
+	line("ExecStart=%s -config %s", quoteUnitArg(u.executable), quoteUnitArg(u.configPath))
+	line("ExecReload=/bin/kill -HUP $MAINPID")
+	line("Restart=on-failure")
+	line("RestartSec=5")
+	line("TimeoutStopSec=%d", u.cfg.Server.ShutdownTimeout+10)
+	line("WatchdogSec=60")
+	line("")
+	line("# Sandboxing: the service only needs to write its data and logs")
+	line("NoNewPrivileges=yes")
+	line("ProtectSystem=strict")
+	line("ProtectHome=%s", u.protectHome())
+	for _, path := range u.writablePaths() {
+		// "-" lets the service start before the directory exists
+		line("ReadWritePaths=-%s", path)
+	}
+	line("PrivateTmp=yes")
+	line("PrivateDevices=yes")
+	line("ProtectKernelTunables=yes")
+	line("ProtectKernelModules=yes")
+	line("ProtectKernelLogs=yes")
+	line("ProtectControlGroups=yes")
+	line("ProtectClock=yes")
+	line("ProtectHostname=yes")
+	line("RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6")
+	line("RestrictNamespaces=yes")
+	line("RestrictRealtime=yes")
+	line("RestrictSUIDSGID=yes")
+	line("LockPersonality=yes")
+	line("MemoryDenyWriteExecute=yes")
+	line("SystemCallArchitectures=native")
+	line("SystemCallFilter=@system-service")
+	line("SystemCallErrorNumber=EPERM")
+	line("UMask=0077")
+	if u.needsBindCapability() {
+		line("CapabilityBoundingSet=CAP_NET_BIND_SERVICE")
+		line("AmbientCapabilities=CAP_NET_BIND_SERVICE")
+	} else {
+		line("CapabilityBoundingSet=")
+	}
+	line("")
+	line("[Install]")
+	line("WantedBy=multi-user.target")
+	return b.String()
+}
+
+// socketUnit renders the .socket unit. The API socket must come first and
+// the redirect port second, which is the order the server takes them in.
+func (u *serviceUnit) socketUnit() string {
+	var b strings.Builder
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format+"\n", args...)
+	}
+
+	server := u.cfg.Server
+	line("[Unit]")
+	line("Description=Webform Sync Service socket")
+	line("")
+	line("[Socket]")
+	if path, ok := strings.CutPrefix(server.Listen, "unix://"); ok {
+		line("ListenStream=%s", path)
+		line("SocketMode=%s", server.SocketMode)
+		line("SocketUser=%s", u.user)
+	} else {
+		line("ListenStream=%s", listenAddress(server.Host, server.Port))
+	}
+	if server.TLS.Enabled && server.TLS.RedirectPort > 0 {
+		line("ListenStream=%s", listenAddress(server.Host, server.TLS.RedirectPort))
+	}
+	line("")
+	line("[Install]")
+	line("WantedBy=sockets.target")
+	return b.String()
+}
+
+// listenAddress formats a ListenStream address; 0.0.0.0 means every
+// interface, which systemd writes as a bare port
+func listenAddress(host string, port int) string {
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		return fmt.Sprint(port)
+	}
+	if strings.Contains(host, ":") {
+		return fmt.Sprintf("[%s]:%d", host, port)
+	}
+	return fmt.Sprintf("%s:%d", host, port)
+}
+
+// writablePaths lists the directories the service writes to
+func (u *serviceUnit) writablePaths() []string {
+	cfg := u.cfg
+	dirs := map[string]bool{}
+	add := func(path string) {
+		if path == "" {
+			return
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(u.workDir, path)
+		}
+		dirs[filepath.Clean(path)] = true
+	}
+
+	add(cfg.Storage.DataDir)
+	if cfg.Storage.Backup.Enabled {
+		add(cfg.Storage.Backup.BackupDir)
+	}
+	if cfg.Logging.Output != "console" {
+		add(filepath.Dir(cfg.Logging.LogFile))
+	}
+	if cfg.Logging.AccessLog.Enabled {
+		add(filepath.Dir(cfg.Logging.AccessLog.File))
+	}
+	if cfg.Server.TLS.Autocert.Enabled {
+		add(cfg.Server.TLS.Autocert.CacheDir)
+	}
+	if path, ok := strings.CutPrefix(cfg.Server.Listen, "unix://"); ok && !u.socket {
+		add(filepath.Dir(path))
+	}
+
+	paths := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		paths = append(paths, dir)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// protectHome hides home directories, unless the service lives in one
+func (u *serviceUnit) protectHome() string {
+	paths := append([]string{u.executable, u.configPath, u.workDir}, u.writablePaths()...)
+	for _, path := range paths {
+		for _, home := range []string{"/home/", "/root/", "/run/user/"} {
+			if strings.HasPrefix(path+"/", home) {
+				return "read-only"
+			}
+		}
+	}
+	return "yes"
+}
+
+// needsBindCapability reports whether the service itself binds a port
+// below 1024, which socket activation would do for it instead
+func (u *serviceUnit) needsBindCapability() bool {
+	if u.socket {
+		return false
+	}
+	server := u.cfg.Server
+	if server.Listen == "" && server.Port < 1024 {
+		return true
+	}
+	return server.TLS.Enabled && server.TLS.RedirectPort > 0 && server.TLS.RedirectPort < 1024
+}
+
+// quoteUnitArg quotes a command line argument for systemd if it needs it
+func quoteUnitArg(arg string) string {
+	if !strings.ContainsAny(arg, " \t\"'\\") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// terminalSize returns the standard terminal size; it isn't looked up here
+func terminalSize(f *os.File) (width, height int) {
+	return 80, 24
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/server"
+)
+
+// ANSI escapes for drawing the dashboard
+const (
+	ansiAltScreen  = "\x1b[?1049h\x1b[?25l"
+	ansiMainScreen = "\x1b[?25h\x1b[?1049l"
+	ansiHome       = "\x1b[H"
+	ansiClearLine  = "\x1b[K"
+	ansiClearBelow = "\x1b[J"
+	ansiBold       = "\x1b[1m"
+	ansiDim        = "\x1b[2m"
+	ansiRed        = "\x1b[31m"
+	ansiReset      = "\x1b[0m"
+)
+
+// sparkBars draw requests per second, from none to the busiest second
+var sparkBars = []rune(" ▁▂▃▄▅▆▇█")
+
+// dashboardClient polls GET /api/v1/admin/dashboard with the admin
+// credentials from the config
+type dashboardClient struct {
+	http   *http.Client
+	base   string
+	config *config.AuthenticationConfig
+}
+
+// runTUI shows live stats of the running service in the terminal, read over
+// the admin API, until interrupted. It returns the process exit code.
+func runTUI(args []string) int {
+	flags := flag.NewFlagSet("tui", flag.ContinueOnError)
+	configPath := flags.String("config", "webform-sync.yml", "path to the config file, for the server's address and admin credentials")
+	serverURL := flags.String("server", "", "server to watch, e.g. https://sync.example.com:8765 (default: the address in the config)")
+	interval := flags.Duration("interval", 2*time.Second, "how often to refresh")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: webform-sync tui [-config path] [-server url] [-interval 2s]")
+		fmt.Fprintln(flags.Output(), "Shows requests per second, recent syncs, devices and the log tail of the running service. Press Ctrl-C to quit.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	if *interval < 500*time.Millisecond {
+		fmt.Fprintln(os.Stderr, "-interval must be at least 500ms")
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load %s: %v\n", *configPath, err)
+		return 1
+	}
+	client := newDashboardClient(cfg, *serverURL)
+	if client == nil {
+		fmt.Fprintf(os.Stderr, "Can't connect to %s; give the server's URL with -server\n", cfg.Server.Listen)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	out := bufio.NewWriter(os.Stdout)
+	fmt.Fprint(out, ansiAltScreen)
+	defer func() {
+		fmt.Fprint(out, ansiMainScreen)
+		out.Flush()
+	}()
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	// The last good dashboard stays up while the server can't be reached,
+	// such as during a restart
+	var last *server.Dashboard
+	for {
+		dashboard, err := client.fetch(ctx)
+		if ctx.Err() != nil {
+			return 0
+		}
+		if err == nil {
+			last = dashboard
+		}
+
+		width, height := terminalSize(os.Stdout)
+		fmt.Fprint(out, ansiHome)
+		for _, line := range renderDashboard(last, err, client.base, *interval, width, height) {
+			fmt.Fprint(out, line, ansiReset, ansiClearLine, "\n")
+		}
+		fmt.Fprint(out, ansiClearBelow)
+		out.Flush()
+
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-ticker.C:
+		}
+	}
+}
+
+// newDashboardClient connects to the server given, or to the one the config
+// describes: its Unix socket, or its port on this machine. It returns nil
+// for a named pipe.
+func newDashboardClient(cfg *config.Config, serverURL string) *dashboardClient {
+	c := &dashboardClient{
+		http:   &http.Client{Timeout: 10 * time.Second},
+		base:   strings.TrimSuffix(serverURL, "/"),
+		config: &cfg.Authentication,
+	}
+	if c.base != "" {
+		return c
+	}
+
+	srv := cfg.Server
+	if path, ok := strings.CutPrefix(srv.Listen, "unix://"); ok {
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		c.base = "http://localhost"
+		return c
+	}
+	if srv.Listen != "" {
+		return nil
+	}
+
+	host := srv.Host
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	scheme := "http"
+	if srv.TLS.Enabled {
+		scheme = "https"
+	}
+	c.base = scheme + "://" + net.JoinHostPort(host, strconv.Itoa(srv.Port))
+	return c
+}
+
+// fetch gets the dashboard, sized for a terminal's worth of syncs and log
+func (c *dashboardClient) fetch(ctx context.Context) (*server.Dashboard, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.base+"/api/v1/admin/dashboard?syncs=50&log_lines=200", nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.Enabled {
+		if c.config.Type == "basic" {
+			req.SetBasicAuth(c.config.Username, c.config.Password)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+c.config.APIToken)
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data  server.Dashboard `json:"data"`
+		Error string           `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("%s: unexpected response", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, body.Error)
+	}
+	return &body.Data, nil
+}
+
+// renderDashboard lays the dashboard out in lines fitting the terminal
+func renderDashboard(d *server.Dashboard, fetchErr error, target string, interval time.Duration, width, height int) []string {
+	now := time.Now()
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fit(fmt.Sprintf(format, args...), width))
+	}
+
+	title := ansiBold + "webform-sync" + ansiReset + " " + target
+	if d != nil {
+		title += fmt.Sprintf(" · up %s · %d presets · %d devices", d.Uptime, d.Presets, len(d.Devices))
+	}
+	add("%s", title)
+	if fetchErr != nil {
+		add("%sCan't refresh: %s%s", ansiRed, printable(fetchErr.Error()), ansiReset)
+	}
+	if d == nil {
+		return lines
+	}
+
+	if r := d.Requests; r != nil {
+		add("Requests  %.1f/s   %d in all   %d failed (5xx)", r.PerSecond, r.Total, r.Errors)
+		add("Last 60s  %s  peak %d/s", sparkline(r.LastMinute, width-24), peak(r.LastMinute))
+	}
+	if len(d.Jobs) == 0 {
+		add("Jobs      %snone running%s", ansiDim, ansiReset)
+	}
+	for _, job := range d.Jobs {
+		progress := ""
+		if job.Progress != nil && job.Progress.Total > 0 {
+			progress = fmt.Sprintf(" %d/%d", job.Progress.Done, job.Progress.Total)
+		}
+		add("Job       %s%s %s (%s)", job.Kind, progress, printable(job.Step), now.Sub(job.StartedAt).Truncate(time.Second))
+	}
+
+	// The footer and section headings are fixed; syncs and devices share
+	// what remains with the log, which gets the most
+	footer := fmt.Sprintf("%sRefreshing every %s · Ctrl-C to quit%s", ansiDim, interval, ansiReset)
+	free := height - len(lines) - 7
+	syncRows := min(len(d.Syncs), max(free/4, 1))
+	deviceRows := min(len(d.Devices), max(free/4, 1))
+	logRows := max(free-syncRows-deviceRows, 1)
+
+	add("")
+	add("%sRECENT SYNCS%s", ansiBold, ansiReset)
+	if len(d.Syncs) == 0 {
+		add("%snone yet%s", ansiDim, ansiReset)
+	}
+	for _, e := range d.Syncs[:syncRows] {
+		add("%s  %-7s %-30s %s", e.Timestamp.Local().Format("15:04:05"), e.Action,
+			truncate(printable(orFallback(e.PresetName, e.PresetID)), 30), printable(orFallback(e.DeviceName, e.DeviceID)))
+	}
+
+	add("")
+	add("%sDEVICES%s", ansiBold, ansiReset)
+	if len(d.Devices) == 0 {
+		add("%snone registered%s", ansiDim, ansiReset)
+	}
+	for _, dev := range d.Devices[:deviceRows] {
+		seen := "seen " + ago(now, dev.LastSeen)
+		if dev.Revoked() {
+			seen = "revoked " + ago(now, *dev.RevokedAt)
+		}
+		add("%-24s %-18s %s", truncate(printable(orFallback(dev.Name, dev.ID)), 24), truncate(printable(dev.Platform+" "+dev.Browser), 18), seen)
+	}
+
+	if d.Log != nil {
+		add("")
+		add("%sLOG%s", ansiBold, ansiReset)
+		for _, line := range d.Log[max(len(d.Log)-logRows, 0):] {
+			add("%s", printable(line))
+		}
+	}
+
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	return append(lines[:max(height-1, 1)], fit(footer, width))
+}
+
+// sparkline draws counts as bars, using at most width of the latest
+func sparkline(counts []int64, width int) string {
+	if width < len(counts) {
+		counts = counts[len(counts)-max(width, 0):]
+	}
+	top := peak(counts)
+	var b strings.Builder
+	for _, n := range counts {
+		if top == 0 {
+			b.WriteRune(sparkBars[0])
+			continue
+		}
+		b.WriteRune(sparkBars[int((n*int64(len(sparkBars)-1)+top-1)/top)])
+	}
+	return b.String()
+}
+
+func peak(counts []int64) int64 {
+	var top int64
+	for _, n := range counts {
+		top = max(top, n)
+	}
+	return top
+}
+
+// ago describes how long before now t was, roughly
+func ago(now, t time.Time) string {
+	d := now.Sub(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	}
+}
+
+func orFallback(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
+
+// printable replaces control characters, so text from the server such as
+// device names and log lines can't move the cursor or recolour the screen
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// truncate shortens s to n characters, marking the cut
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// fit cuts a line to the terminal width, skipping escape sequences when
+// counting, so long lines don't wrap and push the dashboard off screen
+func fit(line string, width int) string {
+	var b strings.Builder
+	visible, escape := 0, false
+	for _, r := range line {
+		switch {
+		case escape:
+			escape = r != 'm'
+		case r == '\x1b':
+			escape = true
+		case visible == width:
+			return b.String()
+		default:
+			visible++
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
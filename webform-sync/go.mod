@@ -9,3 +9,15 @@ require (
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 	gopkg.in/yaml.v3 v3.0.1
 )
+
+require github.com/graphql-go/graphql v0.8.1
+
+require golang.org/x/crypto v0.21.0
+
+require golang.org/x/net v0.22.0
+
+require golang.org/x/sys v0.18.0
+
+require go.starlark.net v0.0.0-20240411212711-9b43f0afd521
+
+require github.com/klauspost/compress v1.17.4
@@ -0,0 +1,237 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Passphrase-protected archives are a chunked AES-256-GCM stream so exports
+// can be encrypted while streaming:
+//
+//	magic (8) | salt (16) | nonce prefix (8) | chunks...
+//	chunk:    length (4, big-endian) | sealed data (length bytes)
+//
+// Each chunk's nonce is the prefix followed by a 32-bit counter, and the final
+// chunk is authenticated with a distinct additional-data marker so truncated
+// archives are detected.
+
+// Magic identifies an encrypted archive
+var Magic = []byte("WFSENC1\n")
+
+// ErrInvalidPassphrase is returned when decryption fails authentication
+var ErrInvalidPassphrase = errors.New("invalid passphrase or corrupted archive")
+
+const (
+	saltSize    = 16
+	prefixSize  = 8
+	chunkSize   = 64 * 1024
+	maxChunkLen = chunkSize + 16
+)
+
+var (
+	adData  = []byte("data")
+	adFinal = []byte("final")
+)
+
+// deriveKey stretches a passphrase into an AES-256 key
+func deriveKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], counter)
+	return nonce
+}
+
+// encryptWriter buffers plaintext and seals it chunk by chunk
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+// NewEncryptWriter returns a writer that encrypts everything written to it.
+// Close must be called to write the final authenticated chunk.
+func NewEncryptWriter(w io.Writer, passphrase string) (io.WriteCloser, error) {
+	salt := make([]byte, saltSize)
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(append(append([]byte{}, Magic...), salt...), prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed archive")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+
+		// Only flush a full chunk once more data follows, so the final chunk
+		// is always sealed by Close
+		if len(e.buf) == cap(e.buf) && len(p) > 0 {
+			if err := e.flush(adData); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) flush(ad []byte) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.counter), e.buf, ad)
+	e.counter++
+	e.buf = e.buf[:0]
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := e.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// Close seals the final chunk
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.flush(adFinal)
+}
+
+// decryptReader opens chunks as they are read
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	plain   []byte
+	done    bool
+}
+
+// IsEncrypted reports whether data starts with the archive magic
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, Magic)
+}
+
+// NewDecryptReader returns a reader yielding the plaintext of an encrypted archive
+func NewDecryptReader(r io.Reader, passphrase string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(Magic)+saltSize+prefixSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("failed to read archive header: %w", err)
+	}
+	if !bytes.Equal(header[:len(Magic)], Magic) {
+		return nil, errors.New("not an encrypted archive")
+	}
+
+	salt := header[len(Magic) : len(Magic)+saltSize]
+	prefix := header[len(Magic)+saltSize:]
+
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{r: br, aead: aead, prefix: append([]byte{}, prefix...)}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	var length [4]byte
+	if _, err := io.ReadFull(d.r, length[:]); err != nil {
+		return fmt.Errorf("truncated archive: %w", err)
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxChunkLen {
+		return ErrInvalidPassphrase
+	}
+
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return fmt.Errorf("truncated archive: %w", err)
+	}
+
+	nonce := chunkNonce(d.prefix, d.counter)
+	d.counter++
+
+	// A chunk is final if it authenticates with the final marker
+	if plain, err := d.aead.Open(nil, nonce, sealed, adData); err == nil {
+		d.plain = plain
+		return nil
+	}
+	plain, err := d.aead.Open(nil, nonce, sealed, adFinal)
+	if err != nil {
+		return ErrInvalidPassphrase
+	}
+	d.plain = plain
+	d.done = true
+	return nil
+}
@@ -0,0 +1,387 @@
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/logger"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// renewBefore is how long before expiry a certificate is renewed
+	renewBefore = 30 * 24 * time.Hour
+	// checkInterval is how often Run checks whether to renew
+	checkInterval = 12 * time.Hour
+	// obtainTimeout bounds getting one certificate
+	obtainTimeout = 5 * time.Minute
+	// retryAfter stops a failing ACME service being asked again on every
+	// TLS handshake
+	retryAfter = time.Minute
+
+	challengePath = "/.well-known/acme-challenge/"
+)
+
+// Manager obtains a certificate covering all the configured domains from an
+// ACME service and renews it ahead of expiry. The service checks each
+// domain by fetching a token from HTTPHandler, so that must be reachable on
+// port 80 of every domain.
+type Manager struct {
+	cfg    config.AutocertConfig
+	logger *logger.Logger
+
+	// obtaining serialises orders; client is created by the first one
+	obtaining sync.Mutex
+	client    *acme.Client
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// tokens maps pending HTTP-01 tokens to their responses
+	tokens map[string]string
+	failed time.Time
+}
+
+// NewManager creates a Manager, starting with the cached certificate if
+// there is one for the same domains
+func NewManager(cfg config.AutocertConfig, log *logger.Logger) (*Manager, error) {
+	if err := os.MkdirAll(cfg.CacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create certificate cache: %w", err)
+	}
+	domains := make([]string, len(cfg.Domains))
+	for i, domain := range cfg.Domains {
+		domains[i] = strings.ToLower(strings.TrimSuffix(domain, "."))
+	}
+	cfg.Domains = domains
+
+	m := &Manager{cfg: cfg, logger: log, tokens: map[string]string{}}
+	cert, err := m.loadCached()
+	switch {
+	case err == nil:
+		m.cert = cert
+	case !errors.Is(err, os.ErrNotExist):
+		log.Warn("Ignoring cached certificate: %v", err)
+	}
+	return m, nil
+}
+
+// GetCertificate is a tls.Config.GetCertificate callback. The first
+// handshake waits while a certificate is obtained if none is cached.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if name := strings.ToLower(strings.TrimSuffix(hello.ServerName, ".")); name != "" && !m.covers(name) {
+		return nil, fmt.Errorf("no certificate for %q", name)
+	}
+	if cert := m.current(); cert != nil {
+		return cert, nil
+	}
+
+	m.mu.RLock()
+	failed := m.failed
+	m.mu.RUnlock()
+	if time.Since(failed) < retryAfter {
+		return nil, fmt.Errorf("no certificate yet; the last attempt failed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), obtainTimeout)
+	defer cancel()
+	return m.obtain(ctx)
+}
+
+// HTTPHandler answers ACME challenges and passes other requests to next
+func (m *Manager) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.URL.Path, challengePath)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m.mu.RLock()
+		response, ok := m.tokens[token]
+		m.mu.RUnlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(response))
+	})
+}
+
+// Run gets a certificate if there is none and renews it when it nears
+// expiry, until stop is closed
+func (m *Manager) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		if cert := m.current(); cert == nil || time.Until(cert.Leaf.NotAfter) < renewBefore {
+			obtainCtx, done := context.WithTimeout(ctx, obtainTimeout)
+			if _, err := m.obtain(obtainCtx); err != nil && ctx.Err() == nil {
+				m.logger.Error("Failed to obtain a certificate for %s: %v", strings.Join(m.cfg.Domains, ", "), err)
+			}
+			done()
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// current returns the certificate in use, or nil if there is none yet
+func (m *Manager) current() *tls.Certificate {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cert
+}
+
+// covers reports whether name is one of the configured domains
+func (m *Manager) covers(name string) bool {
+	for _, domain := range m.cfg.Domains {
+		if name == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// obtain orders a new certificate, caches it and puts it in use
+func (m *Manager) obtain(ctx context.Context) (*tls.Certificate, error) {
+	m.obtaining.Lock()
+	defer m.obtaining.Unlock()
+
+	// Another caller may have got one while this one waited
+	if cert := m.current(); cert != nil && time.Until(cert.Leaf.NotAfter) >= renewBefore {
+		return cert, nil
+	}
+
+	cert, err := m.order(ctx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.failed = time.Now()
+		return nil, err
+	}
+	m.cert = cert
+	m.logger.Info("Obtained a certificate for %s, valid until %s",
+		strings.Join(m.cfg.Domains, ", "), cert.Leaf.NotAfter.Format(time.RFC3339))
+	return cert, nil
+}
+
+// order runs one ACME order through to an issued certificate
+func (m *Manager) order(ctx context.Context) (*tls.Certificate, error) {
+	client, err := m.account(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.cfg.Domains...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to place order: %w", err)
+	}
+	for _, url := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, url); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, fmt.Errorf("order was not completed: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.cfg.Domains[0]},
+		DNSNames: m.cfg.Domains,
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate request: %w", err)
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize order: %w", err)
+	}
+
+	data, err := encodePEM(key, chain)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parsePEM(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(m.certPath(), data, 0600); err != nil {
+		m.logger.Warn("Failed to cache certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// authorize proves control of one domain with an HTTP-01 challenge
+func (m *Manager) authorize(ctx context.Context, client *acme.Client, url string) error {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no http-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	response, err := client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return fmt.Errorf("failed to answer challenge: %w", err)
+	}
+	m.mu.Lock()
+	m.tokens[challenge.Token] = response
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.tokens, challenge.Token)
+		m.mu.Unlock()
+	}()
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("failed to accept challenge for %s: %w", authz.Identifier.Value, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("%s was not authorized (is port 80 reachable?): %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// account returns a client registered with the ACME service, creating the
+// account key on first use
+func (m *Manager) account(ctx context.Context) (*acme.Client, error) {
+	if m.client != nil {
+		return m.client, nil
+	}
+
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: m.cfg.DirectoryURL}
+
+	account := &acme.Account{}
+	if m.cfg.Email != "" {
+		account.Contact = []string{"mailto:" + m.cfg.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %w", err)
+	}
+	m.client = client
+	return client, nil
+}
+
+// accountKey loads the ACME account key, or generates and saves one
+func (m *Manager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(m.cfg.CacheDir, "account.key")
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not a PEM file", path)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		return key, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate account key: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode account key: %w", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, fmt.Errorf("failed to save account key: %w", err)
+	}
+	return key, nil
+}
+
+// certPath is the cached certificate: its key followed by the chain
+func (m *Manager) certPath() string {
+	return filepath.Join(m.cfg.CacheDir, "certificate.pem")
+}
+
+// loadCached reads the cached certificate, rejecting it if it doesn't cover
+// every configured domain
+func (m *Manager) loadCached() (*tls.Certificate, error) {
+	data, err := os.ReadFile(m.certPath())
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parsePEM(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, domain := range m.cfg.Domains {
+		if err := cert.Leaf.VerifyHostname(domain); err != nil {
+			return nil, fmt.Errorf("cached certificate is for other domains")
+		}
+	}
+	return cert, nil
+}
+
+// encodePEM encodes a private key and certificate chain
+func encodePEM(key *ecdsa.PrivateKey, chain [][]byte) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode certificate key: %w", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, cert := range chain {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})...)
+	}
+	return data, nil
+}
+
+// parsePEM decodes a certificate written by encodePEM
+func parsePEM(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return &cert, nil
+}
@@ -0,0 +1,71 @@
+// Package certs supplies the server's TLS certificates, either from PEM
+// files or obtained and renewed automatically from an ACME service such as
+// Let's Encrypt.
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Files serves a certificate from PEM files, loading it again whenever
+// either file changes, so a renewed certificate is picked up without a
+// restart
+type Files struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewFiles loads a certificate and its key, failing if they can't be used
+func NewFiles(certFile, keyFile string) (*Files, error) {
+	f := &Files{certFile: certFile, keyFile: keyFile}
+	if _, err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// GetCertificate is a tls.Config.GetCertificate callback
+func (f *Files) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return f.load()
+}
+
+// load returns the certificate, reading the files again if they have
+// changed. A certificate that fails to load part way through a renewal
+// leaves the previous one in use.
+func (f *Files) load() (*tls.Certificate, error) {
+	modTime := latestModTime(f.certFile, f.keyFile)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cert != nil && modTime.Equal(f.modTime) {
+		return f.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		if f.cert != nil {
+			return f.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	f.cert, f.modTime = &cert, modTime
+	return f.cert, nil
+}
+
+// latestModTime returns the newest modification time of the files
+func latestModTime(paths ...string) time.Time {
+	var latest time.Time
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
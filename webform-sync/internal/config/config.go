@@ -3,7 +3,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
+	"github.com/tezza1971/webform-sync/internal/pii"
 	"gopkg.in/yaml.v3"
 )
 
@@ -12,12 +14,82 @@ type Config struct {
 	Server         ServerConfig         `yaml:"server"`
 	AccessControl  AccessControlConfig  `yaml:"access_control"`
 	URLFilter      URLFilterConfig      `yaml:"url_filter"`
+	FieldPolicy    FieldPolicyConfig    `yaml:"field_policy"`
+	PIIDetection   PIIDetectionConfig   `yaml:"pii_detection"`
+	Transforms     TransformsConfig     `yaml:"transforms"`
+	Suggest        SuggestConfig        `yaml:"suggest"`
 	Storage        StorageConfig        `yaml:"storage"`
 	Logging        LoggingConfig        `yaml:"logging"`
 	CORS           CORSConfig           `yaml:"cors"`
 	Authentication AuthenticationConfig `yaml:"authentication"`
 	Performance    PerformanceConfig    `yaml:"performance"`
 	Maintenance    MaintenanceConfig    `yaml:"maintenance"`
+	Tenancy        TenancyConfig        `yaml:"tenancy"`
+	Cluster        ClusterConfig        `yaml:"cluster"`
+	Sharing        SharingConfig        `yaml:"sharing"`
+	StorageSync    StorageSyncConfig    `yaml:"storage_sync"`
+	WebDAV         WebDAVConfig         `yaml:"webdav"`
+	Discovery      DiscoveryConfig      `yaml:"discovery"`
+	Webhooks       WebhooksConfig       `yaml:"webhooks"`
+	Notifications  NotificationsConfig  `yaml:"notifications"`
+	UsageExport    UsageExportConfig    `yaml:"usage_export"`
+	Telemetry      TelemetryConfig      `yaml:"telemetry"`
+	Secrets        SecretsConfig        `yaml:"secrets"`
+	Plugins        PluginsConfig        `yaml:"plugins"`
+	// Features turns optional features on or off by name (see Features);
+	// those not listed are on
+	Features map[string]bool `yaml:"features"`
+	// Deprecations mark API routes due to be removed, so clients are warned
+	// by response headers before they break
+	Deprecations []DeprecationConfig `yaml:"deprecations"`
+}
+
+// DeprecationConfig marks a route, or every route under a prefix, as
+// deprecated
+type DeprecationConfig struct {
+	// Path is a route as registered, such as /api/v1/presets/{id}, or a
+	// prefix ending in *, such as /api/v1/storage/*
+	Path string `yaml:"path"`
+	// Methods limits the notice to these methods; all by default
+	Methods []string `yaml:"methods"`
+	// Since is the date the route was deprecated, as YYYY-MM-DD
+	Since string `yaml:"since"`
+	// Sunset is the date the route is due to be removed, as YYYY-MM-DD
+	// (optional)
+	Sunset string `yaml:"sunset"`
+	// Link is a page describing the change or the replacement (optional)
+	Link string `yaml:"link"`
+	// Message says what to use instead (optional)
+	Message string `yaml:"message"`
+}
+
+// DeprecationDateLayout is the layout of since and sunset
+const DeprecationDateLayout = "2006-01-02"
+
+// Feature names for the features section
+const (
+	// FeatureDeltaSync serves the sync log and sync status, so clients can
+	// fetch what changed rather than every preset
+	FeatureDeltaSync = "delta_sync"
+	// FeatureE2EEncryption accepts presets encrypted by their device
+	FeatureE2EEncryption = "e2e_encryption"
+	// FeatureWebhooks delivers events to webhooks.endpoints and serves the
+	// delivery history
+	FeatureWebhooks    = "webhooks"
+	FeatureShareLinks  = "share_links"
+	FeatureGraphQL     = "graphql"
+	FeatureImport      = "import"
+	FeatureExport      = "export"
+	FeatureSuggestions = "suggestions"
+)
+
+// Features are the names the features section accepts
+var Features = []string{FeatureDeltaSync, FeatureE2EEncryption, FeatureWebhooks, FeatureShareLinks,
+	FeatureGraphQL, FeatureImport, FeatureExport, FeatureSuggestions}
+
+// FeatureEnabled reports whether an optional feature is turned on
+func (c *Config) FeatureEnabled(name string) bool {
+	return c.Features[name]
 }
 
 // ServerConfig contains server-specific settings
@@ -27,8 +99,54 @@ type ServerConfig struct {
 	Host          string `yaml:"host"`
 	ReadTimeout   int    `yaml:"read_timeout"`
 	WriteTimeout  int    `yaml:"write_timeout"`
+
+	// Listen replaces host and port with a Unix socket (unix:///path) or a
+	// Windows named pipe (npipe:////./pipe/name)
+	Listen string `yaml:"listen"`
+	// SocketMode is the Unix socket's permissions, in octal
+	SocketMode string `yaml:"socket_mode"`
+
+	// TrustedProxies are the reverse proxies, as IPs or CIDR ranges, whose
+	// X-Forwarded-For and X-Real-IP headers give the client's address
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// ShutdownTimeout bounds a graceful shutdown, in seconds
+	ShutdownTimeout int `yaml:"shutdown_timeout"`
+
+	TLS TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig serves HTTPS, with a certificate from files or one obtained
+// from an ACME service such as Let's Encrypt
+type TLSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// CertFile and KeyFile are PEM files; they are re-read when they
+	// change, so renewing them needs no restart
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// RedirectPort listens for plain HTTP, redirecting it to HTTPS and
+	// answering ACME challenges; 0 disables it
+	RedirectPort int            `yaml:"redirect_port"`
+	Autocert     AutocertConfig `yaml:"autocert"`
+}
+
+// AutocertConfig obtains and renews a certificate automatically, using ACME
+// HTTP-01 challenges
+type AutocertConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Domains []string `yaml:"domains"`
+	// Email is given to the ACME service for expiry notices
+	Email string `yaml:"email"`
+	// AcceptTOS confirms acceptance of the ACME service's terms of service
+	AcceptTOS bool `yaml:"accept_tos"`
+	// CacheDir keeps the account key and certificate across restarts
+	CacheDir     string `yaml:"cache_dir"`
+	DirectoryURL string `yaml:"directory_url"`
 }
 
+// LetsEncryptURL is the ACME directory used unless another is configured
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
 // AccessControlConfig contains IP access control settings
 type AccessControlConfig struct {
 	Mode      string   `yaml:"mode"`
@@ -45,21 +163,199 @@ type URLFilterConfig struct {
 	WhitelistOverrides bool   `yaml:"whitelist_overrides"`
 }
 
+// FieldPolicyConfig keeps credentials out of the presets database by
+// checking field names when presets are saved. Fields of client-encrypted
+// presets can't be seen, so they aren't checked.
+type FieldPolicyConfig struct {
+	// Action is reject, strip or off
+	Action string `yaml:"action"`
+	// Fields are field name patterns, where * matches anything. Case and
+	// the separators "-", "_", "." and spaces are ignored, so card_number
+	// also matches cardNumber. Defaults to DefaultSensitiveFields.
+	Fields []string `yaml:"fields"`
+	// Overrides change the policy for presets whose scope value matches;
+	// the first match applies
+	Overrides []FieldPolicyOverride `yaml:"overrides"`
+}
+
+// FieldPolicyOverride changes the sensitive field policy for some scopes
+type FieldPolicyOverride struct {
+	// Scope is a scope value pattern, where * matches anything
+	Scope string `yaml:"scope"`
+	// Action replaces the policy's action when set
+	Action string `yaml:"action"`
+	// Allow are field name patterns allowed for these scopes
+	Allow []string `yaml:"allow"`
+}
+
+// DefaultSensitiveFields are the field names refused when
+// field_policy.fields is not set
+var DefaultSensitiveFields = []string{
+	"*password*", "*passwd*", "*passphrase*",
+	"*cvv*", "*cvc*", "*securitycode*",
+	"*cardnumber*", "*creditcard*", "ccnumber", "ccnum", "pan",
+	"ssn", "*socialsecurity*",
+}
+
+// PIIDetectionConfig looks for personal data in field values when presets
+// are saved, and tags the presets it finds it in
+type PIIDetectionConfig struct {
+	// Mode is off, warn (save and tag), confirm (save only when the client
+	// confirms) or block
+	Mode string `yaml:"mode"`
+	// Types are the kinds of data to look for: card, iban, ssn and email.
+	// Defaults to all of them.
+	Types []string `yaml:"types"`
+}
+
+// TransformsConfig runs a Starlark script over preset fields as presets are
+// saved and read, to normalise or validate them
+type TransformsConfig struct {
+	// Script is the path of the script; transforms are off when empty
+	Script string `yaml:"script"`
+	// TimeoutMS bounds each call of a hook (default 100)
+	TimeoutMS int `yaml:"timeout_ms"`
+	// MaxSteps bounds the work each call may do, in Starlark execution
+	// steps (default 1000000)
+	MaxSteps uint64 `yaml:"max_steps"`
+}
+
+// SuggestConfig weighs what GET /presets/suggest ranks a page's presets
+// by. Each factor scores a preset from 0 to 1; a preset's score is their
+// weighted sum.
+type SuggestConfig struct {
+	// SpecificityWeight favours presets of scopes closer to the page's URL
+	SpecificityWeight float64 `yaml:"specificity_weight"`
+	// RecencyWeight favours presets used (or, if never used, saved) lately
+	RecencyWeight float64 `yaml:"recency_weight"`
+	// FrequencyWeight favours presets used more often
+	FrequencyWeight float64 `yaml:"frequency_weight"`
+	// RecencyHalfLifeDays is how long it takes the recency score to halve
+	// (default 30)
+	RecencyHalfLifeDays int `yaml:"recency_half_life_days"`
+}
+
 // StorageConfig contains storage settings
 type StorageConfig struct {
-	DataDir       string       `yaml:"data_dir"`
-	DBFile        string       `yaml:"db_file"`
-	EncryptAtRest bool         `yaml:"encrypt_at_rest"`
-	EncryptionKey string       `yaml:"encryption_key"`
-	Backup        BackupConfig `yaml:"backup"`
+	DataDir       string `yaml:"data_dir"`
+	DBFile        string `yaml:"db_file"`
+	EncryptAtRest bool   `yaml:"encrypt_at_rest"`
+	EncryptionKey string `yaml:"encryption_key"`
+	// EncryptionKeyFile reads EncryptionKey from a file instead
+	EncryptionKeyFile string       `yaml:"encryption_key_file"`
+	Backup            BackupConfig `yaml:"backup"`
+	Quota             QuotaConfig  `yaml:"quota"`
+
+	// BlobThresholdBytes moves preset fields of at least this many bytes,
+	// such as long textarea drafts, out of the presets table into a table
+	// of blobs (0 = never)
+	BlobThresholdBytes int64 `yaml:"blob_threshold_bytes"`
+	// Compression compresses preset fields before they are stored
+	Compression CompressionConfig `yaml:"compression"`
+	// Backend keeps presets in the storage backend plugin it names instead
+	// of the database (empty = the database)
+	Backend PluginConfig `yaml:"backend"`
+
+	// Connection pool (0 = database/sql default)
+	MaxOpenConns           int `yaml:"max_open_conns"`
+	MaxIdleConns           int `yaml:"max_idle_conns"`
+	ConnMaxLifetimeMinutes int `yaml:"conn_max_lifetime_minutes"`
+
+	// QueryTimeoutSeconds bounds preset list, stream and export queries (0 =
+	// no limit)
+	QueryTimeoutSeconds int `yaml:"query_timeout_seconds"`
+	// SlowQueryMs logs statements that take longer, with their SQL, and
+	// counts them in the usage metrics (0 = off)
+	SlowQueryMs int `yaml:"slow_query_ms"`
+
+	Retry          RetryConfig          `yaml:"retry"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+}
+
+// RetryConfig retries statements that find the database busy
+// (SQLITE_BUSY), such as while a backup or VACUUM holds it
+type RetryConfig struct {
+	// MaxAttempts is the most times a statement is tried (default 3; 1
+	// turns retries off)
+	MaxAttempts int `yaml:"max_attempts"`
+	// BackoffMs is the wait before the first retry, doubling for each one
+	// after it (default 50)
+	BackoffMs int `yaml:"backoff_ms"`
+}
+
+// CircuitBreakerConfig makes storage calls fail fast once the database has
+// failed repeatedly, rather than each waiting to fail in turn
+type CircuitBreakerConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// FailureThreshold is how many failures in a row open the breaker
+	// (default 5)
+	FailureThreshold int `yaml:"failure_threshold"`
+	// OpenSeconds is how long it stays open before one call is let through
+	// to try the database again (default 10)
+	OpenSeconds int `yaml:"open_seconds"`
+}
+
+// CompressionConfig compresses preset fields with zstd at rest
+type CompressionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MinBytes is the smallest fields compressed (default 256); smaller
+	// ones rarely shrink enough to be worth it
+	MinBytes int `yaml:"min_bytes"`
+	// Level is fastest, default, better or best (default "default")
+	Level string `yaml:"level"`
+}
+
+// QuotaConfig contains per-device storage limits (0 = unlimited)
+type QuotaConfig struct {
+	MaxPresetsPerDevice int   `yaml:"max_presets_per_device"`
+	MaxBytesPerDevice   int64 `yaml:"max_bytes_per_device"`
+	MaxPresetBytes      int64 `yaml:"max_preset_bytes"`
 }
 
 // BackupConfig contains backup settings
 type BackupConfig struct {
-	Enabled       bool   `yaml:"enabled"`
-	IntervalHours int    `yaml:"interval_hours"`
-	MaxBackups    int    `yaml:"max_backups"`
-	BackupDir     string `yaml:"backup_dir"`
+	Enabled bool `yaml:"enabled"`
+	// IntervalHours is the time between backups (default 24)
+	IntervalHours int `yaml:"interval_hours"`
+	// MaxBackups is how many backups to keep (0 = all)
+	MaxBackups int    `yaml:"max_backups"`
+	BackupDir  string `yaml:"backup_dir"`
+	// Remotes each get an encrypted copy of every backup, so there is one
+	// off the machine
+	Remotes []BackupRemoteConfig `yaml:"remotes"`
+	// Passphrase encrypts the copies sent to remotes (required with remotes)
+	Passphrase     string `yaml:"passphrase"`
+	PassphraseFile string `yaml:"passphrase_file"`
+}
+
+// BackupRemoteConfig is somewhere backups are copied to
+type BackupRemoteConfig struct {
+	// Name identifies the remote in logs and the backup history (default: its type)
+	Name string `yaml:"name"`
+	// Type is s3, webdav, sftp or plugin
+	Type string `yaml:"type"`
+	// URL is the folder backups go in:
+	//   s3:     https://<endpoint>/<bucket>[/<prefix>] (path-style, so MinIO works too)
+	//   webdav: https://cloud.example.com/remote.php/dav/files/<user>/<folder>
+	//   sftp:   sftp://<user>@<host>[:<port>]/<folder>
+	URL string `yaml:"url"`
+	// Region signs S3 requests (default us-east-1)
+	Region        string `yaml:"region"`
+	AccessKey     string `yaml:"access_key"`
+	SecretKey     string `yaml:"secret_key"`
+	SecretKeyFile string `yaml:"secret_key_file"`
+	// Username and Password log in to WebDAV; Password also works for SFTP
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+	// PrivateKeyFile is an SSH private key for SFTP
+	PrivateKeyFile string `yaml:"private_key_file"`
+	// KnownHostsFile holds the SFTP server's host key (default ~/.ssh/known_hosts)
+	KnownHostsFile string `yaml:"known_hosts_file"`
+	// MaxBackups is how many backups to keep on the remote (0 = storage.backup.max_backups)
+	MaxBackups int `yaml:"max_backups"`
+	// Plugin is the backup store used when Type is plugin, in place of URL
+	Plugin PluginConfig `yaml:"plugin"`
 }
 
 // LoggingConfig contains logging settings
@@ -71,15 +367,48 @@ type LoggingConfig struct {
 	MaxBackups  int    `yaml:"max_backups"`
 	MaxAgeDays  int    `yaml:"max_age_days"`
 	LogRequests bool   `yaml:"log_requests"`
+	// SlowRequestMs logs requests that take longer, with their route and
+	// device, and counts them in the usage metrics (0 = off)
+	SlowRequestMs int `yaml:"slow_request_ms"`
+	// Modules overrides Level per module (see LogModules)
+	Modules   map[string]string `yaml:"modules"`
+	AccessLog AccessLogConfig   `yaml:"access_log"`
+}
+
+// AccessLogConfig contains settings for the per-request access log
+type AccessLogConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	File    string `yaml:"file"`
+	// Format is combined (Apache combined log format) or json
+	Format    string `yaml:"format"`
+	UserAgent bool   `yaml:"user_agent"`
+	Referer   bool   `yaml:"referer"`
 }
 
+// LogModules are the modules whose log level can be set separately: the HTTP
+// server and its handlers, the database layer, and event delivery to
+// webhooks, MQTT and push services
+var LogModules = []string{"server", "storage", "sync"}
+
 // CORSConfig contains CORS settings
 type CORSConfig struct {
-	Enabled        bool     `yaml:"enabled"`
+	Enabled bool `yaml:"enabled"`
+	// AllowedOrigins are origin patterns allowed every method in
+	// AllowedMethods
 	AllowedOrigins []string `yaml:"allowed_origins"`
 	AllowedMethods []string `yaml:"allowed_methods"`
 	AllowedHeaders []string `yaml:"allowed_headers"`
 	MaxAge         int      `yaml:"max_age"`
+	// Rules limit origins to some of the allowed methods. They are checked
+	// before AllowedOrigins, and the first matching rule applies.
+	Rules []CORSRule `yaml:"rules"`
+}
+
+// CORSRule allows origins matching a pattern to use some methods
+type CORSRule struct {
+	Origin string `yaml:"origin" json:"origin"`
+	// Methods defaults to all of cors.allowed_methods
+	Methods []string `yaml:"methods" json:"methods"`
 }
 
 // AuthenticationConfig contains authentication settings
@@ -87,16 +416,97 @@ type AuthenticationConfig struct {
 	Enabled  bool   `yaml:"enabled"`
 	Type     string `yaml:"type"`
 	APIToken string `yaml:"api_token"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	// APITokenFile reads APIToken from a file instead
+	APITokenFile string        `yaml:"api_token_file"`
+	Username     string        `yaml:"username"`
+	Password     string        `yaml:"password"`
+	Lockout      LockoutConfig `yaml:"lockout"`
+	// Plugin is the auth provider used when Type is plugin
+	Plugin PluginConfig `yaml:"plugin"`
+}
+
+// LockoutConfig turns away clients that keep failing to authenticate
+type LockoutConfig struct {
+	// MaxFailures is the failed attempts from one IP within WindowMinutes
+	// that lock it out for DurationMinutes (0 = never lock out)
+	MaxFailures     int `yaml:"max_failures"`
+	WindowMinutes   int `yaml:"window_minutes"`
+	DurationMinutes int `yaml:"duration_minutes"`
 }
 
 // PerformanceConfig contains performance settings
 type PerformanceConfig struct {
-	MaxConcurrentRequests int         `yaml:"max_concurrent_requests"`
-	RateLimit             int         `yaml:"rate_limit"`
-	EnableCompression     bool        `yaml:"enable_compression"`
-	Cache                 CacheConfig `yaml:"cache"`
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests"`
+	// QueueTimeoutMs is how long a request over MaxConcurrentRequests waits
+	// for a slot before getting 503 (0 = reject at once)
+	QueueTimeoutMs int `yaml:"queue_timeout_ms"`
+	// RateLimit is requests per minute per client (0 = unlimited); the
+	// default for both route groups in RateLimits
+	RateLimit         int               `yaml:"rate_limit"`
+	RateLimits        RateLimitConfig   `yaml:"rate_limits"`
+	EnableCompression bool              `yaml:"enable_compression"`
+	Cache             CacheConfig       `yaml:"cache"`
+	SyncLog           SyncLogConfig     `yaml:"sync_log"`
+	WriteBehind       WriteBehindConfig `yaml:"write_behind"`
+}
+
+// WriteBehindConfig queues preset saves and writes them in batches
+type WriteBehindConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// BatchSize is the most saves written in one transaction (default 100)
+	BatchSize int `yaml:"batch_size"`
+	// FlushIntervalMs is the longest a save waits for others to join its
+	// batch (default 20)
+	FlushIntervalMs int `yaml:"flush_interval_ms"`
+	// QueueSize is how many saves can wait; once full, saves wait for room
+	// (default 1000)
+	QueueSize int `yaml:"queue_size"`
+	// Durability is when a save is acknowledged: batch, once its batch has
+	// committed and is on disk (default), or queued, as soon as it is
+	// queued, losing the saves still queued in a crash
+	Durability string `yaml:"durability"`
+}
+
+// SyncLogConfig buffers sync log writes
+type SyncLogConfig struct {
+	// Async writes the sync log from a background worker in batches,
+	// instead of with each save
+	Async bool `yaml:"async"`
+	// BatchSize is the most entries in one write (default 200)
+	BatchSize int `yaml:"batch_size"`
+	// FlushIntervalMs is the longest an entry waits to be written (default
+	// 500)
+	FlushIntervalMs int `yaml:"flush_interval_ms"`
+	// QueueSize is how many entries can wait; once full, saves write their
+	// entries themselves (default 10000)
+	QueueSize int `yaml:"queue_size"`
+}
+
+// RateLimitConfig refines performance.rate_limit
+type RateLimitConfig struct {
+	// Key is what a client is: ip, token (the API token, or the IP without
+	// one) or ip_token (each IP and token pair)
+	Key string `yaml:"key"`
+	// Read and Write are requests per minute for GET/HEAD and for other
+	// methods (0 = rate_limit)
+	Read  int `yaml:"read"`
+	Write int `yaml:"write"`
+	// Burst is the most requests allowed at once (0 = the per-minute limit)
+	Burst int `yaml:"burst"`
+	// Device limits each device on its own as well, so devices sharing an
+	// address behind NAT don't use up each other's requests
+	Device DeviceRateLimitConfig `yaml:"device"`
+}
+
+// DeviceRateLimitConfig limits requests per device, told apart by device
+// ID and API token
+type DeviceRateLimitConfig struct {
+	// Read and Write are requests per minute for GET/HEAD and for other
+	// methods (0 = unlimited)
+	Read  int `yaml:"read"`
+	Write int `yaml:"write"`
+	// Burst is the most requests allowed at once (0 = the per-minute limit)
+	Burst int `yaml:"burst"`
 }
 
 // CacheConfig contains caching settings
@@ -104,13 +514,320 @@ type CacheConfig struct {
 	Enabled    bool `yaml:"enabled"`
 	TTLSeconds int  `yaml:"ttl_seconds"`
 	MaxEntries int  `yaml:"max_entries"`
+	// ClientMaxAgeSeconds is the max-age sent in Cache-Control on preset
+	// reads (0 = clients revalidate every time)
+	ClientMaxAgeSeconds int `yaml:"client_max_age_seconds"`
+	// Backend is memory (default), a cache per server, or redis, one cache
+	// shared by every replica behind a load balancer
+	Backend string      `yaml:"backend"`
+	Redis   RedisConfig `yaml:"redis"`
+	// PublishInvalidations publishes a cache.invalidated event on the event
+	// bus whenever cached lists go stale, for caches outside the service
+	PublishInvalidations bool `yaml:"publish_invalidations"`
+}
+
+// RedisConfig is the Redis server holding the shared cache
+type RedisConfig struct {
+	// Addr is host:port (default 127.0.0.1:6379)
+	Addr         string `yaml:"addr"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+	DB           int    `yaml:"db"`
+	// KeyPrefix starts every key, so servers can share a Redis (default
+	// "webform-sync:"). Tenants add their ID to it.
+	KeyPrefix string `yaml:"key_prefix"`
+	// TimeoutMs bounds each command (default 500); on a timeout the list is
+	// read from the database
+	TimeoutMs int `yaml:"timeout_ms"`
+	// PoolSize is the most connections kept open (default 10)
+	PoolSize int `yaml:"pool_size"`
 }
 
 // MaintenanceConfig contains maintenance settings
 type MaintenanceConfig struct {
+	// AutoCleanup runs the maintenance tasks every CleanupIntervalHours
+	// (default 168)
 	AutoCleanup          bool `yaml:"auto_cleanup"`
 	DeleteAfterDays      int  `yaml:"delete_after_days"`
 	CleanupIntervalHours int  `yaml:"cleanup_interval_hours"`
+	// SyncLogRetentionDays and TombstoneRetentionDays are how long sync log
+	// entries, and the entries recording deleted presets, are kept
+	// (0 = forever)
+	SyncLogRetentionDays   int `yaml:"sync_log_retention_days"`
+	TombstoneRetentionDays int `yaml:"tombstone_retention_days"`
+	// UsageRetentionDays is how long usage events are kept (0 = forever)
+	UsageRetentionDays int `yaml:"usage_retention_days"`
+	// AutoCompactFreePercent is how much of the database file must be free
+	// pages for a maintenance run to VACUUM it (0 = every run)
+	AutoCompactFreePercent int `yaml:"auto_compact_free_percent"`
+	// Retention rules override DeleteAfterDays for the presets they match.
+	// The first rule to match a preset applies.
+	Retention []RetentionRule `yaml:"retention"`
+	// CleanupExempt lists presets that cleanups never remove
+	CleanupExempt   CleanupExemptConfig `yaml:"cleanup_exempt"`
+	StaleDeviceDays int                 `yaml:"stale_device_days"`
+}
+
+// CleanupExemptConfig lists presets cleanup keeps however long they go
+// unused, besides those pinned in their metadata
+type CleanupExemptConfig struct {
+	// Scopes are scope values, in which * matches anything
+	Scopes []string `yaml:"scopes"`
+	// Tags are matched against the tags in a preset's metadata, ignoring case
+	Tags []string `yaml:"tags"`
+}
+
+// RetentionRule sets how long presets with one of its scopes or tags may go
+// unused before cleanup removes them
+type RetentionRule struct {
+	// Scopes are scope values, in which * matches anything
+	Scopes []string `yaml:"scopes"`
+	// Tags are matched against the tags in a preset's metadata, ignoring case
+	Tags []string `yaml:"tags"`
+	// DeleteAfterDays is how long they may go unused (0 = forever)
+	DeleteAfterDays int `yaml:"delete_after_days"`
+}
+
+// TenancyConfig contains multi-tenant settings. Each tenant gets its own
+// database under <data_dir>/tenants/<id>.
+type TenancyConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Header  string `yaml:"header"`
+	// Domain enables subdomain selection: <tenant>.<domain>
+	Domain string `yaml:"domain"`
+	// Required rejects requests that select no tenant instead of serving
+	// them from the default database
+	Required bool           `yaml:"required"`
+	Tenants  []TenantConfig `yaml:"tenants"`
+}
+
+// TenantConfig describes one tenant
+type TenantConfig struct {
+	ID       string `yaml:"id"`
+	Name     string `yaml:"name"`
+	APIToken string `yaml:"api_token"`
+	// Quota overrides storage.quota for this tenant when set
+	Quota *QuotaConfig `yaml:"quota"`
+}
+
+// ClusterConfig lets several replicas share one database behind a load
+// balancer. They elect a leader through a lease in the database, and only
+// the leader runs scheduled work: backups, maintenance, usage exports and
+// stale device checks.
+type ClusterConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// NodeID names this replica as the lease holder (default: the hostname
+	// and process ID)
+	NodeID string `yaml:"node_id"`
+	// LeaseSeconds is how long the leader's lease lasts unless renewed, and
+	// so how soon another replica takes over from one that stops (default
+	// 30). It is renewed every third of that.
+	LeaseSeconds int `yaml:"lease_seconds"`
+}
+
+// SharingConfig contains settings for shareable preset links
+type SharingConfig struct {
+	// Secret signs share links; a random one is used per run if empty, so
+	// links stop working on restart
+	Secret          string `yaml:"secret"`
+	DefaultTTLHours int    `yaml:"default_ttl_hours"`
+	MaxTTLHours     int    `yaml:"max_ttl_hours"`
+	// BaseURL is prefixed to generated links instead of the request's host
+	BaseURL string `yaml:"base_url"`
+}
+
+// StorageSyncConfig contains the chrome.storage.sync compatible API's
+// settings. The quotas default to Chrome's own, so extensions see the same
+// errors they would in the browser.
+type StorageSyncConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// QuotaBytes caps a device's items in all, and QuotaBytesPerItem each
+	// one, counting the key and the value as JSON
+	QuotaBytes        int64 `yaml:"quota_bytes"`
+	QuotaBytesPerItem int64 `yaml:"quota_bytes_per_item"`
+	MaxItems          int   `yaml:"max_items"`
+	// Each set, remove or clear call is one write operation
+	MaxWriteOperationsPerHour   int `yaml:"max_write_operations_per_hour"`
+	MaxWriteOperationsPerMinute int `yaml:"max_write_operations_per_minute"`
+}
+
+// WebDAVConfig serves presets as JSON files over WebDAV at /dav, a folder
+// per device
+type WebDAVConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ReadOnly refuses every change, for browsing and backups
+	ReadOnly bool `yaml:"read_only"`
+}
+
+// DiscoveryConfig lets extensions on the local network find the service
+type DiscoveryConfig struct {
+	// MDNS advertises the service as _webform-sync._tcp over multicast DNS.
+	// It is skipped when the service listens only on loopback or a socket.
+	MDNS bool `yaml:"mdns"`
+	// InstanceName is the name clients show; "Webform Sync on <host>" by
+	// default
+	InstanceName string `yaml:"instance_name"`
+	// Interfaces are the network interfaces to advertise on; all by default
+	Interfaces []string `yaml:"interfaces"`
+}
+
+// WebhooksConfig contains webhook delivery settings
+type WebhooksConfig struct {
+	MaxAttempts    int             `yaml:"max_attempts"`
+	TimeoutSeconds int             `yaml:"timeout_seconds"`
+	Endpoints      []WebhookConfig `yaml:"endpoints"`
+}
+
+// WebhookConfig describes one webhook endpoint
+type WebhookConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Secret signs each body with HMAC-SHA256 when set
+	Secret string `yaml:"secret"`
+	// Events limits deliveries to these event types (all if empty)
+	Events []string `yaml:"events"`
+}
+
+// PluginsConfig loads extensions built as Go plugins
+type PluginsConfig struct {
+	// Files are plugins built with -buildmode=plugin, loaded at startup.
+	// Loading them makes their extensions available; the config chooses
+	// where each is used.
+	Files []string `yaml:"files"`
+}
+
+// PluginConfig picks an extension registered by a plugin, and gives it
+// its settings
+type PluginConfig struct {
+	// Name is the name the extension registered
+	Name string `yaml:"name"`
+	// Settings are passed to the extension as they are
+	Settings map[string]interface{} `yaml:"settings"`
+}
+
+// UsageExportConfig periodically exports aggregate usage metrics in the
+// Prometheus text format, to a URL, a file or both
+type UsageExportConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// IntervalSeconds is the time between exports (default 60)
+	IntervalSeconds int `yaml:"interval_seconds"`
+	// URL receives the metrics by POST, e.g. a Pushgateway job or
+	// VictoriaMetrics' /api/v1/import/prometheus
+	URL string `yaml:"url"`
+	// Headers are sent with each POST, e.g. Authorization
+	Headers map[string]string `yaml:"headers"`
+	// File is replaced with the metrics on each export, e.g. for the node
+	// exporter's textfile collector
+	File string `yaml:"file"`
+	// Instance labels every series (default: the hostname); Labels are
+	// added to every series as well
+	Instance string            `yaml:"instance"`
+	Labels   map[string]string `yaml:"labels"`
+}
+
+// TelemetryConfig sends an anonymous usage report to the project, to help
+// decide what to work on. It is off unless the operator turns it on; the
+// report is the one GET /admin/telemetry shows.
+type TelemetryConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// URL receives the report by POST
+	URL string `yaml:"url"`
+	// IntervalHours is the time between reports (default 24)
+	IntervalHours int `yaml:"interval_hours"`
+}
+
+// NotificationsConfig contains push notification sinks. Each is off unless
+// its url, broker, user or host is set.
+type NotificationsConfig struct {
+	MQTT     MQTTConfig     `yaml:"mqtt"`
+	Ntfy     NtfyConfig     `yaml:"ntfy"`
+	Gotify   GotifyConfig   `yaml:"gotify"`
+	Pushover PushoverConfig `yaml:"pushover"`
+	Email    EmailConfig    `yaml:"email"`
+	// Plugins are notifiers provided by plugins
+	Plugins []PluginConfig `yaml:"plugins"`
+}
+
+// MQTTConfig publishes events to an MQTT broker
+type MQTTConfig struct {
+	// Broker is tcp://host:port or tls://host:port
+	Broker      string `yaml:"broker"`
+	ClientID    string `yaml:"client_id"`
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	TopicPrefix string `yaml:"topic_prefix"`
+	// Topics publish event types, or groups such as "device.*", to topics
+	// of their own instead of under TopicPrefix. {tenant} in a topic is
+	// the tenant's ID, and is dropped with its level for the default
+	// database.
+	Topics map[string]string `yaml:"topics"`
+	Retain bool              `yaml:"retain"`
+	// Events limits publishing to these event types (all if empty)
+	Events []string `yaml:"events"`
+}
+
+// NtfyConfig sends push notifications through an ntfy topic
+type NtfyConfig struct {
+	// URL is the full topic URL, e.g. https://ntfy.sh/my-topic
+	URL      string `yaml:"url"`
+	Token    string `yaml:"token"`
+	Priority int    `yaml:"priority"`
+	// Priorities override Priority for event types, or groups such as
+	// "device.*"
+	Priorities map[string]int `yaml:"priorities"`
+	// Events limits pushes to these event types or groups
+	Events []string `yaml:"events"`
+}
+
+// GotifyConfig sends push notifications through a Gotify server
+type GotifyConfig struct {
+	URL        string         `yaml:"url"`
+	Token      string         `yaml:"token"`
+	Priority   int            `yaml:"priority"`
+	Priorities map[string]int `yaml:"priorities"`
+	Events     []string       `yaml:"events"`
+}
+
+// PushoverConfig sends push notifications through Pushover. It is off
+// unless user is set.
+type PushoverConfig struct {
+	// Token is the application's API token; User is the user or group key
+	// to notify
+	Token string `yaml:"token"`
+	User  string `yaml:"user"`
+	// Device limits delivery to one of the user's devices (all if empty)
+	Device string `yaml:"device"`
+	// Priority is -2 (silent) to 2 (emergency, repeated until
+	// acknowledged)
+	Priority   int            `yaml:"priority"`
+	Priorities map[string]int `yaml:"priorities"`
+	Events     []string       `yaml:"events"`
+}
+
+// EmailConfig sends events as email through an SMTP server
+type EmailConfig struct {
+	Host string `yaml:"host"`
+	// Port defaults to 465 with TLS "tls" and to 587 otherwise
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// TLS is starttls (the default), tls for implicit TLS, or none
+	TLS  string   `yaml:"tls"`
+	From string   `yaml:"from"`
+	To   []string `yaml:"to"`
+	// Events turns mail on or off per event type, or group such as
+	// "device.*" (default: backup.failed, database.corrupt and
+	// device.registered)
+	Events map[string]bool `yaml:"events"`
+	// Templates replace the subject and body for event types or groups
+	Templates map[string]EmailTemplate `yaml:"templates"`
+}
+
+// EmailTemplate is a Go text/template for a message's subject and body.
+// Either may be left empty to keep the default.
+type EmailTemplate struct {
+	Subject string `yaml:"subject"`
+	Body    string `yaml:"body"`
 }
 
 // LoadConfig loads configuration from a YAML file
@@ -125,16 +842,276 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
-	// Set defaults
-	if cfg.Server.Port == 0 {
-		cfg.Server.Port = 8765
-	}
-	if cfg.Server.Host == "" {
-		cfg.Server.Host = "127.0.0.1"
+	if err := cfg.loadSecrets(); err != nil {
+		return nil, err
 	}
-	if cfg.Logging.Level == "" {
-		cfg.Logging.Level = "info"
+	cfg.applyDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
 
 	return &cfg, nil
 }
+
+// applyDefaults fills in settings left empty
+func (c *Config) applyDefaults() {
+	if c.Server.Port == 0 {
+		c.Server.Port = 8765
+	}
+	if c.Server.Host == "" {
+		c.Server.Host = "127.0.0.1"
+	}
+	if c.Server.ShutdownTimeout == 0 {
+		c.Server.ShutdownTimeout = 30
+	}
+	if c.Server.SocketMode == "" {
+		c.Server.SocketMode = "0660"
+	}
+	if auto := &c.Server.TLS.Autocert; auto.Enabled {
+		if auto.CacheDir == "" {
+			auto.CacheDir = filepath.Join(c.Storage.DataDir, "certs")
+		}
+		if auto.DirectoryURL == "" {
+			auto.DirectoryURL = LetsEncryptURL
+		}
+	}
+	if c.Logging.Level == "" {
+		c.Logging.Level = "info"
+	}
+	if c.FieldPolicy.Action == "" {
+		c.FieldPolicy.Action = "reject"
+	}
+	if len(c.FieldPolicy.Fields) == 0 {
+		c.FieldPolicy.Fields = DefaultSensitiveFields
+	}
+	if s := &c.Suggest; s.SpecificityWeight == 0 && s.RecencyWeight == 0 && s.FrequencyWeight == 0 {
+		s.SpecificityWeight, s.RecencyWeight, s.FrequencyWeight = 0.5, 0.3, 0.2
+	}
+	if c.Suggest.RecencyHalfLifeDays == 0 {
+		c.Suggest.RecencyHalfLifeDays = 30
+	}
+	if r := &c.Performance.Cache.Redis; c.Performance.Cache.Backend == "redis" {
+		if r.Addr == "" {
+			r.Addr = "127.0.0.1:6379"
+		}
+		if r.KeyPrefix == "" {
+			r.KeyPrefix = "webform-sync:"
+		}
+		if r.TimeoutMs == 0 {
+			r.TimeoutMs = 500
+		}
+		if r.PoolSize == 0 {
+			r.PoolSize = 10
+		}
+	}
+	if c.Storage.Retry.MaxAttempts == 0 {
+		c.Storage.Retry.MaxAttempts = 3
+	}
+	if c.Storage.Retry.BackoffMs == 0 {
+		c.Storage.Retry.BackoffMs = 50
+	}
+	if cb := &c.Storage.CircuitBreaker; cb.Enabled {
+		if cb.FailureThreshold == 0 {
+			cb.FailureThreshold = 5
+		}
+		if cb.OpenSeconds == 0 {
+			cb.OpenSeconds = 10
+		}
+	}
+	if c.Storage.Compression.MinBytes == 0 {
+		c.Storage.Compression.MinBytes = 256
+	}
+	if c.Storage.Compression.Level == "" {
+		c.Storage.Compression.Level = "default"
+	}
+	if c.Storage.Backup.IntervalHours == 0 {
+		c.Storage.Backup.IntervalHours = 24
+	}
+	if c.Maintenance.CleanupIntervalHours == 0 {
+		c.Maintenance.CleanupIntervalHours = 168
+	}
+	for i := range c.Storage.Backup.Remotes {
+		remote := &c.Storage.Backup.Remotes[i]
+		if remote.Name == "" {
+			remote.Name = remote.Type
+			if remote.Type == "plugin" {
+				remote.Name = remote.Plugin.Name
+			}
+		}
+		if remote.Type == "s3" && remote.Region == "" {
+			remote.Region = "us-east-1"
+		}
+	}
+	if c.PIIDetection.Mode == "" {
+		c.PIIDetection.Mode = "off"
+	}
+	if len(c.PIIDetection.Types) == 0 {
+		c.PIIDetection.Types = pii.Kinds
+	}
+	if syncLog := &c.Performance.SyncLog; syncLog.Async {
+		if syncLog.BatchSize == 0 {
+			syncLog.BatchSize = 200
+		}
+		if syncLog.FlushIntervalMs == 0 {
+			syncLog.FlushIntervalMs = 500
+		}
+		if syncLog.QueueSize == 0 {
+			syncLog.QueueSize = 10000
+		}
+	}
+	if wb := &c.Performance.WriteBehind; wb.Enabled {
+		if wb.BatchSize == 0 {
+			wb.BatchSize = 100
+		}
+		if wb.FlushIntervalMs == 0 {
+			wb.FlushIntervalMs = 20
+		}
+		if wb.QueueSize == 0 {
+			wb.QueueSize = 1000
+		}
+		if wb.Durability == "" {
+			wb.Durability = "batch"
+		}
+	}
+	limits := &c.Performance.RateLimits
+	if limits.Key == "" {
+		limits.Key = "ip"
+	}
+	if limits.Read == 0 {
+		limits.Read = c.Performance.RateLimit
+	}
+	if limits.Write == 0 {
+		limits.Write = c.Performance.RateLimit
+	}
+
+	if access := &c.Logging.AccessLog; access.Enabled {
+		if access.File == "" {
+			access.File = "./logs/access.log"
+		}
+		if access.Format == "" {
+			access.Format = "combined"
+		}
+	}
+	if c.Features == nil {
+		c.Features = map[string]bool{}
+	}
+	for _, name := range Features {
+		if _, ok := c.Features[name]; !ok {
+			c.Features[name] = true
+		}
+	}
+	if c.Tenancy.Header == "" {
+		c.Tenancy.Header = "X-Tenant-ID"
+	}
+	if cluster := &c.Cluster; cluster.Enabled {
+		if cluster.NodeID == "" {
+			host, _ := os.Hostname()
+			cluster.NodeID = fmt.Sprintf("%s-%d", host, os.Getpid())
+		}
+		if cluster.LeaseSeconds == 0 {
+			cluster.LeaseSeconds = 30
+		}
+	}
+	if c.Sharing.DefaultTTLHours == 0 {
+		c.Sharing.DefaultTTLHours = 72
+	}
+	if c.Sharing.MaxTTLHours == 0 {
+		c.Sharing.MaxTTLHours = 720
+	}
+	if sync := &c.StorageSync; sync.Enabled {
+		if sync.QuotaBytes == 0 {
+			sync.QuotaBytes = 102400
+		}
+		if sync.QuotaBytesPerItem == 0 {
+			sync.QuotaBytesPerItem = 8192
+		}
+		if sync.MaxItems == 0 {
+			sync.MaxItems = 512
+		}
+		if sync.MaxWriteOperationsPerHour == 0 {
+			sync.MaxWriteOperationsPerHour = 1800
+		}
+		if sync.MaxWriteOperationsPerMinute == 0 {
+			sync.MaxWriteOperationsPerMinute = 120
+		}
+	}
+	if c.Webhooks.MaxAttempts == 0 {
+		c.Webhooks.MaxAttempts = 5
+	}
+	if c.Webhooks.TimeoutSeconds == 0 {
+		c.Webhooks.TimeoutSeconds = 10
+	}
+	for i, hook := range c.Webhooks.Endpoints {
+		if hook.Name == "" {
+			c.Webhooks.Endpoints[i].Name = hook.URL
+		}
+	}
+
+	notify := &c.Notifications
+	if notify.MQTT.Broker != "" {
+		if notify.MQTT.ClientID == "" {
+			notify.MQTT.ClientID = "webform-sync"
+		}
+		if notify.MQTT.TopicPrefix == "" {
+			notify.MQTT.TopicPrefix = "webform-sync"
+		}
+	}
+	// Phone notifications default to events an admin acts on; a push for
+	// every preset save would be noise
+	pushEvents := []string{"device.registered", "device.revoked", "auth.lockout", "backup.failed", "sync.cleaned"}
+	if notify.Ntfy.URL != "" && len(notify.Ntfy.Events) == 0 {
+		notify.Ntfy.Events = pushEvents
+	}
+	if notify.Gotify.URL != "" {
+		if len(notify.Gotify.Events) == 0 {
+			notify.Gotify.Events = pushEvents
+		}
+		if notify.Gotify.Priority == 0 {
+			notify.Gotify.Priority = 5
+		}
+	}
+	if notify.Pushover.User != "" && len(notify.Pushover.Events) == 0 {
+		notify.Pushover.Events = pushEvents
+	}
+	if email := &notify.Email; email.Host != "" {
+		if email.TLS == "" {
+			email.TLS = "starttls"
+		}
+		if email.Port == 0 {
+			email.Port = 587
+			if email.TLS == "tls" {
+				email.Port = 465
+			}
+		}
+		// Mail is for the critical events unless chosen otherwise
+		if len(email.Events) == 0 {
+			email.Events = map[string]bool{"backup.failed": true, "database.corrupt": true, "device.registered": true}
+		}
+	}
+
+	if c.Transforms.Script != "" {
+		if c.Transforms.TimeoutMS == 0 {
+			c.Transforms.TimeoutMS = 100
+		}
+		if c.Transforms.MaxSteps == 0 {
+			c.Transforms.MaxSteps = 1000000
+		}
+	}
+
+	if c.UsageExport.Enabled && c.UsageExport.IntervalSeconds == 0 {
+		c.UsageExport.IntervalSeconds = 60
+	}
+
+	if c.Telemetry.IntervalHours == 0 {
+		c.Telemetry.IntervalHours = 24
+	}
+
+	if lockout := &c.Authentication.Lockout; lockout.MaxFailures > 0 {
+		if lockout.WindowMinutes == 0 {
+			lockout.WindowMinutes = 15
+		}
+		if lockout.DurationMinutes == 0 {
+			lockout.DurationMinutes = 15
+		}
+	}
+}
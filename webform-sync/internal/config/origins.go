@@ -0,0 +1,44 @@
+package config
+
+import (
+	"errors"
+	"strings"
+)
+
+// CheckOriginPattern returns why a CORS origin pattern is invalid, or nil. A
+// pattern is "*", an origin such as https://example.com, or an origin with
+// one "*" standing for any run of characters, such as chrome-extension://*
+// for every Chrome extension.
+func CheckOriginPattern(pattern string) error {
+	if pattern == "*" {
+		return nil
+	}
+	if strings.Count(pattern, "*") > 1 {
+		return errors.New("only one * is allowed")
+	}
+	scheme, host, ok := strings.Cut(pattern, "://")
+	if !ok || scheme == "" || strings.Contains(scheme, "*") {
+		return errors.New("must start with a scheme, such as https://")
+	}
+	if host == "" {
+		return errors.New("has no host")
+	}
+	if strings.ContainsAny(host, "/?# ") {
+		return errors.New("must not have a path")
+	}
+	return nil
+}
+
+// OriginMatches reports whether an origin matches a pattern, ignoring case
+func OriginMatches(pattern, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+	pattern, origin = strings.ToLower(pattern), strings.ToLower(origin)
+	prefix, suffix, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return pattern == origin
+	}
+	return len(origin) >= len(prefix)+len(suffix) &&
+		strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix)
+}
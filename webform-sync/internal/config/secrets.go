@@ -0,0 +1,186 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SecretsConfig pulls secrets from outside the config file, so the YAML can
+// be committed or shared without them
+type SecretsConfig struct {
+	// SOPSFile is a SOPS-encrypted YAML file laid out like this config.
+	// It is decrypted with the sops command and its values override the
+	// config's.
+	SOPSFile string      `yaml:"sops_file"`
+	Vault    VaultConfig `yaml:"vault"`
+}
+
+// VaultConfig reads secrets from a HashiCorp Vault KV secret (version 1 or
+// 2). Each key of the secret is a dotted config path, such as
+// authentication.api_token, and its value overrides the config's.
+type VaultConfig struct {
+	Address string `yaml:"address"`
+	// Path is the secret's API path, e.g. secret/data/webform-sync for KV v2
+	Path string `yaml:"path"`
+	// TokenFile holds the Vault token; VAULT_TOKEN is used if it is empty
+	TokenFile string `yaml:"token_file"`
+	Namespace string `yaml:"namespace"`
+}
+
+// vaultTimeout bounds the request to Vault
+const vaultTimeout = 10 * time.Second
+
+// loadSecrets fills in secrets from SOPS, Vault and *_file settings, in that
+// order, so a file named in the config has the last word
+func (c *Config) loadSecrets() error {
+	if c.Secrets.SOPSFile != "" {
+		if err := c.loadSOPS(c.Secrets.SOPSFile); err != nil {
+			return err
+		}
+	}
+	if c.Secrets.Vault.Address != "" {
+		if err := c.loadVault(c.Secrets.Vault); err != nil {
+			return err
+		}
+	}
+
+	type fileSecret struct {
+		name  string
+		file  string
+		value *string
+	}
+	secrets := []fileSecret{
+		{"authentication.api_token", c.Authentication.APITokenFile, &c.Authentication.APIToken},
+		{"storage.encryption_key", c.Storage.EncryptionKeyFile, &c.Storage.EncryptionKey},
+		{"storage.backup.passphrase", c.Storage.Backup.PassphraseFile, &c.Storage.Backup.Passphrase},
+		{"performance.cache.redis.password", c.Performance.Cache.Redis.PasswordFile, &c.Performance.Cache.Redis.Password},
+	}
+	for i := range c.Storage.Backup.Remotes {
+		remote := &c.Storage.Backup.Remotes[i]
+		prefix := fmt.Sprintf("storage.backup.remotes[%d].", i)
+		secrets = append(secrets,
+			fileSecret{prefix + "secret_key", remote.SecretKeyFile, &remote.SecretKey},
+			fileSecret{prefix + "password", remote.PasswordFile, &remote.Password},
+		)
+	}
+
+	for _, secret := range secrets {
+		if secret.file == "" {
+			continue
+		}
+		value, err := readSecretFile(secret.file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s_file: %w", secret.name, err)
+		}
+		*secret.value = value
+	}
+	return nil
+}
+
+// readSecretFile reads a secret from a file, such as a Docker or Kubernetes
+// secret mount, ignoring surrounding whitespace
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return value, nil
+}
+
+// loadSOPS decrypts a SOPS file and overlays it on the config
+func (c *Config) loadSOPS(path string) error {
+	out, err := exec.Command("sops", "--decrypt", path).Output()
+	if err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("failed to decrypt %s with sops: %s", path, strings.TrimSpace(string(exit.Stderr)))
+		}
+		return fmt.Errorf("failed to decrypt %s with sops: %w", path, err)
+	}
+	if err := yaml.Unmarshal(out, c); err != nil {
+		return fmt.Errorf("failed to parse decrypted %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadVault reads a Vault secret and overlays its values on the config
+func (c *Config) loadVault(vault VaultConfig) error {
+	token := os.Getenv("VAULT_TOKEN")
+	if vault.TokenFile != "" {
+		var err error
+		if token, err = readSecretFile(vault.TokenFile); err != nil {
+			return fmt.Errorf("failed to read vault token: %w", err)
+		}
+	}
+	if token == "" {
+		return fmt.Errorf("vault needs a token: set secrets.vault.token_file or VAULT_TOKEN")
+	}
+
+	url := strings.TrimSuffix(vault.Address, "/") + "/v1/" + strings.TrimPrefix(vault.Path, "/")
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("invalid vault address: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if vault.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", vault.Namespace)
+	}
+
+	client := &http.Client{Timeout: vaultTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault returned %s for %s", resp.Status, vault.Path)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("failed to parse vault response: %w", err)
+	}
+	// KV v2 nests the values, with metadata, one level further down
+	values := body.Data
+	if nested, ok := values["data"].(map[string]interface{}); ok {
+		values = nested
+	}
+
+	overlay := map[string]interface{}{}
+	for path, value := range values {
+		setPath(overlay, strings.Split(path, "."), value)
+	}
+	data, err := yaml.Marshal(overlay)
+	if err != nil {
+		return fmt.Errorf("failed to apply vault secret: %w", err)
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("failed to apply vault secret: %w", err)
+	}
+	return nil
+}
+
+// setPath stores value in a nested map under a dotted path's keys
+func setPath(tree map[string]interface{}, keys []string, value interface{}) {
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := tree[key].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			tree[key] = child
+		}
+		tree = child
+	}
+	tree[keys[len(keys)-1]] = value
+}
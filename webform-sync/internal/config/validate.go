@@ -0,0 +1,554 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/pii"
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// metricLabelPattern matches Prometheus label names
+var metricLabelPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ValidationError lists every problem found in a config, so they can all be
+// fixed in one go
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return "invalid config: " + e.Problems[0]
+	}
+	return fmt.Sprintf("invalid config, %d problems:\n  - %s", len(e.Problems), strings.Join(e.Problems, "\n  - "))
+}
+
+// Validate rejects contradictory or dangerous settings. It returns a
+// *ValidationError naming each setting to fix, or nil.
+func (c *Config) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		problem("server.port %d is out of range: use 1-65535", c.Server.Port)
+	}
+	if listen := c.Server.Listen; listen != "" {
+		if !strings.HasPrefix(listen, "unix://") && !strings.HasPrefix(listen, "npipe://") {
+			problem("server.listen %q is not recognised: use unix:///path/to/socket or npipe:////./pipe/name", listen)
+		}
+		if mode, err := strconv.ParseUint(c.Server.SocketMode, 8, 32); err != nil || mode > 0777 {
+			problem("server.socket_mode %q is not an octal permission such as 0660", c.Server.SocketMode)
+		}
+	}
+
+	if tls := c.Server.TLS; tls.Enabled {
+		if tls.Autocert.Enabled {
+			if tls.CertFile != "" || tls.KeyFile != "" {
+				problem("server.tls has both cert_file/key_file and autocert: use one or the other")
+			}
+			if len(tls.Autocert.Domains) == 0 {
+				problem("server.tls.autocert.domains is empty: list the domain names to get a certificate for")
+			}
+			if !tls.Autocert.AcceptTOS {
+				problem("server.tls.autocert.accept_tos must be true to agree to the ACME service's terms of service")
+			}
+			if tls.RedirectPort == 0 {
+				problem("server.tls.redirect_port is 0, but autocert answers challenges there: set it to 80, or to the port that 80 is forwarded to")
+			}
+		} else if tls.CertFile == "" || tls.KeyFile == "" {
+			problem("server.tls.cert_file and server.tls.key_file are both required, unless server.tls.autocert is enabled")
+		}
+		if tls.RedirectPort < 0 || tls.RedirectPort > 65535 {
+			problem("server.tls.redirect_port %d is out of range: use 1-65535, or 0 to disable it", tls.RedirectPort)
+		} else if tls.RedirectPort == c.Server.Port {
+			problem("server.tls.redirect_port must differ from server.port")
+		}
+	} else if tls.Autocert.Enabled {
+		problem("server.tls.autocert is enabled but server.tls.enabled is false: enable TLS too")
+	}
+
+	switch c.AccessControl.Mode {
+	case "whitelist":
+		if len(c.AccessControl.Whitelist) == 0 {
+			problem("access_control.whitelist is empty, so whitelist mode would block every client: add an address such as 127.0.0.1, or change access_control.mode")
+		}
+	case "blacklist", "allow_all":
+	default:
+		problem("access_control.mode %q is not recognised: use whitelist, blacklist or allow_all", c.AccessControl.Mode)
+	}
+	for _, list := range []struct {
+		name    string
+		entries []string
+	}{
+		{"access_control.whitelist", c.AccessControl.Whitelist},
+		{"access_control.blacklist", c.AccessControl.Blacklist},
+		{"server.trusted_proxies", c.Server.TrustedProxies},
+	} {
+		for _, entry := range list.entries {
+			if net.ParseIP(entry) == nil {
+				if _, _, err := net.ParseCIDR(entry); err != nil {
+					problem("%s entry %q is not an IP address or CIDR range", list.name, entry)
+				}
+			}
+		}
+	}
+
+	if c.Storage.DBFile == "" {
+		problem("storage.db_file is empty: set a database file name such as presets.db")
+	}
+	if c.Storage.Backup.Enabled && c.Storage.Backup.BackupDir == "" {
+		problem("storage.backup.backup_dir is empty: set a directory, or set storage.backup.enabled to false")
+	}
+	if b := c.Storage.Backup; b.IntervalHours < 0 || b.MaxBackups < 0 {
+		problem("storage.backup.interval_hours and max_backups must not be negative")
+	}
+	if c.Storage.BlobThresholdBytes < 0 {
+		problem("storage.blob_threshold_bytes must not be negative")
+	}
+	if c.Storage.SlowQueryMs < 0 || c.Logging.SlowRequestMs < 0 {
+		problem("storage.slow_query_ms and logging.slow_request_ms must not be negative")
+	}
+	if r := c.Storage.Retry; r.MaxAttempts < 1 || r.BackoffMs < 0 {
+		problem("storage.retry.max_attempts must be at least 1 and backoff_ms must not be negative")
+	}
+	if cb := c.Storage.CircuitBreaker; cb.Enabled && (cb.FailureThreshold < 1 || cb.OpenSeconds < 1) {
+		problem("storage.circuit_breaker.failure_threshold and open_seconds must be at least 1")
+	}
+	switch c.Performance.Cache.Backend {
+	case "", "memory":
+	case "redis":
+		if r := c.Performance.Cache.Redis; r.TimeoutMs < 0 || r.PoolSize < 0 || r.DB < 0 {
+			problem("performance.cache.redis.timeout_ms, pool_size and db must not be negative")
+		}
+	default:
+		problem("performance.cache.backend %q is not valid: use memory or redis", c.Performance.Cache.Backend)
+	}
+	switch c.Storage.Compression.Level {
+	case "fastest", "default", "better", "best":
+	default:
+		problem("storage.compression.level %q is not valid: use fastest, default, better or best", c.Storage.Compression.Level)
+	}
+	if c.Storage.Compression.MinBytes < 0 {
+		problem("storage.compression.min_bytes must not be negative")
+	}
+	if m := c.Maintenance; m.CleanupIntervalHours < 0 || m.DeleteAfterDays < 0 ||
+		m.SyncLogRetentionDays < 0 || m.TombstoneRetentionDays < 0 || m.UsageRetentionDays < 0 {
+		problem("maintenance.cleanup_interval_hours, delete_after_days, sync_log_retention_days, tombstone_retention_days and usage_retention_days must not be negative")
+	}
+	if p := c.Maintenance.AutoCompactFreePercent; p < 0 || p > 100 {
+		problem("maintenance.auto_compact_free_percent must be between 0 and 100")
+	}
+	for i, rule := range c.Maintenance.Retention {
+		if len(rule.Scopes) == 0 && len(rule.Tags) == 0 {
+			problem("maintenance.retention[%d] has no scopes or tags: set one, or use delete_after_days for every preset", i)
+		}
+		if rule.DeleteAfterDays < 0 {
+			problem("maintenance.retention[%d].delete_after_days must not be negative: use 0 to keep its presets forever", i)
+		}
+	}
+	for _, scope := range c.Maintenance.CleanupExempt.Scopes {
+		if strings.Trim(scope, "* ") == "" {
+			problem("maintenance.cleanup_exempt.scopes entry %q would exempt every preset: set delete_after_days to 0 instead", scope)
+		}
+	}
+	if b := c.Storage.Backup; len(b.Remotes) > 0 {
+		if b.Passphrase == "" {
+			problem("storage.backup.passphrase is required with remotes: backups are encrypted before they leave the machine")
+		}
+		names := map[string]bool{}
+		for _, remote := range b.Remotes {
+			if names[remote.Name] {
+				problem("duplicate backup remote %q: give each remote its own name", remote.Name)
+			}
+			names[remote.Name] = true
+			validateBackupRemote(remote, problem)
+		}
+	}
+	if ss := c.StorageSync; ss.QuotaBytes < 0 || ss.QuotaBytesPerItem < 0 || ss.MaxItems < 0 ||
+		ss.MaxWriteOperationsPerHour < 0 || ss.MaxWriteOperationsPerMinute < 0 {
+		problem("storage_sync quotas must not be negative")
+	}
+	if st := c.Storage; st.MaxOpenConns < 0 || st.MaxIdleConns < 0 || st.ConnMaxLifetimeMinutes < 0 || st.QueryTimeoutSeconds < 0 {
+		problem("storage pool and timeout settings must not be negative")
+	}
+
+	if auth := c.Authentication; auth.Enabled {
+		switch auth.Type {
+		case "token":
+			if auth.APIToken == "" {
+				problem("authentication.api_token is empty, which would accept an empty Bearer token: set a long random token, or set authentication.enabled to false")
+			}
+		case "basic":
+			if auth.Username == "" || auth.Password == "" {
+				problem("authentication.username and authentication.password are both required for basic authentication")
+			}
+			for _, origin := range c.CORS.AllowedOrigins {
+				if c.CORS.Enabled && origin == "*" {
+					problem("cors.allowed_origins contains \"*\" while basic authentication is enabled, which lets any website use a browser's saved credentials: list the extension origins instead")
+					break
+				}
+			}
+			for _, rule := range c.CORS.Rules {
+				if c.CORS.Enabled && rule.Origin == "*" {
+					problem("cors.rules has an origin of \"*\" while basic authentication is enabled, which lets any website use a browser's saved credentials: list the extension origins instead")
+					break
+				}
+			}
+		case "plugin":
+			if auth.Plugin.Name == "" {
+				problem("authentication.plugin.name is required for plugin authentication")
+			}
+		case "none":
+		default:
+			problem("authentication.type %q is not recognised: use token, basic, plugin or none", auth.Type)
+		}
+	}
+	if lockout := c.Authentication.Lockout; lockout.MaxFailures < 0 || lockout.WindowMinutes < 0 || lockout.DurationMinutes < 0 {
+		problem("authentication.lockout settings must not be negative")
+	}
+
+	if c.CORS.Enabled {
+		for _, origin := range c.CORS.AllowedOrigins {
+			if err := CheckOriginPattern(origin); err != nil {
+				problem("cors.allowed_origins entry %q %v", origin, err)
+			}
+		}
+		for _, rule := range c.CORS.Rules {
+			if err := CheckOriginPattern(rule.Origin); err != nil {
+				problem("cors.rules origin %q %v", rule.Origin, err)
+			}
+			for _, method := range rule.Methods {
+				if !containsFold(c.CORS.AllowedMethods, method) {
+					problem("cors.rules method %s for %q is not in cors.allowed_methods", method, rule.Origin)
+				}
+			}
+		}
+	}
+
+	if !validFieldPolicyAction(c.FieldPolicy.Action) {
+		problem("invalid field_policy.action %q: use reject, strip or off", c.FieldPolicy.Action)
+	}
+	for i, o := range c.FieldPolicy.Overrides {
+		if o.Scope == "" {
+			problem("field_policy.overrides entry %d has no scope", i)
+		}
+		if o.Action != "" && !validFieldPolicyAction(o.Action) {
+			problem("invalid field_policy.overrides action %q for %q: use reject, strip or off", o.Action, o.Scope)
+		}
+	}
+
+	switch c.PIIDetection.Mode {
+	case "off", "warn", "confirm", "block":
+	default:
+		problem("invalid pii_detection.mode %q: use off, warn, confirm or block", c.PIIDetection.Mode)
+	}
+	for _, kind := range c.PIIDetection.Types {
+		if !pii.Valid(kind) {
+			problem("unknown pii_detection type %q: use %s", kind, strings.Join(pii.Kinds, ", "))
+		}
+	}
+
+	if s := c.Suggest; s.SpecificityWeight < 0 || s.RecencyWeight < 0 || s.FrequencyWeight < 0 || s.RecencyHalfLifeDays < 0 {
+		problem("suggest weights and recency_half_life_days must not be negative")
+	}
+
+	if script := c.Transforms.Script; script != "" {
+		if _, err := os.Stat(script); err != nil {
+			problem("transforms.script: %v", err)
+		}
+		if c.Transforms.TimeoutMS < 0 {
+			problem("transforms.timeout_ms must not be negative")
+		}
+	}
+
+	switch c.Performance.RateLimits.Key {
+	case "ip", "token", "ip_token":
+	default:
+		problem("invalid rate limit key %q: use ip, token or ip_token", c.Performance.RateLimits.Key)
+	}
+	if d := c.Performance.RateLimits.Device; d.Read < 0 || d.Write < 0 || d.Burst < 0 {
+		problem("performance.rate_limits.device read, write and burst must not be negative")
+	}
+	if s := c.Performance.SyncLog; s.BatchSize < 0 || s.FlushIntervalMs < 0 || s.QueueSize < 0 {
+		problem("performance.sync_log batch_size, flush_interval_ms and queue_size must not be negative")
+	}
+	if wb := c.Performance.WriteBehind; wb.Enabled {
+		if wb.BatchSize < 0 || wb.FlushIntervalMs < 0 || wb.QueueSize < 0 {
+			problem("performance.write_behind batch_size, flush_interval_ms and queue_size must not be negative")
+		}
+		switch wb.Durability {
+		case "batch", "queued":
+		default:
+			problem("invalid performance.write_behind.durability %q: use batch or queued", wb.Durability)
+		}
+	}
+
+	if access := c.Logging.AccessLog; access.Enabled {
+		switch access.Format {
+		case "combined", "json":
+		default:
+			problem("invalid access log format %q: use combined or json", access.Format)
+		}
+	}
+	if !validLogLevel(c.Logging.Level) {
+		problem("invalid log level %q: use debug, info, warn or error", c.Logging.Level)
+	}
+	for module, level := range c.Logging.Modules {
+		known := false
+		for _, m := range LogModules {
+			known = known || m == module
+		}
+		if !known {
+			problem("unknown log module %q: use %s", module, strings.Join(LogModules, ", "))
+		}
+		if !validLogLevel(level) {
+			problem("invalid log level %q for module %s", level, module)
+		}
+	}
+
+	for i, d := range c.Deprecations {
+		if !strings.HasPrefix(d.Path, "/api/") {
+			problem("deprecations[%d].path must be an API route, such as /api/v1/presets/{id}", i)
+		}
+		if strings.Contains(strings.TrimSuffix(d.Path, "*"), "*") {
+			problem("deprecations[%d].path may only end in *", i)
+		}
+		since, err := time.Parse(DeprecationDateLayout, d.Since)
+		if err != nil {
+			problem("deprecations[%d].since must be a date as YYYY-MM-DD", i)
+		}
+		if d.Sunset != "" {
+			if sunset, err := time.Parse(DeprecationDateLayout, d.Sunset); err != nil {
+				problem("deprecations[%d].sunset must be a date as YYYY-MM-DD", i)
+			} else if !sunset.After(since) {
+				problem("deprecations[%d].sunset must be after since", i)
+			}
+		}
+		if d.Link != "" {
+			if u, err := url.Parse(d.Link); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				problem("deprecations[%d].link must be an http or https URL", i)
+			}
+		}
+		for _, method := range d.Methods {
+			if method != strings.ToUpper(method) || method == "" {
+				problem("deprecations[%d].methods must be upper-case HTTP methods", i)
+			}
+		}
+	}
+
+	for name := range c.Features {
+		known := false
+		for _, f := range Features {
+			known = known || f == name
+		}
+		if !known {
+			problem("unknown feature %q: use %s", name, strings.Join(Features, ", "))
+		}
+	}
+
+	for i, hook := range c.Webhooks.Endpoints {
+		if hook.URL == "" {
+			problem("webhook %d has no url", i)
+		}
+	}
+
+	notify := c.Notifications
+	if notify.MQTT.Broker != "" && !strings.HasPrefix(notify.MQTT.Broker, "tcp://") && !strings.HasPrefix(notify.MQTT.Broker, "tls://") {
+		problem("mqtt broker must start with tcp:// or tls://")
+	}
+	for event, topic := range notify.MQTT.Topics {
+		if topic == "" || strings.ContainsAny(topic, "+#") {
+			problem("mqtt topic for %s must be set and can't contain the wildcards + or #", event)
+		}
+	}
+	if notify.Gotify.URL != "" && notify.Gotify.Token == "" {
+		problem("gotify needs an application token")
+	}
+	if notify.Pushover.User != "" && notify.Pushover.Token == "" {
+		problem("pushover needs an application token")
+	}
+	if p := notify.Pushover.Priority; p < -2 || p > 2 {
+		problem("pushover priority must be between -2 and 2")
+	}
+	for event, p := range notify.Pushover.Priorities {
+		if p < -2 || p > 2 {
+			problem("pushover priority for %s must be between -2 and 2", event)
+		}
+	}
+	if email := notify.Email; email.Host != "" {
+		if email.From == "" || len(email.To) == 0 {
+			problem("email needs a from address and at least one to address")
+		}
+		for _, addr := range append([]string{email.From}, email.To...) {
+			if _, err := mail.ParseAddress(addr); addr != "" && err != nil {
+				problem("email address %q is invalid: %v", addr, err)
+			}
+		}
+		if email.TLS != "starttls" && email.TLS != "tls" && email.TLS != "none" {
+			problem("email tls must be starttls, tls or none")
+		}
+		for event, tmpl := range email.Templates {
+			for part, text := range map[string]string{"subject": tmpl.Subject, "body": tmpl.Body} {
+				if _, err := template.New(part).Parse(text); err != nil {
+					problem("email %s template for %s is invalid: %v", part, event, err)
+				}
+			}
+		}
+	}
+
+	for _, p := range notify.Plugins {
+		if p.Name == "" {
+			problem("notifications.plugins entries need the name of a notifier")
+		}
+	}
+	for _, file := range c.Plugins.Files {
+		if _, err := os.Stat(file); err != nil {
+			problem("plugins.files: %v", err)
+		}
+	}
+
+	if export := c.UsageExport; export.Enabled {
+		if export.URL == "" && export.File == "" {
+			problem("usage_export needs a url or a file to export to")
+		}
+		if export.URL != "" {
+			if u, err := url.Parse(export.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				problem("usage_export.url must be an http or https URL")
+			}
+		}
+		if export.IntervalSeconds < 10 {
+			problem("usage_export.interval_seconds must be at least 10")
+		}
+		for name := range export.Labels {
+			if !metricLabelPattern.MatchString(name) || strings.HasPrefix(name, "__") || name == "instance" || name == "tenant" {
+				problem("usage_export label %q is not a valid label name, or is reserved", name)
+			}
+		}
+	}
+
+	if telemetry := c.Telemetry; telemetry.Enabled {
+		if u, err := url.Parse(telemetry.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+			problem("telemetry.url must be an https URL")
+		}
+		if telemetry.IntervalHours < 1 {
+			problem("telemetry.interval_hours must be at least 1")
+		}
+	}
+
+	if c.Tenancy.Enabled {
+		seen, tokens := map[string]bool{}, map[string]bool{}
+		for _, t := range c.Tenancy.Tenants {
+			if !tenantIDPattern.MatchString(t.ID) {
+				problem("invalid tenant id %q: use lowercase letters, digits and hyphens", t.ID)
+			}
+			if seen[t.ID] {
+				problem("duplicate tenant id %q", t.ID)
+			}
+			seen[t.ID] = true
+			if c.Authentication.Enabled && t.APIToken == "" {
+				problem("tenant %q needs an api_token when authentication is enabled", t.ID)
+			}
+			if t.APIToken != "" && (t.APIToken == c.Authentication.APIToken || tokens[t.APIToken]) {
+				problem("tenant %q must have its own api_token", t.ID)
+			}
+			tokens[t.APIToken] = true
+		}
+	}
+
+	if c.Cluster.Enabled && c.Cluster.LeaseSeconds < 3 {
+		problem("cluster.lease_seconds must be at least 3")
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// validFieldPolicyAction reports whether a field policy action is recognised
+func validFieldPolicyAction(action string) bool {
+	switch action {
+	case "reject", "strip", "off":
+		return true
+	}
+	return false
+}
+
+// validLogLevel reports whether a level name is recognised
+func validLogLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "debug", "info", "warn", "warning", "error":
+		return true
+	}
+	return false
+}
+
+// containsFold reports whether list holds s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBackupRemote checks that a backup remote has what its type needs
+func validateBackupRemote(remote BackupRemoteConfig, problem func(string, ...interface{})) {
+	if remote.MaxBackups < 0 {
+		problem("backup remote %q: max_backups must not be negative", remote.Name)
+	}
+	if remote.Type == "plugin" {
+		if remote.Plugin.Name == "" {
+			problem("backup remote %q needs plugin.name, the backup store to use", remote.Name)
+		}
+		return
+	}
+
+	u, err := url.Parse(remote.URL)
+	if err != nil || u.Host == "" {
+		problem("backup remote %q needs a url such as https://host/folder", remote.Name)
+		return
+	}
+
+	switch remote.Type {
+	case "s3":
+		if u.Scheme != "https" && u.Scheme != "http" {
+			problem("s3 remote %q url must start with https://", remote.Name)
+		}
+		if strings.Trim(u.Path, "/") == "" {
+			problem("s3 remote %q url must name the bucket, e.g. https://s3.example.com/bucket", remote.Name)
+		}
+		if remote.AccessKey == "" || remote.SecretKey == "" {
+			problem("s3 remote %q needs an access_key and secret_key", remote.Name)
+		}
+	case "webdav":
+		if u.Scheme != "https" && u.Scheme != "http" {
+			problem("webdav remote %q url must start with https://", remote.Name)
+		}
+	case "sftp":
+		if u.Scheme != "sftp" {
+			problem("sftp remote %q url must start with sftp://", remote.Name)
+		}
+		if u.User.Username() == "" {
+			problem("sftp remote %q url must include the user, e.g. sftp://backup@host/folder", remote.Name)
+		}
+		if remote.Password == "" && remote.PrivateKeyFile == "" {
+			problem("sftp remote %q needs a private_key_file or password", remote.Name)
+		}
+	default:
+		problem("backup remote %q has unknown type %q: use s3, webdav, sftp or plugin", remote.Name, remote.Type)
+	}
+}
@@ -0,0 +1,192 @@
+// Package events is the internal event bus. Handlers publish events and the
+// bus fans them out to notification sinks (webhooks, MQTT, push services).
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/logger"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// Event types
+const (
+	PresetCreated    = "preset.created"
+	PresetUpdated    = "preset.updated"
+	PresetDeleted    = "preset.deleted"
+	DeviceRegistered = "device.registered"
+	DeviceRevoked    = "device.revoked"
+	SyncImported     = "sync.imported"
+	SyncTransferred  = "sync.transferred"
+	SyncCleaned      = "sync.cleaned"
+	AuthLockout      = "auth.lockout"
+	BackupFailed     = "backup.failed"
+	DatabaseCorrupt  = "database.corrupt"
+	CacheInvalidated = "cache.invalidated"
+)
+
+// Event is something that happened in the service
+type Event struct {
+	ID     string      `json:"id"`
+	Type   string      `json:"type"`
+	Time   time.Time   `json:"time"`
+	Tenant string      `json:"tenant,omitempty"`
+	Data   interface{} `json:"data"`
+}
+
+// Summary returns a short human-readable description, for push
+// notifications
+func (e Event) Summary() string {
+	var subject struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+		IP    string `json:"ip"`
+		Error string `json:"error"`
+	}
+	if data, err := json.Marshal(e.Data); err == nil {
+		json.Unmarshal(data, &subject)
+	}
+	name := subject.Name
+	if name == "" {
+		name = subject.ID
+	}
+
+	var summary string
+	switch e.Type {
+	case PresetCreated:
+		summary = fmt.Sprintf("Preset %q created", name)
+	case PresetUpdated:
+		summary = fmt.Sprintf("Preset %q updated", name)
+	case PresetDeleted:
+		summary = fmt.Sprintf("Preset %s deleted", name)
+	case DeviceRegistered:
+		summary = fmt.Sprintf("New device registered: %s", name)
+	case DeviceRevoked:
+		summary = fmt.Sprintf("Device revoked: %s", name)
+	case SyncImported:
+		summary = fmt.Sprintf("%d presets imported", subject.Count)
+	case SyncTransferred:
+		summary = fmt.Sprintf("%d presets transferred", subject.Count)
+	case SyncCleaned:
+		summary = fmt.Sprintf("%d unused presets cleaned up", subject.Count)
+	case AuthLockout:
+		summary = fmt.Sprintf("%s locked out after %d failed sign-ins", subject.IP, subject.Count)
+	case BackupFailed:
+		summary = "Backup failed: " + subject.Error
+	case DatabaseCorrupt:
+		summary = "Database failed its integrity check: " + subject.Error
+	case CacheInvalidated:
+		summary = "Cached preset lists invalidated"
+	default:
+		summary = e.Type
+	}
+	if e.Tenant != "" {
+		summary += " (" + e.Tenant + ")"
+	}
+	return summary
+}
+
+// Sink receives events. Handle may block; the bus calls it on its own
+// goroutine and cancels ctx on shutdown.
+type Sink interface {
+	Name() string
+	Accepts(eventType string) bool
+	Handle(ctx context.Context, e Event) error
+}
+
+// Subscribed reports whether an event type passes a sink's event filter of
+// types, groups such as "device.*", or "*"; an empty filter accepts
+// everything
+func Subscribed(filter []string, eventType string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	group, _, _ := strings.Cut(eventType, ".")
+	for _, f := range filter {
+		if f == eventType || f == group+".*" || f == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup finds the setting for an event type in settings keyed by type,
+// group such as "device.*", or "*", the most specific first
+func Lookup[T any](settings map[string]T, eventType string) (T, bool) {
+	group, _, _ := strings.Cut(eventType, ".")
+	for _, key := range []string{eventType, group + ".*", "*"} {
+		if v, ok := settings[key]; ok {
+			return v, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// Bus fans events out to sinks in the background
+type Bus struct {
+	tenant string
+	sinks  []Sink
+	logger *logger.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewBus creates a bus. Events carry tenant so sinks can tell tenants apart.
+func NewBus(tenant string, log *logger.Logger, sinks ...Sink) *Bus {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Bus{tenant: tenant, sinks: sinks, logger: log, ctx: ctx, cancel: cancel}
+}
+
+// Publish sends an event to every sink that accepts its type
+func (b *Bus) Publish(eventType string, data interface{}) {
+	if len(b.sinks) == 0 {
+		return
+	}
+
+	e := Event{
+		ID:     storage.NewPresetID(),
+		Type:   eventType,
+		Time:   time.Now().UTC(),
+		Tenant: b.tenant,
+		Data:   data,
+	}
+	for _, sink := range b.sinks {
+		if !sink.Accepts(eventType) {
+			continue
+		}
+		b.wg.Add(1)
+		go func(sink Sink) {
+			defer b.wg.Done()
+			if err := sink.Handle(b.ctx, e); err != nil {
+				b.logger.Warn("Notification sink %s failed for %s: %v", sink.Name(), e.Type, err)
+			}
+		}(sink)
+	}
+}
+
+// Close lets in-flight deliveries, retries included, finish until ctx is
+// done, then abandons the rest and waits for their sinks to return
+func (b *Bus) Close(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		b.cancel()
+		<-done
+	}
+	b.cancel()
+}
@@ -0,0 +1,107 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// chromeAutofill converts a CSV dump of Chrome's `autofill` table
+// (sqlite3 -header -csv "Web Data" "SELECT name, value, count FROM autofill")
+// into a single global preset holding the most used value per field name
+type chromeAutofill struct{}
+
+func (chromeAutofill) Name() string { return "chrome-autofill" }
+
+func (chromeAutofill) Description() string {
+	return "Chrome autofill table CSV (name, value, count)"
+}
+
+func (chromeAutofill) Detect(data []byte) bool {
+	return csvHeaderHas(data, "name", "value", "count") && !csvHeaderHas(data, "scopetype")
+}
+
+func (chromeAutofill) Convert(data []byte, deviceID string) ([]*storage.Preset, error) {
+	header, records, err := readCSV(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []historyEntry
+	for _, rec := range records {
+		count, _ := strconv.Atoi(field(header, rec, "count"))
+		entries = append(entries, historyEntry{
+			name:  field(header, rec, "name"),
+			value: field(header, rec, "value"),
+			count: count,
+		})
+	}
+
+	fields := mostUsedValues(entries)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return []*storage.Preset{
+		newPreset("Chrome autofill", storage.ScopeTypeGlobal, "", deviceID, "chrome-autofill", fields),
+	}, nil
+}
+
+// firefoxFormHistory converts Firefox's moz_formhistory table, dumped as CSV
+// (fieldname, value, timesUsed) or as a JSON array of the same objects
+type firefoxFormHistory struct{}
+
+func (firefoxFormHistory) Name() string { return "firefox-formhistory" }
+
+func (firefoxFormHistory) Description() string {
+	return "Firefox form history (moz_formhistory) as CSV or JSON"
+}
+
+func (firefoxFormHistory) Detect(data []byte) bool {
+	if csvHeaderHas(data, "fieldname", "value") {
+		return true
+	}
+	trimmed := bytes.TrimSpace(data)
+	return bytes.HasPrefix(trimmed, []byte("[")) && bytes.Contains(trimmed[:min(len(trimmed), 512)], []byte(`"fieldname"`))
+}
+
+func (firefoxFormHistory) Convert(data []byte, deviceID string) ([]*storage.Preset, error) {
+	var entries []historyEntry
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var rows []struct {
+			FieldName string `json:"fieldname"`
+			Value     string `json:"value"`
+			TimesUsed int    `json:"timesUsed"`
+		}
+		if err := json.Unmarshal(data, &rows); err != nil {
+			return nil, fmt.Errorf("invalid form history JSON: %w", err)
+		}
+		for _, row := range rows {
+			entries = append(entries, historyEntry{name: row.FieldName, value: row.Value, count: row.TimesUsed})
+		}
+	} else {
+		header, records, err := readCSV(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range records {
+			count, _ := strconv.Atoi(field(header, rec, "timesused"))
+			entries = append(entries, historyEntry{
+				name:  field(header, rec, "fieldname"),
+				value: field(header, rec, "value"),
+				count: count,
+			})
+		}
+	}
+
+	fields := mostUsedValues(entries)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return []*storage.Preset{
+		newPreset("Firefox form history", storage.ScopeTypeGlobal, "", deviceID, "firefox-formhistory", fields),
+	}, nil
+}
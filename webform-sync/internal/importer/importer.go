@@ -0,0 +1,177 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// Converter turns a third-party export into presets
+type Converter interface {
+	// Name is the identifier used in the import endpoint's format parameter
+	Name() string
+	// Description is a human-readable summary of the source format
+	Description() string
+	// Detect reports whether data looks like this converter's format
+	Detect(data []byte) bool
+	// Convert maps the export into presets owned by deviceID
+	Convert(data []byte, deviceID string) ([]*storage.Preset, error)
+}
+
+var converters = map[string]Converter{}
+
+// Register adds a converter to the registry
+func Register(c Converter) {
+	converters[c.Name()] = c
+}
+
+// Get returns the converter registered under name
+func Get(name string) (Converter, bool) {
+	c, ok := converters[name]
+	return c, ok
+}
+
+// Detect returns the first converter (in name order) that recognizes data
+func Detect(data []byte) (Converter, bool) {
+	for _, name := range Names() {
+		if converters[name].Detect(data) {
+			return converters[name], true
+		}
+	}
+	return nil, false
+}
+
+// Names lists registered converter names in sorted order
+func Names() []string {
+	names := make([]string, 0, len(converters))
+	for name := range converters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	Register(chromeAutofill{})
+	Register(firefoxFormHistory{})
+	Register(bitwardenCSV{})
+	Register(bitwardenJSON{})
+	Register(keepassCSV{})
+}
+
+// readCSV parses CSV data into a header index and records
+func readCSV(data []byte) (map[string]int, [][]string, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("empty CSV")
+	}
+
+	header := make(map[string]int, len(records[0]))
+	for i, name := range records[0] {
+		header[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	return header, records[1:], nil
+}
+
+// csvHeaderHas checks whether the first CSV line contains all the given columns
+func csvHeaderHas(data []byte, columns ...string) bool {
+	line := data
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		line = data[:i]
+	}
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(line, []byte("\xef\xbb\xbf"))))
+	header, err := reader.Read()
+	if err != nil {
+		return false
+	}
+
+	have := make(map[string]bool, len(header))
+	for _, name := range header {
+		have[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	for _, col := range columns {
+		if !have[col] {
+			return false
+		}
+	}
+	return true
+}
+
+// field returns a record value by header name
+func field(header map[string]int, rec []string, name string) string {
+	if i, ok := header[name]; ok && i < len(rec) {
+		return strings.TrimSpace(rec[i])
+	}
+	return ""
+}
+
+// scopeFromURI derives a domain scope from a login URI
+func scopeFromURI(uri string) (string, string) {
+	uri = strings.TrimSpace(uri)
+	if uri == "" {
+		return storage.ScopeTypeGlobal, ""
+	}
+	if !strings.Contains(uri, "://") {
+		uri = "https://" + uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Hostname() == "" {
+		return storage.ScopeTypeGlobal, ""
+	}
+	return storage.ScopeTypeDomain, strings.ToLower(u.Hostname())
+}
+
+// newPreset builds a preset with import metadata
+func newPreset(name, scopeType, scopeValue, deviceID, source string, fields map[string]interface{}) *storage.Preset {
+	now := time.Now()
+	return &storage.Preset{
+		Name:       name,
+		ScopeType:  scopeType,
+		ScopeValue: scopeValue,
+		DeviceID:   deviceID,
+		Fields:     fields,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		Metadata: map[string]interface{}{
+			"importedFrom": source,
+			"importedAt":   now,
+		},
+	}
+}
+
+// historyEntry is one (field name, value) observation with a usage count
+type historyEntry struct {
+	name  string
+	value string
+	count int
+}
+
+// mostUsedValues picks the most used value for each field name
+func mostUsedValues(entries []historyEntry) map[string]interface{} {
+	best := map[string]historyEntry{}
+	for _, e := range entries {
+		if e.name == "" || e.value == "" {
+			continue
+		}
+		if cur, ok := best[e.name]; !ok || e.count > cur.count {
+			best[e.name] = e
+		}
+	}
+
+	fields := make(map[string]interface{}, len(best))
+	for name, e := range best {
+		fields[name] = e.value
+	}
+	return fields
+}
@@ -0,0 +1,160 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// Password-manager converters only carry over identity and username data.
+// Passwords, TOTP secrets and government ID numbers are deliberately dropped:
+// presets are form-fill data, not a credential vault.
+
+// bitwardenCSV converts a Bitwarden CSV export. Each login becomes a preset
+// scoped to its URI's domain with the username and custom fields.
+type bitwardenCSV struct{}
+
+func (bitwardenCSV) Name() string { return "bitwarden-csv" }
+
+func (bitwardenCSV) Description() string {
+	return "Bitwarden CSV export (logins with usernames and custom fields)"
+}
+
+func (bitwardenCSV) Detect(data []byte) bool {
+	return csvHeaderHas(data, "login_uri", "login_username", "type")
+}
+
+func (bitwardenCSV) Convert(data []byte, deviceID string) ([]*storage.Preset, error) {
+	header, records, err := readCSV(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var presets []*storage.Preset
+	for _, rec := range records {
+		fields := map[string]interface{}{}
+		if v := field(header, rec, "login_username"); v != "" {
+			fields["username"] = v
+		}
+		// Custom fields are exported as "name: value" lines
+		for _, line := range strings.Split(field(header, rec, "fields"), "\n") {
+			if name, value, ok := strings.Cut(line, ":"); ok && strings.TrimSpace(name) != "" {
+				fields[strings.TrimSpace(name)] = strings.TrimSpace(value)
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		scopeType, scopeValue := scopeFromURI(field(header, rec, "login_uri"))
+		name := field(header, rec, "name")
+		if name == "" {
+			name = scopeValue
+		}
+		presets = append(presets, newPreset(name, scopeType, scopeValue, deviceID, "bitwarden-csv", fields))
+	}
+
+	return presets, nil
+}
+
+// bitwardenJSON converts identity items from a Bitwarden JSON export into
+// global presets
+type bitwardenJSON struct{}
+
+func (bitwardenJSON) Name() string { return "bitwarden-json" }
+
+func (bitwardenJSON) Description() string {
+	return "Bitwarden JSON export (identity items)"
+}
+
+func (bitwardenJSON) Detect(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	head := trimmed[:min(len(trimmed), 2048)]
+	return bytes.HasPrefix(trimmed, []byte("{")) && bytes.Contains(head, []byte(`"items"`)) &&
+		(bytes.Contains(head, []byte(`"encrypted"`)) || bytes.Contains(head, []byte(`"folders"`)))
+}
+
+// bitwardenIdentityFields maps Bitwarden identity keys to preset field names
+var bitwardenIdentityFields = []string{
+	"title", "firstName", "middleName", "lastName", "company", "email", "phone",
+	"address1", "address2", "address3", "city", "state", "postalCode", "country", "username",
+}
+
+func (bitwardenJSON) Convert(data []byte, deviceID string) ([]*storage.Preset, error) {
+	var export struct {
+		Encrypted bool `json:"encrypted"`
+		Items     []struct {
+			Type     int                    `json:"type"`
+			Name     string                 `json:"name"`
+			Identity map[string]interface{} `json:"identity"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, fmt.Errorf("invalid Bitwarden JSON: %w", err)
+	}
+	if export.Encrypted {
+		return nil, fmt.Errorf("encrypted Bitwarden exports are not supported; export as unencrypted JSON")
+	}
+
+	var presets []*storage.Preset
+	for _, item := range export.Items {
+		// Type 4 is an identity item
+		if item.Type != 4 || item.Identity == nil {
+			continue
+		}
+		fields := map[string]interface{}{}
+		for _, key := range bitwardenIdentityFields {
+			if v, ok := item.Identity[key].(string); ok && v != "" {
+				fields[key] = v
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		presets = append(presets, newPreset(item.Name, storage.ScopeTypeGlobal, "", deviceID, "bitwarden-json", fields))
+	}
+
+	return presets, nil
+}
+
+// keepassCSV converts a KeePass/KeePassXC CSV export. Entries with a URL
+// become domain-scoped presets holding the username.
+type keepassCSV struct{}
+
+func (keepassCSV) Name() string { return "keepass-csv" }
+
+func (keepassCSV) Description() string {
+	return "KeePass / KeePassXC CSV export (titles, usernames, URLs)"
+}
+
+func (keepassCSV) Detect(data []byte) bool {
+	return csvHeaderHas(data, "title", "username", "url") && !csvHeaderHas(data, "login_uri")
+}
+
+func (keepassCSV) Convert(data []byte, deviceID string) ([]*storage.Preset, error) {
+	header, records, err := readCSV(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var presets []*storage.Preset
+	for _, rec := range records {
+		username := field(header, rec, "username")
+		if username == "" {
+			continue
+		}
+
+		scopeType, scopeValue := scopeFromURI(field(header, rec, "url"))
+		name := field(header, rec, "title")
+		if name == "" {
+			name = scopeValue
+		}
+		presets = append(presets, newPreset(name, scopeType, scopeValue, deviceID, "keepass-csv",
+			map[string]interface{}{"username": username}))
+	}
+
+	return presets, nil
+}
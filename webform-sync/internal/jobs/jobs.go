@@ -0,0 +1,254 @@
+// Package jobs tracks long-running work, such as backups, maintenance and
+// imports, so admins can see its progress and errors and cancel it.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// Job kinds
+const (
+	Backup      = "backup"
+	Maintenance = "maintenance"
+	Cleanup     = "cleanup"
+	Compact     = "compact"
+	Import      = "import"
+)
+
+// Job statuses
+const (
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Cancelled = "cancelled"
+)
+
+// historyLimit is how many finished jobs are kept. History is in memory
+// only, so it starts again on restart.
+const historyLimit = 200
+
+// ErrNotFound is returned by Cancel for a job that doesn't exist, or that
+// the caller can't see
+var ErrNotFound = errors.New("job not found")
+
+// ErrFinished is returned by Cancel for a job that has already finished
+var ErrFinished = errors.New("job has already finished")
+
+// Func is the work a job does. It should return soon after ctx is
+// cancelled, and may report its progress through job.
+type Func func(ctx context.Context, job *Job) error
+
+// Progress counts the items a job has done out of its total, where the
+// total is known
+type Progress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// Info is a snapshot of a job
+type Info struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Tenant is the tenant whose database the job works on, if any
+	Tenant string `json:"tenant,omitempty"`
+	// Status is running, succeeded, failed or cancelled
+	Status   string    `json:"status"`
+	Progress *Progress `json:"progress,omitempty"`
+	// Step describes what a running job is doing
+	Step       string     `json:"step,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Job is a running or finished job
+type Job struct {
+	manager *Manager
+	cancel  context.CancelFunc
+	done    chan struct{}
+	err     error
+
+	// info is guarded by manager.mu
+	info Info
+}
+
+// ID returns the job's ID
+func (j *Job) ID() string {
+	return j.info.ID
+}
+
+// Wait waits for the job to finish and returns its error
+func (j *Job) Wait() error {
+	<-j.done
+	return j.err
+}
+
+// SetProgress records how many items the job has done out of total
+func (j *Job) SetProgress(done, total int) {
+	j.manager.mu.Lock()
+	defer j.manager.mu.Unlock()
+	j.info.Progress = &Progress{Done: done, Total: total}
+}
+
+// SetStep records what the job is doing
+func (j *Job) SetStep(step string) {
+	j.manager.mu.Lock()
+	defer j.manager.mu.Unlock()
+	j.info.Step = step
+}
+
+// Manager runs jobs and keeps the recent ones. One manager is shared by
+// all tenants.
+type Manager struct {
+	mu sync.Mutex
+	// jobs are running and recently finished jobs, oldest first
+	jobs []*Job
+}
+
+// NewManager creates a job manager
+func NewManager() *Manager {
+	return &Manager{}
+}
+
+// Start runs fn as a job in the background. The job's context is derived
+// from parent, so cancelling parent cancels the job as well.
+func (m *Manager) Start(parent context.Context, kind, tenant string, fn Func) *Job {
+	ctx, cancel := context.WithCancel(parent)
+	job := &Job{
+		manager: m,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		info: Info{
+			ID:        storage.NewPresetID(),
+			Kind:      kind,
+			Tenant:    tenant,
+			Status:    Running,
+			StartedAt: time.Now(),
+		},
+	}
+
+	m.mu.Lock()
+	m.jobs = append(m.jobs, job)
+	m.prune()
+	m.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		err := fn(ctx, job)
+
+		m.mu.Lock()
+		finished := time.Now()
+		job.info.FinishedAt = &finished
+		job.info.Step = ""
+		switch {
+		case err == nil:
+			job.info.Status = Succeeded
+		case ctx.Err() != nil:
+			job.info.Status = Cancelled
+			job.info.Error = err.Error()
+		default:
+			job.info.Status = Failed
+			job.info.Error = err.Error()
+		}
+		m.mu.Unlock()
+
+		job.err = err
+		close(job.done)
+	}()
+	return job
+}
+
+// Run runs fn as a job and waits for it
+func (m *Manager) Run(parent context.Context, kind, tenant string, fn Func) error {
+	return m.Start(parent, kind, tenant, fn).Wait()
+}
+
+// prune drops the oldest finished jobs beyond historyLimit. Running jobs
+// are always kept. m.mu must be held.
+func (m *Manager) prune() {
+	finished := 0
+	for _, job := range m.jobs {
+		if job.info.FinishedAt != nil {
+			finished++
+		}
+	}
+	if finished <= historyLimit {
+		return
+	}
+	kept := m.jobs[:0]
+	for _, job := range m.jobs {
+		if job.info.FinishedAt != nil && finished > historyLimit {
+			finished--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	m.jobs = kept
+}
+
+// visible reports whether a caller limited to tenant can see a job. An
+// empty tenant sees every job.
+func visible(job *Job, tenant string) bool {
+	return tenant == "" || job.info.Tenant == tenant
+}
+
+// List returns the jobs the caller can see, newest first
+func (m *Manager) List(tenant string) []Info {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := []Info{}
+	for i := len(m.jobs) - 1; i >= 0; i-- {
+		if job := m.jobs[i]; visible(job, tenant) {
+			list = append(list, job.snapshot())
+		}
+	}
+	return list
+}
+
+// Get returns a job the caller can see
+func (m *Manager) Get(id, tenant string) (Info, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, job := range m.jobs {
+		if job.info.ID == id && visible(job, tenant) {
+			return job.snapshot(), true
+		}
+	}
+	return Info{}, false
+}
+
+// Cancel cancels a running job the caller can see. The job stops once its
+// work notices, which Wait and the job's status show.
+func (m *Manager) Cancel(id, tenant string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, job := range m.jobs {
+		if job.info.ID != id || !visible(job, tenant) {
+			continue
+		}
+		if job.info.FinishedAt != nil {
+			return ErrFinished
+		}
+		job.cancel()
+		return nil
+	}
+	return ErrNotFound
+}
+
+// snapshot copies a job's info. m.mu must be held.
+func (j *Job) snapshot() Info {
+	info := j.info
+	if info.Progress != nil {
+		progress := *info.Progress
+		info.Progress = &progress
+	}
+	return info
+}
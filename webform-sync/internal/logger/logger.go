@@ -1,11 +1,13 @@
 package logger
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/tezza1971/webform-sync/internal/config"
 	"gopkg.in/natefinch/lumberjack.v2"
@@ -21,18 +23,62 @@ const (
 	LevelError
 )
 
+// String returns the config name of a level
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// levels holds the default level and per-module overrides. It is shared by a
+// logger and all loggers derived from it, so runtime changes apply everywhere.
+type levels struct {
+	mu       sync.RWMutex
+	fallback LogLevel
+	modules  map[string]LogLevel
+}
+
+func (lv *levels) get(module string) LogLevel {
+	lv.mu.RLock()
+	defer lv.mu.RUnlock()
+	if level, ok := lv.modules[module]; ok {
+		return level
+	}
+	return lv.fallback
+}
+
 // Logger handles application logging
 type Logger struct {
-	debug *log.Logger
-	info  *log.Logger
-	warn  *log.Logger
-	err   *log.Logger
-	level LogLevel
+	debug  *log.Logger
+	info   *log.Logger
+	warn   *log.Logger
+	err    *log.Logger
+	levels *levels
+	recent *recentLines
+
+	// module selects the level override that applies, e.g. "storage"
+	module string
+
+	// prefix is prepended to every message, e.g. a request ID
+	prefix string
 }
 
 // NewLogger creates a new logger instance
 func NewLogger(cfg config.LoggingConfig) *Logger {
-	level := parseLogLevel(cfg.Level)
+	lv := &levels{
+		fallback: parseLogLevel(cfg.Level),
+		modules:  make(map[string]LogLevel, len(cfg.Modules)),
+	}
+	for module, level := range cfg.Modules {
+		lv.modules[module] = parseLogLevel(level)
+	}
 
 	var writer io.Writer
 
@@ -48,13 +94,136 @@ func NewLogger(cfg config.LoggingConfig) *Logger {
 		writer = os.Stdout
 	}
 
+	// The latest lines are also kept in memory, for the dashboard
+	recent := &recentLines{lines: make([]string, recentLineCount)}
+	writer = io.MultiWriter(writer, recent)
+
 	return &Logger{
-		debug: log.New(writer, "[DEBUG] ", log.Ldate|log.Ltime|log.Lshortfile),
-		info:  log.New(writer, "[INFO]  ", log.Ldate|log.Ltime),
-		warn:  log.New(writer, "[WARN]  ", log.Ldate|log.Ltime),
-		err:   log.New(writer, "[ERROR] ", log.Ldate|log.Ltime|log.Lshortfile),
-		level: level,
+		debug:  log.New(writer, "[DEBUG] ", log.Ldate|log.Ltime|log.Lshortfile),
+		info:   log.New(writer, "[INFO]  ", log.Ldate|log.Ltime),
+		warn:   log.New(writer, "[WARN]  ", log.Ldate|log.Ltime),
+		err:    log.New(writer, "[ERROR] ", log.Ldate|log.Ltime|log.Lshortfile),
+		levels: lv,
+		recent: recent,
+	}
+}
+
+// Module returns a logger for one module (see config.LogModules), which
+// honours that module's level override
+func (l *Logger) Module(name string) *Logger {
+	child := *l
+	child.module = name
+	return &child
+}
+
+// Levels returns the default level and the current per-module overrides
+func (l *Logger) Levels() (string, map[string]string) {
+	l.levels.mu.RLock()
+	defer l.levels.mu.RUnlock()
+
+	modules := make(map[string]string, len(l.levels.modules))
+	for module, level := range l.levels.modules {
+		modules[module] = level.String()
+	}
+	return l.levels.fallback.String(), modules
+}
+
+// SetLevel changes a level at runtime. An empty module sets the default
+// level; level "" clears a module's override.
+func (l *Logger) SetLevel(module, level string) error {
+	if level != "" && !validLevel(level) {
+		return fmt.Errorf("invalid log level %q: use %s", level, strings.Join(levelNames, ", "))
+	}
+	if module != "" && !knownModule(module) {
+		return fmt.Errorf("unknown log module %q: use %s", module, strings.Join(config.LogModules, ", "))
+	}
+
+	l.levels.mu.Lock()
+	defer l.levels.mu.Unlock()
+	switch {
+	case module == "":
+		if level == "" {
+			return fmt.Errorf("level is required")
+		}
+		l.levels.fallback = parseLogLevel(level)
+	case level == "":
+		delete(l.levels.modules, module)
+	default:
+		l.levels.modules[module] = parseLogLevel(level)
+	}
+	return nil
+}
+
+// levelNames lists the accepted level names
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// validLevel reports whether a level name is recognised
+func validLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "debug", "info", "warn", "warning", "error":
+		return true
+	}
+	return false
+}
+
+func knownModule(module string) bool {
+	for _, m := range config.LogModules {
+		if m == module {
+			return true
+		}
+	}
+	return false
+}
+
+// Recent returns up to the last n lines logged, oldest first
+func (l *Logger) Recent(n int) []string {
+	if l.recent == nil {
+		return nil
+	}
+	return l.recent.last(n)
+}
+
+// WithRequestID returns a logger that tags every line with a request ID
+func (l *Logger) WithRequestID(id string) *Logger {
+	child := *l
+	child.prefix = l.prefix + "[" + id + "] "
+	return &child
+}
+
+// recentLineCount is how many log lines are kept in memory
+const recentLineCount = 200
+
+// recentLines is a ring of the latest lines written to the log. It is shared,
+// like levels, by a logger and all loggers derived from it.
+type recentLines struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	count int
+}
+
+// Write stores a log line. The standard logger writes each line in one call.
+func (r *recentLines) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		r.lines[r.next] = line
+		r.next = (r.next + 1) % len(r.lines)
+		r.count = min(r.count+1, len(r.lines))
+	}
+	return len(p), nil
+}
+
+// last returns up to the last n lines, oldest first
+func (r *recentLines) last(n int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n = max(0, min(n, r.count))
+	out := make([]string, 0, n)
+	for i := n; i > 0; i-- {
+		out = append(out, r.lines[(r.next-i+len(r.lines))%len(r.lines)])
 	}
+	return out
 }
 
 // createFileWriter creates a rotating file writer
@@ -93,35 +262,35 @@ func parseLogLevel(level string) LogLevel {
 
 // Debug logs debug messages
 func (l *Logger) Debug(format string, v ...interface{}) {
-	if l.level <= LevelDebug {
-		l.debug.Printf(format, v...)
+	if l.levels.get(l.module) <= LevelDebug {
+		l.debug.Printf(l.prefix+format, v...)
 	}
 }
 
 // Info logs informational messages
 func (l *Logger) Info(format string, v ...interface{}) {
-	if l.level <= LevelInfo {
-		l.info.Printf(format, v...)
+	if l.levels.get(l.module) <= LevelInfo {
+		l.info.Printf(l.prefix+format, v...)
 	}
 }
 
 // Warn logs warning messages
 func (l *Logger) Warn(format string, v ...interface{}) {
-	if l.level <= LevelWarn {
-		l.warn.Printf(format, v...)
+	if l.levels.get(l.module) <= LevelWarn {
+		l.warn.Printf(l.prefix+format, v...)
 	}
 }
 
 // Error logs error messages
 func (l *Logger) Error(format string, v ...interface{}) {
-	if l.level <= LevelError {
-		l.err.Printf(format, v...)
+	if l.levels.get(l.module) <= LevelError {
+		l.err.Printf(l.prefix+format, v...)
 	}
 }
 
 // Fatal logs error message and exits
 func (l *Logger) Fatal(format string, v ...interface{}) {
-	l.err.Printf(format, v...)
+	l.err.Printf(l.prefix+format, v...)
 	os.Exit(1)
 }
 
@@ -0,0 +1,379 @@
+// Package mdns advertises a service on the local network with multicast DNS
+// service discovery (RFC 6762 and 6763), so clients can find it without
+// being told its address. It answers only for its own service and leaves
+// other names to the system's responder, if there is one.
+package mdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// group is the mDNS multicast address
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// TTLs from RFC 6762 section 10: host records are short-lived, so address
+// changes spread quickly
+const (
+	hostTTL    = 120
+	serviceTTL = 4500
+)
+
+// classCacheFlush marks a record as the only one of its name and type. In
+// a question, the same bit asks for a unicast reply.
+const classCacheFlush = 0x8000
+
+// Service describes what to advertise
+type Service struct {
+	// Instance is the name users see, such as "Webform Sync on nas"
+	Instance string
+	// Type is the service type, such as "_webform-sync._tcp"
+	Type string
+	// Host is the machine's name, advertised as <Host>.local
+	Host string
+	Port int
+	// TXT are key=value pairs describing the instance
+	TXT []string
+}
+
+// Responder answers queries for a service and announces it
+type Responder struct {
+	svc    Service
+	conn   *ipv4.PacketConn
+	ifaces []net.Interface
+
+	// The service's names, fully qualified
+	typeName     dnsmessage.Name
+	instanceName dnsmessage.Name
+	hostName     dnsmessage.Name
+}
+
+// servicesName lists the service types on the network (RFC 6763 section 9)
+var servicesName = dnsmessage.MustNewName("_services._dns-sd._udp.local.")
+
+// Listen joins the mDNS group on the given interfaces, or on every
+// multicast interface that is up when there are none
+func Listen(svc Service, ifaces []net.Interface) (*Responder, error) {
+	if len(ifaces) == 0 {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list interfaces: %w", err)
+		}
+		for _, ifi := range all {
+			if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 && ifi.Flags&net.FlagLoopback == 0 {
+				ifaces = append(ifaces, ifi)
+			}
+		}
+	}
+	if len(ifaces) == 0 {
+		return nil, errors.New("no multicast network interfaces")
+	}
+
+	r := &Responder{svc: svc, ifaces: ifaces}
+	var err error
+	if r.typeName, err = dnsmessage.NewName(svc.Type + ".local."); err != nil {
+		return nil, fmt.Errorf("invalid service type %q", svc.Type)
+	}
+	if r.instanceName, err = dnsmessage.NewName(label(svc.Instance) + "." + svc.Type + ".local."); err != nil {
+		return nil, fmt.Errorf("invalid instance name %q", svc.Instance)
+	}
+	if r.hostName, err = dnsmessage.NewName(label(svc.Host) + ".local."); err != nil {
+		return nil, fmt.Errorf("invalid host name %q", svc.Host)
+	}
+
+	// ListenMulticastUDP shares the port with the system's responder
+	udp, err := net.ListenMulticastUDP("udp4", &ifaces[0], group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for mDNS: %w", err)
+	}
+	r.conn = ipv4.NewPacketConn(udp)
+	for i := range ifaces[1:] {
+		r.conn.JoinGroup(&ifaces[i+1], group)
+	}
+	// Knowing the interface a query came in on lets answers give that
+	// network's address; where the platform can't tell, all are given
+	r.conn.SetControlMessage(ipv4.FlagInterface, true)
+	r.conn.SetMulticastTTL(255)
+	// ListenMulticastUDP turns loopback off, which would hide the service
+	// from clients on this machine
+	r.conn.SetMulticastLoopback(true)
+	return r, nil
+}
+
+// label makes s a single DNS label: dots would split it, and labels are at
+// most 63 bytes
+func label(s string) string {
+	s = strings.ReplaceAll(s, ".", "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
+
+// Serve answers queries until stop is closed, then says goodbye so caches
+// drop the service at once. The service is announced as it starts.
+func (r *Responder) Serve(stop <-chan struct{}) {
+	go func() {
+		<-stop
+		r.announce(0)
+		r.conn.Close()
+	}()
+
+	// RFC 6762 section 8.3: announce at least twice, a second apart
+	go func() {
+		for i := 0; i < 2; i++ {
+			r.announce(1)
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, cm, src, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		ifIndex := 0
+		if cm != nil {
+			ifIndex = cm.IfIndex
+		}
+		r.answer(buf[:n], ifIndex, src)
+	}
+}
+
+// answer replies to a query for any of the service's names
+func (r *Responder) answer(query []byte, ifIndex int, src net.Addr) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+
+	var answers []dnsmessage.Question
+	unicast := false
+	for _, q := range questions {
+		if r.owns(q) {
+			answers = append(answers, q)
+			unicast = unicast || q.Class&classCacheFlush != 0
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+
+	// A query from a port other than 5353 is a plain DNS client, which
+	// wants a unicast reply echoing its ID and questions (section 6.7)
+	legacy := false
+	if udp, ok := src.(*net.UDPAddr); ok && udp.Port != group.Port {
+		legacy, unicast = true, true
+	}
+	header := dnsmessage.Header{Response: true, Authoritative: true}
+	var echo []dnsmessage.Question
+	if legacy {
+		header.ID, echo = h.ID, answers
+	}
+
+	msg, err := r.response(header, echo, answers, reply{ifIndex: ifIndex, ttlScale: 1, legacy: legacy})
+	if err != nil {
+		return
+	}
+	dst := net.Addr(group)
+	if unicast {
+		dst = src
+	}
+	r.send(msg, ifIndex, dst)
+}
+
+// owns reports whether a question asks for one of the service's records
+func (r *Responder) owns(q dnsmessage.Question) bool {
+	all := q.Type == dnsmessage.TypeALL
+	switch name := q.Name.String(); {
+	case strings.EqualFold(name, r.typeName.String()):
+		return all || q.Type == dnsmessage.TypePTR
+	case strings.EqualFold(name, servicesName.String()):
+		return all || q.Type == dnsmessage.TypePTR
+	case strings.EqualFold(name, r.instanceName.String()):
+		return all || q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeTXT
+	case strings.EqualFold(name, r.hostName.String()):
+		return all || q.Type == dnsmessage.TypeA
+	}
+	return false
+}
+
+// announce sends every record unasked, on every interface; a ttlScale of 0
+// withdraws them
+func (r *Responder) announce(ttlScale uint32) {
+	all := []dnsmessage.Question{
+		{Name: r.typeName, Type: dnsmessage.TypePTR},
+		{Name: r.instanceName, Type: dnsmessage.TypeALL},
+		{Name: r.hostName, Type: dnsmessage.TypeA},
+	}
+	for _, ifi := range r.ifaces {
+		msg, err := r.response(dnsmessage.Header{Response: true, Authoritative: true}, nil, all, reply{ifIndex: ifi.Index, ttlScale: ttlScale})
+		if err == nil {
+			r.send(msg, ifi.Index, group)
+		}
+	}
+}
+
+// recordSet chooses the service's records to put in a section
+type recordSet struct{ ptr, services, srv, txt, a bool }
+
+// reply says how to write a response's records
+type reply struct {
+	// ifIndex is the interface it goes out on, for its address
+	ifIndex int
+	// ttlScale of 0 makes it a goodbye
+	ttlScale uint32
+	// legacy replies to a plain DNS client: no cache-flush bits and short
+	// TTLs (RFC 6762 section 6.7)
+	legacy bool
+}
+
+// response builds a reply answering questions, with the records that
+// follow from them as additional records. Echoed questions are repeated,
+// as plain DNS clients expect.
+func (r *Responder) response(h dnsmessage.Header, echo, questions []dnsmessage.Question, rp reply) ([]byte, error) {
+	var answer, extra recordSet
+	for _, q := range questions {
+		all := q.Type == dnsmessage.TypeALL
+		switch name := q.Name.String(); {
+		case strings.EqualFold(name, r.typeName.String()):
+			answer.ptr = true
+			extra.srv, extra.txt, extra.a = true, true, true
+		case strings.EqualFold(name, servicesName.String()):
+			answer.services = true
+		case strings.EqualFold(name, r.instanceName.String()):
+			answer.srv = answer.srv || all || q.Type == dnsmessage.TypeSRV
+			answer.txt = answer.txt || all || q.Type == dnsmessage.TypeTXT
+			extra.a = true
+		case strings.EqualFold(name, r.hostName.String()):
+			answer.a = true
+		}
+	}
+	extra = recordSet{
+		srv: extra.srv && !answer.srv,
+		txt: extra.txt && !answer.txt,
+		a:   extra.a && !answer.a,
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), h)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, q := range echo {
+		if err := b.Question(q); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if err := r.records(&b, answer, rp); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	if err := r.records(&b, extra, rp); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// records adds the chosen records to the current section
+func (r *Responder) records(b *dnsmessage.Builder, set recordSet, rp reply) error {
+	header := func(name dnsmessage.Name, ttl uint32, unique bool) dnsmessage.ResourceHeader {
+		h := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: ttl * rp.ttlScale}
+		if rp.legacy {
+			h.TTL = min(h.TTL, 10)
+		} else if unique {
+			h.Class |= classCacheFlush
+		}
+		return h
+	}
+
+	if set.ptr {
+		if err := b.PTRResource(header(r.typeName, serviceTTL, false), dnsmessage.PTRResource{PTR: r.instanceName}); err != nil {
+			return err
+		}
+	}
+	if set.services {
+		if err := b.PTRResource(header(servicesName, serviceTTL, false), dnsmessage.PTRResource{PTR: r.typeName}); err != nil {
+			return err
+		}
+	}
+	if set.srv {
+		srv := dnsmessage.SRVResource{Port: uint16(r.svc.Port), Target: r.hostName}
+		if err := b.SRVResource(header(r.instanceName, hostTTL, true), srv); err != nil {
+			return err
+		}
+	}
+	if set.txt {
+		// An empty TXT record still needs one string (RFC 6763 section 6.1)
+		txt := r.svc.TXT
+		if len(txt) == 0 {
+			txt = []string{""}
+		}
+		if err := b.TXTResource(header(r.instanceName, serviceTTL, true), dnsmessage.TXTResource{TXT: txt}); err != nil {
+			return err
+		}
+	}
+	if set.a {
+		for _, ip := range r.addresses(rp.ifIndex) {
+			var addr [4]byte
+			copy(addr[:], ip)
+			if err := b.AResource(header(r.hostName, hostTTL, true), dnsmessage.AResource{A: addr}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addresses returns the IPv4 addresses of an interface, or of all the
+// responder's interfaces when it isn't known
+func (r *Responder) addresses(ifIndex int) []net.IP {
+	var ips []net.IP
+	for _, ifi := range r.ifaces {
+		if ifIndex != 0 && ifi.Index != ifIndex {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				if ip4 := ipnet.IP.To4(); ip4 != nil {
+					ips = append(ips, ip4)
+				}
+			}
+		}
+	}
+	return ips
+}
+
+// send writes a message, out of the interface given if known
+func (r *Responder) send(msg []byte, ifIndex int, dst net.Addr) {
+	var cm *ipv4.ControlMessage
+	if ifIndex != 0 {
+		cm = &ipv4.ControlMessage{IfIndex: ifIndex}
+	}
+	r.conn.WriteTo(msg, cm, dst)
+}
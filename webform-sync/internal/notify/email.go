@@ -0,0 +1,227 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/events"
+)
+
+// smtpTimeout bounds a whole delivery, from dialling to QUIT
+const smtpTimeout = 30 * time.Second
+
+// Default message templates. Templates are given an emailData.
+const (
+	defaultEmailSubject = `[webform-sync] {{.Summary}}`
+	defaultEmailBody    = `{{.Summary}}
+
+Event:  {{.Type}}
+Time:   {{.Time.Format "2006-01-02 15:04:05 MST"}}
+{{- if .Tenant}}
+Tenant: {{.Tenant}}
+{{- end}}
+
+{{.DataJSON}}
+`
+)
+
+// emailTemplate is a parsed subject and body
+type emailTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// emailData is what message templates are rendered with
+type emailData struct {
+	events.Event
+	// Summary is the one-line description push notifications use
+	Summary string
+	// Fields is the event data as a map, e.g. {{.Fields.name}}
+	Fields map[string]interface{}
+	// DataJSON is the event data as indented JSON
+	DataJSON string
+}
+
+// defaultEmailTemplate is used for events without a template of their own
+var defaultEmailTemplate = emailTemplate{
+	subject: template.Must(template.New("subject").Parse(defaultEmailSubject)),
+	body:    template.Must(template.New("body").Parse(defaultEmailBody)),
+}
+
+// Email sends events as email through an SMTP server
+type Email struct {
+	cfg       config.EmailConfig
+	templates map[string]emailTemplate
+}
+
+// NewEmail creates an email sink, or returns nil if no SMTP server is
+// configured
+func NewEmail(cfg config.EmailConfig) (*Email, error) {
+	if cfg.Host == "" {
+		return nil, nil
+	}
+	m := &Email{cfg: cfg, templates: map[string]emailTemplate{}}
+	for event, t := range cfg.Templates {
+		tmpl := defaultEmailTemplate
+		var err error
+		if t.Subject != "" {
+			if tmpl.subject, err = template.New("subject").Parse(t.Subject); err != nil {
+				return nil, fmt.Errorf("invalid email subject template for %s: %w", event, err)
+			}
+		}
+		if t.Body != "" {
+			if tmpl.body, err = template.New("body").Parse(t.Body); err != nil {
+				return nil, fmt.Errorf("invalid email body template for %s: %w", event, err)
+			}
+		}
+		m.templates[event] = tmpl
+	}
+	return m, nil
+}
+
+// Name identifies the sink in logs
+func (m *Email) Name() string {
+	return "email"
+}
+
+// Accepts reports whether an event type is turned on
+func (m *Email) Accepts(eventType string) bool {
+	on, _ := events.Lookup(m.cfg.Events, eventType)
+	return on
+}
+
+// Handle renders the event's message and sends it
+func (m *Email) Handle(ctx context.Context, e events.Event) error {
+	msg, err := m.message(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	return m.send(ctx, msg)
+}
+
+// message renders an event as a complete email
+func (m *Email) message(e events.Event) ([]byte, error) {
+	data := emailData{Event: e, Summary: e.Summary()}
+	if raw, err := json.Marshal(e.Data); err == nil {
+		json.Unmarshal(raw, &data.Fields)
+	}
+	if indented, err := json.MarshalIndent(e.Data, "", "  "); err == nil {
+		data.DataJSON = string(indented)
+	}
+
+	tmpl, ok := events.Lookup(m.templates, e.Type)
+	if !ok {
+		tmpl = defaultEmailTemplate
+	}
+	var subject, body bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return nil, fmt.Errorf("failed to render subject: %w", err)
+	}
+	if err := tmpl.body.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("failed to render body: %w", err)
+	}
+
+	var msg bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", key, value)
+	}
+	header("From", m.cfg.From)
+	header("To", strings.Join(m.cfg.To, ", "))
+	// Headers are one line; a template may have left a newline in
+	header("Subject", mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subject.String()), " ")))
+	header("Date", e.Time.Format(time.RFC1123Z))
+	header("Message-ID", "<"+e.ID+"@webform-sync>")
+	header("MIME-Version", "1.0")
+	header("Content-Type", `text/plain; charset="utf-8"`)
+	header("Content-Transfer-Encoding", "quoted-printable")
+	msg.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write(body.Bytes())
+	qp.Close()
+	return msg.Bytes(), nil
+}
+
+// send delivers a message over SMTP
+func (m *Email) send(ctx context.Context, msg []byte) error {
+	addr := net.JoinHostPort(m.cfg.Host, strconv.Itoa(m.cfg.Port))
+	tlsConfig := &tls.Config{ServerName: m.cfg.Host}
+
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	var err error
+	if m.cfg.TLS == "tls" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// Unblock the conversation if the bus shuts down mid-delivery
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	client, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if m.cfg.TLS == "starttls" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	if m.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+
+	from, err := mail.ParseAddress(m.cfg.From)
+	if err != nil {
+		return err
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range m.cfg.To {
+		rcpt, err := mail.ParseAddress(to)
+		if err != nil {
+			return err
+		}
+		if err := client.Rcpt(rcpt.Address); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,198 @@
+// Package notify contains event bus sinks that push notifications to
+// outside services: an MQTT broker, ntfy and Gotify.
+package notify
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/events"
+)
+
+// mqttTimeout bounds connecting to the broker and each packet exchange
+const mqttTimeout = 10 * time.Second
+
+// MQTT publishes each event as JSON to <prefix>/[<tenant>/]<type>, with the
+// dots in the type turned into topic levels (e.g. webform-sync/device/registered),
+// or to the topic configured for its type.
+//
+// Events are infrequent, so rather than hold a session open it connects,
+// publishes at QoS 0 and disconnects for each one. That keeps this to the
+// handful of MQTT 3.1.1 packets it needs.
+type MQTT struct {
+	cfg config.MQTTConfig
+}
+
+// NewMQTT creates an MQTT sink, or returns nil if no broker is configured
+func NewMQTT(cfg config.MQTTConfig) *MQTT {
+	if cfg.Broker == "" {
+		return nil
+	}
+	return &MQTT{cfg: cfg}
+}
+
+// Name identifies the sink in logs
+func (m *MQTT) Name() string {
+	return "mqtt"
+}
+
+// Accepts reports whether an event type should be published
+func (m *MQTT) Accepts(eventType string) bool {
+	return events.Subscribed(m.cfg.Events, eventType)
+}
+
+// Topic returns the topic an event is published to
+func (m *MQTT) Topic(e events.Event) string {
+	if topic, ok := events.Lookup(m.cfg.Topics, e.Type); ok {
+		return expandTopic(topic, e.Tenant)
+	}
+
+	parts := []string{strings.TrimSuffix(m.cfg.TopicPrefix, "/")}
+	if e.Tenant != "" {
+		parts = append(parts, e.Tenant)
+	}
+	parts = append(parts, strings.ReplaceAll(e.Type, ".", "/"))
+	return strings.Join(parts, "/")
+}
+
+// expandTopic fills the tenant into a configured topic, dropping the
+// {tenant} level when there is none
+func expandTopic(topic, tenant string) string {
+	levels := strings.Split(topic, "/")
+	kept := levels[:0]
+	for _, level := range levels {
+		if level == "{tenant}" && tenant == "" {
+			continue
+		}
+		kept = append(kept, strings.ReplaceAll(level, "{tenant}", tenant))
+	}
+	return strings.Join(kept, "/")
+}
+
+// Handle publishes one event
+func (m *MQTT) Handle(ctx context.Context, e events.Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	conn, err := m.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to broker: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(mqttTimeout))
+
+	// Concurrent publishes would kick each other off the broker if they
+	// shared a client ID
+	clientID := m.cfg.ClientID + "-" + e.ID[max(0, len(e.ID)-8):]
+	if _, err := conn.Write(mqttConnect(clientID, m.cfg.Username, m.cfg.Password)); err != nil {
+		return fmt.Errorf("failed to send connect: %w", err)
+	}
+	if err := readConnack(bufio.NewReader(conn)); err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(mqttPublish(m.Topic(e), payload, m.cfg.Retain)); err != nil {
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+	conn.Write([]byte{0xE0, 0x00}) // DISCONNECT
+	return nil
+}
+
+// dial opens a TCP or TLS connection to the broker
+func (m *MQTT) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+
+	if addr, ok := strings.CutPrefix(m.cfg.Broker, "tls://"); ok {
+		host, _, _ := net.SplitHostPort(addr)
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}
+		return tlsDialer.DialContext(ctx, "tcp", addr)
+	}
+	return dialer.DialContext(ctx, "tcp", strings.TrimPrefix(m.cfg.Broker, "tcp://"))
+}
+
+// mqttConnect builds a CONNECT packet with a clean session
+func mqttConnect(clientID, username, password string) []byte {
+	var flags byte = 0x02
+	if username != "" {
+		flags |= 0x80
+		if password != "" {
+			flags |= 0x40
+		}
+	}
+
+	body := mqttString("MQTT")
+	body = append(body, 4, flags) // protocol level 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttTimeout/time.Second*3))
+	body = append(body, mqttString(clientID)...)
+	if username != "" {
+		body = append(body, mqttString(username)...)
+		if password != "" {
+			body = append(body, mqttString(password)...)
+		}
+	}
+	return mqttPacket(0x10, body)
+}
+
+// mqttPublish builds a QoS 0 PUBLISH packet
+func mqttPublish(topic string, payload []byte, retain bool) []byte {
+	var header byte = 0x30
+	if retain {
+		header |= 0x01
+	}
+	return mqttPacket(header, append(mqttString(topic), payload...))
+}
+
+// readConnack waits for the broker to accept the connection
+func readConnack(r *bufio.Reader) error {
+	var packet [4]byte
+	if _, err := io.ReadFull(r, packet[:]); err != nil {
+		return fmt.Errorf("failed to read connack: %w", err)
+	}
+	if packet[0] != 0x20 || packet[1] != 0x02 {
+		return errors.New("broker sent an unexpected reply to connect")
+	}
+
+	switch packet[3] {
+	case 0:
+		return nil
+	case 4, 5:
+		return errors.New("broker rejected the credentials")
+	default:
+		return fmt.Errorf("broker refused the connection (code %d)", packet[3])
+	}
+}
+
+// mqttPacket prefixes body with a fixed header and its variable-length size
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// mqttString encodes a length-prefixed UTF-8 string
+func mqttString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
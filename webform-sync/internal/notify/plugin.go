@@ -0,0 +1,51 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/events"
+	"github.com/tezza1971/webform-sync/plugin"
+)
+
+// Plugin passes events to a notifier provided by a plugin
+type Plugin struct {
+	name     string
+	notifier plugin.Notifier
+}
+
+// NewPlugin creates the notifier a plugin registered under cfg.Name
+func NewPlugin(cfg config.PluginConfig) (*Plugin, error) {
+	notifier, err := plugin.NewNotifier(cfg.Name, cfg.Settings)
+	if err != nil {
+		return nil, err
+	}
+	return &Plugin{name: cfg.Name, notifier: notifier}, nil
+}
+
+// Name identifies the sink in logs
+func (p *Plugin) Name() string {
+	return "plugin " + p.name
+}
+
+// Accepts asks the notifier
+func (p *Plugin) Accepts(eventType string) bool {
+	return p.notifier.Accepts(eventType)
+}
+
+// Handle hands the event over with its data as JSON
+func (p *Plugin) Handle(ctx context.Context, e events.Event) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return fmt.Errorf("failed to encode event data: %w", err)
+	}
+	return p.notifier.Notify(ctx, plugin.Event{
+		ID:     e.ID,
+		Type:   e.Type,
+		Time:   e.Time,
+		Tenant: e.Tenant,
+		Data:   data,
+	})
+}
@@ -0,0 +1,186 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/events"
+)
+
+// pushTitle is the notification title on the phone
+const pushTitle = "webform-sync"
+
+var pushClient = &http.Client{Timeout: 10 * time.Second}
+
+// Ntfy sends each event as a push notification to an ntfy topic
+type Ntfy struct {
+	cfg config.NtfyConfig
+}
+
+// NewNtfy creates an ntfy sink, or returns nil if no topic URL is configured
+func NewNtfy(cfg config.NtfyConfig) *Ntfy {
+	if cfg.URL == "" {
+		return nil
+	}
+	return &Ntfy{cfg: cfg}
+}
+
+// Name identifies the sink in logs
+func (n *Ntfy) Name() string {
+	return "ntfy"
+}
+
+// Accepts reports whether an event type should be pushed
+func (n *Ntfy) Accepts(eventType string) bool {
+	return events.Subscribed(n.cfg.Events, eventType)
+}
+
+// Handle posts the event summary to the topic
+func (n *Ntfy) Handle(ctx context.Context, e events.Event) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.URL, strings.NewReader(e.Summary()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", pushTitle)
+	req.Header.Set("Tags", e.Type)
+	if priority := priorityFor(n.cfg.Priority, n.cfg.Priorities, e.Type); priority > 0 {
+		req.Header.Set("Priority", strconv.Itoa(priority))
+	}
+	if n.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.cfg.Token)
+	}
+	return send(req)
+}
+
+// Gotify sends each event as a message to a Gotify server
+type Gotify struct {
+	cfg config.GotifyConfig
+}
+
+// NewGotify creates a Gotify sink, or returns nil if no server is configured
+func NewGotify(cfg config.GotifyConfig) *Gotify {
+	if cfg.URL == "" {
+		return nil
+	}
+	return &Gotify{cfg: cfg}
+}
+
+// Name identifies the sink in logs
+func (g *Gotify) Name() string {
+	return "gotify"
+}
+
+// Accepts reports whether an event type should be pushed
+func (g *Gotify) Accepts(eventType string) bool {
+	return events.Subscribed(g.cfg.Events, eventType)
+}
+
+// Handle posts the event summary as a Gotify message
+func (g *Gotify) Handle(ctx context.Context, e events.Event) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"title":    pushTitle,
+		"message":  e.Summary(),
+		"priority": priorityFor(g.cfg.Priority, g.cfg.Priorities, e.Type),
+	})
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(g.cfg.URL, "/") + "/message"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", g.cfg.Token)
+	return send(req)
+}
+
+// pushoverURL is Pushover's message API
+const pushoverURL = "https://api.pushover.net/1/messages.json"
+
+// Pushover sends each event as a Pushover notification
+type Pushover struct {
+	cfg config.PushoverConfig
+}
+
+// NewPushover creates a Pushover sink, or returns nil if no user key is
+// configured
+func NewPushover(cfg config.PushoverConfig) *Pushover {
+	if cfg.User == "" {
+		return nil
+	}
+	return &Pushover{cfg: cfg}
+}
+
+// Name identifies the sink in logs
+func (p *Pushover) Name() string {
+	return "pushover"
+}
+
+// Accepts reports whether an event type should be pushed
+func (p *Pushover) Accepts(eventType string) bool {
+	return events.Subscribed(p.cfg.Events, eventType)
+}
+
+// Handle posts the event summary as a Pushover message
+func (p *Pushover) Handle(ctx context.Context, e events.Event) error {
+	form := url.Values{
+		"token":     {p.cfg.Token},
+		"user":      {p.cfg.User},
+		"title":     {pushTitle},
+		"message":   {e.Summary()},
+		"timestamp": {strconv.FormatInt(e.Time.Unix(), 10)},
+	}
+	if p.cfg.Device != "" {
+		form.Set("device", p.cfg.Device)
+	}
+	priority := priorityFor(p.cfg.Priority, p.cfg.Priorities, e.Type)
+	form.Set("priority", strconv.Itoa(priority))
+	if priority == 2 {
+		// Emergency messages repeat every minute for an hour until
+		// acknowledged
+		form.Set("retry", "60")
+		form.Set("expire", "3600")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pushoverURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return send(req)
+}
+
+// priorityFor is the priority to push an event type with: the most specific
+// of priorities, or base
+func priorityFor(base int, priorities map[string]int, eventType string) int {
+	if priority, ok := events.Lookup(priorities, eventType); ok {
+		return priority
+	}
+	return base
+}
+
+// send makes a push request; any 2xx response is a success
+func send(req *http.Request) error {
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Package offsite copies backups to storage off the machine: S3-compatible
+// object stores, WebDAV servers such as Nextcloud, SFTP servers, and backup
+// stores provided by plugins.
+package offsite
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+)
+
+// Remote is a folder backups are copied to
+type Remote interface {
+	// Name identifies the remote in logs and the backup history
+	Name() string
+	// Put uploads size bytes from r as the file name, replacing it if it exists
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// List returns the names of the files in the folder
+	List(ctx context.Context) ([]string, error)
+	// Delete removes a file, and succeeds if it is already gone
+	Delete(ctx context.Context, name string) error
+}
+
+// New creates the client for a configured remote. Files go in the folder
+// named by its URL, or in sub under it if sub isn't empty.
+func New(cfg config.BackupRemoteConfig, sub string) (Remote, error) {
+	// Plugins are given the folder and keep files where they like
+	if cfg.Type == "plugin" {
+		return newPlugin(cfg, sub)
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url for backup remote %q: %w", cfg.Name, err)
+	}
+	u.Path = strings.TrimSuffix(path.Join("/", u.Path, sub), "/")
+	u.RawPath = ""
+
+	switch cfg.Type {
+	case "s3":
+		return newS3(cfg, u)
+	case "webdav":
+		return newWebDAV(cfg, u), nil
+	case "sftp":
+		return newSFTP(cfg, u), nil
+	}
+	return nil, fmt.Errorf("backup remote %q has unknown type %q", cfg.Name, cfg.Type)
+}
+
+// httpClient has no overall timeout, since uploads can be large; requests
+// are bounded by their context instead
+var httpClient = &http.Client{}
+
+// send makes a request and returns the response if its status is one of ok,
+// closing it and returning an error otherwise
+func send(req *http.Request, ok ...int) (*http.Response, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if msg := strings.TrimSpace(string(body)); msg != "" {
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Redacted(), resp.Status, msg)
+	}
+	return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+}
@@ -0,0 +1,26 @@
+package offsite
+
+import (
+	"fmt"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/plugin"
+)
+
+// pluginRemote is a backup store provided by a plugin
+type pluginRemote struct {
+	plugin.BackupStore
+	name string
+}
+
+func newPlugin(cfg config.BackupRemoteConfig, sub string) (*pluginRemote, error) {
+	store, err := plugin.NewBackupStore(cfg.Plugin.Name, cfg.Plugin.Settings, sub)
+	if err != nil {
+		return nil, fmt.Errorf("backup remote %q: %w", cfg.Name, err)
+	}
+	return &pluginRemote{BackupStore: store, name: cfg.Name}, nil
+}
+
+func (p *pluginRemote) Name() string {
+	return p.name
+}
@@ -0,0 +1,515 @@
+package offsite
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpDialTimeout bounds connecting and logging in to the SFTP server
+const sftpDialTimeout = 30 * time.Second
+
+// sftpChunk is how much of a file each write request carries; servers
+// must accept at least this much
+const sftpChunk = 32 * 1024
+
+// SFTP packet types and the flags used here, from version 3 of the protocol
+// (draft-ietf-secsh-filexfer-02), which every server speaks
+const (
+	fxpInit      = 1
+	fxpVersion   = 2
+	fxpOpen      = 3
+	fxpClose     = 4
+	fxpWrite     = 6
+	fxpOpendir   = 11
+	fxpReaddir   = 12
+	fxpRemove    = 13
+	fxpMkdir     = 14
+	fxpRename    = 18
+	fxpStatus    = 101
+	fxpHandle    = 102
+	fxpName      = 104
+	fxfWrite     = 0x02
+	fxfCreat     = 0x08
+	fxfTrunc     = 0x10
+	fxOK         = 0
+	fxEOF        = 1
+	fxNoSuchFile = 2
+)
+
+// SFTP keeps backups in a folder on an SFTP server. The folder in the URL
+// is an absolute path; start it with /~/ for one under the user's home.
+//
+// Backups are uploaded once a day at most, so rather than pull in a full
+// client this speaks the handful of SFTP requests it needs, one at a time,
+// over a fresh SSH connection for each operation.
+type SFTP struct {
+	name           string
+	addr           string
+	user           string
+	dir            string
+	password       string
+	privateKeyFile string
+	knownHostsFile string
+}
+
+func newSFTP(cfg config.BackupRemoteConfig, u *url.URL) *SFTP {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	dir := u.Path
+	if rest, ok := strings.CutPrefix(dir, "/~"); ok {
+		dir = strings.TrimPrefix(rest, "/")
+		if dir == "" {
+			dir = "."
+		}
+	}
+	return &SFTP{
+		name:           cfg.Name,
+		addr:           addr,
+		user:           u.User.Username(),
+		dir:            dir,
+		password:       cfg.Password,
+		privateKeyFile: cfg.PrivateKeyFile,
+		knownHostsFile: cfg.KnownHostsFile,
+	}
+}
+
+// Name identifies the remote in logs and the backup history
+func (s *SFTP) Name() string {
+	return s.name
+}
+
+// Put uploads to a temporary name and renames it into place, so an
+// interrupted upload never looks like a backup
+func (s *SFTP) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	c.mkdirAll(s.dir)
+	final := path.Join(s.dir, name)
+	partial := final + ".part"
+	handle, err := c.open(partial)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", partial, err)
+	}
+
+	buf := make([]byte, sftpChunk)
+	var offset uint64
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := c.write(handle, offset, buf[:n]); err != nil {
+				c.closeHandle(handle)
+				c.remove(partial)
+				return fmt.Errorf("failed to write %s: %w", partial, err)
+			}
+			offset += uint64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			c.closeHandle(handle)
+			c.remove(partial)
+			return rerr
+		}
+	}
+	if err := c.closeHandle(handle); err != nil {
+		c.remove(partial)
+		return fmt.Errorf("failed to write %s: %w", partial, err)
+	}
+	if offset != uint64(size) {
+		c.remove(partial)
+		return fmt.Errorf("uploaded %d bytes of %d", offset, size)
+	}
+
+	// Version 3 renames fail if the target exists
+	c.remove(final)
+	if err := c.rename(partial, final); err != nil {
+		c.remove(partial)
+		return fmt.Errorf("failed to rename %s: %w", partial, err)
+	}
+	return nil
+}
+
+// List returns the files in the folder, or none if it doesn't exist yet
+func (s *SFTP) List(ctx context.Context) ([]string, error) {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	return c.readDir(s.dir)
+}
+
+// Delete removes a file
+func (s *SFTP) Delete(ctx context.Context, name string) error {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	return c.remove(path.Join(s.dir, name))
+}
+
+// connect logs in over SSH, checking the server's key against the known
+// hosts file, and starts the sftp subsystem
+func (s *SFTP) connect(ctx context.Context) (*sftpConn, error) {
+	var auth []ssh.AuthMethod
+	if s.privateKeyFile != "" {
+		key, err := os.ReadFile(s.privateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key %s: %w", s.privateKeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if s.password != "" {
+		auth = append(auth, ssh.Password(s.password))
+	}
+
+	knownHostsFile := s.knownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("set known_hosts_file: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts: %w", err)
+	}
+
+	dialer := &net.Dialer{Timeout: sftpDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	// Cancelling the context drops the connection, which fails whatever
+	// request is waiting on it
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(sftpDialTimeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, s.addr, &ssh.ClientConfig{
+		User:            s.user,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         sftpDialTimeout,
+	})
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(sshConn, chans, reqs)
+
+	session, err := client.NewSession()
+	if err != nil {
+		stop()
+		client.Close()
+		return nil, err
+	}
+	c := &sftpConn{client: client, session: session, stop: stop}
+	if c.w, err = session.StdinPipe(); err == nil {
+		var out io.Reader
+		if out, err = session.StdoutPipe(); err == nil {
+			c.r = out
+			err = session.RequestSubsystem("sftp")
+		}
+	}
+	if err == nil {
+		err = c.init()
+	}
+	if err != nil {
+		c.close()
+		return nil, fmt.Errorf("failed to start sftp: %w", err)
+	}
+	return c, nil
+}
+
+// sftpConn is an SFTP session. Requests are sent one at a time, each
+// waiting for its response.
+type sftpConn struct {
+	client  *ssh.Client
+	session *ssh.Session
+	stop    func() bool
+	w       io.WriteCloser
+	r       io.Reader
+	id      uint32
+}
+
+func (c *sftpConn) close() {
+	c.stop()
+	c.session.Close()
+	c.client.Close()
+}
+
+// sftpStatus is a status response other than OK
+type sftpStatus struct {
+	code uint32
+	msg  string
+}
+
+func (e *sftpStatus) Error() string {
+	if e.msg != "" {
+		return e.msg
+	}
+	return fmt.Sprintf("sftp status %d", e.code)
+}
+
+func isStatus(err error, code uint32) bool {
+	var status *sftpStatus
+	return errors.As(err, &status) && status.code == code
+}
+
+func (c *sftpConn) init() error {
+	if err := c.send(fxpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return err
+	}
+	typ, _, err := c.recv()
+	if err != nil {
+		return err
+	}
+	if typ != fxpVersion {
+		return fmt.Errorf("unexpected sftp packet %d", typ)
+	}
+	return nil
+}
+
+// send writes a packet: length, type, then the payload
+func (c *sftpConn) send(typ byte, payload []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+	_, err := c.w.Write(append(packet, payload...))
+	return err
+}
+
+// recv reads a packet
+func (c *sftpConn) recv() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > 1<<20 {
+		return 0, nil, fmt.Errorf("sftp packet of %d bytes", length)
+	}
+	data := make([]byte, length-1)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[4], data, nil
+}
+
+// request sends a request and returns its response, after the request ID.
+// A status response other than OK is returned as an error.
+func (c *sftpConn) request(typ byte, args ...interface{}) (byte, *sftpReader, error) {
+	c.id++
+	payload := binary.BigEndian.AppendUint32(nil, c.id)
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			payload = appendString(payload, v)
+		case []byte:
+			payload = appendString(payload, string(v))
+		case uint32:
+			payload = binary.BigEndian.AppendUint32(payload, v)
+		case uint64:
+			payload = binary.BigEndian.AppendUint64(payload, v)
+		}
+	}
+	if err := c.send(typ, payload); err != nil {
+		return 0, nil, err
+	}
+
+	respType, data, err := c.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	r := &sftpReader{data: data}
+	if id := r.uint32(); id != c.id {
+		return 0, nil, fmt.Errorf("sftp response for request %d, expected %d", id, c.id)
+	}
+	if respType == fxpStatus {
+		status := &sftpStatus{code: r.uint32(), msg: r.string()}
+		if status.code != fxOK {
+			return 0, nil, status
+		}
+	}
+	return respType, r, r.err
+}
+
+// expect sends a request answered by a status
+func (c *sftpConn) expect(typ byte, args ...interface{}) error {
+	_, _, err := c.request(typ, args...)
+	return err
+}
+
+// handle sends a request answered by a file handle
+func (c *sftpConn) handle(typ byte, args ...interface{}) (string, error) {
+	respType, r, err := c.request(typ, args...)
+	if err != nil {
+		return "", err
+	}
+	if respType != fxpHandle {
+		return "", fmt.Errorf("unexpected sftp packet %d", respType)
+	}
+	handle := r.string()
+	return handle, r.err
+}
+
+func (c *sftpConn) open(name string) (string, error) {
+	// The trailing zero is an empty attribute set
+	return c.handle(fxpOpen, name, uint32(fxfWrite|fxfCreat|fxfTrunc), uint32(0))
+}
+
+func (c *sftpConn) write(handle string, offset uint64, data []byte) error {
+	return c.expect(fxpWrite, handle, offset, data)
+}
+
+func (c *sftpConn) closeHandle(handle string) error {
+	return c.expect(fxpClose, handle)
+}
+
+func (c *sftpConn) rename(from, to string) error {
+	return c.expect(fxpRename, from, to)
+}
+
+// remove deletes a file, and succeeds if it doesn't exist
+func (c *sftpConn) remove(name string) error {
+	if err := c.expect(fxpRemove, name); err != nil && !isStatus(err, fxNoSuchFile) {
+		return err
+	}
+	return nil
+}
+
+// mkdirAll creates a folder and its parents. Servers don't agree on the
+// status for one that exists, so failures are left for the upload to report.
+func (c *sftpConn) mkdirAll(dir string) {
+	var parts []string
+	for _, part := range strings.Split(dir, "/") {
+		parts = append(parts, part)
+		if part != "" && part != "." {
+			c.expect(fxpMkdir, strings.Join(parts, "/"), uint32(0))
+		}
+	}
+}
+
+// readDir lists the names in a folder, other than . and ..
+func (c *sftpConn) readDir(dir string) ([]string, error) {
+	handle, err := c.handle(fxpOpendir, dir)
+	if err != nil {
+		if isStatus(err, fxNoSuchFile) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open %s: %w", dir, err)
+	}
+	defer c.closeHandle(handle)
+
+	var names []string
+	for {
+		respType, r, err := c.request(fxpReaddir, handle)
+		if isStatus(err, fxEOF) {
+			return names, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+		}
+		if respType != fxpName {
+			return nil, fmt.Errorf("unexpected sftp packet %d", respType)
+		}
+		count := r.uint32()
+		for i := uint32(0); i < count && r.err == nil; i++ {
+			name := r.string()
+			r.string() // long name
+			r.attrs()
+			if name != "." && name != ".." {
+				names = append(names, name)
+			}
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// sftpReader decodes the fields of a packet, remembering the first error
+type sftpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *sftpReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = errors.New("short sftp packet")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *sftpReader) string() string {
+	return string(r.take(int(r.uint32())))
+}
+
+// attrs skips a set of file attributes
+func (r *sftpReader) attrs() {
+	flags := r.uint32()
+	if flags&0x01 != 0 { // size
+		r.take(8)
+	}
+	if flags&0x02 != 0 { // uid, gid
+		r.take(8)
+	}
+	if flags&0x04 != 0 { // permissions
+		r.take(4)
+	}
+	if flags&0x08 != 0 { // atime, mtime
+		r.take(8)
+	}
+	if flags&0x80000000 != 0 { // extended
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			r.string()
+			r.string()
+		}
+	}
+}
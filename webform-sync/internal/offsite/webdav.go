@@ -0,0 +1,155 @@
+package offsite
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+)
+
+// WebDAV keeps backups in a folder on a WebDAV server, such as Nextcloud or
+// ownCloud, creating the folder if needed
+type WebDAV struct {
+	name     string
+	folder   *url.URL
+	username string
+	password string
+}
+
+// propfindBody asks only for the resource type, to keep listings small
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?><d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/></d:prop></d:propfind>`
+
+func newWebDAV(cfg config.BackupRemoteConfig, u *url.URL) *WebDAV {
+	return &WebDAV{name: cfg.Name, folder: u, username: cfg.Username, password: cfg.Password}
+}
+
+// Name identifies the remote in logs and the backup history
+func (d *WebDAV) Name() string {
+	return d.name
+}
+
+// Put creates the folder if it is missing, then uploads the file
+func (d *WebDAV) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if err := d.mkcol(ctx, d.folder.Path); err != nil {
+		return err
+	}
+	req, err := d.request(ctx, http.MethodPut, d.fileURL(name), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := send(req, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns the files in the folder, or none if it doesn't exist yet
+func (d *WebDAV) List(ctx context.Context) ([]string, error) {
+	req, err := d.request(ctx, "PROPFIND", d.folder.String()+"/", strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := send(req, http.StatusMultiStatus, http.StatusNotFound)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	var result struct {
+		Responses []struct {
+			Href       string    `xml:"href"`
+			Collection *struct{} `xml:"propstat>prop>resourcetype>collection"`
+		} `xml:"response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse folder listing: %w", err)
+	}
+
+	var names []string
+	for _, r := range result.Responses {
+		if r.Collection != nil {
+			continue
+		}
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		names = append(names, path.Base(href.Path))
+	}
+	return names, nil
+}
+
+// Delete removes a file
+func (d *WebDAV) Delete(ctx context.Context, name string) error {
+	req, err := d.request(ctx, http.MethodDelete, d.fileURL(name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := send(req, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// mkcol creates a folder, and its parents if they're missing too. Servers
+// answer 405 for a folder that already exists and 409 for a missing parent.
+func (d *WebDAV) mkcol(ctx context.Context, dir string) error {
+	u := *d.folder
+	u.Path = dir + "/"
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := d.request(ctx, "MKCOL", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := send(req, http.StatusCreated, http.StatusMethodNotAllowed, http.StatusConflict)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			return nil
+		}
+		parent := path.Dir(dir)
+		if parent == dir || parent == "/" || attempt > 0 {
+			return fmt.Errorf("failed to create folder %s: %s", dir, resp.Status)
+		}
+		if err := d.mkcol(ctx, parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *WebDAV) fileURL(name string) string {
+	u := *d.folder
+	u.Path += "/" + name
+	return u.String()
+}
+
+func (d *WebDAV) request(ctx context.Context, method, target string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if d.username != "" {
+		req.SetBasicAuth(d.username, d.password)
+	}
+	return req, nil
+}
@@ -0,0 +1,134 @@
+// Package pii recognises personal data in form field values: payment card
+// numbers, IBANs, US social security numbers and email addresses. It checks
+// checksums where the format has one, so most random digit strings aren't
+// reported.
+package pii
+
+import (
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// The kinds of personal data Detect recognises
+const (
+	Card  = "card"
+	IBAN  = "iban"
+	SSN   = "ssn"
+	Email = "email"
+)
+
+// Kinds lists every kind, in the order Detect reports them
+var Kinds = []string{Card, IBAN, SSN, Email}
+
+var (
+	cardPattern  = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+	ibanPattern  = regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`)
+	ssnPattern   = regexp.MustCompile(`\b(\d{3})-(\d{2})-(\d{4})\b`)
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+)
+
+// Detect returns the kinds of personal data in value, out of those in
+// kinds
+func Detect(value string, kinds []string) []string {
+	var found []string
+	for _, kind := range Kinds {
+		if !contains(kinds, kind) {
+			continue
+		}
+		var hit bool
+		switch kind {
+		case Card:
+			hit = anyMatch(cardPattern, value, luhn)
+		case IBAN:
+			hit = anyMatch(ibanPattern, strings.ToUpper(value), validIBAN)
+		case SSN:
+			hit = anyMatch(ssnPattern, value, validSSN)
+		case Email:
+			hit = emailPattern.MatchString(value)
+		}
+		if hit {
+			found = append(found, kind)
+		}
+	}
+	return found
+}
+
+// Valid reports whether kind is one Detect recognises
+func Valid(kind string) bool {
+	return contains(Kinds, kind)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// anyMatch reports whether any match of pattern in s passes check
+func anyMatch(pattern *regexp.Regexp, s string, check func(string) bool) bool {
+	for _, match := range pattern.FindAllString(s, -1) {
+		if check(match) {
+			return true
+		}
+	}
+	return false
+}
+
+// ungroup drops the spaces and dashes used to group card numbers and IBANs
+func ungroup(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// luhn checks a card number's check digit
+func luhn(number string) bool {
+	number = ungroup(number)
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// validIBAN checks an IBAN's check digits (ISO 13616): with the first four
+// characters moved to the end and letters replaced by 10-35, the number
+// leaves 1 when divided by 97
+func validIBAN(iban string) bool {
+	iban = ungroup(iban)
+	rearranged := iban[4:] + iban[:4]
+	var b strings.Builder
+	for _, r := range rearranged {
+		if r >= 'A' && r <= 'Z' {
+			b.WriteString(big.NewInt(int64(r - 'A' + 10)).String())
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	n, ok := new(big.Int).SetString(b.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+// validSSN rejects numbers the Social Security Administration never issues:
+// area 000, 666 or 900-999, group 00 and serial 0000
+func validSSN(ssn string) bool {
+	m := ssnPattern.FindStringSubmatch(ssn)
+	area, group, serial := m[1], m[2], m[3]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/logger"
+)
+
+// Middleware: write each request to the access log. It wraps tenant
+// dispatch so rejected requests are logged too.
+func (s *Server) accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+
+		next.ServeHTTP(wrapped, r)
+
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		user, _, _ := r.BasicAuth()
+
+		s.accessLog.Log(logger.AccessEntry{
+			RemoteIP:  ip,
+			User:      user,
+			Time:      start,
+			Method:    r.Method,
+			URI:       redactedURI(r),
+			Proto:     r.Proto,
+			Status:    wrapped.statusCode,
+			Bytes:     wrapped.bytes,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			Duration:  time.Since(start),
+			RequestID: responseRequestID(w),
+		})
+	})
+}
+
+// redactedURI is the request URI with any ?token= API token masked
+func redactedURI(r *http.Request) string {
+	if !r.URL.Query().Has("token") {
+		return r.RequestURI
+	}
+	u := *r.URL
+	query := u.Query()
+	query.Set("token", "REDACTED")
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/config"
+)
+
+// apiVersionHeader names the API version that answered a request
+const apiVersionHeader = "X-API-Version"
+
+// Deprecation is a route due to be removed, as GET /capabilities lists it
+type Deprecation struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods,omitempty"`
+	Since   string   `json:"since"`
+	Sunset  string   `json:"sunset,omitempty"`
+	Link    string   `json:"link,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+// apiVersion is the version of the API a path belongs to, or "" outside it
+func apiVersion(path string) string {
+	for _, version := range []string{"1", "2"} {
+		if strings.HasPrefix(path, "/api/v"+version+"/") {
+			return version
+		}
+	}
+	return ""
+}
+
+// deprecationFor returns the deprecations entry that covers a request, if
+// any
+func (s *Server) deprecationFor(r *http.Request) (config.DeprecationConfig, bool) {
+	template := r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			template = tpl
+		}
+	}
+	return s.deprecation(r.Method, r.URL.Path, template)
+}
+
+// deprecation returns the deprecations entry that covers a method on a
+// route. Routes are matched by their template, so /api/v1/presets/{id}
+// covers every preset; prefixes by the path.
+func (s *Server) deprecation(method, path, template string) (config.DeprecationConfig, bool) {
+	for _, d := range s.config.Deprecations {
+		if prefix, ok := strings.CutSuffix(d.Path, "*"); ok {
+			if !strings.HasPrefix(path, prefix) {
+				continue
+			}
+		} else if d.Path != template {
+			continue
+		}
+		if len(d.Methods) == 0 {
+			return d, true
+		}
+		for _, m := range d.Methods {
+			if m == method {
+				return d, true
+			}
+		}
+	}
+	return config.DeprecationConfig{}, false
+}
+
+// setDeprecationHeaders warns of a deprecated route: Deprecation with the
+// date it was deprecated (RFC 9745), Sunset with the date it goes (RFC
+// 8594), a Link to the notice, and the message in X-API-Deprecation-Notice
+func setDeprecationHeaders(h http.Header, d config.DeprecationConfig) {
+	if since, err := time.Parse(config.DeprecationDateLayout, d.Since); err == nil {
+		h.Set("Deprecation", fmt.Sprintf("@%d", since.Unix()))
+	}
+	if sunset, err := time.Parse(config.DeprecationDateLayout, d.Sunset); err == nil {
+		h.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+	if d.Link != "" {
+		h.Add("Link", fmt.Sprintf(`<%s>; rel="deprecation"; type="text/html"`, d.Link))
+	}
+	if d.Message != "" {
+		h.Set("X-API-Deprecation-Notice", d.Message)
+	}
+}
+
+// Middleware: report the API version that answers each request, and warn
+// clients of deprecated routes before they are removed
+func (s *Server) apiVersionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if version := apiVersion(r.URL.Path); version != "" {
+			w.Header().Set(apiVersionHeader, version)
+		}
+		if d, ok := s.deprecationFor(r); ok {
+			setDeprecationHeaders(w.Header(), d)
+			s.log(r).Debug("Deprecated route %s %s called", r.Method, r.URL.Path)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deprecations lists the deprecated routes for GET /capabilities
+func (s *Server) deprecations() []Deprecation {
+	list := make([]Deprecation, 0, len(s.config.Deprecations))
+	for _, d := range s.config.Deprecations {
+		list = append(list, Deprecation{
+			Path:    d.Path,
+			Methods: d.Methods,
+			Since:   d.Since,
+			Sunset:  d.Sunset,
+			Link:    d.Link,
+			Message: d.Message,
+		})
+	}
+	return list
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/storage"
+	"github.com/tezza1971/webform-sync/plugin"
+)
+
+// newAuthProvider creates the auth provider a plugin registered, or returns
+// nil unless authentication uses one
+func newAuthProvider(cfg config.AuthenticationConfig) (plugin.AuthProvider, error) {
+	if !cfg.Enabled || cfg.Type != "plugin" {
+		return nil, nil
+	}
+	provider, err := plugin.NewAuthProvider(cfg.Plugin.Name, cfg.Plugin.Settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create auth provider %s: %w", cfg.Plugin.Name, err)
+	}
+	return provider, nil
+}
+
+// authProviderChanged reports whether a new config needs a new auth
+// provider
+func authProviderChanged(old, new config.AuthenticationConfig) bool {
+	return old.Enabled != new.Enabled || old.Type != new.Type || !reflect.DeepEqual(old.Plugin, new.Plugin)
+}
+
+// authenticatePlugin checks a request's credentials with the auth provider,
+// answering it if they are refused. It returns the request to carry on
+// with, which knows the user the provider named.
+func (s *Server) authenticatePlugin(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	creds := plugin.Credentials{RemoteAddr: remoteIP(r), Header: r.Header.Clone()}
+	var basic bool
+	creds.Username, creds.Password, basic = r.BasicAuth()
+	if !basic {
+		creds.Token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if creds.Token == "" {
+		creds.Token = r.URL.Query().Get("token")
+	}
+
+	refuse := func(status int, msg string) (*http.Request, bool) {
+		if isWebDAVPath(r.URL.Path) && status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Webform Sync"`)
+		}
+		s.respondError(w, status, msg)
+		return nil, false
+	}
+
+	identity, err := s.authProvider.Authenticate(r.Context(), creds)
+	if errors.Is(err, plugin.ErrInvalidCredentials) {
+		// As with tokens, asking without credentials doesn't count
+		if creds.Token != "" || creds.Username != "" || creds.Password != "" {
+			s.authFailed(r)
+		}
+		return refuse(http.StatusUnauthorized, "Invalid credentials")
+	}
+	if err != nil {
+		s.log(r).Error("Auth provider %s failed: %v", s.config.Authentication.Plugin.Name, err)
+		return refuse(http.StatusServiceUnavailable, "Authentication unavailable")
+	}
+
+	if identity.UserID == "" {
+		return r, true
+	}
+	user, err := s.storage.GetUser(r.Context(), identity.UserID)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		s.log(r).Warn("Auth provider %s named unknown user %s", s.config.Authentication.Plugin.Name, identity.UserID)
+		return refuse(http.StatusUnauthorized, "Invalid credentials")
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get user: %v", err)
+		return refuse(http.StatusInternalServerError, "Failed to authenticate")
+	}
+	return withUser(r, user), true
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/archive"
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/jobs"
+	"github.com/tezza1971/webform-sync/internal/offsite"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// remoteBackupExt is added to the names of the encrypted copies sent to
+// remotes, so webform-sync-<time>.db goes up as webform-sync-<time>.db.enc
+const remoteBackupExt = ".enc"
+
+// remoteTimeout bounds copying a backup to one remote, rotation included
+const remoteTimeout = time.Hour
+
+// copyToRemotes encrypts a backup with storage.backup.passphrase and
+// uploads it to each remote in turn, removing the oldest copies there
+// beyond its max_backups. A remote that fails doesn't stop the others.
+func (s *Server) copyToRemotes(ctx context.Context, job *jobs.Job, file string) []storage.RemoteCopy {
+	cfg := s.config.Storage.Backup
+	if len(cfg.Remotes) == 0 {
+		return nil
+	}
+	name := filepath.Base(file) + remoteBackupExt
+	copies := make([]storage.RemoteCopy, len(cfg.Remotes))
+	for i, remote := range cfg.Remotes {
+		copies[i] = storage.RemoteCopy{Remote: remote.Name, File: name}
+	}
+
+	encrypted, err := encryptBackup(file, cfg.Passphrase)
+	if err != nil {
+		s.logger.Error("Failed to encrypt backup for remotes: %v", err)
+		for i := range copies {
+			copies[i].Status = storage.BackupFailed
+			copies[i].Error = "failed to encrypt backup: " + err.Error()
+		}
+		return copies
+	}
+	defer os.Remove(encrypted)
+
+	for i, remote := range cfg.Remotes {
+		job.SetStep("copying to remote " + remote.Name)
+		job.SetProgress(i, len(cfg.Remotes))
+		c := &copies[i]
+		c.Bytes, err = s.copyToRemote(ctx, remote, encrypted, name)
+		if err != nil {
+			c.Status = storage.BackupFailed
+			c.Error = err.Error()
+			s.logger.Error("Failed to copy backup to remote %s: %v", remote.Name, err)
+			continue
+		}
+		c.Status = storage.BackupOK
+		s.logger.Info("Copied backup %s to remote %s (%d bytes)", name, remote.Name, c.Bytes)
+	}
+	return copies
+}
+
+// encryptBackup writes an encrypted copy of a backup beside it to be
+// uploaded, and returns its path. The name doesn't look like a backup's, so
+// listing and rotation pass over it.
+func encryptBackup(file, passphrase string) (string, error) {
+	src, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp(filepath.Dir(file), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+
+	buffered := bufio.NewWriter(dst)
+	enc, err := archive.NewEncryptWriter(buffered, passphrase)
+	if err == nil {
+		_, err = io.Copy(enc, src)
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+// copyToRemote uploads an encrypted backup to a remote, then rotates the
+// copies there. Tenants' backups go in a folder of their own.
+func (s *Server) copyToRemote(ctx context.Context, cfg config.BackupRemoteConfig, path, name string) (int64, error) {
+	sub := ""
+	if s.tenant != "" {
+		sub = "tenants/" + s.tenant
+	}
+	remote, err := offsite.New(cfg, sub)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, remoteTimeout)
+	defer cancel()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := remote.Put(ctx, name, f, info.Size()); err != nil {
+		return 0, err
+	}
+
+	keep := cfg.MaxBackups
+	if keep == 0 {
+		keep = s.config.Storage.Backup.MaxBackups
+	}
+	if keep > 0 {
+		s.rotateRemote(ctx, remote, keep)
+	}
+	return info.Size(), nil
+}
+
+// rotateRemote removes the oldest backups on a remote beyond keep. Only
+// files named like the service's backups are touched.
+func (s *Server) rotateRemote(ctx context.Context, remote offsite.Remote, keep int) {
+	names, err := remote.List(ctx)
+	if err != nil {
+		s.logger.Error("Failed to list backups on remote %s: %v", remote.Name(), err)
+		return
+	}
+	var backups []string
+	for _, name := range names {
+		if strings.HasPrefix(name, backupFilePrefix) && strings.HasSuffix(name, backupFileExt+remoteBackupExt) {
+			backups = append(backups, name)
+		}
+	}
+	// The names sort by time
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for _, name := range backups[min(keep, len(backups)):] {
+		if err := remote.Delete(ctx, name); err != nil {
+			s.logger.Error("Failed to remove old backup from remote %s: %v", remote.Name(), err)
+			continue
+		}
+		s.logger.Info("Removed old backup %s from remote %s", name, remote.Name())
+	}
+}
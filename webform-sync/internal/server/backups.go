@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/events"
+	"github.com/tezza1971/webform-sync/internal/jobs"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// Backup files are named webform-sync-<UTC time>.db, so rotation only ever
+// removes files the service wrote
+const (
+	backupFilePrefix = "webform-sync-"
+	backupFileExt    = ".db"
+	backupTimeLayout = "20060102-150405"
+)
+
+// backupRetryDelay is how long to wait after a failed backup before trying
+// again, if that's sooner than the next scheduled one
+const backupRetryDelay = time.Hour
+
+// backupHistoryLimit is how many backup runs GET /admin/backups returns
+const backupHistoryLimit = 100
+
+// BackupFile is a backup in the backup directory
+type BackupFile struct {
+	Name       string    `json:"name"`
+	Bytes      int64     `json:"bytes"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+}
+
+// BackupHistory is the body of GET /admin/backups
+type BackupHistory struct {
+	Enabled       bool   `json:"enabled"`
+	Dir           string `json:"dir"`
+	IntervalHours int    `json:"intervalHours"`
+	MaxBackups    int    `json:"maxBackups"`
+	// Remotes name the remotes each backup is copied to
+	Remotes []string `json:"remotes"`
+	// NextBackup is when the next backup is due, if backups are enabled
+	NextBackup *time.Time `json:"nextBackup,omitempty"`
+	// Files are the backups kept, newest first
+	Files []BackupFile `json:"files"`
+	// Runs are the latest backup attempts, newest first
+	Runs []*storage.BackupRun `json:"runs"`
+}
+
+// backupDir is where this instance's backups go: backup_dir, or a
+// directory per tenant under it
+func (s *Server) backupDir() string {
+	dir := s.config.Storage.Backup.BackupDir
+	if s.tenant != "" {
+		dir = filepath.Join(dir, "tenants", s.tenant)
+	}
+	return dir
+}
+
+// nextBackup returns when the next backup is due: an interval after the
+// last successful one, or now if there hasn't been one
+func (s *Server) nextBackup(ctx context.Context) (time.Time, error) {
+	last, err := s.storage.LastBackup(ctx)
+	if err != nil || last.IsZero() {
+		return time.Now(), err
+	}
+	return last.Add(time.Duration(s.config.Storage.Backup.IntervalHours) * time.Hour), nil
+}
+
+// runBackups backs up the database every storage.backup.interval_hours,
+// starting straight away if the last backup is older than that
+func (s *Server) runBackups() {
+	interval := time.Duration(s.config.Storage.Backup.IntervalHours) * time.Hour
+	next, err := s.nextBackup(s.ctx)
+	if err != nil {
+		s.logger.Error("Failed to read backup history: %v", err)
+	}
+
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+
+		if !s.isLeader() {
+			next = s.followerNext(s.nextBackup)
+			continue
+		}
+		if _, err := s.backup(s.ctx); err != nil {
+			next = time.Now().Add(min(backupRetryDelay, interval))
+		} else {
+			next = time.Now().Add(interval)
+		}
+	}
+}
+
+// backup writes and verifies a backup, removes the oldest ones beyond
+// storage.backup.max_backups, copies it to any remotes, and records the
+// attempt. It runs as a job, so it can be watched and cancelled.
+func (s *Server) backup(ctx context.Context) (*storage.BackupRun, error) {
+	// A backup on demand could otherwise start in the same second as a
+	// scheduled one and want its file name
+	s.backupMu.Lock()
+	defer s.backupMu.Unlock()
+
+	var run *storage.BackupRun
+	err := s.jobManager.Run(ctx, jobs.Backup, s.tenant, func(ctx context.Context, job *jobs.Job) error {
+		var err error
+		run, err = s.writeBackup(ctx, job)
+		return err
+	})
+	// Recorded outside the job, so a cancelled backup is recorded too
+	if rerr := s.storage.RecordBackupRun(ctx, run); rerr != nil {
+		s.logger.Error("Failed to record backup: %v", rerr)
+	}
+	if run != nil && run.Status == storage.BackupFailed && ctx.Err() == nil {
+		s.events.Publish(events.BackupFailed, backupEventData{File: run.File, Error: run.Error})
+	}
+	return run, err
+}
+
+// backupEventData is the event payload for backup.failed
+type backupEventData struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// writeBackup does the work of backup, returning the run to record
+func (s *Server) writeBackup(ctx context.Context, job *jobs.Job) (*storage.BackupRun, error) {
+	dir := s.backupDir()
+	run := &storage.BackupRun{StartedAt: time.Now()}
+	run.File = filepath.Join(dir, backupFilePrefix+run.StartedAt.UTC().Format(backupTimeLayout)+backupFileExt)
+	// Names are to the second and sort by time, so wait for the next
+	// second rather than add a suffix
+	if _, err := os.Stat(run.File); err == nil {
+		time.Sleep(time.Until(run.StartedAt.Truncate(time.Second).Add(time.Second)))
+		run.StartedAt = time.Now()
+		run.File = filepath.Join(dir, backupFilePrefix+run.StartedAt.UTC().Format(backupTimeLayout)+backupFileExt)
+	}
+
+	job.SetStep("writing " + filepath.Base(run.File))
+	err := os.MkdirAll(dir, 0700)
+	if err == nil {
+		err = s.storage.BackupTo(ctx, run.File)
+	}
+	run.FinishedAt = time.Now()
+	if err != nil {
+		run.Status = storage.BackupFailed
+		run.Error = err.Error()
+		s.logger.Error("Backup to %s failed: %v", dir, err)
+	} else {
+		run.Status = storage.BackupOK
+		if info, err := os.Stat(run.File); err == nil {
+			run.Bytes = info.Size()
+		}
+		if run.SHA256, err = fileSHA256(run.File); err != nil {
+			s.logger.Warn("Failed to checksum backup %s: %v", run.File, err)
+		}
+		s.logger.Info("Backed up the database to %s (%d bytes)", run.File, run.Bytes)
+		s.rotateBackups(dir)
+		run.Remotes = s.copyToRemotes(ctx, job, run.File)
+	}
+	return run, err
+}
+
+// fileSHA256 returns the hex SHA-256 checksum of a file
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// listBackups returns the backup files in dir, newest first
+func listBackups(dir string) ([]BackupFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []BackupFile{}, nil
+		}
+		return nil, err
+	}
+
+	files := []BackupFile{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, backupFilePrefix) || !strings.HasSuffix(name, backupFileExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, BackupFile{Name: name, Bytes: info.Size(), ModifiedAt: info.ModTime()})
+	}
+	// The names sort by time
+	sort.Slice(files, func(i, j int) bool { return files[i].Name > files[j].Name })
+	return files, nil
+}
+
+// rotateBackups removes the oldest backups beyond max_backups
+func (s *Server) rotateBackups(dir string) {
+	keep := s.config.Storage.Backup.MaxBackups
+	if keep <= 0 {
+		return
+	}
+	files, err := listBackups(dir)
+	if err != nil {
+		s.logger.Error("Failed to list backups: %v", err)
+		return
+	}
+	for _, f := range files[min(keep, len(files)):] {
+		if err := os.Remove(filepath.Join(dir, f.Name)); err != nil {
+			s.logger.Error("Failed to remove old backup: %v", err)
+			continue
+		}
+		s.logger.Info("Removed old backup %s", f.Name)
+	}
+}
+
+// List the backups kept and the latest backup attempts
+func (s *Server) handleGetBackups(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config.Storage.Backup
+	history := BackupHistory{
+		Enabled:       cfg.Enabled,
+		Dir:           s.backupDir(),
+		IntervalHours: cfg.IntervalHours,
+		MaxBackups:    cfg.MaxBackups,
+		Remotes:       []string{},
+	}
+	for _, remote := range cfg.Remotes {
+		history.Remotes = append(history.Remotes, remote.Name)
+	}
+
+	// The history explains a directory that can't be read, so still show it
+	files, err := listBackups(history.Dir)
+	if err != nil {
+		s.log(r).Warn("Failed to list backups: %v", err)
+		files = []BackupFile{}
+	}
+	history.Files = files
+
+	if history.Runs, err = s.storage.GetBackupRuns(r.Context(), backupHistoryLimit); err != nil {
+		s.log(r).Error("Failed to get backup history: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to get backup history")
+		return
+	}
+
+	if cfg.Enabled {
+		next, err := s.nextBackup(r.Context())
+		if err != nil {
+			s.log(r).Error("Failed to get backup history: %v", err)
+			s.respondError(w, http.StatusInternalServerError, "Failed to get backup history")
+			return
+		}
+		history.NextBackup = &next
+	}
+
+	s.respondSuccess(w, history, "")
+}
+
+// Back up the database straight away, e.g. before an upgrade. The backup is
+// kept, rotated and copied to remotes like a scheduled one.
+func (s *Server) handleBackupNow(w http.ResponseWriter, r *http.Request) {
+	if s.config.Storage.Backup.BackupDir == "" {
+		s.respondError(w, http.StatusConflict, "Set storage.backup.backup_dir to take backups")
+		return
+	}
+
+	// The server's context rather than the request's, so a client that
+	// gives up waiting doesn't abort the backup half way
+	run, err := s.backup(s.ctx)
+	if err != nil {
+		s.respondError(w, http.StatusInternalServerError, "Backup failed: "+run.Error)
+		return
+	}
+	s.log(r).Info("Backup taken on demand: %s", run.File)
+	s.respondSuccess(w, run, "Backup complete")
+}
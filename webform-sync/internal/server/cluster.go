@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/logger"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// leaderLease names the database lease held by the replica that runs
+// scheduled work
+const leaderLease = "leader"
+
+// leaderReleaseTimeout bounds giving up the lease on shutdown
+const leaderReleaseTimeout = 5 * time.Second
+
+// leaderElection keeps this replica's claim on the leader lease. Only the
+// leader runs backups, maintenance, usage exports and stale device checks,
+// so replicas sharing a database don't repeat them. Webhooks need no
+// election: each event is delivered by the replica it happened on.
+type leaderElection struct {
+	storage *storage.Storage
+	logger  *logger.Logger
+	node    string
+	ttl     time.Duration
+	leading atomic.Bool
+}
+
+// newLeaderElection returns the election for cluster mode, or nil when it
+// is off and this server is the only one
+func newLeaderElection(cfg config.ClusterConfig, store *storage.Storage, log *logger.Logger) *leaderElection {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &leaderElection{
+		storage: store,
+		logger:  log,
+		node:    cfg.NodeID,
+		ttl:     time.Duration(cfg.LeaseSeconds) * time.Second,
+	}
+}
+
+// campaign takes or renews the lease. A replica that can't reach the
+// database steps down, since the lease may lapse before it can renew it.
+func (l *leaderElection) campaign(ctx context.Context) {
+	leading, err := l.storage.AcquireLease(ctx, leaderLease, l.node, l.ttl)
+	if err != nil {
+		l.logger.Warn("Failed to renew leader lease: %v", err)
+		leading = false
+	}
+	if was := l.leading.Swap(leading); was != leading {
+		if leading {
+			l.logger.Info("Replica %s is now the leader and runs scheduled jobs", l.node)
+		} else {
+			l.logger.Info("Replica %s is no longer the leader", l.node)
+		}
+	}
+}
+
+// release gives up the lease, so another replica takes over without
+// waiting for it to expire
+func (l *leaderElection) release() {
+	if !l.leading.Swap(false) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), leaderReleaseTimeout)
+	defer cancel()
+	if err := l.storage.ReleaseLease(ctx, leaderLease, l.node); err != nil {
+		l.logger.Warn("Failed to release leader lease: %v", err)
+	}
+}
+
+// isLeader reports whether this server runs scheduled work: always, unless
+// cluster mode is on and another replica holds the lease
+func (s *Server) isLeader() bool {
+	return s.leader == nil || s.leader.leading.Load()
+}
+
+// runLeaderElection renews or bids for the lease every third of its
+// length, and releases it on shutdown
+func (s *Server) runLeaderElection() {
+	ticker := time.NewTicker(s.leader.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.leader.campaign(s.ctx)
+		case <-s.stop:
+			s.leader.release()
+			return
+		}
+	}
+}
+
+// followerNext returns when a replica that isn't the leader should look
+// at a schedule again: when due says the work is next due, going by the
+// history the leader records, or after a lease period if that's sooner,
+// in case this replica has taken over by then
+func (s *Server) followerNext(due func(context.Context) (time.Time, error)) time.Time {
+	recheck := time.Now().Add(s.leader.ttl)
+	next, err := due(s.ctx)
+	if err != nil || next.Before(recheck) {
+		return recheck
+	}
+	return next
+}
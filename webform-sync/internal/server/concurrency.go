@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// busyRetryAfter is how long a client refused for want of a slot is told to
+// wait
+const busyRetryAfter = time.Second
+
+// Middleware: cap the number of requests handled at once, so a burst from
+// one client can't hold every SQLite connection and starve the rest.
+// Requests over the cap wait up to the queue timeout for a slot, then get
+// 503. Probes bypass the cap.
+func (s *Server) concurrencyMiddleware(next http.Handler) http.Handler {
+	slots := s.slots
+	timeout := time.Duration(s.config.Performance.QueueTimeoutMs) * time.Millisecond
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isProbe(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			if !s.waitForSlot(r, slots, timeout) {
+				s.respondRetryLater(w, r, http.StatusServiceUnavailable, "Server busy, try again", busyRetryAfter)
+				return
+			}
+		}
+		defer func() { <-slots }()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// waitForSlot queues a request for up to timeout. It returns false if no slot
+// freed up in time or the client went away.
+func (s *Server) waitForSlot(r *http.Request, slots chan struct{}, timeout time.Duration) bool {
+	if timeout <= 0 {
+		s.log(r).Warn("Rejected request: %d requests already in progress", cap(slots))
+		return false
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		s.log(r).Warn("Rejected request after queueing %s: %d requests already in progress", timeout, cap(slots))
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
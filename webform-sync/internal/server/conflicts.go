@@ -0,0 +1,416 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// Field diff statuses, from the current preset to the conflict copy
+const (
+	diffSame    = "same"
+	diffChanged = "changed"
+	diffAdded   = "added"
+	diffRemoved = "removed"
+)
+
+// FieldDiff compares one field of a preset and its conflict copy
+type FieldDiff struct {
+	Field string `json:"field"`
+	// Status is same, changed, added (only in the copy) or removed (only
+	// in the current preset)
+	Status  string      `json:"status"`
+	Current interface{} `json:"current,omitempty"`
+	Copy    interface{} `json:"copy,omitempty"`
+}
+
+// ConflictDetail is the body of GET /conflicts/{id}: both versions side by
+// side with what differs between them
+type ConflictDetail struct {
+	Conflict *storage.Conflict `json:"conflict"`
+	// Current is the preset as stored, or nil if it has been deleted
+	Current *storage.Preset `json:"current"`
+	// Changed lists what differs: name, scopeType, scopeValue, fields,
+	// encryptedFields and metadata
+	Changed []string `json:"changed"`
+	// Fields compares field by field; it is left out when either side's
+	// fields are encrypted
+	Fields []FieldDiff `json:"fields,omitempty"`
+}
+
+// ConflictResolution is the body of POST /conflicts/{id}/resolve
+type ConflictResolution struct {
+	DeviceID string `json:"deviceId"`
+	// Resolution is current, copy or merge
+	Resolution string `json:"resolution"`
+	// Fields are the merged fields, for a merge
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// presetFieldsForDiff returns a preset's readable fields, or nil if they
+// are encrypted
+func presetFieldsForDiff(p *storage.Preset) map[string]interface{} {
+	if p == nil || p.Encrypted {
+		return nil
+	}
+	return p.Fields
+}
+
+// presetDifferences lists what differs between a stored preset and a save
+// of it
+func presetDifferences(current, copy *storage.Preset) []string {
+	changed := []string{}
+	if current.Name != copy.Name {
+		changed = append(changed, "name")
+	}
+	if current.ScopeType != copy.ScopeType {
+		changed = append(changed, "scopeType")
+	}
+	if current.ScopeValue != storage.NormalizeScope(copy.ScopeType, copy.ScopeValue) {
+		changed = append(changed, "scopeValue")
+	}
+	currentFields, copyFields := presetFieldsForDiff(current), presetFieldsForDiff(copy)
+	switch {
+	case currentFields != nil && copyFields != nil:
+		if !jsonEqual(currentFields, copyFields) {
+			changed = append(changed, "fields")
+		}
+	case current.EncryptedFields != copy.EncryptedFields:
+		changed = append(changed, "encryptedFields")
+	}
+	if !jsonEqual(current.Metadata, copy.Metadata) {
+		changed = append(changed, "metadata")
+	}
+	return changed
+}
+
+// jsonEqual compares two values as they would be sent as JSON, so numbers
+// decoded as float64 match however they were written
+func jsonEqual(a, b interface{}) bool {
+	aj, aerr := json.Marshal(a)
+	bj, berr := json.Marshal(b)
+	if aerr != nil || berr != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	var av, bv interface{}
+	json.Unmarshal(aj, &av)
+	json.Unmarshal(bj, &bv)
+	return reflect.DeepEqual(av, bv)
+}
+
+// diffFields compares two sets of fields, in field name order
+func diffFields(current, copy map[string]interface{}) []FieldDiff {
+	names := make([]string, 0, len(current)+len(copy))
+	for name := range current {
+		names = append(names, name)
+	}
+	for name := range copy {
+		if _, ok := current[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	diffs := make([]FieldDiff, 0, len(names))
+	for _, name := range names {
+		c, inCurrent := current[name]
+		k, inCopy := copy[name]
+		diff := FieldDiff{Field: name, Current: c, Copy: k}
+		switch {
+		case !inCopy:
+			diff.Status = diffRemoved
+		case !inCurrent:
+			diff.Status = diffAdded
+		case jsonEqual(c, k):
+			diff.Status = diffSame
+		default:
+			diff.Status = diffChanged
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs
+}
+
+// keepConflictCopy checks a save against the stored preset when the client
+// says which version its edit started from. If the preset has changed
+// since and the save would change it again, the save is stored as a
+// conflict copy instead, which is returned; otherwise nil, and the save
+// goes ahead. deviceID is the device saving.
+func (s *Server) keepConflictCopy(ctx context.Context, preset *storage.Preset, deviceID string) (*storage.Conflict, error) {
+	baseVersion := preset.BaseVersion
+	preset.BaseVersion = 0
+	if baseVersion <= 0 || preset.ID == "" {
+		return nil, nil
+	}
+	current, err := s.presets.GetPreset(ctx, preset.ID)
+	if errors.Is(err, storage.ErrPresetNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if current.Version <= baseVersion || len(presetDifferences(current, preset)) == 0 {
+		return nil, nil
+	}
+
+	copy := *preset
+	copy.Version, copy.Access, copy.UseCount, copy.LastUsed = 0, "", 0, nil
+	conflict := &storage.Conflict{
+		PresetID:       preset.ID,
+		OwnerDeviceID:  current.DeviceID,
+		DeviceID:       deviceID,
+		BaseVersion:    baseVersion,
+		CurrentVersion: current.Version,
+		Copy:           &copy,
+	}
+	if err := s.storage.CreateConflict(ctx, conflict); err != nil {
+		return nil, err
+	}
+	return conflict, nil
+}
+
+// respondConflictCopy answers a save that was kept as a conflict copy
+func (s *Server) respondConflictCopy(w http.ResponseWriter, r *http.Request, conflict *storage.Conflict) {
+	s.log(r).Info("Save of preset %s based on version %d kept as conflict %s; it is at version %d (device: %s)",
+		conflict.PresetID, conflict.BaseVersion, conflict.ID, conflict.CurrentVersion, conflict.DeviceID)
+	s.respondJSON(w, http.StatusConflict, APIResponse{
+		Success: false,
+		Data:    conflict,
+		Error: fmt.Sprintf("Preset has changed since version %d; the save was kept as conflict %s",
+			conflict.BaseVersion, conflict.ID),
+		RequestID: responseRequestID(w),
+	})
+}
+
+// conflictVisible reports whether a device may see and resolve a conflict:
+// it made the save, or can edit the preset
+func (s *Server) conflictVisible(ctx context.Context, conflict *storage.Conflict, current *storage.Preset, deviceID string) (bool, error) {
+	if deviceID == conflict.DeviceID || deviceID == conflict.OwnerDeviceID {
+		return true, nil
+	}
+	if current == nil {
+		return false, nil
+	}
+	role, err := s.presetRole(ctx, current, deviceID)
+	return storage.RoleAllows(role, storage.RoleEditor), err
+}
+
+// loadConflict fetches a conflict and its preset for the device in
+// deviceID, answering the request if it can't
+func (s *Server) loadConflict(w http.ResponseWriter, r *http.Request, deviceID string) (*storage.Conflict, *storage.Preset, bool) {
+	conflict, err := s.storage.GetConflict(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrConflictNotFound) {
+		s.respondError(w, http.StatusNotFound, "Conflict not found")
+		return nil, nil, false
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get conflict: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve conflict")
+		return nil, nil, false
+	}
+	current, err := s.presets.GetPreset(r.Context(), conflict.PresetID)
+	if errors.Is(err, storage.ErrPresetNotFound) {
+		current, err = nil, nil
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get preset: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve conflict")
+		return nil, nil, false
+	}
+
+	if deviceID != "" {
+		visible, err := s.conflictVisible(r.Context(), conflict, current, deviceID)
+		if err != nil {
+			s.log(r).Error("Failed to check preset access: %v", err)
+			s.respondError(w, http.StatusInternalServerError, "Failed to retrieve conflict")
+			return nil, nil, false
+		}
+		if !visible {
+			s.respondError(w, http.StatusNotFound, "Conflict not found")
+			return nil, nil, false
+		}
+	}
+	return conflict, current, true
+}
+
+// List conflicts
+func (s *Server) handleGetConflicts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := storage.ConflictFilter{DeviceID: query.Get("device_id"), PresetID: query.Get("preset_id")}
+	if !s.requireDeviceScope(w, r, filter.DeviceID) || !s.authorizeDevice(w, r, filter.DeviceID) {
+		return
+	}
+	filter.IncludeResolved, _ = strconv.ParseBool(query.Get("include_resolved"))
+
+	conflicts, err := s.storage.ListConflicts(r.Context(), filter)
+	if err != nil {
+		s.log(r).Error("Failed to get conflicts: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve conflicts")
+		return
+	}
+	s.respondSuccess(w, conflicts, fmt.Sprintf("Found %d conflicts", len(conflicts)))
+}
+
+// Get a conflict with both versions side by side
+func (s *Server) handleGetConflict(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	if !s.requireDeviceScope(w, r, deviceID) || !s.authorizeDevice(w, r, deviceID) {
+		return
+	}
+	conflict, current, ok := s.loadConflict(w, r, deviceID)
+	if !ok {
+		return
+	}
+
+	detail := ConflictDetail{Conflict: conflict, Current: current, Changed: []string{}}
+	if current != nil {
+		detail.Changed = presetDifferences(current, conflict.Copy)
+	}
+	currentFields, copyFields := presetFieldsForDiff(current), presetFieldsForDiff(conflict.Copy)
+	if current == nil || (currentFields != nil && copyFields != nil) {
+		detail.Fields = diffFields(currentFields, copyFields)
+	}
+	s.respondSuccess(w, detail, "")
+}
+
+// Resolve a conflict by keeping the current preset, taking the copy, or
+// merging fields from both
+func (s *Server) handleResolveConflict(w http.ResponseWriter, r *http.Request) {
+	var body ConflictResolution
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if !s.requireDeviceScope(w, r, body.DeviceID) || !s.authorizeDevice(w, r, body.DeviceID) {
+		return
+	}
+	switch body.Resolution {
+	case storage.ResolveKeepCurrent, storage.ResolveTakeCopy:
+	case storage.ResolveMerge:
+		if body.Fields == nil {
+			s.respondError(w, http.StatusBadRequest, "fields are required to merge")
+			return
+		}
+	default:
+		s.respondError(w, http.StatusBadRequest, "resolution must be current, copy or merge")
+		return
+	}
+
+	conflict, current, ok := s.loadConflict(w, r, body.DeviceID)
+	if !ok {
+		return
+	}
+	if conflict.ResolvedAt != nil {
+		s.respondError(w, http.StatusConflict, "Conflict is already resolved")
+		return
+	}
+
+	var resolved *storage.Preset
+	switch body.Resolution {
+	case storage.ResolveTakeCopy:
+		copy := *conflict.Copy
+		resolved = &copy
+	case storage.ResolveMerge:
+		if current == nil {
+			s.respondError(w, http.StatusConflict, "Preset has been deleted; keep the copy or the deletion instead")
+			return
+		}
+		if presetFieldsForDiff(current) == nil || presetFieldsForDiff(conflict.Copy) == nil {
+			s.respondError(w, http.StatusConflict, "Encrypted fields can't be merged here; keep one version instead")
+			return
+		}
+		merged := *current
+		merged.Fields, merged.EncryptedFields = body.Fields, ""
+		resolved = &merged
+	}
+
+	// The conflict is claimed before its resolution is applied, so two
+	// devices resolving it at once can't both write theirs
+	if err := s.storage.ResolveConflict(r.Context(), conflict, body.Resolution, body.DeviceID); err != nil {
+		if errors.Is(err, storage.ErrConflictResolved) {
+			s.respondError(w, http.StatusConflict, "Conflict is already resolved")
+			return
+		}
+		s.log(r).Error("Failed to resolve conflict: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to resolve conflict")
+		return
+	}
+
+	if resolved != nil {
+		resolved.ID, resolved.Access = conflict.PresetID, ""
+		if current != nil {
+			resolved.DeviceID, resolved.CreatedAt = current.DeviceID, current.CreatedAt
+			resolved.UseCount, resolved.LastUsed = current.UseCount, current.LastUsed
+		} else {
+			resolved.DeviceID = conflict.OwnerDeviceID
+		}
+		if status, err := s.applyResolution(r, resolved, current == nil); err != nil {
+			// Reopened even if the client has gone, or it stays claimed
+			if err := s.storage.ReopenConflict(context.WithoutCancel(r.Context()), conflict); err != nil {
+				s.log(r).Error("Failed to reopen conflict %s: %v", conflict.ID, err)
+			}
+			s.respondError(w, status, err.Error())
+			return
+		}
+	}
+
+	s.log(r).Info("Conflict %s on preset %s resolved: %s (device: %s)", conflict.ID, conflict.PresetID, body.Resolution, body.DeviceID)
+	if resolved == nil {
+		resolved = current
+	}
+	s.respondSuccess(w, map[string]interface{}{"conflict": conflict, "preset": resolved}, "Conflict resolved successfully")
+}
+
+// applyResolution saves the preset a conflict resolved to, checked as any
+// save is. A deleted preset is created again. A refusal comes with the
+// status to respond with.
+func (s *Server) applyResolution(r *http.Request, preset *storage.Preset, deleted bool) (int, error) {
+	if err := checkScopePattern(preset); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if preset.ScopeValue != "" && !s.urlFilters.isAllowed(preset.ScopeValue) {
+		s.log(r).Warn("URL blocked by filter: %s", preset.ScopeValue)
+		return http.StatusForbidden, errors.New("URL not allowed")
+	}
+	if status, err := checkFieldTypes(preset); err != nil {
+		return status, err
+	}
+	if status, err := s.transformOnSave(r, preset); err != nil {
+		return status, err
+	}
+	if status, err := s.checkFieldPolicy(r, preset); err != nil {
+		return status, err
+	}
+	if status, err := s.checkPII(r, preset); err != nil {
+		return status, err
+	}
+
+	var err error
+	if deleted {
+		err = s.presets.SavePreset(r.Context(), preset)
+	} else {
+		err = s.presets.EditPreset(r.Context(), preset)
+	}
+	switch {
+	case errors.Is(err, storage.ErrPresetExists):
+		return http.StatusConflict, errors.New("The device already has a preset with this name in that scope")
+	case errors.Is(err, storage.ErrPresetNotFound):
+		return http.StatusConflict, errors.New("Preset was deleted while resolving; try again")
+	case err != nil:
+		if status, ok := quotaStatus(err); ok {
+			return status, err
+		}
+		s.log(r).Error("Failed to save resolved preset: %v", err)
+		return http.StatusInternalServerError, errors.New("Failed to resolve conflict")
+	}
+	s.publishPresetSaved(preset)
+	return 0, nil
+}
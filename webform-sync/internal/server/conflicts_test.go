@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// A resolution that can't be applied leaves the conflict open to resolve
+// another way
+func TestResolveConflictReopensOnFailure(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	save := func(name, user string) *storage.Preset {
+		now := time.Now()
+		p := &storage.Preset{
+			DeviceID: "laptop", Name: name, ScopeType: storage.ScopeTypeGlobal,
+			Fields: map[string]interface{}{"user": user}, CreatedAt: now, UpdatedAt: now,
+		}
+		if err := s.storage.SavePreset(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	current := save("Login", "alice")
+	save("Other", "bob")
+
+	// The copy takes the name of the device's other preset
+	copy := *current
+	copy.Name = "Other"
+	conflict := &storage.Conflict{
+		PresetID: current.ID, OwnerDeviceID: "laptop", DeviceID: "laptop",
+		BaseVersion: 1, CurrentVersion: 2, Copy: &copy,
+	}
+	if err := s.storage.CreateConflict(ctx, conflict); err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := func(resolution string) int {
+		body := `{"deviceId": "laptop", "resolution": "` + resolution + `"}`
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/conflicts/"+conflict.ID+"/resolve", strings.NewReader(body))
+		r = mux.SetURLVars(r, map[string]string{"id": conflict.ID})
+		w := httptest.NewRecorder()
+		s.handleResolveConflict(w, r)
+		return w.Code
+	}
+
+	if code := resolve(storage.ResolveTakeCopy); code != http.StatusConflict {
+		t.Fatalf("taking the copy: status = %d, want %d", code, http.StatusConflict)
+	}
+	got, err := s.storage.GetConflict(ctx, conflict.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ResolvedAt != nil {
+		t.Fatalf("conflict resolved as %q after its resolution failed", got.Resolution)
+	}
+
+	if code := resolve(storage.ResolveKeepCurrent); code != http.StatusOK {
+		t.Fatalf("keeping the current preset: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := resolve(storage.ResolveKeepCurrent); code != http.StatusConflict {
+		t.Errorf("resolving twice: status = %d, want %d", code, http.StatusConflict)
+	}
+}
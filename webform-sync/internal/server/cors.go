@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// corsOrigins holds the origins added through the admin API. They are
+// service-wide, so every instance shares one set across config reloads.
+type corsOrigins struct {
+	mu      sync.RWMutex
+	origins []*storage.CORSOrigin
+}
+
+// load reads the added origins from storage
+func (o *corsOrigins) load(ctx context.Context, store *storage.Storage) error {
+	origins, err := store.GetCORSOrigins(ctx)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	o.origins = origins
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *corsOrigins) list() []*storage.CORSOrigin {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.origins
+}
+
+// corsAllowed decides whether a cross-origin request may go ahead. The
+// method is the one a preflight asks about, or the request's own. Rules in
+// the config come first, then origins added at runtime, then
+// cors.allowed_origins; the first origin that matches decides. rs/cors
+// checks the method against cors.allowed_methods as well.
+func (s *Server) corsAllowed(r *http.Request, origin string) bool {
+	method := r.Method
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		method = r.Header.Get("Access-Control-Request-Method")
+	}
+
+	for _, rule := range s.config.CORS.Rules {
+		if config.OriginMatches(rule.Origin, origin) {
+			return methodAllowed(rule.Methods, method)
+		}
+	}
+	if s.corsOrigins != nil {
+		for _, added := range s.corsOrigins.list() {
+			if config.OriginMatches(added.Origin, origin) {
+				return methodAllowed(added.Methods, method)
+			}
+		}
+	}
+	for _, pattern := range s.config.CORS.AllowedOrigins {
+		if config.OriginMatches(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// methodAllowed reports whether a rule's methods include method; a rule
+// without methods allows them all
+func methodAllowed(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORSOrigins lists the origins allowed to call the API
+type CORSOrigins struct {
+	// AllowedOrigins and Rules come from the config file
+	AllowedOrigins []string          `json:"allowedOrigins"`
+	Rules          []config.CORSRule `json:"rules"`
+	// Added were added through the admin API
+	Added []*storage.CORSOrigin `json:"added"`
+}
+
+// CORSOriginRequest is the body of POST /admin/cors/origins
+type CORSOriginRequest struct {
+	Origin  string   `json:"origin"`
+	Methods []string `json:"methods"`
+}
+
+// corsAdminOnly restricts a handler to the service's own administrator,
+// since CORS applies to every tenant
+func (s *Server) corsAdminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return s.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		if s.tenant != "" {
+			s.respondError(w, http.StatusForbidden, "CORS origins can only be changed by the service administrator")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// List the origins allowed to call the API
+func (s *Server) handleGetCORSOrigins(w http.ResponseWriter, r *http.Request) {
+	rules := s.config.CORS.Rules
+	if rules == nil {
+		rules = []config.CORSRule{}
+	}
+	s.respondSuccess(w, CORSOrigins{
+		AllowedOrigins: s.config.CORS.AllowedOrigins,
+		Rules:          rules,
+		Added:          s.corsOrigins.list(),
+	}, "")
+}
+
+// Allow another origin, such as a new browser's extension, without editing
+// the config file
+func (s *Server) handleAddCORSOrigin(w http.ResponseWriter, r *http.Request) {
+	var req CORSOriginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	req.Origin = strings.TrimSpace(req.Origin)
+	if err := config.CheckOriginPattern(req.Origin); err != nil {
+		s.respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid origin %q: %v", req.Origin, err))
+		return
+	}
+	if req.Origin == "*" && s.config.Authentication.Enabled && s.config.Authentication.Type == "basic" {
+		s.respondError(w, http.StatusBadRequest, "Origin \"*\" is not allowed with basic authentication")
+		return
+	}
+	methods := make([]string, 0, len(req.Methods))
+	for _, m := range req.Methods {
+		if len(s.config.CORS.AllowedMethods) == 0 || !methodAllowed(s.config.CORS.AllowedMethods, m) {
+			s.respondError(w, http.StatusBadRequest, fmt.Sprintf("Method %s is not in cors.allowed_methods", m))
+			return
+		}
+		methods = append(methods, strings.ToUpper(m))
+	}
+
+	origin, err := s.storage.AddCORSOrigin(r.Context(), req.Origin, methods)
+	if err != nil {
+		if errors.Is(err, storage.ErrCORSOriginExists) {
+			s.respondError(w, http.StatusConflict, "Origin already added")
+			return
+		}
+		s.log(r).Error("Failed to add CORS origin: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to add origin")
+		return
+	}
+	if err := s.corsOrigins.load(r.Context(), s.storage); err != nil {
+		s.log(r).Error("Failed to reload CORS origins: %v", err)
+	}
+
+	s.log(r).Warn("CORS origin %s allowed", origin.Origin)
+	s.respondJSON(w, http.StatusCreated, APIResponse{
+		Success: true,
+		Data:    origin,
+		Message: "Origin added",
+	})
+}
+
+// Remove an origin added through the API
+func (s *Server) handleDeleteCORSOrigin(w http.ResponseWriter, r *http.Request) {
+	if err := s.storage.DeleteCORSOrigin(r.Context(), mux.Vars(r)["id"]); err != nil {
+		if errors.Is(err, storage.ErrCORSOriginNotFound) {
+			s.respondError(w, http.StatusNotFound, "Origin not found")
+			return
+		}
+		s.log(r).Error("Failed to delete CORS origin: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to delete origin")
+		return
+	}
+	if err := s.corsOrigins.load(r.Context(), s.storage); err != nil {
+		s.log(r).Error("Failed to reload CORS origins: %v", err)
+	}
+
+	s.respondSuccess(w, nil, "Origin removed")
+}
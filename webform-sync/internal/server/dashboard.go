@@ -0,0 +1,174 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/jobs"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// dashboardPath is left out of the request counts, so watching the dashboard
+// doesn't show up on it
+const dashboardPath = "/api/v1/admin/dashboard"
+
+// requestCounter counts requests per second over the last minute, and in
+// all since the server started
+type requestCounter struct {
+	mu sync.Mutex
+	// counts holds requests per second, indexed by Unix time modulo its
+	// length; seconds holds the second each slot was last counted for
+	counts  [60]int64
+	seconds [60]int64
+	total   int64
+	errors  int64
+	slow    int64
+}
+
+// RequestRates is the request traffic shown on the dashboard
+type RequestRates struct {
+	Total int64 `json:"total"`
+	// Errors are the responses with a 5xx status
+	Errors int64 `json:"errors"`
+	// Slow are the requests that took longer than logging.slow_request_ms
+	Slow int64 `json:"slow"`
+	// PerSecond is the average over the last 10 seconds
+	PerSecond float64 `json:"perSecond"`
+	// LastMinute holds requests per second for the last 60 seconds, oldest
+	// first
+	LastMinute []int64 `json:"lastMinute"`
+}
+
+func (c *requestCounter) record(now time.Time, status int) {
+	sec := now.Unix()
+	slot := sec % int64(len(c.counts))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seconds[slot] != sec {
+		c.seconds[slot], c.counts[slot] = sec, 0
+	}
+	c.counts[slot]++
+	c.total++
+	if status >= 500 {
+		c.errors++
+	}
+}
+
+func (c *requestCounter) recordSlow() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slow++
+}
+
+// rates returns the traffic up to the last whole second
+func (c *requestCounter) rates(now time.Time) RequestRates {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := int64(len(c.counts))
+	rates := RequestRates{Total: c.total, Errors: c.errors, Slow: c.slow, LastMinute: make([]int64, n)}
+	var recent int64
+	for i := int64(0); i < n; i++ {
+		sec := now.Unix() - n + i
+		slot := (sec%n + n) % n
+		if c.seconds[slot] == sec {
+			rates.LastMinute[i] = c.counts[slot]
+		}
+		if i >= n-10 {
+			recent += rates.LastMinute[i]
+		}
+	}
+	rates.PerSecond = float64(recent) / 10
+	return rates
+}
+
+// requestCountMiddleware counts every request but the dashboard's own, with
+// the status it was finally given
+func (s *Server) requestCountMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == dashboardPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(wrapped, r)
+		s.requests.record(time.Now(), wrapped.statusCode)
+	})
+}
+
+// Dashboard is the body of GET /admin/dashboard: what webform-sync tui shows
+type Dashboard struct {
+	Uptime string `json:"uptime"`
+	// Requests and Log cover the whole process, so a tenant's admin doesn't
+	// get them
+	Requests *RequestRates       `json:"requests,omitempty"`
+	Presets  int                 `json:"presets"`
+	Devices  []*storage.Device   `json:"devices"`
+	Syncs    []storage.SyncEvent `json:"syncs"`
+	// Jobs are the jobs running now
+	Jobs []jobs.Info `json:"jobs"`
+	Log  []string    `json:"log,omitempty"`
+}
+
+// Live stats for the terminal dashboard, in one request so it can poll
+// cheaply
+func (s *Server) handleGetDashboard(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	syncs, err := boundedParam(query.Get("syncs"), 20, 200)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "syncs "+err.Error())
+		return
+	}
+	logLines, err := boundedParam(query.Get("log_lines"), 50, 200)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "log_lines "+err.Error())
+		return
+	}
+
+	dashboard := Dashboard{Uptime: s.uptime(), Jobs: []jobs.Info{}}
+	if s.tenant == "" {
+		rates := s.requests.rates(time.Now())
+		dashboard.Requests = &rates
+		dashboard.Log = s.logger.Recent(logLines)
+	}
+
+	// A search with no limit only counts
+	if _, dashboard.Presets, err = s.storage.SearchPresets(r.Context(), storage.PresetQuery{}); err != nil {
+		s.log(r).Error("Failed to count presets: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve dashboard")
+		return
+	}
+	if dashboard.Devices, err = s.storage.GetDevices(r.Context(), ""); err != nil {
+		s.log(r).Error("Failed to get devices: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve dashboard")
+		return
+	}
+	if dashboard.Syncs, err = s.storage.RecentSyncs(r.Context(), syncs); err != nil {
+		s.log(r).Error("Failed to get recent syncs: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve dashboard")
+		return
+	}
+	for _, job := range s.jobManager.List(s.tenant) {
+		if job.Status == jobs.Running {
+			dashboard.Jobs = append(dashboard.Jobs, job)
+		}
+	}
+
+	s.respondSuccess(w, dashboard, "")
+}
+
+// boundedParam parses an optional count between 0 and limit
+func boundedParam(v string, fallback, limit int) (int, error) {
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > limit {
+		return 0, fmt.Errorf("must be between 0 and %d", limit)
+	}
+	return n, nil
+}
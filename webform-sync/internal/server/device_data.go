@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/archive"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// TakeoutFormatVersion is bumped when the takeout layout changes incompatibly
+const TakeoutFormatVersion = 1
+
+// Erase everything the server holds about a device
+func (s *Server) handleEraseDeviceData(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["id"]
+	sessionID := r.URL.Query().Get("session_id")
+
+	erasure, err := s.storage.EraseDeviceData(r.Context(), deviceID, sessionID)
+	if err != nil {
+		s.log(r).Error("Failed to erase device data: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to erase device data")
+		return
+	}
+
+	s.respondSuccess(w, erasure, fmt.Sprintf("Erased %d presets and %d sync log entries", erasure.Presets, erasure.SyncLogEntries))
+}
+
+// Stream everything the server holds about a device as one JSON document
+func (s *Server) handleDeviceTakeout(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["id"]
+	sessionID := r.URL.Query().Get("session_id")
+	passphrase := r.Header.Get("X-Export-Passphrase")
+
+	// Disabled domains are small; load them first so a failure can still
+	// produce a proper error response
+	var disabled []string
+	if sessionID != "" {
+		var err error
+		if disabled, err = s.storage.GetDisabledDomains(r.Context(), sessionID); err != nil {
+			s.log(r).Error("Failed to get disabled domains: %v", err)
+			s.respondError(w, http.StatusInternalServerError, "Failed to build takeout")
+			return
+		}
+	}
+	if disabled == nil {
+		disabled = []string{}
+	}
+
+	device, err := s.storage.GetDevice(r.Context(), deviceID)
+	if err != nil && !errors.Is(err, storage.ErrDeviceNotFound) {
+		s.log(r).Error("Failed to get device: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to build takeout")
+		return
+	}
+
+	filename := fmt.Sprintf("webform-takeout-%s-%s.json", deviceID, time.Now().Format("20060102-150405"))
+	contentType := "application/json"
+	if passphrase != "" {
+		filename += ".enc"
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	buffered := bufio.NewWriter(w)
+	var out io.Writer = buffered
+	var encrypted io.WriteCloser
+	if passphrase != "" {
+		enc, err := archive.NewEncryptWriter(buffered, passphrase)
+		if err != nil {
+			s.log(r).Error("Failed to start encrypted takeout: %v", err)
+			s.respondError(w, http.StatusInternalServerError, "Failed to build takeout")
+			return
+		}
+		encrypted = enc
+		out = enc
+	}
+
+	err = writeTakeout(r.Context(), out, s.storage, deviceID, sessionID, device, disabled)
+	if err == nil && encrypted != nil {
+		err = encrypted.Close()
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		// Headers are already committed; the client sees a truncated body
+		s.log(r).Error("Takeout for device %s failed: %v", deviceID, err)
+		return
+	}
+
+	s.log(r).Info("Takeout generated for device %s (encrypted: %t)", deviceID, passphrase != "")
+}
+
+// writeTakeout streams the takeout document: a header object followed by the
+// presets, sync log and usage event arrays, written row by row
+func writeTakeout(ctx context.Context, w io.Writer, store *storage.Storage, deviceID, sessionID string, device *storage.Device, disabled []string) error {
+	header, err := json.Marshal(map[string]interface{}{
+		"formatVersion":   TakeoutFormatVersion,
+		"generatedAt":     time.Now(),
+		"deviceId":        deviceID,
+		"device":          device,
+		"sessionId":       sessionID,
+		"disabledDomains": disabled,
+	})
+	if err != nil {
+		return err
+	}
+	// Re-open the header object to append the streamed arrays
+	if _, err := fmt.Fprintf(w, "%s,\"presets\":[", header[:len(header)-1]); err != nil {
+		return err
+	}
+
+	writeArray := func(count *int, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if *count > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		*count++
+		_, err = w.Write(data)
+		return err
+	}
+
+	presets := 0
+	if err := store.ForEachDevicePreset(ctx, deviceID, func(p *storage.Preset) error {
+		return writeArray(&presets, p)
+	}); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, "],\"syncLog\":["); err != nil {
+		return err
+	}
+
+	entries := 0
+	if err := store.ForEachDeviceSyncLog(ctx, deviceID, func(entry map[string]interface{}) error {
+		return writeArray(&entries, entry)
+	}); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, "],\"usageEvents\":["); err != nil {
+		return err
+	}
+
+	uses := 0
+	if err := store.ForEachDeviceUsageEvent(ctx, deviceID, func(event map[string]interface{}) error {
+		return writeArray(&uses, event)
+	}); err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
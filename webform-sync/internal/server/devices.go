@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/events"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// requestDeviceID identifies the device making a request, from the
+// X-Device-ID header, the device_id query parameter or the v2 path
+func requestDeviceID(r *http.Request) string {
+	if ids := requestDeviceIDs(r); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+// requestDeviceIDs lists the distinct devices a request names, in the order
+// requestDeviceID prefers them. Handlers act on the query parameter or path,
+// so a request naming more than one device must be refused rather than
+// admitted on the header alone.
+func requestDeviceIDs(r *http.Request) []string {
+	var ids []string
+	add := func(id string) {
+		if id == "" {
+			return
+		}
+		for _, seen := range ids {
+			if seen == id {
+				return
+			}
+		}
+		ids = append(ids, id)
+	}
+	add(r.Header.Get("X-Device-ID"))
+	add(r.URL.Query().Get("device_id"))
+	if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+		add(mux.Vars(r)["device"])
+	}
+	return ids
+}
+
+// tokenFingerprint returns a short, non-reversible fingerprint of the API
+// token presented with a request, or "" if there is none
+func tokenFingerprint(r *http.Request) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// deviceSeenInterval is how stale a device's last_seen may get before a
+// request from it writes a new one
+const deviceSeenInterval = time.Minute
+
+// touchDevice records contact from a device. Most requests come from a
+// device that is already registered, unchanged and recently seen, and those
+// are answered from a read so they don't queue on SQLite's single writer;
+// the rest go through RegisterDevice. written reports which happened.
+func (s *Server) touchDevice(ctx context.Context, contact *storage.Device) (device *storage.Device, written bool, err error) {
+	device, err = s.storage.GetDevice(ctx, contact.ID)
+	if errors.Is(err, storage.ErrDeviceNotFound) {
+		device, err = s.storage.RegisterDevice(ctx, contact)
+		return device, err == nil, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	changed := contact.TokenFingerprint != "" && contact.TokenFingerprint != device.TokenFingerprint
+	claimed := contact.UserID != "" && device.UserID == ""
+	// Another user's device is left alone; the caller turns them away
+	foreign := contact.UserID != "" && device.UserID != "" && device.UserID != contact.UserID
+	if foreign || (!changed && !claimed && time.Since(device.LastSeen) < deviceSeenInterval) {
+		return device, false, nil
+	}
+	device, err = s.storage.RegisterDevice(ctx, contact)
+	return device, err == nil, err
+}
+
+// admitDevice registers contact from a device and rejects revoked devices and,
+// for per-user tokens, devices owned by another user.
+// It writes the error response and returns false if the request must stop.
+func (s *Server) admitDevice(w http.ResponseWriter, r *http.Request, deviceID string) bool {
+	if deviceID == "" {
+		return true
+	}
+	// The registry can't be reached during an outage; reads go ahead as
+	// they would if it failed, without an error logged for each
+	if s.outage.active() && requestUser(r) == nil {
+		return true
+	}
+
+	reject := func(status int, msg string) bool {
+		if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+			s.respondV2Error(w, r, status, msg)
+		} else {
+			s.respondError(w, status, msg)
+		}
+		return false
+	}
+
+	device, written, err := s.touchDevice(r.Context(), &storage.Device{
+		ID:               deviceID,
+		TokenFingerprint: tokenFingerprint(r),
+		UserID:           requestUserID(r),
+	})
+	if err != nil {
+		s.log(r).Error("Failed to register device %s: %v", deviceID, err)
+		// Registry trouble shouldn't take the whole API down, but a user's
+		// request can't proceed without knowing who owns the device
+		if requestUser(r) != nil {
+			return reject(http.StatusInternalServerError, "Failed to verify device")
+		}
+		return true
+	}
+
+	if user := requestUser(r); user != nil && device.UserID != user.ID {
+		s.log(r).Warn("User %s attempted to act as device %s owned by another user", user.ID, deviceID)
+		return reject(http.StatusForbidden, "Device belongs to another user")
+	}
+
+	if device.Revoked() {
+		s.log(r).Warn("Request from revoked device: %s", deviceID)
+		return reject(http.StatusForbidden, "Device has been revoked")
+	}
+	// A device read back unchanged may still look new within its first
+	// minute, so only a write can be its first contact
+	if written && device.FirstContact() {
+		s.publishDevice(events.DeviceRegistered, device)
+	}
+	return true
+}
+
+// Middleware: device registration and revocation
+func (s *Server) deviceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids := requestDeviceIDs(r)
+		if len(ids) > 1 {
+			s.log(r).Warn("Request names devices %s", strings.Join(ids, " and "))
+			msg := "X-Device-ID does not match the request's device"
+			if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+				s.respondV2Error(w, r, http.StatusBadRequest, msg)
+			} else {
+				s.respondError(w, http.StatusBadRequest, msg)
+			}
+			return
+		}
+		if !s.admitDevice(w, r, requestDeviceID(r)) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Register a device, or update its metadata
+func (s *Server) handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
+	var device storage.Device
+	if err := json.NewDecoder(r.Body).Decode(&device); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if device.ID == "" {
+		s.respondError(w, http.StatusBadRequest, "id is required")
+		return
+	}
+	device.TokenFingerprint = tokenFingerprint(r)
+	device.UserID = requestUserID(r)
+
+	registered, err := s.storage.RegisterDevice(r.Context(), &device)
+	if err != nil {
+		s.log(r).Error("Failed to register device: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to register device")
+		return
+	}
+	if registered.Revoked() {
+		s.respondError(w, http.StatusForbidden, "Device has been revoked")
+		return
+	}
+	if registered.UserID != device.UserID && device.UserID != "" {
+		s.respondError(w, http.StatusForbidden, "Device belongs to another user")
+		return
+	}
+
+	s.log(r).Info("Device registered: %s (%s)", registered.ID, registered.Name)
+	if registered.FirstContact() {
+		s.publishDevice(events.DeviceRegistered, registered)
+	}
+	s.respondSuccess(w, registered, "Device registered")
+}
+
+// Get a single device
+func (s *Server) handleGetDevice(w http.ResponseWriter, r *http.Request) {
+	device, err := s.storage.GetDevice(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrDeviceNotFound) {
+		s.respondError(w, http.StatusNotFound, "Device not found")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get device: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve device")
+		return
+	}
+
+	s.respondSuccess(w, device, "")
+}
+
+// Rename a device
+func (s *Server) handleRenameDevice(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if strings.TrimSpace(body.Name) == "" {
+		s.respondError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	if err := s.storage.RenameDevice(r.Context(), id, strings.TrimSpace(body.Name)); err != nil {
+		if errors.Is(err, storage.ErrDeviceNotFound) {
+			s.respondError(w, http.StatusNotFound, "Device not found")
+			return
+		}
+		s.log(r).Error("Failed to rename device: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to rename device")
+		return
+	}
+
+	s.handleGetDevice(w, r)
+}
+
+// Revoke a device, blocking any further requests made as it
+func (s *Server) handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	if err := s.storage.RevokeDevice(r.Context(), mux.Vars(r)["id"]); err != nil {
+		if errors.Is(err, storage.ErrDeviceNotFound) {
+			s.respondError(w, http.StatusNotFound, "Device not found")
+			return
+		}
+		s.log(r).Error("Failed to revoke device: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to revoke device")
+		return
+	}
+	if device, err := s.storage.GetDevice(r.Context(), mux.Vars(r)["id"]); err == nil {
+		s.publishDevice(events.DeviceRevoked, device)
+	}
+
+	s.handleGetDevice(w, r)
+}
+
+// staleDeviceCheckInterval is how often the stale-device monitor runs
+const staleDeviceCheckInterval = 24 * time.Hour
+
+// StaleDevice is a device that hasn't contacted the service recently
+type StaleDevice struct {
+	*storage.Device
+	DaysSinceSeen int `json:"daysSinceSeen"`
+}
+
+// findStaleDevices lists devices not seen for at least the given days
+func (s *Server) findStaleDevices(ctx context.Context, days int) ([]StaleDevice, error) {
+	now := time.Now()
+	devices, err := s.storage.GetStaleDevices(ctx, now.AddDate(0, 0, -days))
+	if err != nil {
+		return nil, err
+	}
+
+	stale := make([]StaleDevice, 0, len(devices))
+	for _, device := range devices {
+		stale = append(stale, StaleDevice{
+			Device:        device,
+			DaysSinceSeen: int(now.Sub(device.LastSeen).Hours() / 24),
+		})
+	}
+	return stale, nil
+}
+
+// monitorStaleDevices periodically logs a warning for each stale device
+func (s *Server) monitorStaleDevices(days int) {
+	ticker := time.NewTicker(staleDeviceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		// Replicas share the devices, so only the leader warns about them
+		if s.isLeader() {
+			stale, err := s.findStaleDevices(s.ctx, days)
+			if err != nil {
+				s.logger.Error("Failed to check for stale devices: %v", err)
+			}
+			for _, d := range stale {
+				s.logger.Warn("Device %s (%s) has not synced for %d days; check its extension install",
+					d.ID, d.Name, d.DaysSinceSeen)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Report devices that haven't synced recently
+func (s *Server) handleGetStaleDevices(w http.ResponseWriter, r *http.Request) {
+	days := s.config.Maintenance.StaleDeviceDays
+	if days <= 0 {
+		days = 14
+	}
+	if daysStr := r.URL.Query().Get("days"); daysStr != "" {
+		fmt.Sscanf(daysStr, "%d", &days)
+	}
+	if days < 1 {
+		s.respondError(w, http.StatusBadRequest, "days must be at least 1")
+		return
+	}
+
+	stale, err := s.findStaleDevices(r.Context(), days)
+	if err != nil {
+		s.log(r).Error("Failed to get stale devices: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve stale devices")
+		return
+	}
+
+	s.respondSuccess(w, map[string]interface{}{
+		"days":    days,
+		"devices": stale,
+	}, fmt.Sprintf("%d devices not seen in %d days", len(stale), days))
+}
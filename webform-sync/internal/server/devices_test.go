@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// A user's request must not be admitted on its own device in X-Device-ID
+// while the handler acts on another user's device in the query or path
+func TestDeviceMiddlewareRejectsMismatchedDevices(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	mallory, _, err := s.storage.CreateUser(ctx, "mallory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, _, err := s.storage.CreateUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, user := range map[string]*storage.User{"mallory-laptop": mallory, "alice-laptop": alice} {
+		if _, err := s.storage.RegisterDevice(ctx, &storage.Device{ID: id, UserID: user.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reached := false
+	handler := s.deviceMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	tests := []struct {
+		name   string
+		url    string
+		vars   map[string]string
+		header string
+		want   int
+	}{
+		{"query names another device", "/api/v1/presets?device_id=alice-laptop", nil, "mallory-laptop", http.StatusBadRequest},
+		{"v2 path names another device", "/api/v2/devices/alice-laptop/presets", map[string]string{"device": "alice-laptop"}, "mallory-laptop", http.StatusBadRequest},
+		{"query without header", "/api/v1/presets?device_id=alice-laptop", nil, "", http.StatusForbidden},
+		{"header and query agree", "/api/v1/presets?device_id=mallory-laptop", nil, "mallory-laptop", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached = false
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.header != "" {
+				r.Header.Set("X-Device-ID", tt.header)
+			}
+			if tt.vars != nil {
+				r = mux.SetURLVars(r, tt.vars)
+			}
+			r = withUser(r, mallory)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d (%s)", w.Code, tt.want, w.Body.String())
+			}
+			if reached != (tt.want == http.StatusOK) {
+				t.Fatalf("handler reached = %t with status %d", reached, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/mdns"
+)
+
+// mdnsServiceType is the DNS-SD service type the service is advertised as
+const mdnsServiceType = "_webform-sync._tcp"
+
+// Discovery is the body of GET /discovery: what a client that found the
+// service on the network needs before it can use it
+type Discovery struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// APIs are the API base paths, newest last
+	APIs []string `json:"apis"`
+	// Auth is how to authenticate: token, basic or none
+	Auth string `json:"auth"`
+	TLS  bool   `json:"tls"`
+	// TenantHeader selects a tenant, when there are several
+	TenantHeader string `json:"tenantHeader,omitempty"`
+	// Capabilities are the optional features turned on
+	Capabilities []string `json:"capabilities"`
+}
+
+// Capabilities is the body of GET /capabilities: which optional features
+// the operator has turned on, so clients can adapt rather than probe for
+// endpoints that may be missing
+type Capabilities struct {
+	// Features maps each name of the config's features section, plus
+	// storage_sync and webdav, to whether it is on
+	Features map[string]bool `json:"features"`
+	// Deprecations are the routes due to be removed
+	Deprecations []Deprecation `json:"deprecations"`
+}
+
+// instanceName is the name the service is advertised under
+func (s *Server) instanceName() string {
+	if name := s.config.Discovery.InstanceName; name != "" {
+		return name
+	}
+	return "Webform Sync on " + shortHostname()
+}
+
+// shortHostname is the machine's name without its domain
+func shortHostname() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "localhost"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	return host
+}
+
+// discovery describes the service
+func (s *Server) discovery() Discovery {
+	d := Discovery{
+		Name:         s.instanceName(),
+		Version:      "1.0.0",
+		APIs:         []string{"/api/v1", "/api/v2"},
+		Auth:         "none",
+		TLS:          s.config.Server.TLS.Enabled,
+		Capabilities: []string{"presets", "scopes", "devices", "groups", "users"},
+	}
+	for _, feature := range []struct{ name, capability string }{
+		{config.FeatureShareLinks, "share-links"},
+		{config.FeatureExport, "export"},
+		{config.FeatureImport, "import"},
+		{config.FeatureGraphQL, "graphql"},
+	} {
+		if s.config.FeatureEnabled(feature.name) {
+			d.Capabilities = append(d.Capabilities, feature.capability)
+		}
+	}
+	if s.config.Authentication.Enabled {
+		d.Auth = s.config.Authentication.Type
+	}
+	if s.config.Tenancy.Enabled {
+		d.TenantHeader = s.config.Tenancy.Header
+	}
+	if s.config.StorageSync.Enabled {
+		d.Capabilities = append(d.Capabilities, "storage-sync")
+	}
+	if s.config.WebDAV.Enabled {
+		d.Capabilities = append(d.Capabilities, "webdav")
+	}
+	if len(s.config.Webhooks.Endpoints) > 0 && s.config.FeatureEnabled(config.FeatureWebhooks) {
+		d.Capabilities = append(d.Capabilities, "webhooks")
+	}
+	return d
+}
+
+// Describe the service to clients on the network
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	s.respondSuccess(w, s.discovery(), "Service description")
+}
+
+// Report which optional features are on
+func (s *Server) handleGetCapabilities(w http.ResponseWriter, r *http.Request) {
+	s.respondSuccess(w, Capabilities{Features: s.features(), Deprecations: s.deprecations()}, "")
+}
+
+// features maps each optional feature to whether it is on
+func (s *Server) features() map[string]bool {
+	features := map[string]bool{
+		"storage_sync": s.config.StorageSync.Enabled,
+		"webdav":       s.config.WebDAV.Enabled,
+	}
+	for _, name := range config.Features {
+		features[name] = s.config.FeatureEnabled(name)
+	}
+	return features
+}
+
+// advertise announces the service over mDNS until the server stops. It
+// does nothing when the service can't be reached from the network.
+func (s *Server) advertise(listener net.Listener) {
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		s.logger.Info("Not advertising over mDNS: the service listens on a socket")
+		return
+	}
+	if addr.IP.IsLoopback() {
+		s.logger.Info("Not advertising over mDNS: the service listens only on %s", addr.IP)
+		return
+	}
+
+	var ifaces []net.Interface
+	for _, name := range s.config.Discovery.Interfaces {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			s.logger.Warn("Not advertising over mDNS on %s: %v", name, err)
+			continue
+		}
+		ifaces = append(ifaces, *ifi)
+	}
+	if len(s.config.Discovery.Interfaces) > 0 && len(ifaces) == 0 {
+		return
+	}
+
+	d := s.discovery()
+	txt := []string{
+		"txtvers=1",
+		"version=" + d.Version,
+		"path=/api/v1",
+		"discovery=/api/v1/discovery",
+		"auth=" + d.Auth,
+	}
+	if d.TLS {
+		txt = append(txt, "tls=1")
+	}
+	responder, err := mdns.Listen(mdns.Service{
+		Instance: d.Name,
+		Type:     mdnsServiceType,
+		Host:     shortHostname(),
+		Port:     addr.Port,
+		TXT:      txt,
+	}, ifaces)
+	if err != nil {
+		s.logger.Warn("Not advertising over mDNS: %v", err)
+		return
+	}
+	s.logger.Info("Advertising %q over mDNS as %s", d.Name, mdnsServiceType)
+	s.runJob(func() { responder.Serve(s.stop) })
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// presetsETag computes a weak ETag from the ID, version and update time of
+// each preset, so any content change (or added/removed preset) changes the tag
+func presetsETag(presets ...*storage.Preset) string {
+	h := sha256.New()
+	for _, p := range presets {
+		fmt.Fprintf(h, "%s:%d:%d;", p.ID, p.Version, p.UpdatedAt.UnixNano())
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// checkNotModified sets the validator and caching headers and, if the
+// request's If-None-Match (or, without one, If-Modified-Since) matches,
+// writes a 304 response. Returns true when the response is done.
+//
+// lastModified is zero for lists: their newest updated_at doesn't move when
+// a preset is deleted, so only the ETag can validate them.
+func (s *Server) checkNotModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", s.config.Performance.Cache.ClientMaxAgeSeconds))
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if !notModified(r, etag, lastModified) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// notModified evaluates the request's conditional headers. If-None-Match
+// takes precedence over If-Modified-Since, as RFC 9110 requires.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag)
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || lastModified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	// HTTP dates have one-second resolution
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// etagMatches performs weak comparison of an If-None-Match header value
+func etagMatches(header, etag string) bool {
+	want := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/events"
+	"github.com/tezza1971/webform-sync/internal/logger"
+	"github.com/tezza1971/webform-sync/internal/notify"
+	"github.com/tezza1971/webform-sync/internal/storage"
+	"github.com/tezza1971/webform-sync/internal/webhook"
+)
+
+// newEventBus creates the event bus for one server instance with every
+// configured sink attached
+func newEventBus(cfg *config.Config, tenant string, store *storage.Storage, log *logger.Logger) *events.Bus {
+	log = log.Module("sync")
+	var sinks []events.Sink
+	if cfg.FeatureEnabled(config.FeatureWebhooks) {
+		sinks = webhook.NewSinks(cfg.Webhooks, store, log)
+	}
+	if mqtt := notify.NewMQTT(cfg.Notifications.MQTT); mqtt != nil {
+		sinks = append(sinks, mqtt)
+	}
+	if ntfy := notify.NewNtfy(cfg.Notifications.Ntfy); ntfy != nil {
+		sinks = append(sinks, ntfy)
+	}
+	if gotify := notify.NewGotify(cfg.Notifications.Gotify); gotify != nil {
+		sinks = append(sinks, gotify)
+	}
+	if pushover := notify.NewPushover(cfg.Notifications.Pushover); pushover != nil {
+		sinks = append(sinks, pushover)
+	}
+	if email, err := notify.NewEmail(cfg.Notifications.Email); err != nil {
+		log.Error("Email notifications are off: %v", err)
+	} else if email != nil {
+		sinks = append(sinks, email)
+	}
+	for _, p := range cfg.Notifications.Plugins {
+		sink, err := notify.NewPlugin(p)
+		if err != nil {
+			log.Error("Notifier %s is off: %v", p.Name, err)
+			continue
+		}
+		sinks = append(sinks, sink)
+	}
+	return events.NewBus(tenant, log, sinks...)
+}
+
+// presetEventData is the event payload for preset events. Field values
+// are left out so no sink ever sees form data.
+type presetEventData struct {
+	ID         string `json:"id"`
+	Name       string `json:"name,omitempty"`
+	ScopeType  string `json:"scopeType,omitempty"`
+	ScopeValue string `json:"scopeValue,omitempty"`
+	DeviceID   string `json:"deviceId"`
+	Version    int    `json:"version,omitempty"`
+}
+
+// publishPresetSaved publishes preset.created for a first save and
+// preset.updated afterwards. Saves that only changed metadata publish
+// nothing, as other devices needn't sync them.
+func (s *Server) publishPresetSaved(p *storage.Preset) {
+	if p.StatsOnly {
+		return
+	}
+	eventType := events.PresetUpdated
+	if p.Version <= 1 {
+		eventType = events.PresetCreated
+	}
+	s.events.Publish(eventType, presetEventData{
+		ID:         p.ID,
+		Name:       p.Name,
+		ScopeType:  p.ScopeType,
+		ScopeValue: p.ScopeValue,
+		DeviceID:   p.DeviceID,
+		Version:    p.Version,
+	})
+}
+
+// publishPresetDeleted publishes preset.deleted
+func (s *Server) publishPresetDeleted(id, deviceID string) {
+	s.events.Publish(events.PresetDeleted, presetEventData{ID: id, DeviceID: deviceID})
+}
+
+// publishCacheInvalidations publishes cache.invalidated on bus whenever
+// store's preset lists go stale, if performance.cache.publish_invalidations
+// is on. The bus carries over config reloads, so it is wired up once.
+func publishCacheInvalidations(cfg *config.Config, store *storage.Storage, bus *events.Bus) {
+	if !cfg.Performance.Cache.PublishInvalidations {
+		return
+	}
+	store.OnCacheInvalidated(func(inv storage.CacheInvalidation) {
+		bus.Publish(events.CacheInvalidated, inv)
+	})
+}
+
+// publishDevice publishes a device event
+func (s *Server) publishDevice(eventType string, d *storage.Device) {
+	s.events.Publish(eventType, d)
+}
+
+// syncEventData is the event payload for sync events, which report a
+// batch of presets by count
+type syncEventData struct {
+	Count int `json:"count"`
+	// DeviceID is the device imported to, or transferred from
+	DeviceID string `json:"deviceId,omitempty"`
+	// ToDeviceID is the device transferred to
+	ToDeviceID string `json:"toDeviceId,omitempty"`
+	// Format is the import format
+	Format string `json:"format,omitempty"`
+	// Counts break the batch down by outcome
+	Counts map[string]int `json:"counts,omitempty"`
+}
+
+// publishSync publishes a sync event, unless the batch changed nothing
+func (s *Server) publishSync(eventType string, data syncEventData) {
+	if data.Count > 0 {
+		s.events.Publish(eventType, data)
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/archive"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// ExportFormatVersion is bumped when the export layout changes incompatibly
+const ExportFormatVersion = 1
+
+// exportCSVHeader is the column layout of CSV exports (and CSV imports)
+var exportCSVHeader = []string{
+	"id", "name", "scopeType", "scopeValue", "deviceId", "encrypted",
+	"fields", "encryptedFields", "metadata", "createdAt", "updatedAt",
+	"lastUsed", "useCount", "version",
+}
+
+// exportContentTypes maps export formats to their MIME types
+var exportContentTypes = map[string]string{
+	"json":   "application/json",
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv",
+}
+
+// presetExporter writes presets in one export format
+type presetExporter interface {
+	Begin() error
+	Write(p *storage.Preset) error
+	End() error
+}
+
+// newPresetExporter creates an exporter for the given format
+func newPresetExporter(format string, w io.Writer, deviceID string) (presetExporter, error) {
+	switch format {
+	case "json":
+		return &jsonExporter{w: w, deviceID: deviceID}, nil
+	case "ndjson":
+		return &ndjsonExporter{enc: json.NewEncoder(w)}, nil
+	case "csv":
+		return &csvExporter{w: csv.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported export format: %s", format)
+	}
+}
+
+// jsonExporter writes {"formatVersion":..,"presets":[...]} incrementally
+type jsonExporter struct {
+	w        io.Writer
+	deviceID string
+	count    int
+}
+
+func (e *jsonExporter) Begin() error {
+	header, err := json.Marshal(map[string]interface{}{
+		"formatVersion": ExportFormatVersion,
+		"exportedAt":    time.Now(),
+		"deviceId":      e.deviceID,
+	})
+	if err != nil {
+		return err
+	}
+	// Re-open the header object to append the presets array
+	_, err = fmt.Fprintf(e.w, "%s,\"presets\":[", header[:len(header)-1])
+	return err
+}
+
+func (e *jsonExporter) Write(p *storage.Preset) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if e.count > 0 {
+		if _, err := io.WriteString(e.w, ","); err != nil {
+			return err
+		}
+	}
+	e.count++
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *jsonExporter) End() error {
+	_, err := io.WriteString(e.w, "]}\n")
+	return err
+}
+
+// ndjsonExporter writes one preset per line
+type ndjsonExporter struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonExporter) Begin() error                  { return nil }
+func (e *ndjsonExporter) Write(p *storage.Preset) error { return e.enc.Encode(p) }
+func (e *ndjsonExporter) End() error                    { return nil }
+
+// csvExporter writes a header row and one row per preset, with nested
+// values (fields, metadata) as JSON strings
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (e *csvExporter) Begin() error {
+	return e.w.Write(exportCSVHeader)
+}
+
+func (e *csvExporter) Write(p *storage.Preset) error {
+	fieldsJSON := ""
+	if p.Fields != nil {
+		data, err := json.Marshal(p.Fields)
+		if err != nil {
+			return err
+		}
+		fieldsJSON = string(data)
+	}
+	metadataJSON := ""
+	if p.Metadata != nil {
+		data, err := json.Marshal(p.Metadata)
+		if err != nil {
+			return err
+		}
+		metadataJSON = string(data)
+	}
+	// Opaque client-encrypted payloads don't decode into fields
+	encryptedFields := ""
+	if p.Fields == nil {
+		encryptedFields = p.EncryptedFields
+	}
+	lastUsed := ""
+	if p.LastUsed != nil {
+		lastUsed = p.LastUsed.Format(time.RFC3339Nano)
+	}
+
+	return e.w.Write([]string{
+		p.ID, p.Name, p.ScopeType, p.ScopeValue, p.DeviceID,
+		strconv.FormatBool(p.Encrypted), fieldsJSON, encryptedFields, metadataJSON,
+		p.CreatedAt.Format(time.RFC3339Nano), p.UpdatedAt.Format(time.RFC3339Nano),
+		lastUsed, strconv.Itoa(p.UseCount), strconv.Itoa(p.Version),
+	})
+}
+
+func (e *csvExporter) End() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// Stream a complete export of a device's (or all) presets
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		s.respondError(w, http.StatusBadRequest, "format must be json, ndjson, or csv")
+		return
+	}
+
+	deviceID := r.URL.Query().Get("device_id")
+	passphrase := r.Header.Get("X-Export-Passphrase")
+	if !s.requireDeviceScope(w, r, deviceID) {
+		return
+	}
+
+	filename := fmt.Sprintf("webform-presets-%s.%s", time.Now().Format("20060102-150405"), format)
+	if passphrase != "" {
+		filename += ".enc"
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	buffered := bufio.NewWriter(w)
+	var out io.Writer = buffered
+	var encrypted io.WriteCloser
+	if passphrase != "" {
+		enc, err := archive.NewEncryptWriter(buffered, passphrase)
+		if err != nil {
+			s.log(r).Error("Failed to start encrypted export: %v", err)
+			s.respondError(w, http.StatusInternalServerError, "Failed to export presets")
+			return
+		}
+		encrypted = enc
+		out = enc
+	}
+
+	exporter, err := newPresetExporter(format, out, deviceID)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Headers are committed once streaming starts, so later failures can
+	// only be logged and surface to the client as a truncated body
+	count := 0
+	err = exporter.Begin()
+	if err == nil {
+		err = s.storage.ForEachPreset(r.Context(), deviceID, func(p *storage.Preset) error {
+			count++
+			return exporter.Write(p)
+		})
+	}
+	if err == nil {
+		err = exporter.End()
+	}
+	if err == nil && encrypted != nil {
+		err = encrypted.Close()
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		s.log(r).Error("Export failed after %d presets: %v", count, err)
+		return
+	}
+
+	s.log(r).Info("Exported %d presets (format: %s, device: %s, encrypted: %t)", count, format, deviceID, passphrase != "")
+}
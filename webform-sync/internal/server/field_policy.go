@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// fieldPolicy is the compiled field_policy config
+type fieldPolicy struct {
+	action    string
+	fields    []*regexp.Regexp
+	overrides []fieldPolicyOverride
+}
+
+type fieldPolicyOverride struct {
+	scope  *regexp.Regexp
+	action string
+	allow  []*regexp.Regexp
+}
+
+// fieldNameSeparators are ignored when matching field names
+var fieldNameSeparators = strings.NewReplacer("-", "", "_", "", ".", "", " ", "")
+
+// normalizeFieldName lowercases a field name and drops separators, so
+// card_number, card-number and cardNumber are the same name
+func normalizeFieldName(name string) string {
+	return fieldNameSeparators.Replace(strings.ToLower(name))
+}
+
+// globPattern compiles a pattern where * matches anything
+func globPattern(glob string) *regexp.Regexp {
+	escaped := strings.ReplaceAll(regexp.QuoteMeta(glob), "\\*", ".*")
+	return regexp.MustCompile("^" + escaped + "$")
+}
+
+// fieldPatterns compiles field name patterns, normalised like the names
+func fieldPatterns(globs []string) []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, 0, len(globs))
+	for _, glob := range globs {
+		patterns = append(patterns, globPattern(normalizeFieldName(glob)))
+	}
+	return patterns
+}
+
+func newFieldPolicy(cfg config.FieldPolicyConfig) *fieldPolicy {
+	p := &fieldPolicy{action: cfg.Action, fields: fieldPatterns(cfg.Fields)}
+	for _, o := range cfg.Overrides {
+		action := o.Action
+		if action == "" {
+			action = cfg.Action
+		}
+		p.overrides = append(p.overrides, fieldPolicyOverride{
+			scope:  globPattern(strings.ToLower(o.Scope)),
+			action: action,
+			allow:  fieldPatterns(o.Allow),
+		})
+	}
+	return p
+}
+
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, p := range patterns {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// names reports whether the policy's patterns match a field name, whatever
+// a scope allows
+func (p *fieldPolicy) names(field string) bool {
+	return p != nil && matchesAny(p.fields, normalizeFieldName(field))
+}
+
+// apply finds the sensitive fields of a preset, in name order, and the
+// action for its scope. Stripped fields are removed from the preset.
+func (p *fieldPolicy) apply(preset *storage.Preset) (sensitive []string, action string) {
+	action = p.action
+	var allow []*regexp.Regexp
+	scope := strings.ToLower(preset.ScopeValue)
+	for _, o := range p.overrides {
+		if o.scope.MatchString(scope) {
+			action, allow = o.action, o.allow
+			break
+		}
+	}
+	if action == "off" {
+		return nil, action
+	}
+
+	for name := range preset.Fields {
+		normalized := normalizeFieldName(name)
+		if matchesAny(p.fields, normalized) && !matchesAny(allow, normalized) {
+			sensitive = append(sensitive, name)
+		}
+	}
+	sort.Strings(sensitive)
+
+	if action == "strip" {
+		for _, name := range sensitive {
+			delete(preset.Fields, name)
+		}
+	}
+	return sensitive, action
+}
+
+// checkFieldPolicy applies the sensitive field policy to a preset about to
+// be saved, stripping fields or returning an error that names them, with the
+// status to respond with. Fields the scope's policy never stores are dropped
+// first. Presets encrypted by their device are refused when the
+// e2e_encryption feature is off.
+func (s *Server) checkFieldPolicy(r *http.Request, preset *storage.Preset) (int, error) {
+	if preset.Encrypted && !s.config.FeatureEnabled(config.FeatureE2EEncryption) {
+		return http.StatusUnprocessableEntity, errors.New("presets encrypted by the client are not accepted by this server")
+	}
+	dropped, err := s.applyNeverStore(r.Context(), preset)
+	if err != nil {
+		s.log(r).Error("Failed to get scope policy: %v", err)
+		return http.StatusInternalServerError, errors.New("failed to check scope policy")
+	}
+	if len(dropped) > 0 {
+		sort.Strings(dropped)
+		s.log(r).Info("Dropped fields of preset %q its scope policy never stores: %s", preset.Name, strings.Join(dropped, ", "))
+	}
+
+	if s.fieldPolicy == nil {
+		return 0, nil
+	}
+	sensitive, action := s.fieldPolicy.apply(preset)
+	if len(sensitive) == 0 {
+		return 0, nil
+	}
+	if action == "strip" {
+		s.log(r).Warn("Stripped sensitive fields from preset %q: %s", preset.Name, strings.Join(sensitive, ", "))
+		return 0, nil
+	}
+	s.log(r).Warn("Preset %q rejected for sensitive fields: %s", preset.Name, strings.Join(sensitive, ", "))
+	return http.StatusUnprocessableEntity, fmt.Errorf("sensitive fields not allowed: %s", strings.Join(sensitive, ", "))
+}
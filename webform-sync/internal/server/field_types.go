@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// fieldTypesMetadataKey is the preset metadata key declaring the types of
+// its fields, by field name
+const fieldTypesMetadataKey = "fieldTypes"
+
+// Field types, named after the HTML input types they validate like
+const (
+	fieldTypeText     = "text"
+	fieldTypeEmail    = "email"
+	fieldTypeDate     = "date"
+	fieldTypeNumber   = "number"
+	fieldTypeSelect   = "select"
+	fieldTypeCheckbox = "checkbox"
+)
+
+var fieldTypes = []string{fieldTypeText, fieldTypeEmail, fieldTypeDate, fieldTypeNumber, fieldTypeSelect, fieldTypeCheckbox}
+
+// fieldType is the declared type of one field
+type fieldType struct {
+	Type string `json:"type"`
+	// Options are the choices of a select field
+	Options []string `json:"options,omitempty"`
+}
+
+// foldTypedFields moves a preset's typed fields into its fields and field
+// type declarations
+func foldTypedFields(preset *storage.Preset, declared map[string]fieldType) error {
+	if preset.Encrypted && len(preset.TypedFields) > 0 {
+		return errors.New("typedFields can't be sent with encrypted fields")
+	}
+	for i, f := range preset.TypedFields {
+		if f.Name == "" {
+			return fmt.Errorf("typedFields[%d] needs a name", i)
+		}
+		if preset.Fields == nil {
+			preset.Fields = make(map[string]interface{})
+		}
+		preset.Fields[f.Name] = f.Value
+		declared[f.Name] = fieldType{Type: f.Type, Options: f.Options}
+	}
+	preset.TypedFields = nil
+	return nil
+}
+
+// declaredFieldTypes reads the field types from a preset's metadata
+func declaredFieldTypes(preset *storage.Preset) (map[string]fieldType, error) {
+	declared := make(map[string]fieldType)
+	raw, ok := preset.Metadata[fieldTypesMetadataKey]
+	if !ok || raw == nil {
+		return declared, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &declared); err != nil {
+		return nil, errors.New("metadata.fieldTypes must map field names to {type, options}")
+	}
+	return declared, nil
+}
+
+// checkFieldType checks a declaration is one the server can validate
+func checkFieldType(name string, t fieldType) error {
+	if !slices.Contains(fieldTypes, t.Type) {
+		return fmt.Errorf("field %q has unknown type %q; use one of %s", name, t.Type, strings.Join(fieldTypes, ", "))
+	}
+	if t.Type == fieldTypeSelect && len(t.Options) == 0 {
+		return fmt.Errorf("select field %q needs options", name)
+	}
+	if t.Type != fieldTypeSelect && len(t.Options) > 0 {
+		return fmt.Errorf("field %q has options but is not a select", name)
+	}
+	return nil
+}
+
+// validFieldValue reports why a value doesn't suit its field's type, or
+// returns nil. Null and, except for checkboxes, empty strings are blank
+// fields, which any type allows.
+func validFieldValue(t fieldType, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	if s, ok := value.(string); ok && s == "" && t.Type != fieldTypeCheckbox {
+		return nil
+	}
+
+	switch t.Type {
+	case fieldTypeText:
+		if _, ok := value.(string); !ok {
+			return errors.New("must be a string")
+		}
+	case fieldTypeEmail:
+		s, ok := value.(string)
+		if !ok {
+			return errors.New("must be a string")
+		}
+		if addr, err := mail.ParseAddress(s); err != nil || addr.Address != s {
+			return errors.New("is not an email address")
+		}
+	case fieldTypeDate:
+		s, ok := value.(string)
+		if !ok {
+			return errors.New("must be a string")
+		}
+		if _, err := time.Parse("2006-01-02", s); err != nil {
+			return errors.New("is not a YYYY-MM-DD date")
+		}
+	case fieldTypeNumber:
+		switch v := value.(type) {
+		case float64:
+		case string:
+			if _, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+				return errors.New("is not a number")
+			}
+		default:
+			return errors.New("is not a number")
+		}
+	case fieldTypeSelect:
+		// A multiple select holds a list of options
+		var chosen []interface{}
+		if list, ok := value.([]interface{}); ok {
+			chosen = list
+		} else {
+			chosen = []interface{}{value}
+		}
+		for _, c := range chosen {
+			s, ok := c.(string)
+			if !ok || !slices.Contains(t.Options, s) {
+				return fmt.Errorf("must be one of %s", strings.Join(t.Options, ", "))
+			}
+		}
+	case fieldTypeCheckbox:
+		if _, ok := value.(bool); !ok {
+			return errors.New("must be true or false")
+		}
+	}
+	return nil
+}
+
+// checkFieldTypes folds a preset's typed fields into it and validates its
+// field values against the types declared in metadata.fieldTypes. Fields
+// without a declared type aren't checked, nor are encrypted presets'
+// values, which the server can't read. A refusal comes with the status to
+// respond with.
+func checkFieldTypes(preset *storage.Preset) (int, error) {
+	declared, err := declaredFieldTypes(preset)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := foldTypedFields(preset, declared); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if len(declared) == 0 {
+		delete(preset.Metadata, fieldTypesMetadataKey)
+		return 0, nil
+	}
+
+	names := make([]string, 0, len(declared))
+	for name := range declared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := checkFieldType(name, declared[name]); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	if !preset.Encrypted {
+		for _, name := range names {
+			if err := validFieldValue(declared[name], preset.Fields[name]); err != nil {
+				return http.StatusUnprocessableEntity, fmt.Errorf("field %q %v", name, err)
+			}
+		}
+	}
+
+	if preset.Metadata == nil {
+		preset.Metadata = make(map[string]interface{})
+	}
+	preset.Metadata[fieldTypesMetadataKey] = declared
+	return 0, nil
+}
@@ -0,0 +1,347 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// Limits on fill failure reports and remaps
+const (
+	maxFillFailureSelectors = 100
+	maxSelectorLength       = 512
+	maxSelectorRemaps       = 100
+)
+
+// FillFailureReport is a fill failure with the presets it affects
+type FillFailureReport struct {
+	*storage.FillFailure
+	// Presets counts the presets in the scope with a field of the selector
+	Presets int `json:"presets"`
+}
+
+// FillFailureRequest is the body of POST /fill-failures
+type FillFailureRequest struct {
+	DeviceID   string `json:"deviceId"`
+	ScopeType  string `json:"scopeType"`
+	ScopeValue string `json:"scopeValue"`
+	// Selectors are the preset field keys that matched nothing on the page
+	Selectors []string `json:"selectors"`
+}
+
+// SelectorRemap is the body of POST /fill-failures/remap
+type SelectorRemap struct {
+	DeviceID   string `json:"deviceId"`
+	ScopeType  string `json:"scopeType"`
+	ScopeValue string `json:"scopeValue"`
+	// Remaps maps old selectors to new ones
+	Remaps map[string]string `json:"remaps"`
+}
+
+// RemapResult reports what a selector remap changed
+type RemapResult struct {
+	Updated []string       `json:"updated"`
+	Skipped []RemapSkipped `json:"skipped"`
+	Cleared int            `json:"cleared"`
+}
+
+// RemapSkipped is a preset a remap left alone, and why
+type RemapSkipped struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// fillFailureScope reads and checks the scope of a fill failure request
+func fillFailureScope(scopeType, scopeValue string) (storage.Scope, error) {
+	switch scopeType {
+	case storage.ScopeTypeURL, storage.ScopeTypeDomain, storage.ScopeTypeWildcard, storage.ScopeTypeRegex:
+		if scopeValue == "" {
+			return storage.Scope{}, fmt.Errorf("scopeValue is required")
+		}
+	case storage.ScopeTypeGlobal:
+		scopeValue = ""
+	default:
+		return storage.Scope{}, fmt.Errorf("scopeType must be url, domain, wildcard, regex or global")
+	}
+	return storage.Scope{Type: scopeType, Value: storage.NormalizeScope(scopeType, scopeValue)}, nil
+}
+
+// Record selectors of a scope's presets that matched nothing on the page
+func (s *Server) handleReportFillFailures(w http.ResponseWriter, r *http.Request) {
+	var body FillFailureRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if body.DeviceID == "" {
+		s.respondError(w, http.StatusBadRequest, "device_id is required")
+		return
+	}
+	if !s.admitDevice(w, r, body.DeviceID) {
+		return
+	}
+	scope, err := fillFailureScope(body.ScopeType, body.ScopeValue)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if scope.Value != "" && !s.urlFilters.isAllowed(scope.Value) {
+		s.log(r).Warn("URL blocked by filter: %s", scope.Value)
+		s.respondError(w, http.StatusForbidden, "URL not allowed")
+		return
+	}
+
+	seen := make(map[string]bool, len(body.Selectors))
+	selectors := make([]string, 0, len(body.Selectors))
+	for _, selector := range body.Selectors {
+		if selector == "" || len(selector) > maxSelectorLength {
+			s.respondError(w, http.StatusBadRequest, fmt.Sprintf("selectors must be 1 to %d bytes", maxSelectorLength))
+			return
+		}
+		if !seen[selector] {
+			seen[selector] = true
+			selectors = append(selectors, selector)
+		}
+	}
+	if len(selectors) == 0 || len(selectors) > maxFillFailureSelectors {
+		s.respondError(w, http.StatusBadRequest, fmt.Sprintf("report 1 to %d selectors", maxFillFailureSelectors))
+		return
+	}
+
+	if err := s.storage.RecordFillFailures(r.Context(), body.DeviceID, scope, selectors); err != nil {
+		s.log(r).Error("Failed to record fill failures: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to record fill failures")
+		return
+	}
+
+	s.log(r).Debug("Fill failures reported for %s %s: %d selectors (device: %s)", scope.Type, scope.Value, len(selectors), body.DeviceID)
+	s.respondSuccess(w, nil, fmt.Sprintf("Recorded %d fill failures", len(selectors)))
+}
+
+// fillFailureFilter reads the filter of a fill failure query, answering
+// the request if it is invalid
+func (s *Server) fillFailureFilter(w http.ResponseWriter, r *http.Request) (storage.FillFailureFilter, bool) {
+	query := r.URL.Query()
+	filter := storage.FillFailureFilter{DeviceID: query.Get("device_id")}
+	if !s.requireDeviceScope(w, r, filter.DeviceID) || !s.authorizeDevice(w, r, filter.DeviceID) {
+		return filter, false
+	}
+	if scopeType := query.Get("scope_type"); scopeType != "" {
+		scope, err := fillFailureScope(scopeType, query.Get("scope_value"))
+		if err != nil {
+			s.respondError(w, http.StatusBadRequest, err.Error())
+			return filter, false
+		}
+		filter.ScopeType, filter.ScopeValue = scope.Type, scope.Value
+	}
+	return filter, true
+}
+
+// Report the selectors clients failed to fill, most reported first
+func (s *Server) handleGetFillFailures(w http.ResponseWriter, r *http.Request) {
+	filter, ok := s.fillFailureFilter(w, r)
+	if !ok {
+		return
+	}
+
+	failures, err := s.storage.GetFillFailures(r.Context(), filter)
+	if err != nil {
+		s.log(r).Error("Failed to get fill failures: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve fill failures")
+		return
+	}
+
+	var scopes []storage.Scope
+	seen := make(map[storage.Scope]bool)
+	for _, f := range failures {
+		scope := storage.Scope{Type: f.ScopeType, Value: f.ScopeValue}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	presets, err := s.storage.GetPresetsInScopes(r.Context(), scopes, filter.DeviceID)
+	if err != nil {
+		s.log(r).Error("Failed to get presets: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve fill failures")
+		return
+	}
+	type scopedField struct {
+		scope storage.Scope
+		field string
+	}
+	using := make(map[scopedField]int)
+	for _, p := range presets {
+		for field := range p.Fields {
+			using[scopedField{storage.Scope{Type: p.ScopeType, Value: p.ScopeValue}, field}]++
+		}
+	}
+
+	reports := make([]FillFailureReport, 0, len(failures))
+	for _, f := range failures {
+		reports = append(reports, FillFailureReport{
+			FillFailure: f,
+			Presets:     using[scopedField{storage.Scope{Type: f.ScopeType, Value: f.ScopeValue}, f.Selector}],
+		})
+	}
+	s.respondSuccess(w, reports, fmt.Sprintf("Found %d fill failures", len(reports)))
+}
+
+// Dismiss fill failures
+func (s *Server) handleClearFillFailures(w http.ResponseWriter, r *http.Request) {
+	filter, ok := s.fillFailureFilter(w, r)
+	if !ok {
+		return
+	}
+
+	cleared, err := s.storage.ClearFillFailures(r.Context(), filter)
+	if err != nil {
+		s.log(r).Error("Failed to clear fill failures: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to clear fill failures")
+		return
+	}
+	s.respondSuccess(w, map[string]int{"cleared": cleared}, fmt.Sprintf("Cleared %d fill failures", cleared))
+}
+
+// remapPresetFields renames a preset's fields, and their declared types,
+// from old selectors to new ones. It returns whether anything changed, or
+// why the preset can't be remapped.
+func remapPresetFields(preset *storage.Preset, remaps map[string]string) (bool, string) {
+	if preset.Fields == nil {
+		return false, "fields are encrypted"
+	}
+	olds := make([]string, 0, len(remaps))
+	for old := range remaps {
+		if _, ok := preset.Fields[old]; ok {
+			olds = append(olds, old)
+		}
+	}
+	if len(olds) == 0 {
+		return false, ""
+	}
+	sort.Strings(olds)
+	// A field can take the name of one that is itself being renamed
+	for _, old := range olds {
+		target := remaps[old]
+		_, taken := preset.Fields[target]
+		_, vacated := remaps[target]
+		if taken && !vacated {
+			return false, fmt.Sprintf("field %q already exists", target)
+		}
+	}
+
+	fields := make(map[string]interface{}, len(preset.Fields))
+	for name, value := range preset.Fields {
+		if _, moved := remaps[name]; !moved {
+			fields[name] = value
+		}
+	}
+	for _, old := range olds {
+		fields[remaps[old]] = preset.Fields[old]
+	}
+	preset.Fields = fields
+
+	if declared, ok := preset.Metadata[fieldTypesMetadataKey].(map[string]interface{}); ok {
+		types := make(map[string]interface{}, len(declared))
+		for name, t := range declared {
+			if _, moved := remaps[name]; !moved {
+				types[name] = t
+			}
+		}
+		for old, t := range declared {
+			if renamed, moved := remaps[old]; moved {
+				types[renamed] = t
+			}
+		}
+		preset.Metadata[fieldTypesMetadataKey] = types
+	}
+	return true, ""
+}
+
+// Rename fields of a scope's presets after a site changed its form, and
+// dismiss the fill failures of the old selectors once no preset is left
+// with them
+func (s *Server) handleRemapSelectors(w http.ResponseWriter, r *http.Request) {
+	var body SelectorRemap
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if !s.requireDeviceScope(w, r, body.DeviceID) || !s.admitDevice(w, r, body.DeviceID) {
+		return
+	}
+	scope, err := fillFailureScope(body.ScopeType, body.ScopeValue)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(body.Remaps) == 0 || len(body.Remaps) > maxSelectorRemaps {
+		s.respondError(w, http.StatusBadRequest, fmt.Sprintf("remaps must have 1 to %d entries", maxSelectorRemaps))
+		return
+	}
+	targets := make(map[string]bool, len(body.Remaps))
+	olds := make([]string, 0, len(body.Remaps))
+	for old, renamed := range body.Remaps {
+		if old == "" || renamed == "" || old == renamed || len(renamed) > maxSelectorLength {
+			s.respondError(w, http.StatusBadRequest, fmt.Sprintf("remap %q to a different selector of up to %d bytes", old, maxSelectorLength))
+			return
+		}
+		if targets[renamed] {
+			s.respondError(w, http.StatusBadRequest, fmt.Sprintf("more than one selector is remapped to %q", renamed))
+			return
+		}
+		targets[renamed] = true
+		olds = append(olds, old)
+	}
+
+	presets, err := s.storage.GetPresetsInScopes(r.Context(), []storage.Scope{scope}, body.DeviceID)
+	if err == nil {
+		err = s.annotateAccess(r.Context(), body.DeviceID, presets)
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get presets: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to remap selectors")
+		return
+	}
+
+	result := RemapResult{Updated: []string{}, Skipped: []RemapSkipped{}}
+	for _, preset := range presets {
+		if body.DeviceID != "" && !storage.RoleAllows(preset.Access, storage.RoleEditor) {
+			continue
+		}
+		changed, reason := remapPresetFields(preset, body.Remaps)
+		if reason == "" && changed {
+			if _, err := checkFieldTypes(preset); err != nil {
+				reason = err.Error()
+			} else if _, err := s.checkFieldPolicy(r, preset); err != nil {
+				reason = err.Error()
+			} else if err := s.storage.EditPreset(r.Context(), preset); err != nil {
+				s.log(r).Error("Failed to remap preset %s: %v", preset.ID, err)
+				reason = "failed to save preset"
+			}
+		}
+		if reason != "" {
+			result.Skipped = append(result.Skipped, RemapSkipped{ID: preset.ID, Reason: reason})
+			continue
+		}
+		if changed {
+			result.Updated = append(result.Updated, preset.ID)
+			s.publishPresetSaved(preset)
+		}
+	}
+
+	// Failures stay reported while any preset still has the old selectors
+	if len(result.Skipped) == 0 {
+		filter := storage.FillFailureFilter{DeviceID: body.DeviceID, ScopeType: scope.Type, ScopeValue: scope.Value}
+		if result.Cleared, err = s.storage.ClearFillFailures(r.Context(), filter, olds...); err != nil {
+			s.log(r).Error("Failed to clear fill failures: %v", err)
+		}
+	}
+
+	s.log(r).Info("Remapped %d selectors in %s %s: %d presets updated, %d skipped",
+		len(body.Remaps), scope.Type, scope.Value, len(result.Updated), len(result.Skipped))
+	s.respondSuccess(w, result, fmt.Sprintf("Updated %d presets", len(result.Updated)))
+}
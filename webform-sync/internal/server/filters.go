@@ -0,0 +1,332 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// Filter entry types and lists
+const (
+	filterTypeURL       = "url"
+	filterTypeIP        = "ip"
+	filterListWhitelist = "whitelist"
+	filterListBlacklist = "blacklist"
+)
+
+// FilterPattern is an entry on a whitelist or blacklist. Source is "file"
+// or "config" for entries from the filter files or webform-sync.yml, which
+// can only be changed there, and "api" for entries added at runtime.
+type FilterPattern struct {
+	ID      string `json:"id,omitempty"`
+	Pattern string `json:"pattern"`
+	Source  string `json:"source"`
+}
+
+// URLFilterLists are the URL filter settings and lists
+type URLFilterLists struct {
+	Enabled   bool            `json:"enabled"`
+	UseRegex  bool            `json:"useRegex"`
+	Whitelist []FilterPattern `json:"whitelist"`
+	Blacklist []FilterPattern `json:"blacklist"`
+}
+
+// IPFilterLists are the access control mode and lists
+type IPFilterLists struct {
+	Mode      string          `json:"mode"`
+	Whitelist []FilterPattern `json:"whitelist"`
+	Blacklist []FilterPattern `json:"blacklist"`
+}
+
+// FilterLists is the body of GET /admin/filters
+type FilterLists struct {
+	URL URLFilterLists `json:"url"`
+	IP  IPFilterLists  `json:"ip"`
+}
+
+// FilterEntryRequest is the body of POST /admin/filters
+type FilterEntryRequest struct {
+	// Type is url or ip
+	Type string `json:"type"`
+	// List is whitelist or blacklist
+	List string `json:"list"`
+	// Pattern is a URL pattern in the filter file syntax, or an IP address
+	// or CIDR range
+	Pattern string `json:"pattern"`
+}
+
+// filterAdminOnly restricts a handler to the service's own administrator,
+// since every tenant shares the filters
+func (s *Server) filterAdminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return s.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		if s.tenant != "" {
+			s.respondError(w, http.StatusForbidden, "Filters can only be changed by the service administrator")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// List the URL and IP filters in force
+func (s *Server) handleGetFilters(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.storage.GetFilterEntries(r.Context())
+	if err != nil {
+		s.log(r).Error("Failed to get filter entries: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to get filters")
+		return
+	}
+
+	urlCfg, ipCfg := s.config.URLFilter, s.config.AccessControl
+	lists := FilterLists{
+		URL: URLFilterLists{
+			Enabled:   urlCfg.Enabled,
+			UseRegex:  urlCfg.UseRegex,
+			Whitelist: filterFilePatterns(urlCfg.WhitelistFile),
+			Blacklist: filterFilePatterns(urlCfg.BlacklistFile),
+		},
+		IP: IPFilterLists{
+			Mode:      ipCfg.Mode,
+			Whitelist: configPatterns(ipCfg.Whitelist),
+			Blacklist: configPatterns(ipCfg.Blacklist),
+		},
+	}
+	for _, e := range entries {
+		p := FilterPattern{ID: e.ID, Pattern: e.Pattern, Source: "api"}
+		switch {
+		case e.Type == filterTypeURL && e.List == filterListWhitelist:
+			lists.URL.Whitelist = append(lists.URL.Whitelist, p)
+		case e.Type == filterTypeURL:
+			lists.URL.Blacklist = append(lists.URL.Blacklist, p)
+		case e.List == filterListWhitelist:
+			lists.IP.Whitelist = append(lists.IP.Whitelist, p)
+		default:
+			lists.IP.Blacklist = append(lists.IP.Blacklist, p)
+		}
+	}
+
+	s.respondSuccess(w, lists, "")
+}
+
+// filterFilePatterns lists the patterns in a filter file; an unreadable
+// file lists none, as it does when the filters are loaded
+func filterFilePatterns(path string) []FilterPattern {
+	patterns := []FilterPattern{}
+	if path == "" {
+		return patterns
+	}
+	lines, _ := readFilterFile(path)
+	for _, line := range lines {
+		patterns = append(patterns, FilterPattern{Pattern: line, Source: "file"})
+	}
+	return patterns
+}
+
+func configPatterns(entries []string) []FilterPattern {
+	patterns := []FilterPattern{}
+	for _, entry := range entries {
+		patterns = append(patterns, FilterPattern{Pattern: entry, Source: "config"})
+	}
+	return patterns
+}
+
+// Add a URL pattern or IP range to a whitelist or blacklist. It is stored
+// in the database and applies straight away.
+func (s *Server) handleAddFilterEntry(w http.ResponseWriter, r *http.Request) {
+	var req FilterEntryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	req.Pattern = strings.TrimSpace(req.Pattern)
+
+	if req.List != filterListWhitelist && req.List != filterListBlacklist {
+		s.respondError(w, http.StatusBadRequest, "list must be whitelist or blacklist")
+		return
+	}
+	if req.Pattern == "" {
+		s.respondError(w, http.StatusBadRequest, "pattern is required")
+		return
+	}
+	switch req.Type {
+	case filterTypeURL:
+		if _, err := compileFilterPattern(req.Pattern, s.config.URLFilter.UseRegex); err != nil {
+			s.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	case filterTypeIP:
+		if len(parseCIDRs([]string{req.Pattern})) == 0 {
+			s.respondError(w, http.StatusBadRequest, fmt.Sprintf("invalid IP address or CIDR range '%s'", req.Pattern))
+			return
+		}
+	default:
+		s.respondError(w, http.StatusBadRequest, "type must be url or ip")
+		return
+	}
+
+	entry, err := s.storage.AddFilterEntry(r.Context(), req.Type, req.List, req.Pattern)
+	if err != nil {
+		if errors.Is(err, storage.ErrFilterEntryExists) {
+			s.respondError(w, http.StatusConflict, "Pattern is already on the list")
+			return
+		}
+		s.log(r).Error("Failed to add filter entry: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to add filter entry")
+		return
+	}
+	if err := s.reloadFilters(); err != nil {
+		s.log(r).Error("Failed to reload filters: %v", err)
+	}
+
+	s.log(r).Warn("Added %s to the %s %s", entry.Pattern, entry.Type, entry.List)
+	s.respondJSON(w, http.StatusCreated, APIResponse{
+		Success: true,
+		Data:    entry,
+		Message: "Filter entry added",
+	})
+}
+
+// Remove a filter entry added through the API
+func (s *Server) handleDeleteFilterEntry(w http.ResponseWriter, r *http.Request) {
+	if err := s.storage.DeleteFilterEntry(r.Context(), mux.Vars(r)["id"]); err != nil {
+		if errors.Is(err, storage.ErrFilterEntryNotFound) {
+			s.respondError(w, http.StatusNotFound, "Filter entry not found")
+			return
+		}
+		s.log(r).Error("Failed to delete filter entry: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to delete filter entry")
+		return
+	}
+	if err := s.reloadFilters(); err != nil {
+		s.log(r).Error("Failed to reload filters: %v", err)
+	}
+
+	s.respondSuccess(w, nil, "Filter entry removed")
+}
+
+// FilterDecision is what a filter decides for a URL or IP address, and why.
+// Match is the entry that decided it, if one did.
+type FilterDecision struct {
+	Allowed bool           `json:"allowed"`
+	Reason  string         `json:"reason"`
+	List    string         `json:"list,omitempty"`
+	Match   *FilterPattern `json:"match,omitempty"`
+}
+
+// FilterCheck is the body of GET /filters/check
+type FilterCheck struct {
+	URL *FilterDecision `json:"url,omitempty"`
+	IP  *FilterDecision `json:"ip,omitempty"`
+}
+
+// matchURL returns the first rule matching url, or nil
+func matchURL(rules []urlRule, url string) *FilterPattern {
+	for _, rule := range rules {
+		if rule.MatchString(url) {
+			return &rule.entry
+		}
+	}
+	return nil
+}
+
+// matchIP returns the first range containing ip, or nil
+func matchIP(rules []ipRule, ip net.IP) *FilterPattern {
+	for _, rule := range rules {
+		if rule.Contains(ip) {
+			return &rule.entry
+		}
+	}
+	return nil
+}
+
+// check decides whether presets may be scoped to url
+func (f *URLFilters) check(url string) FilterDecision {
+	if !f.enabled {
+		return FilterDecision{Allowed: true, Reason: "URL filtering is disabled"}
+	}
+
+	// Check whitelist first if it overrides
+	if f.whitelistOverrides && len(f.whitelist) > 0 {
+		if match := matchURL(f.whitelist, url); match != nil {
+			return FilterDecision{Allowed: true, Reason: "Matched the whitelist", List: filterListWhitelist, Match: match}
+		}
+		// If whitelist exists and nothing matched, deny
+		return FilterDecision{Reason: "Not on the whitelist, which overrides the blacklist"}
+	}
+
+	// Check blacklist
+	if match := matchURL(f.blacklist, url); match != nil {
+		// Check if whitelist overrides this blacklist match
+		if f.whitelistOverrides {
+			if wlMatch := matchURL(f.whitelist, url); wlMatch != nil {
+				return FilterDecision{Allowed: true, Reason: "Matched the whitelist, which overrides the blacklist", List: filterListWhitelist, Match: wlMatch}
+			}
+		}
+		return FilterDecision{Reason: "Matched the blacklist", List: filterListBlacklist, Match: match}
+	}
+
+	// If no whitelist, default allow
+	if len(f.whitelist) == 0 {
+		return FilterDecision{Allowed: true, Reason: "Not on the blacklist"}
+	}
+
+	// Check whitelist
+	if match := matchURL(f.whitelist, url); match != nil {
+		return FilterDecision{Allowed: true, Reason: "Matched the whitelist", List: filterListWhitelist, Match: match}
+	}
+	return FilterDecision{Reason: "Not on the whitelist"}
+}
+
+// check decides whether a client at ipStr may use the API
+func (f *IPFilters) check(ipStr string) FilterDecision {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return FilterDecision{Reason: "Not a valid IP address"}
+	}
+
+	switch f.mode {
+	case "whitelist":
+		if match := matchIP(f.whitelist, ip); match != nil {
+			return FilterDecision{Allowed: true, Reason: "Matched the whitelist", List: filterListWhitelist, Match: match}
+		}
+		return FilterDecision{Reason: "Not on the whitelist"}
+
+	case "blacklist":
+		if match := matchIP(f.blacklist, ip); match != nil {
+			return FilterDecision{Reason: "Matched the blacklist", List: filterListBlacklist, Match: match}
+		}
+		return FilterDecision{Allowed: true, Reason: "Not on the blacklist"}
+
+	case "allow_all":
+		return FilterDecision{Allowed: true, Reason: "Access control mode is allow_all"}
+
+	default:
+		return FilterDecision{Reason: fmt.Sprintf("Unknown access control mode %q", f.mode)}
+	}
+}
+
+// Report what the filters would decide for a URL and/or a client IP,
+// without saving anything, to find out why requests are refused
+func (s *Server) handleCheckFilters(w http.ResponseWriter, r *http.Request) {
+	url, ip := r.URL.Query().Get("url"), r.URL.Query().Get("ip")
+	if url == "" && ip == "" {
+		s.respondError(w, http.StatusBadRequest, "url or ip is required")
+		return
+	}
+
+	var result FilterCheck
+	if url != "" {
+		decision := s.urlFilters.check(url)
+		result.URL = &decision
+	}
+	if ip != "" {
+		decision := s.ipFilters.check(ip)
+		result.IP = &decision
+	}
+	s.respondSuccess(w, result, "")
+}
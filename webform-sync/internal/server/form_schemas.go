@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// maxSchemaFields caps the fields of one form schema
+const maxSchemaFields = 500
+
+// SchemaMatch is a form schema that applies to a page, with how its scope
+// matched
+type SchemaMatch struct {
+	// Level is how the scope matched, as for GET /scopes/resolve
+	Level  string              `json:"level"`
+	Schema *storage.FormSchema `json:"schema"`
+}
+
+// SchemaResolution is the body of GET /schemas
+type SchemaResolution struct {
+	URL     string        `json:"url"`
+	Matches []SchemaMatch `json:"matches"`
+}
+
+// checkFormSchema validates a schema sent by a client
+func checkFormSchema(schema *storage.FormSchema) error {
+	if schema.ScopeType != storage.ScopeTypeURL && schema.ScopeType != storage.ScopeTypeDomain {
+		return errors.New("scopeType must be url or domain")
+	}
+	if schema.ScopeValue == "" {
+		return errors.New("scopeValue is required")
+	}
+	if len(schema.Fields) == 0 {
+		return errors.New("fields are required")
+	}
+	if len(schema.Fields) > maxSchemaFields {
+		return fmt.Errorf("a schema can have at most %d fields", maxSchemaFields)
+	}
+	keys := make(map[string]bool, len(schema.Fields))
+	for i, f := range schema.Fields {
+		if f.Key == "" || f.Selector == "" {
+			return fmt.Errorf("fields[%d] needs a key and a selector", i)
+		}
+		if keys[f.Key] {
+			return fmt.Errorf("field key %q appears twice", f.Key)
+		}
+		keys[f.Key] = true
+	}
+	return nil
+}
+
+// Store the structure of a form, replacing the one captured before for
+// the same scope and form
+func (s *Server) handleSaveFormSchema(w http.ResponseWriter, r *http.Request) {
+	var schema storage.FormSchema
+	if err := json.NewDecoder(r.Body).Decode(&schema); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if schema.DeviceID == "" {
+		s.respondError(w, http.StatusBadRequest, "device_id is required")
+		return
+	}
+	if !s.admitDevice(w, r, schema.DeviceID) {
+		return
+	}
+	if err := checkFormSchema(&schema); err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.urlFilters.isAllowed(schema.ScopeValue) {
+		s.log(r).Warn("URL blocked by filter: %s", schema.ScopeValue)
+		s.respondError(w, http.StatusForbidden, "URL not allowed")
+		return
+	}
+
+	created, err := s.storage.SaveFormSchema(r.Context(), &schema)
+	if err != nil {
+		s.log(r).Error("Failed to save form schema: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to save form schema")
+		return
+	}
+
+	s.log(r).Info("Form schema saved: %s (device: %s)", schema.ID, schema.DeviceID)
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	s.respondJSON(w, status, APIResponse{
+		Success: true,
+		Data:    schema,
+		Message: "Form schema saved successfully",
+	})
+}
+
+// Find the form schemas for a page, most specific scope first
+func (s *Server) handleResolveFormSchemas(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	if !s.requireDeviceScope(w, r, deviceID) || !s.authorizeDevice(w, r, deviceID) {
+		return
+	}
+	u, ok := s.pageURL(w, r)
+	if !ok {
+		return
+	}
+
+	candidates, _ := scopeCandidates(u)
+	scopes := make([]storage.Scope, 0, len(candidates))
+	for _, c := range candidates {
+		if c.scope.Type != storage.ScopeTypeGlobal {
+			scopes = append(scopes, c.scope)
+		}
+	}
+	schemas, err := s.storage.GetFormSchemasInScopes(r.Context(), scopes, deviceID)
+	if err != nil {
+		s.log(r).Error("Failed to get form schemas: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve form schemas")
+		return
+	}
+
+	form, filterForm := r.URL.Query()["form"]
+	byScope := make(map[storage.Scope][]*storage.FormSchema)
+	for _, schema := range schemas {
+		if filterForm && schema.Form != form[0] {
+			continue
+		}
+		scope := storage.Scope{Type: schema.ScopeType, Value: schema.ScopeValue}
+		byScope[scope] = append(byScope[scope], schema)
+	}
+	resolution := SchemaResolution{URL: u.String(), Matches: []SchemaMatch{}}
+	for _, c := range candidates {
+		for _, schema := range byScope[c.scope] {
+			resolution.Matches = append(resolution.Matches, SchemaMatch{Level: c.level, Schema: schema})
+		}
+	}
+
+	s.respondSuccess(w, resolution, fmt.Sprintf("Found %d form schemas", len(resolution.Matches)))
+}
+
+// List the form schemas stored for one scope
+func (s *Server) handleGetFormSchemasByScope(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	scopeType := vars["type"]
+	if scopeType != storage.ScopeTypeURL && scopeType != storage.ScopeTypeDomain {
+		s.respondError(w, http.StatusBadRequest, "scope type must be url or domain")
+		return
+	}
+	deviceID := r.URL.Query().Get("device_id")
+	if !s.requireDeviceScope(w, r, deviceID) || !s.authorizeDevice(w, r, deviceID) {
+		return
+	}
+
+	scope := storage.Scope{Type: scopeType, Value: storage.NormalizeScope(scopeType, vars["value"])}
+	schemas, err := s.storage.GetFormSchemasInScopes(r.Context(), []storage.Scope{scope}, deviceID)
+	if err != nil {
+		s.log(r).Error("Failed to get form schemas: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve form schemas")
+		return
+	}
+
+	s.respondSuccess(w, schemas, "")
+}
+
+// Delete a form schema. Users can only delete their own.
+func (s *Server) handleDeleteFormSchema(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if user := requestUser(r); user != nil {
+		schema, err := s.storage.GetFormSchema(r.Context(), id)
+		if err != nil && !errors.Is(err, storage.ErrFormSchemaNotFound) {
+			s.log(r).Error("Failed to get form schema: %v", err)
+			s.respondError(w, http.StatusInternalServerError, "Failed to delete form schema")
+			return
+		}
+		if err != nil || schema.UserID != user.ID {
+			s.respondError(w, http.StatusNotFound, "Form schema not found")
+			return
+		}
+	}
+
+	if err := s.storage.DeleteFormSchema(r.Context(), id); err != nil {
+		if errors.Is(err, storage.ErrFormSchemaNotFound) {
+			s.respondError(w, http.StatusNotFound, "Form schema not found")
+			return
+		}
+		s.log(r).Error("Failed to delete form schema: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to delete form schema")
+		return
+	}
+
+	s.respondSuccess(w, nil, "Form schema deleted successfully")
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// graphQLRequest is the standard GraphQL-over-HTTP request body
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// jsonScalar passes arbitrary JSON values (form fields, metadata, count maps) through unchanged
+var jsonScalar = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "JSON",
+	Description: "Arbitrary JSON value",
+	Serialize:   func(value interface{}) interface{} { return value },
+	ParseValue:  func(value interface{}) interface{} { return value },
+	ParseLiteral: func(valueAST ast.Value) interface{} {
+		return parseJSONLiteral(valueAST)
+	},
+})
+
+// parseJSONLiteral converts an inline GraphQL literal into a Go value
+func parseJSONLiteral(valueAST ast.Value) interface{} {
+	switch v := valueAST.(type) {
+	case *ast.StringValue:
+		return v.Value
+	case *ast.BooleanValue:
+		return v.Value
+	case *ast.IntValue:
+		return v.Value
+	case *ast.FloatValue:
+		return v.Value
+	case *ast.ListValue:
+		list := make([]interface{}, 0, len(v.Values))
+		for _, item := range v.Values {
+			list = append(list, parseJSONLiteral(item))
+		}
+		return list
+	case *ast.ObjectValue:
+		obj := make(map[string]interface{}, len(v.Fields))
+		for _, field := range v.Fields {
+			obj[field.Name.Value] = parseJSONLiteral(field.Value)
+		}
+		return obj
+	default:
+		return nil
+	}
+}
+
+// syncLogField resolves a key of the map-shaped sync log entries
+func syncLogField(key string) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		if entry, ok := p.Source.(map[string]interface{}); ok {
+			return entry[key], nil
+		}
+		return nil, nil
+	}
+}
+
+// buildGraphQLSchema defines the GraphQL schema over storage
+func (s *Server) buildGraphQLSchema() (graphql.Schema, error) {
+	syncLogType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "SyncLogEntry",
+		Fields: graphql.Fields{
+			"presetId":  &graphql.Field{Type: graphql.String, Resolve: syncLogField("preset_id")},
+			"action":    &graphql.Field{Type: graphql.String, Resolve: syncLogField("action")},
+			"deviceId":  &graphql.Field{Type: graphql.String, Resolve: syncLogField("device_id")},
+			"timestamp": &graphql.Field{Type: graphql.DateTime, Resolve: syncLogField("timestamp")},
+		},
+	})
+
+	presetType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Preset",
+		Fields: graphql.Fields{
+			"id":              &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name":            &graphql.Field{Type: graphql.String},
+			"scopeType":       &graphql.Field{Type: graphql.String},
+			"scopeValue":      &graphql.Field{Type: graphql.String},
+			"fields":          &graphql.Field{Type: jsonScalar},
+			"encryptedFields": &graphql.Field{Type: graphql.String},
+			"encrypted":       &graphql.Field{Type: graphql.Boolean},
+			"createdAt":       &graphql.Field{Type: graphql.DateTime},
+			"updatedAt":       &graphql.Field{Type: graphql.DateTime},
+			"lastUsed":        &graphql.Field{Type: graphql.DateTime},
+			"useCount":        &graphql.Field{Type: graphql.Int},
+			"deviceId":        &graphql.Field{Type: graphql.String},
+			"metadata":        &graphql.Field{Type: jsonScalar},
+			"version":         &graphql.Field{Type: graphql.Int},
+			"syncLog": &graphql.Field{
+				Type: graphql.NewList(syncLogType),
+				Args: graphql.FieldConfigArgument{
+					"limit": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 5},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					preset := p.Source.(*storage.Preset)
+					return s.storage.GetSyncLog(p.Context, preset.ID, p.Args["limit"].(int))
+				},
+			},
+		},
+	})
+
+	deviceType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Device",
+		Fields: graphql.Fields{
+			"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name":      &graphql.Field{Type: graphql.String},
+			"platform":  &graphql.Field{Type: graphql.String},
+			"browser":   &graphql.Field{Type: graphql.String},
+			"createdAt": &graphql.Field{Type: graphql.DateTime},
+			"lastSeen":  &graphql.Field{Type: graphql.DateTime},
+			"revoked": &graphql.Field{
+				Type: graphql.Boolean,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*storage.Device).Revoked(), nil
+				},
+			},
+			"presets": &graphql.Field{
+				Type: graphql.NewList(presetType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return s.presets.GetAllPresets(p.Context, p.Source.(*storage.Device).ID)
+				},
+			},
+		},
+	})
+
+	scopeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Scope",
+		Fields: graphql.Fields{
+			"scopeType":   &graphql.Field{Type: graphql.String},
+			"scopeValue":  &graphql.Field{Type: graphql.String},
+			"presetCount": &graphql.Field{Type: graphql.Int},
+			"lastUpdated": &graphql.Field{Type: graphql.DateTime},
+		},
+	})
+
+	usageSummaryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PresetUsageSummary",
+		Fields: graphql.Fields{
+			"id":         &graphql.Field{Type: graphql.String},
+			"name":       &graphql.Field{Type: graphql.String},
+			"scopeType":  &graphql.Field{Type: graphql.String},
+			"scopeValue": &graphql.Field{Type: graphql.String},
+			"deviceId":   &graphql.Field{Type: graphql.String},
+			"useCount":   &graphql.Field{Type: graphql.Int},
+		},
+	})
+
+	usageBucketType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UsageBucket",
+		Fields: graphql.Fields{
+			"bucket":  &graphql.Field{Type: graphql.String},
+			"presets": &graphql.Field{Type: graphql.Int},
+		},
+	})
+
+	statsType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Stats",
+		Fields: graphql.Fields{
+			"totalPresets":  &graphql.Field{Type: graphql.Int},
+			"totalBytes":    &graphql.Field{Type: graphql.Float},
+			"databaseBytes": &graphql.Field{Type: graphql.Float},
+			"byDevice":      &graphql.Field{Type: jsonScalar},
+			"byScopeType":   &graphql.Field{Type: jsonScalar},
+			"byDomain":      &graphql.Field{Type: jsonScalar},
+			"mostUsed":      &graphql.Field{Type: graphql.NewList(usageSummaryType)},
+			"usageOverTime": &graphql.Field{Type: graphql.NewList(usageBucketType)},
+			"bucketSize":    &graphql.Field{Type: graphql.String},
+			"pii":           &graphql.Field{Type: jsonScalar},
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"presets": &graphql.Field{
+				Type: graphql.NewList(presetType),
+				Args: graphql.FieldConfigArgument{
+					"deviceId":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"scopeType":  &graphql.ArgumentConfig{Type: graphql.String},
+					"scopeValue": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					deviceID := p.Args["deviceId"].(string)
+					scopeType, _ := p.Args["scopeType"].(string)
+					scopeValue, _ := p.Args["scopeValue"].(string)
+					if scopeType != "" && scopeValue != "" {
+						if !s.urlFilters.isAllowed(scopeValue) {
+							return nil, fmt.Errorf("URL not allowed")
+						}
+						presets, err := s.presets.GetPresetsByScope(p.Context, scopeType, scopeValue, deviceID)
+						s.transformOnRead(p.Context, presets...)
+						return presets, err
+					}
+					presets, err := s.presets.GetAllPresets(p.Context, deviceID)
+					s.transformOnRead(p.Context, presets...)
+					return presets, err
+				},
+			},
+			"preset": &graphql.Field{
+				Type: presetType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					preset, err := s.presets.GetPreset(p.Context, p.Args["id"].(string))
+					if errors.Is(err, storage.ErrPresetNotFound) {
+						return nil, nil
+					}
+					if err != nil {
+						return nil, err
+					}
+					s.transformOnRead(p.Context, preset)
+					return preset, nil
+				},
+			},
+			"devices": &graphql.Field{
+				Type: graphql.NewList(deviceType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return s.storage.GetDevices(p.Context, "")
+				},
+			},
+			"scopes": &graphql.Field{
+				Type: graphql.NewList(scopeType),
+				Args: graphql.FieldConfigArgument{
+					"deviceId": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					deviceID, _ := p.Args["deviceId"].(string)
+					return s.storage.GetScopes(p.Context, deviceID)
+				},
+			},
+			"syncLog": &graphql.Field{
+				Type: graphql.NewList(syncLogType),
+				Args: graphql.FieldConfigArgument{
+					"limit":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 50},
+					"offset": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return s.storage.GetAllSyncLog(p.Context, p.Args["limit"].(int), p.Args["offset"].(int))
+				},
+			},
+			"stats": &graphql.Field{
+				Type: statsType,
+				Args: graphql.FieldConfigArgument{
+					"deviceId": &graphql.ArgumentConfig{Type: graphql.String},
+					"bucket":   &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: "day"},
+					"top":      &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 10},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					deviceID, _ := p.Args["deviceId"].(string)
+					top := p.Args["top"].(int)
+					if top < 1 || top > maxStatsTop {
+						return nil, fmt.Errorf("top must be between 1 and %d", maxStatsTop)
+					}
+					return s.storage.GetPresetStats(p.Context, deviceID, p.Args["bucket"].(string), top)
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+}
+
+// Execute a GraphQL query (POST JSON body or GET ?query=)
+func (s *Server) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	if r.Method == http.MethodGet {
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if vars := r.URL.Query().Get("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				s.respondError(w, http.StatusBadRequest, "Invalid variables")
+				return
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Query == "" {
+		s.respondError(w, http.StatusBadRequest, "query is required")
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         s.graphqlSchema,
+		RequestString:  req.Query,
+		OperationName:  req.OperationName,
+		VariableValues: req.Variables,
+		Context:        r.Context(),
+	})
+	if result.HasErrors() {
+		s.log(r).Debug("GraphQL query returned errors: %v", result.Errors)
+	}
+
+	s.respondJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// List device groups, optionally only those a device belongs to
+func (s *Server) handleGetGroups(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	if !s.requireDeviceScope(w, r, deviceID) {
+		return
+	}
+
+	groups, err := s.storage.GetGroups(r.Context(), deviceID)
+	if err != nil {
+		s.log(r).Error("Failed to get groups: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve groups")
+		return
+	}
+
+	s.respondSuccess(w, groups, fmt.Sprintf("Retrieved %d groups", len(groups)))
+}
+
+// Create a device group
+func (s *Server) handleCreateGroup(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name    string            `json:"name"`
+		Members []string          `json:"members"`
+		Roles   map[string]string `json:"roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		s.respondError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	for _, role := range body.Roles {
+		if !storage.ValidRole(role) {
+			s.respondError(w, http.StatusBadRequest, "role must be owner, editor, or viewer")
+			return
+		}
+	}
+
+	group, err := s.storage.CreateGroup(r.Context(), name)
+	if errors.Is(err, storage.ErrGroupExists) {
+		s.respondError(w, http.StatusConflict, "A group with this name already exists")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to create group: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to create group")
+		return
+	}
+
+	for _, deviceID := range body.Members {
+		if err := s.storage.AddGroupMember(r.Context(), group.ID, deviceID, body.Roles[deviceID]); err != nil {
+			s.log(r).Error("Failed to add group member: %v", err)
+			s.respondError(w, http.StatusInternalServerError, "Failed to add group members")
+			return
+		}
+	}
+	if group, err = s.storage.GetGroup(r.Context(), group.ID); err != nil {
+		s.log(r).Error("Failed to get group: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve group")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Data:    group,
+		Message: "Group created successfully",
+	})
+}
+
+// Get a device group with its members
+func (s *Server) handleGetGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := s.storage.GetGroup(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrGroupNotFound) {
+		s.respondError(w, http.StatusNotFound, "Group not found")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get group: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve group")
+		return
+	}
+
+	s.respondSuccess(w, group, "")
+}
+
+// Delete a device group
+func (s *Server) handleDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	err := s.storage.DeleteGroup(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrGroupNotFound) {
+		s.respondError(w, http.StatusNotFound, "Group not found")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to delete group: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to delete group")
+		return
+	}
+
+	s.respondSuccess(w, nil, "Group deleted successfully")
+}
+
+// Add a device to a group or change its role
+func (s *Server) handleAddGroupMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	// The body is optional; without one new members become editors
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if body.Role != "" && !storage.ValidRole(body.Role) {
+		s.respondError(w, http.StatusBadRequest, "role must be owner, editor, or viewer")
+		return
+	}
+
+	err := s.storage.AddGroupMember(r.Context(), vars["id"], vars["device"], body.Role)
+	if errors.Is(err, storage.ErrGroupNotFound) {
+		s.respondError(w, http.StatusNotFound, "Group not found")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to add group member: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to add group member")
+		return
+	}
+
+	s.handleGetGroup(w, r)
+}
+
+// Remove a device from a group
+func (s *Server) handleRemoveGroupMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := s.storage.RemoveGroupMember(r.Context(), vars["id"], vars["device"])
+	if errors.Is(err, storage.ErrNotGroupMember) {
+		s.respondError(w, http.StatusNotFound, "Device is not a member of this group")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to remove group member: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to remove group member")
+		return
+	}
+
+	s.handleGetGroup(w, r)
+}
+
+// Share a preset with one of the owning device's groups
+func (s *Server) handleSharePreset(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		GroupID string `json:"groupId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if body.GroupID == "" {
+		s.respondError(w, http.StatusBadRequest, "groupId is required")
+		return
+	}
+
+	s.setPresetShare(w, r, body.GroupID)
+}
+
+// Stop sharing a preset
+func (s *Server) handleUnsharePreset(w http.ResponseWriter, r *http.Request) {
+	s.setPresetShare(w, r, "")
+}
+
+// setPresetShare applies a share change for the owner in ?device_id
+func (s *Server) setPresetShare(w http.ResponseWriter, r *http.Request, groupID string) {
+	id := mux.Vars(r)["id"]
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" {
+		s.respondError(w, http.StatusBadRequest, "device_id parameter required")
+		return
+	}
+
+	err := s.storage.SharePreset(r.Context(), id, deviceID, groupID)
+	if errors.Is(err, storage.ErrNotGroupMember) {
+		s.respondError(w, http.StatusForbidden, "Device is not a member of this group")
+		return
+	}
+	if errors.Is(err, storage.ErrRoleDenied) {
+		s.respondError(w, http.StatusForbidden, "Viewers cannot share presets with this group")
+		return
+	}
+	if errors.Is(err, storage.ErrPresetNotFound) {
+		s.respondError(w, http.StatusNotFound, "Preset not found")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to share preset: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to update preset sharing")
+		return
+	}
+
+	preset, err := s.storage.GetPreset(r.Context(), id)
+	if err != nil {
+		s.log(r).Error("Failed to get preset: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve preset")
+		return
+	}
+
+	message := "Preset is no longer shared"
+	if groupID != "" {
+		message = "Preset shared with group"
+	}
+	s.log(r).Info("Preset %s sharing set to group %q (device: %s)", id, groupID, deviceID)
+	s.respondSuccess(w, preset, message)
+}
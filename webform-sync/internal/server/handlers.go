@@ -1,13 +1,20 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/events"
+	"github.com/tezza1971/webform-sync/internal/jobs"
 	"github.com/tezza1971/webform-sync/internal/storage"
 )
 
@@ -17,6 +24,14 @@ type APIResponse struct {
 	Data    interface{} `json:"data,omitempty"`
 	Error   string      `json:"error,omitempty"`
 	Message string      `json:"message,omitempty"`
+	// RequestID is set on errors so users can quote it when reporting them
+	RequestID string `json:"requestId,omitempty"`
+	// ReadOnly is set on 503s while the database is unavailable and only
+	// reads can be served
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// RetryAfterMs is set on 429s and 503s that are worth retrying: how
+	// long to wait first, as Retry-After says in whole seconds
+	RetryAfterMs int64 `json:"retryAfterMs,omitempty"`
 }
 
 func (s *Server) respondJSON(w http.ResponseWriter, status int, data interface{}) {
@@ -26,9 +41,38 @@ func (s *Server) respondJSON(w http.ResponseWriter, status int, data interface{}
 }
 
 func (s *Server) respondError(w http.ResponseWriter, status int, message string) {
+	if status == http.StatusInternalServerError && s.storageFailed() {
+		s.respondUnavailable(w, nil)
+		return
+	}
+	s.respondJSON(w, status, APIResponse{
+		Success:   false,
+		Error:     message,
+		RequestID: responseRequestID(w),
+	})
+}
+
+// setRetryAfter sets Retry-After to wait in whole seconds, at least 1, and
+// returns wait in milliseconds for the body
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) int64 {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+	return max(1, wait.Milliseconds())
+}
+
+// respondRetryLater refuses a request that should succeed if retried after
+// wait, such as one over a rate limit, with Retry-After and retryAfterMs so
+// clients back off rather than retrying at once
+func (s *Server) respondRetryLater(w http.ResponseWriter, r *http.Request, status int, message string, wait time.Duration) {
+	retryAfterMs := setRetryAfter(w, wait)
+	if strings.HasPrefix(r.URL.Path, "/api/v2/") && !wantsEnvelope(r) {
+		writeProblem(w, status, message, retryAfterMs)
+		return
+	}
 	s.respondJSON(w, status, APIResponse{
-		Success: false,
-		Error:   message,
+		Success:      false,
+		Error:        message,
+		RequestID:    responseRequestID(w),
+		RetryAfterMs: retryAfterMs,
 	})
 }
 
@@ -42,11 +86,18 @@ func (s *Server) respondSuccess(w http.ResponseWriter, data interface{}, message
 
 // Health check endpoint
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	s.respondSuccess(w, map[string]interface{}{
+	health := map[string]interface{}{
 		"status":  "ok",
 		"version": "1.0.0",
-		"uptime":  time.Since(time.Now()).String(),
-	}, "Service is healthy")
+		"uptime":  s.uptime(),
+		// The breaker's state, so clients and monitors can tell when
+		// storage calls are failing fast
+		"circuitBreaker": s.storage.BreakerStatus(),
+	}
+	if s.tenant != "" {
+		health["tenant"] = s.tenant
+	}
+	s.respondSuccess(w, health, "Service is healthy")
 }
 
 // Get all presets for a device
@@ -57,14 +108,31 @@ func (s *Server) handleGetPresets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	presets, err := s.storage.GetAllPresets(deviceID)
+	presets, err := s.presets.GetAllPresets(r.Context(), deviceID)
 	if err != nil {
-		s.logger.Error("Failed to get presets: %v", err)
+		s.log(r).Error("Failed to get presets: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve presets")
+		return
+	}
+
+	if err := s.annotateAccess(r.Context(), deviceID, presets); err != nil {
+		s.log(r).Error("Failed to get device roles: %v", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve presets")
 		return
 	}
 
-	s.respondSuccess(w, presets, fmt.Sprintf("Retrieved %d presets", len(presets)))
+	s.transformOnRead(r.Context(), presets...)
+	shaped, err := projectPresets(r, presets)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if s.checkNotModified(w, r, presetsETag(presets...), time.Time{}) {
+		return
+	}
+
+	s.respondSuccess(w, shaped, fmt.Sprintf("Retrieved %d presets", len(presets)))
 }
 
 // Get presets by scope
@@ -74,6 +142,10 @@ func (s *Server) handleGetPresetsByScope(w http.ResponseWriter, r *http.Request)
 	scopeValue := vars["value"]
 	deviceID := r.URL.Query().Get("device_id")
 
+	if !s.requireDeviceScope(w, r, deviceID) {
+		return
+	}
+
 	if scopeType == "" || scopeValue == "" {
 		s.respondError(w, http.StatusBadRequest, "scope type and value required")
 		return
@@ -81,19 +153,53 @@ func (s *Server) handleGetPresetsByScope(w http.ResponseWriter, r *http.Request)
 
 	// Check URL filter
 	if !s.urlFilters.isAllowed(scopeValue) {
-		s.logger.Warn("URL blocked by filter: %s", scopeValue)
+		s.log(r).Warn("URL blocked by filter: %s", scopeValue)
 		s.respondError(w, http.StatusForbidden, "URL not allowed")
 		return
 	}
 
-	presets, err := s.storage.GetPresetsByScope(scopeType, scopeValue, deviceID)
+	presets, err := s.presets.GetPresetsByScope(r.Context(), scopeType, scopeValue, deviceID)
 	if err != nil {
-		s.logger.Error("Failed to get presets by scope: %v", err)
+		s.log(r).Error("Failed to get presets by scope: %v", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve presets")
 		return
 	}
 
-	s.respondSuccess(w, presets, fmt.Sprintf("Retrieved %d presets", len(presets)))
+	if err := s.annotateAccess(r.Context(), deviceID, presets); err != nil {
+		s.log(r).Error("Failed to get device roles: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve presets")
+		return
+	}
+
+	s.transformOnRead(r.Context(), presets...)
+	shaped, err := projectPresets(r, presets)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if s.checkNotModified(w, r, presetsETag(presets...), time.Time{}) {
+		return
+	}
+
+	s.respondSuccess(w, shaped, fmt.Sprintf("Retrieved %d presets", len(presets)))
+}
+
+// Get distinct scopes with preset counts
+func (s *Server) handleGetScopes(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	if !s.requireDeviceScope(w, r, deviceID) {
+		return
+	}
+
+	scopes, err := s.storage.GetScopes(r.Context(), deviceID)
+	if err != nil {
+		s.log(r).Error("Failed to get scopes: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve scopes")
+		return
+	}
+
+	s.respondSuccess(w, scopes, fmt.Sprintf("Retrieved %d scopes", len(scopes)))
 }
 
 // Get single preset
@@ -101,16 +207,28 @@ func (s *Server) handleGetPreset(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 	deviceID := r.URL.Query().Get("device_id")
+	if !s.requireDeviceScope(w, r, deviceID) {
+		return
+	}
 
-	presets, err := s.storage.GetAllPresets(deviceID)
+	presets, err := s.presets.GetAllPresets(r.Context(), deviceID)
 	if err != nil {
-		s.logger.Error("Failed to get preset: %v", err)
+		s.log(r).Error("Failed to get preset: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve preset")
+		return
+	}
+
+	if err := s.annotateAccess(r.Context(), deviceID, presets); err != nil {
+		s.log(r).Error("Failed to get device roles: %v", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve preset")
 		return
 	}
 
 	for _, preset := range presets {
 		if preset.ID == id {
+			if s.checkNotModified(w, r, presetsETag(preset), preset.UpdatedAt) {
+				return
+			}
 			s.respondSuccess(w, preset, "Preset found")
 			return
 		}
@@ -132,17 +250,78 @@ func (s *Server) handleSavePreset(w http.ResponseWriter, r *http.Request) {
 		s.respondError(w, http.StatusBadRequest, "device_id is required")
 		return
 	}
+	if !s.admitDevice(w, r, preset.DeviceID) {
+		return
+	}
 	if preset.Name == "" {
 		s.respondError(w, http.StatusBadRequest, "name is required")
 		return
 	}
 
+	if err := checkScopePattern(&preset); err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	// Check URL filter only if scopeValue is provided
 	if preset.ScopeValue != "" && !s.urlFilters.isAllowed(preset.ScopeValue) {
-		s.logger.Warn("URL blocked by filter: %s", preset.ScopeValue)
+		s.log(r).Warn("URL blocked by filter: %s", preset.ScopeValue)
 		s.respondError(w, http.StatusForbidden, "URL not allowed")
 		return
 	}
+	if status, err := checkFieldTypes(&preset); err != nil {
+		s.respondError(w, status, err.Error())
+		return
+	}
+	if status, err := s.transformOnSave(r, &preset); err != nil {
+		s.respondError(w, status, err.Error())
+		return
+	}
+	if status, err := s.checkFieldPolicy(r, &preset); err != nil {
+		s.respondError(w, status, err.Error())
+		return
+	}
+	if status, err := s.checkPII(r, &preset); err != nil {
+		s.respondError(w, status, err.Error())
+		return
+	}
+
+	// Reconcile client-provided IDs: keep the device's own presets' IDs,
+	// whatever their format (older databases hold preset_<nanos> IDs), and
+	// new IDs that are valid UUIDs. Otherwise re-assign and report the
+	// mapping.
+	var idMapping map[string]string
+	if preset.ID != "" {
+		owner, exists, err := s.presets.GetPresetOwner(r.Context(), preset.ID)
+		if err != nil {
+			s.log(r).Error("Failed to check preset ID: %v", err)
+			s.respondError(w, http.StatusInternalServerError, "Failed to save preset")
+			return
+		}
+		reassign := !storage.IsValidPresetID(preset.ID)
+		if exists {
+			reassign = owner != preset.DeviceID
+		}
+		if reassign {
+			// Saved without an ID, so storage assigns a new one
+			idMapping = map[string]string{"clientId": preset.ID}
+			preset.ID = ""
+		}
+	}
+
+	// An edit of a preset that has moved on since is kept as a conflict copy
+	if idMapping == nil {
+		conflict, err := s.keepConflictCopy(r.Context(), &preset, preset.DeviceID)
+		if err != nil {
+			s.log(r).Error("Failed to check for conflicts: %v", err)
+			s.respondError(w, http.StatusInternalServerError, "Failed to save preset")
+			return
+		}
+		if conflict != nil {
+			s.respondConflictCopy(w, r, conflict)
+			return
+		}
+	}
 
 	// Set timestamps if not provided
 	if preset.CreatedAt.IsZero() {
@@ -150,20 +329,33 @@ func (s *Server) handleSavePreset(w http.ResponseWriter, r *http.Request) {
 	}
 	preset.UpdatedAt = time.Now()
 
-	if err := s.storage.SavePreset(&preset); err != nil {
-		s.logger.Error("Failed to save preset: %v", err)
+	if err := s.presets.SavePreset(r.Context(), &preset); err != nil {
+		if status, ok := quotaStatus(err); ok {
+			s.log(r).Warn("Preset rejected: %v", err)
+			s.respondError(w, status, err.Error())
+			return
+		}
+		s.log(r).Error("Failed to save preset: %v", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to save preset")
 		return
 	}
 
-	s.logger.Info("Preset saved: %s (device: %s)", preset.ID, preset.DeviceID)
+	s.log(r).Info("Preset saved: %s (device: %s)", preset.ID, preset.DeviceID)
+	s.publishPresetSaved(&preset)
+
+	data := map[string]interface{}{"preset": preset}
+	if idMapping != nil {
+		idMapping["serverId"] = preset.ID
+		data["idMapping"] = idMapping
+		s.log(r).Info("Re-assigned preset ID %s -> %s (device: %s)", idMapping["clientId"], preset.ID, preset.DeviceID)
+	}
 
 	// Return with 201 status for creation
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(APIResponse{
 		Success: true,
-		Data:    map[string]interface{}{"preset": preset},
+		Data:    data,
 		Message: "Preset saved successfully",
 	})
 }
@@ -182,20 +374,81 @@ func (s *Server) handleUpdatePreset(w http.ResponseWriter, r *http.Request) {
 	preset.ID = id
 	preset.UpdatedAt = time.Now()
 
+	// A user's device-less edit would match device-less presets as their
+	// owner, so user tokens must name a device
+	if !s.requireDeviceScope(w, r, preset.DeviceID) || !s.admitDevice(w, r, preset.DeviceID) {
+		return
+	}
+
+	// Other devices' presets can only be edited through a group role; the
+	// preset stays with its owner
+	deviceID := preset.DeviceID
+	owner, err := s.authorizePresetWrite(r.Context(), id, preset.DeviceID, storage.RoleEditor)
+	switch {
+	case errors.Is(err, storage.ErrPresetNotFound):
+	case errors.Is(err, storage.ErrRoleDenied):
+		s.respondError(w, http.StatusForbidden, "Group role does not allow editing this preset")
+		return
+	case err != nil:
+		s.log(r).Error("Failed to check preset access: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to update preset")
+		return
+	case owner != "":
+		preset.DeviceID = owner
+	}
+
+	if err := checkScopePattern(&preset); err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	// Check URL filter
 	if !s.urlFilters.isAllowed(preset.ScopeValue) {
-		s.logger.Warn("URL blocked by filter: %s", preset.ScopeValue)
+		s.log(r).Warn("URL blocked by filter: %s", preset.ScopeValue)
 		s.respondError(w, http.StatusForbidden, "URL not allowed")
 		return
 	}
+	if status, err := checkFieldTypes(&preset); err != nil {
+		s.respondError(w, status, err.Error())
+		return
+	}
+	if status, err := s.transformOnSave(r, &preset); err != nil {
+		s.respondError(w, status, err.Error())
+		return
+	}
+	if status, err := s.checkFieldPolicy(r, &preset); err != nil {
+		s.respondError(w, status, err.Error())
+		return
+	}
+	if status, err := s.checkPII(r, &preset); err != nil {
+		s.respondError(w, status, err.Error())
+		return
+	}
 
-	if err := s.storage.SavePreset(&preset); err != nil {
-		s.logger.Error("Failed to update preset: %v", err)
+	conflict, err := s.keepConflictCopy(r.Context(), &preset, deviceID)
+	if err != nil {
+		s.log(r).Error("Failed to check for conflicts: %v", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to update preset")
 		return
 	}
+	if conflict != nil {
+		s.respondConflictCopy(w, r, conflict)
+		return
+	}
 
-	s.logger.Info("Preset updated: %s (device: %s)", preset.ID, preset.DeviceID)
+	if err := s.presets.SavePreset(r.Context(), &preset); err != nil {
+		if status, ok := quotaStatus(err); ok {
+			s.log(r).Warn("Preset rejected: %v", err)
+			s.respondError(w, status, err.Error())
+			return
+		}
+		s.log(r).Error("Failed to update preset: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to update preset")
+		return
+	}
+
+	s.log(r).Info("Preset updated: %s (device: %s)", preset.ID, preset.DeviceID)
+	s.publishPresetSaved(&preset)
 	s.respondSuccess(w, preset, "Preset updated successfully")
 }
 
@@ -210,13 +463,28 @@ func (s *Server) handleDeletePreset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.storage.DeletePreset(id, deviceID); err != nil {
-		s.logger.Error("Failed to delete preset: %v", err)
+	// Group owners may delete presets shared with their group
+	owner, err := s.authorizePresetWrite(r.Context(), id, deviceID, storage.RoleOwner)
+	switch {
+	case errors.Is(err, storage.ErrPresetNotFound):
+		owner = deviceID
+	case errors.Is(err, storage.ErrRoleDenied):
+		s.respondError(w, http.StatusForbidden, "Group role does not allow deleting this preset")
+		return
+	case err != nil:
+		s.log(r).Error("Failed to check preset access: %v", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to delete preset")
 		return
 	}
 
-	s.logger.Info("Preset deleted: %s (device: %s)", id, deviceID)
+	if err := s.presets.DeletePreset(r.Context(), id, owner); err != nil {
+		s.log(r).Error("Failed to delete preset: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to delete preset")
+		return
+	}
+
+	s.log(r).Info("Preset deleted: %s (device: %s)", id, deviceID)
+	s.publishPresetDeleted(id, owner)
 	s.respondSuccess(w, nil, "Preset deleted successfully")
 }
 
@@ -225,8 +493,8 @@ func (s *Server) handleUpdateUsage(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	if err := s.storage.UpdatePresetUsage(id); err != nil {
-		s.logger.Error("Failed to update preset usage: %v", err)
+	if err := s.presets.UpdatePresetUsage(r.Context(), id); err != nil {
+		s.log(r).Error("Failed to update preset usage: %v", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to update usage")
 		return
 	}
@@ -240,9 +508,9 @@ func (s *Server) handleGetSyncLog(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 	limit := 100 // Default limit
 
-	logs, err := s.storage.GetSyncLog(id, limit)
+	logs, err := s.storage.GetSyncLog(r.Context(), id, limit)
 	if err != nil {
-		s.logger.Error("Failed to get sync log: %v", err)
+		s.log(r).Error("Failed to get sync log: %v", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve sync log")
 		return
 	}
@@ -258,9 +526,9 @@ func (s *Server) handleSyncStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	presets, err := s.storage.GetAllPresets(deviceID)
+	presets, err := s.presets.GetAllPresets(r.Context(), deviceID)
 	if err != nil {
-		s.logger.Error("Failed to get sync status: %v", err)
+		s.log(r).Error("Failed to get sync status: %v", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve sync status")
 		return
 	}
@@ -291,15 +559,49 @@ func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(wrapped, r)
 
 		duration := time.Since(start).Milliseconds()
-		s.logger.LogRequest(r.Method, r.URL.Path, r.RemoteAddr, wrapped.statusCode, float64(duration))
+		s.log(r).LogRequest(r.Method, r.URL.Path, r.RemoteAddr, wrapped.statusCode, float64(duration))
+	})
+}
+
+// Middleware: log requests that take longer than logging.slow_request_ms,
+// with their route and device, to help track down stalled syncs
+func (s *Server) slowRequestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		threshold := time.Duration(s.config.Logging.SlowRequestMs) * time.Millisecond
+		if threshold == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(wrapped, r)
+		elapsed := time.Since(start)
+		if elapsed < threshold {
+			return
+		}
+
+		s.requests.recordSlow()
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		device := requestDeviceID(r)
+		if device == "" {
+			device = "-"
+		}
+		s.log(r).Warn("Slow request took %s: %s %s (status %d, device %s)",
+			elapsed.Round(time.Millisecond), r.Method, route, wrapped.statusCode, device)
 	})
 }
 
 // Get list of devices
 func (s *Server) handleGetDevices(w http.ResponseWriter, r *http.Request) {
-	devices, err := s.storage.GetDevices()
+	devices, err := s.storage.GetDevices(r.Context(), requestUserID(r))
 	if err != nil {
-		s.logger.Error("Failed to get devices: %v", err)
+		s.log(r).Error("Failed to get devices: %v", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve devices")
 		return
 	}
@@ -307,6 +609,46 @@ func (s *Server) handleGetDevices(w http.ResponseWriter, r *http.Request) {
 	s.respondSuccess(w, devices, fmt.Sprintf("Retrieved %d devices", len(devices)))
 }
 
+// maxStatsTop bounds the most-used presets a statistics request can ask for
+const maxStatsTop = 100
+
+// Get aggregate preset statistics
+func (s *Server) handleGetStats(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	if !s.requireDeviceScope(w, r, deviceID) {
+		return
+	}
+
+	bucket := r.URL.Query().Get("bucket")
+	switch bucket {
+	case "":
+		bucket = "day"
+	case "day", "week", "month":
+	default:
+		s.respondError(w, http.StatusBadRequest, "bucket must be day, week, or month")
+		return
+	}
+
+	top := 10
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxStatsTop {
+			s.respondError(w, http.StatusBadRequest, fmt.Sprintf("top must be between 1 and %d", maxStatsTop))
+			return
+		}
+		top = n
+	}
+
+	stats, err := s.storage.GetPresetStats(r.Context(), deviceID, bucket, top)
+	if err != nil {
+		s.log(r).Error("Failed to get preset stats: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve statistics")
+		return
+	}
+
+	s.respondSuccess(w, stats, "Statistics retrieved")
+}
+
 // Get sync log (all entries)
 func (s *Server) handleGetSyncLogAll(w http.ResponseWriter, r *http.Request) {
 	// Parse limit and offset from query
@@ -320,9 +662,9 @@ func (s *Server) handleGetSyncLogAll(w http.ResponseWriter, r *http.Request) {
 		fmt.Sscanf(offsetStr, "%d", &offset)
 	}
 
-	logs, err := s.storage.GetAllSyncLog(limit, offset)
+	logs, err := s.storage.GetAllSyncLog(r.Context(), limit, offset)
 	if err != nil {
-		s.logger.Error("Failed to retrieve sync log: %v", err)
+		s.log(r).Error("Failed to retrieve sync log: %v", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve sync log")
 		return
 	}
@@ -338,18 +680,48 @@ func (s *Server) handleCleanup(w http.ResponseWriter, r *http.Request) {
 		fmt.Sscanf(daysStr, "%d", &days)
 	}
 
-	count, err := s.storage.CleanupOldPresets(days)
+	// A dry run lists what would go, so rarely used presets worth keeping
+	// can be pinned or exempted first
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	// days replaces delete_after_days; retention rules still apply
+	var result *storage.CleanupResult
+	err := s.jobManager.Run(r.Context(), jobs.Cleanup, s.tenant, func(ctx context.Context, job *jobs.Job) (err error) {
+		job.SetStep("removing presets unused for " + strconv.Itoa(days) + " days")
+		result, err = s.storage.CleanupOldPresets(ctx, s.retentionPolicy(days), dryRun)
+		return err
+	})
+	if errors.Is(err, context.Canceled) {
+		s.log(r).Warn("Cleanup cancelled: %v", err)
+		s.respondError(w, http.StatusConflict, "Cleanup was cancelled")
+		return
+	}
 	if err != nil {
-		s.logger.Error("Cleanup failed: %v", err)
+		s.log(r).Error("Cleanup failed: %v", err)
 		s.respondError(w, http.StatusInternalServerError, "Cleanup failed")
 		return
 	}
+	count := len(result.Presets)
 
-	s.logger.Info("Manual cleanup completed: %d presets removed", count)
+	if dryRun {
+		s.respondSuccess(w, map[string]interface{}{
+			"status":         "dry_run",
+			"removed_count":  count,
+			"exempted_count": result.Exempted,
+			"days":           days,
+			"presets":        result.Presets,
+		}, fmt.Sprintf("Dry run: %d presets would be removed", count))
+		return
+	}
+
+	s.log(r).Info("Manual cleanup completed: %d presets removed, %d exempt", count, result.Exempted)
+	s.publishSync(events.SyncCleaned, syncEventData{Count: count})
 	s.respondSuccess(w, map[string]interface{}{
-		"status":        "completed",
-		"removed_count": count,
-		"days":          days,
+		"status":         "completed",
+		"removed_count":  count,
+		"exempted_count": result.Exempted,
+		"days":           days,
+		"presets":        result.Presets,
 	}, fmt.Sprintf("Cleanup completed: %d presets removed", count))
 }
 
@@ -364,7 +736,7 @@ func (s *Server) ipFilterMiddleware(next http.Handler) http.Handler {
 		}
 
 		if !s.ipFilters.isAllowed(ip) {
-			s.logger.Warn("IP blocked: %s", ip)
+			s.log(r).Warn("IP blocked: %s", ip)
 			s.respondError(w, http.StatusForbidden, "Access denied")
 			return
 		}
@@ -376,12 +748,20 @@ func (s *Server) ipFilterMiddleware(next http.Handler) http.Handler {
 // Middleware: Authentication
 func (s *Server) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip auth for health check
-		if r.URL.Path == "/api/v1/health" {
+		// Skip auth for health checks, probes, discovery and share links,
+		// which carry their own signature
+		if r.URL.Path == "/api/v1/health" || r.URL.Path == "/api/v2/health" ||
+			r.URL.Path == "/api/v1/discovery" ||
+			isProbe(r) ||
+			strings.HasPrefix(r.URL.Path, sharedPathPrefix) {
 			next.ServeHTTP(w, r)
 			return
 		}
 
+		if s.lockedOut(w, r) {
+			return
+		}
+
 		authType := s.config.Authentication.Type
 
 		switch authType {
@@ -390,11 +770,30 @@ func (s *Server) authMiddleware(next http.Handler) http.Handler {
 			if token == "" {
 				token = r.URL.Query().Get("token")
 			}
+			// WebDAV clients only speak basic auth, so the token is the
+			// password
+			dav := isWebDAVPath(r.URL.Path)
+			if _, password, ok := r.BasicAuth(); ok && dav {
+				token = password
+			}
 
 			expectedToken := "Bearer " + s.config.Authentication.APIToken
 			if token != expectedToken && token != s.config.Authentication.APIToken {
-				s.respondError(w, http.StatusUnauthorized, "Invalid or missing token")
-				return
+				// Not the admin token; try a per-user token
+				user, err := s.storage.GetUserByToken(r.Context(), strings.TrimPrefix(token, "Bearer "))
+				if err != nil || token == "" {
+					if dav {
+						w.Header().Set("WWW-Authenticate", `Basic realm="Webform Sync"`)
+					}
+					// Clients often ask without a token first; only a
+					// wrong one counts towards a lockout
+					if token != "" {
+						s.authFailed(r)
+					}
+					s.respondError(w, http.StatusUnauthorized, "Invalid or missing token")
+					return
+				}
+				r = withUser(r, user)
 			}
 
 		case "basic":
@@ -406,10 +805,18 @@ func (s *Server) authMiddleware(next http.Handler) http.Handler {
 			}
 
 			if username != s.config.Authentication.Username || password != s.config.Authentication.Password {
+				s.authFailed(r)
 				s.respondError(w, http.StatusUnauthorized, "Invalid credentials")
 				return
 			}
+
+		case "plugin":
+			var ok bool
+			if r, ok = s.authenticatePlugin(w, r); !ok {
+				return
+			}
 		}
+		s.authSucceeded(r)
 
 		next.ServeHTTP(w, r)
 	})
@@ -419,6 +826,7 @@ func (s *Server) authMiddleware(next http.Handler) http.Handler {
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	bytes      int64
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
@@ -426,6 +834,24 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes through to the wrapped writer, for streamed responses
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // ============================================================================
 // DISABLED DOMAINS HANDLERS
 // ============================================================================
@@ -438,9 +864,9 @@ func (s *Server) handleGetDisabledDomains(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	domains, err := s.storage.GetDisabledDomains(sessionID)
+	domains, err := s.storage.GetDisabledDomains(r.Context(), sessionID)
 	if err != nil {
-		s.logger.Error("Failed to get disabled domains: %v", err)
+		s.log(r).Error("Failed to get disabled domains: %v", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve disabled domains")
 		return
 	}
@@ -461,8 +887,8 @@ func (s *Server) handleDisableDomain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.storage.DisableDomain(domain, sessionID); err != nil {
-		s.logger.Error("Failed to disable domain %s: %v", domain, err)
+	if err := s.storage.DisableDomain(r.Context(), domain, sessionID); err != nil {
+		s.log(r).Error("Failed to disable domain %s: %v", domain, err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to disable domain")
 		return
 	}
@@ -485,8 +911,8 @@ func (s *Server) handleEnableDomain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.storage.EnableDomain(domain, sessionID); err != nil {
-		s.logger.Error("Failed to enable domain %s: %v", domain, err)
+	if err := s.storage.EnableDomain(r.Context(), domain, sessionID); err != nil {
+		s.log(r).Error("Failed to enable domain %s: %v", domain, err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to enable domain")
 		return
 	}
@@ -509,9 +935,9 @@ func (s *Server) handleCheckDomainStatus(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	disabled, err := s.storage.IsDomainDisabled(domain, sessionID)
+	disabled, err := s.storage.IsDomainDisabled(r.Context(), domain, sessionID)
 	if err != nil {
-		s.logger.Error("Failed to check domain status for %s: %v", domain, err)
+		s.log(r).Error("Failed to check domain status for %s: %v", domain, err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to check domain status")
 		return
 	}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// A user token must not edit device-less presets by leaving deviceId empty,
+// which would match them as their owner
+func TestUpdatePresetRequiresDeviceForUsers(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	shared := &storage.Preset{
+		Name: "Shared", ScopeType: storage.ScopeTypeGlobal,
+		Fields: map[string]interface{}{"user": "admin"}, CreatedAt: now, UpdatedAt: now,
+	}
+	if err := s.storage.SavePreset(ctx, shared); err != nil {
+		t.Fatal(err)
+	}
+	mallory, _, err := s.storage.CreateUser(ctx, "mallory")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"deviceId": "", "name": "Shared", "scopeType": "global", "fields": {"user": "mallory"}}`
+	r := httptest.NewRequest(http.MethodPut, "/api/v1/presets/"+shared.ID, strings.NewReader(body))
+	r = withUser(mux.SetURLVars(r, map[string]string{"id": shared.ID}), mallory)
+	w := httptest.NewRecorder()
+	s.handleUpdatePreset(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d (%s)", w.Code, http.StatusForbidden, w.Body.String())
+	}
+	got, err := s.storage.GetPreset(ctx, shared.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Fields["user"] != "admin" {
+		t.Errorf("preset fields = %v, want them unchanged", got.Fields)
+	}
+}
+
+// The number of most-used presets in statistics is bounded
+func TestGetStatsBoundsTop(t *testing.T) {
+	s := newTestServer(t)
+
+	for top, want := range map[string]int{
+		"10": http.StatusOK, "100": http.StatusOK,
+		"0": http.StatusBadRequest, "101": http.StatusBadRequest, "1000000000": http.StatusBadRequest, "ten": http.StatusBadRequest,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/presets/stats?top="+top, nil)
+		w := httptest.NewRecorder()
+		s.handleGetStats(w, r)
+		if w.Code != want {
+			t.Errorf("top=%s: status = %d, want %d", top, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,558 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/archive"
+	"github.com/tezza1971/webform-sync/internal/events"
+	"github.com/tezza1971/webform-sync/internal/importer"
+	"github.com/tezza1971/webform-sync/internal/jobs"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// maxImportBytes bounds the size of an import upload
+const maxImportBytes = 64 << 20
+
+// Import conflict policies
+const (
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictRename    = "rename"
+)
+
+// Import item actions
+const (
+	importCreated = "created"
+	importUpdated = "updated"
+	importSkipped = "skipped"
+	importRenamed = "renamed"
+	importFailed  = "failed"
+)
+
+// ImportItemResult reports what happened to one imported preset
+type ImportItemResult struct {
+	Index   int    `json:"index"`
+	ID      string `json:"id,omitempty"`
+	Name    string `json:"name"`
+	Action  string `json:"action"`
+	NewID   string `json:"newId,omitempty"`
+	NewName string `json:"newName,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ImportResult summarizes an import run
+type ImportResult struct {
+	DryRun bool               `json:"dryRun"`
+	Policy string             `json:"policy"`
+	Format string             `json:"format"`
+	Total  int                `json:"total"`
+	Counts map[string]int     `json:"counts"`
+	Items  []ImportItemResult `json:"items"`
+	// Cancelled is set if the import's job was cancelled part way; Items
+	// lists the presets handled before then
+	Cancelled bool `json:"cancelled,omitempty"`
+}
+
+// readImportPayload returns the raw import bytes from a multipart upload
+// (field "file") or the request body, decrypting archives if needed
+func (s *Server) readImportPayload(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	var src io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, fmt.Errorf("multipart upload must include a 'file' field")
+		}
+		defer file.Close()
+		src = file
+	}
+
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read import data: %w", err)
+	}
+
+	if archive.IsEncrypted(data) {
+		passphrase := r.Header.Get("X-Import-Passphrase")
+		if passphrase == "" {
+			return nil, fmt.Errorf("encrypted import requires the X-Import-Passphrase header")
+		}
+		reader, err := archive.NewDecryptReader(bytes.NewReader(data), passphrase)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// detectImportFormat guesses the export format from the payload
+func detectImportFormat(data []byte) string {
+	trimmed := bytes.TrimSpace(data)
+	if !bytes.HasPrefix(trimmed, []byte("{")) {
+		return "csv"
+	}
+
+	firstLine := trimmed
+	if i := bytes.IndexByte(trimmed, '\n'); i >= 0 {
+		firstLine = trimmed[:i]
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(firstLine, &obj); err != nil {
+		// Pretty-printed JSON document spanning lines
+		return "json"
+	}
+	if _, ok := obj["presets"]; ok {
+		return "json"
+	}
+	if _, ok := obj["formatVersion"]; ok {
+		return "json"
+	}
+	return "ndjson"
+}
+
+// parseImport decodes presets from an export payload
+func parseImport(data []byte, format string) ([]*storage.Preset, error) {
+	switch format {
+	case "json":
+		var doc struct {
+			FormatVersion int               `json:"formatVersion"`
+			Presets       []*storage.Preset `json:"presets"`
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("invalid JSON export: %w", err)
+		}
+		if doc.FormatVersion > ExportFormatVersion {
+			return nil, fmt.Errorf("export format version %d is newer than supported (%d)", doc.FormatVersion, ExportFormatVersion)
+		}
+		return doc.Presets, nil
+
+	case "ndjson":
+		var presets []*storage.Preset
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 0, 64*1024), maxImportBytes)
+		line := 0
+		for scanner.Scan() {
+			line++
+			text := bytes.TrimSpace(scanner.Bytes())
+			if len(text) == 0 {
+				continue
+			}
+			var p storage.Preset
+			if err := json.Unmarshal(text, &p); err != nil {
+				return nil, fmt.Errorf("invalid NDJSON on line %d: %w", line, err)
+			}
+			presets = append(presets, &p)
+		}
+		return presets, scanner.Err()
+
+	case "csv":
+		return parseCSVImport(data)
+
+	default:
+		return nil, fmt.Errorf("unsupported import format: %s", format)
+	}
+}
+
+// parseCSVImport decodes the CSV export layout, matching columns by header
+func parseCSVImport(data []byte) ([]*storage.Preset, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	col := make(map[string]int)
+	for i, name := range records[0] {
+		col[strings.TrimSpace(name)] = i
+	}
+	if _, ok := col["name"]; !ok {
+		return nil, fmt.Errorf("CSV header must include a 'name' column")
+	}
+
+	get := func(rec []string, name string) string {
+		if i, ok := col[name]; ok && i < len(rec) {
+			return rec[i]
+		}
+		return ""
+	}
+	parseTime := func(v string) time.Time {
+		t, _ := time.Parse(time.RFC3339Nano, v)
+		return t
+	}
+
+	var presets []*storage.Preset
+	for n, rec := range records[1:] {
+		p := &storage.Preset{
+			ID:              get(rec, "id"),
+			Name:            get(rec, "name"),
+			ScopeType:       get(rec, "scopeType"),
+			ScopeValue:      get(rec, "scopeValue"),
+			DeviceID:        get(rec, "deviceId"),
+			EncryptedFields: get(rec, "encryptedFields"),
+			CreatedAt:       parseTime(get(rec, "createdAt")),
+			UpdatedAt:       parseTime(get(rec, "updatedAt")),
+		}
+		p.Encrypted, _ = strconv.ParseBool(get(rec, "encrypted"))
+		p.UseCount, _ = strconv.Atoi(get(rec, "useCount"))
+		if v := get(rec, "lastUsed"); v != "" {
+			t := parseTime(v)
+			p.LastUsed = &t
+		}
+		if v := get(rec, "fields"); v != "" {
+			if err := json.Unmarshal([]byte(v), &p.Fields); err != nil {
+				return nil, fmt.Errorf("invalid fields JSON on row %d: %w", n+2, err)
+			}
+		}
+		if v := get(rec, "metadata"); v != "" {
+			if err := json.Unmarshal([]byte(v), &p.Metadata); err != nil {
+				return nil, fmt.Errorf("invalid metadata JSON on row %d: %w", n+2, err)
+			}
+		}
+		presets = append(presets, p)
+	}
+
+	return presets, nil
+}
+
+// Import presets from an export, with dry-run and conflict policies
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	dryRun, _ := strconv.ParseBool(query.Get("dry_run"))
+
+	policy := query.Get("conflict")
+	if policy == "" {
+		policy = conflictSkip
+	}
+	if policy != conflictSkip && policy != conflictOverwrite && policy != conflictRename {
+		s.respondError(w, http.StatusBadRequest, "conflict must be skip, overwrite, or rename")
+		return
+	}
+
+	data, err := s.readImportPayload(w, r)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, archive.ErrInvalidPassphrase) {
+			status = http.StatusUnprocessableEntity
+		}
+		s.respondError(w, status, err.Error())
+		return
+	}
+
+	targetDevice := query.Get("device_id")
+	if !s.requireDeviceScope(w, r, targetDevice) {
+		return
+	}
+
+	// Third-party exports are recognised before our own formats, since
+	// their CSV layouts would otherwise be read as ours
+	format := query.Get("format")
+	if format == "" {
+		if c, ok := importer.Detect(data); ok {
+			format = c.Name()
+		} else {
+			format = detectImportFormat(data)
+		}
+	}
+
+	var presets []*storage.Preset
+	if c, ok := importer.Get(format); ok {
+		if targetDevice == "" {
+			s.respondError(w, http.StatusBadRequest, "device_id is required when importing from "+format)
+			return
+		}
+		presets, err = c.Convert(data, targetDevice)
+	} else {
+		presets, err = parseImport(data, format)
+	}
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result := ImportResult{
+		DryRun: dryRun,
+		Policy: policy,
+		Format: format,
+		Total:  len(presets),
+		Counts: map[string]int{},
+		Items:  make([]ImportItemResult, 0, len(presets)),
+	}
+
+	// Cancelling the job stops the import between presets; those already
+	// imported stay
+	s.jobManager.Run(r.Context(), jobs.Import, s.tenant, func(ctx context.Context, job *jobs.Job) error {
+		job.SetStep("importing " + format)
+		req := r.WithContext(ctx)
+
+		// Presets are saved together, so a write-behind queue writes them
+		// in batches instead of one per flush interval
+		var pending []importSave
+		flush := func(ctx context.Context) {
+			if len(pending) == 0 {
+				return
+			}
+			batch := make([]*storage.Preset, len(pending))
+			for i, save := range pending {
+				batch[i] = save.preset
+			}
+			errs := s.storage.SavePresets(ctx, batch)
+			for i, save := range pending {
+				s.finishImport(req, &result.Items[save.item], save, errs[i])
+			}
+			pending = pending[:0]
+		}
+
+		for i, preset := range presets {
+			if ctx.Err() != nil {
+				flush(context.WithoutCancel(ctx))
+				result.Cancelled = true
+				return ctx.Err()
+			}
+			job.SetProgress(i, len(presets))
+			if targetDevice != "" {
+				preset.DeviceID = targetDevice
+			}
+			// Conflicts are looked up in the database, so the presets this
+			// one could collide with are saved before it is checked
+			if importCollides(pending, preset) {
+				flush(ctx)
+			}
+			item, save := s.importPreset(req, i, preset, policy, dryRun)
+			result.Items = append(result.Items, item)
+			if save != nil {
+				save.item = len(result.Items) - 1
+				pending = append(pending, *save)
+			}
+		}
+		flush(ctx)
+		job.SetProgress(len(presets), len(presets))
+		return nil
+	})
+	for _, item := range result.Items {
+		result.Counts[item.Action]++
+	}
+
+	if result.Cancelled {
+		s.log(r).Warn("Import cancelled after %d of %d presets", len(result.Items), result.Total)
+		s.respondSuccess(w, result, fmt.Sprintf("Import cancelled after %d of %d presets", len(result.Items), result.Total))
+		return
+	}
+
+	s.log(r).Info("Import %s: %d presets (created %d, updated %d, renamed %d, skipped %d, failed %d)",
+		map[bool]string{true: "dry run", false: "completed"}[dryRun], result.Total,
+		result.Counts[importCreated], result.Counts[importUpdated], result.Counts[importRenamed],
+		result.Counts[importSkipped], result.Counts[importFailed])
+
+	imported := result.Total - result.Counts[importSkipped] - result.Counts[importFailed]
+	message := fmt.Sprintf("Imported %d presets", imported)
+	if dryRun {
+		message = "Dry run: no changes written"
+	} else {
+		s.publishSync(events.SyncImported, syncEventData{
+			Count: imported, DeviceID: targetDevice, Format: format, Counts: result.Counts,
+		})
+	}
+	s.respondSuccess(w, result, message)
+}
+
+// importSave is an imported preset waiting to be saved with the others
+type importSave struct {
+	// item is the preset's index in ImportResult.Items
+	item     int
+	preset   *storage.Preset
+	reassign bool
+}
+
+// importCollides reports whether a pending save could be found by the
+// conflict checks for preset: one with its ID, or on its device with a name
+// it or its renamed copies could clash with
+func importCollides(pending []importSave, preset *storage.Preset) bool {
+	for _, save := range pending {
+		if preset.ID != "" && save.preset.ID == preset.ID {
+			return true
+		}
+		if save.preset.DeviceID == preset.DeviceID && strings.HasPrefix(save.preset.Name, preset.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// importPreset checks the import of one preset and resolves its conflicts.
+// It returns the preset's save, for the caller to make, unless it is
+// skipped, failed, or this is a dry run.
+func (s *Server) importPreset(r *http.Request, index int, preset *storage.Preset, policy string, dryRun bool) (ImportItemResult, *importSave) {
+	item := ImportItemResult{Index: index, ID: preset.ID, Name: preset.Name}
+	fail := func(msg string) (ImportItemResult, *importSave) {
+		item.Action = importFailed
+		item.Error = msg
+		return item, nil
+	}
+
+	if preset.Name == "" {
+		return fail("name is required")
+	}
+	if preset.DeviceID == "" {
+		return fail("deviceId is required")
+	}
+	if err := checkScopePattern(preset); err != nil {
+		return fail(err.Error())
+	}
+	if preset.ScopeValue != "" && !s.urlFilters.isAllowed(preset.ScopeValue) {
+		return fail("URL not allowed")
+	}
+	if _, err := checkFieldTypes(preset); err != nil {
+		return fail(err.Error())
+	}
+	if _, err := s.transformOnSave(r, preset); err != nil {
+		return fail(err.Error())
+	}
+	if _, err := s.checkFieldPolicy(r, preset); err != nil {
+		return fail(err.Error())
+	}
+	if _, err := s.checkPII(r, preset); err != nil {
+		return fail(err.Error())
+	}
+
+	// Find conflicts by ID and by natural key. A preset that needs a new ID
+	// is saved without one, and storage assigns it.
+	var existing *storage.Preset
+	reassign := false
+	if preset.ID != "" {
+		found, err := s.storage.GetPreset(r.Context(), preset.ID)
+		if err != nil && !errors.Is(err, storage.ErrPresetNotFound) {
+			return fail("failed to check for conflicts")
+		}
+		// IDs owned by another device are re-assigned, as for regular saves
+		if found != nil && found.DeviceID != preset.DeviceID {
+			reassign = true
+			found = nil
+		}
+		existing = found
+	}
+	if existing == nil {
+		found, err := s.storage.FindPresetByKey(r.Context(), preset.ScopeType, preset.ScopeValue, preset.Name, preset.DeviceID)
+		if err != nil && !errors.Is(err, storage.ErrPresetNotFound) {
+			return fail("failed to check for conflicts")
+		}
+		existing = found
+	}
+
+	item.Action = importCreated
+	if existing != nil {
+		switch policy {
+		case conflictSkip:
+			item.Action = importSkipped
+			return item, nil
+
+		case conflictOverwrite:
+			item.Action = importUpdated
+			// The existing preset keeps its ID, even when the incoming one
+			// belonged to another device
+			preset.ID = existing.ID
+			reassign = false
+			preset.CreatedAt = existing.CreatedAt
+
+		case conflictRename:
+			item.Action = importRenamed
+			name, err := s.uniqueImportName(r.Context(), preset)
+			if err != nil {
+				return fail("failed to choose a new name")
+			}
+			preset.Name = name
+			reassign = true
+			item.NewName = name
+		}
+	}
+
+	if dryRun {
+		return item, nil
+	}
+	if reassign {
+		preset.ID = ""
+	}
+
+	now := time.Now()
+	if preset.CreatedAt.IsZero() {
+		preset.CreatedAt = now
+	}
+	if preset.UpdatedAt.IsZero() {
+		preset.UpdatedAt = now
+	}
+	return item, &importSave{preset: preset, reassign: reassign}
+}
+
+// finishImport records the outcome of an imported preset's save in its item
+func (s *Server) finishImport(r *http.Request, item *ImportItemResult, save importSave, err error) {
+	preset := save.preset
+	if err != nil {
+		s.log(r).Warn("Import of preset %q failed: %v", preset.Name, err)
+		item.Action = importFailed
+		item.Error = "failed to save preset"
+		if _, ok := quotaStatus(err); ok {
+			item.Error = err.Error()
+		}
+		return
+	}
+	if item.ID == "" {
+		item.ID = preset.ID
+	} else if save.reassign {
+		item.NewID = preset.ID
+	}
+	s.publishPresetSaved(preset)
+}
+
+// uniqueImportName finds a name that doesn't collide within the preset's scope
+func (s *Server) uniqueImportName(ctx context.Context, preset *storage.Preset) (string, error) {
+	for n := 1; n < 1000; n++ {
+		candidate := fmt.Sprintf("%s (imported)", preset.Name)
+		if n > 1 {
+			candidate = fmt.Sprintf("%s (imported %d)", preset.Name, n)
+		}
+		_, err := s.storage.FindPresetByKey(ctx, preset.ScopeType, preset.ScopeValue, candidate, preset.DeviceID)
+		if errors.Is(err, storage.ErrPresetNotFound) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no free name for %q", preset.Name)
+}
+
+// ImportConverterInfo describes a registered third-party import converter
+type ImportConverterInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// List the third-party formats accepted by the import endpoint
+func (s *Server) handleGetImportConverters(w http.ResponseWriter, r *http.Request) {
+	infos := make([]ImportConverterInfo, 0, len(importer.Names()))
+	for _, name := range importer.Names() {
+		c, _ := importer.Get(name)
+		infos = append(infos, ImportConverterInfo{Name: c.Name(), Description: c.Description()})
+	}
+	s.respondSuccess(w, infos, "")
+}
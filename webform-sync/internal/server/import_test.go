@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// Overwriting by name must update the device's own preset when the incoming
+// ID belongs to another device's preset, rather than insert a duplicate
+func TestImportOverwriteWithAnotherDevicesID(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	save := func(deviceID, value string) *storage.Preset {
+		now := time.Now()
+		p := &storage.Preset{
+			Name: "Login", ScopeType: storage.ScopeTypeDomain, ScopeValue: "example.com",
+			Fields: map[string]interface{}{"user": value}, DeviceID: deviceID,
+			CreatedAt: now, UpdatedAt: now,
+		}
+		if err := s.storage.SavePreset(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	theirs := save("device-a", "a")
+	ours := save("device-b", "b")
+
+	incoming := func() *storage.Preset {
+		return &storage.Preset{
+			ID: theirs.ID, Name: "Login", ScopeType: storage.ScopeTypeDomain, ScopeValue: "example.com",
+			Fields: map[string]interface{}{"user": "imported"}, DeviceID: "device-b",
+		}
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/import?conflict=overwrite", nil)
+
+	if item, _ := s.importPreset(r, 0, incoming(), conflictOverwrite, true); item.Action != importUpdated {
+		t.Fatalf("dry run action = %q, want %q (%s)", item.Action, importUpdated, item.Error)
+	}
+	item, pending := s.importPreset(r, 0, incoming(), conflictOverwrite, false)
+	if item.Action != importUpdated || pending == nil {
+		t.Fatalf("action = %q, want %q (%s)", item.Action, importUpdated, item.Error)
+	}
+	if errs := s.storage.SavePresets(ctx, []*storage.Preset{pending.preset}); errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+
+	got, err := s.storage.GetPreset(ctx, ours.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Fields["user"] != "imported" {
+		t.Errorf("device-b's preset fields = %v, want the imported ones", got.Fields)
+	}
+	got, err = s.storage.GetPreset(ctx, theirs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DeviceID != "device-a" || got.Fields["user"] != "a" {
+		t.Errorf("device-a's preset changed: %+v", got)
+	}
+}
+
+// An import saves its presets together behind a write-behind queue, while
+// still finding the conflicts between presets of the same file
+func TestImportBatchesSaves(t *testing.T) {
+	s := newTestServer(t)
+	interval := 30 * time.Second
+	if err := s.storage.EnableWriteBehind(config.WriteBehindConfig{
+		Enabled: true, BatchSize: 100, FlushIntervalMs: int(interval / time.Millisecond), QueueSize: 100,
+		Durability: storage.DurabilityBatch,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"formatVersion": 1, "presets": [
+		{"name": "One", "scopeType": "global", "deviceId": "laptop", "fields": {"n": 1}},
+		{"name": "Two", "scopeType": "global", "deviceId": "laptop", "fields": {"n": 2}},
+		{"name": "One", "scopeType": "global", "deviceId": "laptop", "fields": {"n": 3}},
+		{"name": "Three", "scopeType": "global", "deviceId": "laptop", "fields": {"n": 4}}
+	]}`
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/import?format=json&conflict=skip", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	start := time.Now()
+	s.handleImport(w, r)
+	if elapsed := time.Since(start); elapsed >= interval/2 {
+		t.Errorf("import took %v, waiting for the batch interval", elapsed)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (%s)", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	var resp struct {
+		Data ImportResult `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{importCreated, importCreated, importSkipped, importCreated}
+	for i, item := range resp.Data.Items {
+		if item.Action != want[i] || (item.Action == importCreated && item.ID == "") {
+			t.Errorf("item %d = %+v, want %s with an ID", i, item, want[i])
+		}
+	}
+	if resp.Data.Counts[importCreated] != 3 || resp.Data.Counts[importSkipped] != 1 {
+		t.Errorf("counts = %v", resp.Data.Counts)
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/jobs"
+)
+
+// List running and recently finished jobs, newest first, optionally only
+// those of one kind or status
+func (s *Server) handleGetJobs(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	status := r.URL.Query().Get("status")
+
+	list := []jobs.Info{}
+	for _, job := range s.jobManager.List(s.tenant) {
+		if (kind == "" || job.Kind == kind) && (status == "" || job.Status == status) {
+			list = append(list, job)
+		}
+	}
+	s.respondSuccess(w, list, "")
+}
+
+// Get a job
+func (s *Server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobManager.Get(mux.Vars(r)["id"], s.tenant)
+	if !ok {
+		s.respondError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	s.respondSuccess(w, job, "")
+}
+
+// Cancel a running job. It stops once its work notices; its status then
+// reads cancelled.
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := s.jobManager.Cancel(id, s.tenant); err != nil {
+		switch {
+		case errors.Is(err, jobs.ErrNotFound):
+			s.respondError(w, http.StatusNotFound, "Job not found")
+		case errors.Is(err, jobs.ErrFinished):
+			s.respondError(w, http.StatusConflict, "Job has already finished")
+		default:
+			s.respondError(w, http.StatusInternalServerError, "Failed to cancel job")
+		}
+		return
+	}
+	s.log(r).Warn("Job %s cancelled", id)
+	s.respondJSON(w, http.StatusAccepted, APIResponse{Success: true, Message: "Cancelling job"})
+}
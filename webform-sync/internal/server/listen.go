@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+)
+
+// listenLocal opens the Unix socket or named pipe named by server.listen
+func listenLocal(cfg config.ServerConfig) (net.Listener, error) {
+	scheme, path, _ := strings.Cut(cfg.Listen, ":")
+	var listener net.Listener
+	var err error
+	switch scheme {
+	case "unix":
+		listener, err = listenUnix(strings.TrimPrefix(path, "//"), cfg.SocketMode)
+	case "npipe":
+		listener, err = listenPipe(`\\` + strings.ReplaceAll(strings.TrimLeft(path, "/"), "/", `\`))
+	default:
+		err = fmt.Errorf("unsupported listen address %q", cfg.Listen)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return localListener{listener}, nil
+}
+
+// listenUnix listens on a Unix socket with the given octal permissions
+func listenUnix(path, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %q", mode)
+	}
+
+	// A socket left behind by a crash would make Listen fail, but one that
+	// still answers belongs to a running instance
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	return listener, nil
+}
+
+// localListener reports connections from a Unix socket or named pipe as
+// coming from 127.0.0.1, so access control and rate limiting, which work on
+// IP addresses, treat them as local
+type localListener struct {
+	net.Listener
+}
+
+func (l localListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return localConn{conn}, nil
+}
+
+type localConn struct {
+	net.Conn
+}
+
+var loopbackAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+func (localConn) RemoteAddr() net.Addr {
+	return loopbackAddr
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// listenPipe is only available on Windows
+func listenPipe(name string) (net.Listener, error) {
+	return nil, errors.New("named pipes are only available on Windows; use a unix:// address")
+}
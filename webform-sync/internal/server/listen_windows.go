@@ -0,0 +1,347 @@
+//go:build windows
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	kernel32                = syscall.NewLazyDLL("kernel32.dll")
+	procCreateNamedPipeW    = kernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe    = kernel32.NewProc("ConnectNamedPipe")
+	procCreateEventW        = kernel32.NewProc("CreateEventW")
+	procGetOverlappedResult = kernel32.NewProc("GetOverlappedResult")
+)
+
+const (
+	pipeAccessDuplex          = 0x3
+	fileFlagFirstPipeInstance = 0x80000
+	fileFlagOverlapped        = 0x40000000
+	pipeRejectRemoteClients   = 0x8
+	pipeUnlimitedInstances    = 255
+	pipeBufferSize            = 64 * 1024
+
+	errorOperationAborted syscall.Errno = 995
+	errorNoData           syscall.Errno = 232
+	errorPipeNotConnected syscall.Errno = 233
+	errorPipeConnected    syscall.Errno = 535
+)
+
+// pipeListener accepts connections on a named pipe. Each client gets its
+// own pipe instance, and a new one is created to wait for the next.
+//
+// All I/O is overlapped, so Close and deadlines can cancel it; net/http
+// relies on both.
+type pipeListener struct {
+	name string
+
+	// mu is held by Accept while it waits on next, the instance the next
+	// client connects to
+	mu     sync.Mutex
+	next   syscall.Handle
+	closed chan struct{}
+	once   sync.Once
+}
+
+// listenPipe creates a named pipe such as \\.\pipe\webform-sync. Remote
+// clients are refused; local ones get the default pipe security, which
+// gives the account running the service, SYSTEM and administrators full
+// access.
+func listenPipe(name string) (net.Listener, error) {
+	h, err := createPipe(name, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pipe %s: %w", name, err)
+	}
+	return &pipeListener{name: name, next: h, closed: make(chan struct{})}, nil
+}
+
+// createPipe creates an instance of the pipe. The first must be new, so
+// another process can't already be serving the name.
+func createPipe(name string, first bool) (syscall.Handle, error) {
+	path, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return syscall.InvalidHandle, err
+	}
+	flags := uintptr(pipeAccessDuplex | fileFlagOverlapped)
+	if first {
+		flags |= fileFlagFirstPipeInstance
+	}
+	h, _, err := procCreateNamedPipeW.Call(uintptr(unsafe.Pointer(path)), flags,
+		pipeRejectRemoteClients, pipeUnlimitedInstances, pipeBufferSize, pipeBufferSize, 0, 0)
+	if syscall.Handle(h) == syscall.InvalidHandle {
+		return syscall.InvalidHandle, err
+	}
+	return syscall.Handle(h), nil
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for {
+		if isClosed(l.closed) {
+			return nil, net.ErrClosed
+		}
+		h := l.next
+		_, err := overlappedIO(h, func(o *syscall.Overlapped) error {
+			r, _, err := procConnectNamedPipe.Call(uintptr(h), uintptr(unsafe.Pointer(o)))
+			if r != 0 {
+				return nil
+			}
+			return err
+		}, l.closed, nil)
+		if err != nil && err != errorPipeConnected {
+			if isClosed(l.closed) {
+				return nil, net.ErrClosed
+			}
+			// A client that went away before being accepted leaves the
+			// instance unusable; replace it and wait again
+			if err != errorNoData {
+				return nil, err
+			}
+			syscall.CloseHandle(h)
+		}
+
+		next, cerr := createPipe(l.name, false)
+		if cerr != nil {
+			return nil, fmt.Errorf("failed to create pipe instance: %w", cerr)
+		}
+		l.next = next
+		if err == nil || err == errorPipeConnected {
+			return newPipeConn(h, l.name), nil
+		}
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.mu.Lock()
+		syscall.CloseHandle(l.next)
+		l.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
+
+// pipeAddr is a named pipe's name
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn is one client's pipe instance
+type pipeConn struct {
+	h    syscall.Handle
+	name string
+
+	// mu is held for reading by each operation, so Close can wait for
+	// them to be cancelled before closing the handle
+	mu     sync.RWMutex
+	closed chan struct{}
+	once   sync.Once
+
+	readDeadline, writeDeadline *pipeDeadline
+}
+
+func newPipeConn(h syscall.Handle, name string) *pipeConn {
+	return &pipeConn{
+		h:             h,
+		name:          name,
+		closed:        make(chan struct{}),
+		readDeadline:  newPipeDeadline(),
+		writeDeadline: newPipeDeadline(),
+	}
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := c.do(c.readDeadline, func(o *syscall.Overlapped) error {
+		return syscall.ReadFile(c.h, b, nil, o)
+	})
+	if n == 0 && err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		rest := b[written:]
+		n, err := c.do(c.writeDeadline, func(o *syscall.Overlapped) error {
+			return syscall.WriteFile(c.h, rest, nil, o)
+		})
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// do runs one overlapped operation, cancelling it if the connection is
+// closed or the deadline passes
+func (c *pipeConn) do(deadline *pipeDeadline, start func(*syscall.Overlapped) error) (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if isClosed(c.closed) {
+		return 0, net.ErrClosed
+	}
+	expired := deadline.wait()
+	if isClosed(expired) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	n, err := overlappedIO(c.h, start, c.closed, expired)
+	switch {
+	case err == nil:
+		return int(n), nil
+	case err == errorOperationAborted && isClosed(c.closed):
+		return int(n), net.ErrClosed
+	case err == errorOperationAborted:
+		return int(n), os.ErrDeadlineExceeded
+	case err == syscall.ERROR_BROKEN_PIPE || err == errorNoData || err == errorPipeNotConnected:
+		return int(n), io.EOF
+	}
+	return int(n), &net.OpError{Op: "pipe", Net: "pipe", Addr: pipeAddr(c.name), Err: err}
+}
+
+func (c *pipeConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.mu.Lock()
+		syscall.CloseHandle(c.h)
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr(c.name) }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr(c.name) }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// overlappedIO starts an overlapped operation on h and waits for it,
+// cancelling it if either channel is closed first
+func overlappedIO(h syscall.Handle, start func(*syscall.Overlapped) error, cancel, expired <-chan struct{}) (uint32, error) {
+	event, _, err := procCreateEventW.Call(0, 1, 0, 0)
+	if event == 0 {
+		return 0, err
+	}
+	defer syscall.CloseHandle(syscall.Handle(event))
+	o := &syscall.Overlapped{HEvent: syscall.Handle(event)}
+
+	if err := start(o); err != nil && err != syscall.ERROR_IO_PENDING {
+		return 0, err
+	}
+
+	done := make(chan struct{})
+	var watcher sync.WaitGroup
+	watcher.Add(1)
+	go func() {
+		defer watcher.Done()
+		select {
+		case <-cancel:
+		case <-expired:
+		case <-done:
+			return
+		}
+		syscall.CancelIoEx(h, o)
+	}()
+
+	var n uint32
+	r, _, err := procGetOverlappedResult.Call(uintptr(h), uintptr(unsafe.Pointer(o)), uintptr(unsafe.Pointer(&n)), 1)
+	close(done)
+	watcher.Wait()
+	if r == 0 {
+		return n, err
+	}
+	return n, nil
+}
+
+// pipeDeadline is a deadline that can be moved while an operation waits on
+// it, as net/http does to interrupt a pending read
+type pipeDeadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newPipeDeadline() *pipeDeadline {
+	return &pipeDeadline{expired: make(chan struct{})}
+}
+
+// set moves the deadline; the zero time removes it
+func (d *pipeDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// If the timer already fired, wait for it to close the channel
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expired
+	}
+	d.timer = nil
+
+	wasExpired := isClosed(d.expired)
+	if t.IsZero() {
+		if wasExpired {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+	if wait := time.Until(t); wait > 0 {
+		if wasExpired {
+			d.expired = make(chan struct{})
+		}
+		expired := d.expired
+		d.timer = time.AfterFunc(wait, func() { close(expired) })
+		return
+	}
+	if !wasExpired {
+		close(d.expired)
+	}
+}
+
+// wait returns a channel that is closed when the deadline passes
+func (d *pipeDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
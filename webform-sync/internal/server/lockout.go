@@ -0,0 +1,146 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/events"
+)
+
+// authFailures is one IP's recent failed attempts to authenticate
+type authFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// authLockout turns away IPs that fail to authenticate too often
+type authLockout struct {
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*authFailures
+}
+
+// lockoutEventData is the event payload for auth.lockout
+type lockoutEventData struct {
+	IP    string    `json:"ip"`
+	Count int       `json:"count"`
+	Until time.Time `json:"until"`
+}
+
+// newAuthLockout creates a lockout from the authentication config, or
+// returns nil if lockouts are off
+func newAuthLockout(cfg config.LockoutConfig) *authLockout {
+	if cfg.MaxFailures <= 0 {
+		return nil
+	}
+	return &authLockout{
+		maxFailures: cfg.MaxFailures,
+		window:      time.Duration(cfg.WindowMinutes) * time.Minute,
+		duration:    time.Duration(cfg.DurationMinutes) * time.Minute,
+		clients:     make(map[string]*authFailures),
+	}
+}
+
+// locked reports whether ip is locked out, and for how much longer
+func (l *authLockout) locked(ip string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.clients[ip]
+	if !ok {
+		return 0, false
+	}
+	wait := time.Until(f.lockedUntil)
+	return wait, wait > 0
+}
+
+// fail records a failed attempt from ip. It returns the failures counted and
+// true when this attempt locks the IP out.
+func (l *authLockout) fail(ip string) (int, bool) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget IPs whose failures are too old to matter, so the map only
+	// holds clients failing right now
+	for key, f := range l.clients {
+		if now.Sub(f.first) > l.window && now.After(f.lockedUntil) {
+			delete(l.clients, key)
+		}
+	}
+
+	f, ok := l.clients[ip]
+	if !ok {
+		f = &authFailures{first: now}
+		l.clients[ip] = f
+	}
+	f.count++
+	if f.count < l.maxFailures {
+		return f.count, false
+	}
+	count := f.count
+	// Start counting afresh once the lockout ends
+	*f = authFailures{first: now, lockedUntil: now.Add(l.duration)}
+	return count, true
+}
+
+// clear forgets ip's failures after it authenticates
+func (l *authLockout) clear(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.clients, ip)
+}
+
+// remoteIP is the IP a request came from
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// lockedOut answers requests from a locked out IP with 429, returning true
+// if it did
+func (s *Server) lockedOut(w http.ResponseWriter, r *http.Request) bool {
+	if s.lockout == nil {
+		return false
+	}
+	wait, locked := s.lockout.locked(remoteIP(r))
+	if !locked {
+		return false
+	}
+	s.respondRetryLater(w, r, http.StatusTooManyRequests, "Too many failed sign-ins, try again later", wait)
+	return true
+}
+
+// authFailed counts a failed attempt to authenticate, and locks the IP out
+// once it has failed too often
+func (s *Server) authFailed(r *http.Request) {
+	if s.lockout == nil {
+		return
+	}
+	ip := remoteIP(r)
+	count, locked := s.lockout.fail(ip)
+	if !locked {
+		return
+	}
+	until := time.Now().Add(s.lockout.duration).UTC()
+	s.log(r).Warn("Locked out %s for %s after %d failed sign-ins", ip, s.lockout.duration, count)
+	s.events.Publish(events.AuthLockout, lockoutEventData{IP: ip, Count: count, Until: until})
+}
+
+// authSucceeded forgets the IP's failed attempts
+func (s *Server) authSucceeded(r *http.Request) {
+	if s.lockout != nil {
+		s.lockout.clear(remoteIP(r))
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// LogLevels reports the default log level and per-module overrides
+type LogLevels struct {
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules"`
+}
+
+// LogLevelChange is the body of PUT /admin/log-level
+type LogLevelChange struct {
+	// Module is server, storage or sync; empty changes the default level
+	Module string `json:"module,omitempty"`
+	// Level is debug, info, warn or error; empty clears a module override
+	Level string `json:"level"`
+}
+
+func (s *Server) currentLogLevels() LogLevels {
+	level, modules := s.logger.Levels()
+	return LogLevels{Level: level, Modules: modules}
+}
+
+// Get the current log levels
+func (s *Server) handleGetLogLevels(w http.ResponseWriter, r *http.Request) {
+	s.respondSuccess(w, s.currentLogLevels(), "")
+}
+
+// Change a log level at runtime, without a restart
+func (s *Server) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	// The logger is shared by every tenant, so only the service's own
+	// administrator may change it
+	if s.tenant != "" {
+		s.respondError(w, http.StatusForbidden, "Log levels can only be changed by the service administrator")
+		return
+	}
+
+	var change LogLevelChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if err := s.logger.SetLevel(change.Module, change.Level); err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	module := change.Module
+	if module == "" {
+		module = "default"
+	}
+	s.log(r).Warn("Log level for %s changed to %q", module, change.Level)
+	s.respondSuccess(w, s.currentLogLevels(), "Log level updated")
+}
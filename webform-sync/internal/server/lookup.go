@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// maxLookupPresets bounds the presets one lookup may check
+const maxLookupPresets = 500
+
+// PresetVersion is a preset a client holds and the version it holds
+type PresetVersion struct {
+	ID      string `json:"id"`
+	Version int    `json:"version"`
+}
+
+// PresetLookupRequest is the body of POST /presets/lookup
+type PresetLookupRequest struct {
+	Presets []PresetVersion `json:"presets"`
+}
+
+// PresetLookup is the answer to POST /presets/lookup: the presets that
+// moved on from the client's versions, and the IDs it should drop
+type PresetLookup struct {
+	Changed []*storage.Preset `json:"changed"`
+	// Missing are IDs that were deleted or are no longer visible to the
+	// device
+	Missing   []string `json:"missing"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// Look up a list of presets by ID, returning only those whose version
+// differs from the one the client holds
+func (s *Server) handleLookupPresets(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" {
+		s.respondError(w, http.StatusBadRequest, "device_id parameter required")
+		return
+	}
+
+	var req PresetLookupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(req.Presets) == 0 {
+		s.respondError(w, http.StatusBadRequest, "presets is required")
+		return
+	}
+	if len(req.Presets) > maxLookupPresets {
+		s.respondError(w, http.StatusBadRequest, fmt.Sprintf("At most %d presets can be looked up at once", maxLookupPresets))
+		return
+	}
+
+	held := make(map[string]int, len(req.Presets))
+	ids := make([]string, 0, len(req.Presets))
+	for _, p := range req.Presets {
+		if p.ID == "" {
+			s.respondError(w, http.StatusBadRequest, "Every preset needs an id")
+			return
+		}
+		if _, dup := held[p.ID]; !dup {
+			ids = append(ids, p.ID)
+		}
+		held[p.ID] = p.Version
+	}
+
+	presets, err := s.storage.GetPresetsByIDs(r.Context(), ids, deviceID)
+	if err != nil {
+		s.log(r).Error("Failed to look up presets: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve presets")
+		return
+	}
+
+	lookup := PresetLookup{Changed: []*storage.Preset{}, Missing: []string{}}
+	found := make(map[string]bool, len(presets))
+	for _, p := range presets {
+		found[p.ID] = true
+		if p.Version == held[p.ID] {
+			lookup.Unchanged++
+			continue
+		}
+		lookup.Changed = append(lookup.Changed, p)
+	}
+	for _, id := range ids {
+		if !found[id] {
+			lookup.Missing = append(lookup.Missing, id)
+		}
+	}
+
+	if err := s.annotateAccess(r.Context(), deviceID, lookup.Changed); err != nil {
+		s.log(r).Error("Failed to get device roles: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve presets")
+		return
+	}
+	s.transformOnRead(r.Context(), lookup.Changed...)
+
+	s.respondSuccess(w, lookup, fmt.Sprintf("%d of %d presets changed", len(lookup.Changed), len(ids)))
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/events"
+	"github.com/tezza1971/webform-sync/internal/jobs"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// maintenanceMaxJitter caps the random delay added to each maintenance
+// run, so tenants and instances sharing a disk don't all VACUUM at once
+const maintenanceMaxJitter = time.Hour
+
+// maintenanceRetryDelay is how long to wait after a failed run before
+// trying again, if that's sooner than the next scheduled one
+const maintenanceRetryDelay = 6 * time.Hour
+
+// MaintenanceStatus is the body of GET /admin/maintenance
+type MaintenanceStatus struct {
+	Enabled                bool `json:"enabled"`
+	IntervalHours          int  `json:"intervalHours"`
+	DeleteAfterDays        int  `json:"deleteAfterDays"`
+	SyncLogRetentionDays   int  `json:"syncLogRetentionDays"`
+	TombstoneRetentionDays int  `json:"tombstoneRetentionDays"`
+	UsageRetentionDays     int  `json:"usageRetentionDays"`
+	AutoCompactFreePercent int  `json:"autoCompactFreePercent"`
+	// NextRun is when the next run is due, if maintenance is enabled. It
+	// starts up to an hour later.
+	NextRun *time.Time `json:"nextRun,omitempty"`
+	// LastRun is the latest run, if there has been one
+	LastRun *storage.MaintenanceRun `json:"lastRun"`
+}
+
+// CompactResult is the body of POST /admin/db/compact
+type CompactResult struct {
+	// FreedBytes is how much the database file shrank by
+	FreedBytes int64                 `json:"freedBytes"`
+	Size       *storage.DatabaseSize `json:"size"`
+}
+
+// maintenanceJitter returns a random delay of up to a tenth of interval,
+// and no more than maintenanceMaxJitter
+func maintenanceJitter(interval time.Duration) time.Duration {
+	limit := min(interval/10, maintenanceMaxJitter)
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// nextMaintenance returns when the next maintenance run is due: an
+// interval after the last one, or now if there hasn't been one
+func (s *Server) nextMaintenance(ctx context.Context) (time.Time, error) {
+	last, err := s.storage.LastMaintenanceRun(ctx)
+	if err != nil || last == nil {
+		return time.Now(), err
+	}
+	return last.StartedAt.Add(time.Duration(s.config.Maintenance.CleanupIntervalHours) * time.Hour), nil
+}
+
+// runMaintenance runs the maintenance tasks every
+// maintenance.cleanup_interval_hours, plus a little jitter
+func (s *Server) runMaintenance() {
+	interval := time.Duration(s.config.Maintenance.CleanupIntervalHours) * time.Hour
+	next, err := s.nextMaintenance(s.ctx)
+	if err != nil {
+		s.logger.Error("Failed to read maintenance history: %v", err)
+	}
+
+	for {
+		timer := time.NewTimer(time.Until(next) + maintenanceJitter(interval))
+		select {
+		case <-timer.C:
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+
+		if !s.isLeader() {
+			next = s.followerNext(s.nextMaintenance)
+			continue
+		}
+		if run := s.maintain(s.ctx); run.Status == storage.MaintenanceFailed {
+			next = time.Now().Add(min(maintenanceRetryDelay, interval))
+		} else {
+			next = time.Now().Add(interval)
+		}
+	}
+}
+
+// retentionPolicy returns the maintenance retention rules and exemptions,
+// keeping presets no rule matches for days
+func (s *Server) retentionPolicy(days int) storage.RetentionPolicy {
+	cfg := s.config.Maintenance
+	return storage.RetentionPolicy{Days: days, Exempt: cfg.CleanupExempt, Rules: cfg.Retention}
+}
+
+// maintain removes unused presets, old sync log entries and old usage
+// events, VACUUMs the database if enough of it is free, ANALYZEs it, and
+// records the run. It runs as a job, so it can be watched and cancelled.
+func (s *Server) maintain(ctx context.Context) *storage.MaintenanceRun {
+	s.maintenanceMu.Lock()
+	defer s.maintenanceMu.Unlock()
+
+	run := &storage.MaintenanceRun{StartedAt: time.Now()}
+	err := s.jobManager.Run(ctx, jobs.Maintenance, s.tenant, func(ctx context.Context, job *jobs.Job) error {
+		return s.maintenanceTasks(ctx, job, run)
+	})
+
+	run.FinishedAt = time.Now()
+	if err != nil {
+		run.Status = storage.MaintenanceFailed
+		run.Error = err.Error()
+		s.logger.Error("Maintenance failed: %v", err)
+	} else {
+		run.Status = storage.MaintenanceOK
+		s.logger.Info("Maintenance done in %s: removed %d unused presets, %d sync log entries, %d tombstones and %d usage events; compaction freed %d bytes",
+			run.FinishedAt.Sub(run.StartedAt).Round(time.Millisecond), run.PresetsDeleted, run.SyncLogPruned, run.TombstonesExpired, run.UsageEventsPruned, run.FreedBytes)
+	}
+	s.publishSync(events.SyncCleaned, syncEventData{Count: run.PresetsDeleted})
+
+	if rerr := s.storage.RecordMaintenanceRun(ctx, run); rerr != nil {
+		s.logger.Error("Failed to record maintenance run: %v", rerr)
+	}
+	return run
+}
+
+// integrityEventData is the event payload for database.corrupt
+type integrityEventData struct {
+	Error string `json:"error"`
+}
+
+// maintenanceTasks runs each maintenance task in turn, filling in run. A
+// task that fails doesn't stop the others, but the database isn't
+// vacuumed after a failed integrity check or cleanup.
+func (s *Server) maintenanceTasks(ctx context.Context, job *jobs.Job, run *storage.MaintenanceRun) error {
+	cfg := s.config.Maintenance
+	var errs []error
+	tasks := []struct {
+		step string
+		do   func() error
+	}{
+		{"checking integrity", func() error {
+			err := s.storage.CheckIntegrity(ctx)
+			if errors.Is(err, storage.ErrCorrupt) {
+				s.events.Publish(events.DatabaseCorrupt, integrityEventData{Error: err.Error()})
+			}
+			return err
+		}},
+		{"removing unused presets", func() error {
+			cleaned, err := s.storage.CleanupOldPresets(ctx, s.retentionPolicy(cfg.DeleteAfterDays), false)
+			if err == nil {
+				run.PresetsDeleted = len(cleaned.Presets)
+			}
+			return err
+		}},
+		{"pruning the sync log", func() (err error) {
+			run.SyncLogPruned, err = s.storage.PruneSyncLog(ctx, cfg.SyncLogRetentionDays)
+			return err
+		}},
+		{"expiring tombstones", func() (err error) {
+			run.TombstonesExpired, err = s.storage.ExpireTombstones(ctx, cfg.TombstoneRetentionDays)
+			return err
+		}},
+		{"pruning usage events", func() (err error) {
+			run.UsageEventsPruned, err = s.storage.PruneUsageEvents(ctx, cfg.UsageRetentionDays)
+			return err
+		}},
+		{"compacting the database", func() error {
+			if len(errs) > 0 {
+				return nil
+			}
+			size, err := s.storage.DatabaseSize(ctx)
+			if err == nil && size.FreePercent >= float64(cfg.AutoCompactFreePercent) {
+				run.FreedBytes, err = s.storage.Compact(ctx)
+				run.Compacted = err == nil
+			}
+			return err
+		}},
+		{"analyzing the database", func() error {
+			err := s.storage.Analyze(ctx)
+			run.Optimized = err == nil
+			return err
+		}},
+	}
+
+	for i, task := range tasks {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		job.SetStep(task.step)
+		job.SetProgress(i, len(tasks))
+		if err := task.do(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Report the maintenance settings, the last run and when the next is due
+func (s *Server) handleGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config.Maintenance
+	status := MaintenanceStatus{
+		Enabled:                cfg.AutoCleanup,
+		IntervalHours:          cfg.CleanupIntervalHours,
+		DeleteAfterDays:        cfg.DeleteAfterDays,
+		SyncLogRetentionDays:   cfg.SyncLogRetentionDays,
+		TombstoneRetentionDays: cfg.TombstoneRetentionDays,
+		UsageRetentionDays:     cfg.UsageRetentionDays,
+		AutoCompactFreePercent: cfg.AutoCompactFreePercent,
+	}
+
+	var err error
+	if status.LastRun, err = s.storage.LastMaintenanceRun(r.Context()); err != nil {
+		s.log(r).Error("Failed to get maintenance history: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to get maintenance history")
+		return
+	}
+	if cfg.AutoCleanup {
+		next, err := s.nextMaintenance(r.Context())
+		if err != nil {
+			s.log(r).Error("Failed to get maintenance history: %v", err)
+			s.respondError(w, http.StatusInternalServerError, "Failed to get maintenance history")
+			return
+		}
+		status.NextRun = &next
+	}
+
+	s.respondSuccess(w, status, "")
+}
+
+// Report the database file's size, free pages and rows per table
+func (s *Server) handleGetDatabaseSize(w http.ResponseWriter, r *http.Request) {
+	size, err := s.storage.DatabaseSize(r.Context())
+	if err != nil {
+		s.log(r).Error("Failed to get database size: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to get database size")
+		return
+	}
+	s.respondSuccess(w, size, "")
+}
+
+// Compact the database with VACUUM now, in a maintenance window: writes
+// wait until it's done
+func (s *Server) handleCompactDatabase(w http.ResponseWriter, r *http.Request) {
+	if !s.maintenanceMu.TryLock() {
+		s.respondError(w, http.StatusConflict, "Maintenance is running; try again once it's done")
+		return
+	}
+	defer s.maintenanceMu.Unlock()
+
+	// The server's context rather than the request's: an interrupted
+	// VACUUM is rolled back, wasting the work. Cancel the job to stop it.
+	var freed int64
+	err := s.jobManager.Run(s.ctx, jobs.Compact, s.tenant, func(ctx context.Context, job *jobs.Job) (err error) {
+		job.SetStep("vacuuming the database")
+		freed, err = s.storage.Compact(ctx)
+		return err
+	})
+	if errors.Is(err, context.Canceled) {
+		s.respondError(w, http.StatusConflict, "Compaction was cancelled")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to compact database: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to compact database")
+		return
+	}
+	size, err := s.storage.DatabaseSize(r.Context())
+	if err != nil {
+		s.log(r).Error("Failed to get database size: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to get database size")
+		return
+	}
+	s.log(r).Info("Compacted the database, freeing %d bytes", freed)
+	s.respondSuccess(w, CompactResult{FreedBytes: freed, Size: size}, fmt.Sprintf("Freed %d bytes", freed))
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// outageCheckTimeout bounds each check of whether the database is back
+	outageCheckTimeout = 2 * time.Second
+
+	// The wait between checks of an unavailable database starts at
+	// outageMinRetry and doubles up to outageMaxRetry
+	outageMinRetry = time.Second
+	outageMaxRetry = 30 * time.Second
+)
+
+// dbOutage tracks whether an instance's database is unavailable, such as
+// when its disk is full or a network share drops out. While it is, writes
+// are refused with 503 and Retry-After rather than failing one by one,
+// preset lists are served from the cache where it has them, and the
+// database is checked again with a growing backoff until it recovers.
+type dbOutage struct {
+	mu        sync.Mutex
+	down      bool
+	since     time.Time
+	nextCheck time.Time
+}
+
+// active reports whether the database is currently unavailable
+func (o *dbOutage) active() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.down
+}
+
+// retryAfter is the time until the database is next checked
+func (o *dbOutage) retryAfter() time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return time.Until(o.nextCheck)
+}
+
+// storageFailed is called when a request fails with a server error. If the
+// database turns out to be unavailable, it starts an outage and reports
+// true, so the request can be answered with 503 instead of 500.
+func (s *Server) storageFailed() bool {
+	if s.outage.active() {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, outageCheckTimeout)
+	defer cancel()
+	err := s.storage.CheckAvailable(ctx)
+	if err == nil {
+		return false
+	}
+
+	o := s.outage
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.down {
+		return true
+	}
+	o.down = true
+	o.since = time.Now()
+	o.nextCheck = o.since.Add(outageMinRetry)
+	s.logger.Error("Database unavailable, refusing writes until it recovers: %v", err)
+	s.runJob(s.watchOutage)
+	return true
+}
+
+// watchOutage checks the database with a growing backoff until it is
+// available again, then ends the outage
+func (s *Server) watchOutage() {
+	o := s.outage
+	delay := outageMinRetry
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(s.ctx, outageCheckTimeout)
+		err := s.storage.CheckAvailable(ctx)
+		cancel()
+
+		o.mu.Lock()
+		if err == nil {
+			o.down = false
+			s.logger.Info("Database available again after %s", time.Since(o.since).Truncate(time.Second))
+			o.mu.Unlock()
+			return
+		}
+		delay = min(delay*2, outageMaxRetry)
+		o.nextCheck = time.Now().Add(delay)
+		o.mu.Unlock()
+		s.logger.Debug("Database still unavailable, checking again in %s: %v", delay, err)
+	}
+}
+
+// respondUnavailable answers a request that can't be served without the
+// database
+func (s *Server) respondUnavailable(w http.ResponseWriter, r *http.Request) {
+	retryAfterMs := setRetryAfter(w, s.outage.retryAfter())
+	msg := "Database unavailable; the service is read-only until it recovers"
+	if r != nil && strings.HasPrefix(r.URL.Path, "/api/v2/") && !wantsEnvelope(r) {
+		writeProblem(w, http.StatusServiceUnavailable, msg, retryAfterMs)
+		return
+	}
+	s.respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+		Success:      false,
+		Error:        msg,
+		ReadOnly:     true,
+		RequestID:    responseRequestID(w),
+		RetryAfterMs: retryAfterMs,
+	})
+}
+
+// readOnlyMethod reports whether a method only reads, so can go ahead
+// during an outage. PROPFIND is WebDAV's directory listing.
+func readOnlyMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return true
+	}
+	return false
+}
+
+// Middleware: refuse writes while the database is unavailable, before
+// they reach it
+func (s *Server) outageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !readOnlyMethod(r.Method) && s.outage.active() {
+			s.respondUnavailable(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
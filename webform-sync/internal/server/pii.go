@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/pii"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// piiMetadataKey is the preset metadata key listing the personal data found
+// in its fields, by kind
+const piiMetadataKey = "pii"
+
+// piiConfirmHeader confirms that a preset found to hold personal data
+// should be saved anyway, when pii_detection.mode is confirm
+const piiConfirmHeader = "X-Confirm-PII"
+
+// detectPII finds the personal data in a preset's field values, as the
+// names of the fields holding each kind
+func detectPII(fields map[string]interface{}, kinds []string) map[string][]string {
+	found := make(map[string][]string)
+	for name, value := range fields {
+		seen := make(map[string]bool)
+		detectPIIValue(value, kinds, seen)
+		for kind := range seen {
+			found[kind] = append(found[kind], name)
+		}
+	}
+	for kind := range found {
+		sort.Strings(found[kind])
+	}
+	return found
+}
+
+// detectPIIValue looks through a field value, including nested lists and
+// objects, for each kind of personal data
+func detectPIIValue(value interface{}, kinds []string, seen map[string]bool) {
+	switch v := value.(type) {
+	case string:
+		for _, kind := range pii.Detect(v, kinds) {
+			seen[kind] = true
+		}
+	case []interface{}:
+		for _, item := range v {
+			detectPIIValue(item, kinds, seen)
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			detectPIIValue(item, kinds, seen)
+		}
+	}
+}
+
+// checkPII tags a preset about to be saved with the personal data found in
+// its fields. Depending on pii_detection.mode it is then saved anyway,
+// saved only if the client confirms, or refused; a refusal comes with the
+// status to respond with. Encrypted presets can't be read, so they pass.
+func (s *Server) checkPII(r *http.Request, preset *storage.Preset) (int, error) {
+	cfg := s.config.PIIDetection
+	if cfg.Mode == "off" {
+		return 0, nil
+	}
+	// The tag is the server's to set
+	delete(preset.Metadata, piiMetadataKey)
+	if preset.Encrypted {
+		return 0, nil
+	}
+
+	found := detectPII(preset.Fields, cfg.Types)
+	if len(found) == 0 {
+		return 0, nil
+	}
+	var kinds []string
+	for _, kind := range pii.Kinds {
+		if _, ok := found[kind]; ok {
+			kinds = append(kinds, kind)
+		}
+	}
+	summary := strings.Join(kinds, ", ")
+
+	switch cfg.Mode {
+	case "block":
+		s.log(r).Warn("Preset %q rejected for personal data: %s", preset.Name, summary)
+		return http.StatusUnprocessableEntity, fmt.Errorf("fields contain personal data: %s", summary)
+	case "confirm":
+		if !strings.EqualFold(r.Header.Get(piiConfirmHeader), "true") {
+			return http.StatusPreconditionRequired, fmt.Errorf("fields contain personal data: %s; send %s: true to save anyway", summary, piiConfirmHeader)
+		}
+	}
+
+	s.log(r).Warn("Preset %q holds personal data: %s", preset.Name, summary)
+	if preset.Metadata == nil {
+		preset.Metadata = make(map[string]interface{})
+	}
+	preset.Metadata[piiMetadataKey] = found
+	return 0, nil
+}
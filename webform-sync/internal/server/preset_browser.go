@@ -0,0 +1,293 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/pii"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// adminUIPage is the admin UI: a preset browser and editor over the admin
+// API
+//
+//go:embed admin_ui.html
+var adminUIPage []byte
+
+// maskedValue replaces the values of sensitive fields in the preset browser
+const maskedValue = "********"
+
+// maskedPIIKinds are the kinds of personal data masked in the preset
+// browser. Email addresses are left visible: they are what most presets
+// are for.
+var maskedPIIKinds = []string{pii.Card, pii.IBAN, pii.SSN}
+
+// BrowsedPreset is a preset in the admin preset browser
+type BrowsedPreset struct {
+	*storage.Preset
+	// MaskedFields are the fields whose values were replaced with asterisks;
+	// ask with reveal=true to see them
+	MaskedFields []string `json:"maskedFields,omitempty"`
+}
+
+// PresetPage is the body of GET /admin/presets
+type PresetPage struct {
+	Presets []BrowsedPreset `json:"presets"`
+	Total   int             `json:"total"`
+	Limit   int             `json:"limit"`
+	Offset  int             `json:"offset"`
+}
+
+// PresetEdit is the body of PATCH /admin/presets/{id}. Only what is set
+// changes: fields not named keep their values, so masked ones can be left
+// alone.
+type PresetEdit struct {
+	Name *string `json:"name,omitempty"`
+	// Fields are field values to set, adding any new fields
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	// RemoveFields are fields to delete
+	RemoveFields []string `json:"removeFields,omitempty"`
+	// ScopeType and ScopeValue move the preset to another scope
+	ScopeType  *string `json:"scopeType,omitempty"`
+	ScopeValue *string `json:"scopeValue,omitempty"`
+}
+
+// maskPreset hides the values of a preset's sensitive fields: those the
+// field policy's patterns name, even where a scope allows them, and those
+// holding card numbers, IBANs or social security numbers. The preset itself
+// is left as it was.
+func (s *Server) maskPreset(p *storage.Preset) BrowsedPreset {
+	var masked []string
+	for name := range p.Fields {
+		if s.fieldPolicy.names(name) {
+			masked = append(masked, name)
+		}
+	}
+	for _, names := range detectPII(p.Fields, maskedPIIKinds) {
+		masked = append(masked, names...)
+	}
+	if len(masked) == 0 {
+		return BrowsedPreset{Preset: p}
+	}
+	sort.Strings(masked)
+
+	copied := *p
+	copied.Fields = make(map[string]interface{}, len(p.Fields))
+	for name, value := range p.Fields {
+		copied.Fields[name] = value
+	}
+	var names []string
+	for i, name := range masked {
+		if i > 0 && masked[i-1] == name {
+			continue
+		}
+		copied.Fields[name] = maskedValue
+		names = append(names, name)
+	}
+	// The stored copy of the fields would give the values away
+	copied.EncryptedFields = ""
+	return BrowsedPreset{Preset: &copied, MaskedFields: names}
+}
+
+// browsedPreset masks a preset unless the request asks to reveal it
+func (s *Server) browsedPreset(r *http.Request, p *storage.Preset) BrowsedPreset {
+	if reveal, _ := strconv.ParseBool(r.URL.Query().Get("reveal")); reveal {
+		return BrowsedPreset{Preset: p}
+	}
+	return s.maskPreset(p)
+}
+
+// Serve the admin UI
+func (s *Server) handleAdminUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(adminUIPage)
+}
+
+// Search presets across every device, with sensitive values masked unless
+// reveal=true
+func (s *Server) handleBrowsePresets(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := storage.PresetQuery{
+		Search:    query.Get("q"),
+		ScopeType: query.Get("scope_type"),
+		DeviceID:  query.Get("device_id"),
+		Limit:     50,
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			s.respondError(w, http.StatusBadRequest, "limit must be between 1 and 500")
+			return
+		}
+		q.Limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s.respondError(w, http.StatusBadRequest, "offset must be 0 or more")
+			return
+		}
+		q.Offset = n
+	}
+
+	presets, total, err := s.storage.SearchPresets(r.Context(), q)
+	if err != nil {
+		s.log(r).Error("Failed to search presets: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve presets")
+		return
+	}
+
+	page := PresetPage{Presets: make([]BrowsedPreset, 0, len(presets)), Total: total, Limit: q.Limit, Offset: q.Offset}
+	for _, p := range presets {
+		page.Presets = append(page.Presets, s.browsedPreset(r, p))
+	}
+	s.respondSuccess(w, page, fmt.Sprintf("Found %d presets", total))
+}
+
+// Get any preset, with sensitive values masked unless reveal=true
+func (s *Server) handleBrowsePreset(w http.ResponseWriter, r *http.Request) {
+	preset, err := s.storage.GetPreset(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrPresetNotFound) {
+		s.respondError(w, http.StatusNotFound, "Preset not found")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get preset: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve preset")
+		return
+	}
+	if reveal, _ := strconv.ParseBool(r.URL.Query().Get("reveal")); reveal {
+		s.log(r).Info("Revealed the fields of preset %s", preset.ID)
+	}
+	s.respondSuccess(w, s.browsedPreset(r, preset), "")
+}
+
+// Edit a preset's name and field values, or move it to another scope. The
+// same checks apply as when devices save presets.
+func (s *Server) handleEditPreset(w http.ResponseWriter, r *http.Request) {
+	var edit PresetEdit
+	if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	preset, err := s.storage.GetPreset(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrPresetNotFound) {
+		s.respondError(w, http.StatusNotFound, "Preset not found")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get preset: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to edit preset")
+		return
+	}
+
+	if len(edit.Fields) > 0 || len(edit.RemoveFields) > 0 {
+		if preset.Fields == nil && preset.EncryptedFields != "" {
+			s.respondError(w, http.StatusConflict, "Preset is encrypted by its device, so its fields can't be edited here")
+			return
+		}
+		if preset.Fields == nil {
+			preset.Fields = make(map[string]interface{})
+		}
+		for name, value := range edit.Fields {
+			if value == maskedValue {
+				s.respondError(w, http.StatusBadRequest, "Field "+name+" still holds the mask; send only the fields you changed")
+				return
+			}
+			preset.Fields[name] = value
+		}
+		for _, name := range edit.RemoveFields {
+			delete(preset.Fields, name)
+		}
+	}
+	if edit.Name != nil {
+		if *edit.Name == "" {
+			s.respondError(w, http.StatusBadRequest, "name can't be empty")
+			return
+		}
+		preset.Name = *edit.Name
+	}
+	if edit.ScopeType != nil || edit.ScopeValue != nil {
+		if edit.ScopeType != nil {
+			preset.ScopeType = *edit.ScopeType
+		}
+		if edit.ScopeValue != nil {
+			preset.ScopeValue = *edit.ScopeValue
+		}
+		// Any original spelling belonged to the old scope
+		delete(preset.Metadata, storage.OriginalScopeKey)
+		if err := checkScopePattern(preset); err != nil {
+			s.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !s.urlFilters.isAllowed(preset.ScopeValue) {
+			s.respondError(w, http.StatusForbidden, "URL not allowed")
+			return
+		}
+	}
+
+	if status, err := checkFieldTypes(preset); err != nil {
+		s.respondError(w, status, err.Error())
+		return
+	}
+	if status, err := s.transformOnSave(r, preset); err != nil {
+		s.respondError(w, status, err.Error())
+		return
+	}
+	if status, err := s.checkFieldPolicy(r, preset); err != nil {
+		s.respondError(w, status, err.Error())
+		return
+	}
+	if status, err := s.checkPII(r, preset); err != nil {
+		s.respondError(w, status, err.Error())
+		return
+	}
+
+	if err := s.storage.EditPreset(r.Context(), preset); err != nil {
+		switch status, quota := quotaStatus(err); {
+		case quota:
+			s.respondError(w, status, err.Error())
+		case errors.Is(err, storage.ErrPresetNotFound):
+			s.respondError(w, http.StatusNotFound, "Preset not found")
+		case errors.Is(err, storage.ErrPresetExists):
+			s.respondError(w, http.StatusConflict, "The device already has a preset with this name in that scope")
+		default:
+			s.log(r).Error("Failed to edit preset: %v", err)
+			s.respondError(w, http.StatusInternalServerError, "Failed to edit preset")
+		}
+		return
+	}
+
+	s.log(r).Info("Preset edited by admin: %s (device: %s)", preset.ID, preset.DeviceID)
+	s.publishPresetSaved(preset)
+	s.respondSuccess(w, s.maskPreset(preset), "Preset updated successfully")
+}
+
+// Delete any preset, including those belonging to a user rather than a
+// device
+func (s *Server) handleDeleteBrowsedPreset(w http.ResponseWriter, r *http.Request) {
+	preset, err := s.storage.GetPreset(r.Context(), mux.Vars(r)["id"])
+	if err == nil {
+		err = s.storage.DeletePreset(r.Context(), preset.ID, preset.DeviceID)
+	}
+	if errors.Is(err, storage.ErrPresetNotFound) {
+		s.respondError(w, http.StatusNotFound, "Preset not found")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to delete preset: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to delete preset")
+		return
+	}
+
+	s.log(r).Info("Preset deleted by admin: %s (device: %s)", preset.ID, preset.DeviceID)
+	s.publishPresetDeleted(preset.ID, preset.DeviceID)
+	s.respondSuccess(w, nil, "Preset deleted successfully")
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+	"github.com/tezza1971/webform-sync/internal/systemd"
+)
+
+// Component statuses. A warning doesn't make the service unready.
+const (
+	statusOK   = "ok"
+	statusWarn = "warn"
+	statusFail = "fail"
+)
+
+const (
+	// readinessTimeout bounds the database checks in /readyz
+	readinessTimeout = 2 * time.Second
+
+	// Free space in the data directory below which readiness warns or fails
+	lowDiskSpace      = 500 << 20
+	criticalDiskSpace = 50 << 20
+)
+
+// ComponentStatus is the result of one readiness check
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// ProbeResponse is the body of /healthz and /readyz
+type ProbeResponse struct {
+	Status     string                     `json:"status"`
+	Uptime     string                     `json:"uptime"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+// isProbe reports whether a request is for /healthz or /readyz, which are
+// answered by the default instance without a tenant
+func isProbe(r *http.Request) bool {
+	return r.URL.Path == "/healthz" || r.URL.Path == "/readyz"
+}
+
+// uptime is how long the server has been running, to the second
+func (s *Server) uptime() string {
+	return time.Since(s.started).Truncate(time.Second).String()
+}
+
+// Liveness probe: the process is up and serving requests. It deliberately
+// checks nothing else, so a struggling database doesn't get the pod killed.
+func (s *Server) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	s.respondJSON(w, http.StatusOK, ProbeResponse{Status: statusOK, Uptime: s.uptime()})
+}
+
+// Readiness probe: the service can do useful work. Returns 503 if any
+// component fails.
+func (s *Server) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	components := s.checkComponents(ctx)
+	for id, tenant := range s.tenants {
+		components["tenant:"+id] = tenant.checkDatabase(ctx)
+	}
+
+	resp := ProbeResponse{Status: statusOK, Uptime: s.uptime(), Components: components}
+	status := http.StatusOK
+	for name, c := range components {
+		switch c.Status {
+		case statusFail:
+			resp.Status = statusFail
+			status = http.StatusServiceUnavailable
+			s.log(r).Warn("Readiness check %s failed: %s", name, c.Detail)
+		case statusWarn:
+			if resp.Status == statusOK {
+				resp.Status = statusWarn
+			}
+		}
+	}
+
+	s.respondJSON(w, status, resp)
+}
+
+// checkComponents runs every readiness check for this instance
+func (s *Server) checkComponents(ctx context.Context) map[string]ComponentStatus {
+	return map[string]ComponentStatus{
+		"database":   s.checkDatabase(ctx),
+		"migrations": s.checkMigrations(),
+		"disk":       s.checkDiskSpace(),
+		"backups":    s.checkBackups(),
+	}
+}
+
+func (s *Server) checkDatabase(ctx context.Context) ComponentStatus {
+	if err := s.storage.Ping(ctx); err != nil {
+		return ComponentStatus{Status: statusFail, Detail: err.Error()}
+	}
+	return ComponentStatus{Status: statusOK}
+}
+
+func (s *Server) checkMigrations() ComponentStatus {
+	pending, err := s.storage.PendingMigrations()
+	if err != nil {
+		return ComponentStatus{Status: statusFail, Detail: err.Error()}
+	}
+	if len(pending) > 0 {
+		return ComponentStatus{Status: statusFail, Detail: "pending: " + strings.Join(pending, ", ")}
+	}
+	return ComponentStatus{Status: statusOK}
+}
+
+func (s *Server) checkDiskSpace() ComponentStatus {
+	free, err := s.storage.FreeSpace()
+	if errors.Is(err, storage.ErrFreeSpaceUnsupported) {
+		return ComponentStatus{Status: statusOK, Detail: "not checked on this platform"}
+	}
+	if err != nil {
+		return ComponentStatus{Status: statusWarn, Detail: err.Error()}
+	}
+
+	detail := fmt.Sprintf("%d MB free", free>>20)
+	switch {
+	case free < criticalDiskSpace:
+		return ComponentStatus{Status: statusFail, Detail: detail}
+	case free < lowDiskSpace:
+		return ComponentStatus{Status: statusWarn, Detail: detail}
+	}
+	return ComponentStatus{Status: statusOK, Detail: detail}
+}
+
+// checkBackups warns when backups are enabled but the newest file in the
+// backup directory is older than two backup intervals
+func (s *Server) checkBackups() ComponentStatus {
+	backup := s.config.Storage.Backup
+	if !backup.Enabled {
+		return ComponentStatus{Status: statusOK, Detail: "disabled"}
+	}
+
+	entries, err := os.ReadDir(backup.BackupDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return ComponentStatus{Status: statusWarn, Detail: err.Error()}
+	}
+
+	var newest time.Time
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	if newest.IsZero() {
+		return ComponentStatus{Status: statusWarn, Detail: "no backups in " + filepath.Clean(backup.BackupDir)}
+	}
+
+	age := time.Since(newest).Truncate(time.Minute)
+	detail := fmt.Sprintf("last backup %s ago", age)
+	if interval := time.Duration(backup.IntervalHours) * time.Hour; interval > 0 && age > 2*interval {
+		return ComponentStatus{Status: statusWarn, Detail: detail}
+	}
+	return ComponentStatus{Status: statusOK, Detail: detail}
+}
+
+// watchdog pings the systemd watchdog while the database answers, so
+// systemd restarts a service that has stopped working but not exited
+func (s *Server) watchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(s.ctx, interval)
+		err := s.storage.Ping(ctx)
+		cancel()
+		if err != nil {
+			s.logger.Warn("Skipping watchdog ping, database check failed: %v", err)
+			continue
+		}
+		if err := systemd.Notify("WATCHDOG=1"); err != nil {
+			s.logger.Warn("%v", err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// presetValueKeys are the JSON keys that carry form values
+var presetValueKeys = []string{"fields", "encryptedFields"}
+
+// presetProjection is the shape a request asks presets to take, from its
+// ?fields=a,b,c and ?include_fields=false query parameters
+type presetProjection struct {
+	includeValues bool
+	selected      []string
+}
+
+// parseProjection reads and validates a request's projection
+func parseProjection(r *http.Request) (presetProjection, error) {
+	query := r.URL.Query()
+
+	proj := presetProjection{includeValues: true}
+	if v := query.Get("include_fields"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return proj, fmt.Errorf("include_fields must be true or false")
+		}
+		proj.includeValues = b
+	}
+
+	if v := query.Get("fields"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				proj.selected = append(proj.selected, name)
+			}
+		}
+	}
+
+	if err := validatePresetKeys(proj.selected); err != nil {
+		return proj, err
+	}
+	return proj, nil
+}
+
+// full reports whether the projection leaves presets untouched
+func (proj presetProjection) full() bool {
+	return proj.includeValues && len(proj.selected) == 0
+}
+
+// apply shapes a single preset
+func (proj presetProjection) apply(p *storage.Preset) (interface{}, error) {
+	if proj.full() {
+		return p, nil
+	}
+
+	// Without a field list, just drop the value payloads
+	if len(proj.selected) == 0 {
+		cp := *p
+		cp.Fields = nil
+		cp.EncryptedFields = ""
+		return &cp, nil
+	}
+
+	full, err := presetToMap(p)
+	if err != nil {
+		return nil, err
+	}
+
+	item := make(map[string]interface{}, len(proj.selected))
+	for _, key := range proj.selected {
+		if !proj.includeValues && isValueKey(key) {
+			continue
+		}
+		if v, ok := full[key]; ok {
+			item[key] = v
+		}
+	}
+	return item, nil
+}
+
+// projectPresets shapes a preset list according to the request's
+// ?fields=a,b,c and ?include_fields=false query parameters
+func projectPresets(r *http.Request, presets []*storage.Preset) (interface{}, error) {
+	proj, err := parseProjection(r)
+	if err != nil {
+		return nil, err
+	}
+	if proj.full() {
+		return presets, nil
+	}
+
+	shaped := make([]interface{}, 0, len(presets))
+	for _, p := range presets {
+		item, err := proj.apply(p)
+		if err != nil {
+			return nil, err
+		}
+		shaped = append(shaped, item)
+	}
+	return shaped, nil
+}
+
+// presetKeys lists the JSON keys a client may project
+var presetKeys = map[string]bool{
+	"id": true, "name": true, "scopeType": true, "scopeValue": true,
+	"fields": true, "encryptedFields": true, "encrypted": true,
+	"createdAt": true, "updatedAt": true, "lastUsed": true, "useCount": true,
+	"deviceId": true, "metadata": true, "version": true, "sharedGroupId": true,
+	"userId": true, "access": true,
+}
+
+// validatePresetKeys rejects unknown projection keys
+func validatePresetKeys(keys []string) error {
+	for _, key := range keys {
+		if !presetKeys[key] {
+			return fmt.Errorf("unknown field in projection: %s", key)
+		}
+	}
+	return nil
+}
+
+// presetToMap converts a preset to its JSON object representation
+func presetToMap(p *storage.Preset) (map[string]interface{}, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func isValueKey(key string) bool {
+	for _, k := range presetValueKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// quotaStatus maps a quota error from SavePreset to its HTTP status: 413 for
+// size limits, 429 for the preset count limit
+func quotaStatus(err error) (int, bool) {
+	var qe *storage.QuotaError
+	if !errors.As(err, &qe) {
+		return 0, false
+	}
+	if qe.Limit == storage.QuotaPresets {
+		return http.StatusTooManyRequests, true
+	}
+	return http.StatusRequestEntityTooLarge, true
+}
+
+// Get a device's storage usage and limits
+func (s *Server) handleGetDeviceUsage(w http.ResponseWriter, r *http.Request) {
+	usage, err := s.storage.GetDeviceUsage(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.log(r).Error("Failed to get device usage: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve device usage")
+		return
+	}
+
+	s.respondSuccess(w, usage, "")
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+)
+
+// rateLimitSweepInterval is how often idle buckets are dropped
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket holds up to capacity tokens, refilled continuously
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimit is one route group's limit
+type rateLimit struct {
+	capacity float64
+	perSec   float64
+}
+
+// rateLimiter keeps a token bucket per client and route group. Groups
+// prefixed with device: count each device on its own, on top of the
+// client's own limit.
+type rateLimiter struct {
+	key    string
+	limits map[string]rateLimit
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// deviceGroupPrefix marks the route groups limited per device
+const deviceGroupPrefix = "device:"
+
+// newRateLimiter creates a limiter from the performance config, or returns
+// nil if rate limiting is off
+func newRateLimiter(cfg config.PerformanceConfig) *rateLimiter {
+	limits := map[string]rateLimit{}
+	add := func(group string, perMinute, burst int) {
+		if perMinute <= 0 {
+			return
+		}
+		if burst <= 0 {
+			burst = perMinute
+		}
+		limits[group] = rateLimit{capacity: float64(burst), perSec: float64(perMinute) / 60}
+	}
+	add("read", cfg.RateLimits.Read, cfg.RateLimits.Burst)
+	add("write", cfg.RateLimits.Write, cfg.RateLimits.Burst)
+	device := cfg.RateLimits.Device
+	add(deviceGroupPrefix+"read", device.Read, device.Burst)
+	add(deviceGroupPrefix+"write", device.Write, device.Burst)
+	if len(limits) == 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		key:       cfg.RateLimits.Key,
+		limits:    limits,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// routeGroup classifies a request as a read or a write. WebDAV listings
+// are reads, as are preset lookups, which are POSTs only because their ID
+// lists are too long for a query string.
+func routeGroup(r *http.Request) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == "PROPFIND" {
+		return "read"
+	}
+	if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/presets/lookup") {
+		return "read"
+	}
+	return "write"
+}
+
+// clientKey identifies the client a request is counted against
+func (l *rateLimiter) clientKey(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	token := tokenFingerprint(r)
+	switch l.key {
+	case "token":
+		if token != "" {
+			return "token:" + token
+		}
+		return "ip:" + ip
+	case "ip_token":
+		return "ip:" + ip + "|token:" + token
+	default:
+		return "ip:" + ip
+	}
+}
+
+// deviceKey identifies the device a request is counted against, or ""
+// if it names none. The token is part of it, so a client can't use up
+// another's requests by sending its device ID. The limiter runs before
+// routing, so a v2 path's device is read from the path itself.
+func deviceKey(r *http.Request) string {
+	id := requestDeviceID(r)
+	if id == "" {
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/api/v2/devices/"); ok {
+			id, _, _ = strings.Cut(rest, "/")
+		}
+	}
+	if id == "" {
+		return ""
+	}
+	return "device:" + id + "|token:" + tokenFingerprint(r)
+}
+
+// rateDecision is the outcome of taking a token from one bucket
+type rateDecision struct {
+	// scope is client or device, whichever bucket decided
+	scope      string
+	limit      rateLimit
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+	ok         bool
+}
+
+// allow takes a token for the request from the client's bucket, and from
+// the device's bucket when devices are limited too. It returns the
+// decision to report: a refusal if either refused, otherwise the bucket
+// with the fewest tokens left. limit.capacity is 0 when nothing limits
+// the request.
+func (l *rateLimiter) allow(r *http.Request) rateDecision {
+	group := routeGroup(r)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	decision := rateDecision{ok: true}
+	if limit, limited := l.limits[group]; limited {
+		decision = l.take(group+"|"+l.clientKey(r), limit, now)
+		decision.scope = "client"
+	}
+	if limit, limited := l.limits[deviceGroupPrefix+group]; limited {
+		if device := deviceKey(r); device != "" {
+			d := l.take(deviceGroupPrefix+group+"|"+device, limit, now)
+			d.scope = "device"
+			if decision.limit.capacity == 0 || (decision.ok && (!d.ok || d.remaining < decision.remaining)) {
+				decision = d
+			}
+		}
+	}
+	return decision
+}
+
+// take takes a token from a bucket. retryAfter is the wait for the next
+// token when the bucket was empty; reset the time until it is full again.
+func (l *rateLimiter) take(key string, limit rateLimit, now time.Time) rateDecision {
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: limit.capacity, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(limit.capacity, bucket.tokens+now.Sub(bucket.last).Seconds()*limit.perSec)
+	bucket.last = now
+
+	d := rateDecision{limit: limit, ok: bucket.tokens >= 1}
+	if d.ok {
+		bucket.tokens--
+	} else {
+		d.retryAfter = time.Duration((1 - bucket.tokens) / limit.perSec * float64(time.Second))
+	}
+	d.reset = time.Duration((limit.capacity - bucket.tokens) / limit.perSec * float64(time.Second))
+	d.remaining = int(bucket.tokens)
+	return d
+}
+
+// sweep drops buckets that have refilled completely, which behave the same
+// as a new bucket
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		group, _, _ := strings.Cut(key, "|")
+		limit := l.limits[group]
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*limit.perSec >= limit.capacity {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Middleware: per-client rate limiting with RateLimit-* headers. Probes and
+// CORS preflights are never limited.
+func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isProbe(r) || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		d := s.rateLimiter.allow(r)
+		if d.limit.capacity > 0 {
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(int(d.limit.capacity)))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(d.reset.Seconds()))))
+			w.Header().Set("RateLimit-Scope", d.scope)
+		}
+		if !d.ok {
+			msg := "Rate limit exceeded"
+			if d.scope == "device" {
+				msg = "Rate limit exceeded for this device"
+				s.log(r).Warn("Device rate limit exceeded by %s", deviceKey(r))
+			} else {
+				s.log(r).Warn("Rate limit exceeded by %s", s.rateLimiter.clientKey(r))
+			}
+			s.respondRetryLater(w, r, http.StatusTooManyRequests, msg, d.retryAfter)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseCIDRs parses IP addresses and CIDR ranges; a single address becomes
+// a /32 or /128 range. Invalid entries are skipped, since the config has
+// been validated.
+func parseCIDRs(entries []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			continue
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets
+}
+
+// containsIP reports whether ip is in any of the ranges
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware: behind a trusted reverse proxy, replace RemoteAddr with the
+// client address the proxy forwarded, so access control, rate limiting and
+// logs see the client rather than the proxy. Forwarding headers from any
+// other peer are ignored, since a client can send whatever it likes.
+func realIPMiddleware(trusted []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			peer = r.RemoteAddr
+		}
+		if ip := net.ParseIP(peer); ip != nil && containsIP(trusted, ip) {
+			if client := forwardedClient(r, trusted); client != "" {
+				r.RemoteAddr = client
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClient finds the client address in the forwarding headers of a
+// request from a trusted proxy, or returns "". In X-Forwarded-For each proxy
+// appends the address it received the request from, so the client is the
+// rightmost entry that isn't itself a trusted proxy; anything left of that
+// could have been made up by the client.
+func forwardedClient(r *http.Request, trusted []*net.IPNet) string {
+	if header := r.Header.Values("X-Forwarded-For"); len(header) > 0 {
+		hops := strings.Split(strings.Join(header, ","), ",")
+		client := ""
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			client = ip.String()
+			if !containsIP(trusted, ip) {
+				break
+			}
+		}
+		return client
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/systemd"
+	"gopkg.in/yaml.v3"
+)
+
+// configPollInterval is how often WatchConfig checks the file for changes
+const configPollInterval = 2 * time.Second
+
+// WatchConfig reloads the config file at path when it changes, and on SIGHUP
+// where the platform has it. Only logging levels, authentication, access
+// control, trusted proxies, URL filters, the field policy, PII detection,
+// CORS and rate limits are reloaded;
+// other changes are reported and wait for a restart. The URL filter files
+// are watched too, and reloaded on their own when only they change.
+func (s *Server) WatchConfig(path string) {
+	signals := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		signal.Notify(signals, reloadSignals...)
+	}
+	modTime := fileModTime(path)
+	filterTimes := s.filterFileModTimes()
+
+	s.runJob(func() {
+		defer signal.Stop(signals)
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case sig := <-signals:
+				s.logger.Info("Received %s, reloading %s", sig, path)
+			case <-ticker.C:
+				if fileModTime(path).Equal(modTime) {
+					if times := s.filterFileModTimes(); times != filterTimes {
+						filterTimes = times
+						s.logger.Info("URL filter files changed, reloading")
+						if err := s.reloadFilters(); err != nil {
+							s.logger.Error("Filter reload failed, keeping the current filters: %v", err)
+						}
+					}
+					continue
+				}
+				s.logger.Info("%s changed, reloading", path)
+			}
+
+			modTime = fileModTime(path)
+			systemd.Notify("RELOADING=1")
+			if err := s.reloadConfig(path); err != nil {
+				s.logger.Error("Config reload rejected, keeping the current config: %v", err)
+			}
+			systemd.Notify("READY=1")
+			filterTimes = s.filterFileModTimes()
+		}
+	})
+}
+
+// filterFileModTimes identifies the current versions of the URL filter files
+func (s *Server) filterFileModTimes() string {
+	cfg := s.current.Load().config.URLFilter
+	var times []string
+	for _, file := range []string{cfg.WhitelistFile, cfg.BlacklistFile} {
+		if file != "" {
+			times = append(times, fileModTime(file).String())
+		}
+	}
+	return strings.Join(times, ",")
+}
+
+// reloadFilters rebuilds the running instance with its current config, so
+// the filter files and entries are read again
+func (s *Server) reloadFilters() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	cur := s.current.Load()
+	next, err := cur.reconfigure(cur.config)
+	if err != nil {
+		return err
+	}
+	s.current.Store(next)
+	return nil
+}
+
+// fileModTime returns a file's modification time, or the zero time if it
+// can't be read
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadConfig loads path and applies its reloadable sections. Either every
+// change takes effect or, if any part fails, none does.
+func (s *Server) reloadConfig(path string) error {
+	loaded, err := config.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	cur := s.current.Load()
+	cfg := *cur.config
+	cfg.Logging.Level = loaded.Logging.Level
+	cfg.Logging.Modules = loaded.Logging.Modules
+	cfg.Authentication = loaded.Authentication
+	cfg.AccessControl = loaded.AccessControl
+	cfg.Server.TrustedProxies = loaded.Server.TrustedProxies
+	cfg.URLFilter = loaded.URLFilter
+	cfg.FieldPolicy = loaded.FieldPolicy
+	cfg.PIIDetection = loaded.PIIDetection
+	cfg.CORS = loaded.CORS
+	cfg.Performance.RateLimit = loaded.Performance.RateLimit
+	cfg.Performance.RateLimits = loaded.Performance.RateLimits
+
+	if pending := configDiff(&cfg, loaded); len(pending) > 0 {
+		s.logger.Warn("Config changes that need a restart: %s", strings.Join(pending, "; "))
+	}
+	// Rebuild even without changes, so the filter files are read again
+	changes := configDiff(cur.config, &cfg)
+	next, err := cur.reconfigure(&cfg)
+	if err != nil {
+		return err
+	}
+
+	// Levels were validated by LoadConfig, so this can't fail part way.
+	// Only touch them if the file changed, to keep levels set at runtime.
+	if !reflect.DeepEqual(cur.config.Logging, cfg.Logging) {
+		s.logger.SetLevel("", cfg.Logging.Level)
+		for _, module := range config.LogModules {
+			s.logger.SetLevel(module, cfg.Logging.Modules[module])
+		}
+	}
+
+	s.current.Store(next)
+	if len(changes) == 0 {
+		s.logger.Info("Config reloaded, no settings changed")
+	}
+	for _, change := range changes {
+		s.logger.Info("Config reloaded: %s", change)
+	}
+	return nil
+}
+
+// reconfigure builds a new instance of the server, and of each tenant, from
+// cfg. Storage, events, background jobs and share secrets carry over;
+// filters, the rate limiter and the routes are rebuilt. Requests already in
+// progress finish on the old instance.
+func (s *Server) reconfigure(cfg *config.Config) (*Server, error) {
+	entries, err := s.storage.GetFilterEntries(s.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load filter entries: %w", err)
+	}
+	urlFilters, err := loadURLFilters(cfg.URLFilter, entries, s.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load URL filters: %w", err)
+	}
+	ipFilters, err := loadIPFilters(cfg.AccessControl, entries, s.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load IP filters: %w", err)
+	}
+
+	next := *s
+	next.config = cfg
+	next.urlFilters = urlFilters
+	next.ipFilters = ipFilters
+	next.fieldPolicy = newFieldPolicy(cfg.FieldPolicy)
+	// Keep the buckets unless the limits changed
+	if cfg.Performance.RateLimit != s.config.Performance.RateLimit ||
+		cfg.Performance.RateLimits != s.config.Performance.RateLimits {
+		next.rateLimiter = newRateLimiter(cfg.Performance)
+	}
+	// Keep the failure counts unless the lockout settings changed
+	if cfg.Authentication.Lockout != s.config.Authentication.Lockout {
+		next.lockout = newAuthLockout(cfg.Authentication.Lockout)
+	}
+	if authProviderChanged(s.config.Authentication, cfg.Authentication) {
+		if next.authProvider, err = newAuthProvider(cfg.Authentication); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.tenants != nil {
+		next.tenants = make(map[string]*Server, len(s.tenants))
+		for _, t := range cfg.Tenancy.Tenants {
+			tenant := *s.tenants[t.ID]
+			tenantCfg := next.tenantConfig(t)
+			tenant.config = &tenantCfg
+			tenant.urlFilters = urlFilters
+			tenant.ipFilters = ipFilters
+			tenant.fieldPolicy = next.fieldPolicy
+			tenant.lockout = next.lockout
+			tenant.authProvider = next.authProvider
+			if err := tenant.buildRoutes(); err != nil {
+				return nil, fmt.Errorf("tenant %s: %w", t.ID, err)
+			}
+			next.tenants[t.ID] = &tenant
+		}
+	}
+
+	if err := next.buildRoutes(); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// buildRoutes rebuilds the GraphQL schema and router for the current config
+func (s *Server) buildRoutes() error {
+	schema, err := s.buildGraphQLSchema()
+	if err != nil {
+		return fmt.Errorf("failed to build GraphQL schema: %w", err)
+	}
+	s.graphqlSchema = schema
+	s.setupRouter()
+	return nil
+}
+
+// configDiff lists the settings that differ between two configs, as
+// "key: old -> new", with secrets masked
+func configDiff(old, new *config.Config) []string {
+	before, after := flattenConfig(old), flattenConfig(new)
+
+	keys := make([]string, 0, len(after))
+	for key := range after {
+		keys = append(keys, key)
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []string
+	for _, key := range keys {
+		was, is := before[key], after[key]
+		if was == is {
+			continue
+		}
+		if secretKey(key) {
+			changes = append(changes, key+" changed")
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %q -> %q", key, was, is))
+	}
+	return changes
+}
+
+// secretKey reports whether a setting holds a credential
+func secretKey(key string) bool {
+	name := key[strings.LastIndex(key, ".")+1:]
+	for _, word := range []string{"token", "password", "secret", "key"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// flattenConfig renders a config as dotted YAML keys and their values
+func flattenConfig(cfg *config.Config) map[string]string {
+	flat := map[string]string{}
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return flat
+	}
+	var tree interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return flat
+	}
+	flatten("", tree, flat)
+	return flat
+}
+
+func flatten(prefix string, value interface{}, flat map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flatten(key, child, flat)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flatten(fmt.Sprintf("%s[%d]", prefix, i), child, flat)
+		}
+	case nil:
+	default:
+		flat[prefix] = fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignals trigger a config reload
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package server
+
+import "os"
+
+// reloadSignals trigger a config reload. Windows has no SIGHUP, so only file
+// changes do.
+var reloadSignals []os.Signal
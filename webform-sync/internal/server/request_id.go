@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/tezza1971/webform-sync/internal/logger"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// requestIDHeader carries the request ID in both directions
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern limits incoming IDs to what's safe in logs and headers
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+// Middleware: give each request an ID, honouring a well-formed X-Request-ID
+// from the client or a proxy. The ID is echoed in the response header, tags
+// every log line written through s.log(r) and is added to error payloads.
+func (s *Server) requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = storage.NewPresetID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), loggerContextKey, s.logger.WithRequestID(id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// log returns the logger for a request, which tags lines with its ID
+func (s *Server) log(r *http.Request) *logger.Logger {
+	return s.logContext(r.Context())
+}
+
+// logContext returns the logger for a request's context, for code that
+// only has the context
+func (s *Server) logContext(ctx context.Context) *logger.Logger {
+	if l, ok := ctx.Value(loggerContextKey).(*logger.Logger); ok {
+		return l
+	}
+	return s.logger
+}
+
+// responseRequestID returns the ID set on a response by requestIDMiddleware
+func responseRequestID(w http.ResponseWriter) string {
+	return w.Header().Get(requestIDHeader)
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Scope match levels, most specific first
+const (
+	matchExact             = "exact"
+	matchPath              = "path"
+	matchOrigin            = "origin"
+	matchDomain            = "domain"
+	matchParentDomain      = "parentDomain"
+	matchRegistrableDomain = "registrableDomain"
+	matchWildcard          = "wildcard"
+	matchRegex             = "regex"
+	matchGlobal            = "global"
+)
+
+// ScopeMatch is a scope that applies to a page, with its presets
+type ScopeMatch struct {
+	// Level is how the scope matched: exact, path, origin, domain,
+	// parentDomain, registrableDomain, wildcard, regex or global
+	Level      string            `json:"level"`
+	ScopeType  string            `json:"scopeType"`
+	ScopeValue string            `json:"scopeValue"`
+	Presets    []*storage.Preset `json:"presets"`
+}
+
+// ScopeResolution is the body of GET /scopes/resolve
+type ScopeResolution struct {
+	URL               string       `json:"url"`
+	RegistrableDomain string       `json:"registrableDomain,omitempty"`
+	Matches           []ScopeMatch `json:"matches"`
+	// Policy is the autofill policy of the most specific scope that has one
+	Policy *storage.ScopePolicy `json:"policy,omitempty"`
+}
+
+// scopeCandidate is a scope that would apply to a page, if it had presets
+type scopeCandidate struct {
+	level string
+	scope storage.Scope
+}
+
+// scopeCandidates lists the scopes that apply to a page, most specific
+// first: the URL itself, its parent paths, its origin, its host, the
+// parent domains of the host down to the registrable domain (eTLD+1), and
+// global. URL scopes may be stored with or without a scheme, so both are
+// listed.
+func scopeCandidates(u *url.URL) (candidates []scopeCandidate, registrable string) {
+	seen := make(map[storage.Scope]bool)
+	add := func(level, scopeType, value string) {
+		scope := storage.Scope{Type: scopeType, Value: value}
+		if !seen[scope] {
+			seen[scope] = true
+			candidates = append(candidates, scopeCandidate{level, scope})
+		}
+	}
+	addURL := func(level, rest string) {
+		add(level, storage.ScopeTypeURL, u.Scheme+"://"+u.Host+rest)
+		add(level, storage.ScopeTypeURL, u.Host+rest)
+	}
+
+	path := u.EscapedPath()
+	if u.RawQuery != "" {
+		addURL(matchExact, path+"?"+u.RawQuery)
+	} else {
+		addURL(matchExact, path)
+	}
+	for path != "" {
+		addURL(matchPath, path)
+		path = strings.TrimSuffix(path, "/")
+		addURL(matchPath, path)
+		path = path[:strings.LastIndex(path, "/")+1]
+		if path == "/" {
+			path = ""
+		}
+	}
+	addURL(matchOrigin, "")
+
+	host := u.Hostname()
+	add(matchDomain, storage.ScopeTypeDomain, storage.NormalizeScope(storage.ScopeTypeDomain, u.Host))
+	add(matchDomain, storage.ScopeTypeDomain, host)
+	if net.ParseIP(host) == nil {
+		if etld1, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+			registrable = etld1
+			for parent := host; parent != etld1; {
+				parent = parent[strings.Index(parent, ".")+1:]
+				level := matchParentDomain
+				if parent == etld1 {
+					level = matchRegistrableDomain
+				}
+				add(level, storage.ScopeTypeDomain, parent)
+			}
+		}
+	}
+
+	add(matchGlobal, storage.ScopeTypeGlobal, "")
+	return candidates, registrable
+}
+
+// patternMatches returns the wildcard and regex scopes among presets that
+// match u, wildcards first. Patterns that no longer compile are skipped.
+func (s *Server) patternMatches(r *http.Request, u *url.URL, presets []*storage.Preset) []ScopeMatch {
+	var wildcards, regexes []ScopeMatch
+	index := make(map[storage.Scope]*ScopeMatch)
+	for _, p := range presets {
+		scope := storage.Scope{Type: p.ScopeType, Value: p.ScopeValue}
+		if m, ok := index[scope]; ok {
+			if m != nil {
+				m.Presets = append(m.Presets, p)
+			}
+			continue
+		}
+		index[scope] = nil
+
+		pattern, err := compileScopePattern(p.ScopeType, p.ScopeValue)
+		if err != nil {
+			s.log(r).Warn("Skipping scope %s %q of preset %s: %v", p.ScopeType, p.ScopeValue, p.ID, err)
+			continue
+		}
+		if !pattern.matches(u) {
+			continue
+		}
+		match := ScopeMatch{Level: p.ScopeType, ScopeType: p.ScopeType, ScopeValue: p.ScopeValue, Presets: []*storage.Preset{p}}
+		if p.ScopeType == storage.ScopeTypeWildcard {
+			wildcards = append(wildcards, match)
+		} else {
+			regexes = append(regexes, match)
+		}
+	}
+	return append(wildcards, regexes...)
+}
+
+// pageURL parses the url query parameter of a request about a page,
+// answering it if the URL is unusable or blocked by the URL filter
+func (s *Server) pageURL(w http.ResponseWriter, r *http.Request) (*url.URL, bool) {
+	rawURL := r.URL.Query().Get("url")
+	u, err := url.Parse(storage.NormalizeScope(storage.ScopeTypeURL, rawURL))
+	if rawURL == "" || err != nil || !strings.Contains(rawURL, "://") || u.Hostname() == "" {
+		s.respondError(w, http.StatusBadRequest, "url must be an absolute URL")
+		return nil, false
+	}
+	u.Fragment, u.RawFragment = "", ""
+
+	if !s.urlFilters.isAllowed(u.String()) {
+		s.log(r).Warn("URL blocked by filter: %s", u.String())
+		s.respondError(w, http.StatusForbidden, "URL not allowed")
+		return nil, false
+	}
+	return u, true
+}
+
+// resolvePage finds the presets visible to deviceID for the page at u,
+// grouped by the scopes that matched, in priority order from the exact URL
+// through wildcard and regex scopes down to global presets. It also
+// returns how many presets there are.
+func (s *Server) resolvePage(r *http.Request, u *url.URL, deviceID string) (*ScopeResolution, int, error) {
+	candidates, registrable := scopeCandidates(u)
+	scopes := make([]storage.Scope, len(candidates))
+	for i, c := range candidates {
+		scopes[i] = c.scope
+	}
+	presets, err := s.storage.GetPresetsInScopes(r.Context(), scopes, deviceID)
+	if err != nil {
+		return nil, 0, err
+	}
+	patterned, err := s.storage.GetPresetsByScopeTypes(r.Context(), []string{storage.ScopeTypeWildcard, storage.ScopeTypeRegex}, deviceID)
+	if err != nil {
+		return nil, 0, err
+	}
+	patterns := s.patternMatches(r, u, patterned)
+	for _, m := range patterns {
+		presets = append(presets, m.Presets...)
+	}
+	s.transformOnRead(r.Context(), presets...)
+	if err := s.annotateAccess(r.Context(), deviceID, presets); err != nil {
+		return nil, 0, fmt.Errorf("failed to get device roles: %w", err)
+	}
+
+	byScope := make(map[storage.Scope][]*storage.Preset)
+	for _, p := range presets {
+		scope := storage.Scope{Type: p.ScopeType, Value: p.ScopeValue}
+		byScope[scope] = append(byScope[scope], p)
+	}
+	policy, err := s.effectivePolicy(r.Context(), deviceID, candidates)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get scope policy: %w", err)
+	}
+
+	resolution := &ScopeResolution{URL: u.String(), RegistrableDomain: registrable, Matches: []ScopeMatch{}, Policy: policy}
+	for _, c := range candidates {
+		if c.level == matchGlobal {
+			// Patterns are less specific than any scope naming the site
+			resolution.Matches = append(resolution.Matches, patterns...)
+		}
+		if found := byScope[c.scope]; len(found) > 0 {
+			resolution.Matches = append(resolution.Matches, ScopeMatch{
+				Level:      c.level,
+				ScopeType:  c.scope.Type,
+				ScopeValue: c.scope.Value,
+				Presets:    found,
+			})
+		}
+	}
+	return resolution, len(presets), nil
+}
+
+// Find the presets for a page, given its full URL, so the extension
+// doesn't have to guess how their scopes were stored. Matches are in
+// priority order, from the exact URL through wildcard and regex scopes
+// down to global presets.
+func (s *Server) handleResolveScope(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	if !s.requireDeviceScope(w, r, deviceID) {
+		return
+	}
+
+	u, ok := s.pageURL(w, r)
+	if !ok {
+		return
+	}
+
+	resolution, count, err := s.resolvePage(r, u, deviceID)
+	if err != nil {
+		s.log(r).Error("Failed to resolve scope: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve presets")
+		return
+	}
+
+	s.respondSuccess(w, resolution, fmt.Sprintf("Found %d presets in %d scopes", count, len(resolution.Matches)))
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// PreRestorePrefix names the copy of the database taken before a full
+// restore. It doesn't look like a scheduled backup, so rotation keeps it.
+const PreRestorePrefix = "pre-restore-"
+
+// Restore modes
+const (
+	restoreFull    = "full"
+	restoreStaging = "staging"
+)
+
+// RestoreRequest is the body of POST /admin/restore
+type RestoreRequest struct {
+	// Backup is the name of a backup in the backup directory
+	Backup string `json:"backup"`
+	// Mode is full (the default) to replace the data with the backup's, or
+	// staging to stage its presets for recovering chosen ones
+	Mode string `json:"mode"`
+	// Confirm must be true to restore; otherwise only the preview is returned
+	Confirm bool `json:"confirm"`
+}
+
+// RestoreResult is the body of POST /admin/restore
+type RestoreResult struct {
+	Backup string `json:"backup"`
+	Mode   string `json:"mode"`
+	// Restored is false for a preview
+	Restored bool `json:"restored"`
+	// SafetyBackup is the copy of the database taken before a full restore
+	SafetyBackup string `json:"safetyBackup,omitempty"`
+	// Presets is how many presets were restored or staged
+	Presets int                     `json:"presets"`
+	Preview *storage.RestorePreview `json:"preview"`
+}
+
+// RecoverRequest is the body of POST /admin/restore/staging/recover
+type RecoverRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// PreRestoreBackup copies the database to dir before a full restore, so
+// the restore can be undone, and returns the copy's path
+func PreRestoreBackup(ctx context.Context, store *storage.Storage, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	name := PreRestorePrefix + time.Now().UTC().Format(backupTimeLayout)
+	path := filepath.Join(dir, name+backupFileExt)
+	// Restores a second apart would otherwise want the same name
+	for n := 2; ; n++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", name, n, backupFileExt))
+	}
+	return path, store.BackupTo(ctx, path)
+}
+
+// isRestorable reports whether name is a backup or pre-restore copy, and
+// not a path
+func isRestorable(name string) bool {
+	return filepath.Base(name) == name && strings.HasSuffix(name, backupFileExt) &&
+		(strings.HasPrefix(name, backupFilePrefix) || strings.HasPrefix(name, PreRestorePrefix))
+}
+
+// Preview restoring a backup, and restore it, or stage its presets, once
+// confirmed. A full restore first copies the database beside the backups.
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	var req RestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = restoreFull
+	}
+	if req.Mode != restoreFull && req.Mode != restoreStaging {
+		s.respondError(w, http.StatusBadRequest, "mode must be full or staging")
+		return
+	}
+	if !isRestorable(req.Backup) {
+		s.respondError(w, http.StatusBadRequest, "backup must be the name of a backup or pre-restore copy in the backup directory")
+		return
+	}
+	path := filepath.Join(s.backupDir(), req.Backup)
+	if _, err := os.Stat(path); err != nil {
+		s.respondError(w, http.StatusNotFound, "Backup not found")
+		return
+	}
+
+	result := RestoreResult{Backup: req.Backup, Mode: req.Mode}
+	preview, err := s.storage.PreviewRestore(r.Context(), path)
+	if err != nil {
+		s.respondRestoreError(w, r, err)
+		return
+	}
+	result.Preview = preview
+	if !req.Confirm {
+		s.respondSuccess(w, result, "Preview only: set confirm to true to restore")
+		return
+	}
+
+	if req.Mode == restoreStaging {
+		if result.Presets, err = s.storage.StageBackup(r.Context(), path); err != nil {
+			s.respondRestoreError(w, r, err)
+			return
+		}
+		result.Restored = true
+		s.log(r).Warn("Staged %d presets from backup %s", result.Presets, req.Backup)
+		s.respondSuccess(w, result, fmt.Sprintf("Staged %d presets", result.Presets))
+		return
+	}
+
+	if result.SafetyBackup, err = PreRestoreBackup(r.Context(), s.storage, s.backupDir()); err != nil {
+		s.log(r).Error("Failed to back up the database before restoring: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to back up the database before restoring")
+		return
+	}
+
+	if result.Presets, err = s.storage.RestoreBackup(r.Context(), path); err != nil {
+		s.respondRestoreError(w, r, err)
+		return
+	}
+	result.Restored = true
+	s.log(r).Warn("Restored backup %s (%d presets); the database before it is in %s", req.Backup, result.Presets, result.SafetyBackup)
+	s.respondSuccess(w, result, fmt.Sprintf("Restored %d presets", result.Presets))
+}
+
+func (s *Server) respondRestoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, storage.ErrInvalidBackup) {
+		s.respondError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	s.log(r).Error("Failed to restore backup: %v", err)
+	s.respondError(w, http.StatusInternalServerError, "Failed to restore backup")
+}
+
+// List the presets staged from a backup, and whether each is missing or
+// changed now
+func (s *Server) handleGetStagedPresets(w http.ResponseWriter, r *http.Request) {
+	staged, err := s.storage.GetStagedPresets(r.Context())
+	if err != nil {
+		if errors.Is(err, storage.ErrNothingStaged) {
+			s.respondError(w, http.StatusNotFound, "No backup is staged")
+			return
+		}
+		s.log(r).Error("Failed to get staged presets: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to get staged presets")
+		return
+	}
+	s.respondSuccess(w, staged, "")
+}
+
+// Copy chosen staged presets back into the database
+func (s *Server) handleRecoverStaged(w http.ResponseWriter, r *http.Request) {
+	var req RecoverRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(req.IDs) == 0 {
+		s.respondError(w, http.StatusBadRequest, "ids must list the staged presets to recover")
+		return
+	}
+
+	recovered, err := s.storage.RecoverStaged(r.Context(), req.IDs)
+	if err != nil {
+		if errors.Is(err, storage.ErrNothingStaged) {
+			s.respondError(w, http.StatusNotFound, "No backup is staged")
+			return
+		}
+		s.log(r).Error("Failed to recover staged presets: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to recover presets")
+		return
+	}
+	s.log(r).Warn("Recovered %d staged presets", recovered)
+	s.respondSuccess(w, map[string]int{"recovered": recovered}, fmt.Sprintf("Recovered %d presets", recovered))
+}
+
+// Drop the staged presets
+func (s *Server) handleClearStaging(w http.ResponseWriter, r *http.Request) {
+	if err := s.storage.ClearStaging(r.Context()); err != nil {
+		s.log(r).Error("Failed to clear staging: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to clear staging")
+		return
+	}
+	s.respondSuccess(w, nil, "Staging cleared")
+}
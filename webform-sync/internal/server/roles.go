@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// deviceUserID returns the user owning a device, or "" when it has none or
+// isn't registered
+func (s *Server) deviceUserID(ctx context.Context, deviceID string) (string, error) {
+	if deviceID == "" {
+		return "", nil
+	}
+	device, err := s.storage.GetDevice(ctx, deviceID)
+	if errors.Is(err, storage.ErrDeviceNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return device.UserID, nil
+}
+
+// presetRole returns the role deviceID holds over a preset
+func (s *Server) presetRole(ctx context.Context, preset *storage.Preset, deviceID string) (string, error) {
+	roles := map[string]string{}
+	if preset.SharedGroupID != "" && preset.DeviceID != deviceID {
+		role, err := s.storage.GroupRole(ctx, preset.SharedGroupID, deviceID)
+		if err != nil {
+			return "", err
+		}
+		roles[preset.SharedGroupID] = role
+	}
+	var userID string
+	if preset.DeviceID == "" && deviceID != "" {
+		var err error
+		if userID, err = s.deviceUserID(ctx, deviceID); err != nil {
+			return "", err
+		}
+	}
+	return storage.PresetRole(preset, deviceID, userID, roles), nil
+}
+
+// annotateAccess fills in the requesting device's role on listed presets
+func (s *Server) annotateAccess(ctx context.Context, deviceID string, presets []*storage.Preset) error {
+	if deviceID == "" {
+		return nil
+	}
+	roles, err := s.storage.GetDeviceRoles(ctx, deviceID)
+	var userID string
+	if err == nil {
+		userID, err = s.deviceUserID(ctx, deviceID)
+	}
+	if err != nil {
+		// Lists served from the cache during an outage go without access
+		if s.storageFailed() {
+			return nil
+		}
+		return err
+	}
+	for _, preset := range presets {
+		preset.Access = storage.PresetRole(preset, deviceID, userID, roles)
+	}
+	return nil
+}
+
+// authorizePresetWrite checks that deviceID holds at least the role need
+// over an existing preset and returns the owning device. It returns
+// storage.ErrPresetNotFound for unknown presets and storage.ErrRoleDenied
+// when the role falls short.
+func (s *Server) authorizePresetWrite(ctx context.Context, id, deviceID, need string) (string, error) {
+	preset, err := s.presets.GetPreset(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	role, err := s.presetRole(ctx, preset, deviceID)
+	if err != nil {
+		return "", err
+	}
+	if !storage.RoleAllows(role, need) {
+		return "", storage.ErrRoleDenied
+	}
+	return preset.DeviceID, nil
+}
+
+// groupOwnerOnly wraps a /groups/{id} handler so that per-user tokens need a
+// device (X-Device-ID or device_id) holding the owner role in the group
+func (s *Server) groupOwnerOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestUser(r) == nil {
+			next(w, r)
+			return
+		}
+
+		deviceID := requestDeviceID(r)
+		if deviceID == "" {
+			s.respondError(w, http.StatusForbidden, "Admin token or group owner device required")
+			return
+		}
+		role, err := s.storage.GroupRole(r.Context(), mux.Vars(r)["id"], deviceID)
+		if err != nil {
+			s.log(r).Error("Failed to check group role: %v", err)
+			s.respondError(w, http.StatusInternalServerError, "Failed to check group role")
+			return
+		}
+		if role != storage.RoleOwner {
+			s.respondError(w, http.StatusForbidden, "Group owner role required")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// Device-less presets are only editable by devices of the user they belong
+// to, the same ones they are listed to
+func TestPresetRoleDevicelessPresets(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	alice, _, err := s.storage.CreateUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, _, err := s.storage.CreateUser(ctx, "mallory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, user := range map[string]*storage.User{"alice-laptop": alice, "mallory-laptop": mallory} {
+		if _, err := s.storage.RegisterDevice(ctx, &storage.Device{ID: id, UserID: user.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		preset *storage.Preset
+		device string
+		want   string
+	}{
+		{"own user", &storage.Preset{UserID: alice.ID}, "alice-laptop", storage.RoleEditor},
+		{"other user", &storage.Preset{UserID: alice.ID}, "mallory-laptop", ""},
+		{"no user", &storage.Preset{}, "mallory-laptop", ""},
+		{"unowned device", &storage.Preset{}, "kiosk", storage.RoleEditor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.presetRole(ctx, tt.preset, tt.device)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("role = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// maxScopePatternLength bounds wildcard and regex scope values
+const maxScopePatternLength = 1000
+
+// scopePattern is a compiled wildcard or regex scope value
+type scopePattern struct {
+	re *regexp.Regexp
+	// target is the part of a URL the pattern is matched against
+	target func(u *url.URL) string
+}
+
+func urlHost(u *url.URL) string { return u.Host }
+
+func urlWithoutScheme(u *url.URL) string {
+	return strings.TrimPrefix(u.String(), u.Scheme+"://")
+}
+
+func urlString(u *url.URL) string { return u.String() }
+
+// compileScopePattern compiles a wildcard or regex scope value. A wildcard
+// ignores case and matches the whole of what it's compared with: the URL
+// if it has a scheme, the URL without its scheme if it has a path, and
+// otherwise the host, so "*.corp.example.com" covers every page of every
+// subdomain. A regex is matched against the URL, scheme included, and
+// anchors only where it says so.
+func compileScopePattern(scopeType, value string) (*scopePattern, error) {
+	if value == "" {
+		return nil, errors.New("scope value is required")
+	}
+	if len(value) > maxScopePatternLength {
+		return nil, fmt.Errorf("scope value is longer than %d characters", maxScopePatternLength)
+	}
+
+	switch scopeType {
+	case storage.ScopeTypeWildcard:
+		if strings.Trim(value, "*./") == "" {
+			return nil, fmt.Errorf("wildcard scope %q matches every site: use a global scope", value)
+		}
+		target := urlHost
+		switch {
+		case strings.Contains(value, "://"):
+			target = urlString
+		case strings.Contains(value, "/"):
+			target = urlWithoutScheme
+		}
+		escaped := strings.ReplaceAll(regexp.QuoteMeta(value), `\*`, ".*")
+		return &scopePattern{re: regexp.MustCompile("(?i)^" + escaped + "$"), target: target}, nil
+
+	case storage.ScopeTypeRegex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex scope: %v", err)
+		}
+		return &scopePattern{re: re, target: urlString}, nil
+	}
+	return nil, fmt.Errorf("scope type %q is not a pattern", scopeType)
+}
+
+func (p *scopePattern) matches(u *url.URL) bool {
+	return p.re.MatchString(p.target(u))
+}
+
+// checkScopePattern validates the scope of a preset about to be saved, if
+// it is a wildcard or regex
+func checkScopePattern(preset *storage.Preset) error {
+	if preset.ScopeType != storage.ScopeTypeWildcard && preset.ScopeType != storage.ScopeTypeRegex {
+		return nil
+	}
+	_, err := compileScopePattern(preset.ScopeType, strings.TrimSpace(preset.ScopeValue))
+	return err
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// maxNeverStoreFields caps the field patterns of a scope policy
+const maxNeverStoreFields = 100
+
+// ScopePolicyRequest is the body of PUT /scope-policies
+type ScopePolicyRequest struct {
+	DeviceID            string   `json:"deviceId"`
+	ScopeType           string   `json:"scopeType"`
+	ScopeValue          string   `json:"scopeValue"`
+	Mode                string   `json:"mode"`
+	NeverStore          []string `json:"neverStore"`
+	RequireConfirmation bool     `json:"requireConfirmation"`
+}
+
+// policyScope reads and checks the scope of a policy. Policies are set on
+// url, domain and global scopes, which page URLs resolve to.
+func policyScope(scopeType, scopeValue string) (storage.Scope, error) {
+	switch scopeType {
+	case storage.ScopeTypeURL, storage.ScopeTypeDomain:
+		if scopeValue == "" {
+			return storage.Scope{}, errors.New("scopeValue is required")
+		}
+	case storage.ScopeTypeGlobal:
+		scopeValue = ""
+	default:
+		return storage.Scope{}, errors.New("scopeType must be url, domain or global")
+	}
+	return storage.Scope{Type: scopeType, Value: storage.NormalizeScope(scopeType, scopeValue)}, nil
+}
+
+// presetScopeCandidates lists the scopes whose policies cover a preset's
+// scope, most specific first, as scopeCandidates does for a page.
+// Wildcard and regex scopes are only covered by global policies.
+func presetScopeCandidates(scopeType, scopeValue string) []scopeCandidate {
+	var u *url.URL
+	switch scopeType {
+	case storage.ScopeTypeURL:
+		raw := scopeValue
+		if !strings.Contains(raw, "://") {
+			raw = "https://" + raw
+		}
+		u, _ = url.Parse(raw)
+	case storage.ScopeTypeDomain:
+		u = &url.URL{Scheme: "https", Host: scopeValue}
+	}
+	if u == nil || u.Hostname() == "" {
+		return []scopeCandidate{{matchGlobal, storage.Scope{Type: storage.ScopeTypeGlobal}}}
+	}
+
+	candidates, _ := scopeCandidates(u)
+	if scopeType == storage.ScopeTypeDomain {
+		// A domain covers pages on any path, so URL policies don't apply
+		domains := candidates[:0]
+		for _, c := range candidates {
+			if c.scope.Type != storage.ScopeTypeURL {
+				domains = append(domains, c)
+			}
+		}
+		candidates = domains
+	}
+	return candidates
+}
+
+// effectivePolicy returns the policy of the most specific candidate that
+// deviceID's user has one for, or nil
+func (s *Server) effectivePolicy(ctx context.Context, deviceID string, candidates []scopeCandidate) (*storage.ScopePolicy, error) {
+	scopes := make([]storage.Scope, len(candidates))
+	for i, c := range candidates {
+		scopes[i] = c.scope
+	}
+	policies, err := s.storage.GetScopePolicies(ctx, deviceID, scopes)
+	if err != nil {
+		return nil, err
+	}
+	byScope := make(map[storage.Scope]*storage.ScopePolicy, len(policies))
+	for _, p := range policies {
+		byScope[storage.Scope{Type: p.ScopeType, Value: p.ScopeValue}] = p
+	}
+	for _, c := range candidates {
+		if p := byScope[c.scope]; p != nil {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// applyNeverStore drops the fields of a preset about to be saved that the
+// scope policy covering it never stores, returning their names
+func (s *Server) applyNeverStore(ctx context.Context, preset *storage.Preset) ([]string, error) {
+	if preset.Encrypted || len(preset.Fields) == 0 || preset.ScopeType == storage.ScopeTypeStorage {
+		return nil, nil
+	}
+	policy, err := s.effectivePolicy(ctx, preset.DeviceID, presetScopeCandidates(preset.ScopeType, preset.ScopeValue))
+	if err != nil || policy == nil || len(policy.NeverStore) == 0 {
+		return nil, err
+	}
+
+	patterns := fieldPatterns(policy.NeverStore)
+	var dropped []string
+	for name := range preset.Fields {
+		if matchesAny(patterns, normalizeFieldName(name)) {
+			dropped = append(dropped, name)
+			delete(preset.Fields, name)
+		}
+	}
+	return dropped, nil
+}
+
+// List scope policies
+func (s *Server) handleGetScopePolicies(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	if !s.requireDeviceScope(w, r, deviceID) || !s.authorizeDevice(w, r, deviceID) {
+		return
+	}
+
+	policies, err := s.storage.ListScopePolicies(r.Context(), deviceID)
+	if err != nil {
+		s.log(r).Error("Failed to get scope policies: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve scope policies")
+		return
+	}
+	s.respondSuccess(w, policies, fmt.Sprintf("Retrieved %d scope policies", len(policies)))
+}
+
+// Set the autofill policy of a scope
+func (s *Server) handleSetScopePolicy(w http.ResponseWriter, r *http.Request) {
+	var body ScopePolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if body.DeviceID == "" {
+		s.respondError(w, http.StatusBadRequest, "device_id is required")
+		return
+	}
+	if !s.admitDevice(w, r, body.DeviceID) {
+		return
+	}
+	scope, err := policyScope(body.ScopeType, body.ScopeValue)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch body.Mode {
+	case "":
+		body.Mode = storage.AutofillSuggest
+	case storage.AutofillAuto, storage.AutofillSuggest, storage.AutofillOff:
+	default:
+		s.respondError(w, http.StatusBadRequest, "mode must be auto, suggest or off")
+		return
+	}
+	if len(body.NeverStore) > maxNeverStoreFields {
+		s.respondError(w, http.StatusBadRequest, fmt.Sprintf("neverStore can list at most %d fields", maxNeverStoreFields))
+		return
+	}
+	for _, field := range body.NeverStore {
+		if strings.TrimSpace(field) == "" {
+			s.respondError(w, http.StatusBadRequest, "neverStore fields can't be empty")
+			return
+		}
+	}
+	if scope.Value != "" && !s.urlFilters.isAllowed(scope.Value) {
+		s.log(r).Warn("URL blocked by filter: %s", scope.Value)
+		s.respondError(w, http.StatusForbidden, "URL not allowed")
+		return
+	}
+
+	policy := &storage.ScopePolicy{
+		ScopeType:           scope.Type,
+		ScopeValue:          scope.Value,
+		Mode:                body.Mode,
+		NeverStore:          body.NeverStore,
+		RequireConfirmation: body.RequireConfirmation,
+		DeviceID:            body.DeviceID,
+	}
+	if err := s.storage.SetScopePolicy(r.Context(), policy); err != nil {
+		s.log(r).Error("Failed to set scope policy: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to set scope policy")
+		return
+	}
+
+	s.log(r).Info("Scope policy set: %s %s %s (device: %s)", policy.ScopeType, policy.ScopeValue, policy.Mode, policy.DeviceID)
+	s.respondSuccess(w, policy, "Scope policy saved successfully")
+}
+
+// Remove the policy of a scope
+func (s *Server) handleDeleteScopePolicy(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	deviceID := query.Get("device_id")
+	if deviceID == "" {
+		s.respondError(w, http.StatusBadRequest, "device_id parameter required")
+		return
+	}
+	if !s.authorizeDevice(w, r, deviceID) {
+		return
+	}
+	scope, err := policyScope(query.Get("scope_type"), query.Get("scope_value"))
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.storage.DeleteScopePolicy(r.Context(), deviceID, scope); err != nil {
+		if errors.Is(err, storage.ErrScopePolicyNotFound) {
+			s.respondError(w, http.StatusNotFound, "Scope policy not found")
+			return
+		}
+		s.log(r).Error("Failed to delete scope policy: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to delete scope policy")
+		return
+	}
+	s.respondSuccess(w, nil, "Scope policy deleted successfully")
+}
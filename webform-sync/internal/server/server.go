@@ -2,71 +2,275 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/graphql-go/graphql"
 	"github.com/rs/cors"
+	"github.com/tezza1971/webform-sync/internal/certs"
 	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/events"
+	"github.com/tezza1971/webform-sync/internal/jobs"
 	"github.com/tezza1971/webform-sync/internal/logger"
 	"github.com/tezza1971/webform-sync/internal/storage"
+	"github.com/tezza1971/webform-sync/internal/systemd"
+	"github.com/tezza1971/webform-sync/internal/transform"
+	"github.com/tezza1971/webform-sync/plugin"
+	"golang.org/x/net/webdav"
 )
 
 // Server represents the HTTP server
 type Server struct {
-	config     *config.Config
-	storage    *storage.Storage
-	logger     *logger.Logger
+	config    *config.Config
+	storage   *storage.Storage
+	logger    *logger.Logger
+	accessLog *logger.AccessLog
+
+	// presets serves the preset routes: storage, or the storage backend
+	// plugin named by storage.backend
+	presets storage.PresetStore
+
+	// rateLimiter is shared by all tenants; nil when rate limiting is off
+	rateLimiter *rateLimiter
+	// lockout tracks failed sign-ins across tenants; nil when lockouts
+	// are off
+	lockout *authLockout
+	// authProvider checks credentials when authentication.type is plugin,
+	// shared by tenants
+	authProvider plugin.AuthProvider
+	// transforms is the script run over preset fields on save and read,
+	// shared by tenants; nil when transforms are off
+	transforms *transform.Script
 	httpServer *http.Server
 	router     *mux.Router
-	urlFilters *URLFilters
-	ipFilters  *IPFilters
+
+	// redirectServer sends plain HTTP to HTTPS when TLS is on; autocert
+	// manages the certificate when it comes from ACME. Either may be nil.
+	redirectServer *http.Server
+	autocert       *certs.Manager
+
+	// handler is the full middleware chain around router; current is the
+	// instance whose handler serves requests, replaced on config reload
+	handler http.Handler
+	current *atomic.Pointer[Server]
+	// reloadMu serialises config reloads and filter changes
+	reloadMu *sync.Mutex
+	// backupMu serialises backups of this instance's database, scheduled
+	// and on demand; maintenanceMu does the same for maintenance runs and
+	// compaction
+	backupMu      *sync.Mutex
+	maintenanceMu *sync.Mutex
+
+	// jobManager tracks backups, maintenance, cleanups and imports so they
+	// can be watched and cancelled; tenants share it
+	jobManager *jobs.Manager
+	// outage tracks whether this instance's database is unavailable
+	outage *dbOutage
+	// leader decides which replica runs scheduled work in cluster mode;
+	// nil when cluster mode is off. Tenants share it.
+	leader *leaderElection
+
+	// requests counts traffic for the dashboard, across tenants
+	requests *requestCounter
+
+	// storageSync holds the chrome.storage.sync API's recent changes and
+	// write counts
+	storageSync *storageSyncArea
+	// davLocks holds WebDAV clients' locks
+	davLocks webdav.LockSystem
+
+	// slots caps concurrent requests; nil when unlimited
+	slots chan struct{}
+
+	urlFilters  *URLFilters
+	ipFilters   *IPFilters
+	fieldPolicy *fieldPolicy
+
+	// corsOrigins are the origins added through the admin API; nil in
+	// tenant instances, since CORS is applied before tenant dispatch
+	corsOrigins *corsOrigins
+
+	graphqlSchema graphql.Schema
+
+	// shareSecret signs share links
+	shareSecret []byte
+
+	events *events.Bus
+
+	// stop ends background tasks on shutdown; jobs tracks them
+	stop chan struct{}
+	jobs *sync.WaitGroup
+
+	// ctx is the parent of every request's context and of background
+	// queries. Shutdown cancels it once the grace period is over, so
+	// queries still in flight are aborted rather than left running.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// started is when the server was created, for uptime
+	started time.Time
+
+	// tenant is the tenant this instance serves ("" for the default one);
+	// tenants holds the tenant instances requests are dispatched to
+	tenant  string
+	tenants map[string]*Server
 }
 
 // URLFilters handles URL whitelist/blacklist
 type URLFilters struct {
-	whitelist          []*regexp.Regexp
-	blacklist          []*regexp.Regexp
+	whitelist          []urlRule
+	blacklist          []urlRule
 	enabled            bool
 	whitelistOverrides bool
 }
 
 // IPFilters handles IP access control
 type IPFilters struct {
-	whitelist []*net.IPNet
-	blacklist []*net.IPNet
+	whitelist []ipRule
+	blacklist []ipRule
 	mode      string
 }
 
+// urlRule is a compiled URL filter pattern, and the entry it came from
+type urlRule struct {
+	*regexp.Regexp
+	entry FilterPattern
+}
+
+// ipRule is an IP range, and the entry it came from
+type ipRule struct {
+	*net.IPNet
+	entry FilterPattern
+}
+
 // NewServer creates a new server instance
 func NewServer(cfg *config.Config, store *storage.Storage, log *logger.Logger) (*Server, error) {
+	log = log.Module("server")
+
+	// Entries added through the admin API extend the files and config
+	entries, err := store.GetFilterEntries(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load filter entries: %w", err)
+	}
+
 	// Initialize URL filters
-	urlFilters, err := loadURLFilters(cfg.URLFilter, log)
+	urlFilters, err := loadURLFilters(cfg.URLFilter, entries, log)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load URL filters: %w", err)
 	}
 
 	// Initialize IP filters
-	ipFilters, err := loadIPFilters(cfg.AccessControl, log)
+	ipFilters, err := loadIPFilters(cfg.AccessControl, entries, log)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load IP filters: %w", err)
 	}
 
+	store.EnableCache(cfg.Performance.Cache)
+	store.EnableSyncLogBuffer(cfg.Performance.SyncLog)
+	if err := store.EnableWriteBehind(cfg.Performance.WriteBehind); err != nil {
+		return nil, err
+	}
+	presets, err := store.OpenPresetStore(cfg.Storage.Backend, "")
+	if err != nil {
+		return nil, err
+	}
+
+	shareSecret, err := newShareSecret(cfg.Sharing.Secret)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Sharing.Secret == "" {
+		log.Warn("sharing.secret is not set; share links will stop working on restart")
+	}
+
+	transforms, err := loadTransforms(cfg.Transforms, log)
+	if err != nil {
+		return nil, err
+	}
+	authProvider, err := newAuthProvider(cfg.Authentication)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	srv := &Server{
-		config:     cfg,
-		storage:    store,
-		logger:     log,
-		urlFilters: urlFilters,
-		ipFilters:  ipFilters,
+		config:        cfg,
+		storage:       store,
+		presets:       presets,
+		logger:        log,
+		accessLog:     logger.NewAccessLog(cfg.Logging),
+		rateLimiter:   newRateLimiter(cfg.Performance),
+		lockout:       newAuthLockout(cfg.Authentication.Lockout),
+		urlFilters:    urlFilters,
+		ipFilters:     ipFilters,
+		fieldPolicy:   newFieldPolicy(cfg.FieldPolicy),
+		transforms:    transforms,
+		authProvider:  authProvider,
+		stop:          make(chan struct{}),
+		jobs:          &sync.WaitGroup{},
+		ctx:           ctx,
+		cancel:        cancel,
+		started:       time.Now(),
+		shareSecret:   shareSecret,
+		events:        newEventBus(cfg, "", store, log),
+		current:       &atomic.Pointer[Server]{},
+		reloadMu:      &sync.Mutex{},
+		backupMu:      &sync.Mutex{},
+		maintenanceMu: &sync.Mutex{},
+		jobManager:    jobs.NewManager(),
+		leader:        newLeaderElection(cfg.Cluster, store, log),
+		outage:        &dbOutage{},
+		requests:      &requestCounter{},
+		storageSync:   newStorageSyncArea(),
+		davLocks:      webdav.NewMemLS(),
+	}
+	if n := cfg.Performance.MaxConcurrentRequests; n > 0 {
+		srv.slots = make(chan struct{}, n)
+	}
+	publishCacheInvalidations(cfg, store, srv.events)
+
+	srv.corsOrigins = &corsOrigins{}
+	if err := srv.corsOrigins.load(ctx, store); err != nil {
+		return nil, fmt.Errorf("failed to load CORS origins: %w", err)
+	}
+
+	// Build GraphQL schema
+	schema, err := srv.buildGraphQLSchema()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build GraphQL schema: %w", err)
+	}
+	srv.graphqlSchema = schema
+
+	if cfg.Tenancy.Enabled {
+		if err := srv.openTenants(); err != nil {
+			return nil, err
+		}
 	}
 
 	// Setup router
 	srv.setupRouter()
+	srv.current.Store(srv)
+
+	srv.httpServer = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			srv.current.Load().handler.ServeHTTP(w, r)
+		}),
+		ReadTimeout:  time.Duration(cfg.Server.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(cfg.Server.WriteTimeout) * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return srv.ctx },
+	}
+	if err := srv.setupTLS(); err != nil {
+		return nil, fmt.Errorf("failed to set up TLS: %w", err)
+	}
 
 	return srv, nil
 }
@@ -76,29 +280,89 @@ func (s *Server) setupRouter() {
 	r := mux.NewRouter()
 
 	// Middleware
+	r.Use(s.slowRequestMiddleware)
 	r.Use(s.loggingMiddleware)
+	r.Use(s.apiVersionMiddleware)
 	r.Use(s.ipFilterMiddleware)
+	r.Use(s.outageMiddleware)
 	if s.config.Authentication.Enabled {
 		r.Use(s.authMiddleware)
 	}
+	r.Use(s.deviceMiddleware)
+
+	// Container probes
+	r.HandleFunc("/healthz", s.handleLiveness).Methods("GET")
+	r.HandleFunc("/readyz", s.handleReadiness).Methods("GET")
+
+	// Presets as files for WebDAV clients
+	if s.config.WebDAV.Enabled {
+		r.Handle(webdavPrefix, http.HandlerFunc(s.handleWebDAV))
+		r.PathPrefix(webdavPrefix + "/").HandlerFunc(s.handleWebDAV)
+	}
 
 	// API routes
 	api := r.PathPrefix("/api/v1").Subrouter()
 
 	// Health check
 	api.HandleFunc("/health", s.handleHealth).Methods("GET")
+	api.HandleFunc("/discovery", s.handleDiscovery).Methods("GET")
+	api.HandleFunc("/capabilities", s.handleGetCapabilities).Methods("GET")
 
 	// Presets endpoints
+	api.HandleFunc("/presets/stats", s.handleGetStats).Methods("GET")
+	if s.config.FeatureEnabled(config.FeatureSuggestions) {
+		api.HandleFunc("/presets/suggest", s.handleSuggestPresets).Methods("GET")
+	}
+	api.HandleFunc("/presets/transfer", s.handleBulkTransfer).Methods("POST")
+	api.HandleFunc("/presets/stream", s.handleStreamPresets).Methods("GET")
+	api.HandleFunc("/presets/lookup", s.handleLookupPresets).Methods("POST")
 	api.HandleFunc("/presets", s.handleGetPresets).Methods("GET")
 	api.HandleFunc("/presets", s.handleSavePreset).Methods("POST")
 	api.HandleFunc("/presets/{id}", s.handleGetPreset).Methods("GET")
 	api.HandleFunc("/presets/{id}", s.handleUpdatePreset).Methods("PUT")
 	api.HandleFunc("/presets/{id}", s.handleDeletePreset).Methods("DELETE")
 	api.HandleFunc("/presets/{id}/usage", s.handleUpdateUsage).Methods("POST")
+	api.HandleFunc("/presets/{id}/usage", s.handleGetPresetUsage).Methods("GET")
+	api.HandleFunc("/presets/{id}/transfer", s.handleTransferPreset).Methods("POST")
+	api.HandleFunc("/presets/{id}/share", s.handleSharePreset).Methods("PUT")
+	api.HandleFunc("/presets/{id}/share", s.handleUnsharePreset).Methods("DELETE")
+	if s.config.FeatureEnabled(config.FeatureShareLinks) {
+		api.HandleFunc("/presets/{id}/share", s.handleCreateShareLink).Methods("POST")
+	}
+
+	// Conflict copies of saves based on an outdated version
+	api.HandleFunc("/conflicts", s.handleGetConflicts).Methods("GET")
+	api.HandleFunc("/conflicts/{id}", s.handleGetConflict).Methods("GET")
+	api.HandleFunc("/conflicts/{id}/resolve", s.handleResolveConflict).Methods("POST")
+
+	// Share links, served without authentication
+	if s.config.FeatureEnabled(config.FeatureShareLinks) {
+		api.HandleFunc("/shared/{token}", s.handleGetSharedPreset).Methods("GET")
+	}
 
 	// Scope-based retrieval
 	api.HandleFunc("/presets/scope/{type}/{value}", s.handleGetPresetsByScope).Methods("GET")
 
+	// Scope listing
+	api.HandleFunc("/scopes", s.handleGetScopes).Methods("GET")
+	api.HandleFunc("/scopes/resolve", s.handleResolveScope).Methods("GET")
+	api.HandleFunc("/usage/domains", s.handleGetDomainUsage).Methods("GET")
+	api.HandleFunc("/scope-policies", s.handleGetScopePolicies).Methods("GET")
+	api.HandleFunc("/scope-policies", s.handleSetScopePolicy).Methods("PUT")
+	api.HandleFunc("/scope-policies", s.handleDeleteScopePolicy).Methods("DELETE")
+
+	// Form schemas
+	api.HandleFunc("/schemas", s.handleResolveFormSchemas).Methods("GET")
+	api.HandleFunc("/schemas", s.handleSaveFormSchema).Methods("PUT")
+	api.HandleFunc("/schemas/scope/{type}/{value}", s.handleGetFormSchemasByScope).Methods("GET")
+	api.HandleFunc("/schemas/{id}", s.handleDeleteFormSchema).Methods("DELETE")
+
+	// Fill failures and selector remaps
+	api.HandleFunc("/fill-failures", s.handleGetFillFailures).Methods("GET")
+	api.HandleFunc("/fill-failures", s.handleReportFillFailures).Methods("POST")
+	api.HandleFunc("/fill-failures", s.handleClearFillFailures).Methods("DELETE")
+	api.HandleFunc("/fill-failures/remap", s.handleRemapSelectors).Methods("POST")
+
 	// Disabled domains endpoints
 	api.HandleFunc("/disabled-domains", s.handleGetDisabledDomains).Methods("GET")
 	api.HandleFunc("/disabled-domains/{domain}", s.handleDisableDomain).Methods("POST")
@@ -107,36 +371,271 @@ func (s *Server) setupRouter() {
 
 	// Device management
 	api.HandleFunc("/devices", s.handleGetDevices).Methods("GET")
+	api.HandleFunc("/devices", s.handleRegisterDevice).Methods("POST")
+	api.HandleFunc("/devices/stale", s.adminOnly(s.handleGetStaleDevices)).Methods("GET")
+	api.HandleFunc("/devices/{id}", s.ownDevice(s.handleGetDevice)).Methods("GET")
+	api.HandleFunc("/devices/{id}", s.ownDevice(s.handleRenameDevice)).Methods("PUT")
+	api.HandleFunc("/devices/{id}/revoke", s.ownDevice(s.handleRevokeDevice)).Methods("POST")
+	api.HandleFunc("/devices/{id}/usage", s.ownDevice(s.handleGetDeviceUsage)).Methods("GET")
+	api.HandleFunc("/devices/{id}/data", s.ownDevice(s.handleEraseDeviceData)).Methods("DELETE")
+	api.HandleFunc("/devices/{id}/takeout", s.ownDevice(s.handleDeviceTakeout)).Methods("GET")
+
+	// Device groups
+	api.HandleFunc("/groups", s.handleGetGroups).Methods("GET")
+	api.HandleFunc("/groups", s.adminOnly(s.handleCreateGroup)).Methods("POST")
+	api.HandleFunc("/groups/{id}", s.handleGetGroup).Methods("GET")
+	api.HandleFunc("/groups/{id}", s.groupOwnerOnly(s.handleDeleteGroup)).Methods("DELETE")
+	api.HandleFunc("/groups/{id}/members/{device}", s.groupOwnerOnly(s.handleAddGroupMember)).Methods("PUT")
+	api.HandleFunc("/groups/{id}/members/{device}", s.groupOwnerOnly(s.handleRemoveGroupMember)).Methods("DELETE")
+
+	// User accounts
+	api.HandleFunc("/users", s.adminOnly(s.handleGetUsers)).Methods("GET")
+	api.HandleFunc("/users", s.adminOnly(s.handleCreateUser)).Methods("POST")
+	api.HandleFunc("/users/me", s.handleGetCurrentUser).Methods("GET")
+	api.HandleFunc("/users/{id}", s.adminOnly(s.handleGetUser)).Methods("GET")
+	api.HandleFunc("/users/{id}", s.adminOnly(s.handleUpdateUser)).Methods("PUT")
+	api.HandleFunc("/users/{id}", s.adminOnly(s.handleDeleteUser)).Methods("DELETE")
+	api.HandleFunc("/users/{id}/token", s.adminOnly(s.handleRotateUserToken)).Methods("POST")
+
+	// Webhooks
+	if s.config.FeatureEnabled(config.FeatureWebhooks) {
+		api.HandleFunc("/webhooks/deliveries", s.adminOnly(s.handleGetWebhookDeliveries)).Methods("GET")
+	}
+
+	// Administration
+	api.HandleFunc("/admin/log-level", s.adminOnly(s.handleGetLogLevels)).Methods("GET")
+	api.HandleFunc("/admin/log-level", s.adminOnly(s.handleSetLogLevel)).Methods("PUT")
+	api.HandleFunc("/admin/backups", s.adminOnly(s.handleGetBackups)).Methods("GET")
+	api.HandleFunc("/admin/backup/now", s.adminOnly(s.handleBackupNow)).Methods("POST")
+	api.HandleFunc("/admin/maintenance", s.adminOnly(s.handleGetMaintenance)).Methods("GET")
+	api.HandleFunc("/admin/telemetry", s.adminOnly(s.handleGetTelemetry)).Methods("GET")
+	api.HandleFunc("/admin/db/size", s.adminOnly(s.handleGetDatabaseSize)).Methods("GET")
+	api.HandleFunc("/admin/db/compact", s.adminOnly(s.handleCompactDatabase)).Methods("POST")
+	api.HandleFunc("/admin/dashboard", s.adminOnly(s.handleGetDashboard)).Methods("GET")
+	api.HandleFunc("/admin/ui", s.adminOnly(s.handleAdminUI)).Methods("GET")
+	api.HandleFunc("/admin/presets", s.adminOnly(s.handleBrowsePresets)).Methods("GET")
+	api.HandleFunc("/admin/presets/{id}", s.adminOnly(s.handleBrowsePreset)).Methods("GET")
+	api.HandleFunc("/admin/presets/{id}", s.adminOnly(s.handleEditPreset)).Methods("PATCH")
+	api.HandleFunc("/admin/presets/{id}", s.adminOnly(s.handleDeleteBrowsedPreset)).Methods("DELETE")
+	api.HandleFunc("/admin/jobs", s.adminOnly(s.handleGetJobs)).Methods("GET")
+	api.HandleFunc("/admin/jobs/{id}", s.adminOnly(s.handleGetJob)).Methods("GET")
+	api.HandleFunc("/admin/jobs/{id}", s.adminOnly(s.handleCancelJob)).Methods("DELETE")
+	api.HandleFunc("/admin/restore", s.adminOnly(s.handleRestore)).Methods("POST")
+	api.HandleFunc("/admin/restore/staging", s.adminOnly(s.handleGetStagedPresets)).Methods("GET")
+	api.HandleFunc("/admin/restore/staging", s.adminOnly(s.handleClearStaging)).Methods("DELETE")
+	api.HandleFunc("/admin/restore/staging/recover", s.adminOnly(s.handleRecoverStaged)).Methods("POST")
+	api.HandleFunc("/admin/cors/origins", s.corsAdminOnly(s.handleGetCORSOrigins)).Methods("GET")
+	api.HandleFunc("/admin/cors/origins", s.corsAdminOnly(s.handleAddCORSOrigin)).Methods("POST")
+	api.HandleFunc("/admin/cors/origins/{id}", s.corsAdminOnly(s.handleDeleteCORSOrigin)).Methods("DELETE")
+	api.HandleFunc("/admin/filters", s.filterAdminOnly(s.handleGetFilters)).Methods("GET")
+	api.HandleFunc("/admin/filters", s.filterAdminOnly(s.handleAddFilterEntry)).Methods("POST")
+	api.HandleFunc("/admin/filters/{id}", s.filterAdminOnly(s.handleDeleteFilterEntry)).Methods("DELETE")
+	api.HandleFunc("/filters/check", s.adminOnly(s.handleCheckFilters)).Methods("GET")
 
 	// Sync endpoints
-	api.HandleFunc("/sync/log", s.handleGetSyncLogAll).Methods("GET")
-	api.HandleFunc("/sync/log/{id}", s.handleGetSyncLog).Methods("GET")
-	api.HandleFunc("/sync/status", s.handleSyncStatus).Methods("GET")
-	api.HandleFunc("/sync/cleanup", s.handleCleanup).Methods("POST")
+	api.HandleFunc("/sync/log", s.adminOnly(s.handleGetSyncLogAll)).Methods("GET")
+	if s.config.FeatureEnabled(config.FeatureDeltaSync) {
+		api.HandleFunc("/sync/log/{id}", s.handleGetSyncLog).Methods("GET")
+		api.HandleFunc("/sync/status", s.handleSyncStatus).Methods("GET")
+	}
+	api.HandleFunc("/sync/cleanup", s.adminOnly(s.handleCleanup)).Methods("POST")
+
+	// chrome.storage.sync compatible API
+	if s.config.StorageSync.Enabled {
+		api.HandleFunc("/storage/sync", s.handleGetStorageItems).Methods("GET")
+		api.HandleFunc("/storage/sync/get", s.handleGetStorageItemsByKeys).Methods("POST")
+		api.HandleFunc("/storage/sync/set", s.handleSetStorageItems).Methods("POST")
+		api.HandleFunc("/storage/sync/remove", s.handleRemoveStorageItems).Methods("POST")
+		api.HandleFunc("/storage/sync/clear", s.handleClearStorageItems).Methods("POST")
+		api.HandleFunc("/storage/sync/bytes-in-use", s.handleGetStorageBytesInUse).Methods("GET")
+		api.HandleFunc("/storage/sync/quota", s.handleGetStorageQuota).Methods("GET")
+		api.HandleFunc("/storage/sync/changes", s.handleGetStorageChanges).Methods("GET")
+	}
 
-	// Setup CORS
+	// Export / import
+	if s.config.FeatureEnabled(config.FeatureExport) {
+		api.HandleFunc("/export", s.handleExport).Methods("GET")
+	}
+	if s.config.FeatureEnabled(config.FeatureImport) {
+		api.HandleFunc("/import", s.handleImport).Methods("POST")
+		api.HandleFunc("/import/converters", s.handleGetImportConverters).Methods("GET")
+	}
+
+	// GraphQL
+	if s.config.FeatureEnabled(config.FeatureGraphQL) {
+		api.HandleFunc("/graphql", s.adminOnly(s.handleGraphQL)).Methods("GET", "POST")
+	}
+
+	// API specification
+	api.HandleFunc("/openapi.json", s.handleOpenAPI).Methods("GET")
+	api.HandleFunc("/docs", s.handleAPIDocs).Methods("GET")
+
+	// API v2 (REST semantics, no envelope)
+	s.setupV2Routes(r)
+
+	// Tenant dispatch, inside CORS so preflights work for every tenant
 	var handler http.Handler = r
+	if s.tenants != nil {
+		handler = s.tenantMiddleware(r)
+	}
+
+	if s.slots != nil {
+		handler = s.concurrencyMiddleware(handler)
+	}
+
+	// Rate limiting, inside CORS so browsers can read 429 responses
+	if s.rateLimiter != nil {
+		handler = s.rateLimitMiddleware(handler)
+	}
+
+	// Setup CORS
 	if s.config.CORS.Enabled {
 		c := cors.New(cors.Options{
-			AllowedOrigins:   s.config.CORS.AllowedOrigins,
-			AllowedMethods:   s.config.CORS.AllowedMethods,
-			AllowedHeaders:   s.config.CORS.AllowedHeaders,
-			AllowCredentials: true,
-			MaxAge:           s.config.CORS.MaxAge,
+			AllowOriginRequestFunc: s.corsAllowed,
+			AllowedMethods:         s.config.CORS.AllowedMethods,
+			AllowedHeaders:         s.config.CORS.AllowedHeaders,
+			AllowCredentials:       true,
+			MaxAge:                 s.config.CORS.MaxAge,
+			ExposedHeaders: []string{requestIDHeader,
+				"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Scope", "Retry-After",
+				apiVersionHeader, "Deprecation", "Sunset", "Link", "X-API-Deprecation-Notice"},
 		})
-		handler = c.Handler(r)
+		handler = c.Handler(handler)
+	}
+	if s.config.Performance.EnableCompression {
+		handler = s.compressionMiddleware(handler)
+	}
+	if s.accessLog != nil {
+		handler = s.accessLogMiddleware(handler)
+	}
+	handler = s.requestCountMiddleware(handler)
+	handler = s.requestIDMiddleware(handler)
+	if trusted := parseCIDRs(s.config.Server.TrustedProxies); len(trusted) > 0 {
+		handler = realIPMiddleware(trusted, handler)
 	}
 
 	s.router = r
-	s.httpServer = &http.Server{
-		Handler:      handler,
-		ReadTimeout:  time.Duration(s.config.Server.ReadTimeout) * time.Second,
-		WriteTimeout: time.Duration(s.config.Server.WriteTimeout) * time.Second,
-	}
+	s.handler = handler
 }
 
 // Start starts the HTTP server
 func (s *Server) Start() error {
+	// Sockets passed by systemd come first: the API, then the redirect port
+	activated, err := systemd.Listeners()
+	if err != nil {
+		return err
+	}
+	var listener net.Listener
+	switch {
+	case len(activated) > 0:
+		listener = activated[0]
+		if listener.Addr().Network() == "unix" {
+			listener = localListener{listener}
+		}
+		s.logger.Info("Using %d socket(s) from systemd", len(activated))
+	case s.config.Server.Listen != "":
+		listener, err = listenLocal(s.config.Server)
+	default:
+		listener, err = s.listenTCP()
+	}
+	if err != nil {
+		return err
+	}
+
+	// Bind the redirect port too before serving, so a port that can't be
+	// used (such as 80 without privileges) fails the start rather than just
+	// being logged
+	if s.redirectServer != nil {
+		var redirectListener net.Listener
+		if len(activated) > 1 {
+			redirectListener = activated[1]
+		} else if redirectListener, err = net.Listen("tcp", s.redirectServer.Addr); err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to listen for HTTP redirects: %w", err)
+		}
+		s.logger.Info("Redirecting HTTP on %s to HTTPS", redirectListener.Addr())
+		go func() {
+			if err := s.redirectServer.Serve(redirectListener); err != nil && err != http.ErrServerClosed {
+				s.logger.Error("Redirect server error: %v", err)
+			}
+		}()
+	}
+
+	addr := listener.Addr().String()
+	s.httpServer.Addr = addr
+	tlsEnabled := s.config.Server.TLS.Enabled
+	if tlsEnabled {
+		s.logger.Info("Starting server on %s (HTTPS)", addr)
+	} else {
+		s.logger.Info("Starting server on %s", addr)
+	}
+	s.logger.Info("Access control mode: %s", s.config.AccessControl.Mode)
+
+	go func() {
+		var err error
+		if tlsEnabled {
+			err = s.httpServer.ServeTLS(listener, "", "")
+		} else {
+			err = s.httpServer.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			s.logger.Error("Server error: %v", err)
+		}
+	}()
+
+	if s.autocert != nil {
+		s.runJob(func() { s.autocert.Run(s.stop) })
+	}
+	if s.config.Discovery.MDNS {
+		s.advertise(listener)
+	}
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		s.runJob(func() { s.watchdog(interval) })
+	}
+
+	// Bid for the lease before the scheduled jobs start, so the leader
+	// runs any that are due straight away
+	if s.leader != nil {
+		s.leader.campaign(s.ctx)
+		s.runJob(s.runLeaderElection)
+	}
+
+	if s.config.Storage.Backup.Enabled {
+		s.runJob(s.runBackups)
+		for _, tenant := range s.tenants {
+			s.runJob(tenant.runBackups)
+		}
+	}
+
+	if s.config.Maintenance.AutoCleanup {
+		s.runJob(s.runMaintenance)
+		for _, tenant := range s.tenants {
+			s.runJob(tenant.runMaintenance)
+		}
+	}
+
+	if s.config.UsageExport.Enabled {
+		s.runJob(s.runUsageExport)
+	}
+
+	if s.config.Telemetry.Enabled {
+		s.runJob(s.runTelemetry)
+	}
+
+	if days := s.config.Maintenance.StaleDeviceDays; days > 0 {
+		s.runJob(func() { s.monitorStaleDevices(days) })
+		for _, tenant := range s.tenants {
+			tenant := tenant
+			s.runJob(func() { tenant.monitorStaleDevices(days) })
+		}
+	}
+
+	return nil
+}
+
+// listenTCP listens on server.port, or on the first free fallback port if
+// it is in use
+func (s *Server) listenTCP() (net.Listener, error) {
 	port := s.config.Server.Port
 	addr := fmt.Sprintf("%s:%d", s.config.Server.Host, port)
 
@@ -158,26 +657,57 @@ func (s *Server) Start() error {
 
 		// If still no available port
 		if !isPortAvailable(s.config.Server.Host, port) {
-			return fmt.Errorf("no available ports found")
+			return nil, fmt.Errorf("no available ports found")
 		}
 	}
 
-	s.httpServer.Addr = addr
-	s.logger.Info("Starting server on %s", addr)
-	s.logger.Info("Access control mode: %s", s.config.AccessControl.Mode)
+	return net.Listen("tcp", addr)
+}
 
+// runJob starts a background task that Shutdown waits for. Tasks must
+// return once s.stop is closed.
+func (s *Server) runJob(job func()) {
+	s.jobs.Add(1)
 	go func() {
-		if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			s.logger.Error("Server error: %v", err)
-		}
+		defer s.jobs.Done()
+		job()
 	}()
-
-	return nil
 }
 
-// Shutdown gracefully shuts down the server
+// Shutdown gracefully shuts down the server, within server.shutdown_timeout
+// or ctx's deadline, whichever comes first. In order, it:
+//   - stops background tasks and the listener, and waits for in-flight
+//     requests, so sync pushes in progress complete
+//   - cancels the queries of any request still running at the deadline
+//   - delivers queued events, abandoning retries left at the deadline
+//   - closes tenant storage, then the main storage
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.httpServer.Shutdown(ctx)
+	if timeout := s.config.Server.ShutdownTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+
+	close(s.stop)
+	if s.redirectServer != nil {
+		s.redirectServer.Shutdown(ctx)
+	}
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		s.logger.Warn("Requests still running at shutdown deadline: %v", err)
+	}
+	s.cancel()
+	s.jobs.Wait()
+
+	s.events.Close(ctx)
+	s.closeTenants(ctx)
+	if cerr := s.storage.Close(); cerr != nil {
+		s.logger.Error("Failed to close storage: %v", cerr)
+		err = errors.Join(err, cerr)
+	}
+
+	s.logger.Info("Shutdown complete")
+	return err
 }
 
 // isPortAvailable checks if a port is available
@@ -191,8 +721,9 @@ func isPortAvailable(host string, port int) bool {
 	return true
 }
 
-// loadURLFilters loads and compiles URL filter patterns
-func loadURLFilters(cfg config.URLFilterConfig, log *logger.Logger) (*URLFilters, error) {
+// loadURLFilters loads and compiles URL filter patterns from the filter
+// files and the URL entries added through the admin API
+func loadURLFilters(cfg config.URLFilterConfig, entries []*storage.FilterEntry, log *logger.Logger) (*URLFilters, error) {
 	if !cfg.Enabled {
 		return &URLFilters{enabled: false}, nil
 	}
@@ -224,11 +755,35 @@ func loadURLFilters(cfg config.URLFilterConfig, log *logger.Logger) (*URLFilters
 		}
 	}
 
+	// Add entries from the admin API; they were checked when added
+	added := 0
+	for _, e := range entries {
+		if e.Type != filterTypeURL {
+			continue
+		}
+		re, err := compileFilterPattern(e.Pattern, cfg.UseRegex)
+		if err != nil {
+			log.Warn("Skipping URL filter entry %s: %v", e.ID, err)
+			continue
+		}
+		pattern := urlRule{re, FilterPattern{ID: e.ID, Pattern: e.Pattern, Source: "api"}}
+		if e.List == filterListWhitelist {
+			filters.whitelist = append(filters.whitelist, pattern)
+		} else {
+			filters.blacklist = append(filters.blacklist, pattern)
+		}
+		added++
+	}
+	if added > 0 {
+		log.Info("Loaded %d URL filter entries from the database", added)
+	}
+
 	return filters, nil
 }
 
-// loadIPFilters parses IP ranges for access control
-func loadIPFilters(cfg config.AccessControlConfig, log *logger.Logger) (*IPFilters, error) {
+// loadIPFilters parses IP ranges for access control from the config and the
+// IP entries added through the admin API
+func loadIPFilters(cfg config.AccessControlConfig, entries []*storage.FilterEntry, log *logger.Logger) (*IPFilters, error) {
 	filters := &IPFilters{
 		mode: cfg.Mode,
 	}
@@ -250,7 +805,7 @@ func loadIPFilters(cfg config.AccessControlConfig, log *logger.Logger) (*IPFilte
 				_, ipNet, _ = net.ParseCIDR(ipStr + "/128")
 			}
 		}
-		filters.whitelist = append(filters.whitelist, ipNet)
+		filters.whitelist = append(filters.whitelist, ipRule{ipNet, FilterPattern{Pattern: ipStr, Source: "config"}})
 	}
 
 	// Parse blacklist IPs/ranges
@@ -268,7 +823,24 @@ func loadIPFilters(cfg config.AccessControlConfig, log *logger.Logger) (*IPFilte
 				_, ipNet, _ = net.ParseCIDR(ipStr + "/128")
 			}
 		}
-		filters.blacklist = append(filters.blacklist, ipNet)
+		filters.blacklist = append(filters.blacklist, ipRule{ipNet, FilterPattern{Pattern: ipStr, Source: "config"}})
+	}
+
+	for _, e := range entries {
+		if e.Type != filterTypeIP {
+			continue
+		}
+		nets := parseCIDRs([]string{e.Pattern})
+		if len(nets) == 0 {
+			log.Warn("Skipping invalid IP filter entry %s: %s", e.ID, e.Pattern)
+			continue
+		}
+		rule := ipRule{nets[0], FilterPattern{ID: e.ID, Pattern: e.Pattern, Source: "api"}}
+		if e.List == filterListWhitelist {
+			filters.whitelist = append(filters.whitelist, rule)
+		} else {
+			filters.blacklist = append(filters.blacklist, rule)
+		}
 	}
 
 	log.Info("IP filters loaded: %d whitelist, %d blacklist", len(filters.whitelist), len(filters.blacklist))
@@ -276,119 +848,71 @@ func loadIPFilters(cfg config.AccessControlConfig, log *logger.Logger) (*IPFilte
 }
 
 // loadFilterFile loads filter patterns from a file
-func loadFilterFile(path string, useRegex bool) ([]*regexp.Regexp, error) {
-	content, err := os.ReadFile(path)
+func loadFilterFile(path string, useRegex bool) ([]urlRule, error) {
+	lines, err := readFilterFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	lines := strings.Split(string(content), "\n")
-	var patterns []*regexp.Regexp
-
+	var patterns []urlRule
 	for _, line := range lines {
-		line = strings.TrimSpace(line)
-
-		// Skip empty lines and comments
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-
-		var pattern *regexp.Regexp
-		if useRegex {
-			pattern, err = regexp.Compile(line)
-			if err != nil {
-				return nil, fmt.Errorf("invalid regex pattern '%s': %w", line, err)
-			}
-		} else {
-			// Convert glob to regex
-			escaped := regexp.QuoteMeta(line)
-			escaped = strings.ReplaceAll(escaped, "\\*", ".*")
-			pattern, err = regexp.Compile("^" + escaped + "$")
-			if err != nil {
-				return nil, fmt.Errorf("invalid pattern '%s': %w", line, err)
-			}
+		pattern, err := compileFilterPattern(line, useRegex)
+		if err != nil {
+			return nil, err
 		}
-
-		patterns = append(patterns, pattern)
+		patterns = append(patterns, urlRule{pattern, FilterPattern{Pattern: line, Source: "file"}})
 	}
 
 	return patterns, nil
 }
 
-// Helper functions for filters
-func (f *URLFilters) isAllowed(url string) bool {
-	if !f.enabled {
-		return true
+// readFilterFile returns the patterns in a filter file, without blank lines
+// and comments
+func readFilterFile(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check whitelist first if it overrides
-	if f.whitelistOverrides && len(f.whitelist) > 0 {
-		for _, pattern := range f.whitelist {
-			if pattern.MatchString(url) {
-				return true
-			}
-		}
-		// If whitelist exists and nothing matched, deny
-		return false
-	}
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
 
-	// Check blacklist
-	for _, pattern := range f.blacklist {
-		if pattern.MatchString(url) {
-			// Check if whitelist overrides this blacklist match
-			if f.whitelistOverrides {
-				for _, wlPattern := range f.whitelist {
-					if wlPattern.MatchString(url) {
-						return true
-					}
-				}
-			}
-			return false
+		// Skip empty lines and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
+		lines = append(lines, line)
 	}
+	return lines, nil
+}
 
-	// If no whitelist, default allow
-	if len(f.whitelist) == 0 {
-		return true
+// compileFilterPattern compiles a URL filter pattern: a regex, or a glob
+// where * matches anything
+func compileFilterPattern(line string, useRegex bool) (*regexp.Regexp, error) {
+	if useRegex {
+		pattern, err := regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex pattern '%s': %w", line, err)
+		}
+		return pattern, nil
 	}
 
-	// Check whitelist
-	for _, pattern := range f.whitelist {
-		if pattern.MatchString(url) {
-			return true
-		}
+	// Convert glob to regex
+	escaped := regexp.QuoteMeta(line)
+	escaped = strings.ReplaceAll(escaped, "\\*", ".*")
+	pattern, err := regexp.Compile("^" + escaped + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %w", line, err)
 	}
+	return pattern, nil
+}
 
-	return false
+// Helper functions for filters
+func (f *URLFilters) isAllowed(url string) bool {
+	return f.check(url).Allowed
 }
 
 func (f *IPFilters) isAllowed(ipStr string) bool {
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return false
-	}
-
-	switch f.mode {
-	case "whitelist":
-		for _, ipNet := range f.whitelist {
-			if ipNet.Contains(ip) {
-				return true
-			}
-		}
-		return false
-
-	case "blacklist":
-		for _, ipNet := range f.blacklist {
-			if ipNet.Contains(ip) {
-				return false
-			}
-		}
-		return true
-
-	case "allow_all":
-		return true
-
-	default:
-		return false
-	}
+	return f.check(ipStr).Allowed
 }
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/logger"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// newTestServer starts a server over a fresh database in a temporary
+// directory, with authentication off
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "webform-sync.yml")
+	yml := "storage:\n  type: sqlite\n  data_dir: " + dir + "\n  db_file: presets.db\n" +
+		"access_control:\n  mode: allow_all\n" +
+		"logging:\n  level: error\n  output: stdout\n"
+	if err := os.WriteFile(path, []byte(yml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := logger.NewLogger(cfg.Logging)
+	store, err := storage.NewStorage(cfg.Storage, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	s, err := NewServer(cfg, store, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
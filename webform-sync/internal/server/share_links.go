@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// sharedPathPrefix serves share links without authentication
+const sharedPathPrefix = "/api/v1/shared/"
+
+// ShareLinkResponse is returned when a share link is created. The token is
+// only available here.
+type ShareLinkResponse struct {
+	*storage.ShareLink
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+// newShareSecret returns the configured link signing secret, or a random
+// one for this run
+func newShareSecret(configured string) ([]byte, error) {
+	if configured != "" {
+		return []byte(configured), nil
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate share link secret: %w", err)
+	}
+	return secret, nil
+}
+
+// signShareLink returns the MAC binding a link to its preset and expiry
+func (s *Server) signShareLink(link *storage.ShareLink) string {
+	mac := hmac.New(sha256.New, s.shareSecret)
+	fmt.Fprintf(mac, "%s|%s|%d", link.ID, link.PresetID, link.ExpiresAt.Unix())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareLinkToken is the public form of a link: "<id>.<signature>"
+func (s *Server) shareLinkToken(link *storage.ShareLink) string {
+	return link.ID + "." + s.signShareLink(link)
+}
+
+// shareLinkURL builds the absolute URL for a token
+func (s *Server) shareLinkURL(r *http.Request, token string) string {
+	base := strings.TrimSuffix(s.config.Sharing.BaseURL, "/")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return base + sharedPathPrefix + url.PathEscape(token)
+}
+
+// Create an expiring link to a preset
+func (s *Server) handleCreateShareLink(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" {
+		s.respondError(w, http.StatusBadRequest, "device_id parameter required")
+		return
+	}
+
+	// The body is optional; without one the link gets the default lifetime
+	var body struct {
+		ExpiresInHours int    `json:"expiresInHours"`
+		Password       string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	hours := body.ExpiresInHours
+	if hours == 0 {
+		hours = s.config.Sharing.DefaultTTLHours
+	}
+	if hours < 1 || hours > s.config.Sharing.MaxTTLHours {
+		s.respondError(w, http.StatusBadRequest,
+			fmt.Sprintf("expiresInHours must be between 1 and %d", s.config.Sharing.MaxTTLHours))
+		return
+	}
+
+	_, err := s.authorizePresetWrite(r.Context(), id, deviceID, storage.RoleOwner)
+	if errors.Is(err, storage.ErrPresetNotFound) {
+		s.respondError(w, http.StatusNotFound, "Preset not found")
+		return
+	}
+	if errors.Is(err, storage.ErrRoleDenied) {
+		s.respondError(w, http.StatusForbidden, "Only the preset's owner can create share links")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to check preset access: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to create share link")
+		return
+	}
+
+	expiresAt := time.Now().Add(time.Duration(hours) * time.Hour)
+	link, err := s.storage.CreateShareLink(r.Context(), id, deviceID, body.Password, expiresAt)
+	if err != nil {
+		s.log(r).Error("Failed to create share link: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to create share link")
+		return
+	}
+
+	token := s.shareLinkToken(link)
+	s.log(r).Info("Share link created for preset %s (device: %s, expires %s)", id, deviceID, link.ExpiresAt.Format(time.RFC3339))
+	s.respondJSON(w, http.StatusCreated, APIResponse{
+		Success: true,
+		Data:    ShareLinkResponse{ShareLink: link, Token: token, URL: s.shareLinkURL(r, token)},
+		Message: "Share link created",
+	})
+}
+
+// Fetch a shared preset as an importable export document
+func (s *Server) handleGetSharedPreset(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	id, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		s.respondError(w, http.StatusNotFound, "Share link not found")
+		return
+	}
+	link, err := s.storage.GetShareLink(r.Context(), id)
+	if errors.Is(err, storage.ErrShareLinkNotFound) {
+		s.respondError(w, http.StatusNotFound, "Share link not found")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get share link: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve shared preset")
+		return
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.signShareLink(link))) {
+		s.respondError(w, http.StatusNotFound, "Share link not found")
+		return
+	}
+	if link.Expired() {
+		s.respondError(w, http.StatusGone, "Share link has expired")
+		return
+	}
+
+	if link.PasswordProtected {
+		password := r.Header.Get("X-Share-Password")
+		if password == "" {
+			s.respondError(w, http.StatusUnauthorized, "Password required")
+			return
+		}
+		if !link.CheckPassword(password) {
+			s.log(r).Warn("Wrong password for share link %s from %s", link.ID, r.RemoteAddr)
+			s.respondError(w, http.StatusUnauthorized, "Incorrect password")
+			return
+		}
+	}
+
+	preset, err := s.storage.GetPreset(r.Context(), link.PresetID)
+	if errors.Is(err, storage.ErrPresetNotFound) {
+		s.respondError(w, http.StatusNotFound, "Shared preset no longer exists")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get shared preset: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve shared preset")
+		return
+	}
+
+	s.transformOnRead(r.Context(), preset)
+
+	// Strip everything tying the preset to this server
+	shared := *preset
+	shared.ID = ""
+	shared.DeviceID = ""
+	shared.UserID = ""
+	shared.SharedGroupID = ""
+	shared.Access = ""
+	shared.UseCount = 0
+	shared.LastUsed = nil
+	shared.Version = 0
+
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"formatVersion": ExportFormatVersion,
+		"exportedAt":    time.Now(),
+		"expiresAt":     link.ExpiresAt,
+		"presets":       []*storage.Preset{&shared},
+	})
+}
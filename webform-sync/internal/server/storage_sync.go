@@ -0,0 +1,581 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// storageWrappedKey marks storage items whose value isn't an object. Object
+// values are kept as the preset's fields; others as its one field, "value".
+const storageWrappedKey = "storageWrapped"
+
+// storageChangeHistory is how many change batches are kept for clients
+// polling for changes; one further behind must read everything again
+const storageChangeHistory = 256
+
+// maxStorageWait bounds a poll for changes, within server.write_timeout
+const maxStorageWait = 25 * time.Second
+
+// StorageChange is one key's change, as in chrome.storage.onChanged. A
+// missing oldValue means the key was added, a missing newValue that it was
+// removed.
+type StorageChange struct {
+	OldValue interface{} `json:"oldValue,omitempty"`
+	NewValue interface{} `json:"newValue,omitempty"`
+}
+
+// StorageChanges is the body of GET /storage/sync/changes
+type StorageChanges struct {
+	// Cursor is passed as since to wait for the next changes
+	Cursor string `json:"cursor"`
+	// Reset means the changes since the cursor given are no longer known,
+	// such as after a restart, and the client should read every item again
+	Reset   bool                     `json:"reset,omitempty"`
+	Changes map[string]StorageChange `json:"changes"`
+}
+
+// StorageQuota is the body of GET /storage/sync/quota, matching the
+// constants on chrome.storage.sync
+type StorageQuota struct {
+	QuotaBytes                  int64 `json:"QUOTA_BYTES"`
+	QuotaBytesPerItem           int64 `json:"QUOTA_BYTES_PER_ITEM"`
+	MaxItems                    int   `json:"MAX_ITEMS"`
+	MaxWriteOperationsPerHour   int   `json:"MAX_WRITE_OPERATIONS_PER_HOUR"`
+	MaxWriteOperationsPerMinute int   `json:"MAX_WRITE_OPERATIONS_PER_MINUTE"`
+}
+
+// storageChangeBatch is the changes one write made to a device's items
+type storageChangeBatch struct {
+	seq      int64
+	deviceID string
+	changes  map[string]StorageChange
+}
+
+// storageSyncArea holds what the chrome.storage.sync API keeps between
+// requests: recent changes, for clients polling for them, and each device's
+// write times, for the write operation quotas
+type storageSyncArea struct {
+	// writeMu serialises writes, so each quota check sees every earlier
+	// write
+	writeMu sync.Mutex
+
+	mu sync.Mutex
+	// epoch tells cursors from before a restart apart
+	epoch   string
+	seq     int64
+	history []storageChangeBatch
+	// wake is closed, and replaced, when changes are recorded
+	wake chan struct{}
+	// writes holds each device's write times over the last hour
+	writes map[string][]time.Time
+}
+
+func newStorageSyncArea() *storageSyncArea {
+	return &storageSyncArea{
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		wake:   make(chan struct{}),
+		writes: make(map[string][]time.Time),
+	}
+}
+
+// allowWrite checks a write by a device against the write operation quotas.
+// It returns the name of the quota exceeded, or "".
+func (a *storageSyncArea) allowWrite(cfg StorageQuota, deviceID string, now time.Time) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	times := a.writes[deviceID]
+	for len(times) > 0 && now.Sub(times[0]) >= time.Hour {
+		times = times[1:]
+	}
+	a.writes[deviceID] = times
+	if len(times) == 0 {
+		delete(a.writes, deviceID)
+	}
+
+	lastMinute := 0
+	for _, t := range times {
+		if now.Sub(t) < time.Minute {
+			lastMinute++
+		}
+	}
+	switch {
+	case cfg.MaxWriteOperationsPerHour > 0 && len(times) >= cfg.MaxWriteOperationsPerHour:
+		return "MAX_WRITE_OPERATIONS_PER_HOUR"
+	case cfg.MaxWriteOperationsPerMinute > 0 && lastMinute >= cfg.MaxWriteOperationsPerMinute:
+		return "MAX_WRITE_OPERATIONS_PER_MINUTE"
+	}
+	return ""
+}
+
+// recordWrite counts a device's write, and hands its changes to pollers
+func (a *storageSyncArea) recordWrite(deviceID string, changes map[string]StorageChange, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.writes[deviceID] = append(a.writes[deviceID], now)
+	if len(changes) == 0 {
+		return
+	}
+	a.seq++
+	a.history = append(a.history, storageChangeBatch{seq: a.seq, deviceID: deviceID, changes: changes})
+	if len(a.history) > storageChangeHistory {
+		a.history = a.history[len(a.history)-storageChangeHistory:]
+	}
+	close(a.wake)
+	a.wake = make(chan struct{})
+}
+
+// changesSince merges a device's changes after cursor. It also returns a
+// channel closed on the next change, to wait on when there are none.
+func (a *storageSyncArea) changesSince(deviceID, cursor string) (StorageChanges, <-chan struct{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := StorageChanges{Cursor: a.epoch + "-" + strconv.FormatInt(a.seq, 10), Changes: map[string]StorageChange{}}
+	if cursor == "" {
+		return result, a.wake
+	}
+	epoch, seqText, _ := strings.Cut(cursor, "-")
+	since, err := strconv.ParseInt(seqText, 10, 64)
+	oldest := a.seq - int64(len(a.history))
+	if epoch != a.epoch || err != nil || since < oldest || since > a.seq {
+		result.Reset = true
+		return result, a.wake
+	}
+
+	for _, batch := range a.history[since-oldest:] {
+		if batch.deviceID != deviceID {
+			continue
+		}
+		for key, change := range batch.changes {
+			if earlier, ok := result.Changes[key]; ok {
+				change.OldValue = earlier.OldValue
+			}
+			result.Changes[key] = change
+		}
+	}
+	// A key changed and changed back, or added and removed again, is as it
+	// was
+	for key, change := range result.Changes {
+		if sameJSON(change.OldValue, change.NewValue) {
+			delete(result.Changes, key)
+		}
+	}
+	return result, a.wake
+}
+
+// storageQuota returns the configured chrome.storage.sync quotas
+func (s *Server) storageQuota() StorageQuota {
+	cfg := s.config.StorageSync
+	return StorageQuota{
+		QuotaBytes:                  cfg.QuotaBytes,
+		QuotaBytesPerItem:           cfg.QuotaBytesPerItem,
+		MaxItems:                    cfg.MaxItems,
+		MaxWriteOperationsPerHour:   cfg.MaxWriteOperationsPerHour,
+		MaxWriteOperationsPerMinute: cfg.MaxWriteOperationsPerMinute,
+	}
+}
+
+// storageDevice reads the device whose items a request is for, rejecting
+// requests without one
+func (s *Server) storageDevice(w http.ResponseWriter, r *http.Request) (string, bool) {
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" {
+		s.respondError(w, http.StatusBadRequest, "device_id parameter required")
+		return "", false
+	}
+	return deviceID, s.admitDevice(w, r, deviceID)
+}
+
+// storageItemValue is a storage item's value
+func storageItemValue(item *storage.Preset) interface{} {
+	if wrapped, _ := item.Metadata[storageWrappedKey].(bool); wrapped {
+		return item.Fields["value"]
+	}
+	if item.Fields == nil {
+		return map[string]interface{}{}
+	}
+	return item.Fields
+}
+
+// storageItemPreset makes the preset keeping a storage item
+func storageItemPreset(key string, value interface{}) *storage.Preset {
+	item := &storage.Preset{Name: key, ScopeType: storage.ScopeTypeStorage}
+	if fields, ok := value.(map[string]interface{}); ok {
+		item.Fields = fields
+	} else {
+		item.Fields = map[string]interface{}{"value": value}
+		item.Metadata = map[string]interface{}{storageWrappedKey: true}
+	}
+	return item
+}
+
+// storageItemBytes is an item's size as Chrome counts it: the key and the
+// value's JSON
+func storageItemBytes(key string, value interface{}) int64 {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(value)
+	return int64(len(key) + len(bytes.TrimSuffix(b.Bytes(), []byte("\n"))))
+}
+
+// loadStorageItems returns a device's items by key
+func (s *Server) loadStorageItems(w http.ResponseWriter, r *http.Request, deviceID string) (map[string]*storage.Preset, bool) {
+	items, err := s.storage.StorageItems(r.Context(), deviceID)
+	if err != nil {
+		s.log(r).Error("Failed to get storage items: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve storage items")
+		return nil, false
+	}
+	byKey := make(map[string]*storage.Preset, len(items))
+	for _, item := range items {
+		byKey[item.Name] = item
+	}
+	return byKey, true
+}
+
+// parseStorageKeys reads the keys argument of get, remove and
+// getBytesInUse: null for every key, a key, a list of keys, or (for get
+// only) an object of keys and their default values
+func parseStorageKeys(raw json.RawMessage, allowDefaults bool) ([]string, map[string]interface{}, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil, nil
+	}
+	var key string
+	if err := json.Unmarshal(raw, &key); err == nil {
+		return []string{key}, nil, nil
+	}
+	var keys []string
+	if err := json.Unmarshal(raw, &keys); err == nil {
+		return keys, nil, nil
+	}
+	var defaults map[string]interface{}
+	if err := json.Unmarshal(raw, &defaults); err == nil && allowDefaults {
+		keys = make([]string, 0, len(defaults))
+		for key := range defaults {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys, defaults, nil
+	}
+	if allowDefaults {
+		return nil, nil, errors.New("keys must be null, a string, an array of strings or an object of defaults")
+	}
+	return nil, nil, errors.New("keys must be a string or an array of strings")
+}
+
+// getStorageItems answers get: the items named, or all of them when keys is
+// nil, with defaults for those missing
+func (s *Server) getStorageItems(w http.ResponseWriter, r *http.Request, keys []string, defaults map[string]interface{}) {
+	deviceID, ok := s.storageDevice(w, r)
+	if !ok {
+		return
+	}
+	items, ok := s.loadStorageItems(w, r, deviceID)
+	if !ok {
+		return
+	}
+	for _, item := range items {
+		s.transformOnRead(r.Context(), item)
+	}
+
+	result := map[string]interface{}{}
+	if keys == nil {
+		for key, item := range items {
+			result[key] = storageItemValue(item)
+		}
+	}
+	for _, key := range keys {
+		if item, ok := items[key]; ok {
+			result[key] = storageItemValue(item)
+		} else if value, ok := defaults[key]; ok {
+			result[key] = value
+		}
+	}
+	s.respondSuccess(w, result, fmt.Sprintf("Retrieved %d items", len(result)))
+}
+
+// Get storage items named by repeated key parameters, or all of them
+func (s *Server) handleGetStorageItems(w http.ResponseWriter, r *http.Request) {
+	s.getStorageItems(w, r, r.URL.Query()["key"], nil)
+}
+
+// chrome.storage.sync.get: the body is its keys argument
+func (s *Server) handleGetStorageItemsByKeys(w http.ResponseWriter, r *http.Request) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil && !errors.Is(err, io.EOF) {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	keys, defaults, err := parseStorageKeys(raw, true)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.getStorageItems(w, r, keys, defaults)
+}
+
+// chrome.storage.sync.set: the body is the items to set. Like Chrome, it
+// saves every item or, if one breaks a quota, none.
+func (s *Server) handleSetStorageItems(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := s.storageDevice(w, r)
+	if !ok {
+		return
+	}
+	var values map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&values); err != nil || values == nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body: send an object of items")
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if key == "" {
+			s.respondError(w, http.StatusBadRequest, "keys must not be empty")
+			return
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	area := s.storageSync
+	area.writeMu.Lock()
+	defer area.writeMu.Unlock()
+
+	quota := s.storageQuota()
+	now := time.Now()
+	if exceeded := area.allowWrite(quota, deviceID, now); exceeded != "" {
+		s.respondError(w, http.StatusTooManyRequests, exceeded+" quota exceeded")
+		return
+	}
+	current, ok := s.loadStorageItems(w, r, deviceID)
+	if !ok {
+		return
+	}
+
+	// The area as it would be after the write, for the quotas
+	sizes := make(map[string]int64, len(current)+len(keys))
+	for key, item := range current {
+		sizes[key] = storageItemBytes(key, storageItemValue(item))
+	}
+	for _, key := range keys {
+		sizes[key] = storageItemBytes(key, values[key])
+		if quota.QuotaBytesPerItem > 0 && sizes[key] > quota.QuotaBytesPerItem {
+			s.respondError(w, http.StatusRequestEntityTooLarge, "QUOTA_BYTES_PER_ITEM quota exceeded")
+			return
+		}
+	}
+	if quota.MaxItems > 0 && len(sizes) > quota.MaxItems {
+		s.respondError(w, http.StatusTooManyRequests, "MAX_ITEMS quota exceeded")
+		return
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	if quota.QuotaBytes > 0 && total > quota.QuotaBytes {
+		s.respondError(w, http.StatusRequestEntityTooLarge, "QUOTA_BYTES quota exceeded")
+		return
+	}
+
+	items := make([]*storage.Preset, 0, len(keys))
+	for _, key := range keys {
+		item := storageItemPreset(key, values[key])
+		if status, err := s.transformOnSave(r, item); err != nil {
+			s.respondError(w, status, fmt.Sprintf("%s: %v", key, err))
+			return
+		}
+		if status, err := s.checkFieldPolicy(r, item); err != nil {
+			s.respondError(w, status, fmt.Sprintf("%s: %v", key, err))
+			return
+		}
+		if status, err := s.checkPII(r, item); err != nil {
+			s.respondError(w, status, fmt.Sprintf("%s: %v", key, err))
+			return
+		}
+		items = append(items, item)
+	}
+
+	if err := s.storage.SetStorageItems(r.Context(), deviceID, items); err != nil {
+		if status, ok := quotaStatus(err); ok {
+			s.log(r).Warn("Storage items rejected: %v", err)
+			s.respondError(w, status, err.Error())
+			return
+		}
+		s.log(r).Error("Failed to save storage items: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to save storage items")
+		return
+	}
+
+	// Only values that differ are changes, as in Chrome
+	changes := map[string]StorageChange{}
+	for _, item := range items {
+		change := StorageChange{NewValue: storageItemValue(item)}
+		if old, ok := current[item.Name]; ok {
+			change.OldValue = storageItemValue(old)
+			if sameJSON(change.OldValue, change.NewValue) {
+				continue
+			}
+		}
+		changes[item.Name] = change
+		s.publishPresetSaved(item)
+	}
+	area.recordWrite(deviceID, changes, now)
+
+	s.log(r).Info("Storage items set: %d (device: %s)", len(items), deviceID)
+	s.respondSuccess(w, changes, fmt.Sprintf("Saved %d items", len(items)))
+}
+
+// chrome.storage.sync.remove: the body is its keys argument
+func (s *Server) handleRemoveStorageItems(w http.ResponseWriter, r *http.Request) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	keys, _, err := parseStorageKeys(raw, false)
+	if err == nil && keys == nil {
+		err = errors.New("keys must be a string or an array of strings")
+	}
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.removeStorageItems(w, r, keys)
+}
+
+// chrome.storage.sync.clear
+func (s *Server) handleClearStorageItems(w http.ResponseWriter, r *http.Request) {
+	s.removeStorageItems(w, r, nil)
+}
+
+// removeStorageItems removes the items named, or all of them when keys is
+// nil
+func (s *Server) removeStorageItems(w http.ResponseWriter, r *http.Request, keys []string) {
+	deviceID, ok := s.storageDevice(w, r)
+	if !ok {
+		return
+	}
+
+	area := s.storageSync
+	area.writeMu.Lock()
+	defer area.writeMu.Unlock()
+
+	now := time.Now()
+	if exceeded := area.allowWrite(s.storageQuota(), deviceID, now); exceeded != "" {
+		s.respondError(w, http.StatusTooManyRequests, exceeded+" quota exceeded")
+		return
+	}
+	current, ok := s.loadStorageItems(w, r, deviceID)
+	if !ok {
+		return
+	}
+
+	if err := s.storage.RemoveStorageItems(r.Context(), deviceID, keys); err != nil {
+		s.log(r).Error("Failed to remove storage items: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to remove storage items")
+		return
+	}
+
+	if keys == nil {
+		for key := range current {
+			keys = append(keys, key)
+		}
+	}
+	changes := map[string]StorageChange{}
+	for _, key := range keys {
+		if item, ok := current[key]; ok {
+			changes[key] = StorageChange{OldValue: storageItemValue(item)}
+			s.publishPresetDeleted(item.ID, deviceID)
+		}
+	}
+	area.recordWrite(deviceID, changes, now)
+
+	s.log(r).Info("Storage items removed: %d (device: %s)", len(changes), deviceID)
+	s.respondSuccess(w, changes, fmt.Sprintf("Removed %d items", len(changes)))
+}
+
+// chrome.storage.sync.getBytesInUse, for repeated key parameters or every
+// item
+func (s *Server) handleGetStorageBytesInUse(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := s.storageDevice(w, r)
+	if !ok {
+		return
+	}
+	items, ok := s.loadStorageItems(w, r, deviceID)
+	if !ok {
+		return
+	}
+
+	keys, named := r.URL.Query()["key"]
+	var total int64
+	for key, item := range items {
+		if !named || slices.Contains(keys, key) {
+			total += storageItemBytes(key, storageItemValue(item))
+		}
+	}
+	s.respondSuccess(w, map[string]int64{"bytesInUse": total}, "")
+}
+
+// The quotas, as chrome.storage.sync's constants
+func (s *Server) handleGetStorageQuota(w http.ResponseWriter, r *http.Request) {
+	s.respondSuccess(w, s.storageQuota(), "")
+}
+
+// chrome.storage.onChanged: a device's changes since a cursor, waiting up to
+// wait seconds for some. Without since, it returns the cursor to start from.
+func (s *Server) handleGetStorageChanges(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := s.storageDevice(w, r)
+	if !ok {
+		return
+	}
+	limit := maxStorageWait
+	if timeout := time.Duration(s.config.Server.WriteTimeout) * time.Second; timeout > 0 {
+		limit = max(min(limit, timeout-time.Second), 0)
+	}
+	wait, err := boundedParam(r.URL.Query().Get("wait"), 0, int(limit/time.Second))
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "wait "+err.Error())
+		return
+	}
+
+	since := r.URL.Query().Get("since")
+	timer := time.NewTimer(time.Duration(wait) * time.Second)
+	defer timer.Stop()
+	for {
+		changes, wake := s.storageSync.changesSince(deviceID, since)
+		if since == "" || changes.Reset || len(changes.Changes) > 0 {
+			s.respondSuccess(w, changes, "")
+			return
+		}
+		select {
+		case <-wake:
+		case <-timer.C:
+			s.respondSuccess(w, changes, "")
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// sameJSON reports whether two values encode the same
+func sameJSON(a, b interface{}) bool {
+	x, errX := json.Marshal(a)
+	y, errY := json.Marshal(b)
+	return errX == nil && errY == nil && bytes.Equal(x, y)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// ndjsonContentType is the media type of newline-delimited JSON
+const ndjsonContentType = "application/x-ndjson"
+
+// Stream a device's presets as newline-delimited JSON, one preset per line,
+// flushing each as it is read. Unlike GET /presets the list is never held
+// in memory, so very large devices and slow links are served in flat
+// memory and clients can start on the first preset straight away.
+func (s *Server) handleStreamPresets(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" {
+		s.respondError(w, http.StatusBadRequest, "device_id parameter required")
+		return
+	}
+
+	proj, err := parseProjection(r)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	roles, err := s.storage.GetDeviceRoles(r.Context(), deviceID)
+	var userID string
+	if err == nil {
+		userID, err = s.deviceUserID(r.Context(), deviceID)
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get device roles: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve presets")
+		return
+	}
+
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	// Ask buffering proxies to pass each line on as it arrives
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	// The write timeout covers the whole response, which a slow link
+	// could outlast; each row gets its own instead
+	rc := http.NewResponseController(w)
+	writeTimeout := time.Duration(s.config.Server.WriteTimeout) * time.Second
+
+	// Headers are committed once streaming starts, so later failures can
+	// only be logged and surface to the client as a truncated body
+	enc := json.NewEncoder(w)
+	count := 0
+	err = s.storage.ForEachPreset(r.Context(), deviceID, func(p *storage.Preset) error {
+		p.Access = storage.PresetRole(p, deviceID, userID, roles)
+		s.transformOnRead(r.Context(), p)
+
+		item, err := proj.apply(p)
+		if err != nil {
+			return err
+		}
+		if writeTimeout > 0 {
+			if err := rc.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return err
+			}
+		}
+		if err := enc.Encode(item); err != nil {
+			return err
+		}
+		count++
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		s.log(r).Error("Preset stream failed after %d presets: %v", count, err)
+		return
+	}
+
+	// An empty stream still sends its headers
+	if count == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	s.log(r).Debug("Streamed %d presets (device: %s)", count, deviceID)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// defaultSuggestLimit is how many suggestions are returned when no limit
+// is given
+const defaultSuggestLimit = 10
+
+// matchLevels are the scope match levels, most specific first
+var matchLevels = []string{
+	matchExact, matchPath, matchOrigin, matchDomain, matchParentDomain,
+	matchRegistrableDomain, matchWildcard, matchRegex, matchGlobal,
+}
+
+// SuggestionScores are the factors a suggestion was ranked by, each from 0
+// to 1
+type SuggestionScores struct {
+	Specificity float64 `json:"specificity"`
+	Recency     float64 `json:"recency"`
+	Frequency   float64 `json:"frequency"`
+}
+
+// PresetSuggestion is a preset for a page, with how well it ranked
+type PresetSuggestion struct {
+	Preset *storage.Preset `json:"preset"`
+	// Level is how its scope matched the page, as in GET /scopes/resolve
+	Level  string           `json:"level"`
+	Score  float64          `json:"score"`
+	Scores SuggestionScores `json:"scores"`
+}
+
+// PresetSuggestions is the body of GET /presets/suggest
+type PresetSuggestions struct {
+	URL         string             `json:"url"`
+	Suggestions []PresetSuggestion `json:"suggestions"`
+	// Policy is the autofill policy of the page, as in GET /scopes/resolve
+	Policy *storage.ScopePolicy `json:"policy,omitempty"`
+}
+
+// specificityScore scores a match level from 1 for the exact URL down to 0
+// for global
+func specificityScore(level string) float64 {
+	i := slices.Index(matchLevels, level)
+	if i < 0 {
+		return 0
+	}
+	return 1 - float64(i)/float64(len(matchLevels)-1)
+}
+
+// recencyScore halves for every halfLife since the preset was last used,
+// or saved if it never was
+func recencyScore(p *storage.Preset, now time.Time, halfLife time.Duration) float64 {
+	last := p.UpdatedAt
+	if p.LastUsed != nil {
+		last = *p.LastUsed
+	}
+	if last.IsZero() || halfLife <= 0 {
+		return 0
+	}
+	age := now.Sub(last)
+	if age < 0 {
+		age = 0
+	}
+	return math.Pow(0.5, float64(age)/float64(halfLife))
+}
+
+// frequencyScore scores a use count against the most used candidate's, on
+// a log scale so a few heavily used presets don't flatten the rest
+func frequencyScore(uses, maxUses int) float64 {
+	if maxUses <= 0 {
+		return 0
+	}
+	return math.Log1p(float64(uses)) / math.Log1p(float64(maxUses))
+}
+
+// rankSuggestions scores the presets of a resolution by the configured
+// weights, best first. Ties keep the resolution's order.
+func (s *Server) rankSuggestions(resolution *ScopeResolution, now time.Time) []PresetSuggestion {
+	cfg := s.config.Suggest
+	totalWeight := cfg.SpecificityWeight + cfg.RecencyWeight + cfg.FrequencyWeight
+	halfLife := time.Duration(cfg.RecencyHalfLifeDays) * 24 * time.Hour
+
+	maxUses := 0
+	for _, m := range resolution.Matches {
+		for _, p := range m.Presets {
+			maxUses = max(maxUses, p.UseCount)
+		}
+	}
+
+	suggestions := []PresetSuggestion{}
+	for _, m := range resolution.Matches {
+		for _, p := range m.Presets {
+			scores := SuggestionScores{
+				Specificity: specificityScore(m.Level),
+				Recency:     recencyScore(p, now, halfLife),
+				Frequency:   frequencyScore(p.UseCount, maxUses),
+			}
+			score := 0.0
+			if totalWeight > 0 {
+				score = (cfg.SpecificityWeight*scores.Specificity + cfg.RecencyWeight*scores.Recency +
+					cfg.FrequencyWeight*scores.Frequency) / totalWeight
+			}
+			suggestions = append(suggestions, PresetSuggestion{
+				Preset: p,
+				Level:  m.Level,
+				Score:  roundScore(score),
+				Scores: SuggestionScores{
+					Specificity: roundScore(scores.Specificity),
+					Recency:     roundScore(scores.Recency),
+					Frequency:   roundScore(scores.Frequency),
+				},
+			})
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].Score > suggestions[j].Score
+	})
+	return suggestions
+}
+
+// roundScore rounds a score to three decimals
+func roundScore(score float64) float64 {
+	return math.Round(score*1000) / 1000
+}
+
+// Rank the presets for a page, best first, so the extension can preselect
+// one
+func (s *Server) handleSuggestPresets(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	if !s.requireDeviceScope(w, r, deviceID) {
+		return
+	}
+
+	limit := defaultSuggestLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+			s.respondError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+	}
+
+	u, ok := s.pageURL(w, r)
+	if !ok {
+		return
+	}
+
+	resolution, _, err := s.resolvePage(r, u, deviceID)
+	if err != nil {
+		s.log(r).Error("Failed to resolve scope: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve presets")
+		return
+	}
+
+	suggestions := s.rankSuggestions(resolution, time.Now())
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	s.respondSuccess(w, PresetSuggestions{URL: resolution.URL, Suggestions: suggestions, Policy: resolution.Policy},
+		fmt.Sprintf("Ranked %d presets", len(suggestions)))
+}
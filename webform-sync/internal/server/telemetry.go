@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// telemetryClient posts the telemetry report
+var telemetryClient = &http.Client{Timeout: 10 * time.Second}
+
+// TelemetryReport is the anonymous report sent when telemetry is on. It
+// holds no names, hostnames, addresses or IDs, and counts are rounded to
+// buckets, so no report can be traced to an installation.
+type TelemetryReport struct {
+	Version string `json:"version"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	// Presets, Devices and Users are bucketed counts across every tenant,
+	// such as "10-99"
+	Presets string `json:"presets"`
+	Devices string `json:"devices"`
+	Users   string `json:"users"`
+	// Tenants is the bucketed number of tenants, "0" without tenancy
+	Tenants string `json:"tenants"`
+	// Features are the optional features turned on, in order
+	Features []string `json:"features"`
+	Auth     string   `json:"auth"`
+	Cluster  bool     `json:"cluster"`
+}
+
+// TelemetryStatus is the body of GET /admin/telemetry
+type TelemetryStatus struct {
+	Enabled bool   `json:"enabled"`
+	URL     string `json:"url,omitempty"`
+	// Report is what is sent, or would be if telemetry were on
+	Report TelemetryReport `json:"report"`
+}
+
+// countBucket rounds a count down to its order of magnitude, so the
+// report shows scale without exact numbers
+func countBucket(n int) string {
+	switch {
+	case n <= 0:
+		return "0"
+	case n < 10:
+		return "1-9"
+	case n < 100:
+		return "10-99"
+	case n < 1000:
+		return "100-999"
+	case n < 10000:
+		return "1000-9999"
+	}
+	return "10000+"
+}
+
+// telemetryReport builds the report from this instance and its tenants
+func (s *Server) telemetryReport(ctx context.Context) (TelemetryReport, error) {
+	report := TelemetryReport{
+		Version:  "1.0.0",
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Tenants:  countBucket(len(s.tenants)),
+		Features: []string{},
+		Auth:     "none",
+		Cluster:  s.config.Cluster.Enabled,
+	}
+	if s.config.Authentication.Enabled {
+		report.Auth = s.config.Authentication.Type
+	}
+	for name, on := range s.features() {
+		if on {
+			report.Features = append(report.Features, name)
+		}
+	}
+	sort.Strings(report.Features)
+
+	var presets, devices, users int
+	instances := []*Server{s}
+	for _, t := range s.tenants {
+		instances = append(instances, t)
+	}
+	for _, instance := range instances {
+		totals, err := instance.storage.GetUsageTotals(ctx)
+		if err != nil {
+			return report, err
+		}
+		presets += totals.Presets
+		devices += totals.Devices - totals.RevokedDevices
+		users += totals.Users
+	}
+	report.Presets = countBucket(presets)
+	report.Devices = countBucket(devices)
+	report.Users = countBucket(users)
+	return report, nil
+}
+
+// sendTelemetry posts the report to telemetry.url
+func (s *Server) sendTelemetry(ctx context.Context) error {
+	report, err := s.telemetryReport(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to build telemetry report: %w", err)
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.Telemetry.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := telemetryClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send telemetry: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to send telemetry: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// runTelemetry sends the report every telemetry.interval_hours, starting
+// one interval after startup, until the server stops. Failures are only
+// logged at debug level: telemetry is a courtesy and nothing depends on it.
+func (s *Server) runTelemetry() {
+	ticker := time.NewTicker(time.Duration(s.config.Telemetry.IntervalHours) * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+
+		if s.isLeader() {
+			if err := s.sendTelemetry(s.ctx); err != nil {
+				s.logger.Debug("Telemetry not sent: %v", err)
+			}
+		}
+	}
+}
+
+// Show the telemetry setting and the exact report it sends
+func (s *Server) handleGetTelemetry(w http.ResponseWriter, r *http.Request) {
+	// The report covers every tenant, so only the service's own
+	// administrator may see it
+	if s.tenant != "" {
+		s.respondError(w, http.StatusForbidden, "Telemetry can only be viewed by the service administrator")
+		return
+	}
+
+	report, err := s.telemetryReport(r.Context())
+	if err != nil {
+		s.log(r).Error("Failed to build telemetry report: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to build telemetry report")
+		return
+	}
+	status := TelemetryStatus{Enabled: s.config.Telemetry.Enabled, Report: report}
+	if status.Enabled {
+		status.URL = s.config.Telemetry.URL
+	}
+	s.respondSuccess(w, status, "")
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/storage"
+	"golang.org/x/net/webdav"
+)
+
+// openTenants creates an isolated server instance for each configured
+// tenant. Every tenant has its own database, API token and quota, and its own
+// router, so no request can reach another tenant's data.
+func (s *Server) openTenants() error {
+	s.tenants = make(map[string]*Server, len(s.config.Tenancy.Tenants))
+
+	for _, t := range s.config.Tenancy.Tenants {
+		cfg := s.tenantConfig(t)
+
+		store, err := storage.NewStorage(cfg.Storage, s.logger)
+		if err != nil {
+			s.closeTenants(context.Background())
+			return fmt.Errorf("failed to open storage for tenant %s: %w", t.ID, err)
+		}
+		store.EnableCache(cfg.Performance.Cache)
+		store.EnableSyncLogBuffer(cfg.Performance.SyncLog)
+		if err := store.EnableWriteBehind(cfg.Performance.WriteBehind); err != nil {
+			store.Close()
+			s.closeTenants(context.Background())
+			return fmt.Errorf("failed to open storage for tenant %s: %w", t.ID, err)
+		}
+		presets, err := store.OpenPresetStore(cfg.Storage.Backend, t.ID)
+		if err != nil {
+			store.Close()
+			s.closeTenants(context.Background())
+			return fmt.Errorf("failed to open storage for tenant %s: %w", t.ID, err)
+		}
+
+		tenant := &Server{
+			config:        &cfg,
+			storage:       store,
+			presets:       presets,
+			logger:        s.logger,
+			urlFilters:    s.urlFilters,
+			ipFilters:     s.ipFilters,
+			fieldPolicy:   s.fieldPolicy,
+			lockout:       s.lockout,
+			transforms:    s.transforms,
+			authProvider:  s.authProvider,
+			stop:          s.stop,
+			jobs:          s.jobs,
+			ctx:           s.ctx,
+			cancel:        s.cancel,
+			started:       s.started,
+			tenant:        t.ID,
+			shareSecret:   s.shareSecret,
+			events:        newEventBus(&cfg, t.ID, store, s.logger),
+			backupMu:      &sync.Mutex{},
+			maintenanceMu: &sync.Mutex{},
+			jobManager:    s.jobManager,
+			leader:        s.leader,
+			outage:        &dbOutage{},
+			requests:      s.requests,
+			storageSync:   newStorageSyncArea(),
+			davLocks:      webdav.NewMemLS(),
+		}
+		schema, err := tenant.buildGraphQLSchema()
+		if err != nil {
+			store.Close()
+			s.closeTenants(context.Background())
+			return fmt.Errorf("failed to build GraphQL schema for tenant %s: %w", t.ID, err)
+		}
+		tenant.graphqlSchema = schema
+		tenant.setupRouter()
+		publishCacheInvalidations(&cfg, store, tenant.events)
+
+		s.tenants[t.ID] = tenant
+		s.logger.Info("Tenant %s ready (%s)", t.ID, cfg.Storage.DataDir)
+	}
+
+	return nil
+}
+
+// tenantConfig derives a tenant's config from the service's own
+func (s *Server) tenantConfig(t config.TenantConfig) config.Config {
+	cfg := *s.config
+	cfg.Authentication.APIToken = t.APIToken
+	cfg.Storage.DataDir = filepath.Join(s.config.Storage.DataDir, "tenants", t.ID)
+	if t.Quota != nil {
+		cfg.Storage.Quota = *t.Quota
+	}
+	cfg.Performance.Cache.Redis.KeyPrefix += t.ID + ":"
+	return cfg
+}
+
+// closeTenants drains every tenant's event bus, then closes its storage
+func (s *Server) closeTenants(ctx context.Context) {
+	for id, tenant := range s.tenants {
+		tenant.events.Close(ctx)
+		if err := tenant.storage.Close(); err != nil {
+			s.logger.Error("Failed to close storage for tenant %s: %v", id, err)
+		}
+	}
+}
+
+// requestTenant returns the tenant a request selects, by header or else by
+// subdomain of the configured domain, or "" for none
+func (s *Server) requestTenant(r *http.Request) string {
+	if id := r.Header.Get(s.config.Tenancy.Header); id != "" {
+		return strings.ToLower(id)
+	}
+
+	domain := strings.ToLower(s.config.Tenancy.Domain)
+	if domain == "" {
+		return ""
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if sub := strings.TrimSuffix(host, "."+domain); sub != host && !strings.Contains(sub, ".") {
+		return sub
+	}
+	return ""
+}
+
+// Middleware: dispatch requests to the selected tenant's router
+func (s *Server) tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Probes check every tenant from the default instance
+		if isProbe(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id := s.requestTenant(r)
+		if id == "" {
+			if s.config.Tenancy.Required {
+				s.respondError(w, http.StatusBadRequest, "Tenant required")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tenant, ok := s.tenants[id]
+		if !ok {
+			s.respondError(w, http.StatusNotFound, "Unknown tenant")
+			return
+		}
+		tenant.router.ServeHTTP(w, r)
+	})
+}
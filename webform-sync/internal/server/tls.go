@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/certs"
+)
+
+// setupTLS configures HTTPS from server.tls, along with the plain HTTP
+// server that redirects to it and answers ACME challenges
+func (s *Server) setupTLS() error {
+	cfg := s.config.Server.TLS
+	if !cfg.Enabled {
+		return nil
+	}
+
+	var redirect http.Handler = http.HandlerFunc(s.redirectToHTTPS)
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.Autocert.Enabled {
+		manager, err := certs.NewManager(cfg.Autocert, s.logger)
+		if err != nil {
+			return err
+		}
+		s.autocert = manager
+		tlsConfig.GetCertificate = manager.GetCertificate
+		redirect = manager.HTTPHandler(redirect)
+	} else {
+		files, err := certs.NewFiles(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.GetCertificate = files.GetCertificate
+	}
+	s.httpServer.TLSConfig = tlsConfig
+
+	if cfg.RedirectPort > 0 {
+		s.redirectServer = &http.Server{
+			Addr:        net.JoinHostPort(s.config.Server.Host, fmt.Sprint(cfg.RedirectPort)),
+			Handler:     redirect,
+			ReadTimeout: time.Duration(s.config.Server.ReadTimeout) * time.Second,
+		}
+	}
+	return nil
+}
+
+// redirectToHTTPS sends a plain HTTP request to the same URL over HTTPS
+func (s *Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+	if _, port, err := net.SplitHostPort(s.httpServer.Addr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	// 301 lets clients turn a POST into a GET, so other methods get 308
+	status := http.StatusPermanentRedirect
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		status = http.StatusMovedPermanently
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/events"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// transferRequest is the body of the transfer endpoints
+type transferRequest struct {
+	FromDeviceID string   `json:"fromDeviceId"`
+	ToDeviceID   string   `json:"toDeviceId"`
+	IDs          []string `json:"ids,omitempty"` // Bulk only; empty means all
+}
+
+// Transfer one preset to another device
+func (s *Server) handleTransferPreset(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.decodeTransferRequest(w, r)
+	if !ok {
+		return
+	}
+
+	results, err := s.storage.TransferPresets(r.Context(), []string{mux.Vars(r)["id"]}, req.FromDeviceID, req.ToDeviceID)
+	if err != nil {
+		s.log(r).Error("Failed to transfer preset: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to transfer preset")
+		return
+	}
+
+	result := results[0]
+	switch result.Status {
+	case storage.TransferNotFound:
+		s.respondError(w, http.StatusNotFound, "Preset not found")
+	case storage.TransferConflict:
+		s.respondError(w, http.StatusConflict, result.Error)
+	case storage.TransferQuota:
+		s.respondError(w, http.StatusRequestEntityTooLarge, result.Error)
+	default:
+		preset, err := s.storage.GetPreset(r.Context(), result.ID)
+		if err != nil {
+			s.log(r).Error("Failed to get preset: %v", err)
+			s.respondError(w, http.StatusInternalServerError, "Failed to retrieve preset")
+			return
+		}
+		s.publishSync(events.SyncTransferred, syncEventData{Count: 1, DeviceID: req.FromDeviceID, ToDeviceID: req.ToDeviceID})
+		s.respondSuccess(w, preset, "Preset transferred successfully")
+	}
+}
+
+// Transfer several (or all) presets between devices
+func (s *Server) handleBulkTransfer(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.decodeTransferRequest(w, r)
+	if !ok {
+		return
+	}
+
+	results, err := s.storage.TransferPresets(r.Context(), req.IDs, req.FromDeviceID, req.ToDeviceID)
+	if err != nil {
+		s.log(r).Error("Failed to transfer presets: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to transfer presets")
+		return
+	}
+
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.Status]++
+	}
+
+	s.publishSync(events.SyncTransferred, syncEventData{
+		Count: counts[storage.TransferMoved], DeviceID: req.FromDeviceID, ToDeviceID: req.ToDeviceID, Counts: counts,
+	})
+	s.respondSuccess(w, map[string]interface{}{
+		"fromDeviceId": req.FromDeviceID,
+		"toDeviceId":   req.ToDeviceID,
+		"total":        len(results),
+		"counts":       counts,
+		"items":        results,
+	}, fmt.Sprintf("Transferred %d of %d presets", counts[storage.TransferMoved], len(results)))
+}
+
+// decodeTransferRequest reads and validates a transfer body. The target
+// device is admitted like any other client, so revoked devices can't receive
+// presets.
+func (s *Server) decodeTransferRequest(w http.ResponseWriter, r *http.Request) (*transferRequest, bool) {
+	var req transferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return nil, false
+	}
+	if req.FromDeviceID == "" || req.ToDeviceID == "" {
+		s.respondError(w, http.StatusBadRequest, "fromDeviceId and toDeviceId are required")
+		return nil, false
+	}
+	if req.FromDeviceID == req.ToDeviceID {
+		s.respondError(w, http.StatusBadRequest, "fromDeviceId and toDeviceId must differ")
+		return nil, false
+	}
+	if !s.authorizeDevice(w, r, req.FromDeviceID) || !s.admitDevice(w, r, req.ToDeviceID) {
+		return nil, false
+	}
+	return &req, true
+}
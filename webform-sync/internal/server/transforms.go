@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/logger"
+	"github.com/tezza1971/webform-sync/internal/storage"
+	"github.com/tezza1971/webform-sync/internal/transform"
+)
+
+// loadTransforms loads the transform script, or returns nil if none is
+// configured
+func loadTransforms(cfg config.TransformsConfig, log *logger.Logger) (*transform.Script, error) {
+	if cfg.Script == "" {
+		return nil, nil
+	}
+	script, err := transform.Load(cfg.Script, time.Duration(cfg.TimeoutMS)*time.Millisecond, cfg.MaxSteps, func(msg string) {
+		log.Debug("Transform script: %s", msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Loaded transform script %s", cfg.Script)
+	return script, nil
+}
+
+// transformPreset is what the script sees of a preset
+func transformPreset(preset *storage.Preset) transform.Preset {
+	return transform.Preset{
+		Name:       preset.Name,
+		ScopeType:  preset.ScopeType,
+		ScopeValue: preset.ScopeValue,
+		DeviceID:   preset.DeviceID,
+		Fields:     preset.Fields,
+	}
+}
+
+// transformOnSave runs the script's on_save hook over a preset about to be
+// saved. A preset the script refuses gets 422 with its reason; a script
+// that fails refuses the save rather than store fields it didn't check.
+// Encrypted presets are passed over, as the server can't read them.
+func (s *Server) transformOnSave(r *http.Request, preset *storage.Preset) (int, error) {
+	if !s.transforms.Has(transform.OnSave) || preset.Encrypted || preset.Fields == nil {
+		return 0, nil
+	}
+	fields, err := s.transforms.Run(transform.OnSave, transformPreset(preset))
+	var rejected *transform.Rejected
+	if errors.As(err, &rejected) {
+		s.log(r).Info("Preset %q rejected by the transform script: %s", preset.Name, rejected.Reason)
+		return http.StatusUnprocessableEntity, rejected
+	}
+	if err != nil {
+		s.log(r).Error("Transform script failed on preset %q: %v", preset.Name, err)
+		return http.StatusInternalServerError, errors.New("failed to transform preset")
+	}
+	preset.Fields = fields
+	// Stored from Fields, not from whatever the client sent alongside
+	preset.EncryptedFields = ""
+	return 0, nil
+}
+
+// transformOnRead runs the script's on_read hook over presets about to be
+// sent to a client. The presets must be the caller's own copies. A preset
+// the script fails on is sent as stored, so a broken script can't hide
+// presets.
+func (s *Server) transformOnRead(ctx context.Context, presets ...*storage.Preset) {
+	if !s.transforms.Has(transform.OnRead) {
+		return
+	}
+	for _, preset := range presets {
+		if preset.Encrypted || preset.Fields == nil {
+			continue
+		}
+		fields, err := s.transforms.Run(transform.OnRead, transformPreset(preset))
+		if err != nil {
+			s.logContext(ctx).Warn("Transform script failed reading preset %q: %v", preset.Name, err)
+			continue
+		}
+		fieldsJSON, err := json.Marshal(fields)
+		if err != nil {
+			s.logContext(ctx).Warn("Transform script returned unencodable fields for preset %q: %v", preset.Name, err)
+			continue
+		}
+		preset.Fields = fields
+		preset.EncryptedFields = string(fieldsJSON)
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// defaultUsageDays is the period usage is reported for when none is given
+const defaultUsageDays = 90
+
+// usageFilter reads the bucket size and period of a usage query, and the
+// device and domain from its query parameters
+func (s *Server) usageFilter(w http.ResponseWriter, r *http.Request) (storage.UsageFilter, bool) {
+	query := r.URL.Query()
+	filter := storage.UsageFilter{
+		DeviceID:   query.Get("device_id"),
+		Domain:     strings.ToLower(strings.TrimSpace(query.Get("domain"))),
+		BucketSize: query.Get("bucket"),
+	}
+	switch filter.BucketSize {
+	case "":
+		filter.BucketSize = "day"
+	case "day", "week", "month":
+	default:
+		s.respondError(w, http.StatusBadRequest, "bucket must be day, week, or month")
+		return filter, false
+	}
+
+	days := defaultUsageDays
+	if daysStr := query.Get("days"); daysStr != "" {
+		var err error
+		if days, err = strconv.Atoi(daysStr); err != nil || days <= 0 {
+			s.respondError(w, http.StatusBadRequest, "days must be a positive number")
+			return filter, false
+		}
+	}
+	filter.Since = time.Now().AddDate(0, 0, -days)
+	return filter, true
+}
+
+// Get a preset's uses over time
+func (s *Server) handleGetPresetUsage(w http.ResponseWriter, r *http.Request) {
+	filter, ok := s.usageFilter(w, r)
+	if !ok || !s.requireDeviceScope(w, r, filter.DeviceID) || !s.authorizeDevice(w, r, filter.DeviceID) {
+		return
+	}
+
+	preset, err := s.storage.GetPreset(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrPresetNotFound) {
+		s.respondError(w, http.StatusNotFound, "Preset not found")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get preset: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve preset usage")
+		return
+	}
+	if filter.DeviceID != "" {
+		role, err := s.presetRole(r.Context(), preset, filter.DeviceID)
+		if err != nil {
+			s.log(r).Error("Failed to check preset access: %v", err)
+			s.respondError(w, http.StatusInternalServerError, "Failed to retrieve preset usage")
+			return
+		}
+		if role == "" {
+			s.respondError(w, http.StatusNotFound, "Preset not found")
+			return
+		}
+	}
+
+	usage, err := s.storage.GetPresetUsage(r.Context(), preset, filter)
+	if err != nil {
+		s.log(r).Error("Failed to get preset usage: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve preset usage")
+		return
+	}
+	s.respondSuccess(w, usage, fmt.Sprintf("Preset used %d times", usage.Uses))
+}
+
+// Get the uses of each domain's presets over time
+func (s *Server) handleGetDomainUsage(w http.ResponseWriter, r *http.Request) {
+	filter, ok := s.usageFilter(w, r)
+	if !ok || !s.requireDeviceScope(w, r, filter.DeviceID) || !s.authorizeDevice(w, r, filter.DeviceID) {
+		return
+	}
+
+	domains, err := s.storage.GetDomainUsage(r.Context(), filter)
+	if err != nil {
+		s.log(r).Error("Failed to get domain usage: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve domain usage")
+		return
+	}
+	s.respondSuccess(w, domains, fmt.Sprintf("Found usage for %d domains", len(domains)))
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// usageExportClient posts metrics; an export that takes longer than its
+// interval would pile up
+var usageExportClient = &http.Client{Timeout: 10 * time.Second}
+
+// metricFamily is one metric with its series
+type metricFamily struct {
+	name, help, kind string
+	series           []metricSeries
+}
+
+// metricSeries is one labelled value of a metric
+type metricSeries struct {
+	labels map[string]string
+	value  float64
+}
+
+// metricsWriter renders metric families in the Prometheus text format,
+// adding the same labels to every series
+type metricsWriter struct {
+	buf    bytes.Buffer
+	common map[string]string
+}
+
+// family writes a metric's HELP and TYPE lines and its series
+func (m *metricsWriter) family(f metricFamily) {
+	if len(f.series) == 0 {
+		return
+	}
+	fmt.Fprintf(&m.buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	for _, series := range f.series {
+		labels := make(map[string]string, len(m.common)+len(series.labels))
+		for k, v := range m.common {
+			labels[k] = v
+		}
+		for k, v := range series.labels {
+			// An empty label is the same as none, as for the default tenant
+			if v != "" {
+				labels[k] = v
+			}
+		}
+		m.buf.WriteString(f.name)
+		m.labels(labels)
+		m.buf.WriteByte(' ')
+		m.buf.WriteString(strconv.FormatFloat(series.value, 'f', -1, 64))
+		m.buf.WriteByte('\n')
+	}
+}
+
+// labels writes a label set, sorted by name
+func (m *metricsWriter) labels(labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	m.buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			m.buf.WriteByte(',')
+		}
+		fmt.Fprintf(&m.buf, `%s="%s"`, name, escapeLabelValue(labels[name]))
+	}
+	m.buf.WriteByte('}')
+}
+
+// escapeLabelValue escapes a label value for the text format
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// usageMetrics collects the usage metrics of this instance and its tenants.
+// They are counts and sizes only: never names, scopes or field contents.
+func (s *Server) usageMetrics(ctx context.Context) ([]byte, error) {
+	cfg := s.config.UsageExport
+	common := map[string]string{"instance": cfg.Instance}
+	if common["instance"] == "" {
+		common["instance"] = shortHostname()
+	}
+	for k, v := range cfg.Labels {
+		common[k] = v
+	}
+
+	// Tenants get a series each, labelled with their ID
+	instances := []*Server{s}
+	for _, t := range s.tenants {
+		instances = append(instances, t)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].tenant < instances[j].tenant })
+
+	families := []metricFamily{
+		{name: "webform_sync_presets", help: "Presets stored, by scope type.", kind: "gauge"},
+		{name: "webform_sync_preset_bytes", help: "Size of the stored preset data.", kind: "gauge"},
+		{name: "webform_sync_preset_uses_total", help: "Times presets have been used, over their lifetime.", kind: "counter"},
+		{name: "webform_sync_pii_presets", help: "Presets holding personal data, by kind.", kind: "gauge"},
+		{name: "webform_sync_devices", help: "Registered devices, by state.", kind: "gauge"},
+		{name: "webform_sync_users", help: "User accounts.", kind: "gauge"},
+		{name: "webform_sync_database_bytes", help: "Size of the database file.", kind: "gauge"},
+		{name: "webform_sync_slow_queries_total", help: "Statements slower than storage.slow_query_ms.", kind: "counter"},
+	}
+	for _, instance := range instances {
+		tenant := map[string]string{"tenant": instance.tenant}
+		with := func(k, v string) map[string]string {
+			return map[string]string{"tenant": instance.tenant, k: v}
+		}
+
+		totals, err := instance.storage.GetUsageTotals(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, scopeType := range sortedKeys(totals.ByScopeType) {
+			families[0].series = append(families[0].series, metricSeries{with("scope_type", scopeType), float64(totals.ByScopeType[scopeType])})
+		}
+		families[1].series = append(families[1].series, metricSeries{tenant, float64(totals.PresetBytes)})
+		families[2].series = append(families[2].series, metricSeries{tenant, float64(totals.Uses)})
+		for _, kind := range sortedKeys(totals.PII) {
+			families[3].series = append(families[3].series, metricSeries{with("kind", kind), float64(totals.PII[kind])})
+		}
+		families[4].series = append(families[4].series,
+			metricSeries{with("state", "active"), float64(totals.Devices - totals.RevokedDevices)},
+			metricSeries{with("state", "revoked"), float64(totals.RevokedDevices)})
+		families[5].series = append(families[5].series, metricSeries{tenant, float64(totals.Users)})
+		families[6].series = append(families[6].series, metricSeries{tenant, float64(totals.DatabaseBytes)})
+		families[7].series = append(families[7].series, metricSeries{tenant, float64(instance.storage.SlowQueries())})
+	}
+
+	// Requests are counted across tenants
+	rates := s.requests.rates(time.Now())
+	families = append(families,
+		metricFamily{name: "webform_sync_requests_total", help: "HTTP requests served.", kind: "counter",
+			series: []metricSeries{{value: float64(rates.Total)}}},
+		metricFamily{name: "webform_sync_request_errors_total", help: "HTTP requests answered with a 5xx status.", kind: "counter",
+			series: []metricSeries{{value: float64(rates.Errors)}}},
+		metricFamily{name: "webform_sync_slow_requests_total", help: "HTTP requests slower than logging.slow_request_ms.", kind: "counter",
+			series: []metricSeries{{value: float64(rates.Slow)}}},
+		metricFamily{name: "webform_sync_start_time_seconds", help: "When the service started, in seconds since the epoch.", kind: "gauge",
+			series: []metricSeries{{value: float64(s.started.Unix())}}},
+	)
+
+	w := &metricsWriter{common: common}
+	for _, f := range families {
+		w.family(f)
+	}
+	return w.buf.Bytes(), nil
+}
+
+// sortedKeys returns a count map's keys in order
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// exportUsage collects the usage metrics and sends them to the configured
+// URL and file
+func (s *Server) exportUsage(ctx context.Context) error {
+	metrics, err := s.usageMetrics(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to collect usage metrics: %w", err)
+	}
+
+	cfg := s.config.UsageExport
+	if cfg.File != "" {
+		if err := writeFileAtomic(cfg.File, metrics); err != nil {
+			return fmt.Errorf("failed to write usage metrics: %w", err)
+		}
+	}
+	if cfg.URL != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(metrics))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+		for k, v := range cfg.Headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := usageExportClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to post usage metrics: %w", err)
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("failed to post usage metrics: unexpected status %d", resp.StatusCode)
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data, so a reader never sees half a
+// file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// runUsageExport exports the usage metrics every
+// usage_export.interval_seconds until the server stops. Failures are
+// logged once until an export succeeds again.
+func (s *Server) runUsageExport() {
+	ticker := time.NewTicker(time.Duration(s.config.UsageExport.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		if s.isLeader() {
+			err := s.exportUsage(s.ctx)
+			switch {
+			case err != nil && !failing:
+				s.logger.Warn("Usage export failed: %v", err)
+			case err == nil && failing:
+				s.logger.Info("Usage export is working again")
+			}
+			failing = err != nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
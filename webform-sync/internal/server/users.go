@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// contextKey namespaces request context values set by this package
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	loggerContextKey
+)
+
+// withUser attaches the authenticated user to a request
+func withUser(r *http.Request, user *storage.User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+}
+
+// requestUser returns the user authenticated by a per-user token, or nil for
+// requests made with the admin token (or with authentication disabled)
+func requestUser(r *http.Request) *storage.User {
+	user, _ := r.Context().Value(userContextKey).(*storage.User)
+	return user
+}
+
+// requestUserID returns the authenticated user's ID, or "" for admin requests
+func requestUserID(r *http.Request) string {
+	if user := requestUser(r); user != nil {
+		return user.ID
+	}
+	return ""
+}
+
+// requireAdmin rejects requests made with a per-user token
+func (s *Server) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if requestUser(r) != nil {
+		s.respondError(w, http.StatusForbidden, "Admin token required")
+		return false
+	}
+	return true
+}
+
+// adminOnly wraps a handler so per-user tokens are rejected
+func (s *Server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.requireAdmin(w, r) {
+			next(w, r)
+		}
+	}
+}
+
+// authorizeDevice rejects per-user requests about a device owned by another
+// user. Unknown devices are let through for the handler to report.
+func (s *Server) authorizeDevice(w http.ResponseWriter, r *http.Request, deviceID string) bool {
+	user := requestUser(r)
+	if user == nil {
+		return true
+	}
+
+	device, err := s.storage.GetDevice(r.Context(), deviceID)
+	if errors.Is(err, storage.ErrDeviceNotFound) {
+		return true
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get device: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to check device owner")
+		return false
+	}
+	if device.UserID != user.ID {
+		s.respondError(w, http.StatusForbidden, "Device belongs to another user")
+		return false
+	}
+	return true
+}
+
+// ownDevice wraps a /devices/{id} handler with authorizeDevice
+func (s *Server) ownDevice(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.authorizeDevice(w, r, mux.Vars(r)["id"]) {
+			next(w, r)
+		}
+	}
+}
+
+// userWithToken is returned when a token is issued; the token is shown once
+type userWithToken struct {
+	*storage.User
+	Token string `json:"token"`
+}
+
+// List users
+func (s *Server) handleGetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.storage.GetUsers(r.Context())
+	if err != nil {
+		s.log(r).Error("Failed to get users: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve users")
+		return
+	}
+
+	s.respondSuccess(w, users, "")
+}
+
+// Create a user and issue its API token
+func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if strings.TrimSpace(body.Name) == "" {
+		s.respondError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	user, token, err := s.storage.CreateUser(r.Context(), strings.TrimSpace(body.Name))
+	if err != nil {
+		s.log(r).Error("Failed to create user: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to create user")
+		return
+	}
+
+	s.respondJSON(w, http.StatusCreated, APIResponse{
+		Success: true,
+		Data:    userWithToken{User: user, Token: token},
+		Message: "User created; store the token now, it is not shown again",
+	})
+}
+
+// Get a user with its devices
+func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	s.respondUser(w, r, mux.Vars(r)["id"])
+}
+
+// Get the user owning the request's token
+func (s *Server) handleGetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == nil {
+		s.respondError(w, http.StatusNotFound, "Request is not authenticated as a user")
+		return
+	}
+	s.respondUser(w, r, user.ID)
+}
+
+// respondUser writes a user and its devices
+func (s *Server) respondUser(w http.ResponseWriter, r *http.Request, id string) {
+	user, err := s.storage.GetUser(r.Context(), id)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		s.respondError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get user: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve user")
+		return
+	}
+
+	devices, err := s.storage.GetDevices(r.Context(), user.ID)
+	if err != nil {
+		s.log(r).Error("Failed to get devices: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve user")
+		return
+	}
+
+	s.respondSuccess(w, map[string]interface{}{
+		"user":    user,
+		"devices": devices,
+	}, "")
+}
+
+// Rename a user
+func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if strings.TrimSpace(body.Name) == "" {
+		s.respondError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if err := s.storage.RenameUser(r.Context(), id, strings.TrimSpace(body.Name)); err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			s.respondError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		s.log(r).Error("Failed to rename user: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to update user")
+		return
+	}
+
+	s.respondUser(w, r, id)
+}
+
+// Delete a user
+func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	if err := s.storage.DeleteUser(r.Context(), mux.Vars(r)["id"]); err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			s.respondError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		s.log(r).Error("Failed to delete user: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to delete user")
+		return
+	}
+
+	s.respondSuccess(w, nil, "User deleted successfully")
+}
+
+// Issue a new API token for a user, invalidating the old one
+func (s *Server) handleRotateUserToken(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	token, err := s.storage.RotateUserToken(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			s.respondError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		s.log(r).Error("Failed to rotate token: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to rotate token")
+		return
+	}
+
+	s.respondSuccess(w, map[string]string{"id": id, "token": token},
+		"Token rotated; store the token now, it is not shown again")
+}
+
+// requireDeviceScope rejects per-user requests that would read across all
+// devices; users must name one of their own devices instead
+func (s *Server) requireDeviceScope(w http.ResponseWriter, r *http.Request, deviceID string) bool {
+	if deviceID == "" && requestUser(r) != nil {
+		s.respondError(w, http.StatusForbidden, "device_id parameter required for user tokens")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,488 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// API v2 uses plain REST semantics: resources are nested under their device,
+// bodies are the bare resource (no success envelope), errors use RFC 7807
+// problem documents, and list pagination is reported in headers. Clients that
+// still want the v1 envelope can ask for it with
+// `Accept: application/json; profile="envelope"`.
+
+const (
+	v2DefaultPageSize = 100
+	v2MaxPageSize     = 1000
+)
+
+// ProblemDetails is an RFC 7807 error body
+type ProblemDetails struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// RequestID is an extension member identifying the failed request
+	RequestID string `json:"requestId,omitempty"`
+	// RetryAfterMs is an extension member set when the request is worth
+	// retrying after that long, as in the v1 envelope
+	RetryAfterMs int64 `json:"retryAfterMs,omitempty"`
+}
+
+// setupV2Routes registers the /api/v2 routes
+func (s *Server) setupV2Routes(r *mux.Router) {
+	v2 := r.PathPrefix("/api/v2").Subrouter()
+
+	v2.HandleFunc("/health", s.handleV2Health).Methods("GET")
+
+	v2.HandleFunc("/devices", s.handleV2ListDevices).Methods("GET")
+	v2.HandleFunc("/devices/{device}/presets", s.handleV2ListPresets).Methods("GET")
+	v2.HandleFunc("/devices/{device}/presets", s.handleV2CreatePreset).Methods("POST")
+	v2.HandleFunc("/devices/{device}/presets/{id}", s.handleV2GetPreset).Methods("GET")
+	v2.HandleFunc("/devices/{device}/presets/{id}", s.handleV2ReplacePreset).Methods("PUT")
+	v2.HandleFunc("/devices/{device}/presets/{id}", s.handleV2DeletePreset).Methods("DELETE")
+	v2.HandleFunc("/devices/{device}/presets/{id}/usage", s.handleV2RecordUsage).Methods("POST")
+	v2.HandleFunc("/devices/{device}/scopes", s.handleV2ListScopes).Methods("GET")
+}
+
+// wantsEnvelope reports whether the client asked for the v1-style envelope
+func wantsEnvelope(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		accept = strings.ReplaceAll(accept, " ", "")
+		if strings.Contains(accept, `profile="envelope"`) || strings.Contains(accept, "profile=envelope") {
+			return true
+		}
+	}
+	return false
+}
+
+// respondV2 writes a bare resource, or the v1 envelope if requested
+func (s *Server) respondV2(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	if wantsEnvelope(r) {
+		s.respondJSON(w, status, APIResponse{Success: true, Data: data})
+		return
+	}
+	if data == nil {
+		w.WriteHeader(status)
+		return
+	}
+	s.respondJSON(w, status, data)
+}
+
+// respondV2Error writes an RFC 7807 problem document (or v1 error envelope)
+func (s *Server) respondV2Error(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	if status == http.StatusInternalServerError && s.storageFailed() {
+		s.respondUnavailable(w, r)
+		return
+	}
+	if wantsEnvelope(r) {
+		s.respondError(w, status, detail)
+		return
+	}
+
+	writeProblem(w, status, detail, 0)
+}
+
+// writeProblem writes an RFC 7807 problem document
+func writeProblem(w http.ResponseWriter, status int, detail string, retryAfterMs int64) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ProblemDetails{
+		Type:         "about:blank",
+		Title:        http.StatusText(status),
+		Status:       status,
+		Detail:       detail,
+		RequestID:    responseRequestID(w),
+		RetryAfterMs: retryAfterMs,
+	})
+}
+
+// parsePagination reads ?limit= and ?offset= with v2 defaults and bounds
+func parsePagination(r *http.Request) (int, int, error) {
+	limit, offset := v2DefaultPageSize, 0
+
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("limit must be a positive integer")
+		}
+		if n > v2MaxPageSize {
+			n = v2MaxPageSize
+		}
+		limit = n
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+		offset = n
+	}
+
+	return limit, offset, nil
+}
+
+// setPaginationHeaders emits X-Total-Count and an RFC 8288 Link header
+func setPaginationHeaders(w http.ResponseWriter, r *http.Request, total, limit, offset int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	link := func(rel string, off int) string {
+		q := r.URL.Query()
+		q.Set("limit", strconv.Itoa(limit))
+		q.Set("offset", strconv.Itoa(off))
+		u := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+		return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+	}
+
+	links := []string{link("first", 0)}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link("prev", prev))
+	}
+	if offset+limit < total {
+		links = append(links, link("next", offset+limit))
+	}
+	if total > 0 {
+		links = append(links, link("last", ((total-1)/limit)*limit))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// v2 health check
+func (s *Server) handleV2Health(w http.ResponseWriter, r *http.Request) {
+	s.respondV2(w, r, http.StatusOK, map[string]interface{}{
+		"status":  "ok",
+		"version": "1.0.0",
+	})
+}
+
+// v2 device list
+func (s *Server) handleV2ListDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := s.storage.GetDevices(r.Context(), requestUserID(r))
+	if err != nil {
+		s.log(r).Error("Failed to get devices: %v", err)
+		s.respondV2Error(w, r, http.StatusInternalServerError, "Failed to retrieve devices")
+		return
+	}
+
+	s.respondV2(w, r, http.StatusOK, devices)
+}
+
+// v2 paginated preset list for a device
+func (s *Server) handleV2ListPresets(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["device"]
+
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		s.respondV2Error(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	presets, total, err := s.presets.GetPresetsPage(r.Context(), deviceID, limit, offset)
+	if err != nil {
+		s.log(r).Error("Failed to get presets: %v", err)
+		s.respondV2Error(w, r, http.StatusInternalServerError, "Failed to retrieve presets")
+		return
+	}
+
+	if err := s.annotateAccess(r.Context(), deviceID, presets); err != nil {
+		s.log(r).Error("Failed to get device roles: %v", err)
+		s.respondV2Error(w, r, http.StatusInternalServerError, "Failed to retrieve presets")
+		return
+	}
+
+	s.transformOnRead(r.Context(), presets...)
+	shaped, err := projectPresets(r, presets)
+	if err != nil {
+		s.respondV2Error(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	setPaginationHeaders(w, r, total, limit, offset)
+	if s.checkNotModified(w, r, presetsETag(presets...), time.Time{}) {
+		return
+	}
+
+	s.respondV2(w, r, http.StatusOK, shaped)
+}
+
+// loadDevicePreset fetches a preset and verifies it is visible to the device,
+// filling in the device's role in Access
+func (s *Server) loadDevicePreset(w http.ResponseWriter, r *http.Request) (*storage.Preset, bool) {
+	vars := mux.Vars(r)
+
+	preset, err := s.presets.GetPreset(r.Context(), vars["id"])
+	if errors.Is(err, storage.ErrPresetNotFound) {
+		s.respondV2Error(w, r, http.StatusNotFound, "Preset not found")
+		return nil, false
+	}
+	if err != nil {
+		s.log(r).Error("Failed to get preset: %v", err)
+		s.respondV2Error(w, r, http.StatusInternalServerError, "Failed to retrieve preset")
+		return nil, false
+	}
+
+	role, err := s.presetRole(r.Context(), preset, vars["device"])
+	if err != nil {
+		s.log(r).Error("Failed to check preset access: %v", err)
+		s.respondV2Error(w, r, http.StatusInternalServerError, "Failed to retrieve preset")
+		return nil, false
+	}
+	if role == "" {
+		s.respondV2Error(w, r, http.StatusNotFound, "Preset not found")
+		return nil, false
+	}
+	preset.Access = role
+
+	return preset, true
+}
+
+// v2 single preset
+func (s *Server) handleV2GetPreset(w http.ResponseWriter, r *http.Request) {
+	preset, ok := s.loadDevicePreset(w, r)
+	if !ok {
+		return
+	}
+
+	s.transformOnRead(r.Context(), preset)
+	if s.checkNotModified(w, r, presetsETag(preset), preset.UpdatedAt) {
+		return
+	}
+
+	s.respondV2(w, r, http.StatusOK, preset)
+}
+
+// decodeV2Preset reads and validates a preset body for the device in the path
+func (s *Server) decodeV2Preset(w http.ResponseWriter, r *http.Request) (*storage.Preset, bool) {
+	var preset storage.Preset
+	if err := json.NewDecoder(r.Body).Decode(&preset); err != nil {
+		s.respondV2Error(w, r, http.StatusBadRequest, "Invalid request body")
+		return nil, false
+	}
+
+	deviceID := mux.Vars(r)["device"]
+	if preset.DeviceID != "" && preset.DeviceID != deviceID {
+		s.respondV2Error(w, r, http.StatusUnprocessableEntity, "deviceId does not match the device in the URL")
+		return nil, false
+	}
+	preset.DeviceID = deviceID
+
+	if preset.Name == "" {
+		s.respondV2Error(w, r, http.StatusUnprocessableEntity, "name is required")
+		return nil, false
+	}
+
+	if err := checkScopePattern(&preset); err != nil {
+		s.respondV2Error(w, r, http.StatusUnprocessableEntity, err.Error())
+		return nil, false
+	}
+
+	if preset.ScopeValue != "" && !s.urlFilters.isAllowed(preset.ScopeValue) {
+		s.log(r).Warn("URL blocked by filter: %s", preset.ScopeValue)
+		s.respondV2Error(w, r, http.StatusForbidden, "URL not allowed")
+		return nil, false
+	}
+	if status, err := checkFieldTypes(&preset); err != nil {
+		s.respondV2Error(w, r, status, err.Error())
+		return nil, false
+	}
+	if status, err := s.transformOnSave(r, &preset); err != nil {
+		s.respondV2Error(w, r, status, err.Error())
+		return nil, false
+	}
+	if status, err := s.checkFieldPolicy(r, &preset); err != nil {
+		s.respondV2Error(w, r, status, err.Error())
+		return nil, false
+	}
+	if status, err := s.checkPII(r, &preset); err != nil {
+		s.respondV2Error(w, r, status, err.Error())
+		return nil, false
+	}
+
+	return &preset, true
+}
+
+// v2 create preset
+func (s *Server) handleV2CreatePreset(w http.ResponseWriter, r *http.Request) {
+	preset, ok := s.decodeV2Preset(w, r)
+	if !ok {
+		return
+	}
+
+	if preset.ID != "" {
+		if !storage.IsValidPresetID(preset.ID) {
+			s.respondV2Error(w, r, http.StatusUnprocessableEntity, "id must be a UUID")
+			return
+		}
+		_, exists, err := s.presets.GetPresetOwner(r.Context(), preset.ID)
+		if err != nil {
+			s.log(r).Error("Failed to check preset ID: %v", err)
+			s.respondV2Error(w, r, http.StatusInternalServerError, "Failed to save preset")
+			return
+		}
+		if exists {
+			s.respondV2Error(w, r, http.StatusConflict, "A preset with this id already exists")
+			return
+		}
+	}
+
+	now := time.Now()
+	if preset.CreatedAt.IsZero() {
+		preset.CreatedAt = now
+	}
+	preset.UpdatedAt = now
+
+	if err := s.presets.SavePreset(r.Context(), preset); err != nil {
+		if status, ok := quotaStatus(err); ok {
+			s.log(r).Warn("Preset rejected: %v", err)
+			s.respondV2Error(w, r, status, err.Error())
+			return
+		}
+		s.log(r).Error("Failed to save preset: %v", err)
+		s.respondV2Error(w, r, http.StatusInternalServerError, "Failed to save preset")
+		return
+	}
+
+	s.log(r).Info("Preset saved: %s (device: %s)", preset.ID, preset.DeviceID)
+	s.publishPresetSaved(preset)
+	w.Header().Set("Location", fmt.Sprintf("/api/v2/devices/%s/presets/%s", url.PathEscape(preset.DeviceID), url.PathEscape(preset.ID)))
+	w.Header().Set("ETag", presetsETag(preset))
+	s.respondV2(w, r, http.StatusCreated, preset)
+}
+
+// v2 replace preset
+func (s *Server) handleV2ReplacePreset(w http.ResponseWriter, r *http.Request) {
+	existing, ok := s.loadDevicePreset(w, r)
+	if !ok {
+		return
+	}
+
+	// Honor If-Match for optimistic concurrency. The version it matched is
+	// checked again by the write, in case the preset changes in between.
+	version := 0
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagMatches(im, presetsETag(existing)) {
+			s.respondV2Error(w, r, http.StatusPreconditionFailed, "Preset has been modified")
+			return
+		}
+		version = existing.Version
+	}
+
+	if !storage.RoleAllows(existing.Access, storage.RoleEditor) {
+		s.respondV2Error(w, r, http.StatusForbidden, "Group role does not allow editing this preset")
+		return
+	}
+
+	preset, ok := s.decodeV2Preset(w, r)
+	if !ok {
+		return
+	}
+
+	// Group editors change the preset in place; it stays with its owner
+	if existing.DeviceID != "" {
+		preset.DeviceID = existing.DeviceID
+	}
+	preset.ID = existing.ID
+	preset.Access = existing.Access
+	preset.CreatedAt = existing.CreatedAt
+	preset.UpdatedAt = time.Now()
+	preset.LastUsed = existing.LastUsed
+	preset.UseCount = existing.UseCount
+
+	// EditPreset, unlike SavePreset, also writes a change of scope
+	if err := s.presets.EditPresetVersion(r.Context(), preset, version); err != nil {
+		switch {
+		case errors.Is(err, storage.ErrPresetModified):
+			s.respondV2Error(w, r, http.StatusPreconditionFailed, "Preset has been modified")
+			return
+		case errors.Is(err, storage.ErrPresetNotFound):
+			s.respondV2Error(w, r, http.StatusNotFound, "Preset not found")
+			return
+		case errors.Is(err, storage.ErrPresetExists):
+			s.respondV2Error(w, r, http.StatusConflict, err.Error())
+			return
+		}
+		if status, ok := quotaStatus(err); ok {
+			s.log(r).Warn("Preset rejected: %v", err)
+			s.respondV2Error(w, r, status, err.Error())
+			return
+		}
+		s.log(r).Error("Failed to update preset: %v", err)
+		s.respondV2Error(w, r, http.StatusInternalServerError, "Failed to update preset")
+		return
+	}
+
+	s.log(r).Info("Preset updated: %s (device: %s)", preset.ID, preset.DeviceID)
+	s.publishPresetSaved(preset)
+	w.Header().Set("ETag", presetsETag(preset))
+	s.respondV2(w, r, http.StatusOK, preset)
+}
+
+// v2 delete preset
+func (s *Server) handleV2DeletePreset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	existing, ok := s.loadDevicePreset(w, r)
+	if !ok {
+		return
+	}
+	if existing.Access != storage.RoleOwner {
+		s.respondV2Error(w, r, http.StatusForbidden, "Group role does not allow deleting this preset")
+		return
+	}
+
+	err := s.presets.DeletePreset(r.Context(), existing.ID, existing.DeviceID)
+	if errors.Is(err, storage.ErrPresetNotFound) {
+		s.respondV2Error(w, r, http.StatusNotFound, "Preset not found")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("Failed to delete preset: %v", err)
+		s.respondV2Error(w, r, http.StatusInternalServerError, "Failed to delete preset")
+		return
+	}
+
+	s.log(r).Info("Preset deleted: %s (device: %s)", vars["id"], vars["device"])
+	s.publishPresetDeleted(existing.ID, existing.DeviceID)
+	s.respondV2(w, r, http.StatusNoContent, nil)
+}
+
+// v2 record a preset use
+func (s *Server) handleV2RecordUsage(w http.ResponseWriter, r *http.Request) {
+	preset, ok := s.loadDevicePreset(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.presets.UpdatePresetUsage(r.Context(), preset.ID); err != nil {
+		s.log(r).Error("Failed to update preset usage: %v", err)
+		s.respondV2Error(w, r, http.StatusInternalServerError, "Failed to update usage")
+		return
+	}
+
+	s.respondV2(w, r, http.StatusNoContent, nil)
+}
+
+// v2 scope list for a device
+func (s *Server) handleV2ListScopes(w http.ResponseWriter, r *http.Request) {
+	scopes, err := s.storage.GetScopes(r.Context(), mux.Vars(r)["device"])
+	if err != nil {
+		s.log(r).Error("Failed to get scopes: %v", err)
+		s.respondV2Error(w, r, http.StatusInternalServerError, "Failed to retrieve scopes")
+		return
+	}
+
+	s.respondV2(w, r, http.StatusOK, scopes)
+}
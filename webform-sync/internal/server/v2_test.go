@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// A v2 replace writes the new scope, and a stale If-Match is refused
+func TestV2ReplacePresetScope(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	preset := &storage.Preset{
+		DeviceID: "laptop", Name: "Login", ScopeType: storage.ScopeTypeDomain, ScopeValue: "a.example.com",
+		Fields: map[string]interface{}{"user": "alice"}, CreatedAt: now, UpdatedAt: now,
+	}
+	if err := s.storage.SavePreset(ctx, preset); err != nil {
+		t.Fatal(err)
+	}
+	etag := presetsETag(preset)
+
+	replace := func(ifMatch string) *httptest.ResponseRecorder {
+		body := `{"name": "Login", "scopeType": "domain", "scopeValue": "b.example.com", "fields": {"user": "alice"}}`
+		r := httptest.NewRequest(http.MethodPut, "/api/v2/devices/laptop/presets/"+preset.ID, strings.NewReader(body))
+		r.Header.Set("If-Match", ifMatch)
+		r = mux.SetURLVars(r, map[string]string{"device": "laptop", "id": preset.ID})
+		w := httptest.NewRecorder()
+		s.handleV2ReplacePreset(w, r)
+		return w
+	}
+
+	if w := replace(etag); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (%s)", w.Code, http.StatusOK, w.Body.String())
+	}
+	got, err := s.storage.GetPreset(ctx, preset.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ScopeValue != "b.example.com" {
+		t.Errorf("scope = %q, want b.example.com", got.ScopeValue)
+	}
+
+	if w := replace(etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale If-Match: status = %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+}
+
+// The version an edit is based on is checked by the write itself
+func TestEditPresetVersion(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	preset := &storage.Preset{
+		DeviceID: "laptop", Name: "Login", ScopeType: storage.ScopeTypeGlobal,
+		Fields: map[string]interface{}{"user": "alice"}, CreatedAt: now, UpdatedAt: now,
+	}
+	if err := s.storage.SavePreset(ctx, preset); err != nil {
+		t.Fatal(err)
+	}
+	base := preset.Version
+
+	edit := *preset
+	edit.Fields = map[string]interface{}{"user": "bob"}
+	if err := s.storage.EditPresetVersion(ctx, &edit, base); err != nil {
+		t.Fatal(err)
+	}
+	stale := *preset
+	stale.Fields = map[string]interface{}{"user": "mallory"}
+	if err := s.storage.EditPresetVersion(ctx, &stale, base); err != storage.ErrPresetModified {
+		t.Fatalf("err = %v, want %v", err, storage.ErrPresetModified)
+	}
+	got, err := s.storage.GetPreset(ctx, preset.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Fields["user"] != "bob" {
+		t.Errorf("fields = %v, want the first edit", got.Fields)
+	}
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// List webhook deliveries, newest first
+func (s *Server) handleGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	failedOnly, _ := strconv.ParseBool(r.URL.Query().Get("failed"))
+
+	deliveries, err := s.storage.GetWebhookDeliveries(r.Context(), failedOnly, limit, offset)
+	if err != nil {
+		s.log(r).Error("Failed to get webhook deliveries: %v", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to retrieve webhook deliveries")
+		return
+	}
+
+	s.respondSuccess(w, deliveries, fmt.Sprintf("Retrieved %d webhook deliveries", len(deliveries)))
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Backup run statuses
+const (
+	BackupOK     = "ok"
+	BackupFailed = "failed"
+)
+
+// BackupRun records one backup attempt
+type BackupRun struct {
+	ID         string    `json:"id"`
+	File       string    `json:"file"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Bytes      int64     `json:"bytes"`
+	// SHA256 is the hex SHA-256 checksum of the backup file
+	SHA256 string `json:"sha256,omitempty"`
+	// Status is ok or failed
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Remotes are the copies sent to storage.backup.remotes
+	Remotes []RemoteCopy `json:"remotes"`
+}
+
+// RemoteCopy records copying a backup to a remote
+type RemoteCopy struct {
+	Remote string `json:"remote"`
+	File   string `json:"file"`
+	Bytes  int64  `json:"bytes"`
+	// Status is ok or failed
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BackupTo writes a consistent copy of the database to path with VACUUM
+// INTO, which runs alongside other connections without blocking writers
+// for long, then checks that the copy opens and passes an integrity check.
+// path must not exist yet. A copy that fails the check is removed.
+func (s *Storage) BackupTo(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	s.awaitWrites()
+	s.flushSyncLog()
+	if _, err := s.db.ExecContext(ctx, `VACUUM INTO ?`, path); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to copy database: %w", err)
+	}
+	// The copy holds form data, so only the service's user may read it
+	if err := os.Chmod(path, 0600); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to restrict backup permissions: %w", err)
+	}
+	if err := verifyBackup(ctx, path); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("backup failed verification: %w", err)
+	}
+	return nil
+}
+
+// verifyBackup opens a backup read-only and checks its integrity and that
+// its presets can be read
+func verifyBackup(ctx context.Context, path string) error {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRowContext(ctx, `PRAGMA quick_check`).Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check: %s", result)
+	}
+	var count int
+	return db.QueryRowContext(ctx, `SELECT COUNT(*) FROM presets`).Scan(&count)
+}
+
+// RecordBackupRun adds a backup attempt to the history
+func (s *Storage) RecordBackupRun(ctx context.Context, run *BackupRun) error {
+	if run.ID == "" {
+		run.ID = NewPresetID()
+	}
+	if run.Remotes == nil {
+		run.Remotes = []RemoteCopy{}
+	}
+	remotes, err := json.Marshal(run.Remotes)
+	if err != nil {
+		return fmt.Errorf("failed to encode backup remotes: %w", err)
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO backup_runs (id, file, started_at, finished_at, bytes, sha256, status, error, remotes)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.ID, run.File, run.StartedAt, run.FinishedAt, run.Bytes, run.SHA256, run.Status, run.Error, string(remotes))
+	if err != nil {
+		return fmt.Errorf("failed to record backup: %w", err)
+	}
+	return nil
+}
+
+// GetBackupRuns returns the most recent backup attempts, newest first
+func (s *Storage) GetBackupRuns(ctx context.Context, limit int) ([]*BackupRun, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, file, started_at, finished_at, bytes, sha256, status, error, remotes
+		FROM backup_runs
+		ORDER BY started_at DESC
+		LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query backups: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []*BackupRun{}
+	for rows.Next() {
+		var run BackupRun
+		var remotes string
+		if err := rows.Scan(&run.ID, &run.File, &run.StartedAt, &run.FinishedAt, &run.Bytes, &run.SHA256, &run.Status, &run.Error, &remotes); err != nil {
+			return nil, fmt.Errorf("failed to scan backup: %w", err)
+		}
+		if err := json.Unmarshal([]byte(remotes), &run.Remotes); err != nil {
+			return nil, fmt.Errorf("failed to decode backup remotes: %w", err)
+		}
+		runs = append(runs, &run)
+	}
+	return runs, rows.Err()
+}
+
+// LastBackup returns when the newest successful backup finished, or the
+// zero time if there hasn't been one
+func (s *Storage) LastBackup(ctx context.Context) (time.Time, error) {
+	runs, err := s.db.QueryContext(ctx, `
+		SELECT finished_at FROM backup_runs
+		WHERE status = ?
+		ORDER BY finished_at DESC
+		LIMIT 1`, BackupOK)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to query backups: %w", err)
+	}
+	defer runs.Close()
+
+	var last time.Time
+	if runs.Next() {
+		if err := runs.Scan(&last); err != nil {
+			return time.Time{}, fmt.Errorf("failed to scan backup: %w", err)
+		}
+	}
+	return last, runs.Err()
+}
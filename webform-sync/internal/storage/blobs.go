@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// presetFieldsExpr is a preset's fields, read from preset_blobs when they
+// were offloaded there. Use it on presets selected without an alias.
+const presetFieldsExpr = `CASE WHEN presets.fields_blob = '' THEN presets.encrypted_fields
+		ELSE COALESCE((SELECT data FROM preset_blobs WHERE hash = presets.fields_blob), '') END`
+
+// presetFieldsBytesExpr is the size in bytes of presetFieldsExpr, without
+// reading an offloaded blob
+const presetFieldsBytesExpr = `CASE WHEN presets.fields_blob = '' THEN LENGTH(CAST(presets.encrypted_fields AS BLOB))
+		ELSE COALESCE((SELECT size FROM preset_blobs WHERE hash = presets.fields_blob), 0) END`
+
+// blobSchema releases blobs no preset refers to any more, however the
+// preset was deleted or rewritten. It needs presets.fields_blob, so it is
+// created once migrateSchema has added the column.
+const blobSchema = `
+	CREATE INDEX IF NOT EXISTS idx_presets_fields_blob ON presets(fields_blob) WHERE fields_blob != '';
+
+	CREATE TRIGGER IF NOT EXISTS preset_blobs_release_deleted
+	AFTER DELETE ON presets WHEN old.fields_blob != ''
+	BEGIN
+		DELETE FROM preset_blobs WHERE hash = old.fields_blob
+			AND NOT EXISTS (SELECT 1 FROM presets WHERE fields_blob = old.fields_blob);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS preset_blobs_release_updated
+	AFTER UPDATE OF fields_blob ON presets WHEN old.fields_blob != '' AND old.fields_blob != new.fields_blob
+	BEGIN
+		DELETE FROM preset_blobs WHERE hash = old.fields_blob
+			AND NOT EXISTS (SELECT 1 FROM presets WHERE fields_blob = old.fields_blob);
+	END;
+`
+
+// releaseOrphanBlobs deletes the blobs no preset refers to, for the writes
+// the triggers don't see: INSERT OR REPLACE deletes the rows it replaces
+// without firing delete triggers
+const releaseOrphanBlobs = `DELETE FROM preset_blobs WHERE hash NOT IN (SELECT fields_blob FROM presets WHERE fields_blob != '')`
+
+// offloadFields moves fields of at least the configured blob threshold out
+// of the presets table into preset_blobs, keyed by their SHA-256, so the
+// rows list queries walk stay small. Identical fields share one blob. It
+// returns what the preset row keeps: the fields and no hash, or the hash
+// and no fields. Fields are offloaded as stored, compressed with codec.
+func (s *Storage) offloadFields(ctx context.Context, tx *sql.Tx, fields, codec string) (string, string, error) {
+	threshold := s.cfg.BlobThresholdBytes
+	if threshold <= 0 || int64(len(fields)) < threshold {
+		return fields, "", nil
+	}
+	sum := sha256.Sum256([]byte(fields))
+	hash := hex.EncodeToString(sum[:])
+	_, err := tx.ExecContext(ctx, `
+		INSERT OR IGNORE INTO preset_blobs (hash, data, size, created_at)
+		VALUES (?, ?, ?, ?)`, hash, fieldsArg(fields, codec), len(fields), time.Now())
+	if err != nil {
+		return "", "", fmt.Errorf("failed to store preset fields: %w", err)
+	}
+	return "", hash, nil
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrPresetExists is returned when an edit would give a preset the name and
+// scope of another preset on the same device
+var ErrPresetExists = errors.New("device already has a preset with this name and scope")
+
+// ErrPresetModified is returned when a preset has changed since the version
+// an edit was based on
+var ErrPresetModified = errors.New("preset has been modified")
+
+// PresetQuery selects presets across every device, for the admin preset
+// browser
+type PresetQuery struct {
+	// Search matches part of a preset's name or scope value, or its whole ID
+	Search    string
+	ScopeType string
+	// DeviceID limits the results to presets the device owns
+	DeviceID string
+	Limit    int
+	Offset   int
+}
+
+// likeEscaper escapes the LIKE wildcards in a search term
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchPresets returns one page of the presets matching q, most recently
+// updated first, and how many match in all
+func (s *Storage) SearchPresets(ctx context.Context, q PresetQuery) ([]*Preset, int, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	var where []string
+	var args []interface{}
+	if q.Search != "" {
+		pattern := "%" + likeEscaper.Replace(q.Search) + "%"
+		where = append(where, `(name LIKE ? ESCAPE '\' OR scope_value LIKE ? ESCAPE '\' OR id = ?)`)
+		args = append(args, pattern, pattern, q.Search)
+	}
+	if q.ScopeType != "" {
+		where = append(where, `scope_type = ?`)
+		args = append(args, q.ScopeType)
+	}
+	if q.DeviceID != "" {
+		where = append(where, `device_id = ?`)
+		args = append(args, q.DeviceID)
+	}
+	clause := ""
+	if len(where) > 0 {
+		clause = ` WHERE ` + strings.Join(where, ` AND `)
+	}
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM presets`+clause, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count presets: %w", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+presetColumns+` FROM presets`+clause+`
+		ORDER BY updated_at DESC
+		LIMIT ? OFFSET ?`, append(args, q.Limit, q.Offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query presets: %w", err)
+	}
+	defer rows.Close()
+
+	presets := []*Preset{}
+	for rows.Next() {
+		preset, err := s.scanPreset(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		presets = append(presets, preset)
+	}
+	return presets, total, rows.Err()
+}
+
+// EditPreset writes an edited preset back, including a change of scope,
+// which SavePreset keeps as it was. It returns ErrPresetNotFound if the
+// preset is gone, and ErrPresetExists if its new name and scope are taken.
+func (s *Storage) EditPreset(ctx context.Context, preset *Preset) error {
+	return s.EditPresetVersion(ctx, preset, 0)
+}
+
+// EditPresetVersion is EditPreset for a preset still at version, checked in
+// the same statement as the write. It returns ErrPresetModified if the
+// preset has moved on; a version of 0 edits it whatever its version.
+func (s *Storage) EditPresetVersion(ctx context.Context, preset *Preset, version int) error {
+	s.awaitWrites()
+	// Fields encrypted by the device are kept as they are
+	if preset.Fields != nil || preset.EncryptedFields == "" {
+		fieldsJSON, err := json.Marshal(preset.Fields)
+		if err != nil {
+			return fmt.Errorf("failed to marshal fields: %w", err)
+		}
+		preset.EncryptedFields = string(fieldsJSON)
+	}
+	var metadataJSON []byte
+	var err error
+	if preset.Metadata != nil {
+		if metadataJSON, err = json.Marshal(preset.Metadata); err != nil {
+			return fmt.Errorf("failed to marshal metadata: %w", err)
+		}
+	}
+	normalizePresetScope(preset)
+	preset.UpdatedAt = time.Now()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin edit: %w", err)
+	}
+	defer tx.Rollback()
+
+	fields, codec := s.compressFields(preset.EncryptedFields)
+	if err := s.checkQuota(ctx, tx, preset, int64(len(fields)+len(metadataJSON))); err != nil {
+		return err
+	}
+	if preset.StatsOnly, _, err = statsOnly(ctx, tx, preset); err != nil {
+		return err
+	}
+	fields, blob, err := s.offloadFields(ctx, tx, fields, codec)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE presets
+		SET name = ?, scope_type = ?, scope_value = ?, encrypted_fields = ?, fields_blob = ?, fields_codec = ?, metadata = ?,
+			updated_at = CASE WHEN ? THEN updated_at ELSE ? END,
+			version = version + CASE WHEN ? THEN 0 ELSE 1 END,
+			stat_version = stat_version + CASE WHEN ? THEN 1 ELSE 0 END
+		WHERE id = ? AND (? = 0 OR version = ?)
+		RETURNING version, stat_version, updated_at, shared_group_id`,
+		preset.Name, preset.ScopeType, preset.ScopeValue, fieldsArg(fields, codec), blob, codec, metadataJSON,
+		preset.StatsOnly, preset.UpdatedAt, preset.StatsOnly, preset.StatsOnly,
+		preset.ID, version, version).Scan(&preset.Version, &preset.StatVersion, &preset.UpdatedAt, &preset.SharedGroupID)
+	if errors.Is(err, sql.ErrNoRows) {
+		if version != 0 {
+			var exists bool
+			if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM presets WHERE id = ?)`, preset.ID).Scan(&exists); err != nil {
+				return fmt.Errorf("failed to edit preset: %w", err)
+			}
+			if exists {
+				return ErrPresetModified
+			}
+		}
+		return ErrPresetNotFound
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrPresetExists
+		}
+		return fmt.Errorf("failed to edit preset: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to edit preset: %w", err)
+	}
+	s.invalidatePreset(preset.DeviceID, preset.SharedGroupID, preset.ScopeType, preset.ScopeValue)
+
+	s.logSync(preset.ID, saveAction(preset), preset.DeviceID)
+	return nil
+}
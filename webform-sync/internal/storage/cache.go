@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+)
+
+// listCache caches preset lists, in memory (presetCache) or in Redis for
+// several replicas to share (redisCache)
+type listCache interface {
+	// get returns a cached list, or on a miss the stamp to put the list
+	// under once queried
+	get(key, deviceID string) ([]*Preset, cacheStamp, bool)
+	// put stores a list, unless the cache was invalidated since its stamp
+	put(stamp cacheStamp, deviceID string, presets []*Preset)
+	// stale returns a list cached under key even if it has expired, for
+	// when the database can't be read
+	stale(key string) ([]*Preset, bool)
+	invalidateDevices(deviceIDs ...string)
+	flush()
+	close()
+}
+
+// cacheStamp identifies what a cache miss saw, so a query that raced a
+// write doesn't store its stale result
+type cacheStamp struct {
+	key        string
+	generation uint64
+}
+
+// CacheInvalidation reports cached preset lists going stale. All is set
+// when every list is; otherwise those of DeviceIDs are, and ScopeType and
+// ScopeValue are the changed preset's scope. The device "" stands for lists
+// taken across all devices.
+type CacheInvalidation struct {
+	DeviceIDs  []string `json:"deviceIds,omitempty"`
+	ScopeType  string   `json:"scopeType,omitempty"`
+	ScopeValue string   `json:"scopeValue,omitempty"`
+	All        bool     `json:"all,omitempty"`
+}
+
+// presetCache is an LRU cache of preset list queries with a TTL. Entries are
+// indexed by the requesting device so a write only evicts the lists of the
+// devices that can see the changed preset.
+type presetCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element // key -> *cacheEntry
+	lru      *list.List               // most recently used first
+	byDevice map[string]map[string]bool
+
+	// generation changes on every invalidation, so a query that raced a
+	// write doesn't store its stale result
+	generation uint64
+}
+
+type cacheEntry struct {
+	key      string
+	deviceID string
+	presets  []*Preset
+	expires  time.Time
+}
+
+// EnableCache puts a cache in front of GetAllPresets and GetPresetsByScope,
+// for extensions that poll on every tab focus: in memory, or with the redis
+// backend in Redis, so replicas behind a load balancer see each other's
+// invalidations. Call it before serving requests.
+func (s *Storage) EnableCache(cfg config.CacheConfig) {
+	if !cfg.Enabled || cfg.TTLSeconds <= 0 || cfg.MaxEntries <= 0 {
+		return
+	}
+	ttl := time.Duration(cfg.TTLSeconds) * time.Second
+	if cfg.Backend == "redis" {
+		s.cache = newRedisCache(cfg.Redis, ttl, s.logger)
+		return
+	}
+	s.cache = &presetCache{
+		ttl:        ttl,
+		maxEntries: cfg.MaxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		byDevice:   make(map[string]map[string]bool),
+	}
+}
+
+// OnCacheInvalidated calls fn whenever cached preset lists go stale, with
+// the cache on or off, so caches outside the service can follow. fn runs
+// after the write that caused it and must not block. Call it before serving
+// requests.
+func (s *Storage) OnCacheInvalidated(fn func(CacheInvalidation)) {
+	s.onInvalidate = fn
+}
+
+// cachedPresets runs a preset list query through the cache
+func (s *Storage) cachedPresets(key, deviceID string, query func() ([]*Preset, error)) ([]*Preset, error) {
+	if s.cache == nil {
+		return query()
+	}
+	presets, stamp, ok := s.cache.get(key, deviceID)
+	if ok {
+		return presets, nil
+	}
+
+	presets, err := query()
+	if err != nil {
+		// An expired list is better than none while the database is
+		// unreachable. Writes fail then too, so it can't have changed.
+		if old, ok := s.cache.stale(key); ok {
+			s.logger.Debug("Serving expired cached presets: %v", err)
+			return old, nil
+		}
+		return nil, err
+	}
+	s.cache.put(stamp, deviceID, presets)
+	return copyPresets(presets), nil
+}
+
+// copyPresets returns shallow copies, so callers can annotate the presets
+// they get without changing the cached ones
+func copyPresets(presets []*Preset) []*Preset {
+	if presets == nil {
+		return nil
+	}
+	copies := make([]*Preset, len(presets))
+	for i, p := range presets {
+		cp := *p
+		copies[i] = &cp
+	}
+	return copies
+}
+
+func (c *presetCache) get(key, deviceID string) ([]*Preset, cacheStamp, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	miss := cacheStamp{key: key, generation: c.generation}
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, miss, false
+	}
+	// Expired entries are left for stale until replaced or pushed out
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		return nil, miss, false
+	}
+	c.lru.MoveToFront(elem)
+	return copyPresets(entry.presets), cacheStamp{}, true
+}
+
+func (c *presetCache) put(stamp cacheStamp, deviceID string, presets []*Preset) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stamp.generation != c.generation {
+		return
+	}
+	key := stamp.key
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for c.lru.Len() >= c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		key:      key,
+		deviceID: deviceID,
+		presets:  presets,
+		expires:  time.Now().Add(c.ttl),
+	})
+	if c.byDevice[deviceID] == nil {
+		c.byDevice[deviceID] = make(map[string]bool)
+	}
+	c.byDevice[deviceID][key] = true
+}
+
+func (c *presetCache) stale(key string) ([]*Preset, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return copyPresets(elem.Value.(*cacheEntry).presets), true
+}
+
+// remove drops an entry; the caller holds mu
+func (c *presetCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	if keys := c.byDevice[entry.deviceID]; keys != nil {
+		delete(keys, entry.key)
+		if len(keys) == 0 {
+			delete(c.byDevice, entry.deviceID)
+		}
+	}
+}
+
+// invalidateDevices drops the cached lists of the given devices
+func (c *presetCache) invalidateDevices(deviceIDs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, id := range deviceIDs {
+		for key := range c.byDevice[id] {
+			c.remove(c.entries[key])
+		}
+	}
+}
+
+// flush drops every cached list
+func (c *presetCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.byDevice = make(map[string]map[string]bool)
+}
+
+func (c *presetCache) close() {}
+
+// invalidatePreset evicts the lists a changed preset appears in. A preset
+// owned by one device and not shared is only listed for that device and in
+// unfiltered ("") queries; anything wider flushes the cache.
+func (s *Storage) invalidatePreset(deviceID, sharedGroupID, scopeType, scopeValue string) {
+	if deviceID == "" || sharedGroupID != "" {
+		s.invalidateAll()
+		return
+	}
+	if s.cache != nil {
+		s.cache.invalidateDevices(deviceID, "")
+	}
+	if s.onInvalidate != nil {
+		s.onInvalidate(CacheInvalidation{DeviceIDs: []string{deviceID, ""}, ScopeType: scopeType, ScopeValue: scopeValue})
+	}
+}
+
+// invalidateAll flushes the cache after writes that can change what many
+// devices see, such as group or user changes
+func (s *Storage) invalidateAll() {
+	if s.cache != nil {
+		s.cache.flush()
+	}
+	if s.onInvalidate != nil {
+		s.onInvalidate(CacheInvalidation{All: true})
+	}
+}
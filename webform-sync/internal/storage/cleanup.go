@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+)
+
+// Preset metadata keys that cleanup reads. A preset whose metadata has
+// pinned set to true is never cleaned up; its tags select the retention
+// rules and exemptions that apply to it.
+const (
+	PinnedKey = "pinned"
+	TagsKey   = "tags"
+)
+
+// CleanupPreset is a preset cleanup removed, or would remove
+type CleanupPreset struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	ScopeType  string     `json:"scopeType"`
+	ScopeValue string     `json:"scopeValue"`
+	DeviceID   string     `json:"deviceId"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsed   *time.Time `json:"lastUsed,omitempty"`
+	// RetentionDays is how long the preset could go unused, from the
+	// retention rule it matched or the default
+	RetentionDays int `json:"retentionDays"`
+}
+
+// CleanupResult is what a cleanup removed, or would remove on a dry run
+type CleanupResult struct {
+	Presets []CleanupPreset `json:"presets"`
+	// Exempted counts the long unused presets kept because they are
+	// pinned, exempt, or matched a rule that keeps them forever
+	Exempted int `json:"exempted"`
+}
+
+// RetentionPolicy decides how long presets may go unused before cleanup
+// removes them
+type RetentionPolicy struct {
+	// Days applies to presets no rule matches (0 = keep them)
+	Days   int
+	Exempt config.CleanupExemptConfig
+	// Rules are tried in order, and the first to match a preset sets its
+	// retention
+	Rules []config.RetentionRule
+}
+
+// presetMatcher matches presets by scope value and tag
+type presetMatcher struct {
+	scopes []*regexp.Regexp
+	tags   map[string]bool
+}
+
+func newPresetMatcher(scopes, tags []string) *presetMatcher {
+	m := &presetMatcher{tags: make(map[string]bool)}
+	for _, scope := range scopes {
+		escaped := strings.ReplaceAll(regexp.QuoteMeta(strings.TrimSpace(scope)), `\*`, ".*")
+		m.scopes = append(m.scopes, regexp.MustCompile("(?i)^"+escaped+"$"))
+	}
+	for _, tag := range tags {
+		m.tags[strings.ToLower(strings.TrimSpace(tag))] = true
+	}
+	return m
+}
+
+// matches reports whether a preset has one of the tags, or a scope value
+// matching one of the scopes
+func (m *presetMatcher) matches(scopeValue string, metadata map[string]interface{}) bool {
+	if tags, ok := metadata[TagsKey].([]interface{}); ok {
+		for _, tag := range tags {
+			if name, ok := tag.(string); ok && m.tags[strings.ToLower(name)] {
+				return true
+			}
+		}
+	}
+	for _, re := range m.scopes {
+		if re.MatchString(scopeValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// retention is a compiled RetentionPolicy
+type retention struct {
+	days   int
+	exempt *presetMatcher
+	rules  []*presetMatcher
+	// ruleDays are the rules' retention, in the same order
+	ruleDays []int
+}
+
+func newRetention(policy RetentionPolicy) *retention {
+	r := &retention{days: max(policy.Days, 0), exempt: newPresetMatcher(policy.Exempt.Scopes, policy.Exempt.Tags)}
+	for _, rule := range policy.Rules {
+		r.rules = append(r.rules, newPresetMatcher(rule.Scopes, rule.Tags))
+		r.ruleDays = append(r.ruleDays, rule.DeleteAfterDays)
+	}
+	return r
+}
+
+// daysFor returns how long a preset may go unused, or 0 if it is kept
+// however long that is
+func (r *retention) daysFor(scopeValue string, metadata map[string]interface{}) int {
+	if pinned, _ := metadata[PinnedKey].(bool); pinned {
+		return 0
+	}
+	if r.exempt.matches(scopeValue, metadata) {
+		return 0
+	}
+	for i, rule := range r.rules {
+		if rule.matches(scopeValue, metadata) {
+			return r.ruleDays[i]
+		}
+	}
+	return r.days
+}
+
+// shortest returns the shortest retention any preset can have, or 0 if
+// every preset is kept
+func (r *retention) shortest() int {
+	shortest := r.days
+	for _, days := range r.ruleDays {
+		if days > 0 && (shortest == 0 || days < shortest) {
+			shortest = days
+		}
+	}
+	return shortest
+}
+
+// CleanupOldPresets removes presets that have gone unused, or were created
+// and never used, for longer than the policy keeps them. With dryRun it
+// only reports what it would remove.
+func (s *Storage) CleanupOldPresets(ctx context.Context, policy RetentionPolicy, dryRun bool) (*CleanupResult, error) {
+	result := &CleanupResult{Presets: []CleanupPreset{}}
+	retention := newRetention(policy)
+	shortest := retention.shortest()
+	if shortest <= 0 {
+		return result, nil
+	}
+
+	now := time.Now()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, scope_type, scope_value, device_id, created_at, last_used, metadata
+		FROM presets
+		WHERE last_used < ? OR (last_used IS NULL AND created_at < ?)
+		ORDER BY COALESCE(last_used, created_at)`, now.AddDate(0, 0, -shortest), now.AddDate(0, 0, -shortest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find old presets: %w", err)
+	}
+	defer rows.Close()
+
+	var candidates []CleanupPreset
+	for rows.Next() {
+		var p CleanupPreset
+		var lastUsed sql.NullTime
+		var metadataJSON sql.NullString
+		if err := rows.Scan(&p.ID, &p.Name, &p.ScopeType, &p.ScopeValue, &p.DeviceID, &p.CreatedAt, &lastUsed, &metadataJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan preset: %w", err)
+		}
+		unusedSince := p.CreatedAt
+		if lastUsed.Valid {
+			p.LastUsed = &lastUsed.Time
+			unusedSince = lastUsed.Time
+		}
+		var metadata map[string]interface{}
+		if metadataJSON.Valid && metadataJSON.String != "" {
+			// Unreadable metadata can't exempt a preset, but isn't a reason
+			// to stop
+			json.Unmarshal([]byte(metadataJSON.String), &metadata)
+		}
+
+		p.RetentionDays = retention.daysFor(p.ScopeValue, metadata)
+		switch {
+		case p.RetentionDays == 0:
+			result.Exempted++
+		case unusedSince.Before(now.AddDate(0, 0, -p.RetentionDays)):
+			candidates = append(candidates, p)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to find old presets: %w", err)
+	}
+	rows.Close()
+
+	if dryRun {
+		result.Presets = append(result.Presets, candidates...)
+		return result, nil
+	}
+	if len(candidates) == 0 {
+		s.logger.Info("Cleaned up 0 old presets (%d exempt)", result.Exempted)
+		return result, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// A preset used since it was found is no longer old, so check again
+	for _, p := range candidates {
+		cutoff := now.AddDate(0, 0, -p.RetentionDays)
+		res, err := tx.ExecContext(ctx, `
+			DELETE FROM presets
+			WHERE id = ? AND (last_used < ? OR (last_used IS NULL AND created_at < ?))`, p.ID, cutoff, cutoff)
+		if err != nil {
+			return nil, fmt.Errorf("failed to cleanup old presets: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			result.Presets = append(result.Presets, p)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to cleanup old presets: %w", err)
+	}
+
+	if len(result.Presets) > 0 {
+		s.invalidateAll()
+	}
+	s.logger.Info("Cleaned up %d old presets (%d exempt)", len(result.Presets), result.Exempted)
+	return result, nil
+}
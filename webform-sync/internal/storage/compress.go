@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/tezza1971/webform-sync/internal/config"
+)
+
+// CodecZstd marks preset fields stored zstd-compressed. Fields stored as
+// they are have no codec.
+const CodecZstd = "zstd"
+
+// fieldsEncoder compresses preset fields at the configured level. EncodeAll
+// is safe for concurrent use, so one encoder serves every save.
+type fieldsEncoder struct {
+	encoder  *zstd.Encoder
+	minBytes int
+}
+
+// zstdDecoder decompresses preset fields. Rows keep their codec, so it is
+// needed with compression turned off too, and is only made once a
+// compressed row is read.
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil)
+})
+
+// newFieldsEncoder returns the encoder for storage.compression, or nil
+// with it off. It compresses the fields of presets saved from then on that
+// are at least cfg.MinBytes, when that makes them smaller; presets already
+// stored are compressed on their next save.
+func newFieldsEncoder(cfg config.CompressionConfig) (*fieldsEncoder, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	ok, level := zstd.EncoderLevelFromString(cfg.Level)
+	if !ok {
+		return nil, fmt.Errorf("unknown compression level: %s", cfg.Level)
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compressor: %w", err)
+	}
+	return &fieldsEncoder{encoder: encoder, minBytes: cfg.MinBytes}, nil
+}
+
+// compressFields returns preset fields as they are to be stored, and their
+// codec
+func (s *Storage) compressFields(fields string) (string, string) {
+	c := s.compressor
+	if c == nil || len(fields) < c.minBytes {
+		return fields, ""
+	}
+	compressed := c.encoder.EncodeAll([]byte(fields), nil)
+	if len(compressed) >= len(fields) {
+		return fields, ""
+	}
+	return string(compressed), CodecZstd
+}
+
+// fieldsArg binds stored fields: compressed ones as a BLOB, so SQLite
+// doesn't take them for text
+func fieldsArg(fields, codec string) interface{} {
+	if codec != "" {
+		return []byte(fields)
+	}
+	return fields
+}
+
+// decompressFields reverses compressFields
+func decompressFields(stored, codec string) (string, error) {
+	switch codec {
+	case "":
+		return stored, nil
+	case CodecZstd:
+		decoder, err := zstdDecoder()
+		if err != nil {
+			return "", fmt.Errorf("failed to create decompressor: %w", err)
+		}
+		fields, err := decoder.DecodeAll([]byte(stored), nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress preset fields: %w", err)
+		}
+		return string(fields), nil
+	}
+	return "", fmt.Errorf("unknown preset fields codec: %s", codec)
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrConflictNotFound is returned for an unknown conflict
+	ErrConflictNotFound = errors.New("conflict not found")
+	// ErrConflictResolved is returned when resolving a conflict twice
+	ErrConflictResolved = errors.New("conflict already resolved")
+)
+
+// Conflict resolutions
+const (
+	ResolveKeepCurrent = "current" // The preset stays as it is
+	ResolveTakeCopy    = "copy"    // The copy replaces the preset
+	ResolveMerge       = "merge"   // The preset gets fields merged from both
+)
+
+// Conflict is a save that was based on an older version of a preset than
+// the one stored. Rather than overwrite changes the device hadn't seen, the
+// save is kept as a copy until someone resolves the conflict.
+type Conflict struct {
+	ID       string `json:"id"`
+	PresetID string `json:"presetId"`
+	// OwnerDeviceID owns the preset; DeviceID made the conflicting save
+	OwnerDeviceID string `json:"ownerDeviceId"`
+	DeviceID      string `json:"deviceId"`
+	// BaseVersion is the version the save was based on, and
+	// CurrentVersion the preset's version when it arrived
+	BaseVersion    int       `json:"baseVersion"`
+	CurrentVersion int       `json:"currentVersion"`
+	Copy           *Preset   `json:"copy"`
+	CreatedAt      time.Time `json:"createdAt"`
+	// ResolvedAt, Resolution and ResolvedBy are set once resolved
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+	Resolution string     `json:"resolution,omitempty"`
+	ResolvedBy string     `json:"resolvedBy,omitempty"`
+}
+
+// ConflictFilter narrows conflicts down. An empty DeviceID covers every
+// device; otherwise conflicts the device caused or whose preset it owns.
+type ConflictFilter struct {
+	DeviceID        string
+	PresetID        string
+	IncludeResolved bool
+}
+
+// conflictColumns is the column list shared by conflict queries (matches
+// scanConflict)
+const conflictColumns = `id, preset_id, owner_device_id, device_id, base_version, current_version, copy,
+	created_at, resolved_at, resolution, resolved_by`
+
+// CreateConflict stores the copy of a conflicting save and logs it in the
+// sync log
+func (s *Storage) CreateConflict(ctx context.Context, conflict *Conflict) error {
+	if conflict.ID == "" {
+		conflict.ID = NewPresetID()
+	}
+	if conflict.CreatedAt.IsZero() {
+		conflict.CreatedAt = time.Now()
+	}
+	copyJSON, err := json.Marshal(conflict.Copy)
+	if err != nil {
+		return fmt.Errorf("failed to marshal conflict copy: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO conflicts (id, preset_id, owner_device_id, device_id, base_version, current_version, copy, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		conflict.ID, conflict.PresetID, conflict.OwnerDeviceID, conflict.DeviceID,
+		conflict.BaseVersion, conflict.CurrentVersion, string(copyJSON), conflict.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save conflict: %w", err)
+	}
+
+	s.logSync(conflict.PresetID, "conflict", conflict.DeviceID)
+	s.logger.Debug("Saved conflict %s on preset %s (device: %s, base version %d, current %d)",
+		conflict.ID, conflict.PresetID, conflict.DeviceID, conflict.BaseVersion, conflict.CurrentVersion)
+	return nil
+}
+
+// GetConflict returns a conflict by ID
+func (s *Storage) GetConflict(ctx context.Context, id string) (*Conflict, error) {
+	return scanConflict(s.db.QueryRowContext(ctx, `SELECT `+conflictColumns+` FROM conflicts WHERE id = ?`, id))
+}
+
+// ListConflicts returns the conflicts matching filter, newest first
+func (s *Storage) ListConflicts(ctx context.Context, filter ConflictFilter) ([]*Conflict, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	where, args := "1 = 1", []interface{}{}
+	if filter.DeviceID != "" {
+		where += " AND (device_id = ? OR owner_device_id = ?)"
+		args = append(args, filter.DeviceID, filter.DeviceID)
+	}
+	if filter.PresetID != "" {
+		where += " AND preset_id = ?"
+		args = append(args, filter.PresetID)
+	}
+	if !filter.IncludeResolved {
+		where += " AND resolved_at IS NULL"
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+conflictColumns+` FROM conflicts
+		WHERE `+where+` ORDER BY created_at DESC`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query conflicts: %w", err)
+	}
+	defer rows.Close()
+
+	conflicts := []*Conflict{}
+	for rows.Next() {
+		conflict, err := scanConflict(rows)
+		if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, rows.Err()
+}
+
+// ResolveConflict records how a conflict was resolved and by which device,
+// and logs it in the sync log. It returns ErrConflictResolved if it
+// already was. Call it before applying the resolution, so only one device
+// applies one, and ReopenConflict if that fails.
+func (s *Storage) ResolveConflict(ctx context.Context, conflict *Conflict, resolution, deviceID string) error {
+	now := time.Now()
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE conflicts SET resolved_at = ?, resolution = ?, resolved_by = ?
+		WHERE id = ? AND resolved_at IS NULL`,
+		now, resolution, deviceID, conflict.ID)
+	if err != nil {
+		return fmt.Errorf("failed to resolve conflict: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrConflictResolved
+	}
+	conflict.ResolvedAt, conflict.Resolution, conflict.ResolvedBy = &now, resolution, deviceID
+
+	s.logSync(conflict.PresetID, "resolve", deviceID)
+	return nil
+}
+
+// ReopenConflict undoes ResolveConflict, for a resolution that couldn't be
+// applied
+func (s *Storage) ReopenConflict(ctx context.Context, conflict *Conflict) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE conflicts SET resolved_at = NULL, resolution = '', resolved_by = ''
+		WHERE id = ? AND resolved_by = ?`,
+		conflict.ID, conflict.ResolvedBy)
+	if err != nil {
+		return fmt.Errorf("failed to reopen conflict: %w", err)
+	}
+	conflict.ResolvedAt, conflict.Resolution, conflict.ResolvedBy = nil, "", ""
+	return nil
+}
+
+// scanConflict reads one conflict row
+func scanConflict(row interface{ Scan(...interface{}) error }) (*Conflict, error) {
+	var c Conflict
+	var copyJSON string
+	var resolvedAt sql.NullTime
+	err := row.Scan(&c.ID, &c.PresetID, &c.OwnerDeviceID, &c.DeviceID, &c.BaseVersion, &c.CurrentVersion, &copyJSON,
+		&c.CreatedAt, &resolvedAt, &c.Resolution, &c.ResolvedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrConflictNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan conflict: %w", err)
+	}
+	if resolvedAt.Valid {
+		c.ResolvedAt = &resolvedAt.Time
+	}
+	if err := json.Unmarshal([]byte(copyJSON), &c.Copy); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal conflict copy: %w", err)
+	}
+	return &c, nil
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrCORSOriginNotFound is returned when a CORS origin does not exist
+	ErrCORSOriginNotFound = errors.New("CORS origin not found")
+	// ErrCORSOriginExists is returned when an origin pattern was already added
+	ErrCORSOriginExists = errors.New("CORS origin already exists")
+)
+
+// CORSOrigin is an origin pattern allowed through the admin API, on top of
+// those in the config file
+type CORSOrigin struct {
+	ID     string `json:"id"`
+	Origin string `json:"origin"`
+	// Methods limits the origin to these methods; empty allows all the
+	// configured ones
+	Methods   []string  `json:"methods"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// AddCORSOrigin stores an origin pattern
+func (s *Storage) AddCORSOrigin(ctx context.Context, origin string, methods []string) (*CORSOrigin, error) {
+	o := &CORSOrigin{
+		ID:        NewPresetID(),
+		Origin:    origin,
+		Methods:   methods,
+		CreatedAt: time.Now(),
+	}
+	if o.Methods == nil {
+		o.Methods = []string{}
+	}
+
+	_, err := s.db.ExecContext(ctx, `INSERT INTO cors_origins (id, origin, methods, created_at) VALUES (?, ?, ?, ?)`,
+		o.ID, o.Origin, strings.Join(o.Methods, ","), o.CreatedAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return nil, ErrCORSOriginExists
+		}
+		return nil, fmt.Errorf("failed to add CORS origin: %w", err)
+	}
+
+	s.logger.Info("CORS origin added: %s", o.Origin)
+	return o, nil
+}
+
+// GetCORSOrigins returns the stored origin patterns, oldest first
+func (s *Storage) GetCORSOrigins(ctx context.Context) ([]*CORSOrigin, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, origin, methods, created_at FROM cors_origins ORDER BY created_at, id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query CORS origins: %w", err)
+	}
+	defer rows.Close()
+
+	origins := []*CORSOrigin{}
+	for rows.Next() {
+		var o CORSOrigin
+		var methods string
+		if err := rows.Scan(&o.ID, &o.Origin, &methods, &o.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan CORS origin: %w", err)
+		}
+		o.Methods = []string{}
+		if methods != "" {
+			o.Methods = strings.Split(methods, ",")
+		}
+		origins = append(origins, &o)
+	}
+	return origins, rows.Err()
+}
+
+// DeleteCORSOrigin removes an origin pattern
+func (s *Storage) DeleteCORSOrigin(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM cors_origins WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete CORS origin: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrCORSOriginNotFound
+	}
+	s.logger.Info("CORS origin removed: %s", id)
+	return nil
+}
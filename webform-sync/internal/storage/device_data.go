@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DeviceErasure reports how many rows were removed for a device
+type DeviceErasure struct {
+	DeviceID        string `json:"deviceId"`
+	Presets         int    `json:"presets"`
+	SyncLogEntries  int    `json:"syncLogEntries"`
+	UsageEvents     int    `json:"usageEvents"`
+	DisabledDomains int    `json:"disabledDomains"`
+}
+
+// EraseDeviceData permanently removes everything stored for a device: its
+// registry entry, group memberships, presets, sync log entries made by or about those presets,
+// their usage events and conflict copies, and (when a sessionID is given) the session's
+// disabled domains. It runs in a single transaction so a failure leaves the data untouched.
+func (s *Storage) EraseDeviceData(ctx context.Context, deviceID, sessionID string) (*DeviceErasure, error) {
+	s.awaitWrites()
+	s.flushSyncLog()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin erasure: %w", err)
+	}
+	defer tx.Rollback()
+
+	erasure := &DeviceErasure{DeviceID: deviceID}
+
+	result, err := tx.ExecContext(ctx, `
+		DELETE FROM sync_log
+		WHERE device_id = ?
+		   OR preset_id IN (SELECT id FROM presets WHERE device_id = ?)`,
+		deviceID, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to erase sync log: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	erasure.SyncLogEntries = int(n)
+
+	result, err = tx.ExecContext(ctx, `DELETE FROM usage_events WHERE device_id = ?`, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to erase usage events: %w", err)
+	}
+	n, _ = result.RowsAffected()
+	erasure.UsageEvents = int(n)
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM conflicts WHERE device_id = ? OR owner_device_id = ?`, deviceID, deviceID); err != nil {
+		return nil, fmt.Errorf("failed to erase conflicts: %w", err)
+	}
+
+	result, err = tx.ExecContext(ctx, `DELETE FROM presets WHERE device_id = ?`, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to erase presets: %w", err)
+	}
+	n, _ = result.RowsAffected()
+	erasure.Presets = int(n)
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM device_group_members WHERE device_id = ?`, deviceID); err != nil {
+		return nil, fmt.Errorf("failed to erase group memberships: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM share_links WHERE device_id = ?`, deviceID); err != nil {
+		return nil, fmt.Errorf("failed to erase share links: %w", err)
+	}
+
+	// Revoked devices keep a bare registry row so the block stays in force
+	if _, err := tx.ExecContext(ctx, `DELETE FROM devices WHERE id = ? AND revoked_at IS NULL`, deviceID); err != nil {
+		return nil, fmt.Errorf("failed to erase device: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE devices SET name = '', platform = '', browser = '', token_fingerprint = ''
+		WHERE id = ?`, deviceID); err != nil {
+		return nil, fmt.Errorf("failed to erase device: %w", err)
+	}
+
+	if sessionID != "" {
+		result, err = tx.ExecContext(ctx, `DELETE FROM disabled_domains WHERE session_id = ?`, sessionID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to erase disabled domains: %w", err)
+		}
+		n, _ = result.RowsAffected()
+		erasure.DisabledDomains = int(n)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit erasure: %w", err)
+	}
+	s.invalidateAll()
+
+	s.logger.Info("Erased data for device %s: %d presets, %d sync log entries, %d usage events, %d disabled domains",
+		deviceID, erasure.Presets, erasure.SyncLogEntries, erasure.UsageEvents, erasure.DisabledDomains)
+	return erasure, nil
+}
+
+// ForEachDeviceSyncLog streams sync log entries made by or about a device's
+// presets, oldest first
+func (s *Storage) ForEachDeviceSyncLog(ctx context.Context, deviceID string, fn func(map[string]interface{}) error) error {
+	s.flushSyncLog()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT preset_id, action, device_id, timestamp
+		FROM sync_log
+		WHERE device_id = ?
+		   OR preset_id IN (SELECT id FROM presets WHERE device_id = ?)
+		ORDER BY timestamp`,
+		deviceID, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to query sync log: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var presetID, action, logDeviceID string
+		var timestamp time.Time
+		if err := rows.Scan(&presetID, &action, &logDeviceID, &timestamp); err != nil {
+			return fmt.Errorf("failed to scan sync log: %w", err)
+		}
+		if err := fn(map[string]interface{}{
+			"preset_id": presetID,
+			"action":    action,
+			"device_id": logDeviceID,
+			"timestamp": timestamp,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
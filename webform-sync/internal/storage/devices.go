@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrDeviceNotFound is returned when a device is not in the registry
+var ErrDeviceNotFound = errors.New("device not found")
+
+// Device is a registered client installation
+type Device struct {
+	ID               string     `json:"id"`
+	Name             string     `json:"name"`
+	Platform         string     `json:"platform"`
+	Browser          string     `json:"browser"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	LastSeen         time.Time  `json:"lastSeen"`
+	TokenFingerprint string     `json:"tokenFingerprint,omitempty"`
+	RevokedAt        *time.Time `json:"revokedAt,omitempty"`
+	UserID           string     `json:"userId,omitempty"`
+}
+
+// Revoked reports whether the device has been blocked
+func (d *Device) Revoked() bool {
+	return d.RevokedAt != nil
+}
+
+// FirstContact reports whether RegisterDevice just created the record: both
+// timestamps are set together on insert, while later contact only moves
+// last_seen
+func (d *Device) FirstContact() bool {
+	return d.CreatedAt.Equal(d.LastSeen)
+}
+
+const deviceColumns = `id, name, platform, browser, created_at, last_seen, token_fingerprint, revoked_at, user_id`
+
+// backfillDevices registers devices that only exist as preset owners, for
+// databases created before the device registry
+func (s *Storage) backfillDevices() error {
+	_, err := s.db.Exec(`
+		INSERT OR IGNORE INTO devices (id, created_at, last_seen)
+		SELECT device_id, MIN(created_at), MAX(updated_at)
+		FROM presets
+		WHERE device_id != ''
+		GROUP BY device_id`)
+	if err != nil {
+		return fmt.Errorf("failed to backfill devices: %w", err)
+	}
+	return nil
+}
+
+// RegisterDevice records contact from a device, creating it on first sight.
+// Non-empty name, platform, browser and fingerprint values replace stored
+// ones; last_seen is always bumped. A device is bound to the first user that
+// contacts it and keeps that owner: contact from another user changes
+// nothing. The stored record is returned.
+func (s *Storage) RegisterDevice(ctx context.Context, device *Device) (*Device, error) {
+	now := time.Now()
+	row := s.db.QueryRowContext(ctx, `
+		INSERT INTO devices (id, name, platform, browser, created_at, last_seen, token_fingerprint, user_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			name = CASE WHEN excluded.name != '' THEN excluded.name ELSE devices.name END,
+			platform = CASE WHEN excluded.platform != '' THEN excluded.platform ELSE devices.platform END,
+			browser = CASE WHEN excluded.browser != '' THEN excluded.browser ELSE devices.browser END,
+			token_fingerprint = CASE WHEN excluded.token_fingerprint != '' THEN excluded.token_fingerprint ELSE devices.token_fingerprint END,
+			user_id = CASE WHEN devices.user_id = '' THEN excluded.user_id ELSE devices.user_id END,
+			last_seen = excluded.last_seen
+		WHERE devices.user_id = '' OR excluded.user_id = '' OR devices.user_id = excluded.user_id
+		RETURNING `+deviceColumns,
+		device.ID, device.Name, device.Platform, device.Browser, now, now, device.TokenFingerprint, device.UserID)
+
+	registered, err := scanDevice(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Owned by another user, who the caller must turn away
+		return s.GetDevice(ctx, device.ID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to register device: %w", err)
+	}
+
+	// A device claimed by a user brings its existing presets along
+	if device.UserID != "" && registered.UserID == device.UserID {
+		result, err := s.db.ExecContext(ctx, `UPDATE presets SET user_id = ? WHERE device_id = ? AND user_id = ''`,
+			device.UserID, device.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to assign device presets: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			s.invalidateAll()
+		}
+	}
+	return registered, nil
+}
+
+// GetDevice returns a registered device
+func (s *Storage) GetDevice(ctx context.Context, id string) (*Device, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+deviceColumns+` FROM devices WHERE id = ?`, id)
+	device, err := scanDevice(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDeviceNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device: %w", err)
+	}
+	return device, nil
+}
+
+// GetDevices returns all registered devices, or only a user's devices when
+// userID is non-empty
+func (s *Storage) GetDevices(ctx context.Context, userID string) ([]*Device, error) {
+	query := `SELECT ` + deviceColumns + ` FROM devices`
+	var args []interface{}
+	if userID != "" {
+		query += ` WHERE user_id = ?`
+		args = append(args, userID)
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query devices: %w", err)
+	}
+	defer rows.Close()
+
+	devices := []*Device{}
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan device: %w", err)
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, rows.Err()
+}
+
+// GetStaleDevices returns devices that are not revoked and haven't been seen
+// since the cutoff, least recently seen first
+func (s *Storage) GetStaleDevices(ctx context.Context, cutoff time.Time) ([]*Device, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+deviceColumns+`
+		FROM devices
+		WHERE revoked_at IS NULL AND last_seen < ?
+		ORDER BY last_seen`, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query stale devices: %w", err)
+	}
+	defer rows.Close()
+
+	devices := []*Device{}
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan device: %w", err)
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, rows.Err()
+}
+
+// RenameDevice sets a device's display name
+func (s *Storage) RenameDevice(ctx context.Context, id, name string) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE devices SET name = ? WHERE id = ?`, name, id)
+	if err != nil {
+		return fmt.Errorf("failed to rename device: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+// RevokeDevice blocks a device from further access. Revoking an already
+// revoked device keeps the original revocation time.
+func (s *Storage) RevokeDevice(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE devices SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?`, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke device: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrDeviceNotFound
+	}
+
+	s.logger.Info("Device revoked: %s", id)
+	return nil
+}
+
+// scanDevice scans a database row into a Device struct
+func scanDevice(row interface{ Scan(...interface{}) error }) (*Device, error) {
+	var device Device
+	var revokedAt sql.NullTime
+
+	err := row.Scan(
+		&device.ID,
+		&device.Name,
+		&device.Platform,
+		&device.Browser,
+		&device.CreatedAt,
+		&device.LastSeen,
+		&device.TokenFingerprint,
+		&revokedAt,
+		&device.UserID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if revokedAt.Valid {
+		device.RevokedAt = &revokedAt.Time
+	}
+	return &device, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd
+
+package storage
+
+// FreeSpace is not implemented on Windows and the other BSDs
+func (s *Storage) FreeSpace() (uint64, error) {
+	return 0, ErrFreeSpaceUnsupported
+}
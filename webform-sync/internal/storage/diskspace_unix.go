@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import "syscall"
+
+// FreeSpace returns the bytes available to the service in the data directory
+func (s *Storage) FreeSpace() (uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(s.cfg.DataDir, &fs); err != nil {
+		return 0, err
+	}
+	// The field types differ between platforms (Bavail is signed on FreeBSD)
+	return uint64(fs.Bavail) * uint64(fs.Bsize), nil
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ForEachPreset streams the presets visible to a device to fn one row at a
+// time, so exports don't hold the full result set in memory. An empty
+// deviceID iterates all devices.
+func (s *Storage) ForEachPreset(ctx context.Context, deviceID string, fn func(*Preset) error) error {
+	if deviceID == "" {
+		return s.forEachPreset(ctx, ``, nil, fn)
+	}
+	return s.forEachPreset(ctx, `WHERE `+visibleToDevice, []interface{}{deviceID, deviceID, deviceID}, fn)
+}
+
+// ForEachDevicePreset streams only the presets owned by deviceID, without the
+// shared presets that have no device
+func (s *Storage) ForEachDevicePreset(ctx context.Context, deviceID string, fn func(*Preset) error) error {
+	return s.forEachPreset(ctx, `WHERE device_id = ?`, []interface{}{deviceID}, fn)
+}
+
+// forEachPreset streams presets matching a WHERE clause in creation order
+func (s *Storage) forEachPreset(ctx context.Context, where string, args []interface{}, fn func(*Preset) error) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	query := `SELECT ` + presetColumns + ` FROM presets ` + where + ` ORDER BY created_at`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query presets: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		preset, err := s.scanPreset(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(preset); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// FindPresetByKey looks up a preset by its natural key (the UNIQUE constraint
+// on scope, name and device). Returns ErrPresetNotFound if there is none.
+func (s *Storage) FindPresetByKey(ctx context.Context, scopeType, scopeValue, name, deviceID string) (*Preset, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT `+presetColumns+`
+		FROM presets
+		WHERE scope_type = ? AND scope_value = ? AND name = ? AND device_id = ?`,
+		scopeType, NormalizeScope(scopeType, scopeValue), name, deviceID)
+
+	preset, err := s.scanPreset(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPresetNotFound
+	}
+	return preset, err
+}
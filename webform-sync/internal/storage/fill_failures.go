@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FillFailure counts the reports of a selector that matched nothing on a
+// page of a scope, for one user (or for unowned devices)
+type FillFailure struct {
+	ScopeType  string `json:"scopeType"`
+	ScopeValue string `json:"scopeValue"`
+	// Selector is the preset field key the client couldn't place
+	Selector string `json:"selector"`
+	Count    int    `json:"count"`
+	UserID   string `json:"userId,omitempty"`
+	// DeviceID is the device that reported it last
+	DeviceID  string    `json:"deviceId"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// FillFailureFilter narrows fill failures down. An empty DeviceID covers
+// every user; an empty ScopeType every scope.
+type FillFailureFilter struct {
+	DeviceID   string
+	ScopeType  string
+	ScopeValue string
+}
+
+// where builds the filter's condition and arguments
+func (f FillFailureFilter) where() (string, []interface{}) {
+	where, args := "1 = 1", []interface{}{}
+	if f.DeviceID != "" {
+		where += ` AND user_id = ` + deviceOwner
+		args = append(args, f.DeviceID)
+	}
+	if f.ScopeType != "" {
+		where += ` AND scope_type = ? AND scope_value = ?`
+		args = append(args, f.ScopeType, NormalizeScope(f.ScopeType, f.ScopeValue))
+	}
+	return where, args
+}
+
+// RecordFillFailures counts a report from deviceID of selectors that
+// matched nothing in a scope
+func (s *Storage) RecordFillFailures(ctx context.Context, deviceID string, scope Scope, selectors []string) error {
+	scope.Value = NormalizeScope(scope.Type, scope.Value)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin fill failure report: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, selector := range selectors {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO fill_failures (user_id, scope_type, scope_value, selector, device_id, first_seen, last_seen)
+			VALUES (`+deviceOwner+`, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(user_id, scope_type, scope_value, selector) DO UPDATE SET
+				count = count + 1, device_id = excluded.device_id, last_seen = excluded.last_seen`,
+			deviceID, scope.Type, scope.Value, selector, deviceID, now, now); err != nil {
+			return fmt.Errorf("failed to record fill failure: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to record fill failures: %w", err)
+	}
+	return nil
+}
+
+// GetFillFailures returns the fill failures matching filter, most reported
+// first
+func (s *Storage) GetFillFailures(ctx context.Context, filter FillFailureFilter) ([]*FillFailure, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	where, args := filter.where()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT scope_type, scope_value, selector, count, user_id, device_id, first_seen, last_seen
+		FROM fill_failures WHERE `+where+`
+		ORDER BY count DESC, last_seen DESC`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query fill failures: %w", err)
+	}
+	defer rows.Close()
+
+	failures := []*FillFailure{}
+	for rows.Next() {
+		var f FillFailure
+		if err := rows.Scan(&f.ScopeType, &f.ScopeValue, &f.Selector, &f.Count, &f.UserID, &f.DeviceID, &f.FirstSeen, &f.LastSeen); err != nil {
+			return nil, fmt.Errorf("failed to scan fill failure: %w", err)
+		}
+		failures = append(failures, &f)
+	}
+	return failures, rows.Err()
+}
+
+// ClearFillFailures removes the fill failures matching filter, or only
+// those of the given selectors if any are given. It returns how many were
+// removed.
+func (s *Storage) ClearFillFailures(ctx context.Context, filter FillFailureFilter, selectors ...string) (int, error) {
+	where, args := filter.where()
+	if len(selectors) > 0 {
+		where += ` AND selector IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(selectors)), ", ") + `)`
+		for _, selector := range selectors {
+			args = append(args, selector)
+		}
+	}
+	result, err := s.db.ExecContext(ctx, `DELETE FROM fill_failures WHERE `+where, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to clear fill failures: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return int(n), nil
+}
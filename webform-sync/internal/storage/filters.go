@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrFilterEntryNotFound is returned when a filter entry does not exist
+	ErrFilterEntryNotFound = errors.New("filter entry not found")
+	// ErrFilterEntryExists is returned when a pattern is already on the list
+	ErrFilterEntryExists = errors.New("filter entry already exists")
+)
+
+// FilterEntry is a URL pattern or IP range added to a whitelist or
+// blacklist through the admin API, on top of the filter files and config
+type FilterEntry struct {
+	ID string `json:"id"`
+	// Type is "url" or "ip"
+	Type string `json:"type"`
+	// List is "whitelist" or "blacklist"
+	List      string    `json:"list"`
+	Pattern   string    `json:"pattern"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// AddFilterEntry stores a filter entry
+func (s *Storage) AddFilterEntry(ctx context.Context, filterType, list, pattern string) (*FilterEntry, error) {
+	e := &FilterEntry{
+		ID:        NewPresetID(),
+		Type:      filterType,
+		List:      list,
+		Pattern:   pattern,
+		CreatedAt: time.Now(),
+	}
+
+	_, err := s.db.ExecContext(ctx, `INSERT INTO filter_entries (id, type, list, pattern, created_at) VALUES (?, ?, ?, ?, ?)`,
+		e.ID, e.Type, e.List, e.Pattern, e.CreatedAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return nil, ErrFilterEntryExists
+		}
+		return nil, fmt.Errorf("failed to add filter entry: %w", err)
+	}
+
+	s.logger.Info("Filter entry added to %s %s: %s", e.Type, e.List, e.Pattern)
+	return e, nil
+}
+
+// GetFilterEntries returns the stored filter entries, oldest first
+func (s *Storage) GetFilterEntries(ctx context.Context) ([]*FilterEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, type, list, pattern, created_at FROM filter_entries ORDER BY created_at, id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query filter entries: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []*FilterEntry{}
+	for rows.Next() {
+		var e FilterEntry
+		if err := rows.Scan(&e.ID, &e.Type, &e.List, &e.Pattern, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan filter entry: %w", err)
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+// DeleteFilterEntry removes a filter entry
+func (s *Storage) DeleteFilterEntry(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM filter_entries WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete filter entry: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrFilterEntryNotFound
+	}
+	s.logger.Info("Filter entry removed: %s", id)
+	return nil
+}
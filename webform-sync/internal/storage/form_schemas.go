@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrFormSchemaNotFound is returned when a form schema does not exist
+var ErrFormSchemaNotFound = errors.New("form schema not found")
+
+// maxPreviousSelectors is how many of a field's old selectors are kept
+const maxPreviousSelectors = 5
+
+// FormSchema is the structure of a form on a site: its fields' selectors,
+// types and labels, without their values. Schemas belong to the user of
+// the device that captured them, or to nobody for unowned devices, so every
+// device of a user shares them.
+type FormSchema struct {
+	ID         string `json:"id"`
+	ScopeType  string `json:"scopeType"`
+	ScopeValue string `json:"scopeValue"`
+	// Form tells forms on the same page apart, e.g. by their id; empty for
+	// a page's only form
+	Form   string        `json:"form"`
+	Fields []SchemaField `json:"fields"`
+	// DeviceID is the device that last captured the schema
+	DeviceID  string    `json:"deviceId"`
+	UserID    string    `json:"userId,omitempty"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// SchemaField describes one field of a form
+type SchemaField struct {
+	// Key is the field's name in preset fields
+	Key string `json:"key"`
+	// Selector finds the field on the page
+	Selector string `json:"selector"`
+	// PreviousSelectors are selectors the field had in earlier captures,
+	// newest first, so a client can still find presets saved before a
+	// site renamed the field
+	PreviousSelectors []string `json:"previousSelectors,omitempty"`
+	ID                string   `json:"id,omitempty"`
+	Name              string   `json:"name,omitempty"`
+	Type              string   `json:"type,omitempty"`
+	Label             string   `json:"label,omitempty"`
+	Placeholder       string   `json:"placeholder,omitempty"`
+	Autocomplete      string   `json:"autocomplete,omitempty"`
+	Required          bool     `json:"required,omitempty"`
+	// Options are the values a select or radio group offers
+	Options []string `json:"options,omitempty"`
+}
+
+// formSchemaColumns is the column list shared by form schema queries
+// (matches scanFormSchema)
+const formSchemaColumns = `id, scope_type, scope_value, form, fields, device_id, user_id, version, created_at, updated_at`
+
+// deviceOwner is the user a device belongs to, or empty. Bind the device ID.
+const deviceOwner = `COALESCE((SELECT user_id FROM devices WHERE id = ?), '')`
+
+// SaveFormSchema stores a form's schema for the user of schema.DeviceID,
+// replacing the one captured before for the same scope and form. Fields
+// whose selector changed since then keep the old one in PreviousSelectors.
+// It returns whether the schema is new.
+func (s *Storage) SaveFormSchema(ctx context.Context, schema *FormSchema) (bool, error) {
+	schema.ScopeValue = NormalizeScope(schema.ScopeType, schema.ScopeValue)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin save: %w", err)
+	}
+	defer tx.Rollback()
+
+	existing, err := scanFormSchema(tx.QueryRowContext(ctx, `SELECT `+formSchemaColumns+` FROM form_schemas
+		WHERE scope_type = ? AND scope_value = ? AND form = ? AND user_id = `+deviceOwner,
+		schema.ScopeType, schema.ScopeValue, schema.Form, schema.DeviceID))
+	if err != nil && !errors.Is(err, ErrFormSchemaNotFound) {
+		return false, err
+	}
+	created := existing == nil
+	if !created {
+		schema.Fields = mergeSchemaFields(existing.Fields, schema.Fields)
+	}
+
+	fieldsJSON, err := json.Marshal(schema.Fields)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal fields: %w", err)
+	}
+	now := time.Now()
+	if created {
+		schema.ID = NewPresetID()
+		err = tx.QueryRowContext(ctx, `INSERT INTO form_schemas
+			(id, scope_type, scope_value, form, fields, device_id, user_id, version, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, `+deviceOwner+`, 1, ?, ?)
+			RETURNING `+formSchemaColumns,
+			schema.ID, schema.ScopeType, schema.ScopeValue, schema.Form, fieldsJSON, schema.DeviceID, schema.DeviceID, now, now,
+		).Scan(schemaDest(schema)...)
+	} else {
+		err = tx.QueryRowContext(ctx, `UPDATE form_schemas
+			SET fields = ?, device_id = ?, version = version + 1, updated_at = ?
+			WHERE id = ?
+			RETURNING `+formSchemaColumns,
+			fieldsJSON, schema.DeviceID, now, existing.ID,
+		).Scan(schemaDest(schema)...)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to save form schema: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to save form schema: %w", err)
+	}
+	s.logger.Debug("Saved form schema: %s %s %q (device: %s)", schema.ScopeType, schema.ScopeValue, schema.Form, schema.DeviceID)
+	return created, nil
+}
+
+// mergeSchemaFields carries the selector history of fields over to a new
+// capture, matching fields by key
+func mergeSchemaFields(old, new []SchemaField) []SchemaField {
+	history := make(map[string][]string, len(old))
+	for _, f := range old {
+		history[f.Key] = append([]string{f.Selector}, f.PreviousSelectors...)
+	}
+	for i := range new {
+		f := &new[i]
+		previous := f.PreviousSelectors
+		f.PreviousSelectors = nil
+		for _, selector := range append(history[f.Key], previous...) {
+			if selector == "" || selector == f.Selector || slices.Contains(f.PreviousSelectors, selector) {
+				continue
+			}
+			if len(f.PreviousSelectors) == maxPreviousSelectors {
+				break
+			}
+			f.PreviousSelectors = append(f.PreviousSelectors, selector)
+		}
+	}
+	return new
+}
+
+// GetFormSchema returns a form schema by ID
+func (s *Storage) GetFormSchema(ctx context.Context, id string) (*FormSchema, error) {
+	return scanFormSchema(s.db.QueryRowContext(ctx, `SELECT `+formSchemaColumns+` FROM form_schemas WHERE id = ?`, id))
+}
+
+// GetFormSchemasInScopes returns the schemas in any of the scopes that
+// belong to the user of deviceID, most recently updated first. An empty
+// deviceID returns the schemas of unowned devices.
+func (s *Storage) GetFormSchemasInScopes(ctx context.Context, scopes []Scope, deviceID string) ([]*FormSchema, error) {
+	if len(scopes) == 0 {
+		return nil, nil
+	}
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	values := make([]string, 0, len(scopes))
+	var args []interface{}
+	for _, scope := range scopes {
+		values = append(values, "(?, ?)")
+		args = append(args, scope.Type, scope.Value)
+	}
+	args = append(args, deviceID)
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+formSchemaColumns+` FROM form_schemas
+		WHERE (scope_type, scope_value) IN (VALUES `+strings.Join(values, ", ")+`) AND user_id = `+deviceOwner+`
+		ORDER BY updated_at DESC`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query form schemas: %w", err)
+	}
+	defer rows.Close()
+
+	schemas := []*FormSchema{}
+	for rows.Next() {
+		schema, err := scanFormSchema(rows)
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, schema)
+	}
+	return schemas, rows.Err()
+}
+
+// DeleteFormSchema removes a form schema
+func (s *Storage) DeleteFormSchema(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM form_schemas WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete form schema: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrFormSchemaNotFound
+	}
+	return nil
+}
+
+// schemaDest returns the scan destinations for formSchemaColumns
+func schemaDest(schema *FormSchema) []interface{} {
+	schema.Fields = nil
+	return []interface{}{
+		&schema.ID, &schema.ScopeType, &schema.ScopeValue, &schema.Form, (*schemaFieldsJSON)(schema),
+		&schema.DeviceID, &schema.UserID, &schema.Version, &schema.CreatedAt, &schema.UpdatedAt,
+	}
+}
+
+// schemaFieldsJSON scans the fields column of a schema
+type schemaFieldsJSON FormSchema
+
+func (f *schemaFieldsJSON) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("unexpected fields type %T", src)
+	}
+	if err := json.Unmarshal(data, &f.Fields); err != nil {
+		return fmt.Errorf("failed to unmarshal fields: %w", err)
+	}
+	if f.Fields == nil {
+		f.Fields = []SchemaField{}
+	}
+	return nil
+}
+
+// scanFormSchema reads one schema row
+func scanFormSchema(row interface{ Scan(...interface{}) error }) (*FormSchema, error) {
+	var schema FormSchema
+	if err := row.Scan(schemaDest(&schema)...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrFormSchemaNotFound
+		}
+		return nil, fmt.Errorf("failed to scan form schema: %w", err)
+	}
+	return &schema, nil
+}
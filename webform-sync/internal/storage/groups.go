@@ -0,0 +1,333 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrGroupNotFound is returned when a device group does not exist
+	ErrGroupNotFound = errors.New("device group not found")
+	// ErrGroupExists is returned when a group name is already taken
+	ErrGroupExists = errors.New("device group already exists")
+	// ErrNotGroupMember is returned when sharing into a group the device isn't in
+	ErrNotGroupMember = errors.New("device is not a member of the group")
+	// ErrRoleDenied is returned when a device's group role doesn't allow an action
+	ErrRoleDenied = errors.New("group role does not allow this action")
+)
+
+// Group roles, from most to least privileged. Owners manage the group and may
+// delete presets shared with it, editors may share presets into it and modify
+// shared ones, viewers may only read and apply them.
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// ValidRole reports whether role is a known group role
+func ValidRole(role string) bool {
+	return role == RoleOwner || role == RoleEditor || role == RoleViewer
+}
+
+// RoleAllows reports whether role grants at least the privileges of need
+func RoleAllows(role, need string) bool {
+	rank := map[string]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3}
+	return rank[role] > 0 && rank[role] >= rank[need]
+}
+
+// DeviceGroup is a named set of devices that can share presets
+type DeviceGroup struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Members   []string          `json:"members"`
+	Roles     map[string]string `json:"roles"` // Member device ID -> role
+}
+
+// CreateGroup creates an empty device group
+func (s *Storage) CreateGroup(ctx context.Context, name string) (*DeviceGroup, error) {
+	group := &DeviceGroup{
+		ID:        NewPresetID(),
+		Name:      name,
+		CreatedAt: time.Now(),
+		Members:   []string{},
+		Roles:     map[string]string{},
+	}
+
+	_, err := s.db.ExecContext(ctx, `INSERT INTO device_groups (id, name, created_at) VALUES (?, ?, ?)`,
+		group.ID, group.Name, group.CreatedAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return nil, ErrGroupExists
+		}
+		return nil, fmt.Errorf("failed to create group: %w", err)
+	}
+
+	s.logger.Info("Device group created: %s (%s)", group.Name, group.ID)
+	return group, nil
+}
+
+// GetGroup returns a group with its members
+func (s *Storage) GetGroup(ctx context.Context, id string) (*DeviceGroup, error) {
+	var group DeviceGroup
+	err := s.db.QueryRowContext(ctx, `SELECT id, name, created_at FROM device_groups WHERE id = ?`, id).
+		Scan(&group.ID, &group.Name, &group.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get group: %w", err)
+	}
+
+	members, roles, err := s.groupMembers(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	group.Members = members
+	group.Roles = roles
+	return &group, nil
+}
+
+// GetGroups returns all groups, optionally only those a device belongs to
+func (s *Storage) GetGroups(ctx context.Context, deviceID string) ([]*DeviceGroup, error) {
+	query := `SELECT id FROM device_groups ORDER BY name`
+	var args []interface{}
+	if deviceID != "" {
+		query = `
+		SELECT g.id FROM device_groups g
+		JOIN device_group_members m ON m.group_id = g.id
+		WHERE m.device_id = ?
+		ORDER BY g.name`
+		args = append(args, deviceID)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query groups: %w", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan group: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	groups := make([]*DeviceGroup, 0, len(ids))
+	for _, id := range ids {
+		group, err := s.GetGroup(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// DeleteGroup removes a group; presets shared with it become private again
+func (s *Storage) DeleteGroup(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin group deletion: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM device_groups WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete group: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrGroupNotFound
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM device_group_members WHERE group_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete group members: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE presets SET shared_group_id = '' WHERE shared_group_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to unshare group presets: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete group: %w", err)
+	}
+	s.invalidateAll()
+	s.logger.Info("Device group deleted: %s", id)
+	return nil
+}
+
+// AddGroupMember adds a device to a group, or changes its role if it is
+// already a member. An empty role keeps an existing member's role and makes
+// new members editors.
+func (s *Storage) AddGroupMember(ctx context.Context, groupID, deviceID, role string) error {
+	if _, err := s.GetGroup(ctx, groupID); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO device_group_members (group_id, device_id, added_at, role)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(group_id, device_id) DO UPDATE SET role = excluded.role`
+	if role == "" {
+		query = `
+		INSERT OR IGNORE INTO device_group_members (group_id, device_id, added_at, role)
+		VALUES (?, ?, ?, ?)`
+		role = RoleEditor
+	}
+
+	_, err := s.db.ExecContext(ctx, query, groupID, deviceID, time.Now(), role)
+	if err != nil {
+		return fmt.Errorf("failed to add group member: %w", err)
+	}
+	// The new member can now see the group's presets
+	if s.cache != nil {
+		s.cache.invalidateDevices(deviceID)
+	}
+	return nil
+}
+
+// RemoveGroupMember removes a device from a group and stops sharing that
+// device's presets with it
+func (s *Storage) RemoveGroupMember(ctx context.Context, groupID, deviceID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin member removal: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM device_group_members WHERE group_id = ? AND device_id = ?`, groupID, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to remove group member: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrNotGroupMember
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE presets SET shared_group_id = ''
+		WHERE shared_group_id = ? AND device_id = ?`, groupID, deviceID); err != nil {
+		return fmt.Errorf("failed to unshare member presets: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to remove group member: %w", err)
+	}
+	s.invalidateAll()
+	return nil
+}
+
+// SharePreset shares a device's preset with one of its groups, which needs
+// at least the editor role. An empty groupID makes the preset private again.
+func (s *Storage) SharePreset(ctx context.Context, id, deviceID, groupID string) error {
+	if groupID != "" {
+		role, err := s.GroupRole(ctx, groupID, deviceID)
+		if err != nil {
+			return err
+		}
+		if role == "" {
+			return ErrNotGroupMember
+		}
+		if !RoleAllows(role, RoleEditor) {
+			return ErrRoleDenied
+		}
+	}
+
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE presets SET shared_group_id = ?, version = version + 1
+		WHERE id = ? AND device_id = ?`, groupID, id, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to share preset: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrPresetNotFound
+	}
+	s.invalidateAll()
+
+	s.logSync(id, "share", deviceID)
+	return nil
+}
+
+// GroupRole returns a device's role in a group, or "" if it isn't a member
+func (s *Storage) GroupRole(ctx context.Context, groupID, deviceID string) (string, error) {
+	var role string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT role FROM device_group_members
+		WHERE group_id = ? AND device_id = ?`, groupID, deviceID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to check group membership: %w", err)
+	}
+	return role, nil
+}
+
+// GetDeviceRoles returns a device's role in each group it belongs to
+func (s *Storage) GetDeviceRoles(ctx context.Context, deviceID string) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT group_id, role FROM device_group_members WHERE device_id = ?`, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device roles: %w", err)
+	}
+	defer rows.Close()
+
+	roles := map[string]string{}
+	for rows.Next() {
+		var groupID, role string
+		if err := rows.Scan(&groupID, &role); err != nil {
+			return nil, fmt.Errorf("failed to scan device role: %w", err)
+		}
+		roles[groupID] = role
+	}
+	return roles, rows.Err()
+}
+
+// PresetRole returns the role a device holds over a preset given the user
+// owning the device ("" for none) and its group roles: owner of its own
+// presets, editor of the device-less ones shared with its user, its group
+// role for shared ones, and "" otherwise
+func PresetRole(preset *Preset, deviceID, deviceUserID string, roles map[string]string) string {
+	switch {
+	case preset.DeviceID == deviceID:
+		return RoleOwner
+	case preset.DeviceID == "":
+		// As visibleToDevice lists them
+		if preset.UserID == deviceUserID {
+			return RoleEditor
+		}
+		return ""
+	case preset.SharedGroupID != "":
+		return roles[preset.SharedGroupID]
+	}
+	return ""
+}
+
+// groupMembers lists the device IDs in a group and their roles
+func (s *Storage) groupMembers(ctx context.Context, groupID string) ([]string, map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT device_id, role FROM device_group_members
+		WHERE group_id = ? ORDER BY added_at`, groupID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query group members: %w", err)
+	}
+	defer rows.Close()
+
+	members := []string{}
+	roles := map[string]string{}
+	for rows.Next() {
+		var deviceID, role string
+		if err := rows.Scan(&deviceID, &role); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan group member: %w", err)
+		}
+		members = append(members, deviceID)
+		roles[deviceID] = role
+	}
+	return members, roles, rows.Err()
+}
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/logger"
+)
+
+// ErrCircuitOpen is returned by storage calls while the circuit breaker is
+// open, without trying the database
+var ErrCircuitOpen = errors.New("storage circuit breaker is open")
+
+// Circuit breaker states
+const (
+	BreakerDisabled = "disabled"
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	// BreakerHalfOpen lets one call through to see if the database is back
+	BreakerHalfOpen = "half-open"
+)
+
+// busyMessages are SQLite's messages for SQLITE_BUSY and SQLITE_LOCKED,
+// matched like corruptMessages
+var busyMessages = []string{"database is locked", "database table is locked"}
+
+// faultMessages are errors from the database itself being in trouble,
+// rather than from a query or its data. Only these count against the
+// circuit breaker.
+var faultMessages = []string{"disk I/O error", "database or disk is full", "unable to open database file",
+	"attempt to write a readonly database", "sql: database is closed"}
+
+// errorMatches reports whether err's message contains one of messages
+func errorMatches(err error, messages []string) bool {
+	for _, msg := range messages {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFault reports whether err means the database is failing
+func isFault(err error) bool {
+	return err != nil && (errorMatches(err, faultMessages) || errorMatches(err, busyMessages) || errorMatches(err, corruptMessages))
+}
+
+// guardedDB is the handle storage calls go through. Statements that find
+// the database busy are retried with a doubling backoff, and a circuit
+// breaker makes calls fail fast after repeated faults, until the database
+// has had time to recover. Statements inside a transaction aren't retried
+// on their own, since that could apply half of it; beginning one is.
+// Single-row queries report their errors only when scanned, so they are
+// only timed. Statements slower than slowQuery are logged and counted.
+type guardedDB struct {
+	*sql.DB
+	retry config.RetryConfig
+	// breaker is nil when the circuit breaker is off
+	breaker *circuitBreaker
+
+	// slowQuery is 0 when slow statements aren't logged
+	slowQuery   time.Duration
+	slowQueries atomic.Int64
+	logger      *logger.Logger
+}
+
+func newGuardedDB(db *sql.DB, cfg config.StorageConfig, log *logger.Logger) *guardedDB {
+	g := &guardedDB{
+		DB:        db,
+		retry:     cfg.Retry,
+		slowQuery: time.Duration(cfg.SlowQueryMs) * time.Millisecond,
+		logger:    log,
+	}
+	if cb := cfg.CircuitBreaker; cb.Enabled {
+		g.breaker = &circuitBreaker{
+			threshold: cb.FailureThreshold,
+			openFor:   time.Duration(cb.OpenSeconds) * time.Second,
+			logger:    log,
+			state:     BreakerClosed,
+		}
+	}
+	return g
+}
+
+// do runs fn through the breaker, retrying it while the database is busy
+func (db *guardedDB) do(ctx context.Context, fn func() error) error {
+	if err := db.breaker.allow(); err != nil {
+		return err
+	}
+	delay := time.Duration(db.retry.BackoffMs) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= db.retry.MaxAttempts || !errorMatches(err, busyMessages) {
+			db.breaker.record(err)
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			db.breaker.record(err)
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// slowQueryLogLength is as much of a slow statement's SQL as is logged
+const slowQueryLogLength = 200
+
+// timed logs and counts a statement that took longer than slowQuery,
+// retries included, since waiting on a busy database is what stalls a sync
+func (db *guardedDB) timed(query string, start time.Time) {
+	if db.slowQuery == 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	if elapsed < db.slowQuery {
+		return
+	}
+	db.slowQueries.Add(1)
+	text := strings.Join(strings.Fields(query), " ")
+	if len(text) > slowQueryLogLength {
+		text = text[:slowQueryLogLength] + "..."
+	}
+	db.logger.Warn("Slow query took %s: %s", elapsed.Round(time.Millisecond), text)
+}
+
+func (db *guardedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	defer db.timed(query, time.Now())
+	var result sql.Result
+	err := db.do(ctx, func() (err error) {
+		result, err = db.DB.ExecContext(ctx, query, args...)
+		return err
+	})
+	return result, err
+}
+
+func (db *guardedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db *guardedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	defer db.timed(query, time.Now())
+	var rows *sql.Rows
+	err := db.do(ctx, func() (err error) {
+		rows, err = db.DB.QueryContext(ctx, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+func (db *guardedDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+func (db *guardedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	defer db.timed(query, time.Now())
+	return db.DB.QueryRowContext(ctx, query, args...)
+}
+
+func (db *guardedDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.QueryRowContext(context.Background(), query, args...)
+}
+
+func (db *guardedDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	var tx *sql.Tx
+	err := db.do(ctx, func() (err error) {
+		tx, err = db.DB.BeginTx(ctx, opts)
+		return err
+	})
+	return tx, err
+}
+
+func (db *guardedDB) Begin() (*sql.Tx, error) {
+	return db.BeginTx(context.Background(), nil)
+}
+
+// BreakerStatus is the circuit breaker's state, for the health endpoint
+type BreakerStatus struct {
+	// State is disabled, closed, open or half-open
+	State string `json:"state"`
+	// Failures counts faults in a row
+	Failures int `json:"failures"`
+	// OpenedAt is when the breaker last opened, while it isn't closed
+	OpenedAt *time.Time `json:"openedAt,omitempty"`
+}
+
+// circuitBreaker opens after threshold faults in a row. Once open, calls
+// fail with ErrCircuitOpen until openFor has passed; then one call is let
+// through, closing it again if it succeeds and reopening it if not.
+type circuitBreaker struct {
+	threshold int
+	openFor   time.Duration
+	logger    *logger.Logger
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// trying is set while the half-open breaker's one call runs
+	trying bool
+}
+
+// allow reports whether a call may go ahead. A nil breaker allows all.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.openFor {
+		b.state = BreakerHalfOpen
+	}
+	switch {
+	case b.state == BreakerOpen, b.state == BreakerHalfOpen && b.trying:
+		return ErrCircuitOpen
+	case b.state == BreakerHalfOpen:
+		b.trying = true
+	}
+	return nil
+}
+
+// record counts a call's outcome. Errors that aren't faults, such as a
+// missing row or a broken constraint, show the database answering; a
+// cancelled call shows nothing either way.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trying = false
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	if !isFault(err) {
+		if b.state == BreakerHalfOpen {
+			b.logger.Info("Storage circuit breaker closed; the database is answering again")
+		}
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+		if b.state == BreakerClosed {
+			b.logger.Warn("Storage circuit breaker open for %s after %d failures: %v", b.openFor, b.failures, err)
+		}
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// BreakerStatus returns the storage circuit breaker's state
+func (s *Storage) BreakerStatus() BreakerStatus {
+	b := s.db.breaker
+	if b == nil {
+		return BreakerStatus{State: BreakerDisabled}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{State: b.state, Failures: b.failures}
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.openFor {
+		status.State = BreakerHalfOpen
+	}
+	if status.State != BreakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+// SlowQueries counts the statements that took longer than
+// storage.slow_query_ms since the service started
+func (s *Storage) SlowQueries() int64 {
+	return s.db.slowQueries.Load()
+}
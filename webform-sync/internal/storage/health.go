@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrFreeSpaceUnsupported is returned by FreeSpace on platforms where it
+// isn't implemented
+var ErrFreeSpaceUnsupported = errors.New("free space check not supported on this platform")
+
+// ErrCorrupt is returned by CheckIntegrity when the database is damaged
+var ErrCorrupt = errors.New("database is corrupt")
+
+// ErrDiskFull is returned by CheckAvailable when the data directory has no
+// room left for writes
+var ErrDiskFull = errors.New("data directory is full")
+
+// minWritableSpace is the free space below which writes are expected to
+// fail with SQLITE_FULL
+const minWritableSpace = 1 << 20
+
+// CheckIntegrity runs SQLite's quick check over the whole database. It reads
+// every page, so it belongs in maintenance runs rather than probes.
+func (s *Storage) CheckIntegrity(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, `PRAGMA quick_check(10)`)
+	if err != nil {
+		return integrityError(err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return integrityError(err)
+		}
+		if line != "ok" {
+			problems = append(problems, strings.Join(strings.Fields(line), " "))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return integrityError(err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrCorrupt, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// corruptMessages are SQLite's messages for SQLITE_CORRUPT and
+// SQLITE_NOTADB. They are matched rather than the driver's error codes,
+// whose type only exists in cgo builds.
+var corruptMessages = []string{"database disk image is malformed", "file is not a database"}
+
+// integrityError wraps an error from the integrity check, marking SQLite's
+// own corruption errors as ErrCorrupt
+func integrityError(err error) error {
+	for _, msg := range corruptMessages {
+		if strings.Contains(err.Error(), msg) {
+			return fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+	}
+	return fmt.Errorf("failed to check integrity: %w", err)
+}
+
+// Ping checks that the database answers a query. It goes through the
+// circuit breaker, so fails at once while that is open, and is the call
+// let through to close it again.
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.db.do(ctx, func() error {
+		var one int
+		return s.db.DB.QueryRowContext(ctx, `SELECT 1`).Scan(&one)
+	})
+}
+
+// CheckAvailable checks that the database answers a query and that there
+// is room to write to it. It is cheap enough to call after every failed
+// request.
+func (s *Storage) CheckAvailable(ctx context.Context) error {
+	if err := s.Ping(ctx); err != nil {
+		return err
+	}
+	if free, err := s.FreeSpace(); err == nil && free < minWritableSpace {
+		return ErrDiskFull
+	}
+	return nil
+}
+
+// PendingMigrations lists schema migrations that haven't been applied, as
+// table.column. It is empty once NewStorage has succeeded, unless the
+// database was replaced underneath the running service.
+func (s *Storage) PendingMigrations() ([]string, error) {
+	var pending []string
+	for _, m := range columnMigrations {
+		exists, err := s.columnExists(m.table, m.column)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			pending = append(pending, m.table+"."+m.column)
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/logger"
+)
+
+// maxIDAttempts bounds how many IDs a new preset is offered before its
+// save gives up
+const maxIDAttempts = 3
+
+// ErrPresetIDTaken is returned when every ID generated for a new preset was
+// already taken, which points to a broken clock or random source
+var ErrPresetIDTaken = errors.New("generated preset ID already taken")
+
+// uuidv7 state keeps IDs generated within the same millisecond monotonic
+var (
+	idMu     sync.Mutex
+	idLastMS int64
+	idSeq    uint16
+)
+
+// NewPresetID generates a new UUIDv7 preset ID (RFC 9562)
+func NewPresetID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand never fails on supported platforms; keep the time prefix regardless
+		binary.BigEndian.PutUint64(b[8:], uint64(time.Now().UnixNano()))
+	}
+
+	idMu.Lock()
+	ms := time.Now().UnixMilli()
+	if ms <= idLastMS {
+		// Same (or earlier) millisecond: bump the 12-bit counter to stay ordered
+		ms = idLastMS
+		idSeq++
+		if idSeq > 0x0FFF {
+			ms++
+			idSeq = 0
+		}
+	} else {
+		idSeq = binary.BigEndian.Uint16(b[6:8]) & 0x07FF
+	}
+	idLastMS = ms
+	seq := idSeq
+	idMu.Unlock()
+
+	// 48-bit big-endian millisecond timestamp
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+
+	// Version 7 + 12-bit sequence (rand_a)
+	b[6] = 0x70 | byte(seq>>8)
+	b[7] = byte(seq)
+
+	// RFC 4122 variant
+	b[8] = (b[8] & 0x3F) | 0x80
+
+	return formatUUID(b)
+}
+
+// assignID gives a preset without an ID a new one. Saves don't overwrite
+// another preset with an ID assigned this way: they draw another.
+func (p *Preset) assignID() {
+	if p.ID == "" {
+		p.ID = NewPresetID()
+		p.generatedID = true
+	}
+}
+
+// withFreshID runs a preset upsert, drawing a new ID while the one
+// assignID gave it turns out to be taken. The upsert must leave an existing
+// row alone when given generatedID, so it returns no row. IDs are unique
+// within a process, so a clash means another replica or a restored backup
+// holds the same ID, and warrants a warning.
+func withFreshID(preset *Preset, log *logger.Logger, upsert func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := upsert()
+		if !preset.generatedID || !errors.Is(err, sql.ErrNoRows) {
+			if err == nil {
+				preset.generatedID = false
+			}
+			return err
+		}
+		if attempt == maxIDAttempts || preset.idAcknowledged {
+			return fmt.Errorf("%w: %s", ErrPresetIDTaken, preset.ID)
+		}
+		log.Warn("Generated preset ID %s is already taken; drawing another", preset.ID)
+		preset.ID = NewPresetID()
+	}
+}
+
+// reserveID redraws a generated ID while it is taken, for saves that hand
+// the ID back before they are written. The ID is then fixed: should it be
+// taken by the time it is written, the save fails.
+func (s *Storage) reserveID(ctx context.Context, preset *Preset) error {
+	if !preset.generatedID {
+		return nil
+	}
+	for attempt := 1; ; attempt++ {
+		var taken bool
+		err := s.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM presets WHERE id = ?)`, preset.ID).Scan(&taken)
+		if err != nil {
+			return fmt.Errorf("failed to check preset ID: %w", err)
+		}
+		if !taken {
+			preset.idAcknowledged = true
+			return nil
+		}
+		if attempt == maxIDAttempts {
+			return fmt.Errorf("%w: %s", ErrPresetIDTaken, preset.ID)
+		}
+		s.logger.Warn("Generated preset ID %s is already taken; drawing another", preset.ID)
+		preset.ID = NewPresetID()
+	}
+}
+
+// IsValidPresetID reports whether id is a canonical UUID string
+func IsValidPresetID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !isHexChar(c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// formatUUID renders 16 bytes in the 8-4-4-4-12 layout
+func formatUUID(b [16]byte) string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], b[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], b[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], b[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], b[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], b[10:])
+	return string(buf[:])
+}
+
+func isHexChar(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Maintenance run statuses
+const (
+	MaintenanceOK     = "ok"
+	MaintenanceFailed = "failed"
+)
+
+// MaintenanceRun records one run of the maintenance tasks
+type MaintenanceRun struct {
+	ID         string    `json:"id"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// PresetsDeleted are presets unused for maintenance.delete_after_days
+	PresetsDeleted int `json:"presetsDeleted"`
+	// SyncLogPruned are sync log entries older than sync_log_retention_days
+	SyncLogPruned int `json:"syncLogPruned"`
+	// TombstonesExpired are records of deleted presets older than
+	// tombstone_retention_days
+	TombstonesExpired int `json:"tombstonesExpired"`
+	// UsageEventsPruned are usage events older than usage_retention_days
+	UsageEventsPruned int `json:"usageEventsPruned"`
+	// Compacted is whether VACUUM ran, and FreedBytes how much it shrank
+	// the database file by
+	Compacted  bool  `json:"compacted"`
+	FreedBytes int64 `json:"freedBytes"`
+	// Optimized is whether ANALYZE ran
+	Optimized bool `json:"optimized"`
+	// Status is ok, or failed if any task failed
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// PruneSyncLog removes sync log entries older than days, except those
+// recording deletions, which ExpireTombstones handles
+func (s *Storage) PruneSyncLog(ctx context.Context, days int) (int, error) {
+	if days <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	result, err := s.db.ExecContext(ctx, `DELETE FROM sync_log WHERE action != 'delete' AND timestamp < ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune sync log: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+	return int(rows), nil
+}
+
+// ExpireTombstones removes the sync log's records of presets deleted more
+// than days ago. They are all that's left of a deleted preset, so they are
+// usually kept longer than the rest of the log.
+func (s *Storage) ExpireTombstones(ctx context.Context, days int) (int, error) {
+	if days <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	result, err := s.db.ExecContext(ctx, `DELETE FROM sync_log WHERE action = 'delete' AND timestamp < ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire tombstones: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+	return int(rows), nil
+}
+
+// TableSize counts the rows in a table
+type TableSize struct {
+	Name string `json:"name"`
+	Rows int64  `json:"rows"`
+}
+
+// DatabaseSize describes the database file and how much of it is free
+type DatabaseSize struct {
+	File     string `json:"file"`
+	Bytes    int64  `json:"bytes"`
+	PageSize int64  `json:"pageSize"`
+	Pages    int64  `json:"pages"`
+	// FreePages are left by deleted rows; VACUUM gives them back to the
+	// filesystem, and until then new rows reuse them
+	FreePages   int64       `json:"freePages"`
+	FreeBytes   int64       `json:"freeBytes"`
+	FreePercent float64     `json:"freePercent"`
+	Tables      []TableSize `json:"tables"`
+}
+
+// DatabaseSize reports the size of the database file, its free pages and
+// the rows in each table
+func (s *Storage) DatabaseSize(ctx context.Context) (*DatabaseSize, error) {
+	size := &DatabaseSize{File: filepath.Join(s.cfg.DataDir, s.cfg.DBFile), Tables: []TableSize{}}
+	for pragma, dest := range map[string]*int64{"page_size": &size.PageSize, "page_count": &size.Pages, "freelist_count": &size.FreePages} {
+		if err := s.db.QueryRowContext(ctx, `PRAGMA `+pragma).Scan(dest); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", pragma, err)
+		}
+	}
+	size.Bytes = size.Pages * size.PageSize
+	size.FreeBytes = size.FreePages * size.PageSize
+	if size.Pages > 0 {
+		size.FreePercent = math.Round(float64(size.FreePages)/float64(size.Pages)*1000) / 10
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to list tables: %w", err)
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	for _, name := range names {
+		t := TableSize{Name: name}
+		if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM "`+strings.ReplaceAll(name, `"`, `""`)+`"`).Scan(&t.Rows); err != nil {
+			return nil, fmt.Errorf("failed to count rows in %s: %w", name, err)
+		}
+		size.Tables = append(size.Tables, t)
+	}
+	return size, nil
+}
+
+// Compact rebuilds the database with VACUUM, giving its free pages back to
+// the filesystem, and returns how many bytes the file shrank by. VACUUM
+// rewrites the whole file, so writers wait while it runs and it needs as
+// much free disk space again.
+func (s *Storage) Compact(ctx context.Context) (int64, error) {
+	before, err := s.DatabaseSize(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.db.ExecContext(ctx, `VACUUM`); err != nil {
+		return 0, fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	after, err := s.DatabaseSize(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return before.Bytes - after.Bytes, nil
+}
+
+// Analyze refreshes the query planner's statistics
+func (s *Storage) Analyze(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `ANALYZE`); err != nil {
+		return fmt.Errorf("failed to analyze database: %w", err)
+	}
+	return nil
+}
+
+// RecordMaintenanceRun adds a maintenance run to the history
+func (s *Storage) RecordMaintenanceRun(ctx context.Context, run *MaintenanceRun) error {
+	if run.ID == "" {
+		run.ID = NewPresetID()
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO maintenance_runs (id, started_at, finished_at, presets_deleted, sync_log_pruned, tombstones_expired,
+			usage_events_pruned, compacted, freed_bytes, optimized, status, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.ID, run.StartedAt, run.FinishedAt, run.PresetsDeleted, run.SyncLogPruned, run.TombstonesExpired,
+		run.UsageEventsPruned, run.Compacted, run.FreedBytes, run.Optimized, run.Status, run.Error)
+	if err != nil {
+		return fmt.Errorf("failed to record maintenance run: %w", err)
+	}
+	return nil
+}
+
+// LastMaintenanceRun returns the most recent maintenance run, or nil if
+// there hasn't been one
+func (s *Storage) LastMaintenanceRun(ctx context.Context) (*MaintenanceRun, error) {
+	var run MaintenanceRun
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, started_at, finished_at, presets_deleted, sync_log_pruned, tombstones_expired,
+			usage_events_pruned, compacted, freed_bytes, optimized, status, error
+		FROM maintenance_runs
+		ORDER BY started_at DESC
+		LIMIT 1`).Scan(&run.ID, &run.StartedAt, &run.FinishedAt, &run.PresetsDeleted, &run.SyncLogPruned,
+		&run.TombstonesExpired, &run.UsageEventsPruned, &run.Compacted, &run.FreedBytes, &run.Optimized, &run.Status, &run.Error)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query maintenance runs: %w", err)
+	}
+	return &run, nil
+}
@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/plugin"
+)
+
+// PresetStore is the preset reading and writing the server's preset routes
+// depend on. Storage implements it over SQLite, and OpenPresetStore over a
+// plugin.StorageBackend when storage.backend names one.
+type PresetStore interface {
+	GetPreset(ctx context.Context, id string) (*Preset, error)
+	GetPresetOwner(ctx context.Context, id string) (string, bool, error)
+	GetAllPresets(ctx context.Context, deviceID string) ([]*Preset, error)
+	GetPresetsByScope(ctx context.Context, scopeType, scopeValue, deviceID string) ([]*Preset, error)
+	GetPresetsPage(ctx context.Context, deviceID string, limit, offset int) ([]*Preset, int, error)
+	SavePreset(ctx context.Context, preset *Preset) error
+	EditPreset(ctx context.Context, preset *Preset) error
+	EditPresetVersion(ctx context.Context, preset *Preset, version int) error
+	DeletePreset(ctx context.Context, id, deviceID string) error
+	UpdatePresetUsage(ctx context.Context, id string) error
+}
+
+var _ PresetStore = (*Storage)(nil)
+
+// OpenPresetStore returns where presets are kept: s itself, or the storage
+// backend plugin cfg names, keeping its presets in namespace
+func (s *Storage) OpenPresetStore(cfg config.PluginConfig, namespace string) (PresetStore, error) {
+	if cfg.Name == "" {
+		return s, nil
+	}
+	backend, err := plugin.NewStorageBackend(cfg.Name, cfg.Settings, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("storage backend: %w", err)
+	}
+	return &pluginPresets{backend: backend, devices: s}, nil
+}
+
+// pluginPresets keeps presets in a storage backend plugin. Devices, and so
+// the user a device belongs to, still come from the database.
+type pluginPresets struct {
+	backend plugin.StorageBackend
+	devices *Storage
+}
+
+func (p *pluginPresets) GetPreset(ctx context.Context, id string) (*Preset, error) {
+	stored, err := p.backend.Get(ctx, id)
+	if errors.Is(err, plugin.ErrPresetNotFound) {
+		return nil, ErrPresetNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get preset: %w", err)
+	}
+	return fromPluginPreset(stored), nil
+}
+
+func (p *pluginPresets) GetPresetOwner(ctx context.Context, id string) (string, bool, error) {
+	preset, err := p.GetPreset(ctx, id)
+	if errors.Is(err, ErrPresetNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return preset.DeviceID, true, nil
+}
+
+// GetAllPresets lists a device's presets and the device-less ones of its
+// user, newest first, as visibleToDevice does. Presets can't be shared with
+// groups here.
+func (p *pluginPresets) GetAllPresets(ctx context.Context, deviceID string) ([]*Preset, error) {
+	stored, err := p.backend.List(ctx, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query presets: %w", err)
+	}
+	if deviceID != "" {
+		shared, err := p.backend.List(ctx, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to query presets: %w", err)
+		}
+		userID, err := p.deviceUserID(ctx, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		for _, preset := range shared {
+			if preset.UserID == userID {
+				stored = append(stored, preset)
+			}
+		}
+	}
+
+	presets := make([]*Preset, len(stored))
+	for i, preset := range stored {
+		presets[i] = fromPluginPreset(preset)
+	}
+	sort.SliceStable(presets, func(i, j int) bool {
+		return presets[i].UpdatedAt.After(presets[j].UpdatedAt)
+	})
+	return presets, nil
+}
+
+func (p *pluginPresets) GetPresetsByScope(ctx context.Context, scopeType, scopeValue, deviceID string) ([]*Preset, error) {
+	all, err := p.GetAllPresets(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	scopeValue = NormalizeScope(scopeType, scopeValue)
+	var presets []*Preset
+	for _, preset := range all {
+		if preset.ScopeType == scopeType && preset.ScopeValue == scopeValue {
+			presets = append(presets, preset)
+		}
+	}
+	return presets, nil
+}
+
+func (p *pluginPresets) GetPresetsPage(ctx context.Context, deviceID string, limit, offset int) ([]*Preset, int, error) {
+	all, err := p.GetAllPresets(ctx, deviceID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > len(all) {
+		offset = len(all)
+	}
+	end := len(all)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return all[offset:end], len(all), nil
+}
+
+// SavePreset creates a preset or updates its content. As with the database,
+// an update keeps the preset's device, scope and creation time.
+func (p *pluginPresets) SavePreset(ctx context.Context, preset *Preset) error {
+	if _, err := prepareSave(preset); err != nil {
+		return err
+	}
+	existing, err := p.GetPreset(ctx, preset.ID)
+	if err != nil && !errors.Is(err, ErrPresetNotFound) {
+		return err
+	}
+
+	version := 0
+	if existing != nil {
+		preset.DeviceID = existing.DeviceID
+		preset.ScopeType, preset.ScopeValue = existing.ScopeType, existing.ScopeValue
+		preset.CreatedAt = existing.CreatedAt
+		version = existing.Version
+	}
+	return p.put(ctx, preset, version)
+}
+
+func (p *pluginPresets) EditPreset(ctx context.Context, preset *Preset) error {
+	return p.EditPresetVersion(ctx, preset, 0)
+}
+
+// EditPresetVersion writes an edited preset back, including a change of
+// scope, as Storage.EditPreset does
+func (p *pluginPresets) EditPresetVersion(ctx context.Context, preset *Preset, version int) error {
+	if _, err := prepareSave(preset); err != nil {
+		return err
+	}
+	existing, err := p.GetPreset(ctx, preset.ID)
+	if err != nil {
+		return err
+	}
+	if version != 0 && existing.Version != version {
+		return ErrPresetModified
+	}
+
+	// The device's other presets keep their names and scopes to themselves
+	presets, err := p.backend.List(ctx, existing.DeviceID)
+	if err != nil {
+		return fmt.Errorf("failed to edit preset: %w", err)
+	}
+	for _, other := range presets {
+		if other.ID != preset.ID && other.Name == preset.Name &&
+			other.ScopeType == preset.ScopeType && other.ScopeValue == preset.ScopeValue {
+			return ErrPresetExists
+		}
+	}
+
+	preset.DeviceID = existing.DeviceID
+	preset.CreatedAt = existing.CreatedAt
+	preset.LastUsed, preset.UseCount = existing.LastUsed, existing.UseCount
+	preset.UpdatedAt = time.Now()
+	return p.put(ctx, preset, existing.Version)
+}
+
+func (p *pluginPresets) DeletePreset(ctx context.Context, id, deviceID string) error {
+	existing, err := p.GetPreset(ctx, id)
+	if err != nil {
+		return err
+	}
+	if existing.DeviceID != deviceID {
+		return ErrPresetNotFound
+	}
+	if err := p.backend.Delete(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete preset: %w", err)
+	}
+	return nil
+}
+
+// UpdatePresetUsage counts a use of a preset. Unlike the database, the
+// backend keeps no usage events, so usage reports don't include it.
+func (p *pluginPresets) UpdatePresetUsage(ctx context.Context, id string) error {
+	stored, err := p.backend.Get(ctx, id)
+	if errors.Is(err, plugin.ErrPresetNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update preset usage: %w", err)
+	}
+	now := time.Now()
+	stored.LastUsed = &now
+	stored.UseCount++
+	if err := p.backend.Put(ctx, stored, stored.Version); err != nil {
+		return fmt.Errorf("failed to update preset usage: %w", err)
+	}
+	return nil
+}
+
+// put writes a preset as the next version after version (0 for a new
+// preset), failing with ErrPresetModified if another write got there first
+func (p *pluginPresets) put(ctx context.Context, preset *Preset, version int) error {
+	userID, err := p.deviceUserID(ctx, preset.DeviceID)
+	if err != nil {
+		return err
+	}
+	preset.UserID = userID
+	preset.Version = version + 1
+
+	stored, err := toPluginPreset(preset)
+	if err != nil {
+		return err
+	}
+	err = p.backend.Put(ctx, stored, version)
+	if errors.Is(err, plugin.ErrPresetModified) {
+		return ErrPresetModified
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save preset: %w", err)
+	}
+	return nil
+}
+
+// deviceUserID returns the user owning a device, or "" for none
+func (p *pluginPresets) deviceUserID(ctx context.Context, deviceID string) (string, error) {
+	if deviceID == "" {
+		return "", nil
+	}
+	device, err := p.devices.GetDevice(ctx, deviceID)
+	if errors.Is(err, ErrDeviceNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return device.UserID, nil
+}
+
+func toPluginPreset(preset *Preset) (*plugin.Preset, error) {
+	var metadata json.RawMessage
+	if preset.Metadata != nil {
+		var err error
+		if metadata, err = json.Marshal(preset.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+		}
+	}
+	return &plugin.Preset{
+		ID:         preset.ID,
+		DeviceID:   preset.DeviceID,
+		UserID:     preset.UserID,
+		Name:       preset.Name,
+		ScopeType:  preset.ScopeType,
+		ScopeValue: preset.ScopeValue,
+		Fields:     preset.EncryptedFields,
+		Encrypted:  preset.Encrypted,
+		Metadata:   metadata,
+		CreatedAt:  preset.CreatedAt,
+		UpdatedAt:  preset.UpdatedAt,
+		LastUsed:   preset.LastUsed,
+		UseCount:   preset.UseCount,
+		Version:    preset.Version,
+	}, nil
+}
+
+func fromPluginPreset(stored *plugin.Preset) *Preset {
+	preset := &Preset{
+		ID:              stored.ID,
+		DeviceID:        stored.DeviceID,
+		UserID:          stored.UserID,
+		Name:            stored.Name,
+		ScopeType:       stored.ScopeType,
+		ScopeValue:      stored.ScopeValue,
+		EncryptedFields: stored.Fields,
+		Encrypted:       stored.Encrypted,
+		CreatedAt:       stored.CreatedAt,
+		UpdatedAt:       stored.UpdatedAt,
+		LastUsed:        stored.LastUsed,
+		UseCount:        stored.UseCount,
+		Version:         stored.Version,
+	}
+	// As scanPreset does, malformed JSON leaves the maps empty
+	if len(stored.Metadata) > 0 {
+		_ = json.Unmarshal(stored.Metadata, &preset.Metadata)
+	}
+	if stored.Fields != "" {
+		_ = json.Unmarshal([]byte(stored.Fields), &preset.Fields)
+	}
+	return preset
+}
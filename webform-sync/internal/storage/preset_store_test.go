@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/plugin"
+)
+
+// memoryBackend is a storage backend plugin keeping presets in a map
+type memoryBackend struct {
+	mu      sync.Mutex
+	presets map[string]plugin.Preset
+}
+
+func (m *memoryBackend) Get(ctx context.Context, id string) (*plugin.Preset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	preset, ok := m.presets[id]
+	if !ok {
+		return nil, plugin.ErrPresetNotFound
+	}
+	return &preset, nil
+}
+
+func (m *memoryBackend) List(ctx context.Context, deviceID string) ([]*plugin.Preset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var presets []*plugin.Preset
+	for _, preset := range m.presets {
+		if preset.DeviceID == deviceID {
+			preset := preset
+			presets = append(presets, &preset)
+		}
+	}
+	return presets, nil
+}
+
+func (m *memoryBackend) Put(ctx context.Context, preset *plugin.Preset, version int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if version != 0 && m.presets[preset.ID].Version != version {
+		return plugin.ErrPresetModified
+	}
+	m.presets[preset.ID] = *preset
+	return nil
+}
+
+func (m *memoryBackend) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.presets, id)
+	return nil
+}
+
+func init() {
+	plugin.RegisterStorageBackend("memory", func(settings plugin.Settings, namespace string) (plugin.StorageBackend, error) {
+		return &memoryBackend{presets: map[string]plugin.Preset{}}, nil
+	})
+}
+
+// Presets kept by a storage backend plugin behave as the database's do
+func TestPluginPresetStore(t *testing.T) {
+	s := openTestStorage(t, t.TempDir(), config.QuotaConfig{}, config.WriteBehindConfig{})
+	defer s.Close()
+	ctx := context.Background()
+
+	store, err := s.OpenPresetStore(config.PluginConfig{Name: "memory"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RegisterDevice(ctx, &Device{ID: "laptop", UserID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	own := testPreset("Login", "alice")
+	if err := store.SavePreset(ctx, own); err != nil {
+		t.Fatal(err)
+	}
+	shared := testPreset("Shared", "alice")
+	shared.DeviceID = ""
+	shared.UserID = "alice"
+	other := testPreset("Other", "bob")
+	other.DeviceID = "desktop"
+	for _, preset := range []*Preset{shared, other} {
+		stored, err := toPluginPreset(preset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored.ID, stored.Version = preset.Name, 1
+		if err := store.(*pluginPresets).backend.Put(ctx, stored, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := store.GetPreset(ctx, own.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Fields["user"] != "alice" || got.UserID != "alice" || got.Version != 1 {
+		t.Errorf("preset = %+v, want alice's first version", got)
+	}
+
+	presets, err := store.GetAllPresets(ctx, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(presets) != 2 {
+		t.Errorf("listed %d presets, want the device's own and its user's shared one", len(presets))
+	}
+
+	edit := *got
+	edit.ScopeType, edit.ScopeValue = ScopeTypeDomain, "example.com"
+	if err := store.EditPresetVersion(ctx, &edit, got.Version); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EditPresetVersion(ctx, got, got.Version); !errors.Is(err, ErrPresetModified) {
+		t.Errorf("stale edit: err = %v, want %v", err, ErrPresetModified)
+	}
+	byScope, err := store.GetPresetsByScope(ctx, ScopeTypeDomain, "example.com", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byScope) != 1 || byScope[0].Version != 2 {
+		t.Errorf("presets in the new scope = %+v, want the edited one", byScope)
+	}
+
+	if err := store.DeletePreset(ctx, own.ID, "desktop"); !errors.Is(err, ErrPresetNotFound) {
+		t.Errorf("delete by another device: err = %v, want %v", err, ErrPresetNotFound)
+	}
+	if err := store.DeletePreset(ctx, own.ID, "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetPreset(ctx, own.ID); !errors.Is(err, ErrPresetNotFound) {
+		t.Errorf("get after delete: err = %v, want %v", err, ErrPresetNotFound)
+	}
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Quota limit kinds reported in QuotaError
+const (
+	QuotaPresets     = "presets"      // Presets per device
+	QuotaBytes       = "bytes"        // Total stored bytes per device
+	QuotaPresetBytes = "preset_bytes" // Size of a single preset
+)
+
+// presetBytesExpr is the stored size in bytes of a preset, as counted for
+// quotas and stats (LENGTH on TEXT would count characters). Offloaded
+// fields count at their size in preset_blobs.
+const presetBytesExpr = presetFieldsBytesExpr + ` + COALESCE(LENGTH(CAST(metadata AS BLOB)), 0)`
+
+// QuotaError is returned by SavePreset when a save would exceed a configured limit
+type QuotaError struct {
+	Limit    string `json:"limit"`
+	Max      int64  `json:"max"`
+	Attempt  int64  `json:"attempt"`
+	DeviceID string `json:"deviceId"`
+}
+
+func (e *QuotaError) Error() string {
+	switch e.Limit {
+	case QuotaPresets:
+		return fmt.Sprintf("preset quota exceeded: device %s is limited to %d presets", e.DeviceID, e.Max)
+	case QuotaBytes:
+		return fmt.Sprintf("storage quota exceeded: device %s would use %d of %d bytes", e.DeviceID, e.Attempt, e.Max)
+	default:
+		return fmt.Sprintf("preset too large: %d bytes exceeds the %d byte limit", e.Attempt, e.Max)
+	}
+}
+
+// DeviceUsage reports a device's storage use against its limits (0 = unlimited)
+type DeviceUsage struct {
+	DeviceID       string `json:"deviceId"`
+	Presets        int64  `json:"presets"`
+	Bytes          int64  `json:"bytes"`
+	MaxPresets     int64  `json:"maxPresets"`
+	MaxBytes       int64  `json:"maxBytes"`
+	MaxPresetBytes int64  `json:"maxPresetBytes"`
+}
+
+// GetDeviceUsage returns a device's preset count and stored bytes
+func (s *Storage) GetDeviceUsage(ctx context.Context, deviceID string) (*DeviceUsage, error) {
+	usage := &DeviceUsage{
+		DeviceID:       deviceID,
+		MaxPresets:     int64(s.cfg.Quota.MaxPresetsPerDevice),
+		MaxBytes:       s.cfg.Quota.MaxBytesPerDevice,
+		MaxPresetBytes: s.cfg.Quota.MaxPresetBytes,
+	}
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(`+presetBytesExpr+`), 0)
+		FROM presets WHERE device_id = ?`, deviceID).Scan(&usage.Presets, &usage.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device usage: %w", err)
+	}
+	return usage, nil
+}
+
+// checkQuota verifies that saving a preset of the given size keeps the device
+// within its limits. The preset's own current row, if any, is excluded so
+// updates are measured by their new size.
+func (s *Storage) checkQuota(ctx context.Context, tx *sql.Tx, preset *Preset, size int64) error {
+	quota := s.cfg.Quota
+	if quota.MaxPresetBytes > 0 && size > quota.MaxPresetBytes {
+		return &QuotaError{Limit: QuotaPresetBytes, Max: quota.MaxPresetBytes, Attempt: size, DeviceID: preset.DeviceID}
+	}
+	if quota.MaxPresetsPerDevice <= 0 && quota.MaxBytesPerDevice <= 0 {
+		return nil
+	}
+
+	var count, used int64
+	err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(`+presetBytesExpr+`), 0)
+		FROM presets WHERE device_id = ? AND id != ?`,
+		preset.DeviceID, preset.ID).Scan(&count, &used)
+	if err != nil {
+		return fmt.Errorf("failed to check quota: %w", err)
+	}
+
+	if quota.MaxPresetsPerDevice > 0 && count+1 > int64(quota.MaxPresetsPerDevice) {
+		return &QuotaError{Limit: QuotaPresets, Max: int64(quota.MaxPresetsPerDevice), Attempt: count + 1, DeviceID: preset.DeviceID}
+	}
+	if quota.MaxBytesPerDevice > 0 && used+size > quota.MaxBytesPerDevice {
+		return &QuotaError{Limit: QuotaBytes, Max: quota.MaxBytesPerDevice, Attempt: used + size, DeviceID: preset.DeviceID}
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/logger"
+)
+
+// redisCache keeps preset lists in Redis, so every replica behind a load
+// balancer reads and invalidates the same cache.
+//
+// Rather than track which keys each device has, a list is stored under the
+// cache's generation and its device's generation at the time. Invalidating
+// bumps a generation with INCR, which leaves the old lists unreachable
+// until their TTL runs out. A query that raced a write stores its result
+// under the generations it read, where nobody looks for it any more.
+//
+// It speaks the few RESP commands it needs itself. When Redis can't be
+// reached, lists are read from the database.
+type redisCache struct {
+	cfg    config.RedisConfig
+	ttl    time.Duration
+	logger *logger.Logger
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+func newRedisCache(cfg config.RedisConfig, ttl time.Duration, log *logger.Logger) *redisCache {
+	return &redisCache{cfg: cfg, ttl: ttl, logger: log}
+}
+
+func (c *redisCache) generationKey(deviceID string) string {
+	if deviceID == "" {
+		return c.cfg.KeyPrefix + "gen:all"
+	}
+	return c.cfg.KeyPrefix + "gen:device:" + deviceID
+}
+
+func (c *redisCache) get(key, deviceID string) ([]*Preset, cacheStamp, bool) {
+	var stamp cacheStamp
+	var data string
+	err := c.do(func(conn *redisConn) error {
+		reply, err := conn.command("MGET", c.cfg.KeyPrefix+"gen", c.generationKey(deviceID))
+		if err != nil {
+			return err
+		}
+		generations, _ := reply.([]interface{})
+		if len(generations) != 2 {
+			return fmt.Errorf("unexpected MGET reply: %v", reply)
+		}
+		global, _ := generations[0].(string)
+		device, _ := generations[1].(string)
+		stamp.key = c.cfg.KeyPrefix + "list:" + global + ":" + device + ":" + key
+
+		reply, err = conn.command("GET", stamp.key)
+		if err != nil {
+			return err
+		}
+		data, _ = reply.(string)
+		return nil
+	})
+	if err != nil {
+		c.logger.Warn("Preset cache unavailable, reading from the database: %v", err)
+		return nil, cacheStamp{}, false
+	}
+	if data == "" {
+		return nil, stamp, false
+	}
+
+	var presets []*Preset
+	if err := json.Unmarshal([]byte(data), &presets); err != nil {
+		c.logger.Warn("Discarding unreadable cached presets: %v", err)
+		return nil, stamp, false
+	}
+	return presets, cacheStamp{}, true
+}
+
+func (c *redisCache) put(stamp cacheStamp, deviceID string, presets []*Preset) {
+	if stamp.key == "" {
+		return
+	}
+	data, err := json.Marshal(presets)
+	if err != nil {
+		c.logger.Warn("Failed to encode presets for the cache: %v", err)
+		return
+	}
+	err = c.do(func(conn *redisConn) error {
+		_, err := conn.command("SET", stamp.key, string(data), "PX", strconv.FormatInt(c.ttl.Milliseconds(), 10))
+		return err
+	})
+	if err != nil {
+		c.logger.Warn("Failed to cache presets: %v", err)
+	}
+}
+
+// stale finds nothing: Redis drops lists once their TTL is up
+func (c *redisCache) stale(key string) ([]*Preset, bool) {
+	return nil, false
+}
+
+func (c *redisCache) invalidateDevices(deviceIDs ...string) {
+	keys := make([]string, len(deviceIDs))
+	for i, id := range deviceIDs {
+		keys[i] = c.generationKey(id)
+	}
+	c.incr(keys...)
+}
+
+func (c *redisCache) flush() {
+	c.incr(c.cfg.KeyPrefix + "gen")
+}
+
+// incr bumps generations. Other replicas would serve stale lists until
+// their TTL if this failed, so failures are errors.
+func (c *redisCache) incr(keys ...string) {
+	err := c.do(func(conn *redisConn) error {
+		for _, key := range keys {
+			if _, err := conn.command("INCR", key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.logger.Error("Failed to invalidate cached presets; other servers may serve stale lists for up to %s: %v", c.ttl, err)
+	}
+}
+
+func (c *redisCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.idle {
+		conn.Close()
+	}
+	c.idle = nil
+}
+
+// do runs fn on a pooled connection. A connection that failed is dropped
+// rather than returned to the pool, as a reply may still be on its way. If
+// it had been idle, Redis may have closed it meanwhile, so fn gets one more
+// try on a new connection.
+func (c *redisCache) do(fn func(*redisConn) error) error {
+	for {
+		conn, pooled, err := c.conn()
+		if err != nil {
+			return err
+		}
+		conn.SetDeadline(time.Now().Add(time.Duration(c.cfg.TimeoutMs) * time.Millisecond))
+		err = fn(conn)
+		var redisErr redisError
+		if err == nil || errors.As(err, &redisErr) {
+			c.release(conn)
+			return err
+		}
+		conn.Close()
+		if !pooled {
+			return err
+		}
+	}
+}
+
+// conn takes an idle connection from the pool, or opens one
+func (c *redisCache) conn() (*redisConn, bool, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, true, nil
+	}
+	c.mu.Unlock()
+
+	timeout := time.Duration(c.cfg.TimeoutMs) * time.Millisecond
+	netConn, err := net.DialTimeout("tcp", c.cfg.Addr, timeout)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	conn := &redisConn{Conn: netConn, r: bufio.NewReader(netConn)}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if c.cfg.Password != "" {
+		if _, err := conn.command("AUTH", c.cfg.Password); err != nil {
+			conn.Close()
+			return nil, false, fmt.Errorf("redis AUTH failed: %w", err)
+		}
+	}
+	if c.cfg.DB != 0 {
+		if _, err := conn.command("SELECT", strconv.Itoa(c.cfg.DB)); err != nil {
+			conn.Close()
+			return nil, false, fmt.Errorf("redis SELECT failed: %w", err)
+		}
+	}
+	return conn, false, nil
+}
+
+func (c *redisCache) release(conn *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= c.cfg.PoolSize {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// redisError is an error reply from Redis. The connection stays usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection speaking RESP2
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// command sends a command and reads its reply: a string (nil bulk strings
+// are ""), an int64, or a []interface{} of those
+func (c *redisConn) command(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+func (c *redisConn) reply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+
+	switch kind, rest := line[0], line[1:]; kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, fmt.Errorf("bad redis bulk length %q", rest)
+		}
+		if n < 0 {
+			return "", nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, fmt.Errorf("bad redis array length %q", rest)
+		}
+		items := make([]interface{}, 0, max(n, 0))
+		for i := 0; i < n; i++ {
+			item, err := c.reply()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply %q", line)
+}
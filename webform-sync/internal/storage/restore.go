@@ -0,0 +1,395 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// restoreTables hold the data a restore brings back. Credentials (users
+// and share links) are left as they are, so a restore can't bring back a
+// token or link revoked since the backup, and so are settings changed at
+// runtime (CORS origins and filter entries) and history (backup runs and
+// webhook deliveries).
+var restoreTables = []string{
+	"presets", "preset_blobs", "sync_log", "usage_events", "conflicts", "devices", "device_groups", "device_group_members", "disabled_domains",
+}
+
+// restoreStagingTable holds the presets of a backup staged for selective
+// recovery
+const restoreStagingTable = "restore_staging"
+
+// Staged preset statuses, compared with the database now
+const (
+	StagedMissing   = "missing"
+	StagedChanged   = "changed"
+	StagedUnchanged = "unchanged"
+)
+
+var (
+	// ErrInvalidBackup is returned for a file that isn't an intact backup
+	ErrInvalidBackup = errors.New("not a usable backup")
+	// ErrNothingStaged is returned when no backup has been staged
+	ErrNothingStaged = errors.New("no backup is staged")
+)
+
+// DeviceRestoreDiff compares a device's presets now with those in a backup
+type DeviceRestoreDiff struct {
+	DeviceID string `json:"deviceId"`
+	Name     string `json:"name,omitempty"`
+	// Current and Backup count the device's presets now and in the backup
+	Current int `json:"current"`
+	Backup  int `json:"backup"`
+	// Added are only in the backup, so restoring brings them back
+	Added int `json:"added"`
+	// Removed are only in the database now, so restoring loses them
+	Removed int `json:"removed"`
+	// Changed are in both, but were updated since the backup
+	Changed int `json:"changed"`
+}
+
+// RestorePreview is what restoring a backup would change, device by device
+type RestorePreview struct {
+	CurrentPresets int                 `json:"currentPresets"`
+	BackupPresets  int                 `json:"backupPresets"`
+	Devices        []DeviceRestoreDiff `json:"devices"`
+}
+
+// StagedPreset is a preset staged from a backup
+type StagedPreset struct {
+	ID         string    `json:"id"`
+	DeviceID   string    `json:"deviceId"`
+	Name       string    `json:"name"`
+	ScopeType  string    `json:"scopeType"`
+	ScopeValue string    `json:"scopeValue"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	// Status is missing if the preset is gone now, changed if it was
+	// updated since the backup, or unchanged
+	Status string `json:"status"`
+}
+
+// withBackup checks a backup, then attaches it read-only as "backup" to a
+// connection of its own for fn
+func (s *Storage) withBackup(ctx context.Context, path string, fn func(conn *sql.Conn) error) error {
+	if err := verifyBackup(ctx, path); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	uri := (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs), RawQuery: "mode=ro"}).String()
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS backup`, uri); err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `DETACH DATABASE backup`)
+	return fn(conn)
+}
+
+// PreviewRestore compares the presets in a backup with the database,
+// without changing anything
+func (s *Storage) PreviewRestore(ctx context.Context, path string) (*RestorePreview, error) {
+	preview := &RestorePreview{Devices: []DeviceRestoreDiff{}}
+	err := s.withBackup(ctx, path, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, `
+			WITH ids AS (
+				SELECT device_id FROM main.presets UNION SELECT device_id FROM backup.presets
+			)
+			SELECT ids.device_id,
+				COALESCE((SELECT name FROM main.devices WHERE id = ids.device_id),
+					(SELECT name FROM backup.devices WHERE id = ids.device_id), ''),
+				(SELECT COUNT(*) FROM main.presets c WHERE c.device_id = ids.device_id),
+				(SELECT COUNT(*) FROM backup.presets b WHERE b.device_id = ids.device_id),
+				(SELECT COUNT(*) FROM backup.presets b WHERE b.device_id = ids.device_id
+					AND NOT EXISTS (SELECT 1 FROM main.presets c WHERE c.id = b.id)),
+				(SELECT COUNT(*) FROM main.presets c WHERE c.device_id = ids.device_id
+					AND NOT EXISTS (SELECT 1 FROM backup.presets b WHERE b.id = c.id)),
+				(SELECT COUNT(*) FROM main.presets c JOIN backup.presets b ON b.id = c.id
+					WHERE c.device_id = ids.device_id AND c.updated_at != b.updated_at)
+			FROM ids
+			ORDER BY ids.device_id`)
+		if err != nil {
+			return fmt.Errorf("failed to compare backup: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var d DeviceRestoreDiff
+			if err := rows.Scan(&d.DeviceID, &d.Name, &d.Current, &d.Backup, &d.Added, &d.Removed, &d.Changed); err != nil {
+				return fmt.Errorf("failed to compare backup: %w", err)
+			}
+			preview.CurrentPresets += d.Current
+			preview.BackupPresets += d.Backup
+			preview.Devices = append(preview.Devices, d)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+// RestoreBackup replaces the data in the database with a backup's, in one
+// transaction. Columns the backup predates keep their defaults. It returns
+// the number of presets restored.
+func (s *Storage) RestoreBackup(ctx context.Context, path string) (int, error) {
+	s.awaitWrites()
+	s.flushSyncLog()
+	restored := 0
+	err := s.withBackup(ctx, path, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		// Devices revoked since the backup stay revoked
+		if _, err := tx.ExecContext(ctx, `CREATE TEMP TABLE restore_revoked AS SELECT * FROM main.devices WHERE revoked_at IS NOT NULL`); err != nil {
+			return fmt.Errorf("failed to keep revoked devices: %w", err)
+		}
+		defer conn.ExecContext(context.Background(), `DROP TABLE IF EXISTS temp.restore_revoked`)
+
+		for _, table := range restoreTables {
+			columns, err := sharedColumns(ctx, tx, "main", table, "backup", table)
+			if err != nil {
+				return err
+			}
+			if len(columns) == 0 {
+				// Not in the backup, so left as it is
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, `DELETE FROM main.`+table); err != nil {
+				return fmt.Errorf("failed to clear %s: %w", table, err)
+			}
+			cols := strings.Join(columns, ", ")
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO main.%s (%s) SELECT %s FROM backup.%s`, table, cols, cols, table)); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", table, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM main.devices WHERE id IN (SELECT id FROM temp.restore_revoked)`); err != nil {
+			return fmt.Errorf("failed to keep revoked devices: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO main.devices SELECT * FROM temp.restore_revoked`); err != nil {
+			return fmt.Errorf("failed to keep revoked devices: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, markUserShared); err != nil {
+			return fmt.Errorf("failed to mark user-shared presets: %w", err)
+		}
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM main.presets`).Scan(&restored); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.invalidateAll()
+	return restored, nil
+}
+
+// StageBackup copies the presets in a backup to a staging table, replacing
+// any staged before, so chosen ones can be recovered with RecoverStaged.
+// It returns the number of presets staged.
+func (s *Storage) StageBackup(ctx context.Context, path string) (int, error) {
+	staged := 0
+	err := s.withBackup(ctx, path, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.ExecContext(ctx, `DROP TABLE IF EXISTS main.`+restoreStagingTable); err != nil {
+			return fmt.Errorf("failed to clear staging: %w", err)
+		}
+		// A copy of the backup's own table definition keeps the column
+		// types, which CREATE TABLE ... AS SELECT would lose
+		var ddl string
+		if err := tx.QueryRowContext(ctx, `SELECT sql FROM backup.sqlite_master WHERE type = 'table' AND name = 'presets'`).Scan(&ddl); err != nil {
+			return fmt.Errorf("failed to read backup schema: %w", err)
+		}
+		_, columns, ok := strings.Cut(ddl, "presets")
+		if !ok {
+			return fmt.Errorf("unexpected presets table in backup: %s", ddl)
+		}
+		if _, err := tx.ExecContext(ctx, `CREATE TABLE main.`+restoreStagingTable+columns); err != nil {
+			return fmt.Errorf("failed to stage backup: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO main.`+restoreStagingTable+` SELECT * FROM backup.presets`); err != nil {
+			return fmt.Errorf("failed to stage backup: %w", err)
+		}
+		// Staged presets keep their fields inline, as the blobs they refer to
+		// are only in the backup
+		blobColumns, err := tableColumns(ctx, tx, "backup", "preset_blobs")
+		if err != nil {
+			return err
+		}
+		if len(blobColumns) > 0 {
+			if _, err := tx.ExecContext(ctx, `
+				UPDATE main.`+restoreStagingTable+`
+				SET encrypted_fields = COALESCE((SELECT data FROM backup.preset_blobs WHERE hash = fields_blob), ''), fields_blob = ''
+				WHERE fields_blob != ''`); err != nil {
+				return fmt.Errorf("failed to stage backup: %w", err)
+			}
+		}
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM main.`+restoreStagingTable).Scan(&staged); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return staged, err
+}
+
+// stagingExists reports whether a backup has been staged
+func (s *Storage) stagingExists(ctx context.Context) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, restoreStagingTable).Scan(&n)
+	return n > 0, err
+}
+
+// GetStagedPresets lists the staged presets, by device and name
+func (s *Storage) GetStagedPresets(ctx context.Context) ([]*StagedPreset, error) {
+	if ok, err := s.stagingExists(ctx); err != nil {
+		return nil, fmt.Errorf("failed to read staging: %w", err)
+	} else if !ok {
+		return nil, ErrNothingStaged
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT st.id, st.device_id, st.name, st.scope_type, st.scope_value, st.updated_at,
+			CASE
+				WHEN p.id IS NULL THEN ?
+				WHEN p.updated_at != st.updated_at THEN ?
+				ELSE ?
+			END
+		FROM `+restoreStagingTable+` st
+		LEFT JOIN presets p ON p.id = st.id
+		ORDER BY st.device_id, st.name`, StagedMissing, StagedChanged, StagedUnchanged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read staging: %w", err)
+	}
+	defer rows.Close()
+
+	staged := []*StagedPreset{}
+	for rows.Next() {
+		var p StagedPreset
+		if err := rows.Scan(&p.ID, &p.DeviceID, &p.Name, &p.ScopeType, &p.ScopeValue, &p.UpdatedAt, &p.Status); err != nil {
+			return nil, fmt.Errorf("failed to scan staged preset: %w", err)
+		}
+		staged = append(staged, &p)
+	}
+	return staged, rows.Err()
+}
+
+// RecoverStaged copies staged presets back into the database. A staged
+// preset replaces the preset with its ID, and any other preset with its
+// name and scope on the same device. It returns the number recovered.
+func (s *Storage) RecoverStaged(ctx context.Context, ids []string) (int, error) {
+	if ok, err := s.stagingExists(ctx); err != nil {
+		return 0, fmt.Errorf("failed to read staging: %w", err)
+	} else if !ok {
+		return 0, ErrNothingStaged
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	columns, err := sharedColumns(ctx, tx, "main", "presets", "main", restoreStagingTable)
+	if err != nil {
+		return 0, err
+	}
+
+	cols := strings.Join(columns, ", ")
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	result, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		INSERT OR REPLACE INTO presets (%s)
+		SELECT %s FROM %s WHERE id IN (%s)`, cols, cols, restoreStagingTable, placeholders), args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to recover presets: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, markUserShared); err != nil {
+		return 0, fmt.Errorf("failed to mark user-shared presets: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, releaseOrphanBlobs); err != nil {
+		return 0, fmt.Errorf("failed to release preset blobs: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.invalidateAll()
+	recovered, _ := result.RowsAffected()
+	return int(recovered), nil
+}
+
+// ClearStaging drops the staged presets
+func (s *Storage) ClearStaging(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `DROP TABLE IF EXISTS `+restoreStagingTable); err != nil {
+		return fmt.Errorf("failed to clear staging: %w", err)
+	}
+	return nil
+}
+
+// sharedColumns lists the columns two tables have in common, in the order
+// of the first. It is empty if either table doesn't exist.
+func sharedColumns(ctx context.Context, tx *sql.Tx, schemaA, tableA, schemaB, tableB string) ([]string, error) {
+	a, err := tableColumns(ctx, tx, schemaA, tableA)
+	if err != nil {
+		return nil, err
+	}
+	b, err := tableColumns(ctx, tx, schemaB, tableB)
+	if err != nil {
+		return nil, err
+	}
+	inB := make(map[string]bool, len(b))
+	for _, col := range b {
+		inB[col] = true
+	}
+	var shared []string
+	for _, col := range a {
+		if inB[col] {
+			shared = append(shared, col)
+		}
+	}
+	return shared, nil
+}
+
+func tableColumns(ctx context.Context, tx *sql.Tx, schema, table string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("PRAGMA %s.table_info(%s)", schema, table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect table %s.%s: %w", schema, table, err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
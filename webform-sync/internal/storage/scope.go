@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// OriginalScopeKey is the preset metadata key holding the scope value as the
+// client sent it, when normalizing changed it
+const OriginalScopeKey = "originalScopeValue"
+
+// trackingParams are query parameters dropped from URL scopes, since they
+// differ between visits to the same page. A trailing * matches a prefix.
+var trackingParams = []string{
+	"utm_*", "fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid",
+	"yclid", "mc_cid", "mc_eid", "_ga", "_gl", "igshid", "ref_src",
+}
+
+// defaultPorts are dropped from URL scopes with these schemes
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ws":    "80",
+	"wss":   "443",
+}
+
+// NormalizeScope returns the canonical form of a scope value, so that
+// "Example.com/" and "example.com" are the same scope. Hosts are
+// lowercased, without a trailing dot and with international names in
+// punycode; default ports and a bare "/" path are dropped, and so are
+// tracking parameters and an empty query in URL scopes. Values that don't
+// parse, and wildcard and regex scopes, are only trimmed.
+func NormalizeScope(scopeType, scopeValue string) string {
+	value := strings.TrimSpace(scopeValue)
+	if value == "" || (scopeType != ScopeTypeURL && scopeType != ScopeTypeDomain) {
+		return value
+	}
+
+	hasScheme := strings.Contains(value, "://")
+	raw := value
+	if !hasScheme {
+		raw = "http://" + value
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" {
+		return value
+	}
+
+	host := normalizeHost(u.Hostname())
+	port := u.Port()
+	if scopeType == ScopeTypeDomain {
+		// Domain scopes cover every scheme, and so both default ports
+		if port == "80" || port == "443" {
+			port = ""
+		}
+		return joinHost(host, port)
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+	u.Host = joinHost(host, port)
+	if u.Path == "/" {
+		u.Path, u.RawPath = "", ""
+	}
+	u.RawQuery = stripTrackingParams(u.RawQuery)
+	u.ForceQuery = false
+
+	normalized := u.String()
+	if !hasScheme {
+		normalized = strings.TrimPrefix(normalized, "http://")
+	}
+	return normalized
+}
+
+// normalizeHost lowercases a host name, drops a trailing dot and encodes
+// international labels in punycode
+func normalizeHost(host string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(host), "."), ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			labels[i] = "xn--" + punycode(label)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// joinHost adds a port to a host, bracketing IPv6 addresses
+func joinHost(host, port string) string {
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// stripTrackingParams drops tracking parameters from a raw query, keeping
+// the others in their original order and encoding
+func stripTrackingParams(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if param != "" && !isTrackingParam(strings.ToLower(name)) {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+func isTrackingParam(name string) bool {
+	for _, p := range trackingParams {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizePresetScope normalizes a preset's scope value, keeping the value
+// the client sent in metadata when it changes
+func normalizePresetScope(preset *Preset) {
+	normalized := NormalizeScope(preset.ScopeType, preset.ScopeValue)
+	if normalized == preset.ScopeValue {
+		return
+	}
+	if preset.Metadata == nil {
+		preset.Metadata = make(map[string]interface{})
+	}
+	preset.Metadata[OriginalScopeKey] = preset.ScopeValue
+	preset.ScopeValue = normalized
+}
+
+// normalizeScopes brings the scope values of presets saved before scopes
+// were normalized into canonical form. A preset whose normalized scope
+// clashes with another preset of the same name and device is left alone.
+func (s *Storage) normalizeScopes() error {
+	rows, err := s.db.Query(`SELECT id, scope_type, scope_value FROM presets WHERE scope_type IN (?, ?)`, ScopeTypeURL, ScopeTypeDomain)
+	if err != nil {
+		return fmt.Errorf("failed to read preset scopes: %w", err)
+	}
+	type change struct{ id, from, to string }
+	var changes []change
+	for rows.Next() {
+		var id, scopeType, scopeValue string
+		if err := rows.Scan(&id, &scopeType, &scopeValue); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read preset scopes: %w", err)
+		}
+		if normalized := NormalizeScope(scopeType, scopeValue); normalized != scopeValue {
+			changes = append(changes, change{id, scopeValue, normalized})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read preset scopes: %w", err)
+	}
+
+	normalized := 0
+	for _, c := range changes {
+		_, err := s.db.Exec(`
+			UPDATE presets
+			SET scope_value = ?, metadata = json_set(COALESCE(metadata, '{}'), '$.`+OriginalScopeKey+`', ?)
+			WHERE id = ?`, c.to, c.from, c.id)
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+				s.logger.Warn("Left scope %q of preset %s as it is: another preset of the same name already has scope %q", c.from, c.id, c.to)
+				continue
+			}
+			return fmt.Errorf("failed to normalize scope of preset %s: %w", c.id, err)
+		}
+		normalized++
+	}
+	if normalized > 0 {
+		s.logger.Info("Normalized the scopes of %d presets", normalized)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrScopePolicyNotFound is returned when a scope has no policy
+var ErrScopePolicyNotFound = errors.New("scope policy not found")
+
+// Autofill modes of a scope policy
+const (
+	AutofillAuto    = "auto"    // Fill the best preset as the page loads
+	AutofillSuggest = "suggest" // Offer presets, filling only when picked
+	AutofillOff     = "off"     // Don't fill or offer presets
+)
+
+// ScopePolicy is how clients should autofill pages of a scope. Policies
+// belong to the user of the device that set them, or to nobody for
+// unowned devices, so they follow a user across devices.
+type ScopePolicy struct {
+	ScopeType  string `json:"scopeType"`
+	ScopeValue string `json:"scopeValue"`
+	// Mode is auto, suggest or off
+	Mode string `json:"mode"`
+	// NeverStore are field name patterns, where * matches anything, that
+	// are dropped from presets saved in the scope
+	NeverStore []string `json:"neverStore"`
+	// RequireConfirmation asks clients to confirm before filling
+	RequireConfirmation bool   `json:"requireConfirmation"`
+	UserID              string `json:"userId,omitempty"`
+	// DeviceID is the device that set the policy last
+	DeviceID  string    `json:"deviceId"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// scopePolicyColumns is the column list shared by scope policy queries
+// (matches scanScopePolicy)
+const scopePolicyColumns = `scope_type, scope_value, mode, never_store, require_confirmation, user_id, device_id, updated_at`
+
+// SetScopePolicy stores the policy of a scope for the user of
+// policy.DeviceID, replacing any it had
+func (s *Storage) SetScopePolicy(ctx context.Context, policy *ScopePolicy) error {
+	policy.ScopeValue = NormalizeScope(policy.ScopeType, policy.ScopeValue)
+	if policy.NeverStore == nil {
+		policy.NeverStore = []string{}
+	}
+	neverStore, err := json.Marshal(policy.NeverStore)
+	if err != nil {
+		return fmt.Errorf("failed to marshal never store fields: %w", err)
+	}
+
+	err = s.db.QueryRowContext(ctx, `
+		INSERT INTO scope_policies (user_id, scope_type, scope_value, mode, never_store, require_confirmation, device_id, updated_at)
+		VALUES (`+deviceOwner+`, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, scope_type, scope_value) DO UPDATE SET
+			mode = excluded.mode, never_store = excluded.never_store,
+			require_confirmation = excluded.require_confirmation,
+			device_id = excluded.device_id, updated_at = excluded.updated_at
+		RETURNING `+scopePolicyColumns,
+		policy.DeviceID, policy.ScopeType, policy.ScopeValue, policy.Mode, string(neverStore),
+		policy.RequireConfirmation, policy.DeviceID, time.Now(),
+	).Scan(scopePolicyDest(policy)...)
+	if err != nil {
+		return fmt.Errorf("failed to save scope policy: %w", err)
+	}
+	s.logger.Debug("Set scope policy: %s %s %s (device: %s)", policy.ScopeType, policy.ScopeValue, policy.Mode, policy.DeviceID)
+	return nil
+}
+
+// GetScopePolicies returns the policies deviceID's user set for any of the
+// scopes. An empty deviceID returns those of unowned devices.
+func (s *Storage) GetScopePolicies(ctx context.Context, deviceID string, scopes []Scope) ([]*ScopePolicy, error) {
+	if len(scopes) == 0 {
+		return nil, nil
+	}
+	values := make([]string, 0, len(scopes))
+	var args []interface{}
+	for _, scope := range scopes {
+		values = append(values, "(?, ?)")
+		args = append(args, scope.Type, scope.Value)
+	}
+	args = append(args, deviceID)
+	return s.queryScopePolicies(ctx, `(scope_type, scope_value) IN (VALUES `+strings.Join(values, ", ")+`) AND user_id = `+deviceOwner, args...)
+}
+
+// ListScopePolicies returns the policies of deviceID's user, or of every
+// user for an empty deviceID
+func (s *Storage) ListScopePolicies(ctx context.Context, deviceID string) ([]*ScopePolicy, error) {
+	if deviceID == "" {
+		return s.queryScopePolicies(ctx, `1 = 1`)
+	}
+	return s.queryScopePolicies(ctx, `user_id = `+deviceOwner, deviceID)
+}
+
+// queryScopePolicies returns the policies matching where
+func (s *Storage) queryScopePolicies(ctx context.Context, where string, args ...interface{}) ([]*ScopePolicy, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+scopePolicyColumns+` FROM scope_policies
+		WHERE `+where+` ORDER BY scope_type, scope_value`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query scope policies: %w", err)
+	}
+	defer rows.Close()
+
+	policies := []*ScopePolicy{}
+	for rows.Next() {
+		policy, err := scanScopePolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
+
+// DeleteScopePolicy removes the policy deviceID's user set for a scope
+func (s *Storage) DeleteScopePolicy(ctx context.Context, deviceID string, scope Scope) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM scope_policies
+		WHERE scope_type = ? AND scope_value = ? AND user_id = `+deviceOwner,
+		scope.Type, NormalizeScope(scope.Type, scope.Value), deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to delete scope policy: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrScopePolicyNotFound
+	}
+	return nil
+}
+
+// scopePolicyDest returns the scan destinations for scopePolicyColumns
+func scopePolicyDest(policy *ScopePolicy) []interface{} {
+	return []interface{}{
+		&policy.ScopeType, &policy.ScopeValue, &policy.Mode, (*neverStoreJSON)(&policy.NeverStore),
+		&policy.RequireConfirmation, &policy.UserID, &policy.DeviceID, &policy.UpdatedAt,
+	}
+}
+
+// neverStoreJSON scans the never_store column of a policy
+type neverStoreJSON []string
+
+func (n *neverStoreJSON) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("unexpected never_store type %T", src)
+	}
+	*n = nil
+	if err := json.Unmarshal(data, (*[]string)(n)); err != nil {
+		return fmt.Errorf("failed to unmarshal never_store: %w", err)
+	}
+	if *n == nil {
+		*n = []string{}
+	}
+	return nil
+}
+
+// scanScopePolicy reads one policy row
+func scanScopePolicy(row interface{ Scan(...interface{}) error }) (*ScopePolicy, error) {
+	var policy ScopePolicy
+	if err := row.Scan(scopePolicyDest(&policy)...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrScopePolicyNotFound
+		}
+		return nil, fmt.Errorf("failed to scan scope policy: %w", err)
+	}
+	return &policy, nil
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ScopeSummary describes a distinct scope with saved presets
+type ScopeSummary struct {
+	ScopeType   string    `json:"scopeType"`
+	ScopeValue  string    `json:"scopeValue"`
+	PresetCount int       `json:"presetCount"`
+	LastUpdated time.Time `json:"lastUpdated"`
+}
+
+// GetScopes returns distinct scope type/value pairs with preset counts.
+// An empty deviceID returns scopes across all devices.
+func (s *Storage) GetScopes(ctx context.Context, deviceID string) ([]ScopeSummary, error) {
+	query := `
+	SELECT scope_type, scope_value, COUNT(*), MAX(updated_at)
+	FROM presets
+	`
+	var args []interface{}
+	if deviceID != "" {
+		query += `WHERE ` + visibleToDevice + `
+	`
+		args = append(args, deviceID, deviceID, deviceID)
+	}
+	query += `GROUP BY scope_type, scope_value
+	ORDER BY scope_type, scope_value`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query scopes: %w", err)
+	}
+	defer rows.Close()
+
+	scopes := []ScopeSummary{}
+	for rows.Next() {
+		var scope ScopeSummary
+		var lastUpdated string
+		if err := rows.Scan(&scope.ScopeType, &scope.ScopeValue, &scope.PresetCount, &lastUpdated); err != nil {
+			return nil, fmt.Errorf("failed to scan scope: %w", err)
+		}
+		scope.LastUpdated = parseSQLiteTime(lastUpdated)
+		scopes = append(scopes, scope)
+	}
+
+	return scopes, rows.Err()
+}
+
+// Scope identifies a scope by type and value
+type Scope struct {
+	Type  string
+	Value string
+}
+
+// GetPresetsInScopes returns the presets in any of scopes visible to a
+// device, most recently updated first. An empty deviceID returns presets of
+// all devices.
+func (s *Storage) GetPresetsInScopes(ctx context.Context, scopes []Scope, deviceID string) ([]*Preset, error) {
+	if len(scopes) == 0 {
+		return nil, nil
+	}
+	values := make([]string, 0, len(scopes))
+	var args []interface{}
+	for _, scope := range scopes {
+		values = append(values, "(?, ?)")
+		args = append(args, scope.Type, scope.Value)
+	}
+	return s.queryScopedPresets(ctx, `(scope_type, scope_value) IN (VALUES `+strings.Join(values, ", ")+`)`, args, deviceID)
+}
+
+// GetPresetsByScopeTypes returns the presets with any of the scope types
+// visible to a device, most recently updated first. An empty deviceID
+// returns presets of all devices.
+func (s *Storage) GetPresetsByScopeTypes(ctx context.Context, scopeTypes []string, deviceID string) ([]*Preset, error) {
+	if len(scopeTypes) == 0 {
+		return nil, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(scopeTypes)), ", ")
+	args := make([]interface{}, 0, len(scopeTypes))
+	for _, t := range scopeTypes {
+		args = append(args, t)
+	}
+	return s.queryScopedPresets(ctx, `scope_type IN (`+placeholders+`)`, args, deviceID)
+}
+
+// queryScopedPresets returns the presets matching where that are visible to
+// deviceID, most recently updated first
+func (s *Storage) queryScopedPresets(ctx context.Context, where string, args []interface{}, deviceID string) ([]*Preset, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	if deviceID != "" {
+		where += ` AND ` + visibleToDevice
+		args = append(args, deviceID, deviceID, deviceID)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT `+presetColumns+`
+	FROM presets
+	WHERE `+where+`
+	ORDER BY updated_at DESC
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query presets: %w", err)
+	}
+	defer rows.Close()
+
+	var presets []*Preset
+	for rows.Next() {
+		preset, err := s.scanPreset(rows)
+		if err != nil {
+			return nil, err
+		}
+		presets = append(presets, preset)
+	}
+
+	return presets, rows.Err()
+}
+
+// sqliteTimeFormats are the layouts go-sqlite3 uses when storing time.Time
+var sqliteTimeFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// parseSQLiteTime parses aggregate time values (MAX/MIN lose the column type)
+func parseSQLiteTime(value string) time.Time {
+	for _, layout := range sqliteTimeFormats {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrShareLinkNotFound is returned when a share link does not exist
+var ErrShareLinkNotFound = errors.New("share link not found")
+
+// ShareLink lets someone without server access fetch one preset until it
+// expires, optionally behind a password
+type ShareLink struct {
+	ID                string    `json:"id"`
+	PresetID          string    `json:"presetId"`
+	DeviceID          string    `json:"deviceId"`
+	PasswordProtected bool      `json:"passwordProtected"`
+	ExpiresAt         time.Time `json:"expiresAt"`
+	CreatedAt         time.Time `json:"createdAt"`
+
+	passwordHash string
+}
+
+// Expired reports whether the link can no longer be used
+func (l *ShareLink) Expired() bool {
+	return time.Now().After(l.ExpiresAt)
+}
+
+// CheckPassword reports whether password unlocks the link; links without a
+// password accept anything
+func (l *ShareLink) CheckPassword(password string) bool {
+	if l.passwordHash == "" {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(l.passwordHash), []byte(password)) == nil
+}
+
+// CreateShareLink records a link to a preset
+func (s *Storage) CreateShareLink(ctx context.Context, presetID, deviceID, password string, expiresAt time.Time) (*ShareLink, error) {
+	link := &ShareLink{
+		ID:                NewPresetID(),
+		PresetID:          presetID,
+		DeviceID:          deviceID,
+		PasswordProtected: password != "",
+		ExpiresAt:         expiresAt.UTC(),
+		CreatedAt:         time.Now().UTC(),
+	}
+
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash share link password: %w", err)
+		}
+		link.passwordHash = string(hash)
+	}
+
+	// Expired links are only ever rejected, so clear them out as we go
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM share_links WHERE expires_at < ?`, link.CreatedAt); err != nil {
+		return nil, fmt.Errorf("failed to purge expired share links: %w", err)
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO share_links (id, preset_id, device_id, password_hash, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		link.ID, link.PresetID, link.DeviceID, link.passwordHash, link.ExpiresAt, link.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create share link: %w", err)
+	}
+
+	s.logSync(presetID, "share_link", deviceID)
+	return link, nil
+}
+
+// GetShareLink returns a share link, expired or not
+func (s *Storage) GetShareLink(ctx context.Context, id string) (*ShareLink, error) {
+	var link ShareLink
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, preset_id, device_id, password_hash, expires_at, created_at
+		FROM share_links WHERE id = ?`, id).
+		Scan(&link.ID, &link.PresetID, &link.DeviceID, &link.passwordHash, &link.ExpiresAt, &link.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrShareLinkNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share link: %w", err)
+	}
+	link.PasswordProtected = link.passwordHash != ""
+	return &link, nil
+}
@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// PresetStats holds aggregate statistics about stored presets
+type PresetStats struct {
+	TotalPresets  int   `json:"totalPresets"`
+	TotalBytes    int64 `json:"totalBytes"`
+	DatabaseBytes int64 `json:"databaseBytes"`
+	// OffloadedPresets counts the presets whose fields are kept in the
+	// blobs table, being over storage.blob_threshold_bytes
+	OffloadedPresets int                  `json:"offloadedPresets"`
+	ByDevice         map[string]int       `json:"byDevice"`
+	ByScopeType      map[string]int       `json:"byScopeType"`
+	ByDomain         map[string]int       `json:"byDomain"`
+	MostUsed         []PresetUsageSummary `json:"mostUsed"`
+	UsageOverTime    []UsageBucket        `json:"usageOverTime"`
+	BucketSize       string               `json:"bucketSize"`
+	// PII counts the presets found to hold each kind of personal data
+	PII map[string]int `json:"pii"`
+}
+
+// PresetUsageSummary is a compact view of a frequently used preset
+type PresetUsageSummary struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	ScopeType  string `json:"scopeType"`
+	ScopeValue string `json:"scopeValue"`
+	DeviceID   string `json:"deviceId"`
+	UseCount   int    `json:"useCount"`
+}
+
+// UsageBucket counts presets last used within a time bucket
+type UsageBucket struct {
+	Bucket  string `json:"bucket"`
+	Presets int    `json:"presets"`
+}
+
+// statsBucketExpr maps a bucket size to the SQL expression deriving it from
+// a timestamp column, given as %[1]s
+var statsBucketExpr = map[string]string{
+	"day":   "substr(%[1]s, 1, 10)",
+	"week":  "strftime('%%Y-W%%W', substr(%[1]s, 1, 10))",
+	"month": "substr(%[1]s, 1, 7)",
+}
+
+// GetPresetStats computes aggregate statistics, optionally limited to one device
+func (s *Storage) GetPresetStats(ctx context.Context, deviceID, bucketSize string, topN int) (*PresetStats, error) {
+	bucketExpr, ok := statsBucketExpr[bucketSize]
+	if !ok {
+		return nil, fmt.Errorf("invalid bucket size: %s", bucketSize)
+	}
+	bucketExpr = fmt.Sprintf(bucketExpr, "last_used")
+
+	where := "1 = 1"
+	var args []interface{}
+	if deviceID != "" {
+		where = "device_id = ?"
+		args = append(args, deviceID)
+	}
+
+	stats := &PresetStats{
+		ByDevice:    make(map[string]int),
+		ByScopeType: make(map[string]int),
+		ByDomain:    make(map[string]int),
+		BucketSize:  bucketSize,
+		PII:         make(map[string]int),
+	}
+
+	// Totals
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(`+presetBytesExpr+`), 0), COUNT(NULLIF(fields_blob, ''))
+		FROM presets WHERE `+where, args...).Scan(&stats.TotalPresets, &stats.TotalBytes, &stats.OffloadedPresets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query preset totals: %w", err)
+	}
+
+	// Database file size
+	var pageCount, pageSize int64
+	if err := s.db.QueryRowContext(ctx, `PRAGMA page_count`).Scan(&pageCount); err == nil {
+		if err := s.db.QueryRowContext(ctx, `PRAGMA page_size`).Scan(&pageSize); err == nil {
+			stats.DatabaseBytes = pageCount * pageSize
+		}
+	}
+
+	if err := s.countInto(ctx, stats.ByDevice, `SELECT device_id, COUNT(*) FROM presets WHERE `+where+` GROUP BY device_id`, args...); err != nil {
+		return nil, err
+	}
+	if err := s.countInto(ctx, stats.ByScopeType, `SELECT scope_type, COUNT(*) FROM presets WHERE `+where+` GROUP BY scope_type`, args...); err != nil {
+		return nil, err
+	}
+	// Personal data, tagged in metadata.pii by kind when presets are saved
+	if err := s.countInto(ctx, stats.PII, `
+		SELECT pii.key, COUNT(*)
+		FROM presets, json_each(presets.metadata, '$.pii') AS pii
+		WHERE `+where+` GROUP BY pii.key`, args...); err != nil {
+		return nil, err
+	}
+
+	// Per domain: aggregate distinct scopes in SQL, fold into hosts here
+	rows, err := s.db.QueryContext(ctx, `SELECT scope_type, scope_value, COUNT(*) FROM presets WHERE `+where+` GROUP BY scope_type, scope_value`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query scope counts: %w", err)
+	}
+	for rows.Next() {
+		var scopeType, scopeValue string
+		var count int
+		if err := rows.Scan(&scopeType, &scopeValue, &count); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan scope counts: %w", err)
+		}
+		stats.ByDomain[ScopeDomain(scopeType, scopeValue)] += count
+	}
+	rows.Close()
+
+	// Most used presets
+	topArgs := append(append([]interface{}{}, args...), topN)
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT id, name, scope_type, scope_value, device_id, use_count
+		FROM presets WHERE `+where+` AND use_count > 0
+		ORDER BY use_count DESC, last_used DESC
+		LIMIT ?`, topArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query most used presets: %w", err)
+	}
+	for rows.Next() {
+		var p PresetUsageSummary
+		if err := rows.Scan(&p.ID, &p.Name, &p.ScopeType, &p.ScopeValue, &p.DeviceID, &p.UseCount); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan most used presets: %w", err)
+		}
+		stats.MostUsed = append(stats.MostUsed, p)
+	}
+	rows.Close()
+
+	// Usage over time, bucketed by last use
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT `+bucketExpr+` AS bucket, COUNT(*)
+		FROM presets WHERE `+where+` AND last_used IS NOT NULL
+		GROUP BY bucket
+		ORDER BY bucket`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage buckets: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b UsageBucket
+		if err := rows.Scan(&b.Bucket, &b.Presets); err != nil {
+			return nil, fmt.Errorf("failed to scan usage buckets: %w", err)
+		}
+		stats.UsageOverTime = append(stats.UsageOverTime, b)
+	}
+
+	return stats, rows.Err()
+}
+
+// UsageTotals are fleet-level counts for exporting as metrics. They hold
+// no names, scopes or field contents.
+type UsageTotals struct {
+	Presets     int
+	PresetBytes int64
+	// Uses sums every preset's use count
+	Uses           int64
+	ByScopeType    map[string]int
+	Devices        int
+	RevokedDevices int
+	Users          int
+	PII            map[string]int
+	DatabaseBytes  int64
+}
+
+// GetUsageTotals counts presets, uses, devices and users, and sizes the
+// database
+func (s *Storage) GetUsageTotals(ctx context.Context) (*UsageTotals, error) {
+	totals := &UsageTotals{ByScopeType: make(map[string]int), PII: make(map[string]int)}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(`+presetBytesExpr+`), 0), COALESCE(SUM(use_count), 0)
+		FROM presets`).Scan(&totals.Presets, &totals.PresetBytes, &totals.Uses)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query preset totals: %w", err)
+	}
+	err = s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COUNT(revoked_at), (SELECT COUNT(*) FROM users)
+		FROM devices`).Scan(&totals.Devices, &totals.RevokedDevices, &totals.Users)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device totals: %w", err)
+	}
+	if err := s.countInto(ctx, totals.ByScopeType, `SELECT scope_type, COUNT(*) FROM presets GROUP BY scope_type`); err != nil {
+		return nil, err
+	}
+	if err := s.countInto(ctx, totals.PII, `
+		SELECT pii.key, COUNT(*)
+		FROM presets, json_each(presets.metadata, '$.pii') AS pii
+		GROUP BY pii.key`); err != nil {
+		return nil, err
+	}
+	var pageCount, pageSize int64
+	if err := s.db.QueryRowContext(ctx, `PRAGMA page_count`).Scan(&pageCount); err != nil {
+		return nil, fmt.Errorf("failed to read page_count: %w", err)
+	}
+	if err := s.db.QueryRowContext(ctx, `PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return nil, fmt.Errorf("failed to read page_size: %w", err)
+	}
+	totals.DatabaseBytes = pageCount * pageSize
+	return totals, nil
+}
+
+// countInto runs a two-column (key, count) query into a map
+func (s *Storage) countInto(ctx context.Context, dest map[string]int, query string, args ...interface{}) error {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query counts: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			return fmt.Errorf("failed to scan counts: %w", err)
+		}
+		dest[key] = count
+	}
+
+	return rows.Err()
+}
+
+// ScopeDomain extracts the host a scope applies to
+func ScopeDomain(scopeType, scopeValue string) string {
+	value := strings.TrimSpace(scopeValue)
+	if value == "" {
+		return ""
+	}
+	if scopeType == "domain" {
+		return strings.ToLower(value)
+	}
+
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Hostname() == "" {
+		return strings.ToLower(scopeValue)
+	}
+	return strings.ToLower(u.Hostname())
+}
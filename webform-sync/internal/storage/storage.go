@@ -1,11 +1,14 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -13,11 +16,35 @@ import (
 	"github.com/tezza1971/webform-sync/internal/logger"
 )
 
+// ErrPresetNotFound is returned when a preset does not exist or belongs to another device
+var ErrPresetNotFound = errors.New("preset not found or access denied")
+
+// Scope types
+const (
+	ScopeTypeURL      = "url"
+	ScopeTypeDomain   = "domain"
+	ScopeTypeGlobal   = "global"   // Applies to every site
+	ScopeTypeWildcard = "wildcard" // A URL pattern where * matches anything
+	ScopeTypeRegex    = "regex"    // A regular expression matched against the URL
+	ScopeTypeStorage  = "storage"  // A chrome.storage.sync item, named by its key; matches no URL
+)
+
 // Storage handles all database operations
 type Storage struct {
-	db     *sql.DB
+	db     *guardedDB
 	cfg    config.StorageConfig
 	logger *logger.Logger
+
+	// cache is nil unless EnableCache was called
+	cache listCache
+	// onInvalidate is set by OnCacheInvalidated
+	onInvalidate func(CacheInvalidation)
+	// syncLog is nil unless EnableSyncLogBuffer was called
+	syncLog *syncLogWriter
+	// writeBehind is nil unless EnableWriteBehind was called
+	writeBehind *writeBehind
+	// compressor is nil with storage.compression off
+	compressor *fieldsEncoder
 }
 
 // Preset represents a saved form preset
@@ -35,8 +62,46 @@ type Preset struct {
 	UseCount        int                    `json:"useCount"`
 	DeviceID        string                 `json:"deviceId"` // camelCase for JavaScript/JSON standard
 	Metadata        map[string]interface{} `json:"metadata,omitempty"`
+	Version         int                    `json:"version"`                 // Incremented on every content change
+	StatVersion     int                    `json:"statVersion"`             // Incremented when only usage or metadata change, which other devices needn't sync
+	SharedGroupID   string                 `json:"sharedGroupId,omitempty"` // Device group that can also read this preset; set only via SharePreset
+	UserID          string                 `json:"userId,omitempty"`        // Owning user, taken from the device on save
+	Access          string                 `json:"access,omitempty"`        // Requesting device's role for this preset; filled in list responses, not stored
+	TypedFields     []TypedField           `json:"typedFields,omitempty"`   // For API input; folded into Fields and metadata.fieldTypes
+	BaseVersion     int                    `json:"baseVersion,omitempty"`   // For API input; the version an edit started from, to detect conflicts
+	StatsOnly       bool                   `json:"-"`                       // Set by saves that left the content as it was, so only StatVersion moved
+	Pending         bool                   `json:"pending,omitempty"`       // Set by saves queued for writing, with the version the preset will have
+
+	// generatedID is set while the ID is one storage generated and hasn't
+	// written yet
+	generatedID bool
+	// idAcknowledged is set once a generated ID has been returned to the
+	// client ahead of the write, so it can no longer be redrawn
+	idAcknowledged bool
+}
+
+// TypedField is a field with its declared type, for clients that send
+// values and types together
+type TypedField struct {
+	Name  string      `json:"name"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+	// Options are the choices of a select field
+	Options []string `json:"options,omitempty"`
 }
 
+// presetColumns is the column list shared by all preset queries (matches scanPreset)
+const presetColumns = `id, name, scope_type, scope_value, ` + presetFieldsExpr + `,
+		created_at, updated_at, last_used, use_count, device_id, metadata, version, stat_version, shared_group_id, user_id, fields_codec`
+
+// visibleToDevice matches presets a device can read: its own, user-shared
+// (device-less) ones belonging to the same user (or to no user, for unowned
+// devices), and those shared with a group it belongs to. Bind deviceID three
+// times. Each arm matches one of presetIndexes, see there for the plan.
+const visibleToDevice = `(device_id = ?
+		OR (user_shared = 1 AND user_id = COALESCE((SELECT user_id FROM devices WHERE id = ?), ''))
+		OR (shared_group_id != '' AND shared_group_id IN (SELECT group_id FROM device_group_members WHERE device_id = ?)))`
+
 // NewStorage creates a new storage instance
 func NewStorage(cfg config.StorageConfig, log *logger.Logger) (*Storage, error) {
 	// Ensure data directory exists
@@ -51,15 +116,32 @@ func NewStorage(cfg config.StorageConfig, log *logger.Logger) (*Storage, error)
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetimeMinutes > 0 {
+		db.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetimeMinutes) * time.Minute)
+	}
+
 	// Test connection
 	if err := db.Ping(); err != nil {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
+	compressor, err := newFieldsEncoder(cfg.Compression)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	storage := &Storage{
-		db:     db,
-		cfg:    cfg,
-		logger: log,
+		db:         newGuardedDB(db, cfg, log.Module("storage")),
+		cfg:        cfg,
+		logger:     log.Module("storage"),
+		compressor: compressor,
 	}
 
 	// Initialize schema
@@ -71,6 +153,16 @@ func NewStorage(cfg config.StorageConfig, log *logger.Logger) (*Storage, error)
 	return storage, nil
 }
 
+// queryContext derives the context for one storage call from the caller's,
+// applying the configured query timeout. Cancelling ctx (a client
+// disconnecting, say) interrupts the query.
+func (s *Storage) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.cfg.QueryTimeoutSeconds > 0 {
+		return context.WithTimeout(ctx, time.Duration(s.cfg.QueryTimeoutSeconds)*time.Second)
+	}
+	return context.WithCancel(ctx)
+}
+
 // initSchema creates database tables if they don't exist
 func (s *Storage) initSchema() error {
 	schema := `
@@ -86,13 +178,25 @@ func (s *Storage) initSchema() error {
 		use_count INTEGER DEFAULT 0,
 		device_id TEXT NOT NULL,
 		metadata TEXT,
+		version INTEGER NOT NULL DEFAULT 1,
+		stat_version INTEGER NOT NULL DEFAULT 0,
+		shared_group_id TEXT NOT NULL DEFAULT '',
+		user_id TEXT NOT NULL DEFAULT '',
+		user_shared BOOLEAN NOT NULL DEFAULT 0,
+		fields_blob TEXT NOT NULL DEFAULT '',
+		fields_codec TEXT NOT NULL DEFAULT '',
 		UNIQUE(scope_type, scope_value, name, device_id)
 	);
 
-	CREATE INDEX IF NOT EXISTS idx_presets_scope ON presets(scope_type, scope_value);
-	CREATE INDEX IF NOT EXISTS idx_presets_device ON presets(device_id);
 	CREATE INDEX IF NOT EXISTS idx_presets_last_used ON presets(last_used);
 
+	CREATE TABLE IF NOT EXISTS preset_blobs (
+		hash TEXT PRIMARY KEY,
+		data TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+
 	CREATE TABLE IF NOT EXISTS disabled_domains (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		domain TEXT NOT NULL,
@@ -115,27 +219,386 @@ func (s *Storage) initSchema() error {
 
 	CREATE INDEX IF NOT EXISTS idx_sync_log_preset ON sync_log(preset_id);
 	CREATE INDEX IF NOT EXISTS idx_sync_log_timestamp ON sync_log(timestamp);
+
+	CREATE TABLE IF NOT EXISTS devices (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL DEFAULT '',
+		platform TEXT NOT NULL DEFAULT '',
+		browser TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		last_seen DATETIME NOT NULL,
+		token_fingerprint TEXT NOT NULL DEFAULT '',
+		revoked_at DATETIME,
+		user_id TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE TABLE IF NOT EXISTS users (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS share_links (
+		id TEXT PRIMARY KEY,
+		preset_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		password_hash TEXT NOT NULL DEFAULT '',
+		expires_at DATETIME NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id TEXT PRIMARY KEY,
+		webhook TEXT NOT NULL,
+		event TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		attempts INTEGER NOT NULL,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		success BOOLEAN NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		completed_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_created ON webhook_deliveries(created_at);
+
+	CREATE TABLE IF NOT EXISTS device_groups (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS device_group_members (
+		group_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		added_at DATETIME NOT NULL,
+		role TEXT NOT NULL DEFAULT 'editor',
+		PRIMARY KEY(group_id, device_id),
+		FOREIGN KEY(group_id) REFERENCES device_groups(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_device_group_members_device ON device_group_members(device_id);
+
+	CREATE TABLE IF NOT EXISTS cors_origins (
+		id TEXT PRIMARY KEY,
+		origin TEXT NOT NULL UNIQUE,
+		methods TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS filter_entries (
+		id TEXT PRIMARY KEY,
+		type TEXT NOT NULL,
+		list TEXT NOT NULL,
+		pattern TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		UNIQUE(type, list, pattern)
+	);
+
+	CREATE TABLE IF NOT EXISTS backup_runs (
+		id TEXT PRIMARY KEY,
+		file TEXT NOT NULL,
+		started_at DATETIME NOT NULL,
+		finished_at DATETIME NOT NULL,
+		bytes INTEGER NOT NULL DEFAULT 0,
+		sha256 TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		remotes TEXT NOT NULL DEFAULT '[]'
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_backup_runs_started ON backup_runs(started_at);
+
+	CREATE TABLE IF NOT EXISTS maintenance_runs (
+		id TEXT PRIMARY KEY,
+		started_at DATETIME NOT NULL,
+		finished_at DATETIME NOT NULL,
+		presets_deleted INTEGER NOT NULL DEFAULT 0,
+		sync_log_pruned INTEGER NOT NULL DEFAULT 0,
+		tombstones_expired INTEGER NOT NULL DEFAULT 0,
+		usage_events_pruned INTEGER NOT NULL DEFAULT 0,
+		compacted BOOLEAN NOT NULL DEFAULT 0,
+		freed_bytes INTEGER NOT NULL DEFAULT 0,
+		optimized BOOLEAN NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_maintenance_runs_started ON maintenance_runs(started_at);
+
+	CREATE TABLE IF NOT EXISTS form_schemas (
+		id TEXT PRIMARY KEY,
+		scope_type TEXT NOT NULL,
+		scope_value TEXT NOT NULL,
+		form TEXT NOT NULL DEFAULT '',
+		fields TEXT NOT NULL DEFAULT '[]',
+		device_id TEXT NOT NULL,
+		user_id TEXT NOT NULL DEFAULT '',
+		version INTEGER NOT NULL DEFAULT 1,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		UNIQUE(user_id, scope_type, scope_value, form)
+	);
+
+	CREATE TABLE IF NOT EXISTS fill_failures (
+		user_id TEXT NOT NULL,
+		scope_type TEXT NOT NULL,
+		scope_value TEXT NOT NULL,
+		selector TEXT NOT NULL,
+		count INTEGER NOT NULL DEFAULT 1,
+		device_id TEXT NOT NULL,
+		first_seen DATETIME NOT NULL,
+		last_seen DATETIME NOT NULL,
+		PRIMARY KEY(user_id, scope_type, scope_value, selector)
+	);
+
+	CREATE TABLE IF NOT EXISTS scope_policies (
+		user_id TEXT NOT NULL,
+		scope_type TEXT NOT NULL,
+		scope_value TEXT NOT NULL,
+		mode TEXT NOT NULL,
+		never_store TEXT NOT NULL DEFAULT '[]',
+		require_confirmation BOOLEAN NOT NULL DEFAULT 0,
+		device_id TEXT NOT NULL,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY(user_id, scope_type, scope_value)
+	);
+
+	CREATE TABLE IF NOT EXISTS usage_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		preset_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		domain TEXT NOT NULL DEFAULT '',
+		used_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_usage_events_preset ON usage_events(preset_id, used_at);
+	CREATE INDEX IF NOT EXISTS idx_usage_events_used_at ON usage_events(used_at);
+
+	CREATE TABLE IF NOT EXISTS conflicts (
+		id TEXT PRIMARY KEY,
+		preset_id TEXT NOT NULL,
+		owner_device_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		base_version INTEGER NOT NULL,
+		current_version INTEGER NOT NULL,
+		copy TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		resolved_at DATETIME,
+		resolution TEXT NOT NULL DEFAULT '',
+		resolved_by TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_conflicts_preset ON conflicts(preset_id);
+	CREATE INDEX IF NOT EXISTS idx_conflicts_device ON conflicts(device_id);
+	CREATE INDEX IF NOT EXISTS idx_conflicts_owner ON conflicts(owner_device_id);
+
+	CREATE TABLE IF NOT EXISTS leases (
+		name TEXT PRIMARY KEY,
+		holder TEXT NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
 	`
 
-	_, err := s.db.Exec(schema)
-	return err
+	if _, err := s.db.Exec(schema); err != nil {
+		return err
+	}
+
+	if err := s.migrateSchema(); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(presetIndexes); err != nil {
+		return fmt.Errorf("failed to create preset indexes: %w", err)
+	}
+
+	if _, err := s.db.Exec(blobSchema); err != nil {
+		return fmt.Errorf("failed to create blob triggers: %w", err)
+	}
+
+	if _, err := s.db.Exec(markUserShared); err != nil {
+		return fmt.Errorf("failed to mark user-shared presets: %w", err)
+	}
+
+	if err := s.backfillDevices(); err != nil {
+		return err
+	}
+
+	return s.normalizeScopes()
+}
+
+// columnMigrations lists columns added after the initial schema, applied to
+// databases created by older versions
+var columnMigrations = []struct {
+	table  string
+	column string
+	ddl    string
+}{
+	{"presets", "version", "ALTER TABLE presets ADD COLUMN version INTEGER NOT NULL DEFAULT 1"},
+	{"presets", "shared_group_id", "ALTER TABLE presets ADD COLUMN shared_group_id TEXT NOT NULL DEFAULT ''"},
+	{"presets", "user_id", "ALTER TABLE presets ADD COLUMN user_id TEXT NOT NULL DEFAULT ''"},
+	{"presets", "stat_version", "ALTER TABLE presets ADD COLUMN stat_version INTEGER NOT NULL DEFAULT 0"},
+	{"presets", "user_shared", "ALTER TABLE presets ADD COLUMN user_shared BOOLEAN NOT NULL DEFAULT 0"},
+	{"presets", "fields_blob", "ALTER TABLE presets ADD COLUMN fields_blob TEXT NOT NULL DEFAULT ''"},
+	{"presets", "fields_codec", "ALTER TABLE presets ADD COLUMN fields_codec TEXT NOT NULL DEFAULT ''"},
+	{"devices", "user_id", "ALTER TABLE devices ADD COLUMN user_id TEXT NOT NULL DEFAULT ''"},
+	{"device_group_members", "role", "ALTER TABLE device_group_members ADD COLUMN role TEXT NOT NULL DEFAULT 'editor'"},
+	{"backup_runs", "remotes", "ALTER TABLE backup_runs ADD COLUMN remotes TEXT NOT NULL DEFAULT '[]'"},
+	{"backup_runs", "sha256", "ALTER TABLE backup_runs ADD COLUMN sha256 TEXT NOT NULL DEFAULT ''"},
+	{"maintenance_runs", "compacted", "ALTER TABLE maintenance_runs ADD COLUMN compacted BOOLEAN NOT NULL DEFAULT 0"},
+	{"maintenance_runs", "freed_bytes", "ALTER TABLE maintenance_runs ADD COLUMN freed_bytes INTEGER NOT NULL DEFAULT 0"},
+	{"maintenance_runs", "usage_events_pruned", "ALTER TABLE maintenance_runs ADD COLUMN usage_events_pruned INTEGER NOT NULL DEFAULT 0"},
+}
+
+// presetIndexes backs the preset list queries, created once migrateSchema
+// has added the columns they cover. Every list filters with visibleToDevice
+// and sorts by updated_at, so each arm of it has an index ending in
+// updated_at, and SQLite answers the filter from the three of them rather
+// than scanning the table. EXPLAIN QUERY PLAN for GetPresetsPage and
+// GetAllPresets (20,000 presets over 100 devices, after ANALYZE):
+//
+//	MULTI-INDEX OR
+//	|--INDEX 1
+//	|  `--SEARCH presets USING INDEX idx_presets_device_updated (device_id=?)
+//	|--INDEX 2
+//	|  |--SCALAR SUBQUERY 1
+//	|  |  `--SEARCH devices USING INDEX sqlite_autoindex_devices_1 (id=?)
+//	|  `--SEARCH presets USING INDEX idx_presets_user_shared (user_id=?)
+//	`--INDEX 3
+//	   |--LIST SUBQUERY 2
+//	   |  |--SEARCH device_group_members USING INDEX idx_device_group_members_device (device_id=?)
+//	   |  `--CREATE BLOOM FILTER
+//	   `--SEARCH presets USING INDEX idx_presets_group_updated (shared_group_id=?)
+//	USE TEMP B-TREE FOR ORDER BY
+//
+// The sort is over the device's presets only, where it was over a scan of
+// every preset before: a page of 50 with its count went from 6.5ms to 0.4ms
+// on that data. The COUNT of GetPresetsPage needs only the rowids,
+// so the indexes cover it. GetPresetsByScope searches
+// idx_presets_scope_updated (scope_type=? AND scope_value=?) and reads it
+// in updated_at order, so it sorts nothing.
+const presetIndexes = `
+	DROP INDEX IF EXISTS idx_presets_scope;
+	DROP INDEX IF EXISTS idx_presets_device;
+	CREATE INDEX IF NOT EXISTS idx_presets_scope_updated ON presets(scope_type, scope_value, updated_at);
+	CREATE INDEX IF NOT EXISTS idx_presets_device_updated ON presets(device_id, updated_at);
+	CREATE INDEX IF NOT EXISTS idx_presets_user_shared ON presets(user_id, updated_at) WHERE user_shared = 1;
+	CREATE INDEX IF NOT EXISTS idx_presets_group_updated ON presets(shared_group_id, updated_at) WHERE shared_group_id != '';
+`
+
+// markUserShared sets the user_shared flag on device-less presets written
+// without it: those from before the column, or restored from a backup that
+// predates it
+const markUserShared = `UPDATE presets SET user_shared = 1 WHERE device_id = '' AND user_shared = 0`
+
+// migrateSchema adds any missing columns to existing tables
+func (s *Storage) migrateSchema() error {
+	for _, m := range columnMigrations {
+		exists, err := s.columnExists(m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := s.db.Exec(m.ddl); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", m.table, m.column, err)
+		}
+		s.logger.Info("Migrated schema: added %s.%s", m.table, m.column)
+	}
+
+	return nil
+}
+
+// columnExists checks whether a table has the given column
+func (s *Storage) columnExists(table, column string) (bool, error) {
+	rows, err := s.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
 }
 
 // SavePreset saves or updates a preset
-func (s *Storage) SavePreset(preset *Preset) error {
+func (s *Storage) SavePreset(ctx context.Context, preset *Preset) error {
+	metadataJSON, err := prepareSave(preset)
+	if err != nil {
+		return err
+	}
+
+	if s.writeBehind != nil {
+		return s.queueSave(ctx, preset, metadataJSON)
+	}
+
+	// Quota check and write share a transaction so concurrent saves from one
+	// device can't both slip under the limit
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin save: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.upsertPreset(ctx, tx, preset, metadataJSON); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to save preset: %w", err)
+	}
+	s.presetSaved(preset)
+	return nil
+}
+
+// SavePresets saves many presets, as SavePreset would, and returns each
+// one's outcome. Behind a write-behind queue they are queued together and
+// waited for once, instead of each save waiting for its batch in turn.
+func (s *Storage) SavePresets(ctx context.Context, presets []*Preset) []error {
+	errs := make([]error, len(presets))
+	if s.writeBehind == nil {
+		for i, preset := range presets {
+			errs[i] = s.SavePreset(ctx, preset)
+		}
+		return errs
+	}
+
+	metadata := make([][]byte, len(presets))
+	for i, preset := range presets {
+		metadata[i], errs[i] = prepareSave(preset)
+	}
+	s.savePresetsBehind(ctx, presets, metadata, errs)
+	return errs
+}
+
+// prepareSave readies a preset for writing: its fields encoded, an ID
+// assigned and its scope normalized. It returns its metadata as JSON.
+func prepareSave(preset *Preset) ([]byte, error) {
 	// Convert Fields map to EncryptedFields JSON string if present
 	if preset.Fields != nil && preset.EncryptedFields == "" {
 		fieldsJSON, err := json.Marshal(preset.Fields)
 		if err != nil {
-			return fmt.Errorf("failed to marshal fields: %w", err)
+			return nil, fmt.Errorf("failed to marshal fields: %w", err)
 		}
 		preset.EncryptedFields = string(fieldsJSON)
 	}
 
 	// Generate ID if not present
-	if preset.ID == "" {
-		preset.ID = fmt.Sprintf("preset_%d", time.Now().UnixNano())
-	}
+	preset.assignID()
+
+	normalizePresetScope(preset)
 
 	// Serialize metadata
 	var metadataJSON []byte
@@ -143,59 +606,225 @@ func (s *Storage) SavePreset(preset *Preset) error {
 		var err error
 		metadataJSON, err = json.Marshal(preset.Metadata)
 		if err != nil {
-			return fmt.Errorf("failed to marshal metadata: %w", err)
+			return nil, fmt.Errorf("failed to marshal metadata: %w", err)
 		}
 	}
+	return metadataJSON, nil
+}
 
+// upsertPreset writes a preset within tx, after checking its quota
+func (s *Storage) upsertPreset(ctx context.Context, tx *sql.Tx, preset *Preset, metadataJSON []byte) error {
 	query := `
-	INSERT INTO presets (id, name, scope_type, scope_value, encrypted_fields, 
-		created_at, updated_at, last_used, use_count, device_id, metadata)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	INSERT INTO presets (id, name, scope_type, scope_value, encrypted_fields, fields_blob, fields_codec,
+		created_at, updated_at, last_used, use_count, device_id, metadata, user_id, user_shared)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, COALESCE((SELECT user_id FROM devices WHERE id = ?), ''), ?)
 	ON CONFLICT(id) DO UPDATE SET
 		name = excluded.name,
 		encrypted_fields = excluded.encrypted_fields,
-		updated_at = excluded.updated_at,
+		fields_blob = excluded.fields_blob,
+		fields_codec = excluded.fields_codec,
+		updated_at = CASE WHEN ? THEN presets.updated_at ELSE excluded.updated_at END,
 		last_used = excluded.last_used,
 		use_count = excluded.use_count,
-		metadata = excluded.metadata
+		metadata = excluded.metadata,
+		version = presets.version + CASE WHEN ? THEN 0 ELSE 1 END,
+		stat_version = presets.stat_version + CASE WHEN ? THEN 1 ELSE 0 END
+	WHERE NOT ?
+	RETURNING version, stat_version, updated_at, shared_group_id, user_id
 	`
 
-	_, err := s.db.Exec(query,
-		preset.ID,
-		preset.Name,
-		preset.ScopeType,
-		preset.ScopeValue,
-		preset.EncryptedFields,
-		preset.CreatedAt,
-		preset.UpdatedAt,
-		preset.LastUsed,
-		preset.UseCount,
-		preset.DeviceID,
-		metadataJSON,
-	)
+	fields, codec := s.compressFields(preset.EncryptedFields)
+	if err := s.checkQuota(ctx, tx, preset, int64(len(fields)+len(metadataJSON))); err != nil {
+		return err
+	}
+	var err error
+	if preset.StatsOnly, _, err = statsOnly(ctx, tx, preset); err != nil {
+		return err
+	}
+	fields, blob, err := s.offloadFields(ctx, tx, fields, codec)
+	if err != nil {
+		return err
+	}
 
+	err = withFreshID(preset, s.logger, func() error {
+		return tx.QueryRowContext(ctx, query,
+			preset.ID,
+			preset.Name,
+			preset.ScopeType,
+			preset.ScopeValue,
+			fieldsArg(fields, codec),
+			blob,
+			codec,
+			preset.CreatedAt,
+			preset.UpdatedAt,
+			preset.LastUsed,
+			preset.UseCount,
+			preset.DeviceID,
+			metadataJSON,
+			preset.DeviceID,
+			preset.DeviceID == "",
+			preset.StatsOnly, preset.StatsOnly, preset.StatsOnly,
+			preset.generatedID,
+		).Scan(&preset.Version, &preset.StatVersion, &preset.UpdatedAt, &preset.SharedGroupID, &preset.UserID)
+	})
 	if err != nil {
 		return fmt.Errorf("failed to save preset: %w", err)
 	}
+	return nil
+}
+
+// presetSaved follows up a committed save
+func (s *Storage) presetSaved(preset *Preset) {
+	s.invalidatePreset(preset.DeviceID, preset.SharedGroupID, preset.ScopeType, preset.ScopeValue)
 
 	// Log sync action
-	s.logSync(preset.ID, "save", preset.DeviceID)
+	s.logSync(preset.ID, saveAction(preset), preset.DeviceID)
 	s.logger.Debug("Saved preset: %s (device: %s)", preset.ID, preset.DeviceID)
+}
 
-	return nil
+// rowQuerier is a *sql.DB or *sql.Tx
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
-// GetPresetsByScope retrieves all presets for a given scope
-func (s *Storage) GetPresetsByScope(scopeType, scopeValue string, deviceID string) ([]*Preset, error) {
+// statsOnly reports whether a save of an existing preset leaves its name,
+// scope and fields as they are, changing at most its metadata or usage.
+// Such saves move the stat version rather than the version, so other
+// devices don't sync the preset again. It also returns the preset's
+// version, or 0 if it is new.
+func statsOnly(ctx context.Context, q rowQuerier, preset *Preset) (bool, int, error) {
+	var name, scopeType, scopeValue, fields, codec string
+	var version int
+	err := q.QueryRowContext(ctx, `SELECT name, scope_type, scope_value, `+presetFieldsExpr+`, fields_codec, version FROM presets WHERE id = ?`,
+		preset.ID).Scan(&name, &scopeType, &scopeValue, &fields, &codec, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to look up preset: %w", err)
+	}
+	if fields, err = decompressFields(fields, codec); err != nil {
+		return false, 0, err
+	}
+	return name == preset.Name && scopeType == preset.ScopeType && scopeValue == preset.ScopeValue &&
+		fields == preset.EncryptedFields, version, nil
+}
+
+// saveAction is the sync log action of a save
+func saveAction(preset *Preset) string {
+	if preset.StatsOnly {
+		return "metadata"
+	}
+	return "save"
+}
+
+// GetPresetOwner returns the device that owns a preset ID, if it exists
+func (s *Storage) GetPresetOwner(ctx context.Context, id string) (string, bool, error) {
+	s.awaitWrites()
+	var deviceID string
+	err := s.db.QueryRowContext(ctx, `SELECT device_id FROM presets WHERE id = ?`, id).Scan(&deviceID)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to look up preset owner: %w", err)
+	}
+
+	return deviceID, true, nil
+}
+
+// GetPreset retrieves a single preset by ID
+func (s *Storage) GetPreset(ctx context.Context, id string) (*Preset, error) {
+	s.awaitWrites()
+	row := s.db.QueryRowContext(ctx, `SELECT `+presetColumns+` FROM presets WHERE id = ?`, id)
+	preset, err := s.scanPreset(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPresetNotFound
+	}
+	return preset, err
+}
+
+// GetPresetsByIDs retrieves the presets among ids that are visible to
+// deviceID. Unknown and invisible IDs are left out.
+func (s *Storage) GetPresetsByIDs(ctx context.Context, ids []string, deviceID string) ([]*Preset, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	s.awaitWrites()
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	return s.queryScopedPresets(ctx, `id IN (`+placeholders+`)`, args, deviceID)
+}
+
+// GetPresetsPage retrieves one page of a device's presets and the total count
+func (s *Storage) GetPresetsPage(ctx context.Context, deviceID string, limit, offset int) ([]*Preset, int, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	var total int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM presets WHERE `+visibleToDevice, deviceID, deviceID, deviceID).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count presets: %w", err)
+	}
+
 	query := `
-	SELECT id, name, scope_type, scope_value, encrypted_fields,
-		created_at, updated_at, last_used, use_count, device_id, metadata
+	SELECT ` + presetColumns + `
 	FROM presets
-	WHERE scope_type = ? AND scope_value = ?
+	WHERE ` + visibleToDevice + `
 	ORDER BY updated_at DESC
+	LIMIT ? OFFSET ?
 	`
 
-	rows, err := s.db.Query(query, scopeType, scopeValue)
+	rows, err := s.db.QueryContext(ctx, query, deviceID, deviceID, deviceID, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query presets: %w", err)
+	}
+	defer rows.Close()
+
+	presets := []*Preset{}
+	for rows.Next() {
+		preset, err := s.scanPreset(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		presets = append(presets, preset)
+	}
+
+	return presets, total, rows.Err()
+}
+
+// GetPresetsByScope retrieves the presets for a given scope, only those
+// visible to deviceID when it is non-empty
+func (s *Storage) GetPresetsByScope(ctx context.Context, scopeType, scopeValue string, deviceID string) ([]*Preset, error) {
+	scopeValue = NormalizeScope(scopeType, scopeValue)
+	key := "scope\x00" + scopeType + "\x00" + scopeValue + "\x00" + deviceID
+	return s.cachedPresets(key, deviceID, func() ([]*Preset, error) {
+		return s.queryPresetsByScope(ctx, scopeType, scopeValue, deviceID)
+	})
+}
+
+func (s *Storage) queryPresetsByScope(ctx context.Context, scopeType, scopeValue string, deviceID string) ([]*Preset, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	where := `scope_type = ? AND scope_value = ?`
+	args := []interface{}{scopeType, scopeValue}
+	if deviceID != "" {
+		where += ` AND ` + visibleToDevice
+		args = append(args, deviceID, deviceID, deviceID)
+	}
+
+	query := `
+	SELECT ` + presetColumns + `
+	FROM presets
+	WHERE ` + where + `
+	ORDER BY updated_at DESC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query presets: %w", err)
 	}
@@ -210,20 +839,29 @@ func (s *Storage) GetPresetsByScope(scopeType, scopeValue string, deviceID strin
 		presets = append(presets, preset)
 	}
 
-	return presets, nil
+	return presets, rows.Err()
 }
 
-// GetAllPresets retrieves all presets for a device
-func (s *Storage) GetAllPresets(deviceID string) ([]*Preset, error) {
+// GetAllPresets retrieves all presets visible to a device, including those
+// shared with its groups
+func (s *Storage) GetAllPresets(ctx context.Context, deviceID string) ([]*Preset, error) {
+	return s.cachedPresets("all\x00"+deviceID, deviceID, func() ([]*Preset, error) {
+		return s.queryAllPresets(ctx, deviceID)
+	})
+}
+
+func (s *Storage) queryAllPresets(ctx context.Context, deviceID string) ([]*Preset, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
 	query := `
-	SELECT id, name, scope_type, scope_value, encrypted_fields,
-		created_at, updated_at, last_used, use_count, device_id, metadata
+	SELECT ` + presetColumns + `
 	FROM presets
-	WHERE device_id = ? OR device_id = ''
+	WHERE ` + visibleToDevice + `
 	ORDER BY updated_at DESC
 	`
 
-	rows, err := s.db.Query(query, deviceID)
+	rows, err := s.db.QueryContext(ctx, query, deviceID, deviceID, deviceID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query presets: %w", err)
 	}
@@ -238,21 +876,48 @@ func (s *Storage) GetAllPresets(deviceID string) ([]*Preset, error) {
 		presets = append(presets, preset)
 	}
 
-	return presets, nil
+	return presets, rows.Err()
 }
 
-// DeletePreset deletes a preset by ID
-func (s *Storage) DeletePreset(id, deviceID string) error {
-	query := `DELETE FROM presets WHERE id = ? AND device_id = ?`
-	result, err := s.db.Exec(query, id, deviceID)
+// GetDevicePresets returns the presets a device owns, leaving out those it
+// sees through its groups or user, by scope and name
+func (s *Storage) GetDevicePresets(ctx context.Context, deviceID string) ([]*Preset, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+presetColumns+`
+		FROM presets WHERE device_id = ?
+		ORDER BY scope_type, scope_value, name`, deviceID)
 	if err != nil {
-		return fmt.Errorf("failed to delete preset: %w", err)
+		return nil, fmt.Errorf("failed to query presets: %w", err)
 	}
+	defer rows.Close()
 
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		return fmt.Errorf("preset not found or access denied")
+	var presets []*Preset
+	for rows.Next() {
+		preset, err := s.scanPreset(rows)
+		if err != nil {
+			return nil, err
+		}
+		presets = append(presets, preset)
+	}
+	return presets, rows.Err()
+}
+
+// DeletePreset deletes a preset by ID
+func (s *Storage) DeletePreset(ctx context.Context, id, deviceID string) error {
+	s.awaitWrites()
+	query := `DELETE FROM presets WHERE id = ? AND device_id = ? RETURNING shared_group_id, scope_type, scope_value`
+	var sharedGroupID, scopeType, scopeValue string
+	err := s.db.QueryRowContext(ctx, query, id, deviceID).Scan(&sharedGroupID, &scopeType, &scopeValue)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrPresetNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete preset: %w", err)
 	}
+	s.invalidatePreset(deviceID, sharedGroupID, scopeType, scopeValue)
 
 	s.logSync(id, "delete", deviceID)
 	s.logger.Debug("Deleted preset: %s (device: %s)", id, deviceID)
@@ -260,44 +925,47 @@ func (s *Storage) DeletePreset(id, deviceID string) error {
 	return nil
 }
 
-// UpdatePresetUsage updates last_used timestamp and use_count
-func (s *Storage) UpdatePresetUsage(id string) error {
+// UpdatePresetUsage updates last_used timestamp and use_count, and records
+// the use as a usage event
+func (s *Storage) UpdatePresetUsage(ctx context.Context, id string) error {
+	s.awaitWrites()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin usage update: %w", err)
+	}
+	defer tx.Rollback()
+
 	query := `
 	UPDATE presets 
-	SET last_used = ?, use_count = use_count + 1
+	SET last_used = ?, use_count = use_count + 1, stat_version = stat_version + 1
 	WHERE id = ?
+	RETURNING device_id, shared_group_id, scope_type, scope_value
 	`
 
-	_, err := s.db.Exec(query, time.Now(), id)
+	now := time.Now()
+	var deviceID, sharedGroupID, scopeType, scopeValue string
+	err = tx.QueryRowContext(ctx, query, now, id).Scan(&deviceID, &sharedGroupID, &scopeType, &scopeValue)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("failed to update preset usage: %w", err)
 	}
-
-	return nil
-}
-
-// CleanupOldPresets removes presets not accessed in specified days
-func (s *Storage) CleanupOldPresets(days int) (int, error) {
-	if days <= 0 {
-		return 0, nil
+	if _, err := tx.ExecContext(ctx, `INSERT INTO usage_events (preset_id, device_id, domain, used_at) VALUES (?, ?, ?, ?)`,
+		id, deviceID, ScopeDomain(scopeType, scopeValue), now); err != nil {
+		return fmt.Errorf("failed to record usage event: %w", err)
 	}
-
-	cutoff := time.Now().AddDate(0, 0, -days)
-	query := `DELETE FROM presets WHERE last_used < ? OR (last_used IS NULL AND created_at < ?)`
-
-	result, err := s.db.Exec(query, cutoff, cutoff)
-	if err != nil {
-		return 0, fmt.Errorf("failed to cleanup old presets: %w", err)
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to update preset usage: %w", err)
 	}
+	s.invalidatePreset(deviceID, sharedGroupID, scopeType, scopeValue)
 
-	rows, _ := result.RowsAffected()
-	s.logger.Info("Cleaned up %d old presets", rows)
-
-	return int(rows), nil
+	return nil
 }
 
 // GetSyncLog retrieves sync history for a preset
-func (s *Storage) GetSyncLog(presetID string, limit int) ([]map[string]interface{}, error) {
+func (s *Storage) GetSyncLog(ctx context.Context, presetID string, limit int) ([]map[string]interface{}, error) {
+	s.flushSyncLog()
 	query := `
 	SELECT preset_id, action, device_id, timestamp
 	FROM sync_log
@@ -306,7 +974,7 @@ func (s *Storage) GetSyncLog(presetID string, limit int) ([]map[string]interface
 	LIMIT ?
 	`
 
-	rows, err := s.db.Query(query, presetID, limit)
+	rows, err := s.db.QueryContext(ctx, query, presetID, limit)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query sync log: %w", err)
 	}
@@ -332,7 +1000,8 @@ func (s *Storage) GetSyncLog(presetID string, limit int) ([]map[string]interface
 }
 
 // GetAllSyncLog retrieves sync history for all presets
-func (s *Storage) GetAllSyncLog(limit int, offset int) ([]map[string]interface{}, error) {
+func (s *Storage) GetAllSyncLog(ctx context.Context, limit int, offset int) ([]map[string]interface{}, error) {
+	s.flushSyncLog()
 	query := `
 	SELECT preset_id, action, device_id, timestamp
 	FROM sync_log
@@ -340,7 +1009,7 @@ func (s *Storage) GetAllSyncLog(limit int, offset int) ([]map[string]interface{}
 	LIMIT ? OFFSET ?
 	`
 
-	rows, err := s.db.Query(query, limit, offset)
+	rows, err := s.db.QueryContext(ctx, query, limit, offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query sync log: %w", err)
 	}
@@ -365,13 +1034,40 @@ func (s *Storage) GetAllSyncLog(limit int, offset int) ([]map[string]interface{}
 	return logs, nil
 }
 
-// logSync records a sync action
-func (s *Storage) logSync(presetID, action, deviceID string) {
-	query := `INSERT INTO sync_log (preset_id, action, device_id, timestamp) VALUES (?, ?, ?, ?)`
-	_, err := s.db.Exec(query, presetID, action, deviceID, time.Now())
+// SyncEvent is a sync log entry with the names of its preset and device
+type SyncEvent struct {
+	PresetID   string    `json:"presetId"`
+	PresetName string    `json:"presetName,omitempty"`
+	Action     string    `json:"action"`
+	DeviceID   string    `json:"deviceId"`
+	DeviceName string    `json:"deviceName,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// RecentSyncs returns the latest sync log entries, newest first
+func (s *Storage) RecentSyncs(ctx context.Context, limit int) ([]SyncEvent, error) {
+	s.flushSyncLog()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT l.preset_id, COALESCE(p.name, ''), l.action, l.device_id, COALESCE(d.name, ''), l.timestamp
+		FROM sync_log l
+		LEFT JOIN presets p ON p.id = l.preset_id
+		LEFT JOIN devices d ON d.id = l.device_id
+		ORDER BY l.timestamp DESC
+		LIMIT ?`, limit)
 	if err != nil {
-		s.logger.Warn("Failed to log sync action: %v", err)
+		return nil, fmt.Errorf("failed to query sync log: %w", err)
 	}
+	defer rows.Close()
+
+	events := []SyncEvent{}
+	for rows.Next() {
+		var e SyncEvent
+		if err := rows.Scan(&e.PresetID, &e.PresetName, &e.Action, &e.DeviceID, &e.DeviceName, &e.Timestamp); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
 }
 
 // scanPreset scans a database row into a Preset struct
@@ -379,6 +1075,7 @@ func (s *Storage) scanPreset(row interface{ Scan(...interface{}) error }) (*Pres
 	var preset Preset
 	var metadataJSON []byte
 	var lastUsed sql.NullTime
+	var codec string
 
 	err := row.Scan(
 		&preset.ID,
@@ -392,11 +1089,19 @@ func (s *Storage) scanPreset(row interface{ Scan(...interface{}) error }) (*Pres
 		&preset.UseCount,
 		&preset.DeviceID,
 		&metadataJSON,
+		&preset.Version,
+		&preset.StatVersion,
+		&preset.SharedGroupID,
+		&preset.UserID,
+		&codec,
 	)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to scan preset: %w", err)
 	}
+	if preset.EncryptedFields, err = decompressFields(preset.EncryptedFields, codec); err != nil {
+		return nil, err
+	}
 
 	if lastUsed.Valid {
 		preset.LastUsed = &lastUsed.Time
@@ -418,34 +1123,9 @@ func (s *Storage) scanPreset(row interface{ Scan(...interface{}) error }) (*Pres
 	return &preset, nil
 }
 
-// GetDevices returns a list of all unique device IDs
-func (s *Storage) GetDevices() ([]string, error) {
-	rows, err := s.db.Query(`
-		SELECT DISTINCT device_id 
-		FROM presets 
-		WHERE device_id != ''
-		ORDER BY device_id
-	`)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query devices: %w", err)
-	}
-	defer rows.Close()
-
-	var devices []string
-	for rows.Next() {
-		var deviceID string
-		if err := rows.Scan(&deviceID); err != nil {
-			return nil, fmt.Errorf("failed to scan device: %w", err)
-		}
-		devices = append(devices, deviceID)
-	}
-
-	return devices, rows.Err()
-}
-
 // DisableDomain adds a domain to the disabled list for a session
-func (s *Storage) DisableDomain(domain, sessionID string) error {
-	_, err := s.db.Exec(`
+func (s *Storage) DisableDomain(ctx context.Context, domain, sessionID string) error {
+	_, err := s.db.ExecContext(ctx, `
 		INSERT OR IGNORE INTO disabled_domains (domain, session_id, created_at)
 		VALUES (?, ?, ?)
 	`, domain, sessionID, time.Now())
@@ -459,8 +1139,8 @@ func (s *Storage) DisableDomain(domain, sessionID string) error {
 }
 
 // EnableDomain removes a domain from the disabled list for a session
-func (s *Storage) EnableDomain(domain, sessionID string) error {
-	result, err := s.db.Exec(`
+func (s *Storage) EnableDomain(ctx context.Context, domain, sessionID string) error {
+	result, err := s.db.ExecContext(ctx, `
 		DELETE FROM disabled_domains
 		WHERE domain = ? AND session_id = ?
 	`, domain, sessionID)
@@ -475,9 +1155,9 @@ func (s *Storage) EnableDomain(domain, sessionID string) error {
 }
 
 // IsDomaindDisabled checks if a domain is disabled for a session
-func (s *Storage) IsDomainDisabled(domain, sessionID string) (bool, error) {
+func (s *Storage) IsDomainDisabled(ctx context.Context, domain, sessionID string) (bool, error) {
 	var count int
-	err := s.db.QueryRow(`
+	err := s.db.QueryRowContext(ctx, `
 		SELECT COUNT(*) FROM disabled_domains
 		WHERE domain = ? AND session_id = ?
 	`, domain, sessionID).Scan(&count)
@@ -490,8 +1170,8 @@ func (s *Storage) IsDomainDisabled(domain, sessionID string) (bool, error) {
 }
 
 // GetDisabledDomains returns all disabled domains for a session
-func (s *Storage) GetDisabledDomains(sessionID string) ([]string, error) {
-	rows, err := s.db.Query(`
+func (s *Storage) GetDisabledDomains(ctx context.Context, sessionID string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
 		SELECT domain FROM disabled_domains
 		WHERE session_id = ?
 		ORDER BY created_at DESC
@@ -517,5 +1197,10 @@ func (s *Storage) GetDisabledDomains(sessionID string) ([]string, error) {
 // Close closes the database connection
 func (s *Storage) Close() error {
 	s.logger.Info("Closing storage")
+	s.stopWriteBehind()
+	s.stopSyncLog()
+	if s.cache != nil {
+		s.cache.close()
+	}
 	return s.db.Close()
 }
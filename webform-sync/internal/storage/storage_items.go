@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// StorageItems returns a device's chrome.storage.sync items: its presets of
+// scope type storage, named by their keys
+func (s *Storage) StorageItems(ctx context.Context, deviceID string) ([]*Preset, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+presetColumns+`
+		FROM presets WHERE device_id = ? AND scope_type = ?
+		ORDER BY name`, deviceID, ScopeTypeStorage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query storage items: %w", err)
+	}
+	defer rows.Close()
+
+	var items []*Preset
+	for rows.Next() {
+		item, err := s.scanPreset(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// SetStorageItems saves a device's storage items, replacing those with the
+// same keys. The device's quotas apply as in SavePreset, and either every
+// item is saved or, if one fails, none is.
+func (s *Storage) SetStorageItems(ctx context.Context, deviceID string, items []*Preset) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin save: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, item := range items {
+		item.DeviceID, item.ScopeType, item.ScopeValue = deviceID, ScopeTypeStorage, ""
+		item.UpdatedAt = now
+
+		fieldsJSON, err := json.Marshal(item.Fields)
+		if err != nil {
+			return fmt.Errorf("failed to marshal fields: %w", err)
+		}
+		item.EncryptedFields = string(fieldsJSON)
+		var metadataJSON []byte
+		if item.Metadata != nil {
+			if metadataJSON, err = json.Marshal(item.Metadata); err != nil {
+				return fmt.Errorf("failed to marshal metadata: %w", err)
+			}
+		}
+
+		// An existing key keeps its ID, so quotas measure the new size
+		// against the rest
+		err = tx.QueryRowContext(ctx, `
+			SELECT id, created_at FROM presets
+			WHERE device_id = ? AND scope_type = ? AND scope_value = '' AND name = ?`,
+			deviceID, ScopeTypeStorage, item.Name).Scan(&item.ID, &item.CreatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			item.assignID()
+			item.CreatedAt = now
+		} else if err != nil {
+			return fmt.Errorf("failed to look up storage item: %w", err)
+		}
+
+		fields, codec := s.compressFields(item.EncryptedFields)
+		if err := s.checkQuota(ctx, tx, item, int64(len(fields)+len(metadataJSON))); err != nil {
+			return err
+		}
+
+		fields, blob, err := s.offloadFields(ctx, tx, fields, codec)
+		if err != nil {
+			return err
+		}
+		err = withFreshID(item, s.logger, func() error {
+			return tx.QueryRowContext(ctx, `
+				INSERT INTO presets (id, name, scope_type, scope_value, encrypted_fields, fields_blob, fields_codec,
+					created_at, updated_at, device_id, metadata, user_id)
+				VALUES (?, ?, ?, '', ?, ?, ?, ?, ?, ?, ?, COALESCE((SELECT user_id FROM devices WHERE id = ?), ''))
+				ON CONFLICT(id) DO UPDATE SET
+					encrypted_fields = excluded.encrypted_fields,
+					fields_blob = excluded.fields_blob,
+					fields_codec = excluded.fields_codec,
+					updated_at = excluded.updated_at,
+					metadata = excluded.metadata,
+					version = presets.version + 1
+				WHERE NOT ?
+				RETURNING version, shared_group_id, user_id`,
+				item.ID, item.Name, ScopeTypeStorage, fieldsArg(fields, codec), blob, codec,
+				item.CreatedAt, item.UpdatedAt, deviceID, metadataJSON, deviceID, item.generatedID,
+			).Scan(&item.Version, &item.SharedGroupID, &item.UserID)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to save storage item: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to save storage items: %w", err)
+	}
+
+	for _, item := range items {
+		s.invalidatePreset(deviceID, item.SharedGroupID, ScopeTypeStorage, "")
+		s.logSync(item.ID, "save", deviceID)
+	}
+	s.logger.Debug("Saved %d storage items (device: %s)", len(items), deviceID)
+	return nil
+}
+
+// RemoveStorageItems deletes a device's storage items with the given keys,
+// or all of them when keys is nil
+func (s *Storage) RemoveStorageItems(ctx context.Context, deviceID string, keys []string) error {
+	query := `DELETE FROM presets WHERE device_id = ? AND scope_type = ?`
+	args := []interface{}{deviceID, ScopeTypeStorage}
+	if keys != nil {
+		if len(keys) == 0 {
+			return nil
+		}
+		query += ` AND name IN (?` + strings.Repeat(", ?", len(keys)-1) + `)`
+		for _, key := range keys {
+			args = append(args, key)
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, query+` RETURNING id, shared_group_id`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to remove storage items: %w", err)
+	}
+	defer rows.Close()
+
+	var removed []string
+	for rows.Next() {
+		var id, sharedGroupID string
+		if err := rows.Scan(&id, &sharedGroupID); err != nil {
+			return fmt.Errorf("failed to scan removed item: %w", err)
+		}
+		s.invalidatePreset(deviceID, sharedGroupID, ScopeTypeStorage, "")
+		removed = append(removed, id)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to remove storage items: %w", err)
+	}
+	rows.Close()
+
+	for _, id := range removed {
+		s.logSync(id, "delete", deviceID)
+	}
+	s.logger.Debug("Removed %d storage items (device: %s)", len(removed), deviceID)
+	return nil
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+)
+
+// syncLogEntry is a sync log row waiting to be written
+type syncLogEntry struct {
+	presetID  string
+	action    string
+	deviceID  string
+	timestamp time.Time
+}
+
+// syncLogWriter writes the sync log from a background worker in batches,
+// so a bulk import doesn't pay for an INSERT per preset
+type syncLogWriter struct {
+	entries   chan syncLogEntry
+	batchSize int
+	interval  time.Duration
+
+	// flush asks the worker to write what it has, closing the channel it is
+	// sent once done
+	flush chan chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// EnableSyncLogBuffer moves sync log writes to a background worker that
+// writes them in batches, coalescing consecutive entries for the same
+// preset, action and device. Reads of the sync log wait for the entries
+// queued before them. Call it before serving requests; Close stops the
+// worker.
+func (s *Storage) EnableSyncLogBuffer(cfg config.SyncLogConfig) {
+	if !cfg.Async || s.syncLog != nil {
+		return
+	}
+	s.syncLog = &syncLogWriter{
+		entries:   make(chan syncLogEntry, cfg.QueueSize),
+		batchSize: cfg.BatchSize,
+		interval:  time.Duration(cfg.FlushIntervalMs) * time.Millisecond,
+		flush:     make(chan chan struct{}),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go s.runSyncLog(s.syncLog)
+}
+
+// logSync records a sync action. It runs after the change has committed, so
+// it deliberately doesn't take the caller's context: a client disconnecting
+// mustn't lose the log entry for work that was done. With the buffer on,
+// the entry is queued, unless the queue is full.
+func (s *Storage) logSync(presetID, action, deviceID string) {
+	entry := syncLogEntry{presetID: presetID, action: action, deviceID: deviceID, timestamp: time.Now()}
+	if w := s.syncLog; w != nil {
+		select {
+		case w.entries <- entry:
+			return
+		default:
+			// Falling behind: slow the writers down rather than drop entries
+		}
+	}
+	s.writeSyncLog([]syncLogEntry{entry})
+}
+
+// flushSyncLog waits until the sync log entries queued so far are written
+func (s *Storage) flushSyncLog() {
+	w := s.syncLog
+	if w == nil {
+		return
+	}
+	ack := make(chan struct{})
+	select {
+	case w.flush <- ack:
+		<-ack
+	case <-w.done:
+	}
+}
+
+// stopSyncLog writes the queued entries and stops the worker
+func (s *Storage) stopSyncLog() {
+	if w := s.syncLog; w != nil {
+		close(w.stop)
+		<-w.done
+	}
+}
+
+// runSyncLog is the sync log worker. It writes a batch once it is full or
+// interval after the last write, whichever comes first.
+func (s *Storage) runSyncLog(w *syncLogWriter) {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	var batch []syncLogEntry
+	write := func() {
+		if len(batch) > 0 {
+			s.writeSyncLog(batch)
+			batch = batch[:0]
+		}
+	}
+	// drain takes in everything queued, however many batches it makes
+	drain := func() {
+		for {
+			select {
+			case entry := <-w.entries:
+				batch = coalesceSyncLog(batch, entry)
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case entry := <-w.entries:
+			batch = coalesceSyncLog(batch, entry)
+			if len(batch) >= w.batchSize {
+				write()
+			}
+		case <-ticker.C:
+			write()
+		case ack := <-w.flush:
+			drain()
+			write()
+			close(ack)
+		case <-w.stop:
+			drain()
+			write()
+			return
+		}
+	}
+}
+
+// coalesceSyncLog adds an entry to a batch. An entry repeating the last
+// one's preset, action and device only moves its time on, so a preset
+// saved over and over leaves one row.
+func coalesceSyncLog(batch []syncLogEntry, entry syncLogEntry) []syncLogEntry {
+	if n := len(batch); n > 0 {
+		last := &batch[n-1]
+		if last.presetID == entry.presetID && last.action == entry.action && last.deviceID == entry.deviceID {
+			last.timestamp = entry.timestamp
+			return batch
+		}
+	}
+	return append(batch, entry)
+}
+
+// writeSyncLog inserts sync log entries in one transaction
+func (s *Storage) writeSyncLog(entries []syncLogEntry) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		s.logger.Warn("Failed to log sync actions: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO sync_log (preset_id, action, device_id, timestamp) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		s.logger.Warn("Failed to log sync actions: %v", err)
+		return
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		if _, err := stmt.Exec(e.presetID, e.action, e.deviceID, e.timestamp); err != nil {
+			s.logger.Warn("Failed to log sync action: %v", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		s.logger.Warn("Failed to log sync actions: %v", err)
+	}
+}
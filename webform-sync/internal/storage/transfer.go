@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Transfer outcomes
+const (
+	TransferMoved    = "transferred"
+	TransferNotFound = "not_found" // No such preset owned by the source device
+	TransferConflict = "conflict"  // Target already has a preset with the same name and scope
+	TransferQuota    = "quota_exceeded"
+)
+
+// TransferResult reports the outcome for one preset of a transfer
+type TransferResult struct {
+	ID     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// TransferPresets reassigns presets from one device to another. An empty ids
+// list transfers every preset the source device owns. Presets are moved
+// independently: conflicts and quota failures are reported per preset and
+// don't stop the rest. Group shares are kept only if the target device is a
+// member of the group.
+func (s *Storage) TransferPresets(ctx context.Context, ids []string, fromDevice, toDevice string) ([]TransferResult, error) {
+	s.awaitWrites()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transfer: %w", err)
+	}
+	defer tx.Rollback()
+
+	if len(ids) == 0 {
+		rows, err := tx.QueryContext(ctx, `SELECT id FROM presets WHERE device_id = ? ORDER BY created_at`, fromDevice)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query presets: %w", err)
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan preset: %w", err)
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	results := make([]TransferResult, 0, len(ids))
+	for _, id := range ids {
+		result := TransferResult{ID: id}
+
+		var scopeType, scopeValue string
+		var size int64
+		err := tx.QueryRowContext(ctx, `
+			SELECT name, scope_type, scope_value, `+presetBytesExpr+`
+			FROM presets WHERE id = ? AND device_id = ?`, id, fromDevice).
+			Scan(&result.Name, &scopeType, &scopeValue, &size)
+		if errors.Is(err, sql.ErrNoRows) {
+			result.Status = TransferNotFound
+			results = append(results, result)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load preset %s: %w", id, err)
+		}
+
+		var clash int
+		if err := tx.QueryRowContext(ctx, `
+			SELECT COUNT(*) FROM presets
+			WHERE scope_type = ? AND scope_value = ? AND name = ? AND device_id = ?`,
+			scopeType, scopeValue, result.Name, toDevice).Scan(&clash); err != nil {
+			return nil, fmt.Errorf("failed to check for conflicts: %w", err)
+		}
+		if clash > 0 {
+			result.Status = TransferConflict
+			result.Error = "target device already has a preset with this name and scope"
+			results = append(results, result)
+			continue
+		}
+
+		if err := s.checkQuota(ctx, tx, &Preset{ID: id, DeviceID: toDevice}, size); err != nil {
+			var qe *QuotaError
+			if !errors.As(err, &qe) {
+				return nil, err
+			}
+			result.Status = TransferQuota
+			result.Error = qe.Error()
+			results = append(results, result)
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE presets
+			SET device_id = ?, user_shared = 0, updated_at = ?, version = version + 1,
+				user_id = COALESCE((SELECT user_id FROM devices WHERE id = ?), ''),
+				shared_group_id = CASE
+					WHEN shared_group_id IN (SELECT group_id FROM device_group_members WHERE device_id = ?)
+					THEN shared_group_id ELSE '' END
+			WHERE id = ?`, toDevice, now, toDevice, toDevice, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to transfer preset %s: %w", id, err)
+		}
+
+		result.Status = TransferMoved
+		results = append(results, result)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transfer: %w", err)
+	}
+	s.invalidateAll()
+
+	moved := 0
+	for _, result := range results {
+		if result.Status == TransferMoved {
+			s.logSync(result.ID, "transfer", toDevice)
+			moved++
+		}
+	}
+	s.logger.Info("Transferred %d of %d presets from device %s to %s", moved, len(results), fromDevice, toDevice)
+
+	return results, nil
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// UsagePoint counts the uses recorded within a time bucket
+type UsagePoint struct {
+	Bucket string `json:"bucket"`
+	Uses   int    `json:"uses"`
+}
+
+// PresetUsage is a preset's uses over time
+type PresetUsage struct {
+	PresetID string `json:"presetId"`
+	// Uses are those in Series; UseCount counts every use since the preset
+	// was created, including any from before usage events were recorded
+	Uses       int          `json:"uses"`
+	UseCount   int          `json:"useCount"`
+	LastUsed   *time.Time   `json:"lastUsed,omitempty"`
+	BucketSize string       `json:"bucketSize"`
+	Series     []UsagePoint `json:"series"`
+}
+
+// DomainUsage is the uses of a domain's presets over time, and how many of
+// them went unused
+type DomainUsage struct {
+	Domain string `json:"domain"`
+	Uses   int    `json:"uses"`
+	// Presets are those stored for the domain; Unused are the ones among
+	// them not used since the start of the period
+	Presets int          `json:"presets"`
+	Unused  int          `json:"unused"`
+	Series  []UsagePoint `json:"series"`
+}
+
+// UsageFilter narrows usage down. An empty DeviceID covers every device's
+// presets; an empty Domain every domain.
+type UsageFilter struct {
+	DeviceID string
+	Domain   string
+	// Since is the start of the period
+	Since      time.Time
+	BucketSize string
+}
+
+// GetPresetUsage returns a preset's uses since filter.Since, bucketed by
+// filter.BucketSize
+func (s *Storage) GetPresetUsage(ctx context.Context, preset *Preset, filter UsageFilter) (*PresetUsage, error) {
+	bucketExpr, ok := statsBucketExpr[filter.BucketSize]
+	if !ok {
+		return nil, fmt.Errorf("invalid bucket size: %s", filter.BucketSize)
+	}
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+fmt.Sprintf(bucketExpr, "used_at")+` AS bucket, COUNT(*)
+		FROM usage_events WHERE preset_id = ? AND used_at >= ?
+		GROUP BY bucket
+		ORDER BY bucket`, preset.ID, filter.Since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query preset usage: %w", err)
+	}
+	defer rows.Close()
+
+	usage := &PresetUsage{
+		PresetID:   preset.ID,
+		UseCount:   preset.UseCount,
+		LastUsed:   preset.LastUsed,
+		BucketSize: filter.BucketSize,
+		Series:     []UsagePoint{},
+	}
+	for rows.Next() {
+		var p UsagePoint
+		if err := rows.Scan(&p.Bucket, &p.Uses); err != nil {
+			return nil, fmt.Errorf("failed to scan preset usage: %w", err)
+		}
+		usage.Uses += p.Uses
+		usage.Series = append(usage.Series, p)
+	}
+	return usage, rows.Err()
+}
+
+// GetDomainUsage returns the uses per domain since filter.Since, bucketed
+// by filter.BucketSize, with the number of presets each domain has and how
+// many of them went unused. Domains are ordered by uses, most first.
+func (s *Storage) GetDomainUsage(ctx context.Context, filter UsageFilter) ([]*DomainUsage, error) {
+	bucketExpr, ok := statsBucketExpr[filter.BucketSize]
+	if !ok {
+		return nil, fmt.Errorf("invalid bucket size: %s", filter.BucketSize)
+	}
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	byDomain := make(map[string]*DomainUsage)
+	domain := func(name string) *DomainUsage {
+		d, ok := byDomain[name]
+		if !ok {
+			d = &DomainUsage{Domain: name, Series: []UsagePoint{}}
+			byDomain[name] = d
+		}
+		return d
+	}
+
+	where, args := "used_at >= ?", []interface{}{filter.Since}
+	if filter.DeviceID != "" {
+		where += " AND device_id = ?"
+		args = append(args, filter.DeviceID)
+	}
+	if filter.Domain != "" {
+		where += " AND domain = ?"
+		args = append(args, filter.Domain)
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT domain, `+fmt.Sprintf(bucketExpr, "used_at")+` AS bucket, COUNT(*)
+		FROM usage_events WHERE `+where+`
+		GROUP BY domain, bucket
+		ORDER BY domain, bucket`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query domain usage: %w", err)
+	}
+	for rows.Next() {
+		var name string
+		var p UsagePoint
+		if err := rows.Scan(&name, &p.Bucket, &p.Uses); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan domain usage: %w", err)
+		}
+		d := domain(name)
+		d.Uses += p.Uses
+		d.Series = append(d.Series, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query domain usage: %w", err)
+	}
+
+	// Presets per domain: aggregate distinct scopes in SQL, fold into hosts
+	// here, as GetPresetStats does
+	where, args = "1 = 1", []interface{}{filter.Since}
+	if filter.DeviceID != "" {
+		where = "device_id = ?"
+		args = append(args, filter.DeviceID)
+	}
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT scope_type, scope_value, COUNT(*),
+			SUM(CASE WHEN COALESCE(last_used, created_at) < ? THEN 1 ELSE 0 END)
+		FROM presets WHERE `+where+`
+		GROUP BY scope_type, scope_value`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query presets per domain: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var scopeType, scopeValue string
+		var presets, unused int
+		if err := rows.Scan(&scopeType, &scopeValue, &presets, &unused); err != nil {
+			return nil, fmt.Errorf("failed to scan presets per domain: %w", err)
+		}
+		name := ScopeDomain(scopeType, scopeValue)
+		if filter.Domain != "" && name != filter.Domain {
+			continue
+		}
+		d := domain(name)
+		d.Presets += presets
+		d.Unused += unused
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query presets per domain: %w", err)
+	}
+
+	domains := make([]*DomainUsage, 0, len(byDomain))
+	for _, d := range byDomain {
+		domains = append(domains, d)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if domains[i].Uses != domains[j].Uses {
+			return domains[i].Uses > domains[j].Uses
+		}
+		return domains[i].Domain < domains[j].Domain
+	})
+	return domains, nil
+}
+
+// PruneUsageEvents removes usage events older than days
+func (s *Storage) PruneUsageEvents(ctx context.Context, days int) (int, error) {
+	if days <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	result, err := s.db.ExecContext(ctx, `DELETE FROM usage_events WHERE used_at < ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune usage events: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+	return int(rows), nil
+}
+
+// ForEachDeviceUsageEvent streams the usage events of a device's presets,
+// oldest first
+func (s *Storage) ForEachDeviceUsageEvent(ctx context.Context, deviceID string, fn func(map[string]interface{}) error) error {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT preset_id, domain, used_at
+		FROM usage_events
+		WHERE device_id = ?
+		ORDER BY used_at`, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to query usage events: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var presetID, domain string
+		var usedAt time.Time
+		if err := rows.Scan(&presetID, &domain, &usedAt); err != nil {
+			return fmt.Errorf("failed to scan usage events: %w", err)
+		}
+		if err := fn(map[string]interface{}{
+			"preset_id": presetID,
+			"domain":    domain,
+			"used_at":   usedAt,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
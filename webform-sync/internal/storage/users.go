@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUserNotFound is returned when a user does not exist
+var ErrUserNotFound = errors.New("user not found")
+
+// User owns a set of devices and their presets
+type User struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// userTokenPrefix marks per-user API tokens so they're recognizable in configs
+const userTokenPrefix = "wfs_"
+
+// hashToken returns the stored form of an API token; tokens themselves are
+// never persisted
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newUserToken generates a random per-user API token
+func newUserToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return userTokenPrefix + hex.EncodeToString(b), nil
+}
+
+// CreateUser creates a user and returns it with its API token. The token is
+// only available here and from RotateUserToken.
+func (s *Storage) CreateUser(ctx context.Context, name string) (*User, string, error) {
+	token, err := newUserToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	user := &User{ID: NewPresetID(), Name: name, CreatedAt: time.Now()}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO users (id, name, token_hash, created_at) VALUES (?, ?, ?, ?)`,
+		user.ID, user.Name, hashToken(token), user.CreatedAt)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create user: %w", err)
+	}
+
+	s.logger.Info("User created: %s (%s)", user.Name, user.ID)
+	return user, token, nil
+}
+
+// GetUser returns a user by ID
+func (s *Storage) GetUser(ctx context.Context, id string) (*User, error) {
+	return s.queryUser(ctx, `SELECT id, name, created_at FROM users WHERE id = ?`, id)
+}
+
+// GetUserByToken returns the user owning an API token
+func (s *Storage) GetUserByToken(ctx context.Context, token string) (*User, error) {
+	return s.queryUser(ctx, `SELECT id, name, created_at FROM users WHERE token_hash = ?`, hashToken(token))
+}
+
+// GetUsers returns all users
+func (s *Storage) GetUsers(ctx context.Context) ([]*User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, name, created_at FROM users ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Name, &user.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, &user)
+	}
+	return users, rows.Err()
+}
+
+// RenameUser changes a user's display name
+func (s *Storage) RenameUser(ctx context.Context, id, name string) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE users SET name = ? WHERE id = ?`, name, id)
+	if err != nil {
+		return fmt.Errorf("failed to rename user: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// RotateUserToken replaces a user's API token and returns the new one
+func (s *Storage) RotateUserToken(ctx context.Context, id string) (string, error) {
+	token, err := newUserToken()
+	if err != nil {
+		return "", err
+	}
+
+	result, err := s.db.ExecContext(ctx, `UPDATE users SET token_hash = ? WHERE id = ?`, hashToken(token), id)
+	if err != nil {
+		return "", fmt.Errorf("failed to rotate token: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return "", ErrUserNotFound
+	}
+
+	s.logger.Info("Token rotated for user %s", id)
+	return token, nil
+}
+
+// DeleteUser removes a user. Its devices are released (unowned) but keep
+// their presets; the user's device-less presets are deleted, since they would
+// otherwise become visible to every unowned device, and so are its form
+// schemas, fill failures and scope policies, which no device could reach
+// any more.
+func (s *Storage) DeleteUser(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin user deletion: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrUserNotFound
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM presets WHERE user_id = ? AND user_shared = 1`, id); err != nil {
+		return fmt.Errorf("failed to delete user presets: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE presets SET user_id = '' WHERE user_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to release user presets: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM form_schemas WHERE user_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete user form schemas: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM fill_failures WHERE user_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete user fill failures: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM scope_policies WHERE user_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete user scope policies: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE devices SET user_id = '' WHERE user_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to release user devices: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	s.invalidateAll()
+	s.logger.Info("User deleted: %s", id)
+	return nil
+}
+
+// queryUser runs a single-user query
+func (s *Storage) queryUser(ctx context.Context, query string, arg string) (*User, error) {
+	var user User
+	err := s.db.QueryRowContext(ctx, query, arg).Scan(&user.ID, &user.Name, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return &user, nil
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// WebhookDelivery records the outcome of delivering one event to one webhook
+type WebhookDelivery struct {
+	ID          string    `json:"id"`
+	Webhook     string    `json:"webhook"`
+	Event       string    `json:"event"`
+	EventID     string    `json:"eventId"`
+	Attempts    int       `json:"attempts"`
+	StatusCode  int       `json:"statusCode,omitempty"`
+	Success     bool      `json:"success"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+// RecordWebhookDelivery adds a delivery to the log
+func (s *Storage) RecordWebhookDelivery(ctx context.Context, d *WebhookDelivery) error {
+	if d.ID == "" {
+		d.ID = NewPresetID()
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (id, webhook, event, event_id, attempts, status_code, success, error, created_at, completed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.ID, d.Webhook, d.Event, d.EventID, d.Attempts, d.StatusCode, d.Success, d.Error, d.CreatedAt, d.CompletedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// GetWebhookDeliveries returns the delivery log, newest first, optionally
+// only failed deliveries
+func (s *Storage) GetWebhookDeliveries(ctx context.Context, failedOnly bool, limit, offset int) ([]*WebhookDelivery, error) {
+	query := `
+		SELECT id, webhook, event, event_id, attempts, status_code, success, error, created_at, completed_at
+		FROM webhook_deliveries`
+	if failedOnly {
+		query += ` WHERE success = 0`
+	}
+	query += ` ORDER BY created_at DESC LIMIT ? OFFSET ?`
+
+	rows, err := s.db.QueryContext(ctx, query, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.Webhook, &d.Event, &d.EventID, &d.Attempts, &d.StatusCode,
+			&d.Success, &d.Error, &d.CreatedAt, &d.CompletedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, rows.Err()
+}
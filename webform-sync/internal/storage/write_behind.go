@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+)
+
+// Write-behind durabilities: when a queued save is acknowledged
+const (
+	// DurabilityBatch acknowledges a save once the transaction it was
+	// written in has committed, which syncs it to disk
+	DurabilityBatch = "batch"
+	// DurabilityQueued acknowledges a save as soon as it is queued. A crash
+	// loses the saves still queued, and a save the database refuses, such
+	// as one over quota, is only logged.
+	DurabilityQueued = "queued"
+)
+
+// errStorageClosed is returned for saves queued after Close
+var errStorageClosed = errors.New("storage is closed")
+
+// queuedSave is a preset save waiting for the write-behind worker
+type queuedSave struct {
+	// preset is the worker's copy of caller, which the caller gets back
+	// once it is written
+	preset   *Preset
+	caller   *Preset
+	metadata []byte
+	// done receives the outcome, unless the save was acknowledged when it
+	// was queued
+	done chan error
+}
+
+// writeBehind queues preset saves and writes them in batches, one
+// transaction (and one sync to disk) for many saves, so a burst of saves
+// doesn't queue up behind SQLite's single writer until requests time out
+type writeBehind struct {
+	saves      chan *queuedSave
+	batchSize  int
+	interval   time.Duration
+	ackOnQueue bool
+
+	// queued counts the saves not yet written, so waiting for them is free
+	// when there are none
+	queued atomic.Int64
+
+	// closed is set under mu once Close begins, and enqueueSave holds mu
+	// for reading, so no save is queued after the worker's final drain
+	mu     sync.RWMutex
+	closed bool
+
+	// flush asks the worker to write what it has, closing the channel it is
+	// sent once done
+	flush chan chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// EnableWriteBehind puts a write-behind queue in front of SavePreset. Call
+// it before serving requests; Close writes the queued saves and stops it.
+func (s *Storage) EnableWriteBehind(cfg config.WriteBehindConfig) error {
+	if !cfg.Enabled || s.writeBehind != nil {
+		return nil
+	}
+
+	s.writeBehind = &writeBehind{
+		saves:      make(chan *queuedSave, cfg.QueueSize),
+		batchSize:  cfg.BatchSize,
+		interval:   time.Duration(cfg.FlushIntervalMs) * time.Millisecond,
+		ackOnQueue: cfg.Durability == DurabilityQueued,
+		flush:      make(chan chan struct{}),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go s.runWriteBehind(s.writeBehind)
+	return nil
+}
+
+// queueSave hands a save prepared by SavePreset to the worker. With
+// DurabilityQueued it returns at once, with preset marked Pending and given
+// the ID and version it will have; otherwise once the save is written.
+func (s *Storage) queueSave(ctx context.Context, preset *Preset, metadataJSON []byte) error {
+	save, err := s.enqueueSave(ctx, preset, metadataJSON)
+	if err != nil || save.done == nil {
+		return err
+	}
+	return awaitSave(ctx, save)
+}
+
+// enqueueSave queues a save without waiting for it to be written; see
+// queueSave. The worker writes a copy of preset, so a caller that gives up
+// waiting never shares it with the worker.
+func (s *Storage) enqueueSave(ctx context.Context, preset *Preset, metadataJSON []byte) (*queuedSave, error) {
+	w := s.writeBehind
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return nil, errStorageClosed
+	}
+
+	if w.ackOnQueue {
+		// The ID goes back to the client now, so the worker can't redraw it
+		if err := s.reserveID(ctx, preset); err != nil {
+			return nil, err
+		}
+		stats, version, err := statsOnly(ctx, s.db, preset)
+		if err != nil {
+			return nil, err
+		}
+		preset.StatsOnly, preset.Version, preset.Pending = stats, version, true
+		if !stats {
+			preset.Version++
+		}
+	}
+	queued := *preset
+	save := &queuedSave{preset: &queued, caller: preset, metadata: metadataJSON}
+	if !w.ackOnQueue {
+		save.done = make(chan error, 1)
+	}
+
+	w.queued.Add(1)
+	select {
+	case w.saves <- save:
+		return save, nil
+	case <-ctx.Done():
+		w.queued.Add(-1)
+		return nil, ctx.Err()
+	}
+}
+
+// awaitSave waits for a queued save to be written
+func awaitSave(ctx context.Context, save *queuedSave) error {
+	select {
+	case err := <-save.done:
+		if err == nil {
+			// The worker is done with its copy, written as it now stands
+			*save.caller = *save.preset
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// savePresetsBehind queues prepared saves together and waits for them once,
+// flushing the queue rather than waiting out the batch interval
+func (s *Storage) savePresetsBehind(ctx context.Context, presets []*Preset, metadata [][]byte, errs []error) {
+	saves := make([]*queuedSave, len(presets))
+	for i, preset := range presets {
+		if errs[i] != nil {
+			continue
+		}
+		saves[i], errs[i] = s.enqueueSave(ctx, preset, metadata[i])
+	}
+	if s.writeBehind.ackOnQueue {
+		return
+	}
+	s.awaitWrites()
+	for i, save := range saves {
+		if save != nil {
+			errs[i] = awaitSave(ctx, save)
+		}
+	}
+}
+
+// awaitWrites waits until the saves queued so far are written. Reads of a
+// single preset and writes that mustn't be overtaken by a queued save, such
+// as deletes, call it first.
+func (s *Storage) awaitWrites() {
+	w := s.writeBehind
+	if w == nil || w.queued.Load() == 0 {
+		return
+	}
+	ack := make(chan struct{})
+	select {
+	case w.flush <- ack:
+		<-ack
+	case <-w.done:
+	}
+}
+
+// stopWriteBehind refuses further saves, writes the queued ones and stops
+// the worker
+func (s *Storage) stopWriteBehind() {
+	if w := s.writeBehind; w != nil {
+		// Waits out saves being queued, which the final drain then picks up
+		w.mu.Lock()
+		w.closed = true
+		w.mu.Unlock()
+		close(w.stop)
+		<-w.done
+	}
+}
+
+// runWriteBehind is the write-behind worker. A batch is written once it is
+// full, or interval after its first save arrived.
+func (s *Storage) runWriteBehind(w *writeBehind) {
+	defer close(w.done)
+	timer := time.NewTimer(w.interval)
+	timer.Stop()
+
+	var batch []*queuedSave
+	write := func() {
+		if len(batch) > 0 {
+			s.writeBatch(batch)
+			w.queued.Add(-int64(len(batch)))
+			batch = nil
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case save := <-w.saves:
+				batch = append(batch, save)
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case save := <-w.saves:
+			batch = append(batch, save)
+			if len(batch) == 1 {
+				timer.Reset(w.interval)
+			}
+			if len(batch) >= w.batchSize {
+				timer.Stop()
+				write()
+			}
+		case <-timer.C:
+			write()
+		case ack := <-w.flush:
+			drain()
+			write()
+			close(ack)
+		case <-w.stop:
+			drain()
+			write()
+			return
+		}
+	}
+}
+
+// writeBatch writes queued saves in one transaction and reports each
+// outcome. Each save gets a savepoint, so one the database refuses doesn't
+// take the rest of the batch with it. The batch goes through the guarded
+// handle like any other write, and is retried whole while the database is
+// busy.
+func (s *Storage) writeBatch(batch []*queuedSave) {
+	ctx := context.Background()
+	errs := make([]error, len(batch))
+	// Each attempt starts from the presets as queued, since a rolled back
+	// one may have drawn IDs and versions
+	queued := make([]Preset, len(batch))
+	for i, save := range batch {
+		queued[i] = *save.preset
+	}
+
+	err := s.db.do(ctx, func() error {
+		tx, err := s.db.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin save: %w", err)
+		}
+		defer tx.Rollback()
+
+		for i, save := range batch {
+			*save.preset = queued[i]
+			if _, err := tx.ExecContext(ctx, `SAVEPOINT queued_save`); err != nil {
+				return fmt.Errorf("failed to save preset: %w", err)
+			}
+			if errs[i] = s.upsertPreset(ctx, tx, save.preset, save.metadata); errs[i] != nil {
+				if errorMatches(errs[i], busyMessages) {
+					return errs[i]
+				}
+				if _, err := tx.ExecContext(ctx, `ROLLBACK TO queued_save`); err != nil {
+					return fmt.Errorf("failed to save preset: %w", err)
+				}
+			}
+			if _, err := tx.ExecContext(ctx, `RELEASE queued_save`); err != nil {
+				return fmt.Errorf("failed to save preset: %w", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to save preset: %w", err)
+		}
+		return nil
+	})
+
+	for i, save := range batch {
+		if err != nil {
+			errs[i] = err
+		} else if errs[i] == nil {
+			s.presetSaved(save.preset)
+		}
+		if save.done != nil {
+			save.done <- errs[i]
+		} else if errs[i] != nil {
+			s.logger.Error("Failed to write queued save of preset %s (device: %s): %v",
+				save.preset.ID, save.preset.DeviceID, errs[i])
+		}
+	}
+	s.logger.Debug("Wrote a batch of %d saves", len(batch))
+}
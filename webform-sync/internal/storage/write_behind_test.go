@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/logger"
+)
+
+// openTestStorage opens a database in dir, behind a write-behind queue if
+// one is enabled
+func openTestStorage(t *testing.T, dir string, quota config.QuotaConfig, wb config.WriteBehindConfig) *Storage {
+	t.Helper()
+	log := logger.NewLogger(config.LoggingConfig{Level: "error", Output: "stdout"})
+	s, err := NewStorage(config.StorageConfig{DataDir: dir, DBFile: "presets.db", Quota: quota}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableWriteBehind(wb); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testPreset(name, user string) *Preset {
+	now := time.Now()
+	return &Preset{
+		DeviceID: "laptop", Name: name, ScopeType: ScopeTypeGlobal,
+		Fields: map[string]interface{}{"user": user}, CreatedAt: now, UpdatedAt: now,
+	}
+}
+
+// Saves queued together share a batch without waiting out its interval, and
+// one the database refuses doesn't fail the others
+func TestSavePresetsBatchCommitsAndRefuses(t *testing.T) {
+	interval := 30 * time.Second
+	s := openTestStorage(t, t.TempDir(), config.QuotaConfig{MaxPresetBytes: 100}, config.WriteBehindConfig{
+		Enabled: true, BatchSize: 100, FlushIntervalMs: int(interval / time.Millisecond), QueueSize: 10,
+		Durability: DurabilityBatch,
+	})
+	defer s.Close()
+	ctx := context.Background()
+
+	presets := []*Preset{
+		testPreset("First", "alice"),
+		testPreset("Too big", strings.Repeat("x", 200)),
+		testPreset("Second", "bob"),
+	}
+	start := time.Now()
+	errs := s.SavePresets(ctx, presets)
+	if elapsed := time.Since(start); elapsed >= interval/2 {
+		t.Errorf("SavePresets took %v, waiting for the batch interval", elapsed)
+	}
+
+	var quotaErr *QuotaError
+	if !errors.As(errs[1], &quotaErr) {
+		t.Errorf("oversized preset: err = %v, want a quota error", errs[1])
+	}
+	for _, i := range []int{0, 2} {
+		if errs[i] != nil {
+			t.Fatalf("preset %d: %v", i, errs[i])
+		}
+		if presets[i].Pending || presets[i].Version != 1 {
+			t.Errorf("preset %d: pending = %v, version = %d, want it written", i, presets[i].Pending, presets[i].Version)
+		}
+		got, err := s.GetPreset(ctx, presets[i].ID)
+		if err != nil {
+			t.Fatalf("preset %d: %v", i, err)
+		}
+		if got.Name != presets[i].Name {
+			t.Errorf("preset %d: name = %q, want %q", i, got.Name, presets[i].Name)
+		}
+	}
+}
+
+// Close writes every save acknowledged before it, including those queued
+// while it runs, and refuses saves after it
+func TestCloseDrainsWriteBehind(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir, config.QuotaConfig{}, config.WriteBehindConfig{
+		Enabled: true, BatchSize: 1000, FlushIntervalMs: int(time.Minute / time.Millisecond), QueueSize: 1000,
+		Durability: DurabilityQueued,
+	})
+	ctx := context.Background()
+
+	var (
+		mu    sync.Mutex
+		saved []string
+		wg    sync.WaitGroup
+	)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				preset := testPreset(fmt.Sprintf("Preset %d-%d", g, i), "alice")
+				err := s.SavePreset(ctx, preset)
+				if errors.Is(err, errStorageClosed) {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				saved = append(saved, preset.ID)
+				mu.Unlock()
+			}
+		}(g)
+	}
+	time.Sleep(time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if err := s.SavePreset(ctx, testPreset("Late", "alice")); !errors.Is(err, errStorageClosed) {
+		t.Errorf("save after Close: err = %v, want %v", err, errStorageClosed)
+	}
+
+	reopened := openTestStorage(t, dir, config.QuotaConfig{}, config.WriteBehindConfig{})
+	defer reopened.Close()
+	for _, id := range saved {
+		if _, err := reopened.GetPreset(ctx, id); err != nil {
+			t.Errorf("acknowledged save %s: %v", id, err)
+		}
+	}
+}
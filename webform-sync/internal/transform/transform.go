@@ -0,0 +1,316 @@
+// Package transform runs a user-supplied Starlark script over preset fields
+// as they are saved and read. Scripts are sandboxed: they can't load other
+// files or reach the filesystem or network, and every call is bounded by a
+// step limit and a timeout.
+package transform
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// Hook names: the functions a script may define
+const (
+	OnSave = "on_save"
+	OnRead = "on_read"
+)
+
+// Rejected is returned when a script refuses a preset with fail()
+type Rejected struct {
+	Reason string
+}
+
+func (e *Rejected) Error() string {
+	return e.Reason
+}
+
+// Preset is what a hook sees of a preset
+type Preset struct {
+	Name       string
+	ScopeType  string
+	ScopeValue string
+	DeviceID   string
+	Fields     map[string]interface{}
+}
+
+// Script is a loaded transform script. It is safe for concurrent use.
+type Script struct {
+	hooks    map[string]*starlark.Function
+	timeout  time.Duration
+	maxSteps uint64
+	print    func(msg string)
+}
+
+// Load reads and runs a script file, keeping the hooks it defines. print
+// receives the script's print() output.
+func Load(path string, timeout time.Duration, maxSteps uint64, print func(msg string)) (*Script, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transform script: %w", err)
+	}
+
+	s := &Script{hooks: map[string]*starlark.Function{}, timeout: timeout, maxSteps: maxSteps, print: print}
+	thread := s.thread(path)
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, path, src, predeclared)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load transform script: %w", scriptError(err))
+	}
+	for _, name := range []string{OnSave, OnRead} {
+		v, ok := globals[name]
+		if !ok {
+			continue
+		}
+		fn, ok := v.(*starlark.Function)
+		if !ok || fn.NumParams() != 1 {
+			return nil, fmt.Errorf("transform script: %s must be a function of one argument, the preset", name)
+		}
+		s.hooks[name] = fn
+	}
+	if len(s.hooks) == 0 {
+		return nil, fmt.Errorf("transform script defines neither %s nor %s", OnSave, OnRead)
+	}
+	// Frozen globals can be shared by calls running at once
+	globals.Freeze()
+	return s, nil
+}
+
+// Has reports whether the script defines a hook
+func (s *Script) Has(hook string) bool {
+	return s != nil && s.hooks[hook] != nil
+}
+
+// Run calls a hook with a preset and returns the fields it leaves. A hook
+// returns the new fields, or None to keep preset["fields"], which it may
+// have changed in place. A refusal is a *Rejected.
+func (s *Script) Run(hook string, p Preset) (map[string]interface{}, error) {
+	fn := s.hooks[hook]
+	if fn == nil {
+		return p.Fields, nil
+	}
+
+	fields, err := toStarlark(p.Fields)
+	if err != nil {
+		return nil, err
+	}
+	preset := starlark.NewDict(5)
+	for k, v := range map[string]starlark.Value{
+		"name":       starlark.String(p.Name),
+		"scopeType":  starlark.String(p.ScopeType),
+		"scopeValue": starlark.String(p.ScopeValue),
+		"deviceId":   starlark.String(p.DeviceID),
+		"fields":     fields,
+	} {
+		preset.SetKey(starlark.String(k), v)
+	}
+
+	thread := s.thread(hook)
+	timer := time.AfterFunc(s.timeout, func() { thread.Cancel(fmt.Sprintf("timed out after %s", s.timeout)) })
+	defer timer.Stop()
+
+	result, err := starlark.Call(thread, fn, starlark.Tuple{preset}, nil)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	if result == starlark.None {
+		if result, _, err = preset.Get(starlark.String("fields")); err != nil {
+			return nil, err
+		}
+	}
+	out, err := fromStarlark(result)
+	if err != nil {
+		return nil, fmt.Errorf("%s returned %w", hook, err)
+	}
+	m, ok := out.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must return a dict of fields or None, not %s", hook, result.Type())
+	}
+	return m, nil
+}
+
+// thread creates a sandboxed thread: no load(), bounded steps
+func (s *Script) thread(name string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: name,
+		Load: func(*starlark.Thread, string) (starlark.StringDict, error) {
+			return nil, errors.New("load is not allowed in transform scripts")
+		},
+		Print: func(_ *starlark.Thread, msg string) {
+			if s.print != nil {
+				s.print(msg)
+			}
+		},
+	}
+	if s.maxSteps > 0 {
+		thread.SetMaxExecutionSteps(s.maxSteps)
+	}
+	return thread
+}
+
+// scriptError turns a refusal back into a *Rejected, and otherwise puts
+// where in the script it failed on one line
+func scriptError(err error) error {
+	var rejected *Rejected
+	if errors.As(err, &rejected) {
+		return rejected
+	}
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) && len(evalErr.CallStack) > 0 {
+		return fmt.Errorf("%s: %s", evalErr.CallStack.At(0).Pos, evalErr.Msg)
+	}
+	return err
+}
+
+// predeclared are the names scripts get besides Starlark's built-ins
+var predeclared = starlark.StringDict{
+	"fail": starlark.NewBuiltin("fail", builtinFail),
+	"re": &starlarkstruct.Module{
+		Name: "re",
+		Members: starlark.StringDict{
+			"match": starlark.NewBuiltin("re.match", reMatch),
+			"sub":   starlark.NewBuiltin("re.sub", reSub),
+		},
+	},
+}
+
+// builtinFail refuses the preset with a message for the client
+func builtinFail(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msg string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &msg); err != nil {
+		return nil, err
+	}
+	return nil, &Rejected{Reason: msg}
+}
+
+// reMatch reports whether a Go regular expression matches anywhere in s
+func reMatch(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern, s string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &pattern, &s); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.Bool(re.MatchString(s)), nil
+}
+
+// reSub replaces every match of a Go regular expression in s; $1 in repl
+// is the first group
+func reSub(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern, repl, s string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 3, &pattern, &repl, &s); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.String(re.ReplaceAllString(s, repl)), nil
+}
+
+// toStarlark converts a decoded JSON value
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(v), nil
+	case string:
+		return starlark.String(v), nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return starlark.MakeInt64(int64(v)), nil
+		}
+		return starlark.Float(v), nil
+	case int:
+		return starlark.MakeInt(v), nil
+	case int64:
+		return starlark.MakeInt64(v), nil
+	case []interface{}:
+		elems := make([]starlark.Value, len(v))
+		for i, e := range v {
+			sv, err := toStarlark(e)
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = sv
+		}
+		return starlark.NewList(elems), nil
+	case map[string]interface{}:
+		d := starlark.NewDict(len(v))
+		for k, e := range v {
+			sv, err := toStarlark(e)
+			if err != nil {
+				return nil, err
+			}
+			d.SetKey(starlark.String(k), sv)
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("unsupported field value of type %T", v)
+	}
+}
+
+// fromStarlark converts a value back to what JSON decoding would give
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Int:
+		i, ok := v.Int64()
+		if !ok {
+			return nil, fmt.Errorf("an integer too large for a field: %s", v)
+		}
+		return float64(i), nil
+	case starlark.Float:
+		return float64(v), nil
+	case *starlark.List:
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			e, err := fromStarlark(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = e
+		}
+		return out, nil
+	case starlark.Tuple:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			ev, err := fromStarlark(e)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = ev
+		}
+		return out, nil
+	case *starlark.Dict:
+		out := make(map[string]interface{}, v.Len())
+		for _, item := range v.Items() {
+			k, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("a dict with a %s key; field names are strings", item[0].Type())
+			}
+			e, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			out[k] = e
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("a %s, which can't be stored in a field", v.Type())
+	}
+}
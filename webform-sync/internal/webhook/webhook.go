@@ -0,0 +1,151 @@
+// Package webhook delivers events to configured HTTP endpoints.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/tezza1971/webform-sync/internal/config"
+	"github.com/tezza1971/webform-sync/internal/events"
+	"github.com/tezza1971/webform-sync/internal/logger"
+	"github.com/tezza1971/webform-sync/internal/storage"
+)
+
+// Recorder stores the outcome of each delivery
+type Recorder interface {
+	RecordWebhookDelivery(context.Context, *storage.WebhookDelivery) error
+}
+
+// Sink delivers events to one webhook, retrying failed deliveries with
+// exponential backoff and recording each outcome
+type Sink struct {
+	hook        config.WebhookConfig
+	maxAttempts int
+	client      *http.Client
+	recorder    Recorder
+	logger      *logger.Logger
+}
+
+// retryDelay is the wait before the second attempt; it doubles after each
+// failure
+const retryDelay = time.Second
+
+// NewSinks creates a sink for each configured endpoint
+func NewSinks(cfg config.WebhooksConfig, recorder Recorder, log *logger.Logger) []events.Sink {
+	client := &http.Client{Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second}
+
+	sinks := make([]events.Sink, 0, len(cfg.Endpoints))
+	for _, hook := range cfg.Endpoints {
+		sinks = append(sinks, &Sink{
+			hook:        hook,
+			maxAttempts: cfg.MaxAttempts,
+			client:      client,
+			recorder:    recorder,
+			logger:      log,
+		})
+	}
+	return sinks
+}
+
+// Name identifies the sink in logs
+func (s *Sink) Name() string {
+	return "webhook " + s.hook.Name
+}
+
+// Accepts reports whether the webhook subscribes to an event type
+func (s *Sink) Accepts(eventType string) bool {
+	return events.Subscribed(s.hook.Events, eventType)
+}
+
+// Handle posts an event until it succeeds or attempts run out
+func (s *Sink) Handle(ctx context.Context, e events.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	delivery := &storage.WebhookDelivery{
+		Webhook:   s.hook.Name,
+		Event:     e.Type,
+		EventID:   e.ID,
+		CreatedAt: time.Now(),
+	}
+	defer s.record(delivery)
+
+	delay := retryDelay
+	for delivery.Attempts < s.maxAttempts {
+		if delivery.Attempts > 0 {
+			select {
+			case <-time.After(delay):
+				delay *= 2
+			case <-ctx.Done():
+				delivery.Error = "abandoned on shutdown: " + delivery.Error
+				return fmt.Errorf("%s", delivery.Error)
+			}
+		}
+		delivery.Attempts++
+
+		status, err := s.post(ctx, e, body)
+		delivery.StatusCode = status
+		if err == nil {
+			delivery.Success = true
+			delivery.Error = ""
+			return nil
+		}
+		delivery.Error = err.Error()
+		s.logger.Debug("Webhook %s attempt %d for %s failed: %v", s.hook.Name, delivery.Attempts, e.Type, err)
+	}
+
+	return fmt.Errorf("gave up after %d attempts: %s", delivery.Attempts, delivery.Error)
+}
+
+// post makes one delivery attempt; any 2xx response is a success
+func (s *Sink) post(ctx context.Context, e events.Event, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "webform-sync-webhook/1.0")
+	req.Header.Set("X-Webhook-Event", e.Type)
+	req.Header.Set("X-Webhook-ID", e.ID)
+	if s.hook.Secret != "" {
+		req.Header.Set("X-Webhook-Signature", "sha256="+Sign(s.hook.Secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// record stores a finished delivery in the log. It doesn't use the bus
+// context, so deliveries abandoned on shutdown are still recorded.
+func (s *Sink) record(delivery *storage.WebhookDelivery) {
+	delivery.CompletedAt = time.Now()
+	if err := s.recorder.RecordWebhookDelivery(context.Background(), delivery); err != nil {
+		s.logger.Error("Failed to record webhook delivery: %v", err)
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 of body, as sent in X-Webhook-Signature
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,275 @@
+// Package plugin is the interface for extending webform-sync without
+// forking it: authentication providers, notification sinks, backup stores
+// and storage backends for presets.
+//
+// An extension registers a factory for what it provides from an init
+// function, the way a database/sql driver does:
+//
+//	func init() {
+//		plugin.RegisterNotifier("slack", newSlack)
+//	}
+//
+// It is then either built into a custom binary with a blank import of its
+// package, or built with -buildmode=plugin and listed under plugins.files
+// in webform-sync.yml. The config names the extension where it is used and
+// gives it settings, which are passed to the factory.
+//
+// The types here only change in ways that keep extensions compiling.
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Settings are an extension's settings from webform-sync.yml, as decoded
+// from YAML
+type Settings map[string]interface{}
+
+// ErrInvalidCredentials is returned by an AuthProvider for credentials it
+// turns down. Failures count towards authentication.lockout.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrPresetNotFound is returned by a StorageBackend for a preset it doesn't
+// have
+var ErrPresetNotFound = errors.New("preset not found")
+
+// ErrPresetModified is returned by a StorageBackend for a conditional put
+// of a preset whose stored version has moved on
+var ErrPresetModified = errors.New("preset has been modified")
+
+// Credentials are what a client sent to authenticate
+type Credentials struct {
+	// Token is from the Authorization header without its "Bearer " prefix,
+	// or from the token query parameter
+	Token string
+	// Username and Password are from HTTP basic auth. WebDAV clients send
+	// tokens as the password.
+	Username string
+	Password string
+	// RemoteAddr is the client's address, after trusted proxies
+	RemoteAddr string
+	// Header holds the request headers, for schemes of the provider's own
+	Header http.Header
+}
+
+// Identity is who an AuthProvider recognised
+type Identity struct {
+	// UserID is the webform-sync user the client acts as, limiting it to
+	// that user's devices and presets. Empty means an administrator, with
+	// the same access as authentication.api_token.
+	UserID string
+}
+
+// AuthProvider authenticates API requests when authentication.type is
+// plugin
+type AuthProvider interface {
+	// Authenticate checks a request's credentials. It returns
+	// ErrInvalidCredentials for credentials it turns down, which includes
+	// none at all; other errors answer the request with 503.
+	Authenticate(ctx context.Context, creds Credentials) (Identity, error)
+}
+
+// Event is something that happened in the service, as sent to webhooks
+type Event struct {
+	ID   string
+	Type string
+	Time time.Time
+	// Tenant is the tenant's ID, or empty for the default tenant
+	Tenant string
+	// Data is the event's JSON payload, as documented in docs/API.md
+	Data json.RawMessage
+}
+
+// Notifier receives events when listed under notifications.plugins
+type Notifier interface {
+	// Accepts reports whether the notifier wants an event type
+	Accepts(eventType string) bool
+	// Notify delivers an event. It is called on a goroutine of its own,
+	// so calls may overlap, and ctx is cancelled on shutdown. Errors are
+	// logged; the event is not sent again.
+	Notify(ctx context.Context, e Event) error
+}
+
+// BackupStore is somewhere backups are copied to, as a backup remote of
+// type plugin. Backups reach it encrypted.
+type BackupStore interface {
+	// Put stores size bytes from r as the file name, replacing it if it
+	// exists
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// List returns the names of the files stored
+	List(ctx context.Context) ([]string, error)
+	// Delete removes a file, and succeeds if it is already gone
+	Delete(ctx context.Context, name string) error
+}
+
+// Preset is a form preset as a StorageBackend keeps it
+type Preset struct {
+	ID string
+	// DeviceID is the device owning the preset; empty for presets shared
+	// between the devices of UserID
+	DeviceID string
+	// UserID is the user owning DeviceID, or empty
+	UserID     string
+	Name       string
+	ScopeType  string
+	ScopeValue string
+	// Fields are the field values as a JSON object, or as the device
+	// encrypted them
+	Fields    string
+	Encrypted bool
+	// Metadata is a JSON object, or nil
+	Metadata  json.RawMessage
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	LastUsed  *time.Time
+	UseCount  int
+	// Version counts content changes, starting at 1
+	Version int
+}
+
+// StorageBackend keeps presets in place of the SQLite database, when named
+// by storage.backend. Devices, users and everything else stay in SQLite.
+type StorageBackend interface {
+	// Get returns a preset by ID, or ErrPresetNotFound
+	Get(ctx context.Context, id string) (*Preset, error)
+	// List returns a device's presets; an empty deviceID lists the
+	// presets with no device
+	List(ctx context.Context, deviceID string) ([]*Preset, error)
+	// Put stores a preset, replacing the one with its ID. A version other
+	// than 0 makes it conditional: it fails with ErrPresetModified unless
+	// the stored preset is still at that version, checked atomically with
+	// the write.
+	Put(ctx context.Context, preset *Preset, version int) error
+	// Delete removes a preset, and succeeds if it is already gone
+	Delete(ctx context.Context, id string) error
+}
+
+// Factories create an extension from its settings. A backup store is also
+// given the folder to keep its files in, and a storage backend the
+// namespace to keep its presets in, which differ between tenants and are
+// empty for the default one.
+type (
+	AuthProviderFactory   func(settings Settings) (AuthProvider, error)
+	NotifierFactory       func(settings Settings) (Notifier, error)
+	BackupStoreFactory    func(settings Settings, folder string) (BackupStore, error)
+	StorageBackendFactory func(settings Settings, namespace string) (StorageBackend, error)
+)
+
+var (
+	mu              sync.RWMutex
+	authProviders   = map[string]AuthProviderFactory{}
+	notifiers       = map[string]NotifierFactory{}
+	backupStores    = map[string]BackupStoreFactory{}
+	storageBackends = map[string]StorageBackendFactory{}
+)
+
+// register adds a factory under a name, which it panics if already taken
+func register[F any](factories map[string]F, kind, name string, factory F) {
+	mu.Lock()
+	defer mu.Unlock()
+	if name == "" {
+		panic("plugin: " + kind + " registered without a name")
+	}
+	if _, dup := factories[name]; dup {
+		panic("plugin: " + kind + " " + name + " registered twice")
+	}
+	factories[name] = factory
+}
+
+// lookup finds a registered factory
+func lookup[F any](factories map[string]F, kind, name string) (F, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	factory, ok := factories[name]
+	if !ok {
+		return factory, fmt.Errorf("no %s named %q is registered; is its plugin in plugins.files?", kind, name)
+	}
+	return factory, nil
+}
+
+// RegisterAuthProvider makes an authentication provider available by name
+func RegisterAuthProvider(name string, factory AuthProviderFactory) {
+	register(authProviders, "auth provider", name, factory)
+}
+
+// RegisterNotifier makes a notification sink available by name
+func RegisterNotifier(name string, factory NotifierFactory) {
+	register(notifiers, "notifier", name, factory)
+}
+
+// RegisterBackupStore makes a backup store available by name
+func RegisterBackupStore(name string, factory BackupStoreFactory) {
+	register(backupStores, "backup store", name, factory)
+}
+
+// RegisterStorageBackend makes a storage backend available by name
+func RegisterStorageBackend(name string, factory StorageBackendFactory) {
+	register(storageBackends, "storage backend", name, factory)
+}
+
+// NewAuthProvider creates the authentication provider registered as name
+func NewAuthProvider(name string, settings Settings) (AuthProvider, error) {
+	factory, err := lookup(authProviders, "auth provider", name)
+	if err != nil {
+		return nil, err
+	}
+	return factory(settings)
+}
+
+// NewNotifier creates the notification sink registered as name
+func NewNotifier(name string, settings Settings) (Notifier, error) {
+	factory, err := lookup(notifiers, "notifier", name)
+	if err != nil {
+		return nil, err
+	}
+	return factory(settings)
+}
+
+// NewBackupStore creates the backup store registered as name, keeping its
+// files in folder
+func NewBackupStore(name string, settings Settings, folder string) (BackupStore, error) {
+	factory, err := lookup(backupStores, "backup store", name)
+	if err != nil {
+		return nil, err
+	}
+	return factory(settings, folder)
+}
+
+// NewStorageBackend creates the storage backend registered as name,
+// keeping its presets in namespace
+func NewStorageBackend(name string, settings Settings, namespace string) (StorageBackend, error) {
+	factory, err := lookup(storageBackends, "storage backend", name)
+	if err != nil {
+		return nil, err
+	}
+	return factory(settings, namespace)
+}
+
+// Registered lists the names of everything registered, by kind, for logs
+func Registered() map[string][]string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return map[string][]string{
+		"auth providers":   names(authProviders),
+		"notifiers":        names(notifiers),
+		"backup stores":    names(backupStores),
+		"storage backends": names(storageBackends),
+	}
+}
+
+func names[F any](factories map[string]F) []string {
+	list := make([]string, 0, len(factories))
+	for name := range factories {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}